@@ -0,0 +1,237 @@
+//! What is happening across the server, for the activity page: branches and
+//! tags pushed, from each repository's events; repositories created or
+//! imported and releases published, from the audit log; and issues and pull
+//! requests opened, commented on, closed and merged.
+//!
+//! Nothing is stored for it; each source is read again when the page is
+//! shown, as far back as it asks for.
+
+use crate::audit::{self, Action};
+use crate::{events, issues, pulls, releases};
+use std::path::{Path, PathBuf};
+
+/// Audit entries read for each kind of action looked for
+const AUDIT_ENTRIES: usize = 1000;
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum Kind {
+    Push,
+    Tag,
+    Repository,
+    Release,
+    Issue,
+    Pull,
+}
+
+impl Kind {
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::Push => "push",
+            Self::Tag => "tag",
+            Self::Repository => "repository",
+            Self::Release => "release",
+            Self::Issue => "issue",
+            Self::Pull => "pull",
+        }
+    }
+}
+
+/// Something that happened in a repository
+#[derive(Clone, Debug)]
+pub struct Item {
+    /// Unix time
+    pub time: i64,
+    pub repo: String,
+    pub kind: Kind,
+    /// Who did it, if known
+    pub actor: Option<String>,
+    /// What happened, e.g. "opened issue #3: Crash on start"
+    pub summary: String,
+    /// The repository's page about it, below `/repo/<name>/`, e.g.
+    /// `issues/3`; empty for the repository page
+    pub page: String,
+}
+
+/// Up to `limit` items from `repos`, named as the audit log names them,
+/// since a unix time, newest first
+pub fn collect(
+    data_dir: &Path,
+    repos: &[(String, PathBuf)],
+    since: i64,
+    limit: usize,
+) -> Vec<Item> {
+    let mut items = Vec::new();
+    for (repo, repo_path) in repos {
+        items.extend(ref_updates(repo, repo_path, since, limit));
+        items.extend(issue_items(repo, repo_path, since));
+        items.extend(pull_items(repo, repo_path, since));
+    }
+    items.extend(audit_items(data_dir, repos, since));
+
+    items.sort_by(|a, b| b.time.cmp(&a.time));
+    items.truncate(limit);
+    items
+}
+
+fn item(time: i64, repo: &str, kind: Kind, actor: Option<&str>, summary: String) -> Item {
+    Item {
+        time,
+        repo: repo.to_string(),
+        kind,
+        actor: actor.map(str::to_string),
+        summary,
+        page: String::new(),
+    }
+}
+
+fn ref_updates(repo: &str, repo_path: &Path, since: i64, limit: usize) -> Vec<Item> {
+    events::recent(repo_path, None, limit)
+        .into_iter()
+        .filter(|event| event.time >= since)
+        .filter(|event| event.is_tag() || event.refname.starts_with("refs/heads/"))
+        .map(|event| {
+            let (kind, noun) = if event.is_tag() {
+                (Kind::Tag, "tag")
+            } else {
+                (Kind::Push, "branch")
+            };
+            let summary = if event.created() {
+                format!("pushed new {} {}", noun, event.short_name())
+            } else if event.deleted() {
+                format!("deleted {} {}", noun, event.short_name())
+            } else {
+                format!("pushed to {} {}", noun, event.short_name())
+            };
+            let mut item = item(event.time, repo, kind, event.pusher.as_deref(), summary);
+            item.page = match (event.is_tag(), event.deleted()) {
+                (_, true) => String::new(),
+                (true, false) => format!("tag/{}", event.short_name()),
+                (false, false) => format!("log/{}", event.short_name()),
+            };
+            item
+        })
+        .collect()
+}
+
+fn issue_items(repo: &str, repo_path: &Path, since: i64) -> Vec<Item> {
+    let mut items = Vec::new();
+    let all = issues::list(repo_path, &issues::Filter::default()).unwrap_or_default();
+    for issue in all.iter().filter(|issue| issue.updated >= since) {
+        let page = format!("issues/{}", issue.number);
+        let what = format!("issue #{}: {}", issue.number, issue.title);
+        let mut push = |time: i64, actor: &str, summary: String| {
+            if time >= since {
+                let mut item = item(time, repo, Kind::Issue, Some(actor), summary);
+                item.page = page.clone();
+                items.push(item);
+            }
+        };
+        push(issue.created, &issue.author, format!("opened {}", what));
+        for comment in &issue.comments {
+            push(
+                comment.created,
+                &comment.author,
+                format!("commented on {}", what),
+            );
+        }
+        // Only the last change is dated; closing is taken to be it
+        if let Some(closed_by) = &issue.closed_by {
+            push(issue.updated, closed_by, format!("closed {}", what));
+        }
+    }
+    items
+}
+
+fn pull_items(repo: &str, repo_path: &Path, since: i64) -> Vec<Item> {
+    let mut items = Vec::new();
+    for pull in pulls::list(repo_path, None).unwrap_or_default() {
+        if pull.updated < since {
+            continue;
+        }
+        let page = format!("pulls/{}", pull.number);
+        let what = format!("pull request #{}: {}", pull.number, pull.title);
+        let mut push = |time: i64, actor: Option<&str>, summary: String| {
+            if time >= since {
+                let mut item = item(time, repo, Kind::Pull, actor, summary);
+                item.page = page.clone();
+                items.push(item);
+            }
+        };
+        push(pull.created, Some(&pull.author), format!("opened {}", what));
+        for comment in &pull.comments {
+            push(
+                comment.created,
+                Some(&comment.author),
+                format!("commented on {}", what),
+            );
+        }
+        if let Some(merged) = &pull.merged {
+            push(
+                merged.time,
+                merged.by.as_deref(),
+                format!("merged {}", what),
+            );
+        } else if let Some(closed_by) = &pull.closed_by {
+            push(pull.updated, Some(closed_by), format!("closed {}", what));
+        }
+    }
+    items
+}
+
+fn audit_items(data_dir: &Path, repos: &[(String, PathBuf)], since: i64) -> Vec<Item> {
+    let mut items = Vec::new();
+    for action in [
+        Action::RepoCreate,
+        Action::RepoImport,
+        Action::ReleaseChange,
+    ] {
+        let filter = audit::Filter {
+            action: Some(action),
+            ..Default::default()
+        };
+        for entry in audit::query(data_dir, &filter, AUDIT_ENTRIES).unwrap_or_default() {
+            if entry.time < since {
+                break;
+            }
+            let (repo, repo_path) = match entry
+                .repo
+                .as_deref()
+                .and_then(|repo| repos.iter().find(|(name, _)| name == repo))
+            {
+                Some(found) => found,
+                None => continue,
+            };
+            let (kind, summary, page) = match action {
+                Action::RepoCreate => (
+                    Kind::Repository,
+                    "created the repository".to_string(),
+                    String::new(),
+                ),
+                Action::RepoImport => (
+                    Kind::Repository,
+                    "imported the repository".to_string(),
+                    String::new(),
+                ),
+                // Only publishing is news, and only of releases still out of
+                // draft
+                _ if entry.detail == "published" => {
+                    let tag = entry.target.clone().unwrap_or_default();
+                    match releases::get(repo_path, &tag) {
+                        Ok(Some(release)) if !release.draft => {}
+                        _ => continue,
+                    }
+                    (
+                        Kind::Release,
+                        format!("published release {}", tag),
+                        format!("releases/tag/{}", tag),
+                    )
+                }
+                _ => continue,
+            };
+            let mut item = item(entry.time, repo, kind, entry.actor.as_deref(), summary);
+            item.page = page;
+            items.push(item);
+        }
+    }
+    items
+}
@@ -0,0 +1,45 @@
+//! Archived repositories: finished projects that stay readable but take no
+//! more changes.
+//!
+//! An archived repository has `agito.archived = true` in its git config.
+//! Pushes, server-side merges and new pull requests are refused, pull mirrors
+//! stop fetching, and repository listings leave it out unless asked to show
+//! archived repositories.
+
+use crate::git;
+use anyhow::Result;
+use std::path::Path;
+
+const CONFIG_KEY: &str = "agito.archived";
+
+pub fn is_archived(repo_path: &Path) -> bool {
+    git::config_get(repo_path, CONFIG_KEY).as_deref() == Some("true")
+}
+
+/// Archive a repository, or make it writable again
+pub fn set(repo_path: &Path, archived: bool) -> Result<()> {
+    let output = if archived {
+        git::run(repo_path, &["config", CONFIG_KEY, "true"])?
+    } else {
+        if git::config_get(repo_path, CONFIG_KEY).is_none() {
+            return Ok(());
+        }
+        git::run(repo_path, &["config", "--unset-all", CONFIG_KEY])?
+    };
+    if !output.status.success() {
+        anyhow::bail!(
+            "Failed to update {}: {}",
+            CONFIG_KEY,
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(())
+}
+
+/// Why a change to an archived repository is refused
+pub fn refusal(repo: &str) -> String {
+    format!(
+        "{} is archived and read-only; its admins can unarchive it to allow changes",
+        repo
+    )
+}
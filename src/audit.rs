@@ -0,0 +1,368 @@
+//! The server-wide audit log: administrative and security-relevant events,
+//! such as repositories created, keys and tokens added or removed, access
+//! changes, failed sign-ins and force pushes.
+//!
+//! Entries are appended to `<data_dir>/audit.jsonl`, one JSON object per
+//! line, and the file is never rewritten; rotate or archive it externally if
+//! it grows too large. An entry's ID is its line number. Every entry is also
+//! logged, so it reaches the server's log pipeline as well.
+
+use crate::{git, merge};
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::fmt;
+use std::fs::{self, OpenOptions};
+use std::io::{self, Write};
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+
+/// What happened
+#[derive(Clone, Copy, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub enum Action {
+    #[serde(rename = "repo.create")]
+    RepoCreate,
+    #[serde(rename = "repo.import")]
+    RepoImport,
+    #[serde(rename = "repo.rename")]
+    RepoRename,
+    /// A repository was archived or unarchived
+    #[serde(rename = "repo.archive")]
+    RepoArchive,
+    /// A repository's visibility or collaborators changed
+    #[serde(rename = "repo.access")]
+    RepoAccess,
+    /// A repository's default branch changed
+    #[serde(rename = "repo.settings")]
+    RepoSettings,
+    /// A repository was moved to the trash, or purged from it
+    #[serde(rename = "repo.delete")]
+    RepoDelete,
+    /// A deleted repository was restored from the trash
+    #[serde(rename = "repo.restore")]
+    RepoRestore,
+    #[serde(rename = "key.add")]
+    KeyAdd,
+    #[serde(rename = "key.remove")]
+    KeyRemove,
+    #[serde(rename = "deploy_key.add")]
+    DeployKeyAdd,
+    #[serde(rename = "deploy_key.remove")]
+    DeployKeyRemove,
+    #[serde(rename = "token.create")]
+    TokenCreate,
+    #[serde(rename = "token.revoke")]
+    TokenRevoke,
+    /// An account was created, approved, disabled, or made or unmade admin
+    #[serde(rename = "account.change")]
+    AccountChange,
+    /// Organization members, teams or grants changed
+    #[serde(rename = "org.change")]
+    OrgChange,
+    #[serde(rename = "protection.change")]
+    ProtectionChange,
+    #[serde(rename = "webhook.change")]
+    WebhookChange,
+    /// A mirror was added or removed, or its credentials changed
+    #[serde(rename = "mirror.change")]
+    MirrorChange,
+    /// A release was published, edited or removed, or one of its assets
+    /// uploaded or removed
+    #[serde(rename = "release.change")]
+    ReleaseChange,
+    #[serde(rename = "auth.failure")]
+    AuthFailure,
+    #[serde(rename = "push.force")]
+    ForcePush,
+}
+
+impl Action {
+    pub const ALL: [Action; 22] = [
+        Action::RepoCreate,
+        Action::RepoImport,
+        Action::RepoRename,
+        Action::RepoArchive,
+        Action::RepoAccess,
+        Action::RepoSettings,
+        Action::RepoDelete,
+        Action::RepoRestore,
+        Action::KeyAdd,
+        Action::KeyRemove,
+        Action::DeployKeyAdd,
+        Action::DeployKeyRemove,
+        Action::TokenCreate,
+        Action::TokenRevoke,
+        Action::AccountChange,
+        Action::OrgChange,
+        Action::ProtectionChange,
+        Action::WebhookChange,
+        Action::MirrorChange,
+        Action::ReleaseChange,
+        Action::AuthFailure,
+        Action::ForcePush,
+    ];
+
+    pub fn name(self) -> &'static str {
+        match self {
+            Action::RepoCreate => "repo.create",
+            Action::RepoImport => "repo.import",
+            Action::RepoRename => "repo.rename",
+            Action::RepoArchive => "repo.archive",
+            Action::RepoAccess => "repo.access",
+            Action::RepoSettings => "repo.settings",
+            Action::RepoDelete => "repo.delete",
+            Action::RepoRestore => "repo.restore",
+            Action::KeyAdd => "key.add",
+            Action::KeyRemove => "key.remove",
+            Action::DeployKeyAdd => "deploy_key.add",
+            Action::DeployKeyRemove => "deploy_key.remove",
+            Action::TokenCreate => "token.create",
+            Action::TokenRevoke => "token.revoke",
+            Action::AccountChange => "account.change",
+            Action::OrgChange => "org.change",
+            Action::ProtectionChange => "protection.change",
+            Action::WebhookChange => "webhook.change",
+            Action::MirrorChange => "mirror.change",
+            Action::ReleaseChange => "release.change",
+            Action::AuthFailure => "auth.failure",
+            Action::ForcePush => "push.force",
+        }
+    }
+}
+
+impl FromStr for Action {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        Action::ALL
+            .into_iter()
+            .find(|action| action.name() == s)
+            .ok_or_else(|| {
+                format!(
+                    "Unknown audit action '{}' (expected one of: {})",
+                    s,
+                    Action::ALL.map(Action::name).join(", ")
+                )
+            })
+    }
+}
+
+impl fmt::Display for Action {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(self.name())
+    }
+}
+
+/// Where the event came from
+#[derive(Clone, Copy, Debug, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Via {
+    Web,
+    Ssh,
+    /// `agito-admin`, run on the server
+    Cli,
+    /// A git hook, during a push
+    Hook,
+}
+
+impl Via {
+    pub fn name(self) -> &'static str {
+        match self {
+            Via::Web => "web",
+            Via::Ssh => "ssh",
+            Via::Cli => "cli",
+            Via::Hook => "hook",
+        }
+    }
+}
+
+/// One event in the audit log
+#[derive(Clone, Debug, Serialize, Deserialize)]
+pub struct Entry {
+    /// Line number in the log, counting from 1; not stored, only set on
+    /// entries read back
+    #[serde(default, skip_serializing_if = "is_unset")]
+    pub id: u64,
+    /// Unix time of the event
+    pub time: i64,
+    pub action: Action,
+    pub via: Via,
+    /// Who did it, if known; for failed sign-ins, who they claimed to be
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub actor: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub repo: Option<String>,
+    /// What was acted on, e.g. a user, key fingerprint, token or ref
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub target: Option<String>,
+    /// Free-form description of the change
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub detail: String,
+    /// Client address, where the event came over the network
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub remote: Option<String>,
+}
+
+fn is_unset(id: &u64) -> bool {
+    *id == 0
+}
+
+impl Entry {
+    pub fn new(action: Action, via: Via, actor: Option<&str>) -> Self {
+        Entry {
+            id: 0,
+            time: chrono::Utc::now().timestamp(),
+            action,
+            via,
+            actor: actor.map(str::to_string),
+            repo: None,
+            target: None,
+            detail: String::new(),
+            remote: None,
+        }
+    }
+
+    pub fn with_repo(mut self, repo: &str) -> Self {
+        self.repo = Some(repo.to_string());
+        self
+    }
+
+    pub fn with_target(mut self, target: &str) -> Self {
+        self.target = Some(target.to_string());
+        self
+    }
+
+    pub fn with_detail(mut self, detail: impl Into<String>) -> Self {
+        self.detail = detail.into();
+        self
+    }
+
+    pub fn with_remote(mut self, remote: Option<String>) -> Self {
+        self.remote = remote;
+        self
+    }
+
+    /// Append the entry to the log. Failing to write it is logged rather than
+    /// returned, so it never undoes the change it describes.
+    pub fn record(self, data_dir: &Path) {
+        tracing::info!(
+            action = self.action.name(),
+            via = self.via.name(),
+            actor = self.actor.as_deref().unwrap_or("-"),
+            repo = self.repo.as_deref().unwrap_or("-"),
+            target = self.target.as_deref().unwrap_or("-"),
+            remote = self.remote.as_deref().unwrap_or("-"),
+            "Audit: {}",
+            self.detail
+        );
+        if let Err(e) = append(data_dir, &self) {
+            tracing::error!("Failed to write the audit log: {:#}", e);
+        }
+    }
+}
+
+fn audit_path(data_dir: &Path) -> PathBuf {
+    data_dir.join("audit.jsonl")
+}
+
+fn append(data_dir: &Path, entry: &Entry) -> Result<()> {
+    fs::create_dir_all(data_dir)?;
+    let mut line = serde_json::to_string(entry)?;
+    line.push('\n');
+    // One write per entry, so concurrent writers can't interleave lines
+    OpenOptions::new()
+        .create(true)
+        .append(true)
+        .open(audit_path(data_dir))?
+        .write_all(line.as_bytes())?;
+    Ok(())
+}
+
+/// Which entries to return from [`query`]; unset fields match everything
+#[derive(Clone, Debug, Default)]
+pub struct Filter {
+    pub action: Option<Action>,
+    pub actor: Option<String>,
+    pub repo: Option<String>,
+    /// Only entries with a lower ID, for paging back through the log
+    pub before: Option<u64>,
+}
+
+impl Filter {
+    fn matches(&self, entry: &Entry) -> bool {
+        self.action.map_or(true, |action| entry.action == action)
+            && self
+                .actor
+                .as_ref()
+                .map_or(true, |actor| entry.actor.as_ref() == Some(actor))
+            && self
+                .repo
+                .as_ref()
+                .map_or(true, |repo| entry.repo.as_ref() == Some(repo))
+            && self.before.map_or(true, |before| entry.id < before)
+    }
+}
+
+/// Up to `limit` entries matching the filter, newest first. Lines that can't
+/// be parsed are skipped.
+pub fn query(data_dir: &Path, filter: &Filter, limit: usize) -> Result<Vec<Entry>> {
+    let path = audit_path(data_dir);
+    let content = match fs::read_to_string(&path) {
+        Ok(content) => content,
+        Err(e) if e.kind() == io::ErrorKind::NotFound => return Ok(Vec::new()),
+        Err(e) => return Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    };
+    let mut entries: Vec<Entry> = content
+        .lines()
+        .enumerate()
+        .filter_map(|(index, line)| {
+            let mut entry: Entry = serde_json::from_str(line).ok()?;
+            entry.id = index as u64 + 1;
+            Some(entry)
+        })
+        .filter(|entry| filter.matches(entry))
+        .collect();
+    entries.reverse();
+    entries.truncate(limit);
+    Ok(entries)
+}
+
+/// `SHA256:<base64>` fingerprint of an SSH public key line, to name keys in
+/// entries; the key's type and comment if it can't be parsed
+pub fn key_fingerprint(line: &str) -> String {
+    let mut fields = line.split_whitespace();
+    let (kind, data) = (fields.next().unwrap_or(""), fields.next().unwrap_or(""));
+    match russh_keys::parse_public_key_base64(data) {
+        Ok(key) => format!("SHA256:{}", key.fingerprint()),
+        Err(_) => format!("{} {}", kind, fields.next().unwrap_or(""))
+            .trim()
+            .to_string(),
+    }
+}
+
+/// Record the ref updates of a push, given as (old, new, refname), that
+/// rewrote history: the ref existed before and after, and its new commit
+/// doesn't contain the old one
+pub fn record_force_pushes(
+    data_dir: &Path,
+    repo: &str,
+    repo_path: &Path,
+    updates: &[(String, String, String)],
+    pusher: Option<&str>,
+) {
+    for (old, new, refname) in updates {
+        if git::is_zero(old) || git::is_zero(new) {
+            continue;
+        }
+        if let Ok(false) = merge::is_ancestor(repo_path, old, new) {
+            Entry::new(Action::ForcePush, Via::Hook, pusher)
+                .with_repo(repo)
+                .with_target(refname)
+                .with_detail(format!(
+                    "{} -> {}",
+                    &old[..old.len().min(12)],
+                    &new[..new.len().min(12)]
+                ))
+                .record(data_dir);
+        }
+    }
+}
@@ -0,0 +1,371 @@
+//! Backups of the whole server: every repository, the data directory, the
+//! SSH keys and the hook templates, in one tar archive.
+//!
+//! Refs and objects are saved as a git bundle per repository, which is
+//! consistent even while pushes are coming in; everything else in the
+//! repository (config, HEAD, custom hooks, LFS objects, agito's own data) is
+//! copied as is. Restoring recreates each repository from its bundle and
+//! installs the hooks again.
+//!
+//! ```text
+//! manifest.json
+//! repos/<name>/repo.bundle
+//! repos/<name>/files/...
+//! data/...
+//! ssh/host_key, ssh/host_key.pub, ssh/host_key_<type>[.pub], ssh/authorized_keys
+//! hook-templates/...
+//! ```
+
+use crate::host_keys::{self, KeyType};
+use crate::{git, hooks};
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+
+/// Version of the archive layout, bumped when restoring needs to tell apart
+/// archives written differently
+const FORMAT: u32 = 1;
+
+/// Repository contents saved in the bundle, or rebuilt by git, rather than
+/// copied
+const NOT_COPIED: &[&str] = &["objects", "refs", "packed-refs", "logs", "FETCH_HEAD"];
+
+/// Where the server keeps what is backed up
+#[derive(Clone, Debug, Default)]
+pub struct Paths {
+    pub repos_dir: PathBuf,
+    pub data_dir: PathBuf,
+    pub ssh_key: PathBuf,
+    pub authorized_keys: PathBuf,
+    /// Directory given as `--hook-templates`, if any
+    pub hook_templates: Option<PathBuf>,
+}
+
+/// Contents of `manifest.json`
+#[derive(Debug, Serialize, Deserialize)]
+struct Manifest {
+    format: u32,
+    /// Unix time the backup was taken
+    created: i64,
+    repos: Vec<RepoEntry>,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+struct RepoEntry {
+    name: String,
+    /// Whether it has any refs; git cannot bundle an empty repository
+    empty: bool,
+}
+
+/// What a backup or restore did
+#[derive(Debug, Default)]
+pub struct Summary {
+    /// Repositories backed up or restored
+    pub repos: usize,
+    /// Things left alone, and why: repositories that could not be read, or
+    /// that already exist when restoring
+    pub skipped: Vec<String>,
+}
+
+/// Write a backup of the server to `out`, compressed according to its
+/// extension (e.g. `.tar.zst` or `.tar.gz`)
+pub fn backup(paths: &Paths, out: &Path) -> Result<Summary> {
+    let staging = sibling(out, "staging");
+    if staging.exists() {
+        fs::remove_dir_all(&staging)?;
+    }
+    let result = stage(paths, &staging).and_then(|summary| {
+        let partial = sibling(out, "partial");
+        tar(&[
+            "--auto-compress",
+            "-cf",
+            &partial.to_string_lossy(),
+            "-C",
+            &staging.to_string_lossy(),
+            ".",
+        ])?;
+        fs::rename(&partial, out)?;
+        Ok(summary)
+    });
+    let _ = fs::remove_dir_all(&staging);
+    result
+}
+
+/// Collect everything to back up in `staging`
+fn stage(paths: &Paths, staging: &Path) -> Result<Summary> {
+    let mut summary = Summary::default();
+    let mut manifest = Manifest {
+        format: FORMAT,
+        created: chrono::Utc::now().timestamp(),
+        repos: Vec::new(),
+    };
+
+    for (name, repo_path) in git::find_repositories(&paths.repos_dir)? {
+        let dir = staging.join("repos").join(&name);
+        match stage_repo(&repo_path, &dir) {
+            Ok(empty) => {
+                manifest.repos.push(RepoEntry { name, empty });
+                summary.repos += 1;
+            }
+            Err(e) => {
+                let _ = fs::remove_dir_all(&dir);
+                summary.skipped.push(format!("{}: {:#}", name, e));
+            }
+        }
+    }
+
+    copy_tree(&paths.data_dir, &staging.join("data"))?;
+    let ssh = staging.join("ssh");
+    fs::create_dir_all(&ssh)?;
+    for (name, file) in ssh_files(paths) {
+        if file.is_file() {
+            fs::copy(&file, ssh.join(name))?;
+        }
+    }
+    if let Some(templates) = &paths.hook_templates {
+        copy_tree(templates, &staging.join("hook-templates"))?;
+    }
+
+    fs::write(
+        staging.join("manifest.json"),
+        serde_json::to_string_pretty(&manifest)?,
+    )?;
+    Ok(summary)
+}
+
+/// Bundle a repository's refs and copy the rest of it into `dir`. Returns
+/// whether the repository is empty.
+fn stage_repo(repo_path: &Path, dir: &Path) -> Result<bool> {
+    fs::create_dir_all(dir)?;
+    let refs = git::run(repo_path, &["for-each-ref", "--count=1"])?;
+    let empty = refs.stdout.is_empty();
+    if !empty {
+        let bundle = dir.join("repo.bundle");
+        let output = git::run(
+            repo_path,
+            &["bundle", "create", &bundle.to_string_lossy(), "--all"],
+        )?;
+        if !output.status.success() {
+            anyhow::bail!(
+                "git bundle failed: {}",
+                String::from_utf8_lossy(&output.stderr).trim()
+            );
+        }
+    }
+
+    let files = dir.join("files");
+    fs::create_dir_all(&files)?;
+    for entry in fs::read_dir(repo_path)? {
+        let entry = entry?;
+        let name = entry.file_name().to_string_lossy().to_string();
+        if NOT_COPIED.contains(&name.as_str()) || name.ends_with(".lock") {
+            continue;
+        }
+        copy_tree(&entry.path(), &files.join(&name))?;
+    }
+    let _ = fs::remove_dir_all(files.join("lfs").join("tmp"));
+    Ok(empty)
+}
+
+/// Recreate the server from a backup. Repositories and files that already
+/// exist are left alone, so a restore never overwrites newer data.
+pub fn restore(paths: &Paths, archive: &Path, templates: &hooks::Templates) -> Result<Summary> {
+    fs::create_dir_all(&paths.repos_dir)?;
+    let staging = paths.repos_dir.join(".restore");
+    if staging.exists() {
+        fs::remove_dir_all(&staging)?;
+    }
+    fs::create_dir_all(&staging)?;
+    let result = tar(&[
+        "-xf",
+        &archive.to_string_lossy(),
+        "-C",
+        &staging.to_string_lossy(),
+    ])
+    .and_then(|()| unstage(paths, &staging, templates));
+    let _ = fs::remove_dir_all(&staging);
+    result
+}
+
+/// Put everything extracted into `staging` in its place
+fn unstage(paths: &Paths, staging: &Path, templates: &hooks::Templates) -> Result<Summary> {
+    let manifest_path = staging.join("manifest.json");
+    let manifest: Manifest = serde_json::from_str(
+        &fs::read_to_string(&manifest_path).context("Not an agito backup: no manifest.json")?,
+    )
+    .context("Failed to parse manifest.json")?;
+    if manifest.format > FORMAT {
+        anyhow::bail!(
+            "The backup was written by a newer agito (format {}); upgrade to restore it",
+            manifest.format
+        );
+    }
+
+    let mut summary = Summary::default();
+    for repo in &manifest.repos {
+        let target = paths.repos_dir.join(&repo.name);
+        if repo
+            .name
+            .split('/')
+            .any(|part| matches!(part, "" | "." | ".."))
+        {
+            summary
+                .skipped
+                .push(format!("{}: invalid repository name", repo.name));
+            continue;
+        }
+        if target.exists() {
+            summary
+                .skipped
+                .push(format!("{}: already exists", repo.name));
+            continue;
+        }
+        match restore_repo(&staging.join("repos").join(&repo.name), &target, repo.empty) {
+            Ok(()) => {
+                templates.install(&target)?;
+                summary.repos += 1;
+            }
+            Err(e) => {
+                let _ = fs::remove_dir_all(&target);
+                summary.skipped.push(format!("{}: {:#}", repo.name, e));
+            }
+        }
+    }
+
+    copy_missing(&staging.join("data"), &paths.data_dir, &mut summary)?;
+    for (name, target) in ssh_files(paths) {
+        copy_missing(&staging.join("ssh").join(name), &target, &mut summary)?;
+    }
+    if let Some(dir) = &paths.hook_templates {
+        copy_missing(&staging.join("hook-templates"), dir, &mut summary)?;
+    }
+    Ok(summary)
+}
+
+/// Recreate one repository from its bundle and copied files
+fn restore_repo(dir: &Path, target: &Path, empty: bool) -> Result<()> {
+    if let Some(parent) = target.parent() {
+        fs::create_dir_all(parent)?;
+    }
+    let output = Command::new("git")
+        .arg("init")
+        .arg("--bare")
+        .arg("--quiet")
+        .arg(target)
+        .output()
+        .context("Failed to init repository")?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "Failed to init repository: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    copy_tree(&dir.join("files"), target)?;
+
+    if !empty {
+        let bundle = dir.join("repo.bundle");
+        let output = git::run(
+            target,
+            &[
+                "fetch",
+                "--quiet",
+                &bundle.to_string_lossy(),
+                "+refs/*:refs/*",
+            ],
+        )?;
+        if !output.status.success() {
+            anyhow::bail!(
+                "Failed to restore refs from the bundle: {}",
+                String::from_utf8_lossy(&output.stderr).trim()
+            );
+        }
+    }
+    Ok(())
+}
+
+/// Copy a file or directory tree, replacing files that exist
+fn copy_tree(source: &Path, target: &Path) -> Result<()> {
+    let metadata = match fs::symlink_metadata(source) {
+        Ok(metadata) => metadata,
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(()),
+        Err(e) => return Err(e).with_context(|| format!("Failed to read {}", source.display())),
+    };
+    if metadata.is_dir() {
+        fs::create_dir_all(target)?;
+        for entry in fs::read_dir(source)? {
+            let entry = entry?;
+            copy_tree(&entry.path(), &target.join(entry.file_name()))?;
+        }
+    } else if metadata.is_file() {
+        fs::copy(source, target).with_context(|| format!("Failed to copy {}", source.display()))?;
+    }
+    Ok(())
+}
+
+/// Copy a file or directory tree, leaving files that exist alone and
+/// noting them in `summary` unless they are the same as in the backup
+fn copy_missing(source: &Path, target: &Path, summary: &mut Summary) -> Result<()> {
+    if source.is_dir() {
+        fs::create_dir_all(target)?;
+        for entry in fs::read_dir(source)? {
+            let entry = entry?;
+            copy_missing(&entry.path(), &target.join(entry.file_name()), summary)?;
+        }
+    } else if source.is_file() {
+        if target.exists() {
+            if fs::read(source).ok() != fs::read(target).ok() {
+                summary
+                    .skipped
+                    .push(format!("{}: already exists", target.display()));
+            }
+        } else {
+            if let Some(parent) = target.parent() {
+                fs::create_dir_all(parent)?;
+            }
+            fs::copy(source, target)
+                .with_context(|| format!("Failed to copy {}", source.display()))?;
+        }
+    }
+    Ok(())
+}
+
+/// SSH files by the name they have in the archive, which is the same
+/// whatever they are called on the server
+fn ssh_files(paths: &Paths) -> Vec<(String, PathBuf)> {
+    let mut files = vec![
+        ("host_key".to_string(), paths.ssh_key.clone()),
+        ("host_key.pub".to_string(), sibling(&paths.ssh_key, "pub")),
+        ("authorized_keys".to_string(), paths.authorized_keys.clone()),
+    ];
+    // The keys of other types next to it
+    for key_type in KeyType::ALL {
+        let name = format!("host_key_{}", key_type.name());
+        let path = host_keys::typed_path(&paths.ssh_key, key_type);
+        files.push((format!("{}.pub", name), sibling(&path, "pub")));
+        files.push((name, path));
+    }
+    files
+}
+
+/// `<path>.<suffix>`, e.g. for work in progress next to the output
+fn sibling(path: &Path, suffix: &str) -> PathBuf {
+    let mut name = path.as_os_str().to_owned();
+    name.push(format!(".{}", suffix));
+    PathBuf::from(name)
+}
+
+fn tar(args: &[&str]) -> Result<()> {
+    let output = Command::new("tar")
+        .args(args)
+        .output()
+        .context("Failed to run tar")?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "tar failed: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(())
+}
@@ -0,0 +1,205 @@
+use anyhow::{Context, Result};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::process::{Command, Stdio};
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
+
+/// Load-test settings for `agito-admin bench`
+pub struct BenchConfig {
+    /// Clone URL of the repository to exercise
+    pub url: String,
+    /// Number of concurrent workers
+    pub concurrency: usize,
+    /// Operations performed by each worker
+    pub iterations: usize,
+    /// Also push a commit to a scratch branch after each clone
+    pub push: bool,
+}
+
+/// Latency samples for one kind of operation
+#[derive(Default)]
+pub struct OpStats {
+    pub samples: Vec<Duration>,
+    pub errors: usize,
+}
+
+impl OpStats {
+    fn percentile(&self, p: f64) -> Duration {
+        if self.samples.is_empty() {
+            return Duration::ZERO;
+        }
+        let idx = ((self.samples.len() - 1) as f64 * p).round() as usize;
+        self.samples[idx]
+    }
+}
+
+/// Aggregated results of a benchmark run
+pub struct BenchReport {
+    pub clone: OpStats,
+    pub push: OpStats,
+    pub elapsed: Duration,
+}
+
+impl BenchReport {
+    /// Print throughput and latency percentiles
+    pub fn print(&self) {
+        println!("Total time: {:.2}s", self.elapsed.as_secs_f64());
+        print_stats("clone", &self.clone, self.elapsed);
+        if !self.push.samples.is_empty() || self.push.errors > 0 {
+            print_stats("push", &self.push, self.elapsed);
+        }
+    }
+}
+
+fn print_stats(name: &str, stats: &OpStats, elapsed: Duration) {
+    let ok = stats.samples.len();
+    let throughput = ok as f64 / elapsed.as_secs_f64().max(f64::EPSILON);
+    println!();
+    println!("{}:", name);
+    println!("  succeeded:  {}", ok);
+    println!("  failed:     {}", stats.errors);
+    println!("  throughput: {:.2} ops/s", throughput);
+    if ok > 0 {
+        println!(
+            "  latency:    p50 {:.0}ms  p90 {:.0}ms  p99 {:.0}ms  max {:.0}ms",
+            stats.percentile(0.50).as_secs_f64() * 1000.0,
+            stats.percentile(0.90).as_secs_f64() * 1000.0,
+            stats.percentile(0.99).as_secs_f64() * 1000.0,
+            stats.percentile(1.0).as_secs_f64() * 1000.0,
+        );
+    }
+}
+
+/// Run concurrent clones (and optionally pushes) against a server
+pub fn run(config: &BenchConfig) -> Result<BenchReport> {
+    let work_dir = std::env::temp_dir().join(format!("agito-bench-{}", std::process::id()));
+    fs::create_dir_all(&work_dir).context("Failed to create benchmark work directory")?;
+
+    let clone = Mutex::new(OpStats::default());
+    let push = Mutex::new(OpStats::default());
+    let start = Instant::now();
+
+    std::thread::scope(|scope| {
+        for worker in 0..config.concurrency.max(1) {
+            let work_dir = &work_dir;
+            let clone = &clone;
+            let push = &push;
+            scope.spawn(move || {
+                for iteration in 0..config.iterations {
+                    let dir = work_dir.join(format!("w{}-{}", worker, iteration));
+
+                    let result = timed(|| clone_repo(&config.url, &dir));
+                    record(clone, result);
+
+                    if config.push && dir.exists() {
+                        let branch = format!("agito-bench/{}-{}", worker, iteration);
+                        let result = timed(|| push_commit(&dir, &branch));
+                        record(push, result);
+                        // Best effort: don't leave scratch branches behind
+                        let _ = git(&dir, &["push", "-q", "origin", "--delete", &branch]);
+                    }
+
+                    let _ = fs::remove_dir_all(&dir);
+                }
+            });
+        }
+    });
+
+    let elapsed = start.elapsed();
+    let _ = fs::remove_dir_all(&work_dir);
+
+    let mut clone = clone.into_inner().unwrap();
+    let mut push = push.into_inner().unwrap();
+    clone.samples.sort();
+    push.samples.sort();
+
+    Ok(BenchReport {
+        clone,
+        push,
+        elapsed,
+    })
+}
+
+fn timed(op: impl FnOnce() -> Result<()>) -> Result<Duration> {
+    let start = Instant::now();
+    op()?;
+    Ok(start.elapsed())
+}
+
+fn record(stats: &Mutex<OpStats>, result: Result<Duration>) {
+    let mut stats = stats.lock().unwrap();
+    match result {
+        Ok(duration) => stats.samples.push(duration),
+        Err(e) => {
+            tracing::warn!("Benchmark operation failed: {}", e);
+            stats.errors += 1;
+        }
+    }
+}
+
+fn clone_repo(url: &str, dir: &PathBuf) -> Result<()> {
+    let status = Command::new("git")
+        .arg("clone")
+        .arg("-q")
+        .arg(url)
+        .arg(dir)
+        .env("GIT_SSH_COMMAND", ssh_command())
+        .stdout(Stdio::null())
+        .stderr(Stdio::null())
+        .status()
+        .context("Failed to execute git clone")?;
+
+    if !status.success() {
+        anyhow::bail!("git clone failed with status: {}", status);
+    }
+    Ok(())
+}
+
+fn push_commit(dir: &Path, branch: &str) -> Result<()> {
+    git(
+        dir,
+        &[
+            "-c",
+            "user.name=agito-bench",
+            "-c",
+            "user.email=bench@agito.invalid",
+            "commit",
+            "-q",
+            "--allow-empty",
+            "-m",
+            "agito bench commit",
+        ],
+    )?;
+    git(
+        dir,
+        &[
+            "push",
+            "-q",
+            "origin",
+            &format!("HEAD:refs/heads/{}", branch),
+        ],
+    )
+}
+
+fn git(dir: &Path, args: &[&str]) -> Result<()> {
+    let status = Command::new("git")
+        .arg("-C")
+        .arg(dir)
+        .args(args)
+        .env("GIT_SSH_COMMAND", ssh_command())
+        .stdout(Stdio::null())
+        .stderr(Stdio::null())
+        .status()
+        .context("Failed to execute git")?;
+
+    if !status.success() {
+        anyhow::bail!("git {} failed with status: {}", args.join(" "), status);
+    }
+    Ok(())
+}
+
+/// Never let ssh prompt for passwords or host keys from a worker thread
+fn ssh_command() -> String {
+    std::env::var("GIT_SSH_COMMAND").unwrap_or_else(|_| "ssh -o BatchMode=yes".to_string())
+}
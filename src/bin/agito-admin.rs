@@ -0,0 +1,2255 @@
+use agito::{
+    archive, audit, bench, ci, digest, events, git, git_daemon, mail, maintenance, mirror,
+    namespaces, notifications, orgs, pack_cache, policies, protection, pulls, quota, redirects,
+    retention, seed, subscriptions, tokens, usage, users, visibility, watch, webhooks,
+};
+use anyhow::Result;
+use clap::{Parser, Subcommand};
+use std::path::{Path, PathBuf};
+
+#[derive(Parser, Debug)]
+#[command(name = "agito-admin")]
+#[command(about = "Agito administration tools", long_about = None)]
+struct Args {
+    #[command(subcommand)]
+    command: Commands,
+}
+
+#[derive(Subcommand, Debug)]
+enum Commands {
+    /// Load-test a server with concurrent clones and pushes
+    Bench {
+        /// Clone URL of the repository to exercise
+        url: String,
+
+        /// Number of concurrent workers
+        #[arg(short, long, default_value = "4")]
+        concurrency: usize,
+
+        /// Operations performed by each worker
+        #[arg(short = 'n', long, default_value = "10")]
+        iterations: usize,
+
+        /// Also push a commit to a scratch branch after each clone
+        #[arg(long)]
+        push: bool,
+    },
+
+    /// Generate demo repositories with history, branches and tags
+    Seed {
+        /// Number of repositories to create
+        #[arg(long, default_value = "5")]
+        repos: usize,
+
+        /// Number of commits on the default branch of each repository
+        #[arg(long, default_value = "30")]
+        commits: usize,
+
+        /// Directory holding the server's repositories
+        #[arg(long, default_value = "/var/lib/agito/repos")]
+        repos_dir: PathBuf,
+
+        /// Seed for reproducible output
+        #[arg(long, default_value = "42")]
+        seed: u64,
+    },
+
+    /// Report disk usage per repository and namespace, largest first
+    Du {
+        /// Directory holding the server's repositories
+        #[arg(long, default_value = "/var/lib/agito/repos")]
+        repos_dir: PathBuf,
+
+        /// Print the report as JSON
+        #[arg(long)]
+        json: bool,
+    },
+
+    /// Delete CI logs, artifacts and webhook deliveries past their retention period
+    Retention {
+        /// Directory holding the server's repositories
+        #[arg(long, default_value = "/var/lib/agito/repos")]
+        repos_dir: PathBuf,
+
+        /// Days to keep CI logs (0 keeps them forever)
+        #[arg(long, default_value = "90")]
+        ci_logs_days: u64,
+
+        /// Days to keep CI artifacts (0 keeps them forever)
+        #[arg(long, default_value = "30")]
+        artifacts_days: u64,
+
+        /// Days to keep webhook delivery records (0 keeps them forever)
+        #[arg(long, default_value = "14")]
+        webhook_deliveries_days: u64,
+
+        /// Only report what would be removed
+        #[arg(long)]
+        dry_run: bool,
+    },
+
+    /// Run repository maintenance (gc, repack, commit-graph, fsck, caches) now
+    Maintenance {
+        /// Directory holding the server's repositories
+        #[arg(long, default_value = "/var/lib/agito/repos")]
+        repos_dir: PathBuf,
+
+        /// Comma-separated tasks: gc, repack, commit-graph, fsck, caches
+        #[arg(long, value_delimiter = ',', default_value = "gc,commit-graph")]
+        tasks: Vec<maintenance::Task>,
+
+        /// Number of repositories maintained at once
+        #[arg(short, long, default_value = "2")]
+        concurrency: usize,
+
+        /// Repositories to maintain (default: all)
+        repos: Vec<String>,
+    },
+
+    /// Manage email digests of repository activity
+    Digest {
+        /// Directory holding the server's own data
+        #[arg(long, default_value = "/var/lib/agito/data")]
+        data_dir: PathBuf,
+
+        #[command(subcommand)]
+        action: DigestAction,
+    },
+
+    /// Mail addresses about pushes to particular branches or tags, e.g. new releases
+    Watch {
+        /// Directory holding the server's own data
+        #[arg(long, default_value = "/var/lib/agito/data")]
+        data_dir: PathBuf,
+
+        #[command(subcommand)]
+        action: WatchAction,
+    },
+
+    /// Mail accounts about pushes, issues and pull requests in repositories they follow
+    Subscription {
+        /// Directory holding the server's own data
+        #[arg(long, default_value = "/var/lib/agito/data")]
+        data_dir: PathBuf,
+
+        #[command(subcommand)]
+        action: SubscriptionAction,
+    },
+
+    /// Work with the stream of ref updates pushed to repositories
+    Events {
+        #[command(subcommand)]
+        action: EventsAction,
+    },
+
+    /// Build a pack through the server's pack cache; run by git-upload-pack as
+    /// its uploadpack.packObjectsHook, in the repository
+    PackCache {
+        /// The git pack-objects command line to run
+        #[arg(trailing_var_arg = true, allow_hyphen_values = true, required = true)]
+        command: Vec<String>,
+    },
+
+    /// Queue and inspect CI builds
+    Ci {
+        #[command(subcommand)]
+        action: CiAction,
+    },
+
+    /// Configure a repository's webhooks and inspect their deliveries
+    Webhook {
+        #[command(subcommand)]
+        action: WebhookAction,
+    },
+
+    /// Add a notification to a user's inbox, e.g. from a CI script
+    Notify {
+        /// Recipient user name
+        user: String,
+
+        /// mention, review-request, review-comment or ci-failure
+        #[arg(long)]
+        reason: notifications::Reason,
+
+        /// Repository the notification is about
+        #[arg(long)]
+        repo: String,
+
+        /// Short description shown in the inbox
+        #[arg(long)]
+        title: String,
+
+        /// Page the notification links to
+        #[arg(long)]
+        url: Option<String>,
+
+        /// Directory holding the server's own data
+        #[arg(long, default_value = "/var/lib/agito/data")]
+        data_dir: PathBuf,
+    },
+
+    /// Switch built-in push policies of a repository on and off
+    Policy {
+        #[command(subcommand)]
+        action: PolicyAction,
+    },
+
+    /// Protect branches of a repository from force-pushes and deletion
+    Protect {
+        #[command(subcommand)]
+        action: ProtectAction,
+    },
+
+    /// Manage per-user disk quotas
+    Quota {
+        /// Directory holding the server's own data
+        #[arg(long, default_value = "/var/lib/agito/data")]
+        data_dir: PathBuf,
+
+        #[command(subcommand)]
+        action: QuotaAction,
+    },
+
+    /// Manage user accounts and approve registrations
+    User {
+        /// Directory holding the server's own data
+        #[arg(long, default_value = "/var/lib/agito/data")]
+        data_dir: PathBuf,
+
+        #[command(subcommand)]
+        action: UserAction,
+    },
+
+    /// Issue and revoke personal access tokens for the HTTP API
+    Token {
+        /// Directory holding the server's own data
+        #[arg(long, default_value = "/var/lib/agito/data")]
+        data_dir: PathBuf,
+
+        #[command(subcommand)]
+        action: TokenAction,
+    },
+
+    /// Search the audit log of administrative and security-relevant events
+    Audit {
+        /// Directory holding the server's own data
+        #[arg(long, default_value = "/var/lib/agito/data")]
+        data_dir: PathBuf,
+
+        #[command(subcommand)]
+        action: AuditAction,
+    },
+
+    /// Manage organizations, their members and teams
+    Org {
+        /// Directory holding the server's own data
+        #[arg(long, default_value = "/var/lib/agito/data")]
+        data_dir: PathBuf,
+
+        /// Directory containing the repositories
+        #[arg(long, default_value = "/var/lib/agito/repos")]
+        repos_dir: PathBuf,
+
+        #[command(subcommand)]
+        action: OrgAction,
+    },
+
+    /// Manage per-user repository limits and who may create top-level repositories
+    Namespace {
+        /// Directory holding the server's own data
+        #[arg(long, default_value = "/var/lib/agito/data")]
+        data_dir: PathBuf,
+
+        #[command(subcommand)]
+        action: NamespaceAction,
+    },
+
+    /// Configure pull and push mirrors of repositories
+    Mirror {
+        /// Directory containing the repositories
+        #[arg(long, default_value = "/var/lib/agito/repos")]
+        repos_dir: PathBuf,
+
+        /// Directory holding the server's own data, for the audit log
+        #[arg(long, default_value = "/var/lib/agito/data")]
+        data_dir: PathBuf,
+
+        #[command(subcommand)]
+        action: MirrorAction,
+    },
+
+    /// Keep old names of renamed or moved repositories working
+    Redirect {
+        /// Directory holding the server's own data
+        #[arg(long, default_value = "/var/lib/agito/data")]
+        data_dir: PathBuf,
+
+        /// Directory containing the repositories
+        #[arg(long, default_value = "/var/lib/agito/repos")]
+        repos_dir: PathBuf,
+
+        #[command(subcommand)]
+        action: RedirectAction,
+    },
+
+    /// Archive or rename repositories
+    Repo {
+        /// Directory holding the server's own data
+        #[arg(long, default_value = "/var/lib/agito/data")]
+        data_dir: PathBuf,
+
+        /// Directory containing the repositories
+        #[arg(long, default_value = "/var/lib/agito/repos")]
+        repos_dir: PathBuf,
+
+        #[command(subcommand)]
+        action: RepoAction,
+    },
+}
+
+#[derive(Subcommand, Debug)]
+enum RepoAction {
+    /// List archived repositories
+    Archived,
+
+    /// Make a repository read-only and leave it out of repository lists
+    Archive { repo: String },
+
+    /// Let an archived repository take pushes again
+    Unarchive { repo: String },
+
+    /// Rename or move a repository, redirecting its old name for a while
+    Rename {
+        repo: String,
+
+        /// New name, e.g. new-name.git or team/new-name.git
+        to: String,
+
+        /// Days the old name keeps working (0 keeps it for ever)
+        #[arg(long, default_value_t = redirects::DEFAULT_DAYS)]
+        redirect_days: u64,
+    },
+
+    /// Show or change who may read a repository: public, internal or private
+    Visibility {
+        repo: String,
+        visibility: Option<visibility::Visibility>,
+    },
+
+    /// Serve a public repository over git://, when the server runs the git
+    /// daemon
+    Export { repo: String },
+
+    /// Stop serving a repository over git://
+    Unexport { repo: String },
+
+    /// List the users granted a role on a repository itself
+    Collaborators { repo: String },
+
+    /// Grant a user a role on a repository (read, write or admin), or take it
+    /// away with none
+    Collaborator {
+        repo: String,
+        user: String,
+        role: String,
+    },
+}
+
+#[derive(Subcommand, Debug)]
+enum MirrorAction {
+    /// Show mirrors and their last sync, for one repository or all
+    List { repo: Option<String> },
+
+    /// Mirror a repository from an upstream (pull) or to another remote (push)
+    Add {
+        repo: String,
+
+        /// pull: fetch from the URL on a schedule; push: push to it after every push
+        direction: mirror::Direction,
+
+        /// Remote URL; github:<owner>/<repo> and gitlab:<owner>/<repo> are short
+        /// for their HTTPS URLs
+        url: String,
+
+        /// Remote name (default: upstream for pull mirrors, backup for push mirrors)
+        #[arg(long)]
+        name: Option<String>,
+
+        /// Seconds between fetches of a pull mirror
+        #[arg(long, default_value_t = mirror::DEFAULT_INTERVAL)]
+        interval: u64,
+
+        #[command(flatten)]
+        credentials: MirrorCredentials,
+    },
+
+    /// Stop mirroring
+    Remove { repo: String, name: String },
+
+    /// Store or replace the credentials a mirror authenticates with, or
+    /// forget them with neither option
+    Credentials {
+        repo: String,
+        name: String,
+
+        #[command(flatten)]
+        credentials: MirrorCredentials,
+    },
+
+    /// Fetch or push mirrors now, all of the repository's or just one
+    Sync { repo: String, name: Option<String> },
+}
+
+#[derive(clap::Args, Debug)]
+struct MirrorCredentials {
+    /// File whose first line is an access token for HTTPS remotes, e.g. a GitHub
+    /// personal access token with the contents:write permission
+    #[arg(long, conflicts_with = "ssh_key")]
+    token_file: Option<PathBuf>,
+
+    /// User name sent with the token
+    #[arg(long, default_value = mirror::DEFAULT_TOKEN_USER, requires = "token_file")]
+    username: String,
+
+    /// Private SSH key for SSH remotes, e.g. a deploy key with write access
+    #[arg(long)]
+    ssh_key: Option<PathBuf>,
+}
+
+impl MirrorCredentials {
+    fn read(&self) -> Result<Option<mirror::Credentials>> {
+        let read = |path: &PathBuf| {
+            std::fs::read_to_string(path)
+                .map_err(|e| anyhow::anyhow!("Failed to read {}: {}", path.display(), e))
+        };
+        Ok(match (&self.token_file, &self.ssh_key) {
+            (Some(path), _) => Some(mirror::Credentials::Token {
+                username: self.username.clone(),
+                token: read(path)?.lines().next().unwrap_or("").trim().to_string(),
+            }),
+            (None, Some(path)) => Some(mirror::Credentials::SshKey { key: read(path)? }),
+            (None, None) => None,
+        })
+    }
+}
+
+#[derive(Subcommand, Debug)]
+enum RedirectAction {
+    /// List redirects from old repository names
+    List,
+
+    /// Send web links and remotes using an old name to the repository's current name
+    Add {
+        /// Name the repository used to have, e.g. old-name.git or team/old-name.git
+        from: String,
+
+        /// Current name of the repository
+        to: String,
+
+        /// Days until the redirect expires (default: never)
+        #[arg(long)]
+        days: Option<u64>,
+    },
+
+    /// Stop redirecting an old name
+    Remove { from: String },
+}
+
+#[derive(Subcommand, Debug)]
+enum TokenAction {
+    /// List tokens, of one user or of everyone
+    List { user: Option<String> },
+
+    /// Issue a token to a user and print it; it can't be shown again
+    Create {
+        user: String,
+
+        /// What the token is for
+        #[arg(long)]
+        name: String,
+
+        /// Most the token may do: read, write or admin
+        #[arg(long, default_value = "read")]
+        scope: orgs::Role,
+
+        /// Days until the token expires (never if unset)
+        #[arg(long)]
+        expires_in_days: Option<u32>,
+    },
+
+    /// Revoke a token
+    Revoke { id: u64 },
+}
+
+#[derive(Subcommand, Debug)]
+enum AuditAction {
+    /// Show entries, newest first
+    List {
+        /// Only this kind of event, e.g. repo.create or auth.failure
+        #[arg(long)]
+        action: Option<audit::Action>,
+
+        /// Only events by this user
+        #[arg(long)]
+        actor: Option<String>,
+
+        /// Only events in this repository
+        #[arg(long)]
+        repo: Option<String>,
+
+        /// Number of entries to show
+        #[arg(short = 'n', long, default_value = "50")]
+        limit: usize,
+    },
+}
+
+#[derive(Subcommand, Debug)]
+enum UserAction {
+    /// List accounts and their state
+    List,
+
+    /// Create an active account
+    Add {
+        name: String,
+
+        #[arg(long)]
+        email: String,
+
+        #[arg(long)]
+        display_name: Option<String>,
+
+        /// Let the user administer the server
+        #[arg(long)]
+        admin: bool,
+
+        /// Read the password from the first line of stdin; without it the
+        /// account can only sign in with SSH keys
+        #[arg(long)]
+        password_stdin: bool,
+
+        /// SSH public key, as a line of an authorized_keys file (repeatable)
+        #[arg(long = "key")]
+        keys: Vec<String>,
+    },
+
+    /// Activate a pending or disabled account
+    Approve { name: String },
+
+    /// Lock an account out of the web interface and SSH
+    Disable { name: String },
+
+    /// Make a user a server admin
+    Promote {
+        name: String,
+
+        /// Take admin rights away instead
+        #[arg(long)]
+        revoke: bool,
+    },
+
+    /// Set a user's password, read from the first line of stdin
+    Passwd { name: String },
+
+    /// Add an SSH public key to an account
+    Key { name: String, key: String },
+}
+
+#[derive(Subcommand, Debug)]
+enum OrgAction {
+    /// List organizations with their members and teams
+    List,
+
+    /// Create an organization owning the namespace of the same name
+    Create {
+        name: String,
+
+        /// First owner of the organization
+        #[arg(long)]
+        owner: String,
+
+        #[arg(long)]
+        display_name: Option<String>,
+    },
+
+    /// Delete an organization that has no repositories left
+    Delete { name: String },
+
+    /// Add a member, or with --owner make them an owner
+    AddMember {
+        org: String,
+        user: String,
+
+        #[arg(long)]
+        owner: bool,
+    },
+
+    /// Remove a member from the organization and all of its teams
+    RemoveMember { org: String, user: String },
+
+    /// Set the role every member has on every repository (none, read, write or admin)
+    BaseRole { org: String, role: String },
+
+    /// Manage an organization's teams
+    Team {
+        org: String,
+
+        #[command(subcommand)]
+        action: TeamAction,
+    },
+}
+
+#[derive(Subcommand, Debug)]
+enum TeamAction {
+    /// Create a team, or change its role
+    Set {
+        team: String,
+
+        /// read, write or admin
+        #[arg(long)]
+        role: orgs::Role,
+    },
+
+    /// Delete a team
+    Delete { team: String },
+
+    /// Add an organization member to a team
+    AddMember { team: String, user: String },
+
+    /// Remove a member from a team
+    RemoveMember { team: String, user: String },
+
+    /// Give a team its role on one of the organization's repositories
+    Grant { team: String, repo: String },
+
+    /// Take a repository away from a team
+    Revoke { team: String, repo: String },
+}
+
+#[derive(Subcommand, Debug)]
+enum NamespaceAction {
+    /// List users with their own limits
+    List,
+
+    /// Override the server defaults for a user
+    Set {
+        user: String,
+
+        /// Most repositories in the user's namespace (0 for unlimited; server default if unset)
+        #[arg(long)]
+        max_repos: Option<usize>,
+
+        /// Allow the user to create top-level repositories under --top-level-repos granted
+        #[arg(long)]
+        top_level: bool,
+    },
+
+    /// Remove a user's overrides, falling back to the server defaults
+    Unset { user: String },
+}
+
+#[derive(Subcommand, Debug)]
+enum QuotaAction {
+    /// List per-user quotas
+    List,
+
+    /// Set the quota for all repositories in a user's namespace (0 for unlimited)
+    Set {
+        user: String,
+
+        /// Size such as 500M or 10G
+        #[arg(value_parser = usage::parse_size)]
+        size: u64,
+    },
+
+    /// Remove a user's quota, falling back to the server default
+    Unset { user: String },
+
+    /// Reject a push that exceeds a quota; run by the pre-receive hook
+    Check {
+        /// Repository being pushed to
+        git_dir: PathBuf,
+    },
+}
+
+#[derive(Subcommand, Debug)]
+enum PolicyAction {
+    /// Show which policies a repository enforces
+    List { git_dir: PathBuf },
+
+    /// Switch a policy on, e.g. `enable repo.git max-file-size 10M`
+    Enable {
+        git_dir: PathBuf,
+
+        /// max-file-size, linear-history, path-conventions, denied-paths,
+        /// secrets, commit-message or signed-off-by
+        policy: policies::Policy,
+
+        /// Size for max-file-size, kinds of secrets for secrets, a regex for
+        /// commit-message, author or any for signed-off-by and space-separated
+        /// globs for the others; defaults to a sensible starting point
+        value: Option<String>,
+    },
+
+    /// Switch a policy off
+    Disable {
+        git_dir: PathBuf,
+
+        policy: policies::Policy,
+    },
+
+    /// Reject a push, given as `<old> <new> <ref>` lines on standard input,
+    /// that breaks a policy; run by the pre-receive hook
+    Check {
+        /// Repository being pushed to
+        git_dir: PathBuf,
+    },
+}
+
+#[derive(Subcommand, Debug)]
+enum ProtectAction {
+    /// Show a repository's protected branches
+    List { git_dir: PathBuf },
+
+    /// Protect the branches matching a pattern, replacing its existing rule
+    Add {
+        git_dir: PathBuf,
+
+        /// Branch name or glob, e.g. main or release/*
+        pattern: String,
+
+        /// Still allow pushes that rewrite the branch's history
+        #[arg(long)]
+        allow_force_push: bool,
+
+        /// Still allow deleting the branch
+        #[arg(long)]
+        allow_deletion: bool,
+
+        /// Reject pushes and merges; the branch only moves through pull requests
+        #[arg(long)]
+        require_pull_request: bool,
+    },
+
+    /// Stop protecting the branches matching a pattern
+    Remove { git_dir: PathBuf, pattern: String },
+
+    /// Reject a ref update that breaks a protection rule; run by the update
+    /// hook with its arguments
+    Check {
+        /// Repository being pushed to
+        git_dir: PathBuf,
+        refname: String,
+        old: String,
+        new: String,
+    },
+}
+
+#[derive(Subcommand, Debug)]
+enum SubscriptionAction {
+    /// List subscriptions, of one user or of everyone
+    List { user: Option<String> },
+
+    /// Choose what a user is mailed about a repository; asking for nothing unsubscribes
+    Set {
+        user: String,
+
+        repo: String,
+
+        /// Comma-separated branch patterns whose pushes are mailed, e.g. main,release/*
+        #[arg(long, default_value = "")]
+        branches: String,
+
+        /// Mail new issues
+        #[arg(long)]
+        issues: bool,
+
+        /// Mail pull request activity
+        #[arg(long)]
+        pulls: bool,
+    },
+
+    /// Mail what happened since the last delivery now
+    Send {
+        /// Directory holding the server's repositories
+        #[arg(long, default_value = "/var/lib/agito/repos")]
+        repos_dir: PathBuf,
+
+        /// Base URL of the web interface, for links in the mail
+        #[arg(long, default_value = "http://localhost:3000")]
+        public_url: String,
+
+        #[command(flatten)]
+        mail: MailArgs,
+    },
+}
+
+#[derive(Subcommand, Debug)]
+enum WatchAction {
+    /// List watches
+    List,
+
+    /// Mail an address when refs matching a pattern are pushed to a repository
+    Add {
+        email: String,
+
+        repo: String,
+
+        /// Glob matched against the ref name, e.g. main, heads/release-*, tags/v*
+        #[arg(long, default_value = "*")]
+        refs: String,
+    },
+
+    /// Stop a watch
+    Remove {
+        email: String,
+
+        repo: String,
+
+        #[arg(long, default_value = "*")]
+        refs: String,
+    },
+
+    /// Mail the updates pushed since the last delivery now
+    Send {
+        /// Directory holding the server's repositories
+        #[arg(long, default_value = "/var/lib/agito/repos")]
+        repos_dir: PathBuf,
+
+        #[command(flatten)]
+        mail: MailArgs,
+    },
+}
+
+/// How mail leaves the server
+#[derive(clap::Args, Debug)]
+struct MailArgs {
+    /// sendmail-compatible binary used to deliver mail
+    #[arg(long, default_value = "/usr/sbin/sendmail")]
+    sendmail: PathBuf,
+
+    /// Sender address
+    #[arg(long, default_value = "agito@localhost")]
+    mail_from: String,
+
+    /// Send through this SMTP server instead of sendmail: smtp://host:587
+    /// (STARTTLS) or smtps://host:465
+    #[arg(long, value_parser = mail::Smtp::parse_url)]
+    smtp_url: Option<String>,
+
+    /// User name to log in to the SMTP server with
+    #[arg(long)]
+    smtp_username: Option<String>,
+
+    /// File holding the SMTP password on its first line
+    #[arg(long)]
+    smtp_password_file: Option<PathBuf>,
+
+    /// Send over smtp:// without TLS if the server does not offer STARTTLS
+    #[arg(long)]
+    smtp_allow_plaintext: bool,
+
+    /// curl binary used to talk to the SMTP server
+    #[arg(long, default_value = "curl")]
+    curl: PathBuf,
+}
+
+impl MailArgs {
+    fn mailer(self) -> Result<mail::Mailer> {
+        let smtp = match self.smtp_url {
+            Some(url) => Some(mail::Smtp {
+                url,
+                username: self.smtp_username,
+                password: self
+                    .smtp_password_file
+                    .as_deref()
+                    .map(mail::Smtp::read_password)
+                    .transpose()?,
+                allow_plaintext: self.smtp_allow_plaintext,
+                curl: self.curl,
+            }),
+            None => None,
+        };
+        Ok(mail::Mailer {
+            sendmail: self.sendmail,
+            from: self.mail_from,
+            smtp,
+        })
+    }
+}
+
+#[derive(Subcommand, Debug)]
+enum EventsAction {
+    /// Append the `<old> <new> <ref>` lines on standard input to a repository's
+    /// event stream and update its pull requests; run by the post-receive hook
+    Record {
+        /// Repository pushed to
+        git_dir: PathBuf,
+    },
+
+    /// Show a repository's latest ref updates
+    List {
+        git_dir: PathBuf,
+
+        /// Only refs matching this glob, e.g. tags/v*
+        #[arg(long)]
+        refs: Option<String>,
+
+        #[arg(short = 'n', long, default_value = "20")]
+        limit: usize,
+    },
+}
+
+#[derive(Subcommand, Debug)]
+enum CiAction {
+    /// Queue builds of the branches in the `<old> <new> <ref>` lines on
+    /// standard input; run by the post-receive hook
+    Enqueue {
+        /// Repository pushed to
+        git_dir: PathBuf,
+    },
+
+    /// Show a repository's latest builds
+    List {
+        git_dir: PathBuf,
+
+        #[arg(short = 'n', long, default_value = "20")]
+        limit: usize,
+    },
+
+    /// Queue another build of the same commit as an earlier one
+    Retry { git_dir: PathBuf, id: u64 },
+}
+
+#[derive(Subcommand, Debug)]
+enum WebhookAction {
+    /// List a repository's webhooks
+    List { git_dir: PathBuf },
+
+    /// POST events of a repository to a URL
+    Add {
+        git_dir: PathBuf,
+        url: String,
+
+        /// Key of the X-Agito-Signature HMAC
+        #[arg(long)]
+        secret: Option<String>,
+
+        /// push, issues, pull_request or build (repeatable; all if omitted)
+        #[arg(long = "event")]
+        events: Vec<webhooks::Event>,
+    },
+
+    /// Delete a webhook
+    Remove { git_dir: PathBuf, id: u64 },
+
+    /// Show a repository's latest deliveries
+    Deliveries {
+        git_dir: PathBuf,
+
+        /// Only deliveries to this webhook
+        #[arg(long)]
+        hook: Option<u64>,
+
+        #[arg(short = 'n', long, default_value = "20")]
+        limit: usize,
+    },
+
+    /// Queue a delivery's payload again
+    Redeliver { git_dir: PathBuf, id: u64 },
+}
+
+#[derive(Subcommand, Debug)]
+enum DigestAction {
+    /// List digest subscriptions
+    List,
+
+    /// Subscribe an address to a digest of the given repositories
+    Subscribe {
+        email: String,
+
+        /// daily or weekly
+        #[arg(long, default_value = "daily")]
+        frequency: digest::Frequency,
+
+        /// Repository to watch (repeatable)
+        #[arg(long = "repo", required = true)]
+        repos: Vec<String>,
+    },
+
+    /// Stop sending digests to an address
+    Unsubscribe { email: String },
+
+    /// Send all digests that are due now
+    Send {
+        /// Directory holding the server's repositories
+        #[arg(long, default_value = "/var/lib/agito/repos")]
+        repos_dir: PathBuf,
+
+        #[command(flatten)]
+        mail: MailArgs,
+    },
+}
+
+fn main() -> Result<()> {
+    tracing_subscriber::fmt::init();
+
+    let args = Args::parse();
+
+    match args.command {
+        Commands::Bench {
+            url,
+            concurrency,
+            iterations,
+            push,
+        } => {
+            println!(
+                "Benchmarking {} with {} workers x {} iterations{}",
+                url,
+                concurrency,
+                iterations,
+                if push { " (clone + push)" } else { "" }
+            );
+            let report = bench::run(&bench::BenchConfig {
+                url,
+                concurrency,
+                iterations,
+                push,
+            })?;
+            report.print();
+        }
+        Commands::Seed {
+            repos,
+            commits,
+            repos_dir,
+            seed,
+        } => {
+            std::fs::create_dir_all(&repos_dir)?;
+            let created = seed::run(&seed::SeedConfig {
+                repos_dir,
+                repos,
+                commits,
+                seed,
+            })?;
+            println!("Seeded {} repositories", created.len());
+        }
+        Commands::Du { repos_dir, json } => {
+            let snapshot = usage::scan(&repos_dir)?;
+            if json {
+                println!("{}", serde_json::to_string_pretty(&snapshot)?);
+                return Ok(());
+            }
+
+            let mut repos: Vec<_> = snapshot.repos.iter().collect();
+            repos.sort_by(|a, b| b.1.bytes.cmp(&a.1.bytes));
+            for (name, repo) in repos {
+                println!(
+                    "{:>10}  {:>10}  {}{}",
+                    usage::format_bytes(repo.bytes),
+                    usage::format_bytes(repo.objects_bytes),
+                    name,
+                    if repo.alternates.is_empty() {
+                        ""
+                    } else {
+                        "  (uses alternates)"
+                    }
+                );
+            }
+
+            let namespaces = snapshot.namespaces();
+            if namespaces.keys().any(|ns| !ns.is_empty()) {
+                println!();
+                for (namespace, ns) in &namespaces {
+                    let name = if namespace.is_empty() {
+                        "(top level)"
+                    } else {
+                        namespace
+                    };
+                    println!(
+                        "{:>10}  {} repositories in {}",
+                        usage::format_bytes(ns.bytes),
+                        ns.repos,
+                        name
+                    );
+                }
+            }
+
+            println!();
+            println!(
+                "{:>10}  total ({} repositories)",
+                usage::format_bytes(snapshot.total()),
+                snapshot.repos.len()
+            );
+        }
+        Commands::Retention {
+            repos_dir,
+            ci_logs_days,
+            artifacts_days,
+            webhook_deliveries_days,
+            dry_run,
+        } => {
+            let policy = retention::Policy {
+                ci_logs_days,
+                artifacts_days,
+                webhook_deliveries_days,
+            };
+            retention::run(&repos_dir, &policy, dry_run)?.print();
+        }
+        Commands::Maintenance {
+            repos_dir,
+            tasks,
+            concurrency,
+            repos,
+        } => {
+            let schedule = maintenance::Schedule { tasks, concurrency };
+            let report = maintenance::run(&repos_dir, &schedule, &repos)?;
+            report.print();
+            if report.failures() > 0 {
+                std::process::exit(1);
+            }
+        }
+        Commands::Digest { data_dir, action } => match action {
+            DigestAction::List => {
+                for sub in digest::load(&data_dir)? {
+                    println!(
+                        "{} ({:?}): {}",
+                        sub.email,
+                        sub.frequency,
+                        sub.repos.join(", ")
+                    );
+                }
+            }
+            DigestAction::Subscribe {
+                email,
+                frequency,
+                repos,
+            } => {
+                let repos = repos.into_iter().map(with_git_suffix).collect();
+                digest::subscribe(
+                    &data_dir,
+                    digest::Subscription {
+                        email: email.clone(),
+                        frequency,
+                        repos,
+                        last_sent: None,
+                    },
+                )?;
+                println!("Subscribed {}", email);
+            }
+            DigestAction::Unsubscribe { email } => {
+                if digest::unsubscribe(&data_dir, &email)? {
+                    println!("Unsubscribed {}", email);
+                } else {
+                    println!("{} has no digest subscription", email);
+                }
+            }
+            DigestAction::Send { repos_dir, mail } => {
+                let mailer = mail.mailer()?;
+                let sent = digest::send_due(
+                    &repos_dir,
+                    &data_dir,
+                    &mailer,
+                    chrono::Utc::now().timestamp(),
+                )?;
+                println!("Sent {} digests", sent);
+            }
+        },
+        Commands::Watch { data_dir, action } => match action {
+            WatchAction::List => {
+                for w in watch::load(&data_dir)? {
+                    println!("{} {} {}", w.email, w.repo, w.refs);
+                }
+            }
+            WatchAction::Add { email, repo, refs } => {
+                let watch = watch::Watch {
+                    email,
+                    repo: with_git_suffix(repo),
+                    refs,
+                };
+                if watch::add(&data_dir, watch.clone())? {
+                    println!(
+                        "{} now watches {} in {}",
+                        watch.email, watch.refs, watch.repo
+                    );
+                } else {
+                    println!(
+                        "{} already watches {} in {}",
+                        watch.email, watch.refs, watch.repo
+                    );
+                }
+            }
+            WatchAction::Remove { email, repo, refs } => {
+                let watch = watch::Watch {
+                    email,
+                    repo: with_git_suffix(repo),
+                    refs,
+                };
+                if !watch::remove(&data_dir, &watch)? {
+                    anyhow::bail!(
+                        "{} does not watch {} in {}",
+                        watch.email,
+                        watch.refs,
+                        watch.repo
+                    );
+                }
+            }
+            WatchAction::Send { repos_dir, mail } => {
+                let mailer = mail.mailer()?;
+                let sent = watch::deliver(&repos_dir, &data_dir, &mailer)?;
+                println!("Sent {} alerts", sent);
+            }
+        },
+        Commands::Subscription { data_dir, action } => match action {
+            SubscriptionAction::List { user } => {
+                let found = match user {
+                    Some(user) => subscriptions::list(&data_dir, &user)?
+                        .into_iter()
+                        .map(|s| (user.clone(), s))
+                        .collect(),
+                    None => subscriptions::all(&data_dir)?,
+                };
+                for (user, s) in found {
+                    let mut wants = Vec::new();
+                    if !s.branches.is_empty() {
+                        wants.push(format!("pushes to {}", s.branches.join(",")));
+                    }
+                    if s.issues {
+                        wants.push("issues".to_string());
+                    }
+                    if s.pulls {
+                        wants.push("pull requests".to_string());
+                    }
+                    println!("{} {} {}", user, s.repo, wants.join(", "));
+                }
+            }
+            SubscriptionAction::Set {
+                user,
+                repo,
+                branches,
+                issues,
+                pulls,
+            } => {
+                if users::get(&data_dir, &user).is_none() {
+                    anyhow::bail!("No such user: {}", user);
+                }
+                let subscription = subscriptions::Subscription {
+                    repo: with_git_suffix(repo),
+                    branches: subscriptions::parse_branches(&branches),
+                    issues,
+                    pulls,
+                };
+                let (repo, unsubscribed) = (subscription.repo.clone(), subscription.is_empty());
+                subscriptions::set(&data_dir, &user, subscription)?;
+                if unsubscribed {
+                    println!("{} is no longer subscribed to {}", user, repo);
+                } else {
+                    println!("Updated {}'s subscription to {}", user, repo);
+                }
+            }
+            SubscriptionAction::Send {
+                repos_dir,
+                public_url,
+                mail,
+            } => {
+                let mailer = mail.mailer()?;
+                let sent = subscriptions::deliver(&repos_dir, &data_dir, &mailer, &public_url)?;
+                println!("Sent {} mails", sent);
+            }
+        },
+        Commands::Events { action } => match action {
+            EventsAction::Record { git_dir } => {
+                let mut input = String::new();
+                std::io::Read::read_to_string(&mut std::io::stdin(), &mut input)?;
+                let updates = events::parse_hook_input(&input);
+                let pusher = std::env::var("AGITO_USER").ok();
+                events::record(&git_dir, &updates, pusher.as_deref())?;
+                pulls::sync(&git_dir, &updates, pusher.as_deref())?;
+                // Only pushes through agito-server know where its audit log is
+                if let Some(server) = quota::Quotas::from_env() {
+                    let repo = server
+                        .repos_dir
+                        .canonicalize()
+                        .ok()
+                        .zip(git_dir.canonicalize().ok())
+                        .and_then(|(repos_dir, path)| {
+                            Some(
+                                path.strip_prefix(repos_dir)
+                                    .ok()?
+                                    .to_string_lossy()
+                                    .into_owned(),
+                            )
+                        })
+                        .unwrap_or_else(|| git_dir.display().to_string());
+                    audit::record_force_pushes(
+                        &server.data_dir,
+                        &repo,
+                        &git_dir,
+                        &updates,
+                        pusher.as_deref(),
+                    );
+                }
+            }
+            EventsAction::List {
+                git_dir,
+                refs,
+                limit,
+            } => {
+                for event in events::recent(&git_dir, refs.as_deref(), limit) {
+                    let time = chrono::DateTime::from_timestamp(event.time, 0)
+                        .map(|t| t.format("%Y-%m-%d %H:%M UTC").to_string())
+                        .unwrap_or_default();
+                    println!(
+                        "{}  {}  {}{}",
+                        time,
+                        &event.new[..event.new.len().min(8)],
+                        event.summary(),
+                        event
+                            .pusher
+                            .map(|p| format!(" by {}", p))
+                            .unwrap_or_default()
+                    );
+                }
+            }
+        },
+        Commands::Ci { action } => match action {
+            CiAction::Enqueue { git_dir } => {
+                let mut input = String::new();
+                std::io::Read::read_to_string(&mut std::io::stdin(), &mut input)?;
+                let pusher = std::env::var("AGITO_USER").ok();
+                for build in ci::enqueue(
+                    &git_dir,
+                    &events::parse_hook_input(&input),
+                    pusher.as_deref(),
+                )? {
+                    match &build.error {
+                        Some(e) => {
+                            println!("Build #{} of {} failed: {}", build.id, build.branch(), e)
+                        }
+                        None => println!("Queued build #{} of {}", build.id, build.branch()),
+                    }
+                }
+            }
+            CiAction::List { git_dir, limit } => {
+                for build in ci::list(&git_dir)?.into_iter().take(limit) {
+                    let time = chrono::DateTime::from_timestamp(build.created, 0)
+                        .map(|t| t.format("%Y-%m-%d %H:%M UTC").to_string())
+                        .unwrap_or_default();
+                    println!(
+                        "#{}  {}  {}  {}  {}",
+                        build.id,
+                        time,
+                        &build.commit[..build.commit.len().min(8)],
+                        build.status_name(),
+                        build.branch()
+                    );
+                }
+            }
+            CiAction::Retry { git_dir, id } => {
+                let build = ci::retry(&git_dir, id, None)?;
+                println!("Queued build #{}", build.id);
+            }
+        },
+        Commands::Webhook { action } => match action {
+            WebhookAction::List { git_dir } => {
+                for hook in webhooks::list(&git_dir)? {
+                    let events: Vec<&str> = hook.events.iter().map(|e| e.name()).collect();
+                    println!(
+                        "{}  {}  {}{}{}",
+                        hook.id,
+                        hook.url,
+                        if events.is_empty() {
+                            "all events".to_string()
+                        } else {
+                            events.join(",")
+                        },
+                        if hook.secret.is_some() {
+                            "  signed"
+                        } else {
+                            ""
+                        },
+                        if hook.active { "" } else { "  paused" }
+                    );
+                }
+            }
+            WebhookAction::Add {
+                git_dir,
+                url,
+                secret,
+                events,
+            } => {
+                let hook = webhooks::add(&git_dir, &url, secret.as_deref(), events)?;
+                println!("Added webhook {} to {}", hook.id, hook.url);
+            }
+            WebhookAction::Remove { git_dir, id } => {
+                webhooks::remove(&git_dir, id)?;
+                println!("Removed webhook {}", id);
+            }
+            WebhookAction::Deliveries {
+                git_dir,
+                hook,
+                limit,
+            } => {
+                for delivery in webhooks::deliveries(&git_dir, hook, limit)? {
+                    let time = chrono::DateTime::from_timestamp(delivery.created, 0)
+                        .map(|t| t.format("%Y-%m-%d %H:%M UTC").to_string())
+                        .unwrap_or_default();
+                    let status = delivery
+                        .attempts
+                        .last()
+                        .and_then(|attempt| attempt.status)
+                        .map(|status| format!("  HTTP {}", status))
+                        .unwrap_or_default();
+                    println!(
+                        "#{}  {}  {}  {}  {} attempts{}  {}",
+                        delivery.id,
+                        time,
+                        delivery.event.name(),
+                        delivery.state.name(),
+                        delivery.attempts.len(),
+                        status,
+                        delivery.url
+                    );
+                }
+            }
+            WebhookAction::Redeliver { git_dir, id } => {
+                let delivery = webhooks::redeliver(&git_dir, id)?;
+                println!("Queued delivery #{}", delivery.id);
+            }
+        },
+        Commands::Notify {
+            user,
+            reason,
+            repo,
+            title,
+            url,
+            data_dir,
+        } => {
+            let notification = notifications::push(&data_dir, &user, reason, &repo, &title, url)?;
+            println!("Notified {} (#{})", user, notification.id);
+        }
+        Commands::PackCache { command } => {
+            // Only clones through agito-server carry the cache size
+            match pack_cache::PackCache::from_env().and_then(|cache| cache.max_bytes) {
+                Some(max_bytes) => {
+                    pack_cache::serve(
+                        &std::env::current_dir()?,
+                        max_bytes,
+                        &command,
+                        std::io::stdin(),
+                        &mut std::io::stdout().lock(),
+                    )?;
+                }
+                None => {
+                    let status = std::process::Command::new(&command[0])
+                        .args(&command[1..])
+                        .status()?;
+                    std::process::exit(status.code().unwrap_or(1));
+                }
+            }
+        }
+        Commands::Policy { action } => match action {
+            PolicyAction::List { git_dir } => {
+                for policy in policies::Policy::ALL {
+                    match policies::value(&git_dir, policy) {
+                        Some(value) => println!("{}: {}", policy.name(), value),
+                        None => println!("{}: off", policy.name()),
+                    }
+                }
+            }
+            PolicyAction::Enable {
+                git_dir,
+                policy,
+                value,
+            } => {
+                let value = value.unwrap_or_else(|| policy.default_value().to_string());
+                policies::set(&git_dir, policy, Some(&value))?;
+                println!("{}: {}", policy.name(), value);
+            }
+            PolicyAction::Disable { git_dir, policy } => {
+                policies::set(&git_dir, policy, None)?;
+            }
+            PolicyAction::Check { git_dir } => {
+                let mut input = String::new();
+                std::io::Read::read_to_string(&mut std::io::stdin(), &mut input)?;
+                let violations = policies::check(&git_dir, &events::parse_hook_input(&input))?;
+                if !violations.is_empty() {
+                    eprint!("{}", policies::report(&violations));
+                    std::process::exit(1);
+                }
+            }
+        },
+        Commands::Protect { action } => match action {
+            ProtectAction::List { git_dir } => {
+                for rule in protection::rules(&git_dir) {
+                    println!("{}", rule);
+                }
+            }
+            ProtectAction::Add {
+                git_dir,
+                pattern,
+                allow_force_push,
+                allow_deletion,
+                require_pull_request,
+            } => {
+                let rule = protection::Rule {
+                    pattern: pattern.trim_start_matches("refs/heads/").to_string(),
+                    allow_force_push,
+                    allow_deletion,
+                    require_pull_request,
+                };
+                protection::protect(&git_dir, &rule)?;
+                println!("Protected {}", rule);
+            }
+            ProtectAction::Remove { git_dir, pattern } => {
+                if !protection::unprotect(&git_dir, &pattern)? {
+                    anyhow::bail!("{} is not protected", pattern);
+                }
+            }
+            ProtectAction::Check {
+                git_dir,
+                refname,
+                old,
+                new,
+            } => {
+                let violations =
+                    protection::check(&git_dir, &[(old, new, refname)], protection::Via::Push)?;
+                if !violations.is_empty() {
+                    eprint!("{}", policies::report(&violations));
+                    std::process::exit(1);
+                }
+            }
+        },
+        Commands::Quota { data_dir, action } => match action {
+            QuotaAction::List => {
+                for (user, bytes) in quota::load_user_quotas(&data_dir)? {
+                    if bytes == 0 {
+                        println!("{}: unlimited", user);
+                    } else {
+                        println!("{}: {}", user, usage::format_bytes(bytes));
+                    }
+                }
+            }
+            QuotaAction::Set { user, size } => {
+                quota::set_user_quota(&data_dir, &user, Some(size))?;
+            }
+            QuotaAction::Unset { user } => {
+                quota::set_user_quota(&data_dir, &user, None)?;
+            }
+            QuotaAction::Check { git_dir } => {
+                // Only pushes through agito-server carry quota settings
+                let quotas = match quota::Quotas::from_env() {
+                    Some(quotas) => quotas,
+                    None => return Ok(()),
+                };
+                if let Some(reason) = quotas.status(&git_dir)?.exceeded() {
+                    eprintln!("Push rejected: {}", reason);
+                    std::process::exit(1);
+                }
+            }
+        },
+        Commands::User { data_dir, action } => match action {
+            UserAction::List => {
+                for (name, user) in users::load(&data_dir)? {
+                    println!(
+                        "{} <{}>: {}{}{}",
+                        name,
+                        user.email,
+                        user.state.name(),
+                        if user.admin { ", admin" } else { "" },
+                        if user.password.is_none() {
+                            ", key-only"
+                        } else {
+                            ""
+                        }
+                    );
+                }
+            }
+            UserAction::Add {
+                name,
+                email,
+                display_name,
+                admin,
+                password_stdin,
+                keys,
+            } => {
+                let mut user = users::User::new(
+                    display_name.as_deref().unwrap_or(&name),
+                    &email,
+                    users::State::Active,
+                );
+                user.admin = admin;
+                if password_stdin {
+                    user.password = Some(users::hash_password(&read_password()?)?);
+                }
+                for key in keys {
+                    user.keys.push(users::normalize_key(&key)?);
+                }
+                users::create(&data_dir, &name, user)?;
+                record_audit(&data_dir, audit::Action::AccountChange, &name, "created");
+                println!("Created {}", name);
+            }
+            UserAction::Approve { name } => {
+                users::update(&data_dir, &name, |user| {
+                    user.state = users::State::Active;
+                    Ok(())
+                })?;
+                record_audit(&data_dir, audit::Action::AccountChange, &name, "approved");
+                println!("Approved {}", name);
+            }
+            UserAction::Disable { name } => {
+                users::update(&data_dir, &name, |user| {
+                    user.state = users::State::Disabled;
+                    Ok(())
+                })?;
+                record_audit(&data_dir, audit::Action::AccountChange, &name, "disabled");
+                println!("Disabled {}", name);
+            }
+            UserAction::Promote { name, revoke } => {
+                users::update(&data_dir, &name, |user| {
+                    user.admin = !revoke;
+                    Ok(())
+                })?;
+                let change = if revoke {
+                    "admin revoked"
+                } else {
+                    "made admin"
+                };
+                record_audit(&data_dir, audit::Action::AccountChange, &name, change);
+            }
+            UserAction::Passwd { name } => {
+                let hash = users::hash_password(&read_password()?)?;
+                users::update(&data_dir, &name, |user| {
+                    user.password = Some(hash);
+                    Ok(())
+                })?;
+                record_audit(
+                    &data_dir,
+                    audit::Action::AccountChange,
+                    &name,
+                    "password set",
+                );
+            }
+            UserAction::Key { name, key } => {
+                let key = users::normalize_key(&key)?;
+                users::update(&data_dir, &name, |user| {
+                    if !user.keys.contains(&key) {
+                        user.keys.push(key.clone());
+                    }
+                    Ok(())
+                })?;
+                record_audit(
+                    &data_dir,
+                    audit::Action::KeyAdd,
+                    &name,
+                    &audit::key_fingerprint(&key),
+                );
+            }
+        },
+        Commands::Token { data_dir, action } => match action {
+            TokenAction::List { user } => {
+                let now = chrono::Utc::now().timestamp();
+                for token in tokens::load(&data_dir)? {
+                    if user.as_ref().map_or(false, |user| *user != token.user) {
+                        continue;
+                    }
+                    let expires = match token.expires {
+                        Some(_) if token.expired(now) => "expired".to_string(),
+                        Some(expires) => chrono::DateTime::from_timestamp(expires, 0)
+                            .map(|t| format!("expires {}", t.format("%Y-%m-%d")))
+                            .unwrap_or_default(),
+                        None => "no expiry".to_string(),
+                    };
+                    println!(
+                        "{} {} {} {} ({})",
+                        token.id,
+                        token.user,
+                        token.scope.name(),
+                        token.name,
+                        expires
+                    );
+                }
+            }
+            TokenAction::Create {
+                user,
+                name,
+                scope,
+                expires_in_days,
+            } => {
+                let expires = expires_in_days
+                    .map(|days| chrono::Utc::now().timestamp() + i64::from(days) * 24 * 3600);
+                let (token, secret) = tokens::create(&data_dir, &user, &name, scope, expires)?;
+                record_audit(
+                    &data_dir,
+                    audit::Action::TokenCreate,
+                    &user,
+                    &format!("token {} ({}, {})", token.id, token.name, scope.name()),
+                );
+                eprintln!(
+                    "Created {} token {} for {}; it won't be shown again:",
+                    scope.name(),
+                    token.id,
+                    user
+                );
+                println!("{}", secret);
+            }
+            TokenAction::Revoke { id } => {
+                let token = tokens::revoke(&data_dir, None, id)?;
+                record_audit(
+                    &data_dir,
+                    audit::Action::TokenRevoke,
+                    &token.user,
+                    &format!("token {} ({})", token.id, token.name),
+                );
+                println!(
+                    "Revoked token {} of {} ({})",
+                    token.id, token.user, token.name
+                );
+            }
+        },
+        Commands::Audit { data_dir, action } => match action {
+            AuditAction::List {
+                action,
+                actor,
+                repo,
+                limit,
+            } => {
+                let filter = audit::Filter {
+                    action,
+                    actor,
+                    repo,
+                    before: None,
+                };
+                for entry in audit::query(&data_dir, &filter, limit)? {
+                    let time = chrono::DateTime::from_timestamp(entry.time, 0)
+                        .map(|t| t.format("%Y-%m-%d %H:%M:%S UTC").to_string())
+                        .unwrap_or_default();
+                    println!(
+                        "{}  {}  {}  {} via {}{}{}{}{}",
+                        entry.id,
+                        time,
+                        entry.action,
+                        entry.actor.as_deref().unwrap_or("-"),
+                        entry.via.name(),
+                        entry
+                            .repo
+                            .map(|repo| format!(" repo={}", repo))
+                            .unwrap_or_default(),
+                        entry
+                            .target
+                            .map(|target| format!(" target={}", target))
+                            .unwrap_or_default(),
+                        entry
+                            .remote
+                            .map(|remote| format!(" from {}", remote))
+                            .unwrap_or_default(),
+                        if entry.detail.is_empty() {
+                            String::new()
+                        } else {
+                            format!(": {}", entry.detail)
+                        }
+                    );
+                }
+            }
+        },
+        Commands::Org {
+            data_dir,
+            repos_dir,
+            action,
+        } => match action {
+            OrgAction::List => {
+                for (name, org) in orgs::load(&data_dir)? {
+                    let join = |set: &std::collections::BTreeSet<String>| {
+                        set.iter().cloned().collect::<Vec<_>>().join(", ")
+                    };
+                    println!(
+                        "{}: owners {}; members {}; base role {}",
+                        name,
+                        join(&org.owners),
+                        if org.members.is_empty() {
+                            "none".to_string()
+                        } else {
+                            join(&org.members)
+                        },
+                        org.base_role.map_or("none", |role| role.name())
+                    );
+                    for (team_name, team) in &org.teams {
+                        println!(
+                            "  team {} ({}): members {}; repositories {}",
+                            team_name,
+                            team.role.name(),
+                            join(&team.members),
+                            join(&team.repos)
+                        );
+                    }
+                }
+            }
+            OrgAction::Create {
+                name,
+                owner,
+                display_name,
+            } => {
+                if !namespaces::valid_user(&owner) {
+                    anyhow::bail!("Invalid user name '{}'", owner);
+                }
+                let org = orgs::Org::new(display_name.as_deref().unwrap_or(&name), &owner);
+                orgs::create(&data_dir, &repos_dir, &name, org)?;
+                record_audit(
+                    &data_dir,
+                    audit::Action::OrgChange,
+                    &name,
+                    &format!("created, owned by {}", owner),
+                );
+                println!("Created {}, owned by {}", name, owner);
+            }
+            OrgAction::Delete { name } => {
+                if !orgs::delete(&data_dir, &repos_dir, &name)? {
+                    anyhow::bail!("No such organization: {}", name);
+                }
+                record_audit(&data_dir, audit::Action::OrgChange, &name, "deleted");
+            }
+            OrgAction::AddMember { org, user, owner } => {
+                orgs::update(&data_dir, &org, |o| o.add_member(&user, owner))?;
+                let change = format!(
+                    "added {} as {}",
+                    user,
+                    if owner { "owner" } else { "member" }
+                );
+                record_audit(&data_dir, audit::Action::OrgChange, &org, &change);
+            }
+            OrgAction::RemoveMember { org, user } => {
+                orgs::update(&data_dir, &org, |o| o.remove_member(&user))?;
+                let change = format!("removed {}", user);
+                record_audit(&data_dir, audit::Action::OrgChange, &org, &change);
+            }
+            OrgAction::BaseRole { org, role } => {
+                let role = match role.as_str() {
+                    "none" => None,
+                    role => Some(role.parse::<orgs::Role>().map_err(anyhow::Error::msg)?),
+                };
+                orgs::update(&data_dir, &org, |o| {
+                    o.base_role = role;
+                    Ok(())
+                })?;
+                let change = format!("base role {}", role.map_or("none", |role| role.name()));
+                record_audit(&data_dir, audit::Action::OrgChange, &org, &change);
+            }
+            OrgAction::Team { org, action } => {
+                let change = match &action {
+                    TeamAction::Set { team, role } => {
+                        format!("team {} set to {}", team, role.name())
+                    }
+                    TeamAction::Delete { team } => format!("team {} deleted", team),
+                    TeamAction::AddMember { team, user } => {
+                        format!("added {} to team {}", user, team)
+                    }
+                    TeamAction::RemoveMember { team, user } => {
+                        format!("removed {} from team {}", user, team)
+                    }
+                    TeamAction::Grant { team, repo } => {
+                        format!("granted {} to team {}", repo, team)
+                    }
+                    TeamAction::Revoke { team, repo } => {
+                        format!("revoked {} from team {}", repo, team)
+                    }
+                };
+                orgs::update(&data_dir, &org, |o| match action {
+                    TeamAction::Set { team, role } => o.set_team(&team, role),
+                    TeamAction::Delete { team } => {
+                        if o.teams.remove(&team).is_none() {
+                            anyhow::bail!("No such team: {}", team);
+                        }
+                        Ok(())
+                    }
+                    TeamAction::AddMember { team, user } => o.add_to_team(&team, &user),
+                    TeamAction::RemoveMember { team, user } => {
+                        o.team_mut(&team)?.members.remove(&user);
+                        Ok(())
+                    }
+                    TeamAction::Grant { team, repo } => o.grant(&team, &repo),
+                    TeamAction::Revoke { team, repo } => o.revoke(&team, &repo),
+                })?;
+                record_audit(&data_dir, audit::Action::OrgChange, &org, &change);
+            }
+        },
+        Commands::Namespace { data_dir, action } => match action {
+            NamespaceAction::List => {
+                for (user, limits) in namespaces::load(&data_dir)? {
+                    let max_repos = match limits.max_repos {
+                        Some(0) => "unlimited".to_string(),
+                        Some(max) => max.to_string(),
+                        None => "default".to_string(),
+                    };
+                    println!(
+                        "{}: max repos {}{}",
+                        user,
+                        max_repos,
+                        if limits.top_level { ", top-level" } else { "" }
+                    );
+                }
+            }
+            NamespaceAction::Set {
+                user,
+                max_repos,
+                top_level,
+            } => {
+                if !namespaces::valid_user(&user) {
+                    anyhow::bail!("'{}' cannot be used as a namespace", user);
+                }
+                namespaces::set(
+                    &data_dir,
+                    &user,
+                    Some(namespaces::UserLimits {
+                        max_repos,
+                        top_level,
+                    }),
+                )?;
+            }
+            NamespaceAction::Unset { user } => {
+                namespaces::set(&data_dir, &user, None)?;
+            }
+        },
+        Commands::Mirror {
+            repos_dir,
+            data_dir,
+            action,
+        } => {
+            let resolver = redirects::Resolver {
+                repos_dir: repos_dir.clone(),
+                ..Default::default()
+            };
+            let find = |repo: &str| -> Result<PathBuf> {
+                resolver
+                    .resolve(repo)
+                    .map(|name| repos_dir.join(name))
+                    .ok_or_else(|| anyhow::anyhow!("Repository not found: {}", repo))
+            };
+
+            match action {
+                MirrorAction::List { repo } => {
+                    let repos = match repo {
+                        Some(repo) => vec![(repo.clone(), find(&repo)?)],
+                        None => git::find_repositories(&repos_dir)?,
+                    };
+                    for (name, path) in repos {
+                        for m in mirror::list(&path) {
+                            let status = mirror::status(&path, &m.name);
+                            let state = match (&status.error, status.last_success) {
+                                (Some(error), _) => match status
+                                    .failing_since
+                                    .and_then(|at| chrono::DateTime::from_timestamp(at, 0))
+                                {
+                                    Some(since) => format!(
+                                        "failing since {}: {}",
+                                        since.format("%Y-%m-%d %H:%M UTC"),
+                                        error
+                                    ),
+                                    None => format!("failed: {}", error),
+                                },
+                                (None, Some(at)) => match chrono::DateTime::from_timestamp(at, 0) {
+                                    Some(at) => {
+                                        format!("synced {}", at.format("%Y-%m-%d %H:%M UTC"))
+                                    }
+                                    None => "synced".to_string(),
+                                },
+                                (None, None) => "not synced yet".to_string(),
+                            };
+                            let credentials = mirror::credentials(&path, &m.name)
+                                .map(|c| format!(" [{}]", c.kind()))
+                                .unwrap_or_default();
+                            println!(
+                                "{} {} {} {}{} ({})",
+                                name,
+                                m.name,
+                                m.direction.name(),
+                                mirror::redact(&m.url),
+                                credentials,
+                                state
+                            );
+                        }
+                    }
+                }
+                MirrorAction::Add {
+                    repo,
+                    direction,
+                    url,
+                    name,
+                    interval,
+                    credentials,
+                } => {
+                    let name = name.unwrap_or_else(|| {
+                        match direction {
+                            mirror::Direction::Pull => "upstream",
+                            mirror::Direction::Push => "backup",
+                        }
+                        .to_string()
+                    });
+                    let credentials = credentials.read()?;
+                    let path = find(&repo)?;
+                    mirror::add(&path, &name, direction, &url, interval)?;
+                    if let Err(e) = mirror::set_credentials(&path, &name, credentials.as_ref()) {
+                        let _ = mirror::remove(&path, &name);
+                        return Err(e);
+                    }
+                    record_mirror_change(
+                        &data_dir,
+                        &repo,
+                        &name,
+                        format!(
+                            "added {} mirror {}",
+                            direction.name(),
+                            mirror::redact(&mirror::expand_url(&url))
+                        ),
+                    );
+                    println!("Added {} mirror {} to {}", direction.name(), name, repo);
+                }
+                MirrorAction::Remove { repo, name } => {
+                    mirror::remove(&find(&repo)?, &name)?;
+                    record_mirror_change(&data_dir, &repo, &name, "removed".to_string());
+                }
+                MirrorAction::Credentials {
+                    repo,
+                    name,
+                    credentials,
+                } => {
+                    let credentials = credentials.read()?;
+                    mirror::set_credentials(&find(&repo)?, &name, credentials.as_ref())?;
+                    let change = match &credentials {
+                        Some(c) => format!("stored a {}", c.kind()),
+                        None => "removed the credentials".to_string(),
+                    };
+                    record_mirror_change(&data_dir, &repo, &name, change.clone());
+                    println!("{}: {}", name, change);
+                }
+                MirrorAction::Sync { repo, name } => {
+                    let path = find(&repo)?;
+                    let mirrors: Vec<_> = mirror::list(&path)
+                        .into_iter()
+                        .filter(|m| name.as_ref().map_or(true, |n| &m.name == n))
+                        .collect();
+                    if mirrors.is_empty() {
+                        anyhow::bail!("No mirrors to sync in {}", repo);
+                    }
+                    let mut failed = false;
+                    for m in &mirrors {
+                        match mirror::sync(&path, m) {
+                            Ok(()) => println!("{}: synced", m.name),
+                            Err(e) => {
+                                eprintln!("{}: {:#}", m.name, e);
+                                failed = true;
+                            }
+                        }
+                    }
+                    if failed {
+                        std::process::exit(1);
+                    }
+                }
+            }
+        }
+        Commands::Redirect {
+            data_dir,
+            repos_dir,
+            action,
+        } => match action {
+            RedirectAction::List => {
+                let now = chrono::Utc::now().timestamp();
+                for (from, redirect) in redirects::load(&data_dir)? {
+                    let expiry = match redirect.expires {
+                        _ if redirect.is_expired(now) => " (expired)".to_string(),
+                        Some(expires) => chrono::DateTime::from_timestamp(expires, 0)
+                            .map(|t| format!(" (until {})", t.format("%Y-%m-%d")))
+                            .unwrap_or_default(),
+                        None => String::new(),
+                    };
+                    println!("{} -> {}{}", from, redirect.to, expiry);
+                }
+            }
+            RedirectAction::Add { from, to, days } => {
+                let resolver = redirects::Resolver {
+                    repos_dir,
+                    ..Default::default()
+                };
+                if resolver.resolve(&to).is_none() {
+                    anyhow::bail!("Repository not found: {}", to);
+                }
+                if let Some(existing) = resolver.resolve(&from) {
+                    eprintln!(
+                        "Warning: {} exists and takes precedence over the redirect",
+                        existing
+                    );
+                }
+                redirects::add(&data_dir, &from, &to, days)?;
+            }
+            RedirectAction::Remove { from } => {
+                if !redirects::remove(&data_dir, &from)? {
+                    anyhow::bail!("No redirect for {}", from);
+                }
+            }
+        },
+        Commands::Repo {
+            data_dir,
+            repos_dir,
+            action,
+        } => {
+            let resolver = redirects::Resolver {
+                repos_dir: repos_dir.clone(),
+                ..Default::default()
+            };
+            let find = |repo: &str| -> Result<(String, PathBuf)> {
+                resolver
+                    .resolve(repo)
+                    .map(|name| (name.clone(), repos_dir.join(name)))
+                    .ok_or_else(|| anyhow::anyhow!("Repository not found: {}", repo))
+            };
+
+            match &action {
+                RepoAction::Archived => {
+                    for (name, path) in git::find_repositories(&repos_dir)? {
+                        if archive::is_archived(&path) {
+                            println!("{}", name);
+                        }
+                    }
+                }
+                RepoAction::Archive { repo } | RepoAction::Unarchive { repo } => {
+                    let archived = matches!(action, RepoAction::Archive { .. });
+                    let (name, path) = find(repo)?;
+                    archive::set(&path, archived)?;
+                    let change = if archived { "archived" } else { "unarchived" };
+                    audit::Entry::new(
+                        audit::Action::RepoArchive,
+                        audit::Via::Cli,
+                        local_user().as_deref(),
+                    )
+                    .with_repo(&name)
+                    .with_detail(change)
+                    .record(&data_dir);
+                    println!("{} {}", name, change);
+                }
+                RepoAction::Rename {
+                    repo,
+                    to,
+                    redirect_days,
+                } => {
+                    let (name, _) = find(repo)?;
+                    let to = namespaces::qualified_name(to)?;
+                    let days = Some(*redirect_days).filter(|&days| days > 0);
+                    redirects::rename(&repos_dir, &data_dir, &name, &to, days)?;
+                    audit::Entry::new(
+                        audit::Action::RepoRename,
+                        audit::Via::Cli,
+                        local_user().as_deref(),
+                    )
+                    .with_repo(&to)
+                    .with_target(&name)
+                    .with_detail(format!("renamed from {}", name))
+                    .record(&data_dir);
+                    println!("Renamed {} to {}", name, to);
+                }
+                RepoAction::Visibility { repo, visibility } => {
+                    let (name, path) = find(repo)?;
+                    match visibility {
+                        None => {
+                            let in_org = orgs::in_org(&data_dir, &name);
+                            println!("{}", visibility::effective(&path, in_org).name());
+                        }
+                        Some(chosen) => {
+                            visibility::set(&path, *chosen)?;
+                            record_repo_access(
+                                &data_dir,
+                                &name,
+                                format!("visibility {}", chosen.name()),
+                            );
+                            println!("{} is now {}", name, chosen.name());
+                        }
+                    }
+                }
+                RepoAction::Export { repo } | RepoAction::Unexport { repo } => {
+                    let exported = matches!(action, RepoAction::Export { .. });
+                    let (name, path) = find(repo)?;
+                    git_daemon::set_exported(&path, exported)?;
+                    let change = if exported { "exported" } else { "unexported" };
+                    record_repo_access(&data_dir, &name, format!("{} over git://", change));
+                    println!("{} {} over git://", name, change);
+                }
+                RepoAction::Collaborators { repo } => {
+                    let (_, path) = find(repo)?;
+                    for (user, role) in visibility::collaborators(&path)? {
+                        println!("{}  {}", user, role.name());
+                    }
+                }
+                RepoAction::Collaborator { repo, user, role } => {
+                    let (name, path) = find(repo)?;
+                    if !namespaces::valid_user(user) {
+                        anyhow::bail!("Invalid user name '{}'", user);
+                    }
+                    let role = match role.as_str() {
+                        "none" => None,
+                        role => Some(role.parse::<orgs::Role>().map_err(anyhow::Error::msg)?),
+                    };
+                    visibility::set_collaborator(&path, user, role)?;
+                    let change = match role {
+                        Some(role) => format!("collaborator {} {}", user, role.name()),
+                        None => format!("collaborator {} removed", user),
+                    };
+                    record_repo_access(&data_dir, &name, change.clone());
+                    println!("{}: {}", name, change);
+                }
+            }
+        }
+    }
+
+    Ok(())
+}
+
+/// Repository names as stored in subscriptions, always with the .git suffix
+fn with_git_suffix(repo: String) -> String {
+    if repo.ends_with(".git") {
+        repo
+    } else {
+        format!("{}.git", repo)
+    }
+}
+
+/// Record a change made with this tool in the audit log, as the local user
+/// running it
+fn record_audit(data_dir: &Path, action: audit::Action, target: &str, detail: &str) {
+    audit::Entry::new(action, audit::Via::Cli, local_user().as_deref())
+        .with_target(target)
+        .with_detail(detail)
+        .record(data_dir);
+}
+
+fn record_repo_access(data_dir: &Path, repo: &str, detail: String) {
+    audit::Entry::new(
+        audit::Action::RepoAccess,
+        audit::Via::Cli,
+        local_user().as_deref(),
+    )
+    .with_repo(repo)
+    .with_detail(detail)
+    .record(data_dir);
+}
+
+fn record_mirror_change(data_dir: &Path, repo: &str, name: &str, detail: String) {
+    audit::Entry::new(
+        audit::Action::MirrorChange,
+        audit::Via::Cli,
+        local_user().as_deref(),
+    )
+    .with_repo(repo)
+    .with_target(name)
+    .with_detail(detail)
+    .record(data_dir);
+}
+
+/// Who is running this tool, behind sudo if need be
+fn local_user() -> Option<String> {
+    std::env::var("SUDO_USER")
+        .or_else(|_| std::env::var("USER"))
+        .ok()
+}
+
+/// First line of stdin, without its line ending
+fn read_password() -> Result<String> {
+    let mut line = String::new();
+    std::io::stdin().read_line(&mut line)?;
+    Ok(line.trim_end_matches(['\r', '\n']).to_string())
+}
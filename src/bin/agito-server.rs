@@ -1,92 +1,1750 @@
-use agito::{ssh, web};
+use agito::{
+    archive, audit, backup, ci, clone_urls, config, digest, federation, git, git_daemon, hooks, host_keys, import, ip_access, jobs, lfs, listeners, mail, maintenance, maintenance_mode, migrate,
+    mirror, namespaces, orgs, pack_cache, quota, rate_limit, redirects, retention, search, signatures, ssh, stats, subscriptions, telemetry, trash, usage, users,
+    visibility, watch, web, webhooks,
+};
 use anyhow::Result;
-use clap::Parser;
+use clap::{Parser, Subcommand};
 use std::path::PathBuf;
+use std::time::Duration;
 use tokio::signal;
 
 #[derive(Parser, Debug)]
 #[command(name = "agito-server")]
 #[command(about = "Agito Git Server", long_about = None)]
+#[command(args_override_self = true)]
 struct Args {
+    #[command(subcommand)]
+    command: Option<Command>,
+
+    /// Read options from this file, one `name = value` per line (e.g. `http-port = 8080`),
+    /// before the command line. SIGHUP rereads it; see the README for what a reload changes.
+    #[arg(long, global = true)]
+    config: Option<PathBuf>,
+
     /// Directory to store repositories
-    #[arg(long, default_value = "/var/lib/agito/repos")]
+    #[arg(long, global = true, default_value = "/var/lib/agito/repos")]
     repos: PathBuf,
 
     /// HTTP port for web viewer
-    #[arg(long, default_value = "3000")]
+    #[arg(long, global = true, default_value = "3000")]
     http_port: String,
 
     /// SSH port for git operations
     #[arg(long, default_value = "2222")]
     ssh_port: String,
 
-    /// SSH host key file
-    #[arg(long, default_value = "/var/lib/agito/ssh/host_key")]
+    /// Serve anonymous clones of public repositories marked for export over
+    /// git:// on this port, usually 9418 (off if unset)
+    #[arg(long)]
+    git_daemon_port: Option<u16>,
+
+    /// SSH host key file; keys of the other types are kept next to it, e.g.
+    /// host_key_ed25519
+    #[arg(long, global = true, default_value = "/var/lib/agito/ssh/host_key")]
     ssh_key: PathBuf,
 
     /// Authorized keys file
-    #[arg(long, default_value = "/var/lib/agito/ssh/authorized_keys")]
+    #[arg(long, global = true, default_value = "/var/lib/agito/ssh/authorized_keys")]
     authorized_keys: PathBuf,
+
+    /// HTTP access log format (common, combined or json)
+    #[arg(long, default_value = "common")]
+    access_log_format: web::AccessLogFormat,
+
+    /// Write the HTTP access log to this file ("-" for stdout) instead of the application log
+    #[arg(long)]
+    access_log: Option<String>,
+
+    /// Trust X-Forwarded-For for client addresses, taking the last address,
+    /// which the proxy appended (only behind a reverse proxy)
+    #[arg(long)]
+    trust_proxy: bool,
+
+    /// Avatar source for commit authors: local identicons, gravatar or libravatar.
+    /// The remote services learn which addresses are viewed, so they are opt-in.
+    #[arg(long, default_value = "local")]
+    avatars: web::AvatarSource,
+
+    /// URL the web server is reachable at from clients (e.g. https://git.example.com),
+    /// used for absolute links and Git LFS transfers. Defaults to http://localhost:<http-port>
+    /// for LFS and to the request's Host header elsewhere.
+    #[arg(long, global = true)]
+    public_url: Option<String>,
+
+    /// Host name clients reach the server at, for the clone URLs shown in the web
+    /// interface, the API and `agito create`. Defaults to the host of --public-url,
+    /// then localhost.
+    #[arg(long)]
+    public_host: Option<String>,
+
+    /// SSH port clients connect to, for clone URLs, when it differs from --ssh-port
+    /// (e.g. behind NAT or a load balancer)
+    #[arg(long)]
+    public_ssh_port: Option<u16>,
+
+    /// Directory of hook templates named after the hook (pre-receive, update,
+    /// post-receive, post-update), replacing the built-in ones. Templates may use
+    /// {{repo}}, {{repo_path}} and {{public_url}}.
+    #[arg(long, global = true)]
+    hook_templates: Option<PathBuf>,
+
+    /// Let search engines crawl repository pages (allow) or keep them all out (deny).
+    /// Repositories can opt out individually with agito.noindex.
+    #[arg(long, default_value = "allow")]
+    robots: web::RobotsPolicy,
+
+    /// Seconds between sitemap regenerations (0 disables /sitemap.xml)
+    #[arg(long, default_value = "21600")]
+    sitemap_interval: u64,
+
+    /// Comma-separated glob patterns of repositories the index and sitemap list,
+    /// e.g. 'public-*' (all if unset). Other repositories are still served by name.
+    #[arg(long, value_delimiter = ',')]
+    index_allow: Vec<String>,
+
+    /// Comma-separated glob patterns of repositories never listed, e.g. '*-archive.git'
+    #[arg(long, value_delimiter = ',')]
+    index_deny: Vec<String>,
+
+    /// GnuPG home directory with the public keys of trusted signers, for verifying
+    /// GPG-signed commits and tags (the server user's keyring if unset)
+    #[arg(long)]
+    gpg_home: Option<PathBuf>,
+
+    /// ssh-keygen allowed signers file, for verifying SSH-signed commits and tags
+    #[arg(long)]
+    allowed_signers: Option<PathBuf>,
+
+    /// Find repositories by names that differ only in case, e.g. /repo/MyRepo.git for myrepo.git
+    #[arg(long)]
+    case_insensitive_repos: bool,
+
+    /// Days the old name of a renamed repository keeps working, for SSH
+    /// remotes and web links (0 keeps it for ever)
+    #[arg(long, default_value_t = redirects::DEFAULT_DAYS)]
+    rename_redirect_days: u64,
+
+    /// Redirect cgit-style URLs (/<repo>/tree/<path>?h=<ref>, ...) to agito pages
+    #[arg(long)]
+    cgit_urls: bool,
+
+    /// Seconds between repository disk usage scans (0 disables the scanner)
+    #[arg(long, default_value = "3600")]
+    usage_scan_interval: u64,
+
+    /// Days to keep CI logs; repositories can override with agito.retention.ciLogsDays (0 keeps forever)
+    #[arg(long, default_value = "90")]
+    retention_ci_logs_days: u64,
+
+    /// Days to keep CI artifacts; override with agito.retention.artifactsDays (0 keeps forever)
+    #[arg(long, default_value = "30")]
+    retention_artifacts_days: u64,
+
+    /// Days to keep webhook delivery records; override with agito.retention.webhookDeliveriesDays (0 keeps forever)
+    #[arg(long, default_value = "14")]
+    retention_webhook_deliveries_days: u64,
+
+    /// Days deleted repositories stay in the trash, restorable with
+    /// `agito-server admin trash restore`, before being purged (0 keeps them until purged by hand)
+    #[arg(long, default_value = "30")]
+    trash_retention_days: u64,
+
+    /// Seconds between repository maintenance runs (0 disables maintenance)
+    #[arg(long, default_value = "86400")]
+    maintenance_interval: u64,
+
+    /// Comma-separated maintenance tasks: gc, repack, commit-graph, fsck, caches
+    #[arg(long, value_delimiter = ',', default_value = "gc,commit-graph")]
+    maintenance_tasks: Vec<maintenance::Task>,
+
+    /// Number of repositories maintained at once
+    #[arg(long, default_value = "2")]
+    maintenance_concurrency: usize,
+
+    /// Seconds between checks for pull mirrors due to fetch (0 disables pull mirroring).
+    /// Each mirror's own interval decides how often it is actually fetched.
+    #[arg(long, default_value = "60")]
+    mirror_check_interval: u64,
+
+    /// Seconds between checks for repositories whose default branch moved
+    /// since the code search index was built (0 disables code search)
+    #[arg(long, default_value = "0")]
+    search_index_interval: u64,
+
+    /// Seconds between checks for repositories whose branches or tags moved
+    /// since their statistics were computed (0 disables the statistics)
+    #[arg(long, default_value = "30")]
+    stats_interval: u64,
+
+    /// Number of CI builds run at once (0, the default, disables the built-in runner)
+    #[arg(long, default_value = "0")]
+    ci_runners: usize,
+
+    /// Seconds between checks for queued CI builds
+    #[arg(long, default_value = "5")]
+    ci_poll_interval: u64,
+
+    /// Directory CI builds check their commit out in
+    #[arg(long, default_value = "/var/lib/agito/ci")]
+    ci_workspace_dir: PathBuf,
+
+    /// docker, podman or a compatible CLI to run the steps of pipelines that name
+    /// an image; such pipelines fail if unset
+    #[arg(long)]
+    ci_container_runtime: Option<String>,
+
+    /// Longest a CI build may take, e.g. 30m or 2h; pipelines may set a shorter timeout
+    #[arg(long, default_value = "1h", value_parser = ci::pipeline::parse_duration)]
+    ci_timeout: Duration,
+
+    /// Seconds between checks for webhook deliveries due to be sent (0 disables webhooks)
+    #[arg(long, default_value = "5")]
+    webhook_poll_interval: u64,
+
+    /// curl binary used to send webhooks and SMTP mail
+    #[arg(long, global = true, default_value = "curl")]
+    curl: PathBuf,
+
+    /// Longest a webhook may take to respond before the attempt counts as failed
+    #[arg(long, default_value = "10s", value_parser = ci::pipeline::parse_duration)]
+    webhook_timeout: Duration,
+
+    /// Publish public repositories as ForgeFed actors that other forges and the
+    /// fediverse can follow for pushes, releases and issues. Needs --public-url.
+    #[arg(long)]
+    federation: bool,
+
+    /// Default size limit per repository, e.g. 2G; repositories can override it
+    /// with agito.quota (unlimited if unset)
+    #[arg(long, value_parser = usage::parse_size)]
+    repo_quota: Option<u64>,
+
+    /// Default size limit for all repositories in a user's namespace, e.g. 10G;
+    /// set per user with `agito-admin quota set` (unlimited if unset)
+    #[arg(long, value_parser = usage::parse_size)]
+    user_quota: Option<u64>,
+
+    /// Default limit of repositories a user may create in their namespace; set per
+    /// user with `agito-admin namespace set` (unlimited if unset)
+    #[arg(long)]
+    max_repos_per_user: Option<usize>,
+
+    /// Who may create top-level repositories outside a namespace: anyone, or only
+    /// users granted it with `agito-admin namespace set --top-level` (granted)
+    #[arg(long, default_value = "anyone")]
+    top_level_repos: namespaces::TopLevel,
+
+    /// Visibility of repositories created or imported without naming one:
+    /// public (anyone may read), internal (signed-in users) or private
+    /// (collaborators and the owning namespace or organization only)
+    #[arg(long, default_value = "public")]
+    default_visibility: visibility::Visibility,
+
+    /// Web and API requests per second allowed from one client address, with
+    /// bursts of twice as many (unlimited if unset)
+    #[arg(long)]
+    rate_limit_requests: Option<f64>,
+
+    /// Requests one client address may make at once before
+    /// --rate-limit-requests applies (default: twice the rate)
+    #[arg(long)]
+    rate_limit_burst: Option<f64>,
+
+    /// Clones and fetches one client address, or one user, may run at once
+    /// (unlimited if unset)
+    #[arg(long)]
+    max_concurrent_clones: Option<usize>,
+
+    /// Pushes per minute allowed for one user, or one client address when
+    /// pushing anonymously (unlimited if unset)
+    #[arg(long)]
+    max_pushes_per_minute: Option<f64>,
+
+    /// git-upload-pack processes, serving clones and fetches, run at once over
+    /// all clients; more wait for a place (unlimited if unset)
+    #[arg(long)]
+    max_git_uploads: Option<usize>,
+
+    /// git-receive-pack processes, taking pushes, run at once over all clients
+    /// (unlimited if unset)
+    #[arg(long)]
+    max_git_receives: Option<usize>,
+
+    /// git processes run at once for web pages and API requests (unlimited if
+    /// unset)
+    #[arg(long)]
+    max_git_web: Option<usize>,
+
+    /// Seconds a git process waits for a place under --max-git-uploads,
+    /// --max-git-receives or --max-git-web before the client is turned away
+    #[arg(long, default_value = "30")]
+    git_queue_timeout: u64,
+
+    /// Seconds git may take to serve a clone or fetch before it is stopped,
+    /// along with everything it started (0 for no limit)
+    #[arg(long, default_value = "3600")]
+    git_upload_timeout: u64,
+
+    /// Seconds git may take to receive a push, hooks included, before it is
+    /// stopped (0 for no limit)
+    #[arg(long, default_value = "3600")]
+    git_receive_timeout: u64,
+
+    /// Seconds a git process may take for a web page or API request before
+    /// it is stopped (0 for no limit)
+    #[arg(long, default_value = "60")]
+    git_web_timeout: u64,
+
+    /// Comma-separated addresses or CIDR ranges allowed to connect over SSH and
+    /// HTTP, e.g. 10.8.0.0/16,192.0.2.10; others are turned away (anyone if unset)
+    #[arg(long, value_delimiter = ',')]
+    allow_ip: Vec<ip_access::Cidr>,
+
+    /// Comma-separated addresses or CIDR ranges never allowed to connect, even
+    /// when in --allow-ip
+    #[arg(long, value_delimiter = ',')]
+    deny_ip: Vec<ip_access::Cidr>,
+
+    /// Like --allow-ip, for SSH only; clients must pass both
+    #[arg(long, value_delimiter = ',')]
+    ssh_allow_ip: Vec<ip_access::Cidr>,
+
+    /// Like --deny-ip, for SSH only
+    #[arg(long, value_delimiter = ',')]
+    ssh_deny_ip: Vec<ip_access::Cidr>,
+
+    /// Like --allow-ip, for the web interface and API only; clients must pass
+    /// both. Checks the forwarded address with --trust-proxy.
+    #[arg(long, value_delimiter = ',')]
+    http_allow_ip: Vec<ip_access::Cidr>,
+
+    /// Like --deny-ip, for the web interface and API only
+    #[arg(long, value_delimiter = ',')]
+    http_deny_ip: Vec<ip_access::Cidr>,
+
+    /// Like --allow-ip, for the git:// daemon only
+    #[arg(long, value_delimiter = ',')]
+    git_allow_ip: Vec<ip_access::Cidr>,
+
+    /// Like --deny-ip, for the git:// daemon only
+    #[arg(long, value_delimiter = ',')]
+    git_deny_ip: Vec<ip_access::Cidr>,
+
+    /// Keep the packs sent for full clones, up to this size per repository,
+    /// e.g. 1G, and send them again to the next clone asking for the same
+    /// objects (off if unset)
+    #[arg(long, value_parser = usage::parse_size)]
+    pack_cache_size: Option<u64>,
+
+    /// Directory for server-wide data such as digest subscriptions
+    #[arg(long, global = true, default_value = "/var/lib/agito/data")]
+    data_dir: PathBuf,
+
+    /// sendmail-compatible binary used to deliver mail
+    #[arg(long, default_value = "/usr/sbin/sendmail")]
+    sendmail: PathBuf,
+
+    /// Sender address for mail sent by the server
+    #[arg(long, default_value = "agito@localhost")]
+    mail_from: String,
+
+    /// Send mail through this SMTP server instead of sendmail: smtp://host:587
+    /// (upgraded with STARTTLS) or smtps://host:465
+    #[arg(long, value_parser = mail::Smtp::parse_url)]
+    smtp_url: Option<String>,
+
+    /// User name to log in to the SMTP server with
+    #[arg(long)]
+    smtp_username: Option<String>,
+
+    /// File holding the SMTP password on its first line
+    #[arg(long)]
+    smtp_password_file: Option<PathBuf>,
+
+    /// Send over smtp:// without TLS if the server does not offer STARTTLS
+    #[arg(long)]
+    smtp_allow_plaintext: bool,
+
+    /// Trust this header from an authenticating reverse proxy as the signed-in user
+    /// (e.g. X-Remote-User). The proxy must strip it from client requests.
+    #[arg(long)]
+    auth_proxy_header: Option<String>,
+
+    /// Users who may change the settings of any repository from the web
+    /// interface, such as its push policies (repeatable)
+    #[arg(long = "admin")]
+    admins: Vec<String>,
+
+    /// Who may register an account from the web interface: nobody (closed),
+    /// anyone pending an admin's approval (approval), or anyone (open)
+    #[arg(long, default_value = "approval")]
+    registration: users::Registration,
+
+    /// Export traces to this OTLP/gRPC endpoint (e.g. http://localhost:4317)
+    #[arg(long)]
+    otlp_endpoint: Option<String>,
+
+    /// Format of the server log: text, or json for log aggregators
+    #[arg(long, global = true, default_value = "text")]
+    log_format: telemetry::LogFormat,
+
+    /// Which messages to log: a level such as debug, or per-module filters such
+    /// as info,agito::ssh=debug. Defaults to RUST_LOG, or info.
+    #[arg(long, global = true)]
+    log_level: Option<String>,
+
+    /// Longest the new process may take to start accepting connections when
+    /// restarting on SIGUSR2; the restart is called off after that
+    #[arg(long, default_value = "30s", value_parser = ci::pipeline::parse_duration)]
+    restart_timeout: Duration,
+
+    /// Longest the old process keeps serving connections in flight, such as
+    /// clones and pushes, after a restart or on shutdown
+    #[arg(long, default_value = "10m", value_parser = ci::pipeline::parse_duration)]
+    drain_timeout: Duration,
+}
+
+#[derive(Subcommand, Debug)]
+enum Command {
+    /// Manage the server-side hooks of repositories
+    Hooks {
+        #[command(subcommand)]
+        action: HooksAction,
+    },
+    /// Import a repository from another server with `git clone --mirror`.
+    /// An interrupted import resumes when run again.
+    Import {
+        /// Name of the new repository, e.g. webshop.git or team/webshop.git
+        name: String,
+        /// URL of the repository to import
+        url: String,
+    },
+    /// Bring a project over from GitHub or GitLab: the repository, if it
+    /// isn't here yet, then its labels, milestones, issues with comments,
+    /// and releases. Safe to run again; what exists is left alone.
+    Migrate {
+        /// Name of the repository, e.g. webshop.git or team/webshop.git
+        name: String,
+        /// Project to bring over: github:<owner>/<repo>, gitlab:<group>/<repo>
+        /// or the URL of its page
+        source: String,
+        /// File holding an access token for the forge's API, and for cloning
+        /// private repositories
+        #[arg(long)]
+        token_file: Option<PathBuf>,
+        /// Account for a forge user, e.g. --map octocat=alice; others are
+        /// matched by the public email address of their profile
+        #[arg(long = "map", value_name = "LOGIN=USER")]
+        user_map: Vec<String>,
+        /// Forge the URL is on, for GitHub Enterprise (github or gitlab)
+        #[arg(long)]
+        forge: Option<migrate::Forge>,
+        /// Only bring over the metadata, into an existing repository
+        #[arg(long)]
+        no_git: bool,
+    },
+    /// Back up every repository, the data directory, the SSH keys and the
+    /// hook templates into one archive
+    Backup {
+        /// Archive to write, compressed according to its extension (e.g. backup.tar.zst)
+        #[arg(long)]
+        out: PathBuf,
+    },
+    /// Recreate repositories and server data from a backup. Repositories and
+    /// files that already exist are left alone.
+    Restore {
+        /// Archive written by `agito-server backup`
+        archive: PathBuf,
+    },
+    /// Server administration
+    Admin {
+        #[command(subcommand)]
+        action: AdminAction,
+    },
+}
+
+#[derive(Subcommand, Debug)]
+enum AdminAction {
+    /// Repositories on this server
+    Repos {
+        #[command(subcommand)]
+        action: ReposAction,
+    },
+    /// Accounts
+    Users {
+        #[command(subcommand)]
+        action: UsersAction,
+    },
+    /// SSH keys of accounts
+    Keys {
+        #[command(subcommand)]
+        action: KeysAction,
+    },
+    /// Run `git gc` on repositories now: a full repack and a new commit-graph
+    Gc {
+        /// Repositories to collect (default: all)
+        #[arg(value_name = "REPO")]
+        only: Vec<String>,
+    },
+    /// Verify repositories with `git fsck`; exits non-zero if any is damaged
+    Fsck {
+        /// Repositories to verify (default: all)
+        #[arg(value_name = "REPO")]
+        only: Vec<String>,
+    },
+    /// Rewrite the commit-graph of repositories from scratch
+    RebuildCaches {
+        /// Repositories to rebuild (default: all)
+        #[arg(value_name = "REPO")]
+        only: Vec<String>,
+    },
+    /// Remove the packs kept by --pack-cache-size
+    ClearPackCache {
+        /// Repositories to clear (default: all)
+        #[arg(value_name = "REPO")]
+        only: Vec<String>,
+    },
+    /// Build the code search index of repositories now, even if it is current
+    SearchIndex {
+        /// Repositories to index (default: all)
+        #[arg(value_name = "REPO")]
+        only: Vec<String>,
+    },
+    /// Deleted repositories, kept for --trash-retention-days
+    Trash {
+        #[command(subcommand)]
+        action: TrashAction,
+    },
+    /// Refuse pushes and merges, server-wide or to one repository, while
+    /// clones, fetches and the web interface keep working
+    Maintenance {
+        #[command(subcommand)]
+        action: MaintenanceAction,
+    },
+}
+
+#[derive(Subcommand, Debug)]
+enum ReposAction {
+    /// List repositories with their size and visibility
+    List,
+    /// Create an empty repository
+    Create {
+        /// Name of the repository, e.g. webshop.git or team/webshop.git
+        name: String,
+        /// User creating it, who is granted it as if they had created it over
+        /// SSH
+        #[arg(long)]
+        owner: Option<String>,
+        /// public, internal or private (default: --default-visibility)
+        #[arg(long)]
+        visibility: Option<visibility::Visibility>,
+    },
+    /// Move a repository to the trash
+    Delete { name: String },
+}
+
+#[derive(Subcommand, Debug)]
+enum UsersAction {
+    /// List accounts
+    List,
+    /// Create an active account that signs in with SSH keys; set a password
+    /// with `agito-admin user passwd`
+    Add {
+        name: String,
+        #[arg(long)]
+        email: String,
+        /// Display name (default: the user name)
+        #[arg(long)]
+        display_name: Option<String>,
+        /// Make the account a server admin
+        #[arg(long)]
+        admin: bool,
+        /// SSH public key, e.g. "ssh-ed25519 AAAA... alice@laptop"; may be repeated
+        #[arg(long = "key")]
+        keys: Vec<String>,
+    },
+    /// Delete an account and revoke its tokens
+    Remove { name: String },
+}
+
+#[derive(Subcommand, Debug)]
+enum KeysAction {
+    /// List SSH keys with their fingerprints
+    List {
+        /// Only this user's keys
+        user: Option<String>,
+    },
+    /// Add an SSH public key to an account
+    Add { user: String, key: String },
+    /// Remove an SSH key from an account
+    Remove {
+        user: String,
+        /// Fingerprint shown by `keys list`, e.g. SHA256:..., or the key itself
+        key: String,
+    },
+}
+
+#[derive(Subcommand, Debug)]
+enum TrashAction {
+    /// List deleted repositories, most recently deleted first
+    List,
+    /// Put a deleted repository back
+    Restore {
+        /// ID shown by `trash list`
+        id: String,
+        /// Restore under this name instead of the old one, e.g. when a new
+        /// repository has taken it
+        #[arg(long = "as")]
+        name: Option<String>,
+    },
+    /// Delete a repository in the trash for good
+    Purge {
+        /// ID shown by `trash list`
+        id: String,
+    },
+}
+
+#[derive(Subcommand, Debug)]
+enum MaintenanceAction {
+    /// Start maintenance
+    On {
+        /// Only this repository, instead of the whole server
+        #[arg(long)]
+        repo: Option<String>,
+        /// Why, shown to users whose changes are refused and on the web
+        #[arg(long, short, default_value = "")]
+        message: String,
+    },
+    /// End maintenance
+    Off {
+        /// Only this repository, instead of the whole server
+        #[arg(long)]
+        repo: Option<String>,
+    },
+    /// Show whether the server and its repositories are in maintenance
+    Status,
+}
+
+#[derive(Subcommand, Debug)]
+enum HooksAction {
+    /// Re-apply the hook templates to every existing repository
+    Sync,
 }
 
 #[tokio::main]
 async fn main() -> Result<()> {
-    // Initialize tracing
-    tracing_subscriber::fmt::init();
+    let args = Args::parse_from(config::expand_args(std::env::args().collect())?);
 
-    let args = Args::parse();
+    let public_url = args
+        .public_url
+        .clone()
+        .unwrap_or_else(|| format!("http://localhost:{}", args.http_port));
+    let hook_templates = hooks::Templates {
+        dir: args.hook_templates.clone(),
+        repos_dir: args.repos.clone(),
+        public_url: public_url.clone(),
+    };
+
+    if let Some(Command::Import { name, url }) = &args.command {
+        let import = import::Import {
+            repos_dir: args.repos.clone(),
+            name: namespaces::qualified_name(name)?,
+            url: url.clone(),
+            remote_only: false,
+        };
+        let path = import.run(&hook_templates, &mut |progress| {
+            use std::io::Write;
+            let _ = std::io::stderr().write_all(progress);
+        })?;
+        visibility::set(&path, args.default_visibility)?;
+        println!("Imported {} into {}", import.name, path.display());
+        return Ok(());
+    }
+
+    if let Some(Command::Migrate {
+        name,
+        source,
+        token_file,
+        user_map,
+        forge,
+        no_git,
+    }) = &args.command
+    {
+        migrate_command(
+            &args,
+            &hook_templates,
+            name,
+            source,
+            token_file.as_deref(),
+            user_map,
+            *forge,
+            *no_git,
+        )?;
+        return Ok(());
+    }
+
+    let backup_paths = backup::Paths {
+        repos_dir: args.repos.clone(),
+        data_dir: args.data_dir.clone(),
+        ssh_key: args.ssh_key.clone(),
+        authorized_keys: args.authorized_keys.clone(),
+        hook_templates: args.hook_templates.clone(),
+    };
+    if let Some(Command::Backup { out }) = &args.command {
+        let summary = backup::backup(&backup_paths, out)?;
+        println!("Backed up {} repositories to {}", summary.repos, out.display());
+        report_skipped(&summary);
+        return Ok(());
+    }
+    if let Some(Command::Restore { archive }) = &args.command {
+        let summary = backup::restore(&backup_paths, archive, &hook_templates)?;
+        println!("Restored {} repositories", summary.repos);
+        report_skipped(&summary);
+        return Ok(());
+    }
+
+    if let Some(Command::Admin { action }) = &args.command {
+        match action {
+            AdminAction::Repos { action } => repos_command(&args, &hook_templates, action)?,
+            AdminAction::Users { action } => users_command(&args, action)?,
+            AdminAction::Keys { action } => keys_command(&args, action)?,
+            AdminAction::Gc { only } => maintain(
+                &args,
+                &[maintenance::Task::Repack, maintenance::Task::CommitGraph],
+                only,
+            )?,
+            AdminAction::Fsck { only } => maintain(&args, &[maintenance::Task::Fsck], only)?,
+            AdminAction::RebuildCaches { only } => {
+                maintain(&args, &[maintenance::Task::Caches], only)?
+            }
+            AdminAction::ClearPackCache { only } => clear_pack_cache(&args, only)?,
+            AdminAction::SearchIndex { only } => search_index(&args, only)?,
+            AdminAction::Trash { action } => trash_command(&args, action)?,
+            AdminAction::Maintenance { action } => maintenance_command(&args, action)?,
+        }
+        return Ok(());
+    }
+
+    if let Some(Command::Hooks { action }) = &args.command {
+        match action {
+            HooksAction::Sync => {
+                let (updated, failures) = hook_templates.sync(&args.repos)?;
+                for (name, e) in &failures {
+                    eprintln!("{}: {:#}", name, e);
+                }
+                println!("Updated hooks of {} repositories", updated);
+                if !failures.is_empty() {
+                    std::process::exit(1);
+                }
+            }
+        }
+        return Ok(());
+    }
+
+    // Initialize tracing
+    telemetry::init(
+        "agito-server",
+        args.otlp_endpoint.as_deref(),
+        args.log_format,
+        args.log_level.as_deref(),
+    )?;
 
     // Create directories if they don't exist
     std::fs::create_dir_all(&args.repos)?;
+    std::fs::create_dir_all(&args.data_dir)?;
     
     if let Some(parent) = args.ssh_key.parent() {
         std::fs::create_dir_all(parent)?;
     }
 
+    let access_log_output = match &args.access_log {
+        Some(target) => web::AccessLogOutput::open(target)?,
+        None => web::AccessLogOutput::Tracing,
+    };
+
     tracing::info!("Agito Server Starting...");
     tracing::info!("Repositories: {:?}", args.repos);
     tracing::info!("HTTP Port: {}", args.http_port);
     tracing::info!("SSH Port: {}", args.ssh_port);
 
+    // Sockets from systemd socket activation or a restarting server come
+    // first; anything else is bound here
+    let mut passed = listeners::Listeners::from_env()?;
+    let ssh_listener = passed.take_or_bind(listeners::SSH, &format!("0.0.0.0:{}", args.ssh_port))?;
+    let http_listener = passed.take_or_bind(listeners::HTTP, &format!("0.0.0.0:{}", args.http_port))?;
+    let git_listener = match args.git_daemon_port {
+        Some(port) => Some(passed.take_or_bind(listeners::GIT, &format!("0.0.0.0:{}", port))?),
+        None => None,
+    };
+    for name in passed.unused() {
+        tracing::warn!("Ignoring passed-in socket '{}'", name);
+    }
+    // Kept to hand over to the next process on restart
+    let mut handover = vec![
+        (listeners::SSH, ssh_listener.try_clone()?),
+        (listeners::HTTP, http_listener.try_clone()?),
+    ];
+    if let Some(listener) = &git_listener {
+        handover.push((listeners::GIT, listener.try_clone()?));
+    }
+    // Set once the servers should stop accepting and finish what's in flight
+    let (drain_tx, drain_rx) = tokio::sync::watch::channel(false);
+    let drained = |mut rx: tokio::sync::watch::Receiver<bool>| async move {
+        let _ = rx.wait_for(|drain| *drain).await;
+    };
+
+    let clone_urls = clone_urls::CloneUrls {
+        host: args
+            .public_host
+            .clone()
+            .or_else(|| args.public_url.as_deref().and_then(clone_urls::CloneUrls::host_of))
+            .unwrap_or_else(|| "localhost".to_string()),
+        ssh_port: args.public_ssh_port.or_else(|| args.ssh_port.parse().ok()),
+        git_port: args.git_daemon_port,
+        http_base: Some(public_url.clone()),
+    };
+
+    let disk_usage = usage::DiskUsage::default();
+    let lfs_tokens = lfs::Tokens::load_or_create(&args.data_dir)?;
+    let sessions = users::Sessions::load_or_create(&args.data_dir)?;
+    if let Some(token) = users::bootstrap_token(&args.data_dir)? {
+        tracing::info!(
+            "No admin account yet; register the first one at {}/register?bootstrap={}",
+            public_url.trim_end_matches('/'),
+            token
+        );
+    }
+    let resolver = redirects::Resolver {
+        repos_dir: args.repos.clone(),
+        data_dir: Some(args.data_dir.clone()),
+        case_insensitive: args.case_insensitive_repos,
+        redirect_days: Some(args.rename_redirect_days).filter(|&days| days > 0),
+    };
+    let quotas = quota::Quotas {
+        repos_dir: args.repos.clone(),
+        data_dir: args.data_dir.clone(),
+        repo_bytes: args.repo_quota,
+        user_bytes: args.user_quota,
+    };
+
+    // One limiter for both servers, so limits hold across protocols
+    let rate_limiter = rate_limit::Limiter::new(rate_limits(&args));
+    rate_limiter.spawn_sweeper(Duration::from_secs(60));
+    let git_pools = git::limits::Pools::new(git_limits(&args));
+    let ip_filter = ip_access::Filter::new(ip_rules(&args));
+    // Settings a reload replaces
+    let reloadable = Reloadable {
+        admins: config::Shared::new(args.admins.clone()),
+        registration: config::Shared::new(args.registration),
+        rate_limiter: rate_limiter.clone(),
+        git_pools: git_pools.clone(),
+        ip_filter: ip_filter.clone(),
+    };
+    let reload = config::ReloadTrigger::default();
+
+    let limits = namespaces::Limits {
+        repos_dir: args.repos.clone(),
+        data_dir: args.data_dir.clone(),
+        max_repos: args.max_repos_per_user,
+        top_level: args.top_level_repos,
+    };
+
     // Start SSH server in a task
     let ssh_server = ssh::Server::new(
         args.ssh_port.clone(),
-        args.ssh_key,
+        args.ssh_key.clone(),
         args.authorized_keys,
         args.repos.clone(),
-    );
+    )
+    .with_quotas(quotas.clone())
+    .with_disk_usage(disk_usage.clone())
+    .with_lfs(lfs_tokens.clone(), public_url.clone())
+    .with_resolver(resolver.clone())
+    .with_hook_templates(hook_templates.clone())
+    .with_rate_limiter(rate_limiter.clone())
+    .with_git_pools(git_pools.clone())
+    .with_ip_filter(ip_filter.clone())
+    .with_default_visibility(args.default_visibility)
+    .with_clone_urls(clone_urls.clone())
+    .with_pack_cache(pack_cache::PackCache {
+        max_bytes: args.pack_cache_size,
+    })
+    .with_listener(ssh_listener)
+    .with_limits(limits.clone());
     
-    let ssh_handle = tokio::spawn(async move {
-        if let Err(e) = ssh_server.start().await {
+    let ssh_drained = drained(drain_rx.clone());
+    let mut ssh_handle = tokio::spawn(async move {
+        if let Err(e) = ssh_server.start(ssh_drained).await {
             tracing::error!("SSH server error: {}", e);
         }
     });
 
+    let git_daemon = git_daemon::Server::new(args.repos.clone(), args.data_dir.clone())
+        .with_resolver(resolver.clone())
+        .with_rate_limiter(rate_limiter.clone())
+        .with_git_pools(git_pools.clone())
+        .with_ip_filter(ip_filter.clone())
+        .with_pack_cache(pack_cache::PackCache {
+            max_bytes: args.pack_cache_size,
+        });
+    let git_drained = drained(drain_rx.clone());
+    let mut git_handle = tokio::spawn(async move {
+        if let Some(listener) = git_listener {
+            if let Err(e) = git_daemon.start(listener, git_drained).await {
+                tracing::error!("git daemon error: {}", e);
+            }
+        }
+    });
+
+    if args.usage_scan_interval > 0 {
+        disk_usage.spawn_scanner(
+            args.repos.clone(),
+            Duration::from_secs(args.usage_scan_interval),
+        );
+    }
+
+    let listing = web::Listing {
+        allow: args.index_allow.clone(),
+        deny: args.index_deny.clone(),
+    };
+
+    // Crawlers are turned away under --robots deny, so skip the sitemap too
+    let sitemap = web::Sitemap::default();
+    let sitemap_enabled = args.sitemap_interval > 0 && args.robots == web::RobotsPolicy::Allow;
+    if sitemap_enabled {
+        sitemap.spawn_generator(
+            args.repos.clone(),
+            listing.clone(),
+            Duration::from_secs(args.sitemap_interval),
+        );
+    }
+
+    retention::spawn(
+        args.repos.clone(),
+        retention::Policy {
+            ci_logs_days: args.retention_ci_logs_days,
+            artifacts_days: args.retention_artifacts_days,
+            webhook_deliveries_days: args.retention_webhook_deliveries_days,
+        },
+        Duration::from_secs(24 * 3600),
+    );
+
+    if args.trash_retention_days > 0 {
+        trash::spawn(
+            args.repos.clone(),
+            args.trash_retention_days,
+            Duration::from_secs(3600),
+        );
+    }
+
+    if args.maintenance_interval > 0 {
+        maintenance::spawn(
+            args.repos.clone(),
+            maintenance::Schedule {
+                tasks: args.maintenance_tasks.clone(),
+                concurrency: args.maintenance_concurrency,
+            },
+            Duration::from_secs(args.maintenance_interval),
+        );
+    }
+
+    if args.mirror_check_interval > 0 {
+        mirror::spawn(
+            args.repos.clone(),
+            Duration::from_secs(args.mirror_check_interval),
+        );
+    }
+
+    if args.search_index_interval > 0 {
+        search::spawn(
+            args.repos.clone(),
+            Duration::from_secs(args.search_index_interval),
+        );
+    }
+
+    if args.stats_interval > 0 {
+        stats::spawn(
+            args.repos.clone(),
+            Duration::from_secs(args.stats_interval),
+        );
+    }
+
+    if args.ci_runners > 0 {
+        ci::runner::spawn(
+            ci::runner::Runner {
+                repos_dir: args.repos.clone(),
+                data_dir: args.data_dir.clone(),
+                workspace_dir: args.ci_workspace_dir.clone(),
+                container_runtime: args.ci_container_runtime.clone(),
+                timeout: args.ci_timeout,
+            },
+            args.ci_runners,
+            Duration::from_secs(args.ci_poll_interval.max(1)),
+        );
+    }
+
+    if args.webhook_poll_interval > 0 {
+        webhooks::spawn(
+            args.repos.clone(),
+            webhooks::Sender {
+                curl: args.curl.clone(),
+                public_url: public_url.clone(),
+                timeout: args.webhook_timeout,
+            },
+            Duration::from_secs(args.webhook_poll_interval),
+        );
+    }
+
+    // Send due notification digests; checked hourly so daily digests go out on time
+    let smtp = match &args.smtp_url {
+        Some(url) => Some(mail::Smtp {
+            url: url.clone(),
+            username: args.smtp_username.clone(),
+            password: match &args.smtp_password_file {
+                Some(path) => Some(mail::Smtp::read_password(path)?),
+                None => None,
+            },
+            allow_plaintext: args.smtp_allow_plaintext,
+            curl: args.curl.clone(),
+        }),
+        None => None,
+    };
+    let mailer = mail::Mailer {
+        sendmail: args.sendmail.clone(),
+        from: args.mail_from.clone(),
+        smtp,
+    };
+    let (repos_dir, data_dir) = (args.repos.clone(), args.data_dir.clone());
+    let digest_mailer = mailer.clone();
+    jobs::spawn_periodic("digests", Duration::from_secs(3600), move || {
+        let sent = digest::send_due(
+            &repos_dir,
+            &data_dir,
+            &digest_mailer,
+            chrono::Utc::now().timestamp(),
+        )?;
+        if sent > 0 {
+            tracing::info!("Sent {} notification digests", sent);
+        }
+        Ok(())
+    });
+
+    // Mail subscribed accounts about pushes, issues and pull requests
+    let (repos_dir, data_dir) = (args.repos.clone(), args.data_dir.clone());
+    let (subscription_mailer, subscription_url) = (mailer.clone(), public_url.clone());
+    jobs::spawn_periodic("subscriptions", Duration::from_secs(60), move || {
+        let sent = subscriptions::deliver(&repos_dir, &data_dir, &subscription_mailer, &subscription_url)?;
+        if sent > 0 {
+            tracing::info!("Sent {} subscription mails", sent);
+        }
+        Ok(())
+    });
+
+    let federation = match (&args.public_url, args.federation) {
+        (Some(url), true) => Some(federation::Federation {
+            public_url: url.clone(),
+            repos_dir: args.repos.clone(),
+            data_dir: args.data_dir.clone(),
+            curl: args.curl.clone(),
+            timeout: args.webhook_timeout,
+        }),
+        (None, true) => anyhow::bail!("--federation needs --public-url, as actor IDs are absolute URLs"),
+        _ => None,
+    };
+    if let Some(federation) = &federation {
+        // Make the signing key now rather than on the first request
+        federation.public_key()?;
+        federation::spawn(federation.clone(), Duration::from_secs(60));
+    }
+
+    // Mail watchers about pushes to the branches and tags they watch
+    let (repos_dir, data_dir) = (args.repos.clone(), args.data_dir.clone());
+    jobs::spawn_periodic("watches", Duration::from_secs(60), move || {
+        let sent = watch::deliver(&repos_dir, &data_dir, &mailer)?;
+        if sent > 0 {
+            tracing::info!("Sent {} ref alerts", sent);
+        }
+        Ok(())
+    });
+
     // Start HTTP server in a task
-    let web_server = web::WebServer::new(args.repos);
-    let http_port = args.http_port.clone();
-    
-    let web_handle = tokio::spawn(async move {
-        if let Err(e) = web_server.start(&http_port).await {
+    let mut web_server = web::WebServer::new(args.repos)
+        .with_access_log(web::AccessLog {
+            format: args.access_log_format,
+            output: access_log_output,
+            trust_proxy: args.trust_proxy,
+        })
+        .with_avatars(args.avatars)
+        .with_cgit_urls(args.cgit_urls)
+        .with_robots(args.robots)
+        .with_public_url(args.public_url.clone())
+        .with_clone_urls(clone_urls)
+        .with_lfs_tokens(lfs_tokens)
+        .with_resolver(resolver)
+        .with_listing(listing)
+        .with_signatures(signatures::Verifier {
+            gpg_home: args.gpg_home.clone(),
+            allowed_signers: args.allowed_signers.clone(),
+        })
+        .with_disk_usage(disk_usage)
+        .with_quotas(quotas)
+        .with_data_dir(args.data_dir.clone())
+        .with_auth_proxy_header(args.auth_proxy_header.clone())
+        .with_admins(reloadable.admins.clone())
+        .with_accounts(sessions, reloadable.registration.clone())
+        .with_rate_limiter(rate_limiter)
+        .with_git_pools(git_pools)
+        .with_pack_cache(pack_cache::PackCache {
+            max_bytes: args.pack_cache_size,
+        })
+        .with_ip_filter(ip_filter)
+        .with_reload(reload.clone())
+        .with_code_search(args.search_index_interval > 0)
+        .with_host_keys(host_keys::paths(&args.ssh_key))
+        .with_repo_creation(limits, hook_templates, args.default_visibility);
+    if sitemap_enabled {
+        web_server = web_server.with_sitemap(sitemap);
+    }
+    if let Some(federation) = federation {
+        web_server = web_server.with_federation(federation);
+    }
+    let web_drained = drained(drain_rx);
+    let mut web_handle = tokio::spawn(async move {
+        if let Err(e) = web_server.start(http_listener, web_drained).await {
             tracing::error!("Web server error: {}", e);
         }
     });
 
-    // Wait for shutdown signal
-    match signal::ctrl_c().await {
-        Ok(()) => {
-            tracing::info!("Shutdown signal received");
-        }
-        Err(err) => {
-            tracing::error!("Unable to listen for shutdown signal: {}", err);
+    // Tell whoever started us that the sockets are being served
+    listeners::report_ready();
+    listeners::notify_ready();
+
+    // Wait for shutdown signal, SIGUSR2 to restart in place, or SIGHUP to reload
+    let mut restart = signal::unix::signal(signal::unix::SignalKind::user_defined2())?;
+    let mut hangup = signal::unix::signal(signal::unix::SignalKind::hangup())?;
+    let mut terminate = signal::unix::signal(signal::unix::SignalKind::terminate())?;
+    loop {
+        tokio::select! {
+            result = signal::ctrl_c() => {
+                match result {
+                    Ok(()) => tracing::info!("Shutdown signal received"),
+                    Err(err) => tracing::error!("Unable to listen for shutdown signal: {}", err),
+                }
+                break;
+            }
+            _ = terminate.recv() => {
+                tracing::info!("Shutdown signal received");
+                break;
+            }
+            _ = hangup.recv() => {
+                tracing::info!("Reload signal received");
+                reloadable.reload();
+            }
+            _ = reload.requested() => {
+                tracing::info!("Reload requested through the API");
+                reloadable.reload();
+            }
+            _ = restart.recv() => {
+                tracing::info!("Restart signal received, starting a new server process");
+                let sockets: Vec<(&str, &std::net::TcpListener)> =
+                    handover.iter().map(|(name, listener)| (*name, listener)).collect();
+                let timeout = args.restart_timeout;
+                match tokio::task::block_in_place(|| listeners::spawn_successor(&sockets, timeout)) {
+                    Ok(pid) => {
+                        tracing::info!("New server process {} is accepting connections", pid);
+                        let _ = drain_tx.send(true);
+                        break;
+                    }
+                    Err(e) => tracing::error!("Restart failed, carrying on: {:#}", e),
+                }
+            }
         }
     }
 
     tracing::info!("Shutting down...");
-    
-    // In a production system, we'd gracefully shutdown servers here
+    let _ = drain_tx.send(true);
+    drop(handover);
+
+    // Finish clones, pushes and page loads in flight, then cut off the rest;
+    // a second Ctrl-C doesn't wait
+    let finished = async {
+        let _ = (&mut ssh_handle).await;
+        let _ = (&mut git_handle).await;
+        let _ = (&mut web_handle).await;
+    };
+    tokio::select! {
+        _ = finished => {}
+        _ = tokio::time::sleep(args.drain_timeout) => {
+            tracing::warn!(
+                "Connections still open after {} seconds, closing them",
+                args.drain_timeout.as_secs()
+            );
+        }
+        _ = signal::ctrl_c() => tracing::warn!("Closing open connections"),
+    }
     ssh_handle.abort();
+    git_handle.abort();
     web_handle.abort();
+    telemetry::shutdown();
 
     Ok(())
 }
+
+fn rate_limits(args: &Args) -> rate_limit::Config {
+    rate_limit::Config {
+        requests_per_second: args.rate_limit_requests,
+        request_burst: args.rate_limit_burst,
+        concurrent_clones: args.max_concurrent_clones,
+        pushes_per_minute: args.max_pushes_per_minute,
+    }
+}
+
+fn git_limits(args: &Args) -> git::limits::Config {
+    git::limits::Config {
+        uploads: args.max_git_uploads,
+        receives: args.max_git_receives,
+        web: args.max_git_web,
+        queue_timeout: Duration::from_secs(args.git_queue_timeout),
+        upload_timeout: run_time(args.git_upload_timeout),
+        receive_timeout: run_time(args.git_receive_timeout),
+        web_timeout: run_time(args.git_web_timeout),
+    }
+}
+
+/// A git timeout in seconds, where 0 means none
+fn run_time(secs: u64) -> Option<Duration> {
+    (secs > 0).then(|| Duration::from_secs(secs))
+}
+
+fn ip_rules(args: &Args) -> ip_access::Config {
+    ip_access::Config {
+        global: ip_access::Rules {
+            allow: args.allow_ip.clone(),
+            deny: args.deny_ip.clone(),
+        },
+        ssh: ip_access::Rules {
+            allow: args.ssh_allow_ip.clone(),
+            deny: args.ssh_deny_ip.clone(),
+        },
+        http: ip_access::Rules {
+            allow: args.http_allow_ip.clone(),
+            deny: args.http_deny_ip.clone(),
+        },
+        git: ip_access::Rules {
+            allow: args.git_allow_ip.clone(),
+            deny: args.git_deny_ip.clone(),
+        },
+    }
+}
+
+/// The settings a running server can take from a reloaded configuration.
+/// Everything else only changes with a restart (SIGUSR2).
+struct Reloadable {
+    admins: config::Shared<Vec<String>>,
+    registration: config::Shared<users::Registration>,
+    rate_limiter: rate_limit::Limiter,
+    git_pools: git::limits::Pools,
+    ip_filter: ip_access::Filter,
+}
+
+impl Reloadable {
+    /// Reread the configuration file and the command line, and apply them.
+    /// An invalid configuration leaves the running one in place.
+    fn reload(&self) {
+        let args = config::expand_args(std::env::args().collect())
+            .and_then(|args| Ok(Args::try_parse_from(args)?));
+        let args = match args {
+            Ok(args) => args,
+            Err(e) => {
+                tracing::error!(
+                    "Keeping the running configuration, the new one is invalid: {:#}",
+                    e
+                );
+                return;
+            }
+        };
+        self.admins.set(args.admins.clone());
+        self.registration.set(args.registration);
+        self.rate_limiter.reconfigure(rate_limits(&args));
+        self.git_pools.reconfigure(git_limits(&args));
+        self.ip_filter.reconfigure(ip_rules(&args));
+        tracing::info!(
+            "Configuration reloaded: {} admins named, {} registration",
+            args.admins.len(),
+            args.registration.name()
+        );
+
+        // Keys, roles and webhooks are read when used; point out broken keys
+        // now rather than at someone's next push
+        match ssh::check_authorized_keys(&args.authorized_keys) {
+            Ok((keys, invalid)) if invalid.is_empty() => {
+                tracing::info!("{} keys in {}", keys, args.authorized_keys.display())
+            }
+            Ok((keys, invalid)) => tracing::warn!(
+                "{} keys in {}; lines {:?} are not keys and are ignored",
+                keys,
+                args.authorized_keys.display(),
+                invalid
+            ),
+            Err(e) => tracing::error!("{:#}", e),
+        }
+    }
+}
+
+/// Import a repository from GitHub or GitLab, unless it's already here, and
+/// then its issues, labels, milestones and releases
+#[allow(clippy::too_many_arguments)]
+fn migrate_command(
+    args: &Args,
+    hook_templates: &hooks::Templates,
+    name: &str,
+    source: &str,
+    token_file: Option<&std::path::Path>,
+    user_map: &[String],
+    forge: Option<migrate::Forge>,
+    no_git: bool,
+) -> Result<()> {
+    let name = namespaces::qualified_name(name)?;
+    let token = match token_file {
+        Some(path) => Some(
+            std::fs::read_to_string(path)
+                .map_err(|e| anyhow::anyhow!("Failed to read {}: {}", path.display(), e))?
+                .trim()
+                .to_string(),
+        ),
+        None => None,
+    };
+    let mut source = migrate::Source::parse(source, forge)?.with_token(token);
+    source.curl = args.curl.clone();
+    let user_map = user_map
+        .iter()
+        .map(|pair| match pair.split_once('=') {
+            Some((login, user)) if !login.is_empty() && !user.is_empty() => {
+                Ok((login.to_string(), user.to_string()))
+            }
+            _ => Err(anyhow::anyhow!("Expected --map <login>=<user>, not '{}'", pair)),
+        })
+        .collect::<Result<_>>()?;
+
+    let repo_path = args.repos.join(&name);
+    if !repo_path.exists() {
+        if no_git {
+            anyhow::bail!("{} doesn't exist; leave out --no-git to import it", name);
+        }
+        let import = import::Import {
+            repos_dir: args.repos.clone(),
+            name: name.clone(),
+            url: source.clone_url(),
+            remote_only: false,
+        };
+        import.run(hook_templates, &mut |progress| {
+            use std::io::Write;
+            let _ = std::io::stderr().write_all(progress);
+        })?;
+        println!("Imported the repository into {}", repo_path.display());
+    }
+
+    let migration = migrate::Migration {
+        source: &source,
+        repo_path: &repo_path,
+        data_dir: &args.data_dir,
+        user_map,
+    };
+    let summary = migration.run(&mut |progress| eprint!("{}", progress))?;
+    let detail = format!(
+        "migrated {} issues with {} comments, {} labels, {} milestones and {} releases from {}:{}",
+        summary.issues,
+        summary.comments,
+        summary.labels,
+        summary.milestones,
+        summary.releases,
+        source.forge.name(),
+        source.project
+    );
+    audit::Entry::new(audit::Action::RepoImport, audit::Via::Cli, local_user().as_deref())
+        .with_repo(&name)
+        .with_detail(detail.clone())
+        .record(&args.data_dir);
+    println!("{}", detail.replacen("migrated", "Migrated", 1));
+    if summary.skipped_issues > 0 {
+        println!("Skipped {} issues whose numbers were taken", summary.skipped_issues);
+    }
+    for (login, user) in &summary.mapped_users {
+        println!("{} -> {}", login, user);
+    }
+    if !summary.unmapped_users.is_empty() {
+        println!(
+            "No account for {} (give one with --map <login>=<user>)",
+            summary.unmapped_users.join(", ")
+        );
+    }
+    Ok(())
+}
+
+fn repos_command(
+    args: &Args,
+    hook_templates: &hooks::Templates,
+    action: &ReposAction,
+) -> Result<()> {
+    let actor = local_user();
+    match action {
+        ReposAction::List => {
+            for (name, path) in git::find_repositories(&args.repos)? {
+                let size = usage::scan_repo(&path)
+                    .map(|usage| usage::format_bytes(usage.bytes))
+                    .unwrap_or_else(|_| "?".to_string());
+                let visibility = visibility::effective(&path, orgs::in_org(&args.data_dir, &name));
+                println!(
+                    "{}  {}  {}{}",
+                    name,
+                    size,
+                    visibility.name(),
+                    if archive::is_archived(&path) { "  archived" } else { "" }
+                );
+            }
+        }
+        ReposAction::Create { name, owner, visibility: chosen } => {
+            let name = namespaces::qualified_name(name)?;
+            let repo_path = args.repos.join(&name);
+            if repo_path.exists() {
+                anyhow::bail!("{} already exists", name);
+            }
+            if let Some(owner) = owner {
+                if users::get(&args.data_dir, owner).is_none() {
+                    anyhow::bail!("No such user: {}", owner);
+                }
+            }
+            git::init_bare_repo(&repo_path, hook_templates)?;
+            let chosen = chosen.unwrap_or(args.default_visibility);
+            visibility::set(&repo_path, chosen)?;
+            if let Some(owner) = owner {
+                orgs::created(&args.data_dir, &args.repos, &name, owner)?;
+            }
+            audit::Entry::new(audit::Action::RepoCreate, audit::Via::Cli, actor.as_deref())
+                .with_repo(&name)
+                .with_detail(chosen.name())
+                .record(&args.data_dir);
+            println!("Created {} ({})", name, chosen.name());
+        }
+        ReposAction::Delete { name } => {
+            let name = namespaces::qualified_name(name)?;
+            let deleted = trash::delete(&args.repos, &name, actor.as_deref())?;
+            audit::Entry::new(audit::Action::RepoDelete, audit::Via::Cli, actor.as_deref())
+                .with_repo(&name)
+                .with_detail(format!("moved to the trash as {}", deleted.id))
+                .record(&args.data_dir);
+            println!("Deleted {}; restore it with `admin trash restore {}`", name, deleted.id);
+        }
+    }
+    Ok(())
+}
+
+fn users_command(args: &Args, action: &UsersAction) -> Result<()> {
+    let actor = local_user();
+    let record = |name: &str, detail: &str| {
+        audit::Entry::new(audit::Action::AccountChange, audit::Via::Cli, actor.as_deref())
+            .with_target(name)
+            .with_detail(detail)
+            .record(&args.data_dir);
+    };
+    match action {
+        UsersAction::List => {
+            for (name, user) in users::load(&args.data_dir)? {
+                println!(
+                    "{}  {} <{}>  {}{}  {} keys",
+                    name,
+                    user.display_name,
+                    user.email,
+                    user.state.name(),
+                    if user.admin { ", admin" } else { "" },
+                    user.keys.len()
+                );
+            }
+        }
+        UsersAction::Add {
+            name,
+            email,
+            display_name,
+            admin,
+            keys,
+        } => {
+            let mut user = users::User::new(
+                display_name.as_deref().unwrap_or(name),
+                email,
+                users::State::Active,
+            );
+            user.admin = *admin;
+            for key in keys {
+                user.keys.push(users::normalize_key(key)?);
+            }
+            users::create(&args.data_dir, name, user)?;
+            record(name, "created");
+            println!("Created {}", name);
+        }
+        UsersAction::Remove { name } => {
+            users::remove(&args.data_dir, name)?;
+            record(name, "deleted");
+            println!("Deleted {}", name);
+        }
+    }
+    Ok(())
+}
+
+fn keys_command(args: &Args, action: &KeysAction) -> Result<()> {
+    let actor = local_user();
+    match action {
+        KeysAction::List { user } => {
+            for (name, account) in users::load(&args.data_dir)? {
+                if user.as_ref().map_or(false, |user| *user != name) {
+                    continue;
+                }
+                for key in &account.keys {
+                    println!(
+                        "{}  {}  {}",
+                        name,
+                        audit::key_fingerprint(key),
+                        key.split_whitespace().nth(2).unwrap_or("")
+                    );
+                }
+            }
+        }
+        KeysAction::Add { user, key } => {
+            let key = users::normalize_key(key)?;
+            users::update(&args.data_dir, user, |account| {
+                if account.keys.contains(&key) {
+                    anyhow::bail!("{} has this key already", user);
+                }
+                account.keys.push(key.clone());
+                Ok(())
+            })?;
+            let fingerprint = audit::key_fingerprint(&key);
+            audit::Entry::new(audit::Action::KeyAdd, audit::Via::Cli, actor.as_deref())
+                .with_target(user)
+                .with_detail(fingerprint.clone())
+                .record(&args.data_dir);
+            println!("Added {} to {}", fingerprint, user);
+        }
+        KeysAction::Remove { user, key } => {
+            // A key is matched by its type and data, ignoring the comment
+            let given: Vec<&str> = key.split_whitespace().take(2).collect();
+            let wanted = match users::normalize_key(key) {
+                Ok(key) => audit::key_fingerprint(&key),
+                Err(_) => key.trim().to_string(),
+            };
+            users::update(&args.data_dir, user, |account| {
+                let before = account.keys.len();
+                account.keys.retain(|key| {
+                    let fields: Vec<&str> = key.split_whitespace().take(2).collect();
+                    fields != given && audit::key_fingerprint(key) != wanted
+                });
+                if account.keys.len() == before {
+                    anyhow::bail!("{} has no key {}", user, wanted);
+                }
+                Ok(())
+            })?;
+            audit::Entry::new(audit::Action::KeyRemove, audit::Via::Cli, actor.as_deref())
+                .with_target(user)
+                .with_detail(wanted.clone())
+                .record(&args.data_dir);
+            println!("Removed {} from {}", wanted, user);
+        }
+    }
+    Ok(())
+}
+
+/// Run maintenance tasks on some or all repositories, exiting non-zero if any
+/// failed
+fn maintain(args: &Args, tasks: &[maintenance::Task], only: &[String]) -> Result<()> {
+    let schedule = maintenance::Schedule {
+        tasks: tasks.to_vec(),
+        concurrency: args.maintenance_concurrency,
+    };
+    let report = maintenance::run(&args.repos, &schedule, only)?;
+    report.print();
+    if report.failures() > 0 {
+        std::process::exit(1);
+    }
+    Ok(())
+}
+
+fn clear_pack_cache(args: &Args, only: &[String]) -> Result<()> {
+    let mut total = 0;
+    for (name, repo_path) in git::find_repositories(&args.repos)? {
+        if !only.is_empty() && !only.contains(&name) {
+            continue;
+        }
+        let freed = pack_cache::clear(&repo_path)?;
+        if freed > 0 {
+            println!("{}: {}", name, usage::format_bytes(freed));
+        }
+        total += freed;
+    }
+    println!("Freed {}", usage::format_bytes(total));
+    Ok(())
+}
+
+fn search_index(args: &Args, only: &[String]) -> Result<()> {
+    let mut failed = false;
+    for (name, repo_path) in git::find_repositories(&args.repos)? {
+        if !only.is_empty() && !only.contains(&name) {
+            continue;
+        }
+        // Empty repositories have nothing to index
+        if only.is_empty() && !search::indexable(&repo_path) {
+            continue;
+        }
+        match search::build(&repo_path) {
+            Ok(meta) => println!(
+                "{}: indexed {} files of {} ({} skipped)",
+                name,
+                meta.files.len(),
+                meta.branch,
+                meta.skipped
+            ),
+            Err(e) => {
+                eprintln!("{}: {:#}", name, e);
+                failed = true;
+            }
+        }
+    }
+    if failed {
+        std::process::exit(1);
+    }
+    Ok(())
+}
+
+fn maintenance_command(args: &Args, action: &MaintenanceAction) -> Result<()> {
+    let repo = |name: &str| -> Result<(String, PathBuf)> {
+        let name = namespaces::qualified_name(name)?;
+        let repo_path = args.repos.join(&name);
+        if !repo_path.is_dir() {
+            anyhow::bail!("No such repository: {}", name);
+        }
+        Ok((name, repo_path))
+    };
+    match action {
+        MaintenanceAction::On { repo: None, message } => {
+            let notice = maintenance_mode::Notice::new(message, local_user().as_deref());
+            maintenance_mode::set_server(&args.data_dir, Some(&notice))?;
+            tracing::info!(user = ?notice.by, "Server maintenance started");
+            println!("The server is in maintenance; pushes and merges are refused");
+        }
+        MaintenanceAction::On { repo: Some(name), message } => {
+            let (name, repo_path) = repo(name)?;
+            let notice = maintenance_mode::Notice::new(message, local_user().as_deref());
+            maintenance_mode::set_repo(&repo_path, Some(&notice))?;
+            tracing::info!(repo = %name, user = ?notice.by, "Repository maintenance started");
+            println!("{} is in maintenance; pushes and merges are refused", name);
+        }
+        MaintenanceAction::Off { repo: None } => {
+            maintenance_mode::set_server(&args.data_dir, None)?;
+            println!("The server is out of maintenance");
+        }
+        MaintenanceAction::Off { repo: Some(name) } => {
+            let (name, repo_path) = repo(name)?;
+            maintenance_mode::set_repo(&repo_path, None)?;
+            println!("{} is out of maintenance", name);
+        }
+        MaintenanceAction::Status => {
+            let describe = |notice: &maintenance_mode::Notice| {
+                let since = chrono::DateTime::from_timestamp(notice.since, 0)
+                    .map(|t| format!(" since {}", t.format("%Y-%m-%d %H:%M UTC")))
+                    .unwrap_or_default();
+                let by = notice.by.as_ref().map(|by| format!(" by {}", by)).unwrap_or_default();
+                let message = if notice.message.is_empty() {
+                    String::new()
+                } else {
+                    format!(": {}", notice.message)
+                };
+                format!("in maintenance{}{}{}", since, by, message)
+            };
+            match maintenance_mode::server(&args.data_dir) {
+                Some(notice) => println!("Server: {}", describe(&notice)),
+                None => println!("Server: not in maintenance"),
+            }
+            for (name, repo_path) in git::find_repositories(&args.repos)? {
+                if let Some(notice) = maintenance_mode::repo(&repo_path) {
+                    println!("{}: {}", name, describe(&notice));
+                }
+            }
+        }
+    }
+    Ok(())
+}
+
+fn trash_command(args: &Args, action: &TrashAction) -> Result<()> {
+    let actor = local_user();
+    match action {
+        TrashAction::List => {
+            let deleted = trash::list(&args.repos)?;
+            if deleted.is_empty() {
+                println!("The trash is empty");
+            }
+            for deleted in deleted {
+                let when = chrono::DateTime::from_timestamp(deleted.deleted, 0)
+                    .map(|t| t.format("%Y-%m-%d %H:%M UTC").to_string())
+                    .unwrap_or_default();
+                let purge = match args.trash_retention_days {
+                    0 => String::new(),
+                    days => {
+                        let purge = deleted.deleted + days as i64 * 24 * 3600;
+                        chrono::DateTime::from_timestamp(purge, 0)
+                            .map(|t| format!(", purged after {}", t.format("%Y-%m-%d")))
+                            .unwrap_or_default()
+                    }
+                };
+                println!(
+                    "{}  {} ({}, deleted {}{}{})",
+                    deleted.id,
+                    deleted.name,
+                    usage::format_bytes(deleted.bytes),
+                    when,
+                    deleted
+                        .deleted_by
+                        .map(|user| format!(" by {}", user))
+                        .unwrap_or_default(),
+                    purge
+                );
+            }
+        }
+        TrashAction::Restore { id, name } => {
+            let name = match name {
+                Some(name) => Some(namespaces::qualified_name(name)?),
+                None => None,
+            };
+            let restored = trash::restore(&args.repos, id, name.as_deref())?;
+            audit::Entry::new(audit::Action::RepoRestore, audit::Via::Cli, actor.as_deref())
+                .with_repo(&restored)
+                .with_detail(format!("restored from the trash ({})", id))
+                .record(&args.data_dir);
+            println!("Restored {}", restored);
+        }
+        TrashAction::Purge { id } => {
+            let purged = trash::purge(&args.repos, id)?;
+            audit::Entry::new(audit::Action::RepoDelete, audit::Via::Cli, actor.as_deref())
+                .with_repo(&purged.name)
+                .with_detail(format!("purged from the trash ({})", id))
+                .record(&args.data_dir);
+            println!("Purged {}", purged.name);
+        }
+    }
+    Ok(())
+}
+
+/// Who is running the command, for the audit log
+fn local_user() -> Option<String> {
+    std::env::var("SUDO_USER")
+        .or_else(|_| std::env::var("USER"))
+        .ok()
+}
+
+/// List what a backup or restore left out, failing if anything was
+fn report_skipped(summary: &backup::Summary) {
+    for skipped in &summary.skipped {
+        eprintln!("Skipped {}", skipped);
+    }
+    if !summary.skipped.is_empty() {
+        std::process::exit(1);
+    }
+}
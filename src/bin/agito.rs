@@ -1,4 +1,5 @@
-use agito::git;
+use agito::profile::{Profile, Protocol};
+use agito::{bundle, clone_all, credential, doctor, git, rest, serve, sync, telemetry, trust, tui, version};
 use std::env;
 use std::process::{Command, exit};
 
@@ -13,8 +14,28 @@ fn main() {
     let command = &args[1];
 
     match command.as_str() {
+        "bundle" => handle_bundle(&args[2..]),
         "clone" => handle_clone(&args[2..]),
         "create" => handle_create(&args[2..]),
+        "credential" => handle_credential(&args[2..]),
+        "doctor" => handle_doctor(),
+        "grep" => handle_grep(&args[2..]),
+        "import" => handle_import(&args[2..]),
+        "info" => handle_info(&args[2..]),
+        "key" => handle_key(&args[2..]),
+        "ci" => handle_read("ci", &args[2..]),
+        "issue" => handle_read("issue", &args[2..]),
+        "list" => handle_list(&args[2..]),
+        "log" if is_remote_log(&args[2..]) => handle_log(&args[2..]),
+        "pr" => handle_pr(&args[2..]),
+        "release" => handle_release(&args[2..]),
+        "push" if args[2..].iter().any(|arg| arg == "--check") => handle_push_check(&args[2..]),
+        "repo" => handle_repo(&args[2..]),
+        "serve" => handle_serve(&args[2..]),
+        "sync" => handle_sync(&args[2..]),
+        "trust" => handle_trust(&args[2..]),
+        "tui" => handle_tui(),
+        "version" | "--version" => handle_version(&args[2..]),
         "help" | "--help" | "-h" => print_usage(),
         _ => {
             // Pass through to git for standard git commands
@@ -30,14 +51,125 @@ Usage:
   agito <command> [arguments]
 
 Agito Commands:
+  bundle <name> [--since <rev>] [-o <file>] [<ref>...]
+                           Download a git bundle of a repository's branches and
+                           tags, or only the refs given; with --since, only
+                           what is new since that revision
+  ci <name> list [--branch=<branch>] | show <build>
+                           Show a repository's CI builds
   clone <url>              Clone a repository from agito server
-  create <name>            Create a new bare repository on agito server
+  clone --all [<dir>] [--include <pattern>] [--exclude <pattern>] [--mirror]
+        [-j <n>]           Clone every repository you may read into a
+                           directory (default .), or fetch the ones already
+                           there; patterns like alice/* pick repositories,
+                           --mirror makes bare mirrors, -j sets how many run
+                           at once (default 4)
+  create <name> [--visibility public|internal|private]
+         [--template <repo> [--with-hooks]]
+                           Create a repository in your namespace on agito server
+                           (/<name> for a top-level repository); without
+                           --visibility it gets the server's default. With
+                           --template it starts with a template's files, and
+                           with --with-hooks its hooks and CI script too
+  credential setup         Make git take access tokens from the profile's
+                           token when cloning and pushing over HTTP
+  credential get|store|erase
+                           Run as git's credential helper (see setup)
+  doctor                   Diagnose git, SSH and server connectivity problems
+  grep <text> [<name>] [--lang <language>] [--path <prefix>]
+                           Search the default branch of a repository, or of
+                           all you may read, on agito server for text
+                           (ignoring case), printing [repo:]path:line:text
+  import <name> <url>      Import a repository from another server into your
+                           namespace (run again to resume an interrupted import)
+  info <name>              Show a repository's disk usage and quota
+  issue <name> list [--state=<s>] [--label=<label>] | show <n>
+                           Show a repository's issues
+  key add --deploy <name> <public-key-file> [--title <title>]
+                           Let a key fetch one repository and nothing else,
+                           e.g. for CI jobs (needs admin access to it)
+  key list --deploy <name> List a repository's deploy keys
+  key remove --deploy <name> <id>
+                           Remove a deploy key
+  list                     List the repositories you may read
+  log [--remote] <name> [<ref>] [-n <count>] [--stat]
+                           Show the latest commits of a branch or tag (the
+                           default branch if none) of a repository on agito
+                           server; without --remote only when <name> is not
+                           a local revision or path, else it runs git log
+  pr <name> <action> [arguments]
+                           Work with pull requests: list [--state=<s>],
+                           show <n>, create <base> <head> <title> [body],
+                           comment <n> <text>, close <n>, reopen <n>,
+                           merge <n> [--strategy=<s>] [message] and
+                           update <n> [--rebase]
+  --json                   With list, info, grep, log, ci, issue and
+                           pr list|show: print JSON instead, with errors
+                           only on stderr
+  release <name> <action> [arguments]
+                           Work with releases of tags: list, show <tag>,
+                           create <tag> [title] [notes] [--prerelease]
+                           [--draft], upload <tag> <file> [<asset-name>],
+                           remove-asset <tag> <asset-name> and delete <tag>
+  push --check [<remote>] [<refspec>...]
+                           Ask the server whether a push would be accepted,
+                           without pushing
+  repo <name> archive      Make a finished repository read-only and hide it
+                           from the repository list (needs admin access)
+  repo <name> unarchive    Let an archived repository take pushes again
+  repo <name> delete       Delete a repository; it stays in the server's trash
+                           for a while, where a server admin can restore it
+  repo <name> rename <new-name>
+                           Rename a repository, or move it to another namespace
+                           (org/name); the old name keeps working for a while
+  repo <name> visibility [public|internal|private]
+                           Show or change who may read a repository: anyone,
+                           signed-in users, or only those granted a role
+  repo <name> default-branch [<branch>]
+                           Show or change a repository's default branch, the
+                           one HEAD points to and clones check out
+  repo <name> export       Serve a public repository over git://, when the
+                           server runs the git daemon
+  repo <name> unexport     Stop serving a repository over git://
+  repo <name> template [on|off]
+                           Show or change whether a repository is offered as
+                           a template for new repositories
+  repo <name> collaborators
+                           List the users granted a role on a repository
+  repo <name> collaborator add <user> read|write|admin
+                           Grant a user a role on a repository
+  repo <name> collaborator remove <user>
+                           Take a user's role on a repository away
+  serve [<dir>] [--port <n>] [--ssh-port <n>] [--bind <addr>]
+                           Serve a directory of bare repositories (default .)
+                           in the web viewer and for clones over HTTP, and
+                           over SSH with --ssh-port, until interrupted
+  sync [<dir>] [--manifest <file>] [--visibility public|internal|private]
+                           Copy the repositories in a directory (default .),
+                           or listed in a manifest, to agito server: create
+                           any it doesn't have and push all branches and tags
+  trust [<server>] [--yes] Fetch a server's SSH host keys (the profile's if
+                           none is given), show their fingerprints, check
+                           them against those its web server publishes when
+                           the profile has a url, and after you confirm,
+                           trust them in ~/.ssh/known_hosts
+  tui                      Browse the server's repositories, their branches,
+                           commits and files in the terminal, and clone or
+                           create repositories from there
+  version [--remote]       Show agito's version, and with --remote the
+                           server's and the commands it supports
   help                     Show this help message
 
 Git Commands:
   Any standard git command will be passed through to git
   Examples: agito status, agito commit -m "message", agito push, etc.
 
+Configuration:
+  Profiles in ~/.config/agito/config set server, user, protocol, url and
+  token; AGITO_PROFILE picks one, and AGITO_SERVER, AGITO_USER, AGITO_TOKEN
+  etc. override it. With protocol = https, create, list, info and repo
+  <name> delete use the REST API with the token instead of SSH
+
 Examples:
   agito clone ssh://user@server/repo.git
   agito create myrepo
@@ -48,6 +180,10 @@ Examples:
 }
 
 fn handle_clone(args: &[String]) {
+    if args.iter().any(|arg| arg == "--all") {
+        handle_clone_all(args);
+        return;
+    }
     if args.is_empty() {
         eprintln!("Error: clone requires a repository URL");
         exit(1);
@@ -62,25 +198,907 @@ fn handle_clone(args: &[String]) {
     }
 }
 
+fn handle_clone_all(args: &[String]) {
+    let usage = || -> ! {
+        eprintln!(
+            "Error: usage: agito clone --all [<dir>] [--include <pattern>] [--exclude <pattern>] [--mirror] [-j <n>]"
+        );
+        exit(1);
+    };
+    let mut options = clone_all::Options {
+        dir: ".".into(),
+        include: Vec::new(),
+        exclude: Vec::new(),
+        mirror: false,
+        jobs: 4,
+    };
+    let mut dir_given = false;
+    let mut rest = args.iter();
+    while let Some(arg) = rest.next() {
+        match arg.as_str() {
+            "--all" => {}
+            "--include" => options.include.push(rest.next().unwrap_or_else(|| usage()).clone()),
+            "--exclude" => options.exclude.push(rest.next().unwrap_or_else(|| usage()).clone()),
+            "--mirror" => options.mirror = true,
+            "-j" | "--jobs" => {
+                options.jobs = match rest.next().and_then(|jobs| jobs.parse().ok()) {
+                    Some(jobs) if jobs > 0 => jobs,
+                    _ => usage(),
+                }
+            }
+            dir if !dir.starts_with('-') && !dir_given => {
+                options.dir = dir.into();
+                dir_given = true;
+            }
+            _ => usage(),
+        }
+    }
+
+    let Profile { server, user, .. } = profile();
+    require(&server, &user, "list", "clone --all");
+
+    let names = match git::list_remote_repos(&server, &user) {
+        Ok(names) => options.select(names),
+        Err(e) => {
+            eprintln!("Error listing repositories: {}", e);
+            exit(1);
+        }
+    };
+    if names.is_empty() {
+        println!("No repositories to clone");
+        return;
+    }
+
+    let failed = std::sync::atomic::AtomicUsize::new(0);
+    clone_all::run(&server, &user, &names, &options, &|name, result| {
+        let target = options.target(name);
+        match result {
+            Ok(clone_all::Outcome::Cloned) => {
+                println!("{}: cloned to {}", name, target.display())
+            }
+            Ok(clone_all::Outcome::Fetched) => {
+                println!("{}: fetched into {}", name, target.display())
+            }
+            Err(e) => {
+                failed.fetch_add(1, std::sync::atomic::Ordering::Relaxed);
+                println!("{}: failed: {:#}", name, e);
+            }
+        }
+    });
+    let failed = failed.into_inner();
+    println!(
+        "{} of {} repositories up to date in {}",
+        names.len() - failed,
+        names.len(),
+        options.dir.display()
+    );
+    if failed > 0 {
+        exit(1);
+    }
+}
+
 fn handle_create(args: &[String]) {
+    let usage = || -> ! {
+        eprintln!(
+            "Error: usage: agito create <name> [--visibility public|internal|private] [--template <repo> [--with-hooks]]"
+        );
+        exit(1);
+    };
+    let (mut repo_name, mut visibility, mut template, mut with_hooks) = (None, None, None, false);
+    let mut args = args.iter();
+    while let Some(arg) = args.next() {
+        match arg.as_str() {
+            "--visibility" => visibility = Some(args.next().unwrap_or_else(|| usage()).as_str()),
+            "--template" => template = Some(args.next().unwrap_or_else(|| usage()).as_str()),
+            "--with-hooks" => with_hooks = true,
+            _ if repo_name.is_none() && !arg.starts_with('-') => repo_name = Some(arg.as_str()),
+            _ => usage(),
+        }
+    }
+    let repo_name = repo_name.unwrap_or_else(|| usage());
+    if with_hooks && template.is_none() {
+        usage();
+    }
+
+    let profile = profile();
+    if let Some(client) = rest_client(&profile) {
+        let created = match client.create(repo_name, visibility, template, with_hooks) {
+            Ok(created) => created,
+            Err(e) => {
+                eprintln!("Error creating repository: {}", e);
+                exit(1);
+            }
+        };
+        let name = created["name"].as_str().unwrap_or(repo_name);
+        println!("Repository '{}' created successfully on {}", name, client.url());
+        if let Some(url) = created["clone_urls"]["http"].as_str() {
+            println!("Clone it with: agito clone {}", url);
+        }
+        return;
+    }
+    let Profile { server, user, .. } = profile;
+    require(&server, &user, "create-repo", "create");
+
+    let created = match git::create_remote_repo(&server, &user, repo_name, visibility, template, with_hooks) {
+        Ok(created) => created,
+        Err(e) => {
+            eprintln!("Error creating repository: {}", e);
+            exit(1);
+        }
+    };
+
+    println!("Repository '{}' created successfully on {}", created.name, server);
+    println!("Clone it with: agito clone {}", clone_url(&created, &user, &server));
+}
+
+fn handle_credential(args: &[String]) {
+    match args.first().map(String::as_str) {
+        Some("setup") => {
+            let profile = profile();
+            let Some(url) = profile.url else {
+                eprintln!("Error: the profile has no url of the web server");
+                exit(1);
+            };
+            if profile.token.is_none() {
+                eprintln!("warning: the profile has no token yet; create one on the web interface's Access tokens page");
+            }
+            if let Err(e) = credential::setup(&url) {
+                eprintln!("Error: {:#}", e);
+                exit(1);
+            }
+            println!("git now takes the profile's token for {}", url);
+        }
+        Some("get") => {
+            let mut input = String::new();
+            let _ = std::io::Read::read_to_string(&mut std::io::stdin(), &mut input);
+            if let Some(reply) = credential::get(&credential::parse(&input)) {
+                print!("{}", reply);
+            }
+        }
+        // Tokens live in the profiles; git tells the helper about them
+        // anyway
+        Some("store") | Some("erase") => {
+            let _ = std::io::Read::read_to_string(&mut std::io::stdin(), &mut String::new());
+        }
+        _ => {
+            eprintln!("Error: usage: agito credential setup|get|store|erase");
+            exit(1);
+        }
+    }
+}
+
+fn handle_import(args: &[String]) {
+    if args.len() < 2 {
+        eprintln!("Error: import requires a repository name and the URL to import from");
+        exit(1);
+    }
+
+    let Profile { server, user, .. } = profile();
+    require(&server, &user, "import", "import");
+
+    let imported = match git::import_remote_repo(&server, &user, &args[0], &args[1]) {
+        Ok(imported) => imported,
+        Err(e) => {
+            eprintln!("Error importing repository: {}", e);
+            exit(1);
+        }
+    };
+
+    println!("Repository '{}' imported on {}", imported.name, server);
+    println!("Clone it with: agito clone {}", clone_url(&imported, &user, &server));
+}
+
+/// The URL the server gave for a new repository, or one built from how we
+/// reached it
+fn clone_url(repo: &git::RemoteRepo, user: &str, server: &str) -> String {
+    repo.clone_url
+        .clone()
+        .unwrap_or_else(|| format!("ssh://{}@{}/{}", user, server, repo.name))
+}
+
+fn handle_bundle(args: &[String]) {
+    let mut output = None;
+    let mut remote_args = Vec::new();
+    let mut rest = args.iter();
+    while let Some(arg) = rest.next() {
+        match arg.as_str() {
+            "-o" | "--output" => output = rest.next().cloned(),
+            "--since" => {
+                remote_args.push(arg.clone());
+                remote_args.extend(rest.next().cloned());
+            }
+            _ => remote_args.push(arg.clone()),
+        }
+    }
+    if remote_args.is_empty() {
+        eprintln!("Error: usage: agito bundle <name> [--since <rev>] [-o <file>] [<ref>...]");
+        exit(1);
+    }
+    let repo = remote_args.remove(0);
+    let output = output.unwrap_or_else(|| bundle::file_name(&repo));
+
+    let Profile { server, user, .. } = profile();
+    require(&server, &user, "bundle", "bundle");
+
+    match git::remote_bundle(&server, &user, &repo, &remote_args, std::path::Path::new(&output)) {
+        Ok(bytes) => println!("Wrote {} ({} bytes)", output, bytes),
+        Err(e) => {
+            eprintln!("Error: {}", e);
+            exit(1);
+        }
+    }
+}
+
+fn handle_sync(args: &[String]) {
+    let usage = || -> ! {
+        eprintln!(
+            "Error: usage: agito sync [<dir>] [--manifest <file>] [--visibility public|internal|private]"
+        );
+        exit(1);
+    };
+    let mut dir: Option<std::path::PathBuf> = None;
+    let mut manifest: Option<std::path::PathBuf> = None;
+    let mut visibility = None;
+    let mut rest = args.iter();
+    while let Some(arg) = rest.next() {
+        match arg.as_str() {
+            "--manifest" => manifest = Some(rest.next().unwrap_or_else(|| usage()).into()),
+            "--visibility" => visibility = Some(rest.next().unwrap_or_else(|| usage()).as_str()),
+            path if !path.starts_with('-') && dir.is_none() => dir = Some(path.into()),
+            _ => usage(),
+        }
+    }
+
+    let entries = match (&manifest, &dir) {
+        (Some(_), Some(_)) => usage(),
+        (Some(manifest), None) => sync::read_manifest(manifest),
+        (None, dir) => sync::walk(dir.as_deref().unwrap_or(std::path::Path::new("."))),
+    };
+    let entries = match entries {
+        Ok(entries) if entries.is_empty() => {
+            eprintln!("Error: no repositories to sync");
+            exit(1);
+        }
+        Ok(entries) => entries,
+        Err(e) => {
+            eprintln!("Error: {:#}", e);
+            exit(1);
+        }
+    };
+
+    let Profile { server, user, .. } = profile();
+    require(&server, &user, "create-repo", "sync");
+
+    let mut failed = 0;
+    for entry in &entries {
+        match sync::sync(&server, &user, entry, visibility) {
+            Ok(synced) if !synced.rejected.is_empty() => {
+                failed += 1;
+                println!(
+                    "{}: failed: {} rejected: {}",
+                    entry.path.display(),
+                    synced.name,
+                    synced.rejected.join(", ")
+                );
+            }
+            Ok(synced) => {
+                let what = match (synced.created, synced.updated) {
+                    (true, n) => format!("created, {} refs pushed", n),
+                    (false, 0) => "up to date".to_string(),
+                    (false, n) => format!("{} refs updated", n),
+                };
+                println!("{}: {} {}", entry.path.display(), synced.name, what);
+            }
+            Err(e) => {
+                failed += 1;
+                println!("{}: failed: {:#}", entry.path.display(), e);
+            }
+        }
+    }
+    println!(
+        "{} of {} repositories synced to {}",
+        entries.len() - failed,
+        entries.len(),
+        server
+    );
+    if failed > 0 {
+        exit(1);
+    }
+}
+
+fn handle_trust(args: &[String]) {
+    let yes = args.iter().any(|arg| arg == "--yes" || arg == "-y");
+    let positional: Vec<&String> = args.iter().filter(|arg| !arg.starts_with('-')).collect();
+    let profile = profile();
+    let (server, url) = match positional.as_slice() {
+        [] => (profile.server.clone(), profile.url.clone()),
+        // The profile's web server only vouches for the profile's server
+        [server] if **server == profile.server => (profile.server.clone(), profile.url.clone()),
+        [server] => (server.to_string(), None),
+        _ => {
+            eprintln!("Error: usage: agito trust [<server>] [--yes]");
+            exit(1);
+        }
+    };
+
+    let keys = match trust::scan(&server) {
+        Ok(keys) => keys,
+        Err(e) => {
+            eprintln!("Error: {:#}", e);
+            exit(1);
+        }
+    };
+    println!("{} offers these host keys:", server);
+    for key in &keys {
+        println!("  {:<22} {}", key.algorithm, key.fingerprint);
+    }
+
+    let verified = match url {
+        Some(url) => match trust::published(&url) {
+            Ok(published) if keys.iter().all(|key| trust::listed(key, &published)) => {
+                println!("They match the keys {} publishes.", url);
+                true
+            }
+            Ok(_) => {
+                eprintln!(
+                    "Error: they don't match the keys {}/api/v1/host-keys publishes; someone may be in the way, so nothing was trusted",
+                    url.trim_end_matches('/')
+                );
+                exit(1);
+            }
+            Err(e) => {
+                eprintln!("Error: {:#}", e);
+                exit(1);
+            }
+        },
+        None => {
+            println!(
+                "Compare them with the fingerprints on the server's /host-keys page, or ask its admin."
+            );
+            false
+        }
+    };
+
+    let known = trust::known(&server);
+    if !known.is_empty() && keys.iter().all(|key| trust::listed(key, &known)) {
+        println!("They are already trusted.");
+        return;
+    }
+    if !known.is_empty() {
+        eprintln!("warning: ~/.ssh/known_hosts trusts other keys for {}; they will be replaced", server);
+        // A changed key nobody checked may be someone in the way: only the
+        // user, having compared the fingerprints, may replace the old ones
+        if !verified && yes {
+            eprintln!(
+                "Error: nothing vouches for the new keys, so they aren't trusted with --yes; run `agito trust {}` and confirm after comparing the fingerprints",
+                server
+            );
+            exit(1);
+        }
+    }
+
+    if !yes {
+        eprint!("Trust them? [y/N] ");
+        let mut answer = String::new();
+        if std::io::stdin().read_line(&mut answer).is_err()
+            || !matches!(answer.trim(), "y" | "Y" | "yes")
+        {
+            eprintln!("Not trusted");
+            exit(1);
+        }
+    }
+    match trust::pin(&server, &keys) {
+        Ok(path) => println!("Trusted {} host keys of {} in {}", keys.len(), server, path.display()),
+        Err(e) => {
+            eprintln!("Error: {:#}", e);
+            exit(1);
+        }
+    }
+}
+
+fn handle_tui() {
+    let Profile { server, user, .. } = profile();
+    require(&server, &user, "list", "tui");
+
+    if let Err(e) = tui::run(&server, &user) {
+        eprintln!("Error: {:#}", e);
+        exit(1);
+    }
+}
+
+fn handle_serve(args: &[String]) {
+    let mut options = serve::Options {
+        dir: ".".into(),
+        bind: "0.0.0.0".to_string(),
+        http_port: 8080,
+        ssh_port: None,
+    };
+    let port = |value: Option<&String>| match value.and_then(|value| value.parse().ok()) {
+        Some(port) => port,
+        None => {
+            eprintln!("Error: a port must be a number from 1 to 65535");
+            exit(1);
+        }
+    };
+    let mut rest = args.iter();
+    while let Some(arg) = rest.next() {
+        match arg.as_str() {
+            "--port" => options.http_port = port(rest.next()),
+            "--ssh-port" => options.ssh_port = Some(port(rest.next())),
+            "--bind" => options.bind = rest.next().cloned().unwrap_or(options.bind),
+            dir if !dir.starts_with('-') => options.dir = dir.into(),
+            _ => {
+                eprintln!(
+                    "Error: usage: agito serve [<dir>] [--port <n>] [--ssh-port <n>] [--bind <addr>]"
+                );
+                exit(1);
+            }
+        }
+    }
+
+    let runtime = match tokio::runtime::Runtime::new() {
+        Ok(runtime) => runtime,
+        Err(e) => {
+            eprintln!("Error: {}", e);
+            exit(1);
+        }
+    };
+    let result = runtime.block_on(async {
+        telemetry::init("agito", None, telemetry::LogFormat::Text, Some("warn"))?;
+        serve::run(options).await
+    });
+    if let Err(e) = result {
+        eprintln!("Error: {:#}", e);
+        exit(1);
+    }
+}
+
+fn handle_info(args: &[String]) {
     if args.is_empty() {
-        eprintln!("Error: create requires a repository name");
+        eprintln!("Error: info requires a repository name");
         exit(1);
     }
 
-    let repo_name = &args[0];
+    let json = args[1..].iter().any(|arg| arg == "--json");
+    let profile = profile();
+    if let Some(client) = rest_client(&profile) {
+        match client.quota(&args[0]) {
+            Ok(reply) if json => println!("{}", reply),
+            Ok(reply) => print!(
+                "Repository: {}\n{}",
+                reply["name"].as_str().unwrap_or(&args[0]),
+                rest::quota_status(&reply).describe()
+            ),
+            Err(e) => {
+                eprintln!("Error: {:#}", e);
+                exit(1);
+            }
+        }
+        return;
+    }
+    let Profile { server, user, .. } = profile;
+    require(&server, &user, "info", "info");
+
+    if json {
+        print_reply(&server, &user, "agito-info", args);
+        return;
+    }
+    if let Err(e) = git::remote_repo_info(&server, &user, &args[0]) {
+        eprintln!("Error: {}", e);
+        exit(1);
+    }
+}
+
+fn handle_key(args: &[String]) {
+    let mut repo = None;
+    let mut title = None;
+    let mut positional = Vec::new();
+    let mut rest = args.iter();
+    while let Some(arg) = rest.next() {
+        match arg.as_str() {
+            "--deploy" => repo = rest.next().cloned(),
+            "--title" => title = rest.next().cloned(),
+            _ => positional.push(arg.clone()),
+        }
+    }
+    let repo = match repo {
+        Some(repo) => repo,
+        None => {
+            eprintln!("Error: key needs --deploy <repository>; add keys to your account on the web interface");
+            exit(1);
+        }
+    };
+
+    let remote_args = match (positional.first().map(String::as_str), &positional[1..]) {
+        (Some("list"), []) => vec!["list".to_string()],
+        (Some("add"), [file]) => {
+            let key = match std::fs::read_to_string(file) {
+                Ok(content) => content.lines().next().unwrap_or("").trim().to_string(),
+                Err(e) => {
+                    eprintln!("Error reading {}: {}", file, e);
+                    exit(1);
+                }
+            };
+            let mut remote_args = vec!["add".to_string(), key];
+            remote_args.extend(title);
+            remote_args
+        }
+        (Some("remove"), [id]) => vec!["remove".to_string(), id.clone()],
+        _ => {
+            eprintln!("Error: usage: agito key add|list|remove --deploy <repository> [<public-key-file>|<id>]");
+            exit(1);
+        }
+    };
 
-    // Get server from environment or use default
-    let server = env::var("AGITO_SERVER").unwrap_or_else(|_| "localhost:2222".to_string());
-    let user = env::var("AGITO_USER").unwrap_or_else(|_| "git".to_string());
+    let Profile { server, user, .. } = profile();
+    require(&server, &user, "deploy-key", "key");
 
-    if let Err(e) = git::create_remote_repo(&server, &user, repo_name) {
-        eprintln!("Error creating repository: {}", e);
+    if let Err(e) = git::remote_deploy_key(&server, &user, &repo, &remote_args) {
+        eprintln!("Error: {}", e);
         exit(1);
     }
+}
+
+fn handle_repo(args: &[String]) {
+    let (repo, remote_args) = match args {
+        [repo, action] if action == "archive" || action == "unarchive" => (repo, vec![action.clone()]),
+        [repo, action] if action == "export" || action == "unexport" => (repo, vec![action.clone()]),
+        [repo, action, ..] if action == "visibility" || action == "default-branch" || action == "collaborators" || action == "collaborator" => {
+            (repo, args[1..].to_vec())
+        }
+        [repo, action, to] if action == "rename" => (repo, vec![action.clone(), to.clone()]),
+        [repo, action] if action == "delete" => {
+            confirm_delete(repo);
+            (repo, vec![action.clone()])
+        }
+        _ => {
+            eprintln!("Error: usage: agito repo <name> archive|unarchive|delete|rename <new-name>|visibility [<v>]|default-branch [<branch>]|export|unexport|collaborators|collaborator add <user> <role>|collaborator remove <user>");
+            exit(1);
+        }
+    };
+
+    let profile = profile();
+    if let Some(client) = rest_client(&profile) {
+        if remote_args != ["delete"] {
+            eprintln!("Error: only `agito repo <name> delete` works over https; use ssh for the rest");
+            exit(1);
+        }
+        match client.delete(repo) {
+            Ok(id) => println!("Deleted {}; a server admin can restore it from the trash as {}", repo, id),
+            Err(e) => {
+                eprintln!("Error: {:#}", e);
+                exit(1);
+            }
+        }
+        return;
+    }
+    let Profile { server, user, .. } = profile;
+    if remote_args[0] == "default-branch" {
+        require(&server, &user, "set-default-branch", "repo <name> default-branch");
+    } else {
+        require(&server, &user, "repo", "repo");
+    }
+
+    if let Err(e) = git::remote_repo(&server, &user, repo, &remote_args) {
+        eprintln!("Error: {}", e);
+        exit(1);
+    }
+}
+
+/// Make the user type the repository's name before deleting it
+fn confirm_delete(repo: &str) {
+    eprint!("This deletes {} for everyone. Type its name to confirm: ", repo);
+    let mut answer = String::new();
+    if std::io::stdin().read_line(&mut answer).is_err() || answer.trim() != repo {
+        eprintln!("Not deleted");
+        exit(1);
+    }
+}
+
+fn handle_pr(args: &[String]) {
+    if args.len() < 2 {
+        eprintln!("Error: pr requires a repository name and an action");
+        exit(1);
+    }
+
+    let Profile { server, user, .. } = profile();
+    require(&server, &user, "pr", "pr");
+
+    if args.iter().any(|arg| arg == "--json") {
+        print_reply(&server, &user, "agito-pr", args);
+        return;
+    }
+    if let Err(e) = git::remote_pr(&server, &user, &args[0], &args[1..]) {
+        eprintln!("Error: {}", e);
+        exit(1);
+    }
+}
+
+fn handle_grep(args: &[String]) {
+    let usage = || -> ! {
+        eprintln!(
+            "Error: usage: agito grep <text> [<name>] [--lang <language>] [--path <prefix>] [--json]"
+        );
+        exit(1);
+    };
+    let mut remote_args = Vec::new();
+    let mut positional = 0;
+    let mut rest = args.iter();
+    while let Some(arg) = rest.next() {
+        match arg.as_str() {
+            "--lang" | "--path" => remote_args.push(format!(
+                "{}={}",
+                arg,
+                rest.next().unwrap_or_else(|| usage())
+            )),
+            "--json" => remote_args.push(arg.clone()),
+            flag if flag.starts_with("--lang=") || flag.starts_with("--path=") => {
+                remote_args.push(arg.clone())
+            }
+            _ if positional < 2 => {
+                positional += 1;
+                remote_args.push(arg.clone());
+            }
+            _ => usage(),
+        }
+    }
+    if positional == 0 {
+        usage();
+    }
+
+    let Profile { server, user, .. } = profile();
+    require(&server, &user, "grep", "grep");
+
+    match git::remote_grep(&server, &user, &remote_args) {
+        Ok(code) => exit(code),
+        Err(e) => {
+            eprintln!("Error: {}", e);
+            exit(2);
+        }
+    }
+}
+
+/// `agito issue` and `agito ci`, which only read
+fn handle_read(command: &str, args: &[String]) {
+    if args.len() < 2 {
+        eprintln!("Error: {} requires a repository name and an action", command);
+        exit(1);
+    }
+
+    let Profile { server, user, .. } = profile();
+    require(&server, &user, command, command);
+
+    print_reply(&server, &user, &format!("agito-{}", command), args);
+}
+
+/// Whether `agito log` is about a repository on the server rather than
+/// `git log`: it is with --remote, or when the first argument is neither a
+/// local revision nor a path
+fn is_remote_log(args: &[String]) -> bool {
+    match args.first().map(String::as_str) {
+        Some("--remote") => true,
+        Some(arg) if !arg.starts_with('-') => {
+            let local_revision = Command::new("git")
+                .args(["rev-parse", "--verify", "--quiet", &format!("{}^{{commit}}", arg)])
+                .stdout(std::process::Stdio::null())
+                .stderr(std::process::Stdio::null())
+                .status()
+                .map(|status| status.success())
+                .unwrap_or(false);
+            !local_revision && !std::path::Path::new(arg).exists()
+        }
+        _ => false,
+    }
+}
+
+fn handle_log(args: &[String]) {
+    let args: Vec<String> = args.iter().filter(|arg| *arg != "--remote").cloned().collect();
+    if args.is_empty() {
+        eprintln!("Error: usage: agito log [--remote] <name> [<ref>] [-n <count>] [--stat] [--json]");
+        exit(1);
+    }
+
+    let Profile { server, user, .. } = profile();
+    require(&server, &user, "log", "log");
+
+    print_reply(&server, &user, "agito-log", &args);
+}
+
+fn handle_list(args: &[String]) {
+    if args.iter().any(|arg| arg != "--json") {
+        eprintln!("Error: usage: agito list [--json]");
+        exit(1);
+    }
+
+    let profile = profile();
+    if let Some(client) = rest_client(&profile) {
+        let repos = match client.list() {
+            Ok(repos) => repos,
+            Err(e) => {
+                eprintln!("Error: {:#}", e);
+                exit(1);
+            }
+        };
+        if args.is_empty() {
+            for repo in repos.as_array().into_iter().flatten() {
+                println!("{}", repo["name"].as_str().unwrap_or_default());
+            }
+        } else {
+            println!("{}", repos);
+        }
+        return;
+    }
+    let Profile { server, user, .. } = profile;
+    require(&server, &user, "list", "list");
+
+    print_reply(&server, &user, "agito-list", args);
+}
+
+/// Print what the server replies to `command`, or the reply as an error on
+/// stderr, so that scripts reading `--json` output get nothing else
+fn print_reply(server: &str, user: &str, command: &str, args: &[String]) {
+    match git::remote_reply(server, user, command, args) {
+        Ok(reply) => print!("{}", reply),
+        Err(e) => {
+            eprintln!("Error: {:#}", e);
+            exit(1);
+        }
+    }
+}
+
+fn handle_release(args: &[String]) {
+    if args.len() < 2 {
+        eprintln!("Error: release requires a repository name and an action");
+        exit(1);
+    }
+
+    let Profile { server, user, .. } = profile();
+    require(&server, &user, "release", "release");
+
+    // Uploads send the file itself; the server only needs its name
+    let (remote_args, upload) = match (args[1].as_str(), &args[2..]) {
+        ("upload", [tag, file, rest @ ..]) if rest.len() <= 1 => {
+            let path = std::path::Path::new(file);
+            let name = match rest.first() {
+                Some(name) => name.clone(),
+                None => path
+                    .file_name()
+                    .map(|name| name.to_string_lossy().to_string())
+                    .unwrap_or_default(),
+            };
+            (vec!["upload".to_string(), tag.clone(), name], Some(path))
+        }
+        ("upload", _) => {
+            eprintln!("Error: usage: agito release <name> upload <tag> <file> [<asset-name>]");
+            exit(1);
+        }
+        _ => (args[1..].to_vec(), None),
+    };
+
+    if let Err(e) = git::remote_release(&server, &user, &args[0], &remote_args, upload) {
+        eprintln!("Error: {}", e);
+        exit(1);
+    }
+}
+
+fn handle_push_check(args: &[String]) {
+    let mut positional = args.iter().filter(|arg| *arg != "--check");
+    let remote = match positional.next() {
+        Some(remote) => remote.clone(),
+        None => default_remote(),
+    };
+    let refspecs: Vec<String> = positional.cloned().collect();
+
+    match git::check_push(&remote, &refspecs) {
+        Ok(true) => {}
+        Ok(false) => exit(1),
+        Err(e) => {
+            eprintln!("Error: {}", e);
+            exit(1);
+        }
+    }
+}
+
+/// The profile to reach the server with, from the config file and the
+/// environment
+fn profile() -> Profile {
+    match Profile::load() {
+        Ok(profile) => profile,
+        Err(e) => {
+            eprintln!("Error: {:#}", e);
+            exit(1);
+        }
+    }
+}
+
+/// A client for the REST API if the profile uses https rather than SSH
+fn rest_client(profile: &Profile) -> Option<rest::Client> {
+    if profile.protocol != Protocol::Https {
+        return None;
+    }
+    match rest::Client::new(profile) {
+        Ok(client) => Some(client),
+        Err(e) => {
+            eprintln!("Error: {:#}", e);
+            exit(1);
+        }
+    }
+}
 
-    println!("Repository '{}' created successfully on {}", repo_name, server);
-    println!("Clone it with: agito clone ssh://{}@{}/{}", user, server, repo_name);
+/// Stop with an explanation, rather than the server's "Unknown command", if
+/// the server is too old for `command`
+fn require(server: &str, user: &str, capability: &str, command: &str) {
+    if let Err(e) = version::require(server, user, capability, command) {
+        eprintln!("Error: {:#}", e);
+        exit(1);
+    }
+}
+
+fn handle_version(args: &[String]) {
+    println!("agito {}", version::VERSION);
+    match args {
+        [] => return,
+        [flag] if flag == "--remote" => {}
+        _ => {
+            eprintln!("Error: usage: agito version [--remote]");
+            exit(1);
+        }
+    }
+
+    let Profile { server, user, .. } = profile();
+
+    let remote = match version::remote(&server, &user) {
+        Ok(remote) => remote,
+        Err(e) => {
+            eprintln!("Error: {:#}", e);
+            exit(1);
+        }
+    };
+    println!("{}: agito-server {}", server, remote.describe());
+    match &remote.capabilities {
+        Some(capabilities) => println!("Supports: {}", capabilities.join(", ")),
+        None => println!("Supports: (not advertised; the server predates capabilities)"),
+    }
+    if !remote.compatible() {
+        eprintln!(
+            "warning: agito {} may not work with this server; upgrade whichever is older",
+            version::VERSION
+        );
+        exit(1);
+    }
+}
+
+/// Remote the current branch pushes to, like `git push` without arguments
+fn default_remote() -> String {
+    let config = |key: String| {
+        Command::new("git")
+            .args(["config", "--get", &key])
+            .output()
+            .ok()
+            .filter(|output| output.status.success())
+            .map(|output| String::from_utf8_lossy(&output.stdout).trim().to_string())
+    };
+    let branch = Command::new("git")
+        .args(["symbolic-ref", "--quiet", "--short", "HEAD"])
+        .output()
+        .map(|output| String::from_utf8_lossy(&output.stdout).trim().to_string())
+        .unwrap_or_default();
+    config(format!("branch.{}.pushRemote", branch))
+        .or_else(|| config("remote.pushDefault".to_string()))
+        .or_else(|| config(format!("branch.{}.remote", branch)))
+        .unwrap_or_else(|| "origin".to_string())
+}
+
+fn handle_doctor() {
+    let Profile { server, user, .. } = profile();
+
+    println!("Checking agito setup for {}@{}\n", user, server);
+
+    let repo = git::remote_repo_name(&default_remote());
+    let checks = doctor::run(&server, &user, repo.as_deref());
+    if !doctor::report(&checks) {
+        exit(1);
+    }
 }
 
 fn pass_to_git(args: &[String]) {
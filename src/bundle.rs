@@ -0,0 +1,142 @@
+//! Git bundles of a repository, for carrying it to machines that can't
+//! reach the server, or keeping a cheap offline copy.
+//!
+//! A bundle holds the chosen refs, all branches and tags by default, and
+//! the objects they need. One made `since` a commit leaves out what that
+//! commit already has, so it only applies to a copy that has it, and can
+//! be fetched from like a remote: `git pull repo.bundle main`.
+
+use crate::git;
+use std::path::Path;
+use std::process::Command;
+
+/// What to put in a bundle
+#[derive(Clone, Debug, Default)]
+pub struct Request {
+    /// Branches, tags or full ref names; all branches and tags if empty
+    pub refs: Vec<String>,
+    /// Leave out the objects this revision already has
+    pub since: Option<String>,
+}
+
+impl Request {
+    /// Refs from a comma- or whitespace-separated list
+    pub fn new(refs: &str, since: Option<&str>) -> Self {
+        Self {
+            refs: refs
+                .split(|c: char| c == ',' || c.is_whitespace())
+                .filter(|name| !name.is_empty())
+                .map(str::to_string)
+                .collect(),
+            since: since
+                .map(str::trim)
+                .filter(|since| !since.is_empty())
+                .map(str::to_string),
+        }
+    }
+
+    /// Check the request against the repository, and turn it into the
+    /// arguments of `git bundle create`, writing the bundle to stdout
+    pub fn resolve(&self, repo_path: &Path) -> Result<Vec<String>, String> {
+        let mut refs = Vec::new();
+        if self.refs.is_empty() {
+            refs = lines(
+                repo_path,
+                &[
+                    "for-each-ref",
+                    "--format=%(refname)",
+                    "refs/heads",
+                    "refs/tags",
+                ],
+            );
+            if refs.is_empty() {
+                return Err("The repository is empty".to_string());
+            }
+            // So a clone of the bundle checks out the default branch
+            if git::head_branch(repo_path).map_or(false, |branch| {
+                refs.contains(&format!("refs/heads/{}", branch))
+            }) {
+                refs.insert(0, "HEAD".to_string());
+            }
+        }
+        for name in &self.refs {
+            if name.starts_with('-') {
+                return Err(format!("Invalid ref '{}'", name));
+            }
+            match lines(
+                repo_path,
+                &[
+                    "rev-parse",
+                    "--verify",
+                    "--quiet",
+                    "--symbolic-full-name",
+                    name,
+                ],
+            )
+            .pop()
+            {
+                Some(full) if full.starts_with("refs/") => refs.push(full),
+                _ => return Err(format!("No branch or tag named '{}'", name)),
+            }
+        }
+        refs.dedup();
+
+        let mut args: Vec<String> = ["bundle", "create", "--quiet", "-"]
+            .iter()
+            .map(|arg| arg.to_string())
+            .collect();
+        args.extend(refs.iter().cloned());
+        if let Some(since) = &self.since {
+            let base = if since.starts_with('-') {
+                None
+            } else {
+                lines(
+                    repo_path,
+                    &[
+                        "rev-parse",
+                        "--verify",
+                        "--quiet",
+                        &format!("{}^{{commit}}", since),
+                    ],
+                )
+                .pop()
+            };
+            let base = base.ok_or_else(|| format!("Unknown revision '{}'", since))?;
+            // git refuses to make a bundle with nothing in it
+            let mut rev_list = vec!["rev-list", "-n", "1"];
+            rev_list.extend(refs.iter().map(String::as_str));
+            let not_base = format!("^{}", base);
+            rev_list.push(&not_base);
+            if lines(repo_path, &rev_list).is_empty() {
+                return Err(format!("Nothing new since {}", since));
+            }
+            args.push(not_base);
+        }
+        Ok(args)
+    }
+}
+
+/// Output lines of a git command, none if it failed
+fn lines(repo_path: &Path, args: &[&str]) -> Vec<String> {
+    match git::run(repo_path, args) {
+        Ok(output) if output.status.success() => String::from_utf8_lossy(&output.stdout)
+            .lines()
+            .map(str::to_string)
+            .collect(),
+        _ => Vec::new(),
+    }
+}
+
+/// The `git bundle create` command for arguments from [`Request::resolve`]
+pub fn command(repo_path: &Path, args: &[String]) -> Command {
+    let mut command = Command::new("git");
+    command.arg("-C").arg(repo_path).args(args);
+    command
+}
+
+/// File name for a bundle of a repository: `webshop.bundle` for
+/// `team/webshop.git`
+pub fn file_name(repo_name: &str) -> String {
+    let name = repo_name.rsplit('/').next().unwrap_or(repo_name);
+    format!("{}.bundle", name.strip_suffix(".git").unwrap_or(name))
+}
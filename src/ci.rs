@@ -0,0 +1,508 @@
+//! Continuous integration: builds of pushed commits, run by the server.
+//!
+//! The post-receive hook queues a build for every branch update whose new
+//! commit has a pipeline (see [`pipeline`]). Builds live below the
+//! repository's `agito/ci/` directory:
+//!
+//! - `builds/<id>.json`: what was built, its state and its steps
+//! - `queue/<id>`: waiting for a runner, which claims it by moving it to
+//!   `running/<id>`
+//! - `logs/<id>.log`: output of every step, expired by retention
+//! - `status/<commit>`: state of the commit's latest build, for badges
+//! - `statuses/<commit>.json`: states reported for the commit by outside CI
+//!   systems through the API, one per context
+//!
+//! Finished builds are sent to build webhooks.
+
+pub mod pipeline;
+pub mod runner;
+
+use crate::git;
+use crate::webhooks::{self, Event};
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+
+/// Outcome of the CI pipeline for a commit
+#[derive(Clone, Copy, Debug, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum State {
+    Pending,
+    Success,
+    Failure,
+}
+
+impl FromStr for State {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "pending" => Ok(Self::Pending),
+            "success" => Ok(Self::Success),
+            "failure" => Ok(Self::Failure),
+            _ => Err(format!(
+                "unknown CI state '{}' (expected pending, success or failure)",
+                s
+            )),
+        }
+    }
+}
+
+impl State {
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::Pending => "pending",
+            Self::Success => "success",
+            Self::Failure => "failure",
+        }
+    }
+}
+
+/// Directory holding one file per commit, named by its full id and containing its state
+pub fn status_dir(repo_path: &Path) -> PathBuf {
+    git::data_dir(repo_path).join("ci").join("status")
+}
+
+/// CI state of a commit, if the pipeline ran for it
+pub fn status(repo_path: &Path, commit: &str) -> Option<State> {
+    if commit.is_empty() || !commit.chars().all(|c| c.is_ascii_hexdigit()) {
+        return None;
+    }
+    fs::read_to_string(status_dir(repo_path).join(commit))
+        .ok()?
+        .trim()
+        .parse()
+        .ok()
+}
+
+/// Write the state of a commit's latest build, for badges
+pub fn set_status(repo_path: &Path, commit: &str, state: State) -> Result<()> {
+    let dir = status_dir(repo_path);
+    fs::create_dir_all(&dir)?;
+    fs::write(dir.join(commit), format!("{}\n", state.name()))?;
+    Ok(())
+}
+
+/// Contexts an outside system may report for one commit
+const MAX_CONTEXTS: usize = 100;
+
+/// State of a commit as reported by an outside CI system, such as
+/// "ci/jenkins: success"; a new report replaces the one of the same context
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct CommitStatus {
+    /// What reported the state, such as "ci/jenkins"
+    pub context: String,
+    pub state: State,
+    /// Where the details are, such as the build's page
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub target_url: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub description: String,
+    /// User who reported it
+    pub creator: String,
+    /// Unix time
+    pub updated: i64,
+}
+
+fn statuses_path(repo_path: &Path, commit: &str) -> PathBuf {
+    ci_dir(repo_path)
+        .join("statuses")
+        .join(format!("{}.json", commit))
+}
+
+fn valid_commit_id(commit: &str) -> bool {
+    commit.len() == 40 && commit.chars().all(|c| c.is_ascii_hexdigit())
+}
+
+/// States reported for a commit by outside systems, by context
+pub fn statuses(repo_path: &Path, commit: &str) -> Result<Vec<CommitStatus>> {
+    if !valid_commit_id(commit) {
+        return Ok(Vec::new());
+    }
+    let path = statuses_path(repo_path, commit);
+    match fs::read_to_string(&path) {
+        Ok(content) => serde_json::from_str(&content)
+            .with_context(|| format!("Failed to parse {}", path.display())),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(Vec::new()),
+        Err(e) => Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    }
+}
+
+/// Record a state reported for a commit, given by its full id
+pub fn report_status(repo_path: &Path, commit: &str, status: CommitStatus) -> Result<()> {
+    if !valid_commit_id(commit) {
+        anyhow::bail!("Invalid commit id '{}'", commit);
+    }
+    if status.context.is_empty() || status.context.len() > 255 {
+        anyhow::bail!("The context must be between 1 and 255 characters");
+    }
+    if !status.target_url.is_empty()
+        && !status.target_url.starts_with("https://")
+        && !status.target_url.starts_with("http://")
+    {
+        anyhow::bail!("The target URL must be an http or https URL");
+    }
+    let mut statuses = statuses(repo_path, commit)?;
+    statuses.retain(|existing| existing.context != status.context);
+    if statuses.len() >= MAX_CONTEXTS {
+        anyhow::bail!("A commit can have at most {} status contexts", MAX_CONTEXTS);
+    }
+    statuses.push(status);
+    statuses.sort_by(|a, b| a.context.cmp(&b.context));
+
+    let path = statuses_path(repo_path, commit);
+    if let Some(dir) = path.parent() {
+        fs::create_dir_all(dir)?;
+    }
+    let tmp = path.with_extension("json.tmp");
+    fs::write(&tmp, serde_json::to_string_pretty(&statuses)?)?;
+    fs::rename(&tmp, &path)?;
+    Ok(())
+}
+
+/// State of a commit over its own build and every outside report: failure
+/// if anything failed, pending while anything runs, else success
+pub fn combined_status(repo_path: &Path, commit: &str) -> Option<State> {
+    let states: Vec<State> = status(repo_path, commit)
+        .into_iter()
+        .chain(
+            statuses(repo_path, commit)
+                .unwrap_or_default()
+                .into_iter()
+                .map(|status| status.state),
+        )
+        .collect();
+    if states.is_empty() {
+        None
+    } else if states.contains(&State::Failure) {
+        Some(State::Failure)
+    } else if states.contains(&State::Pending) {
+        Some(State::Pending)
+    } else {
+        Some(State::Success)
+    }
+}
+
+/// A step of a build and how it went
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct StepRun {
+    pub name: String,
+    /// Pending until the step has run, and for good if an earlier one failed
+    pub state: State,
+    /// Exit code, if the step ran to its end
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub exit_code: Option<i32>,
+    /// Seconds the step took
+    #[serde(default)]
+    pub duration: u64,
+}
+
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Build {
+    pub id: u64,
+    /// Branch pushed to, e.g. refs/heads/main
+    pub refname: String,
+    /// Commit the branch pointed at before the push
+    pub before: String,
+    /// Commit built
+    pub commit: String,
+    /// User who pushed, or who asked for the build again
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub pusher: Option<String>,
+    pub state: State,
+    pub steps: Vec<StepRun>,
+    /// Why the build failed outside of any step, e.g. an invalid pipeline
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub error: Option<String>,
+    /// Unix time the build was queued
+    pub created: i64,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub started: Option<i64>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub finished: Option<i64>,
+}
+
+impl Build {
+    /// Branch name without refs/heads/
+    pub fn branch(&self) -> &str {
+        self.refname
+            .strip_prefix("refs/heads/")
+            .unwrap_or(&self.refname)
+    }
+
+    /// "queued", "running", "success" or "failure"
+    pub fn status_name(&self) -> &'static str {
+        match (self.state, self.started) {
+            (State::Pending, None) => "queued",
+            (State::Pending, Some(_)) => "running",
+            (state, _) => state.name(),
+        }
+    }
+
+    /// Seconds between start and end, or until now while running
+    pub fn duration(&self) -> Option<i64> {
+        let end = self
+            .finished
+            .unwrap_or_else(|| chrono::Utc::now().timestamp());
+        self.started.map(|started| (end - started).max(0))
+    }
+}
+
+fn ci_dir(repo_path: &Path) -> PathBuf {
+    git::data_dir(repo_path).join("ci")
+}
+
+fn builds_dir(repo_path: &Path) -> PathBuf {
+    ci_dir(repo_path).join("builds")
+}
+
+fn build_path(repo_path: &Path, id: u64) -> PathBuf {
+    builds_dir(repo_path).join(format!("{}.json", id))
+}
+
+/// Output of a build's steps
+pub fn log_path(repo_path: &Path, id: u64) -> PathBuf {
+    ci_dir(repo_path).join("logs").join(format!("{}.log", id))
+}
+
+fn queue_dir(repo_path: &Path) -> PathBuf {
+    ci_dir(repo_path).join("queue")
+}
+
+fn running_dir(repo_path: &Path) -> PathBuf {
+    ci_dir(repo_path).join("running")
+}
+
+/// IDs of the files named `<id><suffix>` in a directory, in order
+fn ids(dir: &Path, suffix: &str) -> Result<Vec<u64>> {
+    let entries = match fs::read_dir(dir) {
+        Ok(entries) => entries,
+        Err(e) if e.kind() == io::ErrorKind::NotFound => return Ok(Vec::new()),
+        Err(e) => return Err(e).with_context(|| format!("Failed to read {}", dir.display())),
+    };
+    let mut ids: Vec<u64> = entries
+        .filter_map(|entry| {
+            entry
+                .ok()?
+                .file_name()
+                .to_str()?
+                .strip_suffix(suffix)?
+                .parse()
+                .ok()
+        })
+        .collect();
+    ids.sort_unstable();
+    Ok(ids)
+}
+
+/// Builds of a repository, newest first
+pub fn list(repo_path: &Path) -> Result<Vec<Build>> {
+    let mut builds = Vec::new();
+    for id in ids(&builds_dir(repo_path), ".json")?.into_iter().rev() {
+        builds.extend(get(repo_path, id)?);
+    }
+    Ok(builds)
+}
+
+pub fn get(repo_path: &Path, id: u64) -> Result<Option<Build>> {
+    let path = build_path(repo_path, id);
+    match fs::read_to_string(&path) {
+        // Just claimed by create() and not written yet
+        Ok(content) if content.is_empty() => Ok(None),
+        Ok(content) => serde_json::from_str(&content)
+            .map(Some)
+            .with_context(|| format!("Failed to parse {}", path.display())),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(None),
+        Err(e) => Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    }
+}
+
+/// The latest build of a commit
+pub fn latest_for(repo_path: &Path, commit: &str) -> Result<Option<Build>> {
+    Ok(list(repo_path)?
+        .into_iter()
+        .find(|build| build.commit == commit))
+}
+
+/// Queue builds for the branch updates of a push, given as (old, new,
+/// refname), whose new commit has a pipeline that builds the branch.
+/// Returns the builds queued.
+pub fn enqueue(
+    repo_path: &Path,
+    updates: &[(String, String, String)],
+    pusher: Option<&str>,
+) -> Result<Vec<Build>> {
+    let mut queued = Vec::new();
+    for (old, new, refname) in updates {
+        let branch = match refname.strip_prefix("refs/heads/") {
+            Some(branch) if !git::is_zero(new) => branch,
+            _ => continue,
+        };
+        let pipeline = pipeline::load(repo_path, branch, old, new);
+        if let Ok(pipeline) = &pipeline {
+            if !pipeline.as_ref().map_or(false, |p| p.builds(branch)) {
+                continue;
+            }
+        }
+        queued.push(create(repo_path, refname, old, new, pusher, pipeline)?);
+    }
+    Ok(queued)
+}
+
+/// Queue a build of the same commit as an earlier one
+pub fn retry(repo_path: &Path, id: u64, pusher: Option<&str>) -> Result<Build> {
+    let build = get(repo_path, id)?.with_context(|| format!("No such build: {}", id))?;
+    let pipeline = pipeline::load(repo_path, build.branch(), &build.before, &build.commit)
+        .and_then(|pipeline| pipeline.context("The commit has no pipeline"));
+    create(
+        repo_path,
+        &build.refname,
+        &build.before,
+        &build.commit,
+        pusher,
+        pipeline.map(Some),
+    )
+}
+
+/// Save a new build, queued, or failed right away if its pipeline could
+/// not be read
+fn create(
+    repo_path: &Path,
+    refname: &str,
+    before: &str,
+    commit: &str,
+    pusher: Option<&str>,
+    pipeline: Result<Option<pipeline::Pipeline>>,
+) -> Result<Build> {
+    let now = chrono::Utc::now().timestamp();
+    let mut build = Build {
+        id: 0,
+        refname: refname.to_string(),
+        before: before.to_string(),
+        commit: commit.to_string(),
+        pusher: pusher.map(str::to_string),
+        state: State::Pending,
+        steps: Vec::new(),
+        error: None,
+        created: now,
+        started: None,
+        finished: None,
+    };
+    match pipeline {
+        Ok(pipeline) => {
+            build.steps = pipeline
+                .map(|pipeline| pipeline.steps)
+                .unwrap_or_default()
+                .into_iter()
+                .map(|step| StepRun {
+                    name: step.name,
+                    state: State::Pending,
+                    exit_code: None,
+                    duration: 0,
+                })
+                .collect();
+        }
+        Err(e) => {
+            build.state = State::Failure;
+            build.error = Some(format!("{:#}", e));
+            build.finished = Some(now);
+        }
+    }
+
+    fs::create_dir_all(builds_dir(repo_path))?;
+    let mut id = ids(&builds_dir(repo_path), ".json")?
+        .last()
+        .copied()
+        .unwrap_or(0)
+        + 1;
+    // Claim the id by creating its file, so concurrent pushes can't get the
+    // same one
+    loop {
+        match fs::OpenOptions::new()
+            .write(true)
+            .create_new(true)
+            .open(build_path(repo_path, id))
+        {
+            Ok(_) => break,
+            Err(e) if e.kind() == io::ErrorKind::AlreadyExists => id += 1,
+            Err(e) => return Err(e).context("Failed to create the build"),
+        }
+    }
+    build.id = id;
+    save(repo_path, &build)?;
+    set_status(repo_path, commit, build.state)?;
+    if build.state == State::Pending {
+        fs::create_dir_all(queue_dir(repo_path))?;
+        fs::write(queue_dir(repo_path).join(id.to_string()), "")?;
+    } else {
+        finished(repo_path, &build);
+    }
+    Ok(build)
+}
+
+/// Send a finished build to the repository's build webhooks
+fn finished(repo_path: &Path, build: &Build) {
+    webhooks::trigger(
+        repo_path,
+        Event::Build,
+        || serde_json::json!({"action": "finished", "build": build, "sender": build.pusher}),
+    );
+}
+
+/// Take the oldest queued build of a repository for running, if any.
+/// Runners move its marker from the queue, so each build runs once.
+pub fn claim(repo_path: &Path) -> Result<Option<Build>> {
+    for id in ids(&queue_dir(repo_path), "")? {
+        fs::create_dir_all(running_dir(repo_path))?;
+        match fs::rename(
+            queue_dir(repo_path).join(id.to_string()),
+            running_dir(repo_path).join(id.to_string()),
+        ) {
+            Ok(()) => {}
+            // Another runner was faster
+            Err(e) if e.kind() == io::ErrorKind::NotFound => continue,
+            Err(e) => return Err(e).context("Failed to claim a build"),
+        }
+        match get(repo_path, id)? {
+            Some(build) => return Ok(Some(build)),
+            None => release(repo_path, id),
+        }
+    }
+    Ok(None)
+}
+
+/// Builds a runner claimed and has not finished
+pub fn running(repo_path: &Path) -> Result<Vec<u64>> {
+    ids(&running_dir(repo_path), "")
+}
+
+/// Let go of a claimed build once it finished
+pub fn release(repo_path: &Path, id: u64) {
+    let _ = fs::remove_file(running_dir(repo_path).join(id.to_string()));
+}
+
+/// Change a build and save it, returning the result
+pub fn update(
+    repo_path: &Path,
+    id: u64,
+    change: impl FnOnce(&mut Build) -> Result<()>,
+) -> Result<Build> {
+    let mut build = get(repo_path, id)?.with_context(|| format!("No such build: {}", id))?;
+    change(&mut build)?;
+    save(repo_path, &build)?;
+    if build.finished.is_some() {
+        set_status(repo_path, &build.commit, build.state)?;
+    }
+    Ok(build)
+}
+
+fn save(repo_path: &Path, build: &Build) -> Result<()> {
+    let path = build_path(repo_path, build.id);
+    let tmp = path.with_extension("json.tmp");
+    fs::write(&tmp, serde_json::to_string_pretty(build)?)?;
+    fs::rename(&tmp, &path)?;
+    Ok(())
+}
@@ -0,0 +1,501 @@
+//! Pipeline definitions: `.agito-ci.yml` at the root of a commit's tree.
+//!
+//! ```yaml
+//! image: rust:1.80          # run the steps in this container (optional)
+//! branches: [main, release/*]
+//! timeout: 30m
+//! env:
+//!   RUST_BACKTRACE: 1
+//! steps:
+//!   - cargo build
+//!   - name: Test
+//!     run: |
+//!       cargo test
+//!       cargo clippy
+//! ```
+//!
+//! Only the part of YAML such files need is understood: block mappings and
+//! sequences, `[a, b]` lists, quoted and plain scalars, and `|`/`>` blocks.
+//! Every scalar is read as a string.
+//!
+//! Repositories without a definition may keep the older `agito-ci.sh` in the
+//! repository directory, which becomes a pipeline of one step.
+
+use crate::glob::glob_match;
+use anyhow::{Context, Result};
+use serde::Deserialize;
+use serde_json::{Map, Value};
+use std::collections::BTreeMap;
+use std::path::Path;
+use std::time::Duration;
+
+/// Where a commit defines its pipeline
+pub const FILE: &str = ".agito-ci.yml";
+
+/// Script in the repository directory run by repositories without [`FILE`]
+pub const LEGACY_SCRIPT: &str = "agito-ci.sh";
+
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct Pipeline {
+    /// Container image to run the steps in
+    pub image: Option<String>,
+    /// Globs of the branches to build; all branches if empty
+    pub branches: Vec<String>,
+    pub env: BTreeMap<String, String>,
+    /// Longest the build may take; the runner's limit applies if None
+    pub timeout: Option<Duration>,
+    pub steps: Vec<Step>,
+}
+
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct Step {
+    pub name: String,
+    /// Shell script, run with `sh -e -c`
+    pub run: String,
+}
+
+#[derive(Deserialize)]
+#[serde(deny_unknown_fields)]
+struct Definition {
+    #[serde(default)]
+    image: Option<String>,
+    #[serde(default)]
+    branches: Vec<String>,
+    #[serde(default)]
+    env: BTreeMap<String, String>,
+    #[serde(default)]
+    timeout: Option<String>,
+    /// Commands, or mappings read as [`NamedStep`]
+    steps: Vec<Value>,
+}
+
+#[derive(Deserialize)]
+#[serde(deny_unknown_fields)]
+struct NamedStep {
+    #[serde(default)]
+    name: Option<String>,
+    run: String,
+}
+
+impl Pipeline {
+    pub fn parse(text: &str) -> Result<Self> {
+        let definition: Definition = serde_json::from_value(parse_yaml(text)?)
+            .map_err(|e| anyhow::anyhow!("Invalid pipeline: {}", e))?;
+        if definition.steps.is_empty() {
+            anyhow::bail!("Invalid pipeline: no steps");
+        }
+        let timeout = match &definition.timeout {
+            Some(timeout) => Some(parse_duration(timeout).map_err(anyhow::Error::msg)?),
+            None => None,
+        };
+        let mut steps = Vec::new();
+        for (i, step) in definition.steps.into_iter().enumerate() {
+            let step = match step {
+                Value::String(run) => NamedStep { name: None, run },
+                Value::Object(_) => serde_json::from_value(step)
+                    .map_err(|e| anyhow::anyhow!("Invalid pipeline: step {}: {}", i + 1, e))?,
+                _ => anyhow::bail!(
+                    "Invalid pipeline: step {} is neither a command nor a name and run",
+                    i + 1
+                ),
+            };
+            steps.push(Step {
+                name: step
+                    .name
+                    .unwrap_or_else(|| step.run.lines().next().unwrap_or("").to_string()),
+                run: step.run,
+            });
+        }
+        Ok(Self {
+            image: definition.image.filter(|image| !image.is_empty()),
+            branches: definition.branches,
+            env: definition.env,
+            timeout,
+            steps,
+        })
+    }
+
+    /// The pipeline of a repository's `agito-ci.sh`, which gets the branch
+    /// and the old and new commit as arguments and `GIT_DIR`, as it did when
+    /// the hook ran it
+    fn legacy(repo_path: &Path, script: &Path, branch: &str, old: &str, new: &str) -> Self {
+        let quote = |s: &str| format!("'{}'", s.replace('\'', "'\\''"));
+        Self {
+            image: None,
+            branches: Vec::new(),
+            env: BTreeMap::from([(
+                "GIT_DIR".to_string(),
+                repo_path.to_string_lossy().to_string(),
+            )]),
+            timeout: None,
+            steps: vec![Step {
+                name: LEGACY_SCRIPT.to_string(),
+                run: format!(
+                    "sh {} {} {} {}",
+                    quote(&script.to_string_lossy()),
+                    quote(branch),
+                    quote(old),
+                    quote(new)
+                ),
+            }],
+        }
+    }
+
+    /// Whether pushes to `branch` are built
+    pub fn builds(&self, branch: &str) -> bool {
+        self.branches.is_empty() || self.branches.iter().any(|glob| glob_match(glob, branch))
+    }
+}
+
+/// The pipeline to build `new` with after a push to `branch`: the commit's
+/// own definition, or the repository's `agito-ci.sh`
+pub fn load(repo_path: &Path, branch: &str, old: &str, new: &str) -> Result<Option<Pipeline>> {
+    let output = crate::git::run(repo_path, &["show", &format!("{}:{}", new, FILE)])?;
+    if output.status.success() {
+        let text =
+            String::from_utf8(output.stdout).with_context(|| format!("{} is not UTF-8", FILE))?;
+        return Pipeline::parse(&text)
+            .with_context(|| format!("{} in {}", FILE, &new[..8.min(new.len())]))
+            .map(Some);
+    }
+    let script = repo_path.join(LEGACY_SCRIPT);
+    Ok(script
+        .is_file()
+        .then(|| Pipeline::legacy(repo_path, &script, branch, old, new)))
+}
+
+/// Parse a duration such as "90s", "30m", "2h" or "600" (seconds)
+pub fn parse_duration(s: &str) -> Result<Duration, String> {
+    let s = s.trim();
+    let split = s.find(|c: char| !c.is_ascii_digit()).unwrap_or(s.len());
+    let (number, unit) = s.split_at(split);
+    let number: u64 = number
+        .parse()
+        .map_err(|_| format!("invalid duration '{}'", s))?;
+    let seconds = match unit.trim() {
+        "" | "s" => 1,
+        "m" => 60,
+        "h" => 3600,
+        _ => {
+            return Err(format!(
+                "invalid duration unit in '{}' (expected s, m or h)",
+                s
+            ))
+        }
+    };
+    Ok(Duration::from_secs(number * seconds))
+}
+
+/// Read the YAML subset described above into JSON values
+fn parse_yaml(text: &str) -> Result<Value> {
+    let mut parser = Yaml {
+        lines: text.lines().collect(),
+        pos: 0,
+    };
+    parser.skip_blank();
+    if parser.done() {
+        return Ok(Value::Null);
+    }
+    let value = parser.block(parser.indent())?;
+    parser.skip_blank();
+    if !parser.done() {
+        return Err(parser.error("unexpected indentation"));
+    }
+    Ok(value)
+}
+
+struct Yaml<'a> {
+    lines: Vec<&'a str>,
+    pos: usize,
+}
+
+impl<'a> Yaml<'a> {
+    fn done(&self) -> bool {
+        self.pos >= self.lines.len()
+    }
+
+    fn error(&self, message: &str) -> anyhow::Error {
+        anyhow::anyhow!("line {}: {}", self.pos + 1, message)
+    }
+
+    /// Indentation of the current line
+    fn indent(&self) -> usize {
+        let line = self.lines[self.pos];
+        line.len() - line.trim_start_matches(' ').len()
+    }
+
+    /// The current line without indentation, comment and trailing blanks
+    fn content(&self) -> &'a str {
+        strip_comment(self.lines[self.pos].trim_start_matches(' ')).trim_end()
+    }
+
+    fn skip_blank(&mut self) {
+        while !self.done() && self.content().is_empty() {
+            self.pos += 1;
+        }
+    }
+
+    /// Whether the current line is at `indent` and continues a block there
+    fn at(&mut self, indent: usize) -> Result<bool> {
+        self.skip_blank();
+        if self.done() || self.indent() < indent {
+            return Ok(false);
+        }
+        if self.indent() > indent {
+            return Err(self.error("unexpected indentation"));
+        }
+        Ok(true)
+    }
+
+    fn block(&mut self, indent: usize) -> Result<Value> {
+        if self.lines[self.pos].contains('\t')
+            && self.lines[self.pos]
+                .trim_start_matches(' ')
+                .starts_with('\t')
+        {
+            return Err(self.error("tabs cannot be used for indentation"));
+        }
+        match item(self.content()) {
+            Some(_) => self.sequence(indent),
+            None => self.mapping(indent, None),
+        }
+    }
+
+    fn sequence(&mut self, indent: usize) -> Result<Value> {
+        let mut items = Vec::new();
+        while self.at(indent)? {
+            let content = self.content();
+            let rest = match item(content) {
+                Some(rest) => rest,
+                None => break,
+            };
+            if rest.is_empty() {
+                self.pos += 1;
+                self.skip_blank();
+                if self.done() || self.indent() <= indent {
+                    items.push(Value::Null);
+                } else {
+                    items.push(self.block(self.indent())?);
+                }
+            } else if split_key(rest).is_some() {
+                // "- key: value" starts a mapping indented like the key
+                let column = indent + (content.len() - rest.len());
+                items.push(self.mapping(column, Some(rest))?);
+            } else {
+                items.push(self.scalar(rest)?);
+                self.pos += 1;
+            }
+        }
+        Ok(Value::Array(items))
+    }
+
+    /// A mapping at `indent`, whose first entry may already have been read
+    /// from a sequence item's line
+    fn mapping(&mut self, indent: usize, mut first: Option<&'a str>) -> Result<Value> {
+        let mut map = Map::new();
+        loop {
+            let content = match first.take() {
+                Some(content) => content,
+                None if self.at(indent)? => self.content(),
+                None => break,
+            };
+            let (key, rest) =
+                split_key(content).ok_or_else(|| self.error("expected 'key: value'"))?;
+            let key = unquote(key);
+            if map.contains_key(&key) {
+                return Err(self.error(&format!("duplicate key '{}'", key)));
+            }
+            self.pos += 1;
+            let value = if rest.is_empty() {
+                self.skip_blank();
+                if self.done() {
+                    Value::Null
+                } else if self.indent() > indent {
+                    self.block(self.indent())?
+                } else if self.indent() == indent && item(self.content()).is_some() {
+                    // A sequence may sit at its key's indentation
+                    self.sequence(indent)?
+                } else {
+                    Value::Null
+                }
+            } else if let Some(style) = rest.strip_prefix(['|', '>']).map(|_| rest) {
+                self.block_scalar(indent, style)
+            } else {
+                self.pos -= 1;
+                let value = self.scalar(rest)?;
+                self.pos += 1;
+                value
+            };
+            map.insert(key, value);
+        }
+        Ok(Value::Object(map))
+    }
+
+    /// The lines of a `|` (literal) or `>` (folded) block below a key at
+    /// `indent`, with `-` to strip the final newline
+    fn block_scalar(&mut self, indent: usize, style: &str) -> Value {
+        let start = self.pos;
+        let mut end = start;
+        let mut block_indent = None;
+        while end < self.lines.len() {
+            let line = self.lines[end];
+            let line_indent = line.len() - line.trim_start_matches(' ').len();
+            if line.trim().is_empty() {
+                end += 1;
+                continue;
+            }
+            if line_indent <= indent {
+                break;
+            }
+            block_indent.get_or_insert(line_indent);
+            end += 1;
+        }
+        // Trailing blank lines belong to what follows
+        while end > start && self.lines[end - 1].trim().is_empty() {
+            end -= 1;
+        }
+        self.pos = end;
+        let block_indent = block_indent.unwrap_or(indent + 1);
+        let lines: Vec<&str> = self.lines[start..end]
+            .iter()
+            .map(|line| {
+                line.get(block_indent..)
+                    .unwrap_or("")
+                    .trim_end_matches('\r')
+            })
+            .collect();
+        let mut text = if style.starts_with('>') {
+            let mut folded = String::new();
+            for line in &lines {
+                if line.is_empty() {
+                    folded.push('\n');
+                } else {
+                    if !folded.is_empty() && !folded.ends_with('\n') {
+                        folded.push(' ');
+                    }
+                    folded.push_str(line);
+                }
+            }
+            folded
+        } else {
+            lines.join("\n")
+        };
+        if !style.ends_with('-') && !text.is_empty() {
+            text.push('\n');
+        }
+        Value::String(text)
+    }
+
+    fn scalar(&self, text: &str) -> Result<Value> {
+        if let Some(list) = text.strip_prefix('[') {
+            let list = list
+                .strip_suffix(']')
+                .ok_or_else(|| self.error("unterminated list"))?;
+            return Ok(Value::Array(
+                split_list(list)
+                    .into_iter()
+                    .filter(|item| !item.is_empty())
+                    .map(|item| Value::String(unquote(item)))
+                    .collect(),
+            ));
+        }
+        if text.starts_with('{') {
+            return Err(self.error("{...} mappings are not supported; use one key per line"));
+        }
+        if text.starts_with(['&', '*', '!']) {
+            return Err(self.error("anchors, aliases and tags are not supported"));
+        }
+        Ok(Value::String(unquote(text)))
+    }
+}
+
+/// What follows the dash of a sequence item
+fn item(content: &str) -> Option<&str> {
+    if content == "-" {
+        Some("")
+    } else {
+        content.strip_prefix("- ").map(str::trim_start)
+    }
+}
+
+/// Split `key: value` at the first colon outside quotes that ends the line or
+/// is followed by a space
+fn split_key(content: &str) -> Option<(&str, &str)> {
+    let mut quote = None;
+    for (i, c) in content.char_indices() {
+        match (quote, c) {
+            (None, '"' | '\'') if i == 0 => quote = Some(c),
+            (Some(q), c) if c == q => quote = None,
+            (None, ':') => {
+                let rest = &content[i + 1..];
+                if rest.is_empty() || rest.starts_with(' ') {
+                    return Some((content[..i].trim_end(), rest.trim_start()));
+                }
+            }
+            _ => {}
+        }
+    }
+    None
+}
+
+/// Cut a `#` comment that starts the line or follows a blank, outside quotes
+fn strip_comment(line: &str) -> &str {
+    let mut quote = None;
+    let mut previous = ' ';
+    for (i, c) in line.char_indices() {
+        match (quote, c) {
+            (None, '#') if previous == ' ' || previous == '\t' => return &line[..i],
+            (None, '"' | '\'') => quote = Some(c),
+            (Some(q), c) if c == q => quote = None,
+            _ => {}
+        }
+        previous = c;
+    }
+    line
+}
+
+/// Split the inside of `[a, "b, c"]` at commas outside quotes
+fn split_list(list: &str) -> Vec<&str> {
+    let mut items = Vec::new();
+    let mut quote = None;
+    let mut start = 0;
+    for (i, c) in list.char_indices() {
+        match (quote, c) {
+            (None, ',') => {
+                items.push(list[start..i].trim());
+                start = i + 1;
+            }
+            (None, '"' | '\'') => quote = Some(c),
+            (Some(q), c) if c == q => quote = None,
+            _ => {}
+        }
+    }
+    items.push(list[start..].trim());
+    items
+}
+
+/// A scalar without its quotes; double quotes allow `\"`, `\\`, `\n` and `\t`
+fn unquote(text: &str) -> String {
+    let text = text.trim();
+    if let Some(inner) = text.strip_prefix('\'').and_then(|t| t.strip_suffix('\'')) {
+        return inner.replace("''", "'");
+    }
+    if let Some(inner) = text.strip_prefix('"').and_then(|t| t.strip_suffix('"')) {
+        let mut out = String::with_capacity(inner.len());
+        let mut chars = inner.chars();
+        while let Some(c) = chars.next() {
+            if c != '\\' {
+                out.push(c);
+                continue;
+            }
+            match chars.next() {
+                Some('n') => out.push('\n'),
+                Some('t') => out.push('\t'),
+                Some(other) => out.push(other),
+                None => out.push('\\'),
+            }
+        }
+        return out;
+    }
+    text.to_string()
+}
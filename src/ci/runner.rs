@@ -0,0 +1,360 @@
+//! Runs queued builds: checks the commit out into a workspace and runs each
+//! step of its pipeline there, in a container. Pipelines without an image
+//! run on the host only in repositories an admin allowed that for, with
+//! `agito.ciHost = true` in their git config.
+
+use super::pipeline::{self, Pipeline, Step};
+use super::{Build, State, StepRun};
+use crate::notifications::{self, Reason};
+use crate::{git, jobs};
+use anyhow::{Context, Result};
+use std::fs::{self, File};
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::process::{Child, Command, Stdio};
+use std::time::{Duration, Instant};
+
+#[derive(Clone, Debug)]
+pub struct Runner {
+    pub repos_dir: PathBuf,
+    /// Server data, for notifying pushers of failed builds
+    pub data_dir: PathBuf,
+    /// Where builds check out their commit, one directory per build
+    pub workspace_dir: PathBuf,
+    /// docker, podman or another compatible CLI that runs the steps of
+    /// pipelines naming an `image`; such pipelines fail without one
+    pub container_runtime: Option<String>,
+    /// Longest a build may take; pipelines may only ask for less
+    pub timeout: Duration,
+}
+
+impl Runner {
+    /// Run queued builds until none is left. Returns how many ran.
+    pub fn run_queued(&self) -> Result<usize> {
+        let mut ran = 0;
+        loop {
+            let mut claimed = None;
+            for (name, repo_path) in git::find_repositories(&self.repos_dir)? {
+                if let Some(build) = super::claim(&repo_path)? {
+                    claimed = Some((name, repo_path, build));
+                    break;
+                }
+            }
+            let Some((name, repo_path, build)) = claimed else {
+                return Ok(ran);
+            };
+            let id = build.id;
+            let result = self.run(&name, &repo_path, build);
+            super::release(&repo_path, id);
+            result.with_context(|| format!("Build {} of {}", id, name))?;
+            ran += 1;
+        }
+    }
+
+    /// Fail the builds a previous server process left running
+    pub fn recover(&self) -> Result<()> {
+        for (name, repo_path) in git::find_repositories(&self.repos_dir)? {
+            for id in super::running(&repo_path)? {
+                tracing::warn!(repo = %name, "Build {} was interrupted", id);
+                super::update(&repo_path, id, |build| {
+                    build.state = State::Failure;
+                    build.error = Some("Interrupted by a server restart".to_string());
+                    build.finished = Some(chrono::Utc::now().timestamp());
+                    Ok(())
+                })?;
+                super::release(&repo_path, id);
+            }
+        }
+        Ok(())
+    }
+
+    fn run(&self, name: &str, repo_path: &Path, mut build: Build) -> Result<()> {
+        let log_path = super::log_path(repo_path, build.id);
+        if let Some(dir) = log_path.parent() {
+            fs::create_dir_all(dir)?;
+        }
+        let mut log = File::create(&log_path)
+            .with_context(|| format!("Failed to create {}", log_path.display()))?;
+        build.started = Some(chrono::Utc::now().timestamp());
+        build = super::update(repo_path, build.id, |saved| {
+            saved.started = build.started;
+            Ok(())
+        })?;
+        tracing::info!(repo = %name, branch = build.branch(), "Running build {}", build.id);
+
+        let workspace = self
+            .workspace_dir
+            .join(format!("{}-{}", name.replace('/', "_"), build.id));
+        let result = self.execute(name, repo_path, &workspace, &mut build, &mut log);
+        let _ = fs::remove_dir_all(&workspace);
+        if let Err(e) = result {
+            let _ = writeln!(log, "{:#}", e);
+            build.error = Some(format!("{:#}", e));
+        }
+
+        // Steps after a failing one stay pending: they never ran
+        build.state = if build.error.is_none()
+            && build.steps.iter().all(|step| step.state == State::Success)
+        {
+            State::Success
+        } else {
+            State::Failure
+        };
+        build.finished = Some(chrono::Utc::now().timestamp());
+        let build = super::update(repo_path, build.id, |saved| {
+            *saved = build;
+            Ok(())
+        })?;
+        tracing::info!(
+            repo = %name,
+            state = build.state.name(),
+            "Build {} finished",
+            build.id
+        );
+        super::finished(repo_path, &build);
+        if build.state == State::Failure {
+            self.notify(name, &build);
+        }
+        Ok(())
+    }
+
+    /// Check the commit out and run the pipeline's steps until one fails,
+    /// saving the build after each
+    fn execute(
+        &self,
+        name: &str,
+        repo_path: &Path,
+        workspace: &Path,
+        build: &mut Build,
+        log: &mut File,
+    ) -> Result<()> {
+        let pipeline = pipeline::load(repo_path, build.branch(), &build.before, &build.commit)?
+            .context("The commit no longer has a pipeline")?;
+        match (&pipeline.image, &self.container_runtime) {
+            (Some(_), None) => {
+                anyhow::bail!("The pipeline needs a container runtime, and the server has none")
+            }
+            (None, _) if !host_allowed(repo_path) => anyhow::bail!(
+                "The pipeline names no image, and this repository may not run builds on the server itself"
+            ),
+            _ => {}
+        }
+        // Steps as the pipeline has them now, in case it changed since queueing
+        build.steps = pipeline
+            .steps
+            .iter()
+            .map(|step| StepRun {
+                name: step.name.clone(),
+                state: State::Pending,
+                exit_code: None,
+                duration: 0,
+            })
+            .collect();
+
+        let _ = fs::remove_dir_all(workspace);
+        fs::create_dir_all(&self.workspace_dir)?;
+        checkout(repo_path, workspace, &build.commit)?;
+
+        let mut env = vec![
+            ("CI".to_string(), "true".to_string()),
+            ("AGITO_CI".to_string(), "true".to_string()),
+            ("AGITO_REPO".to_string(), name.to_string()),
+            ("AGITO_BRANCH".to_string(), build.branch().to_string()),
+            ("AGITO_COMMIT".to_string(), build.commit.clone()),
+            ("AGITO_BEFORE".to_string(), build.before.clone()),
+            ("AGITO_BUILD".to_string(), build.id.to_string()),
+            (
+                "AGITO_PUSHER".to_string(),
+                build.pusher.clone().unwrap_or_default(),
+            ),
+        ];
+        env.extend(pipeline.env.clone());
+
+        let timeout = pipeline
+            .timeout
+            .map_or(self.timeout, |timeout| timeout.min(self.timeout));
+        let deadline = Instant::now() + timeout;
+        for (index, step) in pipeline.steps.iter().enumerate() {
+            writeln!(log, "--- {}", step.name)?;
+            let start = Instant::now();
+            let container = format!("agito-ci-{}-{}", name.replace('/', "_"), build.id);
+            let exit_code =
+                self.step(&pipeline, step, workspace, &env, &container, deadline, log)?;
+            let run = &mut build.steps[index];
+            run.duration = start.elapsed().as_secs();
+            run.exit_code = exit_code;
+            run.state = if exit_code == Some(0) {
+                State::Success
+            } else {
+                State::Failure
+            };
+            let failed = run.state == State::Failure;
+            match exit_code {
+                None => writeln!(log, "--- timed out after {}s", timeout.as_secs())?,
+                Some(code) => writeln!(log, "--- exited with {} after {}s", code, run.duration)?,
+            }
+            let steps = build.steps.clone();
+            super::update(repo_path, build.id, |saved| {
+                saved.steps = steps;
+                Ok(())
+            })?;
+            if exit_code.is_none() {
+                anyhow::bail!("Timed out after {}s", timeout.as_secs());
+            }
+            if failed {
+                break;
+            }
+        }
+        Ok(())
+    }
+
+    /// Run one step; its exit code, or None if it ran past the deadline
+    #[allow(clippy::too_many_arguments)]
+    fn step(
+        &self,
+        pipeline: &Pipeline,
+        step: &Step,
+        workspace: &Path,
+        env: &[(String, String)],
+        container: &str,
+        deadline: Instant,
+        log: &File,
+    ) -> Result<Option<i32>> {
+        let mut command = match &pipeline.image {
+            Some(image) => {
+                let runtime = self
+                    .container_runtime
+                    .as_ref()
+                    .context("The pipeline needs a container runtime, and the server has none")?;
+                let mut command = Command::new(runtime);
+                command
+                    .args(["run", "--rm", "--name", container, "-v"])
+                    .arg(format!("{}:/workspace", workspace.display()))
+                    .args(["-w", "/workspace"]);
+                // Values come from the runtime's own environment, so they
+                // don't show up in its arguments
+                for (key, value) in env {
+                    command.arg("-e").arg(key).env(key, value);
+                }
+                command.args([image.as_str(), "sh", "-e", "-c", &step.run]);
+                command
+            }
+            None => {
+                let mut command = Command::new("sh");
+                command
+                    .args(["-e", "-c", &step.run])
+                    .current_dir(workspace)
+                    .env_clear()
+                    .env("PATH", std::env::var_os("PATH").unwrap_or_default())
+                    .env("HOME", workspace)
+                    .envs(env.iter().map(|(key, value)| (key, value)));
+                command
+            }
+        };
+        // A group of its own, so a timeout can stop everything the step started
+        std::os::unix::process::CommandExt::process_group(&mut command, 0);
+        let mut child = command
+            .stdin(Stdio::null())
+            .stdout(log.try_clone()?)
+            .stderr(log.try_clone()?)
+            .spawn()
+            .with_context(|| format!("Failed to run step {}", step.name))?;
+
+        loop {
+            if let Some(status) = child.try_wait()? {
+                // Killed by a signal counts as failing
+                return Ok(Some(status.code().unwrap_or(-1)));
+            }
+            if Instant::now() >= deadline {
+                kill(&mut child);
+                if let (Some(_), Some(runtime)) = (&pipeline.image, &self.container_runtime) {
+                    let _ = Command::new(runtime)
+                        .args(["rm", "--force", container])
+                        .stdout(Stdio::null())
+                        .stderr(Stdio::null())
+                        .status();
+                }
+                return Ok(None);
+            }
+            std::thread::sleep(Duration::from_millis(200));
+        }
+    }
+
+    fn notify(&self, name: &str, build: &Build) {
+        let Some(pusher) = &build.pusher else {
+            return;
+        };
+        let title = format!(
+            "Build #{} of {} failed on {}",
+            build.id,
+            &build.commit[..build.commit.len().min(8)],
+            build.branch()
+        );
+        let url = format!("/repo/{}/builds/{}", name, build.id);
+        if let Err(e) = notifications::push(
+            &self.data_dir,
+            pusher,
+            Reason::CiFailure,
+            name,
+            &title,
+            Some(url),
+        ) {
+            tracing::warn!("Failed to notify {} of a failed build: {:#}", pusher, e);
+        }
+    }
+}
+
+/// Whether an admin allowed the repository's pipelines to run on the server
+/// itself, as the server's user, with `agito.ciHost = true` in its git config
+fn host_allowed(repo_path: &Path) -> bool {
+    git::config_get(repo_path, "agito.ciHost").as_deref() == Some("true")
+}
+
+/// Check `commit` out into a fresh clone sharing the repository's objects
+fn checkout(repo_path: &Path, workspace: &Path, commit: &str) -> Result<()> {
+    let output = Command::new("git")
+        .args(["clone", "--quiet", "--shared", "--no-checkout"])
+        .arg(repo_path)
+        .arg(workspace)
+        .output()?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "git clone failed: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    let output = git::run(workspace, &["checkout", "--quiet", "--detach", commit])?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "git checkout failed: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(())
+}
+
+/// Stop a step's process group
+fn kill(child: &mut Child) {
+    let _ = Command::new("kill")
+        .args(["-KILL", &format!("-{}", child.id())])
+        .status();
+    let _ = child.kill();
+    let _ = child.wait();
+}
+
+/// Run up to `runners` builds at once, checking the queues every `interval`
+pub fn spawn(runner: Runner, runners: usize, interval: Duration) {
+    if let Err(e) = runner.recover() {
+        tracing::warn!("Failed to recover interrupted builds: {:#}", e);
+    }
+    for _ in 0..runners {
+        let runner = runner.clone();
+        jobs::spawn_periodic("ci", interval, move || {
+            let ran = runner.run_queued()?;
+            if ran > 0 {
+                tracing::debug!("Ran {} builds", ran);
+            }
+            Ok(())
+        });
+    }
+}
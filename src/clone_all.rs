@@ -0,0 +1,115 @@
+//! `agito clone --all`: clone every repository the user may read into a
+//! directory, or fetch those already cloned there, to set up a workstation
+//! or keep an offline backup.
+
+use crate::glob::glob_match;
+use anyhow::{Context, Result};
+use std::path::{Path, PathBuf};
+use std::process::Command;
+use std::sync::atomic::{AtomicUsize, Ordering};
+
+pub struct Options {
+    /// Directory to clone into; repositories keep their namespace as a
+    /// subdirectory
+    pub dir: PathBuf,
+    /// Only repositories matching one of these patterns, if any are given
+    pub include: Vec<String>,
+    /// Leave out repositories matching any of these patterns
+    pub exclude: Vec<String>,
+    /// Bare mirrors of every ref instead of working copies
+    pub mirror: bool,
+    /// How many repositories to clone or fetch at once
+    pub jobs: usize,
+}
+
+/// What happened to one repository
+pub enum Outcome {
+    Cloned,
+    Fetched,
+}
+
+impl Options {
+    /// The repositories of `names` the filters let through. Patterns match
+    /// the full name, with or without `.git`.
+    pub fn select(&self, names: Vec<String>) -> Vec<String> {
+        let matches = |pattern: &String, name: &str| {
+            glob_match(pattern, name) || glob_match(pattern, name.trim_end_matches(".git"))
+        };
+        names
+            .into_iter()
+            .filter(|name| {
+                self.include.is_empty() || self.include.iter().any(|pattern| matches(pattern, name))
+            })
+            .filter(|name| !self.exclude.iter().any(|pattern| matches(pattern, name)))
+            .collect()
+    }
+
+    /// Where a repository goes: `<dir>/<namespace>/<name>`, keeping `.git`
+    /// for mirrors only, as git itself does
+    pub fn target(&self, name: &str) -> PathBuf {
+        if self.mirror {
+            self.dir.join(name)
+        } else {
+            self.dir.join(name.trim_end_matches(".git"))
+        }
+    }
+}
+
+/// Clone or fetch each of `names` from the server, `options.jobs` at a time,
+/// calling `done` as each finishes
+pub fn run(
+    server: &str,
+    user: &str,
+    names: &[String],
+    options: &Options,
+    done: &(dyn Fn(&str, &Result<Outcome>) + Sync),
+) {
+    let next = AtomicUsize::new(0);
+    std::thread::scope(|scope| {
+        for _ in 0..options.jobs.max(1).min(names.len()) {
+            scope.spawn(|| {
+                while let Some(name) = names.get(next.fetch_add(1, Ordering::Relaxed)) {
+                    let url = format!("ssh://{}@{}/{}", user, server, name);
+                    done(name, &update(&url, &options.target(name), options.mirror));
+                }
+            });
+        }
+    });
+}
+
+/// Clone `url` to `target`, or fetch into it if it is already there
+fn update(url: &str, target: &Path, mirror: bool) -> Result<Outcome> {
+    if target.exists() {
+        let is_clone = target.join(".git").exists() || crate::git::is_repository(target);
+        if !is_clone {
+            anyhow::bail!("{} exists and is not a repository", target.display());
+        }
+        git(Command::new("git")
+            .arg("-C")
+            .arg(target)
+            .args(["fetch", "--quiet", "--prune", "origin"]))?;
+        return Ok(Outcome::Fetched);
+    }
+
+    if let Some(parent) = target.parent() {
+        std::fs::create_dir_all(parent)
+            .with_context(|| format!("Failed to create {}", parent.display()))?;
+    }
+    let mut clone = Command::new("git");
+    clone.args(["clone", "--quiet"]);
+    if mirror {
+        clone.arg("--mirror");
+    }
+    git(clone.arg(url).arg(target))?;
+    Ok(Outcome::Cloned)
+}
+
+/// Run git, failing with the last line it wrote to stderr
+fn git(command: &mut Command) -> Result<()> {
+    let output = command.output().context("Failed to run git")?;
+    if !output.status.success() {
+        let stderr = String::from_utf8_lossy(&output.stderr);
+        anyhow::bail!("{}", stderr.lines().last().unwrap_or("git failed").trim());
+    }
+    Ok(())
+}
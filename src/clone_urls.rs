@@ -0,0 +1,95 @@
+//! The URLs users clone repositories from, built from how clients reach the
+//! server rather than how it listens: behind NAT or a load balancer the
+//! host name and ports differ from the server's own.
+//!
+//! The host comes from `--public-host`, or else the host of `--public-url`;
+//! the SSH port from `--public-ssh-port`, or else `--ssh-port`. SSH URLs
+//! leave out port 22, so they read as users expect them. HTTP URLs are under
+//! `--public-url`.
+
+use crate::git_daemon;
+use std::path::Path;
+
+/// The SSH user clone URLs name; the server accepts any, and tells users
+/// apart by their keys
+const SSH_USER: &str = "git";
+
+#[derive(Clone, Debug)]
+pub struct CloneUrls {
+    /// Host name clients reach the server at
+    pub host: String,
+    /// Port clients connect to for SSH, if it is served
+    pub ssh_port: Option<u16>,
+    /// Port of the `git://` daemon, if it runs
+    pub git_port: Option<u16>,
+    /// Where the web server is reached, for clones over HTTP
+    pub http_base: Option<String>,
+}
+
+impl Default for CloneUrls {
+    fn default() -> Self {
+        Self {
+            host: "localhost".to_string(),
+            ssh_port: Some(2222),
+            git_port: None,
+            http_base: None,
+        }
+    }
+}
+
+impl CloneUrls {
+    /// The host of a URL such as `https://git.example.com:8443/`, for servers
+    /// only configured with their web address
+    pub fn host_of(url: &str) -> Option<String> {
+        let rest = url.split_once("://").map_or(url, |(_, rest)| rest);
+        let authority = rest.split('/').next()?;
+        let authority = authority.rsplit_once('@').map_or(authority, |(_, a)| a);
+        let host = match authority.strip_prefix('[') {
+            // [2001:db8::1]:8443
+            Some(v6) => format!("[{}]", v6.split(']').next()?),
+            None => authority.split(':').next()?.to_string(),
+        };
+        Some(host).filter(|host| !host.is_empty())
+    }
+
+    /// `ssh://git@host[:port]/<repo>`, if SSH is served
+    pub fn ssh(&self, repo: &str) -> Option<String> {
+        let port = match self.ssh_port? {
+            22 => String::new(),
+            port => format!(":{}", port),
+        };
+        Some(format!("ssh://{}@{}{}/{}", SSH_USER, self.host, port, repo))
+    }
+
+    /// `<http-base>/<repo>`, if the web server's address is known
+    pub fn http(&self, repo: &str) -> Option<String> {
+        let base = self.http_base.as_deref()?;
+        Some(format!("{}/{}", base.trim_end_matches('/'), repo))
+    }
+
+    /// `git://host[:port]/<repo>`, if the daemon runs and serves the
+    /// repository; whether it is public is for the caller to know
+    pub fn git(&self, repo: &str, repo_path: &Path, public: bool) -> Option<String> {
+        let port = self.git_port?;
+        if !public || !git_daemon::is_exported(repo_path) {
+            return None;
+        }
+        let port = match port {
+            9418 => String::new(),
+            port => format!(":{}", port),
+        };
+        Some(format!("git://{}{}/{}", self.host, port, repo))
+    }
+
+    /// Every way to clone the repository, by protocol name
+    pub fn all(&self, repo: &str, repo_path: &Path, public: bool) -> Vec<(&'static str, String)> {
+        [
+            ("ssh", self.ssh(repo)),
+            ("http", self.http(repo)),
+            ("git", self.git(repo, repo_path, public)),
+        ]
+        .into_iter()
+        .filter_map(|(protocol, url)| Some((protocol, url?)))
+        .collect()
+    }
+}
@@ -0,0 +1,118 @@
+//! The server's configuration file, and reloading it while the server runs.
+//!
+//! The file holds the server's long options, one `name = value` per line,
+//! such as `http-port = 8080` or `admin = alice`; `#` starts a comment, and
+//! a switch is given as `trust-proxy = true`. Options on the command line
+//! override the file, and options that may be repeated add to it.
+//!
+//! On SIGHUP, or when an admin asks through the API, the server rereads the
+//! file and the command line and applies the settings kept in [`Shared`]
+//! values, without touching the listeners or the transfers in flight.
+//! Authorized keys, account keys, organisation roles and webhooks are read
+//! from disk whenever they are needed, so they never need a reload.
+
+use anyhow::{Context, Result};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, RwLock};
+use tokio::sync::Notify;
+
+/// The options in a configuration file, as command-line arguments
+pub fn read_args(path: &Path) -> Result<Vec<String>> {
+    let content =
+        fs::read_to_string(path).with_context(|| format!("Failed to read {}", path.display()))?;
+    let mut args = Vec::new();
+    for (number, line) in content.lines().enumerate() {
+        let line = line.trim();
+        if line.is_empty() || line.starts_with('#') {
+            continue;
+        }
+        let (name, value) = match line.split_once('=') {
+            Some((name, value)) => (name.trim(), value.trim()),
+            None => (line, ""),
+        };
+        let valid = !name.is_empty()
+            && !name.starts_with('-')
+            && name.chars().all(|c| c.is_ascii_alphanumeric() || c == '-');
+        if !valid || name == "config" {
+            anyhow::bail!(
+                "{}:{}: expected 'name = value', got '{}'",
+                path.display(),
+                number + 1,
+                line
+            );
+        }
+        let value = value
+            .strip_prefix('"')
+            .and_then(|value| value.strip_suffix('"'))
+            .unwrap_or(value);
+        match value {
+            "" | "true" => args.push(format!("--{}", name)),
+            "false" => {}
+            _ => args.push(format!("--{}={}", name, value)),
+        }
+    }
+    Ok(args)
+}
+
+/// The command line with the options of the configuration file named by
+/// `--config` put first, so the command line overrides them
+pub fn expand_args(args: Vec<String>) -> Result<Vec<String>> {
+    let mut path = None;
+    let mut iter = args.iter().skip(1);
+    while let Some(arg) = iter.next() {
+        if arg == "--" {
+            break;
+        }
+        if arg == "--config" {
+            path = iter.next().map(PathBuf::from);
+            break;
+        }
+        if let Some(value) = arg.strip_prefix("--config=") {
+            path = Some(PathBuf::from(value));
+            break;
+        }
+    }
+    let path = match path {
+        Some(path) => path,
+        None => return Ok(args),
+    };
+    let mut expanded: Vec<String> = args.iter().take(1).cloned().collect();
+    expanded.extend(read_args(&path)?);
+    expanded.extend(args.into_iter().skip(1));
+    Ok(expanded)
+}
+
+/// A setting that can change while the server runs. Clones share the value,
+/// so the reloading code and the servers can each hold one.
+#[derive(Clone, Debug, Default)]
+pub struct Shared<T>(Arc<RwLock<T>>);
+
+impl<T: Clone> Shared<T> {
+    pub fn new(value: T) -> Self {
+        Self(Arc::new(RwLock::new(value)))
+    }
+
+    pub fn get(&self) -> T {
+        self.0.read().unwrap().clone()
+    }
+
+    pub fn set(&self, value: T) {
+        *self.0.write().unwrap() = value;
+    }
+}
+
+/// Lets the web server ask for a reload, as SIGHUP does
+#[derive(Clone, Debug, Default)]
+pub struct ReloadTrigger(Arc<Notify>);
+
+impl ReloadTrigger {
+    pub fn request(&self) {
+        self.0.notify_one();
+    }
+
+    /// Wait until a reload is asked for
+    pub async fn requested(&self) {
+        self.0.notified().await;
+    }
+}
@@ -0,0 +1,69 @@
+//! Creating repositories for users, over SSH and the API alike.
+
+use crate::git;
+use crate::hooks::Templates;
+use crate::merge::Identity;
+use crate::namespaces::Limits;
+use crate::templates;
+use crate::visibility::{self, Visibility};
+use anyhow::{Context, Result};
+use std::path::{Path, PathBuf};
+
+/// A repository to create
+pub struct Request<'a> {
+    /// Name relative to the repositories directory, as [`Limits::place`]
+    /// gives it
+    pub name: &'a str,
+    pub visibility: Visibility,
+    /// Template repository whose files it starts with
+    pub template: Option<&'a Path>,
+    /// Also copy the template's own hooks
+    pub with_hooks: bool,
+    /// Who creates it; the creator of a top-level repository becomes its
+    /// admin
+    pub user: Option<&'a str>,
+}
+
+/// Create a repository with agito's hooks, returning its path. A repository
+/// that can't be set up from its template is removed again.
+pub fn create(limits: &Limits, hooks: &Templates, request: &Request) -> Result<PathBuf> {
+    let repo_path = limits.repos_dir.join(request.name);
+    if repo_path.exists() {
+        anyhow::bail!("Repository already exists: {}", request.name);
+    }
+    git::init_bare_repo(&repo_path, hooks).context("Failed to create repository")?;
+
+    if let Some(template_path) = request.template {
+        let vars = templates::Vars::new(request.name, request.user);
+        let identity = Identity::for_user(request.user.unwrap_or("agito"));
+        if let Err(e) = templates::instantiate(
+            template_path,
+            &repo_path,
+            &vars,
+            &identity,
+            request.with_hooks,
+        ) {
+            let _ = std::fs::remove_dir_all(&repo_path);
+            return Err(e.context("Failed to create repository from its template"));
+        }
+    }
+
+    let visibility = request.visibility;
+    if let Err(e) = visibility::set(&repo_path, visibility) {
+        tracing::warn!(
+            "Failed to make {} {}: {}",
+            request.name,
+            visibility.name(),
+            e
+        );
+    }
+    if let Some(user) = request.user {
+        if let Err(e) =
+            crate::orgs::created(&limits.data_dir, &limits.repos_dir, request.name, user)
+        {
+            tracing::warn!("Failed to grant {} to its creator: {}", request.name, e);
+        }
+    }
+    tracing::info!("Created repository: {:?}", repo_path);
+    Ok(repo_path)
+}
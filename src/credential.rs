@@ -0,0 +1,93 @@
+//! `agito credential`: a git credential helper that hands git the access
+//! token of the profile whose web server it is talking to, so clones and
+//! pushes over HTTP neither need the token in the remote's URL nor ask for
+//! it.
+//!
+//! git runs the helper with `get`, `store` or `erase` and describes the
+//! credential it wants on stdin as `key=value` lines (see
+//! gitcredentials(7)). A request for `https://git.example.com:8443` is
+//! answered with the token of the profile whose `url` has that scheme, host
+//! and port: the current profile's, with the environment's settings, or else
+//! the first other profile in the config file with one. Tokens are kept in
+//! the profiles, so `store` and `erase` leave them alone.
+
+use crate::profile::Profile;
+use anyhow::{Context, Result};
+use std::collections::HashMap;
+use std::process::Command;
+
+/// The helper as git's `credential.helper` names it
+pub const HELPER: &str = "!agito credential";
+
+/// The `key=value` lines of a request, up to the first empty line
+pub fn parse(input: &str) -> HashMap<String, String> {
+    input
+        .lines()
+        .take_while(|line| !line.is_empty())
+        .filter_map(|line| {
+            let (key, value) = line.split_once('=')?;
+            Some((key.to_string(), value.to_string()))
+        })
+        .collect()
+}
+
+/// The scheme and `host[:port]` of a URL such as `https://git.example.com/`
+fn origin(url: &str) -> Option<(&str, &str)> {
+    let (scheme, rest) = url.split_once("://")?;
+    let authority = rest.split('/').next()?;
+    let authority = authority.rsplit_once('@').map_or(authority, |(_, a)| a);
+    Some((scheme, authority))
+}
+
+/// The reply to `get`: the user name and token of the profile for the
+/// server the request names, or nothing, which leaves git to ask elsewhere
+pub fn get(request: &HashMap<String, String>) -> Option<String> {
+    let protocol = request.get("protocol")?;
+    let host = request.get("host")?;
+    let matches = |profile: &Profile| {
+        profile
+            .url
+            .as_deref()
+            .and_then(origin)
+            .is_some_and(|(scheme, authority)| {
+                scheme.eq_ignore_ascii_case(protocol) && authority.eq_ignore_ascii_case(host)
+            })
+            && profile.token.is_some()
+    };
+    let profile = Profile::load()
+        .ok()
+        .filter(matches)
+        .or_else(|| Profile::all().ok()?.into_iter().find(matches))?;
+
+    // The server takes the token with any user name
+    let username = request.get("username").unwrap_or(&profile.user);
+    Some(format!(
+        "username={}\npassword={}\n",
+        username,
+        profile.token?.trim()
+    ))
+}
+
+/// Make git ask the helper first for the credentials of the web server at
+/// `url`, in the user's global git config
+pub fn setup(url: &str) -> Result<()> {
+    let key = format!("credential.{}.helper", url.trim_end_matches('/'));
+    // An empty helper clears those configured for every server, such as a
+    // keychain that may hold an old password
+    for args in [
+        vec!["config", "--global", "--replace-all", &key, ""],
+        vec!["config", "--global", "--add", &key, HELPER],
+    ] {
+        let output = Command::new("git")
+            .args(&args)
+            .output()
+            .context("Failed to run git")?;
+        if !output.status.success() {
+            anyhow::bail!(
+                "git config failed: {}",
+                String::from_utf8_lossy(&output.stderr).trim()
+            );
+        }
+    }
+    Ok(())
+}
@@ -0,0 +1,145 @@
+//! Deploy keys: SSH keys that may fetch one repository and do nothing else,
+//! for CI jobs and servers pulling releases instead of a person's key.
+//!
+//! Each repository keeps its keys in `agito/deploy-keys.json`. A key can be
+//! registered on only one repository and on no account, so a key that
+//! authenticates always names a single repository.
+
+use crate::{git, users};
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+
+/// A key that may fetch from the repository it is registered on
+#[derive(Clone, Debug, Serialize, Deserialize)]
+pub struct DeployKey {
+    pub id: u64,
+    pub title: String,
+    /// `<type> <base64> [comment]`, as [`users::normalize_key`] leaves it
+    pub key: String,
+    /// `SHA256:<base64>`, as `ssh-keygen -l` prints it
+    pub fingerprint: String,
+    /// Who registered the key, if they were signed in
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub added_by: Option<String>,
+    /// Unix time the key was registered
+    pub created: i64,
+}
+
+fn keys_path(repo_path: &Path) -> PathBuf {
+    git::data_dir(repo_path).join("deploy-keys.json")
+}
+
+/// The base64 field of a key line, which identifies the key
+fn key_data(line: &str) -> &str {
+    line.split_whitespace().nth(1).unwrap_or("")
+}
+
+/// Deploy keys registered on a repository
+pub fn list(repo_path: &Path) -> Result<Vec<DeployKey>> {
+    let path = keys_path(repo_path);
+    match fs::read_to_string(&path) {
+        Ok(content) => serde_json::from_str(&content)
+            .with_context(|| format!("Failed to parse {}", path.display())),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(Vec::new()),
+        Err(e) => Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    }
+}
+
+fn save(repo_path: &Path, keys: &[DeployKey]) -> Result<()> {
+    let path = keys_path(repo_path);
+    fs::create_dir_all(git::data_dir(repo_path))?;
+    let tmp = path.with_extension("json.tmp");
+    fs::write(&tmp, serde_json::to_string_pretty(keys)?)?;
+    fs::rename(&tmp, &path)?;
+    Ok(())
+}
+
+/// Every deploy key on the server, as (repository name, key). Repositories
+/// whose keys can't be read are skipped with a warning.
+pub fn all(repos_dir: &Path) -> Vec<(String, DeployKey)> {
+    let repos = match git::find_repositories(repos_dir) {
+        Ok(repos) => repos,
+        Err(e) => {
+            tracing::warn!("Failed to list repositories: {}", e);
+            return Vec::new();
+        }
+    };
+    let mut found = Vec::new();
+    for (name, path) in repos {
+        if !keys_path(&path).exists() {
+            continue;
+        }
+        match list(&path) {
+            Ok(keys) => found.extend(keys.into_iter().map(|key| (name.clone(), key))),
+            Err(e) => tracing::warn!("Skipping deploy keys of {}: {:#}", name, e),
+        }
+    }
+    found
+}
+
+/// The repository a key line is a deploy key of, if any
+pub fn find(repos_dir: &Path, line: &str) -> Option<String> {
+    let data = key_data(line);
+    all(repos_dir)
+        .into_iter()
+        .find(|(_, key)| key_data(&key.key) == data)
+        .map(|(repo, _)| repo)
+}
+
+/// Register a key on a repository. The title defaults to the key's comment.
+/// Keys already on an account or on any repository are refused.
+pub fn add(
+    repos_dir: &Path,
+    data_dir: &Path,
+    repo_path: &Path,
+    title: &str,
+    key: &str,
+    added_by: Option<&str>,
+) -> Result<DeployKey> {
+    let key = users::normalize_key(key)?;
+    let data = key_data(&key);
+    if let Some(repo) = find(repos_dir, &key) {
+        anyhow::bail!("This key is already a deploy key of {}", repo);
+    }
+    if users::load(data_dir)?
+        .values()
+        .any(|user| user.keys.iter().any(|k| key_data(k) == data))
+    {
+        anyhow::bail!("This key belongs to an account; generate a separate key for deploying");
+    }
+    let fingerprint = russh_keys::parse_public_key_base64(data)
+        .map(|parsed| format!("SHA256:{}", parsed.fingerprint()))
+        .map_err(|_| anyhow::anyhow!("Not an SSH public key"))?;
+
+    let title = match title.trim() {
+        "" => key.split_whitespace().nth(2).unwrap_or("deploy key"),
+        title => title,
+    };
+    let mut keys = list(repo_path)?;
+    let deploy_key = DeployKey {
+        id: keys.iter().map(|k| k.id).max().unwrap_or(0) + 1,
+        title: title.to_string(),
+        fingerprint,
+        key,
+        added_by: added_by.map(str::to_string),
+        created: chrono::Utc::now().timestamp(),
+    };
+    keys.push(deploy_key.clone());
+    save(repo_path, &keys)?;
+    Ok(deploy_key)
+}
+
+/// Remove a deploy key, returning it
+pub fn remove(repo_path: &Path, id: u64) -> Result<DeployKey> {
+    let mut keys = list(repo_path)?;
+    let index = keys
+        .iter()
+        .position(|key| key.id == id)
+        .with_context(|| format!("No such deploy key: {}", id))?;
+    let removed = keys.remove(index);
+    save(repo_path, &keys)?;
+    Ok(removed)
+}
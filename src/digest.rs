@@ -0,0 +1,230 @@
+use crate::git;
+use crate::mail::Mailer;
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+
+/// How often a digest is sent
+#[derive(Clone, Copy, Debug, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Frequency {
+    Daily,
+    Weekly,
+}
+
+impl FromStr for Frequency {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "daily" => Ok(Self::Daily),
+            "weekly" => Ok(Self::Weekly),
+            _ => Err(format!(
+                "unknown digest frequency '{}' (expected daily or weekly)",
+                s
+            )),
+        }
+    }
+}
+
+impl Frequency {
+    fn period_secs(self) -> i64 {
+        match self {
+            Self::Daily => 24 * 3600,
+            Self::Weekly => 7 * 24 * 3600,
+        }
+    }
+
+    fn name(self) -> &'static str {
+        match self {
+            Self::Daily => "daily",
+            Self::Weekly => "weekly",
+        }
+    }
+}
+
+/// A recipient's digest settings
+#[derive(Clone, Debug, Serialize, Deserialize)]
+pub struct Subscription {
+    pub email: String,
+    pub frequency: Frequency,
+    /// Watched repositories
+    pub repos: Vec<String>,
+    /// Unix time the last digest covered up to
+    #[serde(default)]
+    pub last_sent: Option<i64>,
+}
+
+/// Commits pushed to one repository during the digest period
+pub struct RepoActivity {
+    pub repo: String,
+    /// Short hash, author and subject, newest first
+    pub commits: Vec<(String, String, String)>,
+    /// Number of commits in the period, which may exceed those listed
+    pub total: usize,
+}
+
+/// Commits listed per repository; the rest are only counted
+const MAX_COMMITS: usize = 20;
+
+fn subscriptions_path(data_dir: &Path) -> PathBuf {
+    data_dir.join("digests.json")
+}
+
+/// Load all digest subscriptions from the data directory
+pub fn load(data_dir: &Path) -> Result<Vec<Subscription>> {
+    let path = subscriptions_path(data_dir);
+    match fs::read_to_string(&path) {
+        Ok(content) => serde_json::from_str(&content)
+            .with_context(|| format!("Failed to parse {}", path.display())),
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => Ok(Vec::new()),
+        Err(e) => Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    }
+}
+
+/// Replace the stored digest subscriptions
+pub fn save(data_dir: &Path, subscriptions: &[Subscription]) -> Result<()> {
+    fs::create_dir_all(data_dir)?;
+    let path = subscriptions_path(data_dir);
+    let tmp = path.with_extension("json.tmp");
+    fs::write(&tmp, serde_json::to_string_pretty(subscriptions)?)?;
+    fs::rename(&tmp, &path)?;
+    Ok(())
+}
+
+/// Add or replace the subscription for an email address
+pub fn subscribe(data_dir: &Path, subscription: Subscription) -> Result<()> {
+    let mut subscriptions = load(data_dir)?;
+    subscriptions.retain(|s| s.email != subscription.email);
+    subscriptions.push(subscription);
+    save(data_dir, &subscriptions)
+}
+
+/// Remove the subscription for an email address; returns whether one existed
+pub fn unsubscribe(data_dir: &Path, email: &str) -> Result<bool> {
+    let mut subscriptions = load(data_dir)?;
+    let before = subscriptions.len();
+    subscriptions.retain(|s| s.email != email);
+    save(data_dir, &subscriptions)?;
+    Ok(subscriptions.len() != before)
+}
+
+/// Commits on any branch of the given repositories since a unix time
+pub fn collect(repos_dir: &Path, repos: &[String], since: i64) -> Vec<RepoActivity> {
+    let mut activity = Vec::new();
+    let since = format!("--since=@{}", since);
+
+    for repo in repos {
+        let repo_path = repos_dir.join(repo);
+        if !repo_path.join("HEAD").exists() {
+            tracing::warn!("Digest references unknown repository {}", repo);
+            continue;
+        }
+
+        let output = match git::run(
+            &repo_path,
+            &["log", "--branches", &since, "--format=%h%x1f%an%x1f%s"],
+        ) {
+            Ok(output) if output.status.success() => output,
+            _ => continue,
+        };
+
+        let lines: Vec<(String, String, String)> = String::from_utf8_lossy(&output.stdout)
+            .lines()
+            .filter_map(|line| {
+                let mut fields = line.splitn(3, '\x1f');
+                Some((
+                    fields.next()?.to_string(),
+                    fields.next()?.to_string(),
+                    fields.next()?.to_string(),
+                ))
+            })
+            .collect();
+
+        if !lines.is_empty() {
+            activity.push(RepoActivity {
+                repo: repo.clone(),
+                total: lines.len(),
+                commits: lines.into_iter().take(MAX_COMMITS).collect(),
+            });
+        }
+    }
+
+    activity
+}
+
+/// Subject and plain-text body of a digest
+pub fn render(subscription: &Subscription, activity: &[RepoActivity]) -> (String, String) {
+    let total: usize = activity.iter().map(|a| a.total).sum();
+    let subject = format!(
+        "[agito] Your {} digest: {} new commit{} in {} repositor{}",
+        subscription.frequency.name(),
+        total,
+        if total == 1 { "" } else { "s" },
+        activity.len(),
+        if activity.len() == 1 { "y" } else { "ies" }
+    );
+
+    let mut body = String::new();
+    for repo in activity {
+        body.push_str(&format!("{} ({} commits)\n", repo.repo, repo.total));
+        for (hash, author, message) in &repo.commits {
+            body.push_str(&format!("  {} {} ({})\n", hash, message, author));
+        }
+        if repo.total > repo.commits.len() {
+            body.push_str(&format!(
+                "  ... and {} more\n",
+                repo.total - repo.commits.len()
+            ));
+        }
+        body.push('\n');
+    }
+    body.push_str(&format!(
+        "You receive this {} digest because you watch these repositories on agito.\n",
+        subscription.frequency.name()
+    ));
+
+    (subject, body)
+}
+
+/// Send every digest whose period has elapsed. Digests without activity are
+/// skipped but still count as sent. Returns the number of emails sent.
+pub fn send_due(repos_dir: &Path, data_dir: &Path, mailer: &Mailer, now: i64) -> Result<usize> {
+    let subscriptions = load(data_dir)?;
+    let mut sent = 0;
+    let mut done = Vec::new();
+
+    for subscription in &subscriptions {
+        let period = subscription.frequency.period_secs();
+        let since = subscription.last_sent.unwrap_or(now - period);
+        if now - since < period {
+            continue;
+        }
+
+        let activity = collect(repos_dir, &subscription.repos, since);
+        if !activity.is_empty() {
+            let (subject, body) = render(subscription, &activity);
+            if let Err(e) = mailer.send(&subscription.email, &subject, &body) {
+                tracing::warn!("Failed to send digest to {}: {:#}", subscription.email, e);
+                continue;
+            }
+            sent += 1;
+        }
+        done.push(subscription.email.clone());
+    }
+
+    if !done.is_empty() {
+        // Reload so subscriptions changed while mail was going out are kept
+        let mut subscriptions = load(data_dir)?;
+        for subscription in subscriptions.iter_mut() {
+            if done.contains(&subscription.email) {
+                subscription.last_sent = Some(now);
+            }
+        }
+        save(data_dir, &subscriptions)?;
+    }
+
+    Ok(sent)
+}
@@ -0,0 +1,349 @@
+use crate::git;
+use std::env;
+use std::process::{Command, Stdio};
+use std::time::{SystemTime, UNIX_EPOCH};
+
+/// Maximum tolerated difference between the local and server clocks, in seconds
+const MAX_CLOCK_SKEW: i64 = 60;
+
+/// Outcome of a single diagnostic check
+pub enum Status {
+    Ok,
+    Warn,
+    Fail,
+    Skip,
+}
+
+/// What the server said to `agito-ping`
+#[derive(Default)]
+struct Pong {
+    time: Option<i64>,
+    version: Option<String>,
+    /// `ok`, or what is wrong with the repository's hooks
+    hooks: Vec<String>,
+    /// Why the server said nothing about the repository
+    repo_error: Option<String>,
+}
+
+impl Pong {
+    fn parse(reply: &str) -> Self {
+        let mut pong = Self::default();
+        for line in reply.lines() {
+            let (key, value) = line.split_once(' ').unwrap_or((line, ""));
+            match key {
+                "pong" => pong.time = value.trim().parse().ok(),
+                "version" => pong.version = Some(value.trim().to_string()),
+                "hooks" => pong.hooks.push(value.trim().to_string()),
+                "repo" => pong.repo_error = Some(value.trim().to_string()),
+                _ => {}
+            }
+        }
+        pong
+    }
+}
+
+/// Result of a single diagnostic check, with a suggested fix when it did not pass
+pub struct Check {
+    pub name: &'static str,
+    pub status: Status,
+    pub detail: String,
+    pub fix: Option<String>,
+}
+
+impl Check {
+    fn ok(name: &'static str, detail: impl Into<String>) -> Self {
+        Self {
+            name,
+            status: Status::Ok,
+            detail: detail.into(),
+            fix: None,
+        }
+    }
+
+    fn warn(name: &'static str, detail: impl Into<String>, fix: impl Into<String>) -> Self {
+        Self {
+            name,
+            status: Status::Warn,
+            detail: detail.into(),
+            fix: Some(fix.into()),
+        }
+    }
+
+    fn fail(name: &'static str, detail: impl Into<String>, fix: impl Into<String>) -> Self {
+        Self {
+            name,
+            status: Status::Fail,
+            detail: detail.into(),
+            fix: Some(fix.into()),
+        }
+    }
+
+    fn skip(name: &'static str, detail: impl Into<String>) -> Self {
+        Self {
+            name,
+            status: Status::Skip,
+            detail: detail.into(),
+            fix: None,
+        }
+    }
+}
+
+/// Run all client-side diagnostics against the given server, and against
+/// `repo` on it when run inside a clone
+pub fn run(server: &str, user: &str, repo: Option<&str>) -> Vec<Check> {
+    let mut checks = vec![check_git(), check_agent()];
+
+    let (ssh_check, pong) = check_ssh(server, user, repo);
+    checks.push(ssh_check);
+
+    match pong {
+        Some(pong) => {
+            checks.push(check_version(pong.version.as_deref()));
+            checks.push(check_clock(pong.time));
+            checks.push(check_hooks(repo, &pong));
+        }
+        None => {
+            checks.push(Check::skip("version", "server not reachable"));
+            checks.push(Check::skip("clock", "server not reachable"));
+            checks.push(Check::skip("hooks", "server not reachable"));
+        }
+    }
+
+    checks.push(check_token());
+
+    checks
+}
+
+/// Print checks in a human readable form. Returns true if nothing failed.
+pub fn report(checks: &[Check]) -> bool {
+    let mut healthy = true;
+
+    for check in checks {
+        let label = match check.status {
+            Status::Ok => "ok",
+            Status::Warn => "warn",
+            Status::Fail => {
+                healthy = false;
+                "FAIL"
+            }
+            Status::Skip => "skip",
+        };
+        println!("[{:<4}] {}: {}", label, check.name, check.detail);
+        if let Some(fix) = &check.fix {
+            println!("       fix: {}", fix);
+        }
+    }
+
+    healthy
+}
+
+fn check_git() -> Check {
+    let output = match Command::new("git").arg("--version").output() {
+        Ok(output) if output.status.success() => output,
+        _ => {
+            return Check::fail(
+                "git",
+                "git executable not found",
+                "install git and make sure it is on your PATH",
+            )
+        }
+    };
+
+    let version = String::from_utf8_lossy(&output.stdout).trim().to_string();
+    let major = version
+        .trim_start_matches("git version ")
+        .split('.')
+        .next()
+        .and_then(|v| v.parse::<u32>().ok())
+        .unwrap_or(0);
+
+    if major < 2 {
+        return Check::warn("git", version, "upgrade to git 2.x or later");
+    }
+
+    Check::ok("git", version)
+}
+
+fn check_agent() -> Check {
+    if env::var_os("SSH_AUTH_SOCK").is_none() {
+        return Check::warn(
+            "ssh-agent",
+            "SSH_AUTH_SOCK is not set",
+            "start an agent with `eval $(ssh-agent)` and add your key with `ssh-add`",
+        );
+    }
+
+    let status = Command::new("ssh-add")
+        .arg("-l")
+        .stdout(Stdio::null())
+        .stderr(Stdio::null())
+        .status();
+
+    match status.ok().and_then(|s| s.code()) {
+        Some(0) => Check::ok("ssh-agent", "agent running with keys loaded"),
+        Some(1) => Check::warn(
+            "ssh-agent",
+            "agent running but has no identities",
+            "add your key with `ssh-add ~/.ssh/id_ed25519`",
+        ),
+        _ => Check::warn(
+            "ssh-agent",
+            "could not contact the agent",
+            "restart the agent with `eval $(ssh-agent)`",
+        ),
+    }
+}
+
+fn check_ssh(server: &str, user: &str, repo: Option<&str>) -> (Check, Option<Pong>) {
+    let (host, port) = git::split_server(server);
+    let target = format!("{}@{}", user, host);
+    let ping = match repo {
+        Some(repo) => format!("agito-ping {}", repo),
+        None => "agito-ping".to_string(),
+    };
+
+    let output = Command::new("ssh")
+        .arg("-o")
+        .arg("BatchMode=yes")
+        .arg("-o")
+        .arg("ConnectTimeout=10")
+        .arg("-p")
+        .arg(port)
+        .arg(&target)
+        .arg(ping)
+        .output();
+
+    let output = match output {
+        Ok(output) => output,
+        Err(_) => {
+            return (
+                Check::fail(
+                    "ssh",
+                    "ssh executable not found",
+                    "install an OpenSSH client",
+                ),
+                None,
+            )
+        }
+    };
+
+    let stderr = String::from_utf8_lossy(&output.stderr);
+    if !output.status.success() {
+        let fix = if stderr.contains("Permission denied") {
+            "add your public key to the server's authorized_keys file".to_string()
+        } else if stderr.contains("Host key verification failed") {
+            format!(
+                "check and trust the server's host key with `agito trust {}`",
+                server
+            )
+        } else if stderr.contains("Connection refused") || stderr.contains("timed out") {
+            format!(
+                "check that agito-server is running and port {} is reachable",
+                port
+            )
+        } else if stderr.contains("Could not resolve") {
+            "check the AGITO_SERVER hostname".to_string()
+        } else {
+            "run `ssh -v` against the server to investigate".to_string()
+        };
+        let detail = stderr
+            .lines()
+            .last()
+            .unwrap_or("connection failed")
+            .to_string();
+        return (Check::fail("ssh", detail, fix), None);
+    }
+
+    let pong = Pong::parse(&String::from_utf8_lossy(&output.stdout));
+
+    (
+        Check::ok(
+            "ssh",
+            format!("authenticated to {}:{} as {}", host, port, user),
+        ),
+        Some(pong),
+    )
+}
+
+fn check_version(server_version: Option<&str>) -> Check {
+    let client_version = env!("CARGO_PKG_VERSION");
+    match server_version {
+        None => Check::warn(
+            "version",
+            "server did not report its version",
+            "upgrade agito-server; this client may use commands it lacks",
+        ),
+        Some(version) if !crate::version::compatible(version, client_version) => Check::warn(
+            "version",
+            format!("server {}, client {}", version, client_version),
+            "upgrade whichever is older so both run the same release",
+        ),
+        Some(version) if version != client_version => Check::ok(
+            "version",
+            format!("server {}, client {}, which work together", version, client_version),
+        ),
+        Some(version) => Check::ok("version", format!("server and client {}", version)),
+    }
+}
+
+fn check_clock(server_time: Option<i64>) -> Check {
+    let server_time = match server_time {
+        Some(t) => t,
+        None => return Check::skip("clock", "server did not report its time"),
+    };
+
+    let local_time = SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_secs() as i64)
+        .unwrap_or(0);
+    let skew = local_time - server_time;
+
+    if skew.abs() > MAX_CLOCK_SKEW {
+        return Check::warn(
+            "clock",
+            format!("local clock differs from server by {}s", skew),
+            "enable NTP synchronisation (e.g. `timedatectl set-ntp true`) on both machines",
+        );
+    }
+
+    Check::ok("clock", format!("skew {}s", skew))
+}
+
+fn check_hooks(repo: Option<&str>, pong: &Pong) -> Check {
+    let repo = match repo {
+        Some(repo) => repo,
+        None => return Check::skip("hooks", "not in a clone of a repository on the server"),
+    };
+    if let Some(error) = &pong.repo_error {
+        return Check::fail(
+            "hooks",
+            error.clone(),
+            "check the remote URL with `git remote -v` and that you have access to the repository",
+        );
+    }
+    match pong.hooks.as_slice() {
+        [] => Check::skip("hooks", "server did not report hook status"),
+        [ok] if ok == "ok" => Check::ok("hooks", format!("installed in {}", repo)),
+        problems => Check::fail(
+            "hooks",
+            format!("{}: {}", repo, problems.join("; ")),
+            "ask a server administrator to run `agito-server hooks sync`",
+        ),
+    }
+}
+
+fn check_token() -> Check {
+    match env::var("AGITO_TOKEN") {
+        Ok(token) if token.trim().is_empty() => Check::fail(
+            "token",
+            "AGITO_TOKEN is set but empty",
+            "unset AGITO_TOKEN or set it to a valid token",
+        ),
+        Ok(_) => Check::warn(
+            "token",
+            "AGITO_TOKEN is set but the server does not accept tokens yet",
+            "unset AGITO_TOKEN; SSH keys are used for authentication",
+        ),
+        Err(_) => Check::skip("token", "AGITO_TOKEN not set"),
+    }
+}
@@ -0,0 +1,277 @@
+//! The stream of ref updates pushed to each repository.
+//!
+//! The post-receive hook appends every updated ref to
+//! `agito/events.jsonl` in the repository, through `agito-admin events
+//! record`, which also brings pull requests up to date. Feeds and ref
+//! watches read it from there, and each update is sent to push webhooks.
+
+use crate::webhooks::{self, Event};
+use crate::{git, glob};
+use anyhow::Result;
+use serde::{Deserialize, Serialize};
+use serde_json::json;
+use std::fs::{self, OpenOptions};
+use std::io::Write;
+use std::path::{Path, PathBuf};
+
+/// Events kept per repository; older ones are dropped
+const MAX_EVENTS: usize = 1000;
+
+/// A ref created, moved or deleted by a push
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct RefUpdate {
+    /// Increases by one with every event in the repository
+    pub id: u64,
+    /// Unix time of the push
+    pub time: i64,
+    /// Full ref name, e.g. refs/tags/v1.0
+    pub refname: String,
+    pub old: String,
+    pub new: String,
+    /// User who pushed, if the server knows them by name
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub pusher: Option<String>,
+}
+
+impl RefUpdate {
+    pub fn created(&self) -> bool {
+        git::is_zero(&self.old)
+    }
+
+    pub fn deleted(&self) -> bool {
+        git::is_zero(&self.new)
+    }
+
+    pub fn is_tag(&self) -> bool {
+        self.refname.starts_with("refs/tags/")
+    }
+
+    /// Branch or tag name without its refs/heads/ or refs/tags/ prefix
+    pub fn short_name(&self) -> &str {
+        self.refname
+            .strip_prefix("refs/heads/")
+            .or_else(|| self.refname.strip_prefix("refs/tags/"))
+            .unwrap_or(&self.refname)
+    }
+
+    /// One-line description, e.g. "New tag v1.0"
+    pub fn summary(&self) -> String {
+        let kind = if self.is_tag() { "tag" } else { "branch" };
+        if self.created() {
+            format!("New {} {}", kind, self.short_name())
+        } else if self.deleted() {
+            format!("Deleted {} {}", kind, self.short_name())
+        } else {
+            format!("Updated {} {}", kind, self.short_name())
+        }
+    }
+}
+
+/// Whether `refname` matches a ref pattern. Patterns are globs matched
+/// against the full ref name, the name without `refs/` (`tags/v*`) or the
+/// short branch or tag name (`main`, `v*`).
+pub fn ref_matches(pattern: &str, refname: &str) -> bool {
+    let without_refs = refname.strip_prefix("refs/").unwrap_or(refname);
+    let short = without_refs
+        .strip_prefix("heads/")
+        .or_else(|| without_refs.strip_prefix("tags/"))
+        .unwrap_or(without_refs);
+    [refname, without_refs, short]
+        .iter()
+        .any(|name| glob::glob_match(pattern, name))
+}
+
+fn events_path(repo_path: &Path) -> PathBuf {
+    git::data_dir(repo_path).join("events.jsonl")
+}
+
+/// Parse the `<old> <new> <refname>` lines git passes to post-receive
+pub fn parse_hook_input(input: &str) -> Vec<(String, String, String)> {
+    input
+        .lines()
+        .filter_map(|line| {
+            let mut fields = line.split_whitespace();
+            Some((
+                fields.next()?.to_string(),
+                fields.next()?.to_string(),
+                fields.next()?.to_string(),
+            ))
+        })
+        .collect()
+}
+
+/// Append ref updates, given as (old, new, refname), to the repository's
+/// stream
+pub fn record(
+    repo_path: &Path,
+    updates: &[(String, String, String)],
+    pusher: Option<&str>,
+) -> Result<Vec<RefUpdate>> {
+    let mut events = all(repo_path);
+    let mut next_id = events.last().map_or(1, |event| event.id + 1);
+    let time = chrono::Utc::now().timestamp();
+    let recorded: Vec<RefUpdate> = updates
+        .iter()
+        .map(|(old, new, refname)| {
+            let event = RefUpdate {
+                id: next_id,
+                time,
+                refname: refname.clone(),
+                old: old.clone(),
+                new: new.clone(),
+                pusher: pusher.map(str::to_string),
+            };
+            next_id += 1;
+            event
+        })
+        .collect();
+
+    let path = events_path(repo_path);
+    if let Some(dir) = path.parent() {
+        fs::create_dir_all(dir)?;
+    }
+    // Rewrite the whole stream only once it is well past the limit
+    if events.len() + recorded.len() > MAX_EVENTS * 2 {
+        events.extend(recorded.iter().cloned());
+        let keep = events.split_off(events.len() - MAX_EVENTS);
+        let tmp = path.with_extension("jsonl.tmp");
+        fs::write(&tmp, to_lines(&keep)?)?;
+        fs::rename(&tmp, &path)?;
+    } else {
+        OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(&path)?
+            .write_all(to_lines(&recorded)?.as_bytes())?;
+    }
+    for event in &recorded {
+        webhooks::trigger(repo_path, Event::Push, || push_payload(repo_path, event));
+    }
+    Ok(recorded)
+}
+
+/// Body of the push webhook for a ref update
+fn push_payload(repo_path: &Path, event: &RefUpdate) -> serde_json::Value {
+    let commits: Vec<_> = new_commits(repo_path, event, 20)
+        .into_iter()
+        .map(|(id, author, subject)| json!({"id": id, "author": author, "message": subject}))
+        .collect();
+    json!({
+        "ref": event.refname,
+        "before": event.old,
+        "after": event.new,
+        "created": event.created(),
+        "deleted": event.deleted(),
+        "pusher": event.pusher,
+        "commits": commits,
+    })
+}
+
+fn to_lines(events: &[RefUpdate]) -> Result<String> {
+    let mut out = String::new();
+    for event in events {
+        out.push_str(&serde_json::to_string(event)?);
+        out.push('\n');
+    }
+    Ok(out)
+}
+
+/// Every recorded event, oldest first
+fn all(repo_path: &Path) -> Vec<RefUpdate> {
+    fs::read_to_string(events_path(repo_path))
+        .map(|content| {
+            content
+                .lines()
+                .filter_map(|line| serde_json::from_str(line).ok())
+                .collect()
+        })
+        .unwrap_or_default()
+}
+
+/// Events after the one with ID `after`, oldest first
+pub fn since(repo_path: &Path, after: u64) -> Vec<RefUpdate> {
+    all(repo_path)
+        .into_iter()
+        .filter(|event| event.id > after)
+        .collect()
+}
+
+/// ID of the latest event, or 0 if there are none
+pub fn latest_id(repo_path: &Path) -> u64 {
+    all(repo_path).last().map_or(0, |event| event.id)
+}
+
+/// The latest events for refs matching `pattern` (all refs if None),
+/// newest first
+pub fn recent(repo_path: &Path, pattern: Option<&str>, limit: usize) -> Vec<RefUpdate> {
+    all(repo_path)
+        .into_iter()
+        .rev()
+        .filter(|event| pattern.map_or(true, |p| ref_matches(p, &event.refname)))
+        .take(limit)
+        .collect()
+}
+
+/// Commits a branch update brought in, as (short hash, author, subject),
+/// newest first
+pub fn new_commits(
+    repo_path: &Path,
+    event: &RefUpdate,
+    limit: usize,
+) -> Vec<(String, String, String)> {
+    if event.deleted() || event.is_tag() {
+        return Vec::new();
+    }
+    let range = if event.created() {
+        event.new.clone()
+    } else {
+        format!("{}..{}", event.old, event.new)
+    };
+    let output = match git::run(
+        repo_path,
+        &[
+            "log",
+            &format!("--max-count={}", limit),
+            "--format=%h%x1f%an%x1f%s",
+            &range,
+            "--",
+        ],
+    ) {
+        Ok(output) if output.status.success() => output,
+        _ => return Vec::new(),
+    };
+    String::from_utf8_lossy(&output.stdout)
+        .lines()
+        .filter_map(|line| {
+            let mut fields = line.splitn(3, '\x1f');
+            Some((
+                fields.next()?.to_string(),
+                fields.next()?.to_string(),
+                fields.next()?.to_string(),
+            ))
+        })
+        .collect()
+}
+
+/// Message of an annotated tag, empty for lightweight tags
+pub fn tag_message(repo_path: &Path, event: &RefUpdate) -> String {
+    if !event.is_tag() || event.deleted() {
+        return String::new();
+    }
+    git::run(
+        repo_path,
+        &[
+            "for-each-ref",
+            "--format=%(objecttype)%00%(contents)",
+            &event.refname,
+        ],
+    )
+    .ok()
+    .filter(|output| output.status.success())
+    .and_then(|output| {
+        let stdout = String::from_utf8_lossy(&output.stdout).to_string();
+        let (kind, message) = stdout.split_once('\0')?;
+        Some(message.trim().to_string()).filter(|_| kind == "tag")
+    })
+    .unwrap_or_default()
+}
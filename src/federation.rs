@@ -0,0 +1,851 @@
+//! ForgeFed federation: repositories as ActivityPub actors that other forges
+//! and fediverse servers can follow.
+//!
+//! Every repository anyone may read is a `Repository` actor at
+//! `<public_url>/ap/<repo>`, found through WebFinger as `<name>@<host>` with
+//! the `/` of a namespace written as `+`, e.g. `team+webshop@example.com`.
+//! Its outbox lists recent pushes, new tags and new issues, and followers get
+//! them delivered to their inbox as they happen. Follows and unfollows arrive
+//! at the actor's inbox and must carry a valid HTTP signature.
+//!
+//! Requests are signed with one RSA key for the whole server, kept in
+//! `<data_dir>/federation/`, using the draft-cavage HTTP signatures that
+//! Mastodon, Forgejo and most of the fediverse use. The key is made and used
+//! with `openssl`, and requests are sent with curl. Followers are kept in the
+//! repository's `agito/federation/followers.json`, and what was last
+//! delivered to them in `agito/federation/cursor`.
+
+use crate::events::{self, RefUpdate};
+use crate::subscriptions::{self, Activity, Kind};
+use crate::{git, jobs, keys, orgs};
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use serde_json::{json, Value};
+use sha2::{Digest, Sha256};
+use std::collections::BTreeSet;
+use std::fs;
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::process::{Command, Stdio};
+use std::time::Duration;
+
+/// Media type of ActivityPub objects
+pub const ACTIVITY_JSON: &str = "application/activity+json";
+
+/// Activities listed in an outbox
+const OUTBOX_SIZE: usize = 20;
+
+/// Commits listed in a push activity
+const MAX_COMMITS: usize = 10;
+
+/// How far the Date of a signed request may be from now, in seconds
+const MAX_CLOCK_SKEW: i64 = 12 * 3600;
+
+/// Largest response read from another server
+const MAX_RESPONSE: u64 = 1024 * 1024;
+
+/// Federation settings of the server
+#[derive(Clone, Debug)]
+pub struct Federation {
+    /// URL the server is reached at, which actor IDs start with
+    pub public_url: String,
+    pub repos_dir: PathBuf,
+    /// Holds the signing key, and decides who may read repositories
+    pub data_dir: PathBuf,
+    /// Path of the curl binary
+    pub curl: PathBuf,
+    /// Longest a request to another server may take
+    pub timeout: Duration,
+}
+
+/// An actor following a repository
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Follower {
+    /// The follower's actor ID
+    pub actor: String,
+    /// Where activities are delivered: the shared inbox of its server if it
+    /// has one
+    pub inbox: String,
+    /// Unix time of the follow
+    pub since: i64,
+    /// Why the last delivery failed, if it did
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub error: Option<String>,
+}
+
+/// Last push event and activity delivered to a repository's followers
+#[derive(Clone, Copy, Debug, Default, Serialize, Deserialize)]
+struct Cursor {
+    events: u64,
+    activity: u64,
+}
+
+/// WebFinger user part of a repository: its name without `.git`, with `+`
+/// for the slash of a namespace
+pub fn handle(repo: &str) -> String {
+    repo.strip_suffix(".git").unwrap_or(repo).replace('/', "+")
+}
+
+/// The repository a WebFinger user part names
+pub fn repo_for_handle(handle: &str) -> String {
+    format!("{}.git", handle.replace('+', "/"))
+}
+
+fn federation_dir(repo_path: &Path) -> PathBuf {
+    git::data_dir(repo_path).join("federation")
+}
+
+/// The repository's followers
+pub fn followers(repo_path: &Path) -> Vec<Follower> {
+    fs::read_to_string(federation_dir(repo_path).join("followers.json"))
+        .ok()
+        .and_then(|content| serde_json::from_str(&content).ok())
+        .unwrap_or_default()
+}
+
+fn save_followers(repo_path: &Path, followers: &[Follower]) -> Result<()> {
+    let dir = federation_dir(repo_path);
+    fs::create_dir_all(&dir)?;
+    let path = dir.join("followers.json");
+    let tmp = path.with_extension("json.tmp");
+    fs::write(&tmp, serde_json::to_string_pretty(followers)?)?;
+    fs::rename(&tmp, &path)?;
+    Ok(())
+}
+
+fn cursor(repo_path: &Path) -> Option<Cursor> {
+    fs::read_to_string(federation_dir(repo_path).join("cursor"))
+        .ok()
+        .and_then(|content| serde_json::from_str(&content).ok())
+}
+
+fn set_cursor(repo_path: &Path, cursor: Cursor) -> Result<()> {
+    let dir = federation_dir(repo_path);
+    fs::create_dir_all(&dir)?;
+    fs::write(dir.join("cursor"), serde_json::to_string(&cursor)?)?;
+    Ok(())
+}
+
+/// Date header value for now
+fn http_date() -> String {
+    chrono::Utc::now()
+        .format("%a, %d %b %Y %H:%M:%S GMT")
+        .to_string()
+}
+
+fn digest(body: &[u8]) -> String {
+    format!("SHA-256={}", keys::encode_base64(&Sha256::digest(body)))
+}
+
+/// Host and path of an http(s) URL
+fn split_url(url: &str) -> Option<(&str, &str)> {
+    let rest = url
+        .strip_prefix("https://")
+        .or_else(|| url.strip_prefix("http://"))?;
+    let (host, path) = match rest.find('/') {
+        Some(i) => rest.split_at(i),
+        None => (rest, "/"),
+    };
+    (!host.is_empty()).then_some((host, path))
+}
+
+/// Whether two http(s) URLs have the same scheme and host
+fn same_origin(a: &str, b: &str) -> bool {
+    let scheme = |url: &str| {
+        url.split_once("://")
+            .map(|(scheme, _)| scheme.to_ascii_lowercase())
+    };
+    match (split_url(a), split_url(b)) {
+        (Some((a_host, _)), Some((b_host, _))) => {
+            a_host.eq_ignore_ascii_case(b_host) && scheme(a) == scheme(b)
+        }
+        _ => false,
+    }
+}
+
+/// Parameters of a Signature header, e.g. keyId="...",headers="...",signature="..."
+fn signature_params(header: &str) -> Vec<(&str, &str)> {
+    header
+        .split(',')
+        .filter_map(|param| {
+            let (key, value) = param.trim().split_once('=')?;
+            Some((key.trim(), value.trim().trim_matches('"')))
+        })
+        .collect()
+}
+
+/// Whether `value` names `id`, directly or as an object with that ID
+fn refers_to(value: &Value, id: &str) -> bool {
+    match value {
+        Value::String(s) => s == id,
+        Value::Object(_) => value["id"].as_str() == Some(id),
+        _ => false,
+    }
+}
+
+impl Federation {
+    fn base(&self) -> &str {
+        self.public_url.trim_end_matches('/')
+    }
+
+    /// Host part of the public URL, as used in WebFinger addresses
+    pub fn host(&self) -> &str {
+        split_url(self.base()).map_or("", |(host, _)| host)
+    }
+
+    pub fn actor_id(&self, repo: &str) -> String {
+        format!("{}/ap/{}", self.base(), repo)
+    }
+
+    /// Whether a repository is visible to the fediverse: anyone may read it
+    pub fn is_public(&self, repo: &str) -> bool {
+        orgs::is_public(&self.data_dir, &self.repos_dir, repo)
+    }
+
+    fn key_dir(&self) -> PathBuf {
+        self.data_dir.join("federation")
+    }
+
+    /// Paths of the private key and its public half, generated on first use
+    fn key(&self) -> Result<(PathBuf, PathBuf)> {
+        let dir = self.key_dir();
+        let (private, public) = (dir.join("key.pem"), dir.join("key.pub.pem"));
+        if !private.exists() {
+            fs::create_dir_all(&dir)?;
+            let tmp = dir.join("key.pem.tmp");
+            openssl(&[
+                "genpkey",
+                "-algorithm",
+                "RSA",
+                "-pkeyopt",
+                "rsa_keygen_bits:2048",
+                "-out",
+                &tmp.to_string_lossy(),
+            ])
+            .context("Failed to generate the federation key")?;
+            #[cfg(unix)]
+            {
+                use std::os::unix::fs::PermissionsExt;
+                fs::set_permissions(&tmp, fs::Permissions::from_mode(0o600))?;
+            }
+            fs::rename(&tmp, &private)?;
+        }
+        if !public.exists() {
+            openssl(&[
+                "pkey",
+                "-in",
+                &private.to_string_lossy(),
+                "-pubout",
+                "-out",
+                &public.to_string_lossy(),
+            ])
+            .context("Failed to write the public federation key")?;
+        }
+        Ok((private, public))
+    }
+
+    /// The server's public key, in PEM
+    pub fn public_key(&self) -> Result<String> {
+        let (_, public) = self.key()?;
+        fs::read_to_string(&public).with_context(|| format!("Failed to read {}", public.display()))
+    }
+
+    /// WebFinger response for a repository
+    pub fn webfinger(&self, repo: &str) -> Value {
+        json!({
+            "subject": format!("acct:{}@{}", handle(repo), self.host()),
+            "aliases": [self.actor_id(repo), format!("{}/repo/{}", self.base(), repo)],
+            "links": [
+                {"rel": "self", "type": ACTIVITY_JSON, "href": self.actor_id(repo)},
+                {
+                    "rel": "http://webfinger.net/rel/profile-page",
+                    "type": "text/html",
+                    "href": format!("{}/repo/{}", self.base(), repo)
+                },
+            ],
+        })
+    }
+
+    /// The repository's actor document
+    pub fn actor(&self, repo: &str, repo_path: &Path) -> Result<Value> {
+        let id = self.actor_id(repo);
+        let description = fs::read_to_string(repo_path.join("description"))
+            .unwrap_or_default()
+            .trim()
+            .to_string();
+        let summary = if description.starts_with("Unnamed repository;") {
+            String::new()
+        } else {
+            description
+        };
+        Ok(json!({
+            "@context": [
+                "https://www.w3.org/ns/activitystreams",
+                "https://w3id.org/security/v1",
+                "https://forgefed.org/ns",
+            ],
+            "id": id,
+            "type": "Repository",
+            "preferredUsername": handle(repo),
+            "name": repo,
+            "summary": summary,
+            "url": format!("{}/repo/{}", self.base(), repo),
+            "cloneUri": format!("{}/repo/{}", self.base(), repo),
+            "inbox": format!("{}/inbox", id),
+            "outbox": format!("{}/outbox", id),
+            "followers": format!("{}/followers", id),
+            "publicKey": {
+                "id": format!("{}#main-key", id),
+                "owner": id,
+                "publicKeyPem": self.public_key()?,
+            },
+        }))
+    }
+
+    /// The repository's followers collection, which only tells how many
+    pub fn followers_collection(&self, repo: &str, repo_path: &Path) -> Value {
+        json!({
+            "@context": "https://www.w3.org/ns/activitystreams",
+            "id": format!("{}/followers", self.actor_id(repo)),
+            "type": "OrderedCollection",
+            "totalItems": followers(repo_path).len(),
+        })
+    }
+
+    /// The repository's latest activities, newest first
+    pub fn outbox(&self, repo: &str, repo_path: &Path) -> Value {
+        let mut items: Vec<(i64, Value)> = events::recent(repo_path, None, OUTBOX_SIZE)
+            .iter()
+            .filter_map(|event| Some((event.time, self.push_activity(repo, repo_path, event)?)))
+            .collect();
+        let activity = subscriptions::activity(repo_path);
+        items.extend(
+            activity
+                .iter()
+                .rev()
+                .filter_map(|a| Some((a.time, self.issue_activity(repo, a)?)))
+                .take(OUTBOX_SIZE),
+        );
+        items.sort_by(|a, b| b.0.cmp(&a.0));
+        items.truncate(OUTBOX_SIZE);
+        let items: Vec<Value> = items.into_iter().map(|(_, item)| item).collect();
+        json!({
+            "@context": ["https://www.w3.org/ns/activitystreams", "https://forgefed.org/ns"],
+            "id": format!("{}/outbox", self.actor_id(repo)),
+            "type": "OrderedCollection",
+            "totalItems": items.len(),
+            "orderedItems": items,
+        })
+    }
+
+    fn published(time: i64) -> String {
+        chrono::DateTime::from_timestamp(time, 0)
+            .unwrap_or_default()
+            .to_rfc3339_opts(chrono::SecondsFormat::Secs, true)
+    }
+
+    /// A ForgeFed Push for a branch update, or a Create of a release note
+    /// for a new tag; None for deletions
+    fn push_activity(&self, repo: &str, repo_path: &Path, event: &RefUpdate) -> Option<Value> {
+        if event.deleted() {
+            return None;
+        }
+        let actor = self.actor_id(repo);
+        let id = format!("{}/activities/push/{}", actor, event.id);
+        let pusher = event.pusher.as_deref().unwrap_or("someone");
+        if event.is_tag() {
+            if !event.created() {
+                return None;
+            }
+            let tag = event.short_name();
+            let message = events::tag_message(repo_path, event);
+            let url = format!("{}/repo/{}/tree/{}", self.base(), repo, tag);
+            return Some(json!({
+                "id": id,
+                "type": "Create",
+                "actor": actor,
+                "published": Self::published(event.time),
+                "to": ["https://www.w3.org/ns/activitystreams#Public"],
+                "cc": [format!("{}/followers", actor)],
+                "object": {
+                    "id": format!("{}/releases/{}", actor, tag),
+                    "type": "Note",
+                    "attributedTo": actor,
+                    "name": format!("{} {}", repo, tag),
+                    "content": format!(
+                        "<p>Released <a href=\"{}\">{} {}</a></p>{}",
+                        url,
+                        html(repo),
+                        html(tag),
+                        if message.trim().is_empty() {
+                            String::new()
+                        } else {
+                            format!("<pre>{}</pre>", html(message.trim()))
+                        }
+                    ),
+                    "url": url,
+                    "published": Self::published(event.time),
+                },
+            }));
+        }
+
+        let commits: Vec<Value> = events::new_commits(repo_path, event, MAX_COMMITS)
+            .into_iter()
+            .map(|(hash, author, subject)| {
+                json!({
+                    "type": "Commit",
+                    "id": format!("{}/repo/{}/commit/{}", self.base(), repo, hash),
+                    "context": actor,
+                    "hash": hash,
+                    "summary": subject,
+                    "attributedTo": author,
+                })
+            })
+            .collect();
+        Some(json!({
+            "id": id,
+            "type": "Push",
+            "actor": actor,
+            "attributedTo": actor,
+            "published": Self::published(event.time),
+            "to": ["https://www.w3.org/ns/activitystreams#Public"],
+            "cc": [format!("{}/followers", actor)],
+            "context": actor,
+            "target": format!("{}/branches/{}", actor, event.short_name()),
+            "summary": format!("{} pushed to {} in {}", pusher, event.short_name(), repo),
+            "object": {
+                "type": "OrderedCollection",
+                "totalItems": commits.len(),
+                "orderedItems": commits,
+            },
+        }))
+    }
+
+    /// A Create of a Ticket for a new issue; None for other activity
+    fn issue_activity(&self, repo: &str, activity: &Activity) -> Option<Value> {
+        if activity.kind != Kind::Issue || activity.action != "opened" {
+            return None;
+        }
+        let actor = self.actor_id(repo);
+        let url = format!("{}/repo/{}/issues/{}", self.base(), repo, activity.number);
+        Some(json!({
+            "id": format!("{}/activities/issue/{}", actor, activity.id),
+            "type": "Create",
+            "actor": actor,
+            "published": Self::published(activity.time),
+            "to": ["https://www.w3.org/ns/activitystreams#Public"],
+            "cc": [format!("{}/followers", actor)],
+            "object": {
+                "id": url,
+                "type": "Ticket",
+                "context": actor,
+                "attributedTo": actor,
+                "name": format!("#{} {}", activity.number, activity.title),
+                "summary": activity.title,
+                "content": format!("<p>{}</p>", html(&activity.text)),
+                "mediaType": "text/html",
+                "url": url,
+                "published": Self::published(activity.time),
+            },
+        }))
+    }
+
+    /// Send an activity to an inbox, signed as the repository's actor
+    fn post(&self, repo: &str, inbox: &str, activity: &Value) -> Result<()> {
+        let (host, path) =
+            split_url(inbox).with_context(|| format!("Invalid inbox URL: {}", inbox))?;
+        let body = serde_json::to_vec(activity)?;
+        let (date, digest) = (http_date(), digest(&body));
+        let signed = format!(
+            "(request-target): post {}\nhost: {}\ndate: {}\ndigest: {}",
+            path, host, date, digest
+        );
+        let signature = keys::encode_base64(&self.sign(signed.as_bytes())?);
+        let headers = [
+            format!("Content-Type: {}", ACTIVITY_JSON),
+            format!("Date: {}", date),
+            format!("Digest: {}", digest),
+            format!(
+                "Signature: keyId=\"{}#main-key\",algorithm=\"rsa-sha256\",headers=\"(request-target) host date digest\",signature=\"{}\"",
+                self.actor_id(repo),
+                signature
+            ),
+        ];
+        let (status, response) = self.curl(&["--request", "POST"], &headers, inbox, Some(&body))?;
+        if !(200..300).contains(&status) {
+            anyhow::bail!(
+                "{} answered {}: {}",
+                inbox,
+                status,
+                String::from_utf8_lossy(&response)
+                    .chars()
+                    .take(200)
+                    .collect::<String>()
+            );
+        }
+        Ok(())
+    }
+
+    /// Fetch an ActivityPub object
+    pub fn fetch(&self, url: &str) -> Result<Value> {
+        split_url(url).with_context(|| format!("Invalid URL: {}", url))?;
+        let accept = format!(
+            "Accept: {}, application/ld+json; profile=\"https://www.w3.org/ns/activitystreams\"",
+            ACTIVITY_JSON
+        );
+        let (status, body) = self.curl(&["--location"], &[accept], url, None)?;
+        if status != 200 {
+            anyhow::bail!("{} answered {}", url, status);
+        }
+        serde_json::from_slice(&body).with_context(|| format!("{} sent invalid JSON", url))
+    }
+
+    /// Run curl, returning the status and body of the response
+    fn curl(
+        &self,
+        args: &[&str],
+        headers: &[String],
+        url: &str,
+        body: Option<&[u8]>,
+    ) -> Result<(u16, Vec<u8>)> {
+        let mut command = Command::new(&self.curl);
+        command
+            .args(["--silent", "--show-error", "--proto", "=http,https"])
+            .args(["--max-filesize", &MAX_RESPONSE.to_string(), "--max-time"])
+            .arg(self.timeout.as_secs().max(1).to_string())
+            .args([
+                "--user-agent",
+                "agito-federation",
+                "--write-out",
+                "\n%{http_code}",
+            ])
+            .args(args);
+        for header in headers {
+            command.arg("--header").arg(header);
+        }
+        if body.is_some() {
+            command.args(["--data-binary", "@-"]);
+        }
+        let mut child = command
+            .arg("--")
+            .arg(url)
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::piped())
+            .spawn()
+            .with_context(|| format!("Failed to run {}", self.curl.display()))?;
+        if let (Some(mut stdin), Some(body)) = (child.stdin.take(), body) {
+            let _ = stdin.write_all(body);
+        }
+        let output = child.wait_with_output()?;
+        if !output.status.success() {
+            anyhow::bail!("{}", String::from_utf8_lossy(&output.stderr).trim());
+        }
+        let mut stdout = output.stdout;
+        let split = stdout.iter().rposition(|&b| b == b'\n').unwrap_or(0);
+        let status = String::from_utf8_lossy(&stdout[split..]).trim().parse()?;
+        stdout.truncate(split);
+        Ok((status, stdout))
+    }
+
+    fn sign(&self, data: &[u8]) -> Result<Vec<u8>> {
+        let (private, _) = self.key()?;
+        let mut child = Command::new("openssl")
+            .args(["dgst", "-sha256", "-sign"])
+            .arg(&private)
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::piped())
+            .spawn()
+            .context("Failed to run openssl")?;
+        child.stdin.take().context("No stdin")?.write_all(data)?;
+        let output = child.wait_with_output()?;
+        if !output.status.success() {
+            anyhow::bail!(
+                "Failed to sign: {}",
+                String::from_utf8_lossy(&output.stderr).trim()
+            );
+        }
+        Ok(output.stdout)
+    }
+
+    /// Check the HTTP signature of a request to `path`, given its headers
+    /// with lowercase names, returning the ID of the actor that signed it
+    pub fn verify(&self, path: &str, headers: &[(String, String)], body: &[u8]) -> Result<String> {
+        let header = |name: &str| {
+            headers
+                .iter()
+                .find(|(n, _)| n == name)
+                .map(|(_, value)| value.as_str())
+        };
+        let params = signature_params(header("signature").context("The request is not signed")?);
+        let param = |name: &str| {
+            params
+                .iter()
+                .find(|(key, _)| *key == name)
+                .map(|(_, value)| *value)
+        };
+        let key_id = param("keyId").context("The signature has no keyId")?;
+        let signature = param("signature")
+            .and_then(keys::decode_base64)
+            .context("The signature is not base64")?;
+        let signed_headers: Vec<&str> = param("headers").unwrap_or("date").split(' ').collect();
+        for required in ["(request-target)", "host", "date", "digest"] {
+            if !signed_headers.contains(&required) {
+                anyhow::bail!("The signature must cover {}", required);
+            }
+        }
+
+        if header("digest") != Some(digest(body).as_str()) {
+            anyhow::bail!("The Digest header does not match the body");
+        }
+        let date = header("date")
+            .and_then(|date| chrono::DateTime::parse_from_rfc2822(date).ok())
+            .context("Missing or invalid Date header")?;
+        if (chrono::Utc::now().timestamp() - date.timestamp()).abs() > MAX_CLOCK_SKEW {
+            anyhow::bail!("The Date header is too far from now");
+        }
+
+        let mut signed = Vec::new();
+        for name in &signed_headers {
+            let value = match *name {
+                "(request-target)" => format!("post {}", path),
+                name => header(name)
+                    .with_context(|| format!("Signed header {} is missing", name))?
+                    .to_string(),
+            };
+            signed.push(format!("{}: {}", name, value));
+        }
+
+        // The key is either part of the actor document or a document of its own
+        let document = self.fetch(key_id.split('#').next().unwrap_or(key_id))?;
+        let key = if document["publicKeyPem"].is_string() {
+            &document
+        } else {
+            &document["publicKey"]
+        };
+        let (owner, pem) = match (key["owner"].as_str(), key["publicKeyPem"].as_str()) {
+            (Some(owner), Some(pem)) => (owner, pem),
+            _ => anyhow::bail!("{} has no public key", key_id),
+        };
+        // Anyone can publish a key naming someone else as its owner: the
+        // owner must be on the key's server and list the key as its own
+        if !same_origin(owner, key_id) {
+            anyhow::bail!("{} is not on the server of its key {}", owner, key_id);
+        }
+        let fetched;
+        let actor = if document["id"].as_str() == Some(owner) {
+            &document
+        } else {
+            fetched = self.fetch(owner)?;
+            &fetched
+        };
+        let listed = match &actor["publicKey"] {
+            Value::Array(keys) => keys.iter().any(|k| refers_to(k, key_id)),
+            key => refers_to(key, key_id),
+        };
+        if actor["id"].as_str() != Some(owner) || !listed {
+            anyhow::bail!("{} does not list the key {}", owner, key_id);
+        }
+        self.verify_signature(pem, signed.join("\n").as_bytes(), &signature)?;
+        Ok(owner.to_string())
+    }
+
+    fn verify_signature(&self, pem: &str, data: &[u8], signature: &[u8]) -> Result<()> {
+        let dir = self.key_dir().join("tmp");
+        fs::create_dir_all(&dir)?;
+        let name = keys::hex(&keys::random_bytes(8)?);
+        let (key_path, signature_path) = (
+            dir.join(format!("{}.pem", name)),
+            dir.join(format!("{}.sig", name)),
+        );
+        fs::write(&key_path, pem)?;
+        fs::write(&signature_path, signature)?;
+        let verified = Command::new("openssl")
+            .args(["dgst", "-sha256", "-verify"])
+            .arg(&key_path)
+            .arg("-signature")
+            .arg(&signature_path)
+            .stdin(Stdio::piped())
+            .stdout(Stdio::null())
+            .stderr(Stdio::null())
+            .spawn()
+            .and_then(|mut child| {
+                if let Some(mut stdin) = child.stdin.take() {
+                    stdin.write_all(data)?;
+                }
+                child.wait()
+            });
+        let _ = fs::remove_file(&key_path);
+        let _ = fs::remove_file(&signature_path);
+        match verified {
+            Ok(status) if status.success() => Ok(()),
+            Ok(_) => anyhow::bail!("The signature is invalid"),
+            Err(e) => Err(e).context("Failed to run openssl"),
+        }
+    }
+
+    /// Act on an activity `sender` posted to the repository's inbox: follows
+    /// are accepted and unfollows honored, anything else is ignored
+    pub fn receive(
+        &self,
+        repo: &str,
+        repo_path: &Path,
+        sender: &str,
+        activity: &Value,
+    ) -> Result<()> {
+        let actor = self.actor_id(repo);
+        if activity["actor"].as_str() != Some(sender) && !refers_to(&activity["actor"], sender) {
+            anyhow::bail!("The activity was not signed by its actor");
+        }
+        match activity["type"].as_str() {
+            Some("Follow") if refers_to(&activity["object"], &actor) => {
+                let follower = self.fetch(sender)?;
+                let inbox = follower["endpoints"]["sharedInbox"]
+                    .as_str()
+                    .or_else(|| follower["inbox"].as_str())
+                    .context("The follower has no inbox")?
+                    .to_string();
+                let mut all = followers(repo_path);
+                all.retain(|f| f.actor != sender);
+                all.push(Follower {
+                    actor: sender.to_string(),
+                    inbox: inbox.clone(),
+                    since: chrono::Utc::now().timestamp(),
+                    error: None,
+                });
+                save_followers(repo_path, &all)?;
+                tracing::info!(repo, follower = sender, "New follower");
+                // Delivery starts with what happens from now on
+                if cursor(repo_path).is_none() {
+                    set_cursor(repo_path, latest(repo_path))?;
+                }
+                let accept = json!({
+                    "@context": "https://www.w3.org/ns/activitystreams",
+                    "id": format!("{}/activities/accept/{}", actor, keys::hex(&keys::random_bytes(8)?)),
+                    "type": "Accept",
+                    "actor": actor,
+                    "object": activity,
+                });
+                let inbox = follower["inbox"].as_str().unwrap_or(&inbox);
+                self.post(repo, inbox, &accept)
+            }
+            Some("Undo") if activity["object"]["type"].as_str() == Some("Follow") => {
+                let mut all = followers(repo_path);
+                let before = all.len();
+                all.retain(|f| f.actor != sender);
+                if all.len() != before {
+                    save_followers(repo_path, &all)?;
+                    tracing::info!(repo, follower = sender, "Follower left");
+                }
+                Ok(())
+            }
+            _ => Ok(()),
+        }
+    }
+
+    /// Deliver what happened in every followed repository since the last
+    /// run, returning the number of activities sent
+    pub fn deliver(&self) -> Result<usize> {
+        let mut sent = 0;
+        for (repo, repo_path) in git::find_repositories(&self.repos_dir)? {
+            let mut all = followers(&repo_path);
+            if all.is_empty() {
+                continue;
+            }
+            let mut position = match cursor(&repo_path) {
+                Some(position) => position,
+                None => {
+                    set_cursor(&repo_path, latest(&repo_path))?;
+                    continue;
+                }
+            };
+            // A repository that became private keeps its followers but tells
+            // them nothing
+            if !self.is_public(&repo) {
+                set_cursor(&repo_path, latest(&repo_path))?;
+                continue;
+            }
+
+            let mut activities = Vec::new();
+            for event in events::since(&repo_path, position.events) {
+                activities.extend(self.push_activity(&repo, &repo_path, &event));
+                position.events = event.id;
+            }
+            for activity in subscriptions::activity(&repo_path) {
+                if activity.id > position.activity {
+                    activities.extend(self.issue_activity(&repo, &activity));
+                    position.activity = activity.id;
+                }
+            }
+            set_cursor(&repo_path, position)?;
+            if activities.is_empty() {
+                continue;
+            }
+
+            let inboxes: BTreeSet<String> = all.iter().map(|f| f.inbox.clone()).collect();
+            for inbox in inboxes {
+                let mut error = None;
+                for activity in &activities {
+                    let mut activity = activity.clone();
+                    activity["@context"] = json!([
+                        "https://www.w3.org/ns/activitystreams",
+                        "https://forgefed.org/ns"
+                    ]);
+                    match self.post(&repo, &inbox, &activity) {
+                        Ok(()) => sent += 1,
+                        Err(e) => {
+                            tracing::warn!(repo = %repo, "Failed to deliver to {}: {:#}", inbox, e);
+                            error = Some(format!("{:#}", e));
+                            break;
+                        }
+                    }
+                }
+                for follower in all.iter_mut().filter(|f| f.inbox == inbox) {
+                    follower.error = error.clone();
+                }
+            }
+            save_followers(&repo_path, &all)?;
+        }
+        Ok(sent)
+    }
+}
+
+/// The latest push event and activity of a repository
+fn latest(repo_path: &Path) -> Cursor {
+    Cursor {
+        events: events::latest_id(repo_path),
+        activity: subscriptions::activity(repo_path)
+            .last()
+            .map_or(0, |last| last.id),
+    }
+}
+
+fn html(text: &str) -> String {
+    text.replace('&', "&amp;")
+        .replace('<', "&lt;")
+        .replace('>', "&gt;")
+        .replace('"', "&quot;")
+}
+
+fn openssl(args: &[&str]) -> Result<()> {
+    let output = Command::new("openssl")
+        .args(args)
+        .output()
+        .context("Failed to run openssl")?;
+    if !output.status.success() {
+        anyhow::bail!("{}", String::from_utf8_lossy(&output.stderr).trim());
+    }
+    Ok(())
+}
+
+/// Deliver new activities to followers every `interval` in the background
+pub fn spawn(federation: Federation, interval: Duration) -> tokio::task::JoinHandle<()> {
+    jobs::spawn_periodic("federation", interval, move || {
+        let sent = federation.deliver()?;
+        if sent > 0 {
+            tracing::debug!("Delivered {} activities to followers", sent);
+        }
+        Ok(())
+    })
+}
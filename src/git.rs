@@ -1,7 +1,311 @@
 use anyhow::{Context, Result};
 use std::fs;
+use std::io::Read;
 use std::path::{Path, PathBuf};
-use std::process::Command;
+use std::process::{Command, Output, Stdio};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::mpsc::{self, RecvTimeoutError};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+pub mod batch;
+pub mod limits;
+pub mod process;
+
+/// Run git inside a repository and capture its output.
+///
+/// Every invocation gets its own tracing span, so slow git operations show up
+/// in exported traces alongside the request or session that caused them,
+/// with how long they took, how they exited and how much they printed.
+///
+/// Inside [`limits::Pools::scope`], as web requests are, git waits for a
+/// place in the scope's pool first, and fails with `TimedOut` if it doesn't
+/// get one, or if it runs longer than the pool's timeout.
+pub fn run(repo_path: &Path, args: &[&str]) -> std::io::Result<Output> {
+    run_with_env(repo_path, args, &[])
+}
+
+/// Like [`run`], with extra environment variables for git
+pub fn run_with_env(
+    repo_path: &Path,
+    args: &[&str],
+    env: &[(&str, &str)],
+) -> std::io::Result<Output> {
+    instrumented(repo_path, args, env, None).map(|(output, _)| output)
+}
+
+/// Like [`run`], keeping at most `max_bytes` of what git writes to stdout,
+/// cut at the last whole line. git is stopped as soon as it writes more, and
+/// the flag says whether it did.
+pub fn run_capped(
+    repo_path: &Path,
+    args: &[&str],
+    max_bytes: usize,
+) -> std::io::Result<(Output, bool)> {
+    instrumented(repo_path, args, &[], Some(max_bytes))
+}
+
+/// Run git as `run` describes
+fn instrumented(
+    repo_path: &Path,
+    args: &[&str],
+    env: &[(&str, &str)],
+    max_bytes: Option<usize>,
+) -> std::io::Result<(Output, bool)> {
+    let span = tracing::info_span!(
+        "git",
+        repo = %repo_path.display(),
+        command = args.first().copied().unwrap_or_default(),
+        bytes = tracing::field::Empty,
+        duration_ms = tracing::field::Empty,
+        exit_code = tracing::field::Empty,
+    );
+    let _guard = span.enter();
+
+    let _permit = limits::enter()?;
+    let start = Instant::now();
+    let mut command = Command::new("git");
+    command
+        .arg("-C")
+        .arg(repo_path)
+        .args(args)
+        .envs(env.iter().copied());
+    let output = collect(&mut command, max_bytes, limits::timeout());
+    crate::metrics::global()
+        .git_subprocess(args.first().copied().unwrap_or_default(), start.elapsed());
+    span.record("duration_ms", start.elapsed().as_millis() as u64);
+    if let Ok((output, _)) = &output {
+        span.record("bytes", output.stdout.len() as u64);
+        span.record("exit_code", output.status.code().unwrap_or(-1));
+    }
+
+    tracing::debug!(
+        elapsed_ms = start.elapsed().as_millis() as u64,
+        success = output.as_ref().map(|(o, _)| o.status.success()).unwrap_or(false),
+        "git {}",
+        args.join(" ")
+    );
+
+    output
+}
+
+/// Run `command` in a process group of its own and collect its output,
+/// keeping at most `max_bytes` of stdout. The group is stopped once stdout
+/// passes `max_bytes`, which the flag tells, or once `timeout` passes, which
+/// fails with `TimedOut`.
+fn collect(
+    command: &mut Command,
+    max_bytes: Option<usize>,
+    timeout: Option<Duration>,
+) -> std::io::Result<(Output, bool)> {
+    process::isolate(command);
+    let mut child = command
+        .stdin(Stdio::null())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()?;
+    let pid = child.id();
+
+    // A watchdog stops git when time is up, unless it hears first that git
+    // finished: `finished` goes out of scope
+    let (finished, finishing) = mpsc::channel::<()>();
+    let timed_out = Arc::new(AtomicBool::new(false));
+    if let Some(timeout) = timeout {
+        let timed_out = timed_out.clone();
+        std::thread::spawn(move || {
+            if finishing.recv_timeout(timeout) == Err(RecvTimeoutError::Timeout) {
+                timed_out.store(true, Ordering::SeqCst);
+                process::kill_group(pid);
+            }
+        });
+    }
+
+    let (output, truncated) = match max_bytes {
+        None => (child.wait_with_output()?, false),
+        Some(max_bytes) => {
+            // Read stderr alongside, so that git never blocks writing to it
+            let mut stderr_pipe = child.stderr.take();
+            let stderr = std::thread::spawn(move || {
+                let mut stderr = Vec::new();
+                if let Some(pipe) = stderr_pipe.as_mut() {
+                    let _ = pipe.read_to_end(&mut stderr);
+                }
+                stderr
+            });
+            let mut stdout = Vec::new();
+            if let Some(pipe) = child.stdout.take() {
+                pipe.take(max_bytes as u64 + 1).read_to_end(&mut stdout)?;
+            }
+            let truncated = stdout.len() > max_bytes;
+            if truncated {
+                process::kill_group(pid);
+                let end = stdout[..max_bytes]
+                    .iter()
+                    .rposition(|&byte| byte == b'\n')
+                    .map_or(0, |newline| newline + 1);
+                stdout.truncate(end);
+            }
+            let status = child.wait()?;
+            let output = Output {
+                status,
+                stdout,
+                stderr: stderr.join().unwrap_or_default(),
+            };
+            (output, truncated)
+        }
+    };
+    drop(finished);
+
+    if timed_out.load(Ordering::SeqCst) {
+        return Err(std::io::Error::new(
+            std::io::ErrorKind::TimedOut,
+            format!(
+                "git took longer than {}s and was stopped",
+                timeout.unwrap_or_default().as_secs()
+            ),
+        ));
+    }
+    Ok((output, truncated))
+}
+
+/// Branch HEAD points to, read straight from the HEAD file
+pub fn head_branch(repo_path: &Path) -> Option<String> {
+    let head = fs::read_to_string(repo_path.join("HEAD")).ok()?;
+    head.trim()
+        .strip_prefix("ref: refs/heads/")
+        .map(|branch| branch.to_string())
+}
+
+/// Point HEAD at `branch`, making it the default branch; it must exist
+pub fn set_head_branch(repo_path: &Path, branch: &str) -> Result<()> {
+    let refname = format!("refs/heads/{}", branch);
+    let output = run(
+        repo_path,
+        &["rev-parse", "--verify", "--quiet", &format!("{}^{{commit}}", refname)],
+    )?;
+    if !output.status.success() {
+        anyhow::bail!("No branch {}", branch);
+    }
+    let output = run(repo_path, &["symbolic-ref", "HEAD", &refname])?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "Failed to set HEAD: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(())
+}
+
+/// Local branch names, read from loose refs and packed-refs without spawning git
+pub fn branches(repo_path: &Path) -> std::io::Result<Vec<String>> {
+    let mut branches = Vec::new();
+    collect_refs(&repo_path.join("refs/heads"), "", &mut branches)?;
+
+    if let Ok(packed) = fs::read_to_string(repo_path.join("packed-refs")) {
+        for line in packed.lines() {
+            if let Some((_, name)) = line.split_once(' ') {
+                if let Some(branch) = name.strip_prefix("refs/heads/") {
+                    branches.push(branch.to_string());
+                }
+            }
+        }
+    }
+
+    branches.sort();
+    branches.dedup();
+    Ok(branches)
+}
+
+fn collect_refs(dir: &Path, prefix: &str, refs: &mut Vec<String>) -> std::io::Result<()> {
+    let entries = match fs::read_dir(dir) {
+        Ok(entries) => entries,
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(()),
+        Err(e) => return Err(e),
+    };
+    for entry in entries {
+        let entry = entry?;
+        let name = format!("{}{}", prefix, entry.file_name().to_string_lossy());
+        if entry.file_type()?.is_dir() {
+            collect_refs(&entry.path(), &format!("{}/", name), refs)?;
+        } else if !name.ends_with(".lock") {
+            refs.push(name);
+        }
+    }
+    Ok(())
+}
+
+/// Read a setting from a repository's git config, e.g. `agito.retention.ciLogsDays`.
+/// Per-repository agito settings live in the `[agito]` section.
+pub fn config_get(repo_path: &Path, key: &str) -> Option<String> {
+    let output = run(repo_path, &["config", "--get", key]).ok()?;
+    if !output.status.success() {
+        return None;
+    }
+    let value = String::from_utf8_lossy(&output.stdout).trim().to_string();
+    Some(value).filter(|v| !v.is_empty())
+}
+
+/// Git's all-zero object ID, meaning the ref did not exist before or after
+pub fn is_zero(oid: &str) -> bool {
+    !oid.is_empty() && oid.chars().all(|c| c == '0')
+}
+
+/// Commits `tip` has that `base` lacks, and the other way round
+pub fn ahead_behind(repo_path: &Path, base: &str, tip: &str) -> Option<(usize, usize)> {
+    let output = run(
+        repo_path,
+        &["rev-list", "--left-right", "--count", &format!("{}...{}", base, tip)],
+    )
+    .ok()
+    .filter(|output| output.status.success())?;
+    let stdout = String::from_utf8_lossy(&output.stdout);
+    let (behind, ahead) = stdout.trim().split_once('\t')?;
+    Some((ahead.parse().ok()?, behind.parse().ok()?))
+}
+
+/// Directory for agito's own per-repository data (CI logs, webhook deliveries, ...)
+pub fn data_dir(repo_path: &Path) -> PathBuf {
+    repo_path.join("agito")
+}
+
+/// Whether a directory is a bare repository, rather than any directory
+/// that happens to contain a file named HEAD
+pub fn is_repository(path: &Path) -> bool {
+    path.join("HEAD").is_file() && path.join("objects").is_dir() && path.join("refs").is_dir()
+}
+
+/// Find the bare repositories below `repos_dir`, returning their names
+/// relative to it. Directories that are not repositories themselves are
+/// treated as namespaces and searched one level deeper.
+pub fn find_repositories(repos_dir: &Path) -> std::io::Result<Vec<(String, PathBuf)>> {
+    let mut repos = Vec::new();
+    find_in(repos_dir, "", 0, &mut repos)?;
+    repos.sort();
+    Ok(repos)
+}
+
+fn find_in(
+    dir: &Path,
+    prefix: &str,
+    depth: usize,
+    repos: &mut Vec<(String, PathBuf)>,
+) -> std::io::Result<()> {
+    for entry in fs::read_dir(dir)? {
+        let entry = entry?;
+        if !entry.file_type()?.is_dir() {
+            continue;
+        }
+
+        let name = format!("{}{}", prefix, entry.file_name().to_string_lossy());
+        let path = entry.path();
+        if is_repository(&path) {
+            repos.push((name, path));
+        } else if depth == 0 && !name.starts_with('.') {
+            find_in(&path, &format!("{}/", name), depth + 1, repos)?;
+        }
+    }
+    Ok(())
+}
 
 /// Clone a repository using git
 pub fn clone(url: &str, args: &[String]) -> Result<()> {
@@ -23,151 +327,515 @@ pub fn clone(url: &str, args: &[String]) -> Result<()> {
     Ok(())
 }
 
-/// Create a remote repository on an agito server via SSH
-pub fn create_remote_repo(server: &str, user: &str, repo_name: &str) -> Result<()> {
+/// A repository the server created or imported
+pub struct RemoteRepo {
+    /// The name it has there (e.g. in the user's namespace)
+    pub name: String,
+    /// Where the server says to clone it from; older servers don't say
+    pub clone_url: Option<String>,
+}
+
+impl RemoteRepo {
+    /// Read the server's reply: `<prefix><name>` and then `Clone URL: <url>`
+    fn parse(reply: &str, prefix: &str, requested: &str) -> Self {
+        let mut lines = reply.lines();
+        let name = lines
+            .next()
+            .and_then(|line| line.strip_prefix(prefix))
+            .unwrap_or(requested)
+            .to_string();
+        let clone_url = lines
+            .find_map(|line| line.strip_prefix("Clone URL: "))
+            .map(str::to_string);
+        Self { name, clone_url }
+    }
+}
+
+/// Create a remote repository on an agito server via SSH. Without a
+/// visibility it gets the server's default. With a template it starts with
+/// the template's files, and with `with_hooks` its hooks too.
+pub fn create_remote_repo(
+    server: &str,
+    user: &str,
+    repo_name: &str,
+    visibility: Option<&str>,
+    template: Option<&str>,
+    with_hooks: bool,
+) -> Result<RemoteRepo> {
     let repo_name = if !repo_name.ends_with(".git") {
         format!("{}.git", repo_name)
     } else {
         repo_name.to_string()
     };
     
-    // Parse server and port
-    let (host, port) = if let Some(idx) = server.find(':') {
-        let (h, p) = server.split_at(idx);
-        (h, &p[1..])
-    } else {
-        (server, "22")
-    };
+    let (host, port) = split_server(server);
     
     // SSH command to create repository on server
-    let ssh_cmd = format!("agito-create-repo {}", repo_name);
-    let status = Command::new("ssh")
+    let mut ssh_cmd = format!("agito-create-repo {}", repo_name);
+    if let Some(visibility) = visibility {
+        ssh_cmd.push_str(&format!(" --visibility={}", visibility));
+    }
+    if let Some(template) = template {
+        ssh_cmd.push_str(&format!(" --template={}", template));
+        if with_hooks {
+            ssh_cmd.push_str(" --with-hooks");
+        }
+    }
+    let output = Command::new("ssh")
         .arg("-p")
         .arg(port)
         .arg(format!("{}@{}", user, host))
         .arg(ssh_cmd)
-        .status()
+        .stderr(std::process::Stdio::inherit())
+        .output()
         .context("Failed to execute ssh command")?;
     
-    if !status.success() {
-        anyhow::bail!("Failed to create remote repository");
+    let reply = String::from_utf8_lossy(&output.stdout).trim().to_string();
+    if !output.status.success() {
+        if reply.is_empty() {
+            anyhow::bail!("Failed to create remote repository");
+        }
+        anyhow::bail!("{}", reply);
     }
     
-    Ok(())
+    Ok(RemoteRepo::parse(&reply, "Repository created: ", &repo_name))
 }
 
-/// Initialize a bare git repository
-pub fn init_bare_repo(path: &Path) -> Result<()> {
-    fs::create_dir_all(path)
-        .context("Failed to create directory")?;
+/// Import a repository from `url` into the agito server via SSH, showing
+/// the server's progress
+pub fn import_remote_repo(
+    server: &str,
+    user: &str,
+    repo_name: &str,
+    url: &str,
+) -> Result<RemoteRepo> {
+    let (host, port) = split_server(server);
     
-    let output = Command::new("git")
-        .arg("init")
-        .arg("--bare")
-        .arg(path)
+    let output = Command::new("ssh")
+        .arg("-p")
+        .arg(port)
+        .arg(format!("{}@{}", user, host))
+        .arg(format!("agito-import {} '{}'", repo_name, url))
+        .stderr(std::process::Stdio::inherit())
         .output()
-        .context("Failed to init repository")?;
+        .context("Failed to execute ssh command")?;
     
+    let reply = String::from_utf8_lossy(&output.stdout).trim().to_string();
     if !output.status.success() {
-        anyhow::bail!(
-            "Failed to init repository: {}",
-            String::from_utf8_lossy(&output.stderr)
-        );
+        if reply.is_empty() {
+            anyhow::bail!("Failed to import repository");
+        }
+        anyhow::bail!("{}", reply);
+    }
+    
+    Ok(RemoteRepo::parse(&reply, "Repository imported: ", repo_name))
+}
+
+/// The names of the repositories on the server the user may read
+pub fn list_remote_repos(server: &str, user: &str) -> Result<Vec<String>> {
+    let (host, port) = split_server(server);
+
+    let output = Command::new("ssh")
+        .arg("-p")
+        .arg(port)
+        .arg(format!("{}@{}", user, host))
+        .arg("agito-list")
+        .stderr(std::process::Stdio::inherit())
+        .output()
+        .context("Failed to execute ssh command")?;
+
+    let reply = String::from_utf8_lossy(&output.stdout);
+    if !output.status.success() {
+        match reply.trim() {
+            "" => anyhow::bail!("Failed to list repositories"),
+            reply => anyhow::bail!("{}", reply),
+        }
     }
+
+    Ok(reply.lines().map(str::to_string).filter(|name| !name.is_empty()).collect())
+}
+
+/// Print a repository's disk usage and quotas as reported by the server
+pub fn remote_repo_info(server: &str, user: &str, repo_name: &str) -> Result<()> {
+    let (host, port) = split_server(server);
+    
+    let status = Command::new("ssh")
+        .arg("-p")
+        .arg(port)
+        .arg(format!("{}@{}", user, host))
+        .arg(format!("agito-info {}", repo_name))
+        .status()
+        .context("Failed to execute ssh command")?;
     
-    // Set up default hooks
-    setup_hooks(path)?;
+    if !status.success() {
+        anyhow::bail!("Failed to get repository information");
+    }
     
     Ok(())
 }
 
-/// Set up server-side git hooks
-fn setup_hooks(repo_path: &Path) -> Result<()> {
-    let hooks_dir = repo_path.join("hooks");
-    
-    // Create post-receive hook for CI/CD
-    let post_receive = hooks_dir.join("post-receive");
-    let post_receive_content = r#"#!/bin/sh
-# Agito post-receive hook
-# This hook is called after a push is completed
+/// Run an `agito-*` command on the server with `args`, each single-quoted,
+/// and return its reply. A failure carries the reply as its error, so that
+/// callers can keep errors off standard output.
+pub fn remote_reply(server: &str, user: &str, command: &str, args: &[String]) -> Result<String> {
+    let (host, port) = split_server(server);
+    let quoted: Vec<String> = args
+        .iter()
+        .map(|arg| format!("'{}'", arg.replace('\'', "'\\''")))
+        .collect();
 
-echo "Running post-receive hook..."
+    let output = Command::new("ssh")
+        .arg("-p")
+        .arg(port)
+        .arg(format!("{}@{}", user, host))
+        .arg(format!("{} {}", command, quoted.join(" ")))
+        .stderr(std::process::Stdio::inherit())
+        .output()
+        .context("Failed to execute ssh command")?;
+
+    let reply = String::from_utf8_lossy(&output.stdout).to_string();
+    if !output.status.success() {
+        match reply.trim() {
+            "" => anyhow::bail!("{} failed", command),
+            reply => anyhow::bail!("{}", reply),
+        }
+    }
+    Ok(reply)
+}
 
-# Read the pushed refs
-while read oldrev newrev refname; do
-    echo "Processing: $refname"
-    echo "  Old: $oldrev"
-    echo "  New: $newrev"
+/// Run `agito-pr` on the server with `args` and print its reply. Each
+/// argument is single-quoted so titles and comments may contain spaces.
+pub fn remote_pr(server: &str, user: &str, repo_name: &str, args: &[String]) -> Result<()> {
+    let (host, port) = split_server(server);
+    let quoted: Vec<String> = args
+        .iter()
+        .map(|arg| format!("'{}'", arg.replace('\'', "'\\''")))
+        .collect();
     
-    # Extract branch name
-    branch=$(echo $refname | sed 's/refs\/heads\///')
+    let status = Command::new("ssh")
+        .arg("-p")
+        .arg(port)
+        .arg(format!("{}@{}", user, host))
+        .arg(format!("agito-pr {} {}", repo_name, quoted.join(" ")))
+        .status()
+        .context("Failed to execute ssh command")?;
     
-    # Run CI/CD if configured
-    if [ -f "$GIT_DIR/agito-ci.sh" ]; then
-        echo "Running CI/CD pipeline for branch: $branch"
-        sh "$GIT_DIR/agito-ci.sh" "$branch" "$oldrev" "$newrev"
-    fi
-done
-
-echo "Post-receive hook completed."
-"#;
-    fs::write(&post_receive, post_receive_content)?;
-    #[cfg(unix)]
-    {
-        use std::os::unix::fs::PermissionsExt;
-        fs::set_permissions(&post_receive, fs::Permissions::from_mode(0o755))?;
+    if !status.success() {
+        anyhow::bail!("The pull request command failed");
     }
     
-    // Create pre-receive hook for validation
-    let pre_receive = hooks_dir.join("pre-receive");
-    let pre_receive_content = r#"#!/bin/sh
-# Agito pre-receive hook
-# This hook is called before a push is accepted
+    Ok(())
+}
 
-echo "Running pre-receive hook..."
+/// Run `agito-deploy-key` on the server for a repository with `args` and
+/// print its reply
+pub fn remote_deploy_key(server: &str, user: &str, repo_name: &str, args: &[String]) -> Result<()> {
+    let (host, port) = split_server(server);
+    let quoted: Vec<String> = args
+        .iter()
+        .map(|arg| format!("'{}'", arg.replace('\'', "'\\''")))
+        .collect();
 
-# Read the refs being pushed
-while read oldrev newrev refname; do
-    echo "Validating: $refname"
-    
-    # Add custom validation logic here
-    # Return non-zero to reject the push
-done
+    let status = Command::new("ssh")
+        .arg("-p")
+        .arg(port)
+        .arg(format!("{}@{}", user, host))
+        .arg(format!("agito-deploy-key {} {}", repo_name, quoted.join(" ")))
+        .status()
+        .context("Failed to execute ssh command")?;
 
-echo "Pre-receive validation passed."
-exit 0
-"#;
-    fs::write(&pre_receive, pre_receive_content)?;
-    #[cfg(unix)]
-    {
-        use std::os::unix::fs::PermissionsExt;
-        fs::set_permissions(&pre_receive, fs::Permissions::from_mode(0o755))?;
+    if !status.success() {
+        anyhow::bail!("The deploy key command failed");
     }
-    
-    // Create update hook
-    let update = hooks_dir.join("update");
-    let update_content = r#"#!/bin/sh
-# Agito update hook
-# This hook is called for each ref being updated
 
-refname="$1"
-oldrev="$2"
-newrev="$3"
+    Ok(())
+}
+
+/// Run `agito-repo` on the server for a repository with `args` and print its
+/// reply
+pub fn remote_repo(server: &str, user: &str, repo_name: &str, args: &[String]) -> Result<()> {
+    let (host, port) = split_server(server);
+    let quoted: Vec<String> = args
+        .iter()
+        .map(|arg| format!("'{}'", arg.replace('\'', "'\\''")))
+        .collect();
+
+    let status = Command::new("ssh")
+        .arg("-p")
+        .arg(port)
+        .arg(format!("{}@{}", user, host))
+        .arg(format!("agito-repo {} {}", repo_name, quoted.join(" ")))
+        .status()
+        .context("Failed to execute ssh command")?;
+
+    if !status.success() {
+        anyhow::bail!("The repository command failed");
+    }
+
+    Ok(())
+}
+
+/// Run `agito-release` on the server for a repository with `args` and print
+/// its reply. With `upload`, the file is sent on standard input.
+pub fn remote_release(
+    server: &str,
+    user: &str,
+    repo_name: &str,
+    args: &[String],
+    upload: Option<&Path>,
+) -> Result<()> {
+    let (host, port) = split_server(server);
+    let quoted: Vec<String> = args
+        .iter()
+        .map(|arg| format!("'{}'", arg.replace('\'', "'\\''")))
+        .collect();
+
+    let mut command = Command::new("ssh");
+    command
+        .arg("-p")
+        .arg(port)
+        .arg(format!("{}@{}", user, host))
+        .arg(format!("agito-release {} {}", repo_name, quoted.join(" ")));
+    if let Some(path) = upload {
+        let file = fs::File::open(path)
+            .with_context(|| format!("Failed to open {}", path.display()))?;
+        command.stdin(file);
+    }
+    let status = command.status().context("Failed to execute ssh command")?;
+
+    if !status.success() {
+        anyhow::bail!("The release command failed");
+    }
+
+    Ok(())
+}
+
+/// Search the server through `agito-grep` with `args`, printing the matches,
+/// and return its exit status: 0 if something matched, 1 if nothing did
+pub fn remote_grep(server: &str, user: &str, args: &[String]) -> Result<i32> {
+    let (host, port) = split_server(server);
+    let quoted: Vec<String> = args
+        .iter()
+        .map(|arg| format!("'{}'", arg.replace('\'', "'\\''")))
+        .collect();
+
+    let status = Command::new("ssh")
+        .arg("-p")
+        .arg(port)
+        .arg(format!("{}@{}", user, host))
+        .arg(format!("agito-grep {}", quoted.join(" ")))
+        .status()
+        .context("Failed to execute ssh command")?;
+
+    match status.code() {
+        Some(code @ (0 | 1)) => Ok(code),
+        _ => anyhow::bail!("The search failed"),
+    }
+}
+
+/// Download a bundle of a repository through `agito-bundle` into `output`,
+/// returning its size. A failed download leaves no file behind.
+pub fn remote_bundle(
+    server: &str,
+    user: &str,
+    repo_name: &str,
+    args: &[String],
+    output: &Path,
+) -> Result<u64> {
+    let (host, port) = split_server(server);
+    let quoted: Vec<String> = args
+        .iter()
+        .map(|arg| format!("'{}'", arg.replace('\'', "'\\''")))
+        .collect();
 
-echo "Update hook: $refname"
+    let tmp = output.with_extension("bundle.partial");
+    let file = fs::File::create(&tmp)
+        .with_context(|| format!("Failed to create {}", tmp.display()))?;
+    let status = Command::new("ssh")
+        .arg("-p")
+        .arg(port)
+        .arg(format!("{}@{}", user, host))
+        .arg(format!("agito-bundle {} {}", repo_name, quoted.join(" ")))
+        .stdout(file)
+        .status()
+        .context("Failed to execute ssh command")?;
 
-# Add custom branch protection logic here
-# Return non-zero to reject the update
+    if !status.success() {
+        let _ = fs::remove_file(&tmp);
+        anyhow::bail!("The bundle could not be made");
+    }
+    fs::rename(&tmp, output)
+        .with_context(|| format!("Failed to write {}", output.display()))?;
+    Ok(fs::metadata(output)?.len())
+}
+
+/// Ask the server whether pushing `refspecs` (the current branch if none)
+/// to `remote` would be accepted, without pushing. The refs and a pack of
+/// the objects the remote-tracking branches don't have are sent to
+/// `agito-push-check`, which prints its verdict. Returns whether the push
+/// would be accepted.
+pub fn check_push(remote: &str, refspecs: &[String]) -> Result<bool> {
+    let url = local_git(&["remote", "get-url", "--push", remote])
+        .map_err(|_| anyhow::anyhow!("No such remote: {}", remote))?;
+    let (destination, port, repo) = parse_ssh_url(&url)
+        .with_context(|| format!("{} is not an SSH remote: {}", remote, url))?;
+
+    let refspecs = if refspecs.is_empty() {
+        vec!["HEAD".to_string()]
+    } else {
+        refspecs.to_vec()
+    };
+    let mut header = String::new();
+    let mut wanted = Vec::new();
+    for refspec in &refspecs {
+        let refspec = refspec.trim_start_matches('+');
+        let (src, dst) = match refspec.split_once(':') {
+            Some((src, dst)) => (src, Some(dst)),
+            None => (refspec, None),
+        };
+        let full_src = if src.is_empty() {
+            String::new()
+        } else {
+            local_git(&["rev-parse", "--symbolic-full-name", src]).unwrap_or_default()
+        };
+        let dst = match dst {
+            Some(dst) if dst.starts_with("refs/") => dst.to_string(),
+            Some(dst) if full_src.starts_with("refs/tags/") => format!("refs/tags/{}", dst),
+            Some(dst) => format!("refs/heads/{}", dst),
+            None if full_src.starts_with("refs/") => full_src.clone(),
+            None => anyhow::bail!("Name the ref to push {} to, e.g. {}:main", src, src),
+        };
+        let new = if src.is_empty() {
+            "0".repeat(40)
+        } else {
+            let new = local_git(&["rev-parse", "--verify", src])
+                .with_context(|| format!("Unknown revision: {}", src))?;
+            wanted.push(new.clone());
+            new
+        };
+        header.push_str(&format!("{} {}\n", new, dst));
+    }
+    header.push('\n');
 
-exit 0
-"#;
-    fs::write(&update, update_content)?;
-    #[cfg(unix)]
-    {
-        use std::os::unix::fs::PermissionsExt;
-        fs::set_permissions(&update, fs::Permissions::from_mode(0o755))?;
+    let mut ssh = Command::new("ssh")
+        .arg("-p")
+        .arg(&port)
+        .arg(&destination)
+        .arg(format!("agito-push-check {}", repo))
+        .stdin(std::process::Stdio::piped())
+        .spawn()
+        .context("Failed to execute ssh command")?;
+    let mut stdin = ssh.stdin.take().unwrap();
+    std::io::Write::write_all(&mut stdin, header.as_bytes())?;
+
+    if !wanted.is_empty() {
+        // Objects reachable from the remote-tracking branches are on the server
+        let known = local_git(&[
+            "for-each-ref",
+            "--format=^%(objectname)",
+            &format!("refs/remotes/{}/", remote),
+        ])
+        .unwrap_or_default();
+        let mut pack = Command::new("git")
+            .args(["pack-objects", "--stdout", "--revs", "--quiet"])
+            .stdin(std::process::Stdio::piped())
+            .stdout(std::process::Stdio::piped())
+            .spawn()
+            .context("Failed to run git pack-objects")?;
+        let mut revs = String::new();
+        for rev in wanted.iter().map(String::as_str).chain(known.lines()) {
+            revs.push_str(rev);
+            revs.push('\n');
+        }
+        let mut pack_stdin = pack.stdin.take().unwrap();
+        let writer = std::thread::spawn(move || {
+            std::io::Write::write_all(&mut pack_stdin, revs.as_bytes())
+        });
+        std::io::copy(pack.stdout.as_mut().unwrap(), &mut stdin)?;
+        let _ = writer.join();
+        if !pack.wait()?.success() {
+            anyhow::bail!("git pack-objects failed");
+        }
+    }
+    drop(stdin);
+
+    Ok(ssh.wait()?.success())
+}
+
+/// The repository `remote` of the current directory pushes to, if it is
+/// reached over SSH
+pub fn remote_repo_name(remote: &str) -> Option<String> {
+    let url = local_git(&["remote", "get-url", "--push", remote]).ok()?;
+    let (_, _, repo) = parse_ssh_url(&url)?;
+    Some(repo)
+}
+
+/// Run git in the current directory and return its trimmed output
+fn local_git(args: &[&str]) -> Result<String> {
+    let output = Command::new("git").args(args).output()?;
+    if !output.status.success() {
+        anyhow::bail!("{}", String::from_utf8_lossy(&output.stderr).trim());
+    }
+    Ok(String::from_utf8_lossy(&output.stdout).trim().to_string())
+}
+
+/// Split an SSH remote URL, `ssh://user@host[:port]/path` or
+/// `user@host:path`, into the SSH destination, port and repository path
+fn parse_ssh_url(url: &str) -> Option<(String, String, String)> {
+    if let Some(rest) = url.strip_prefix("ssh://") {
+        let (authority, path) = rest.split_once('/')?;
+        let (destination, port) = match authority.rsplit_once(':') {
+            Some((destination, port)) => (destination, port),
+            None => (authority, "22"),
+        };
+        return Some((destination.to_string(), port.to_string(), path.to_string()));
+    }
+    if url.contains("://") {
+        return None;
+    }
+    let (destination, path) = url.split_once(':')?;
+    if destination.contains('/') {
+        return None;
+    }
+    Some((
+        destination.to_string(),
+        "22".to_string(),
+        path.trim_start_matches('/').to_string(),
+    ))
+}
+
+/// Split a `host[:port]` server address, defaulting to port 22
+pub fn split_server(server: &str) -> (&str, &str) {
+    if let Some(idx) = server.find(':') {
+        let (h, p) = server.split_at(idx);
+        (h, &p[1..])
+    } else {
+        (server, "22")
+    }
+}
+
+/// Initialize a bare git repository with hooks from `hooks`
+pub fn init_bare_repo(path: &Path, hooks: &crate::hooks::Templates) -> Result<()> {
+    fs::create_dir_all(path)
+        .context("Failed to create directory")?;
+    
+    let output = Command::new("git")
+        .arg("init")
+        .arg("--bare")
+        .arg(path)
+        .output()
+        .context("Failed to init repository")?;
+    
+    if !output.status.success() {
+        anyhow::bail!(
+            "Failed to init repository: {}",
+            String::from_utf8_lossy(&output.stderr)
+        );
     }
     
+    // Set up server-side hooks
+    hooks.install(path)?;
+    
     Ok(())
 }
 
@@ -201,6 +869,28 @@ pub fn get_repo_info(repo_path: &Path) -> Result<std::collections::HashMap<Strin
     Ok(info)
 }
 
+/// Most recently created tag, used as the latest release
+pub fn latest_tag(repo_path: &Path) -> Option<String> {
+    let output = run(
+        repo_path,
+        &[
+            "for-each-ref",
+            "--sort=-creatordate",
+            "--count=1",
+            "--format=%(refname:short)",
+            "refs/tags",
+        ],
+    )
+    .ok()?;
+
+    let tag = String::from_utf8_lossy(&output.stdout).trim().to_string();
+    if output.status.success() && !tag.is_empty() {
+        Some(tag)
+    } else {
+        None
+    }
+}
+
 /// List all refs in a repository
 pub fn list_refs(repo_path: &Path) -> Result<Vec<String>> {
     let output = Command::new("git")
@@ -0,0 +1,383 @@
+//! Long-running `git cat-file` workers for read-only object access.
+//!
+//! Spawning git for every blob, tree or commit a page needs dominates the cost
+//! of serving the web viewer. Instead, each repository gets a persistent
+//! `git cat-file --batch` (and `--batch-check`) process that objects are
+//! requested from over a pipe. Workers are shared between requests, respawned
+//! if they die and closed after a period of inactivity.
+
+use std::collections::{BinaryHeap, HashMap, HashSet};
+use std::io::{self, BufRead, BufReader, Read, Write};
+use std::path::{Path, PathBuf};
+use std::process::{Child, ChildStdin, ChildStdout, Command, Stdio};
+use std::sync::{Arc, Mutex, OnceLock};
+use std::time::{Duration, Instant};
+
+/// Workers unused for this long are shut down
+const IDLE_TIMEOUT: Duration = Duration::from_secs(300);
+
+/// Upper bound on live workers; the least recently used one is closed beyond it
+const MAX_WORKERS: usize = 128;
+
+/// A git object read from the repository
+pub struct Object {
+    /// Full object id
+    pub id: String,
+    /// "blob", "tree", "commit" or "tag"
+    pub kind: String,
+    pub size: usize,
+    /// Object content; empty for `--batch-check` lookups
+    pub data: Vec<u8>,
+}
+
+/// An entry of a tree object
+pub struct TreeEntry {
+    pub mode: String,
+    /// "blob", "tree" or "commit" (submodule)
+    pub kind: &'static str,
+    pub name: String,
+    pub id: String,
+}
+
+/// The parts of a commit object the viewer needs
+pub struct Commit {
+    pub id: String,
+    pub parents: Vec<String>,
+    pub author_name: String,
+    pub author_email: String,
+    pub author_time: i64,
+    pub committer_time: i64,
+    pub message: String,
+}
+
+impl Commit {
+    /// First line of the commit message
+    pub fn subject(&self) -> &str {
+        self.message.lines().next().unwrap_or("")
+    }
+}
+
+#[derive(Clone, Copy, PartialEq, Eq, Hash)]
+enum Mode {
+    /// `--batch`: header and content
+    Contents,
+    /// `--batch-check`: header only
+    Check,
+}
+
+struct Worker {
+    child: Child,
+    stdin: ChildStdin,
+    stdout: BufReader<ChildStdout>,
+    last_used: Instant,
+}
+
+impl Worker {
+    fn spawn(repo_path: &Path, mode: Mode) -> io::Result<Self> {
+        let flag = match mode {
+            Mode::Contents => "--batch",
+            Mode::Check => "--batch-check",
+        };
+        let mut child = Command::new("git")
+            .arg("-C")
+            .arg(repo_path)
+            .args(["cat-file", flag])
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::null())
+            .spawn()?;
+        tracing::debug!(repo = %repo_path.display(), "Started git cat-file {}", flag);
+
+        let stdin = child.stdin.take().unwrap();
+        let stdout = BufReader::new(child.stdout.take().unwrap());
+        Ok(Self {
+            child,
+            stdin,
+            stdout,
+            last_used: Instant::now(),
+        })
+    }
+
+    fn request(&mut self, spec: &str, mode: Mode) -> io::Result<Option<Object>> {
+        self.last_used = Instant::now();
+        writeln!(self.stdin, "{}", spec)?;
+        self.stdin.flush()?;
+
+        let mut header = String::new();
+        if self.stdout.read_line(&mut header)? == 0 {
+            return Err(io::Error::new(
+                io::ErrorKind::UnexpectedEof,
+                "git cat-file exited",
+            ));
+        }
+
+        // "<id> <type> <size>" or "<spec> missing" / "<spec> ambiguous"
+        let fields: Vec<&str> = header.trim_end().split(' ').collect();
+        let (id, kind, size) = match fields.as_slice() {
+            [id, kind, size] => match size.parse::<usize>() {
+                Ok(size) => (id.to_string(), kind.to_string(), size),
+                Err(_) => return Ok(None),
+            },
+            _ => return Ok(None),
+        };
+
+        let mut data = Vec::new();
+        if mode == Mode::Contents {
+            data.resize(size, 0);
+            self.stdout.read_exact(&mut data)?;
+            let mut newline = [0u8; 1];
+            self.stdout.read_exact(&mut newline)?;
+        }
+
+        Ok(Some(Object {
+            id,
+            kind,
+            size,
+            data,
+        }))
+    }
+}
+
+impl Drop for Worker {
+    fn drop(&mut self) {
+        let _ = self.child.kill();
+        let _ = self.child.wait();
+    }
+}
+
+/// Shared cat-file workers, one per repository and mode
+#[derive(Default)]
+pub struct Pool {
+    workers: Mutex<HashMap<(PathBuf, Mode), Arc<Mutex<Worker>>>>,
+}
+
+/// The pool used by the web server
+pub fn pool() -> &'static Pool {
+    static POOL: OnceLock<Pool> = OnceLock::new();
+    POOL.get_or_init(Pool::default)
+}
+
+impl Pool {
+    fn worker(&self, repo_path: &Path, mode: Mode) -> io::Result<Arc<Mutex<Worker>>> {
+        let mut workers = self.workers.lock().unwrap();
+        self.evict(&mut workers);
+
+        let key = (repo_path.to_path_buf(), mode);
+        if let Some(worker) = workers.get(&key) {
+            return Ok(worker.clone());
+        }
+
+        let worker = Arc::new(Mutex::new(Worker::spawn(repo_path, mode)?));
+        workers.insert(key, worker.clone());
+        Ok(worker)
+    }
+
+    /// Close idle workers, and the least recently used ones beyond the limit
+    fn evict(&self, workers: &mut HashMap<(PathBuf, Mode), Arc<Mutex<Worker>>>) {
+        workers.retain(|_, worker| match worker.try_lock() {
+            Ok(worker) => worker.last_used.elapsed() < IDLE_TIMEOUT,
+            Err(_) => true,
+        });
+
+        while workers.len() >= MAX_WORKERS {
+            let oldest = workers
+                .iter()
+                .filter_map(|(key, worker)| {
+                    worker.try_lock().ok().map(|w| (key.clone(), w.last_used))
+                })
+                .min_by_key(|(_, last_used)| *last_used)
+                .map(|(key, _)| key);
+            match oldest {
+                Some(key) => {
+                    workers.remove(&key);
+                }
+                None => break,
+            }
+        }
+    }
+
+    fn request(&self, repo_path: &Path, spec: &str, mode: Mode) -> io::Result<Option<Object>> {
+        // The object name is terminated by a newline, so it can't contain one
+        if spec.contains('\n') {
+            return Ok(None);
+        }
+
+        let worker = self.worker(repo_path, mode)?;
+        let result = worker.lock().unwrap().request(spec, mode);
+        match result {
+            Ok(object) => Ok(object),
+            Err(e) => {
+                // A worker that failed mid-request is out of sync; replace it and retry once
+                tracing::debug!("git cat-file worker failed, restarting: {}", e);
+                self.workers
+                    .lock()
+                    .unwrap()
+                    .remove(&(repo_path.to_path_buf(), mode));
+                let worker = self.worker(repo_path, mode)?;
+                let result = worker.lock().unwrap().request(spec, mode);
+                result
+            }
+        }
+    }
+
+    /// Read an object by any name git understands, e.g. `main:src/lib.rs` or a hash
+    pub fn read(&self, repo_path: &Path, spec: &str) -> io::Result<Option<Object>> {
+        self.request(repo_path, spec, Mode::Contents)
+    }
+
+    /// Look up an object's id, type and size without reading its content
+    pub fn check(&self, repo_path: &Path, spec: &str) -> io::Result<Option<Object>> {
+        self.request(repo_path, spec, Mode::Check)
+    }
+
+    /// Entries of the tree at `spec`, or None if it isn't a tree
+    pub fn tree(&self, repo_path: &Path, spec: &str) -> io::Result<Option<Vec<TreeEntry>>> {
+        match self.read(repo_path, spec)? {
+            Some(object) if object.kind == "tree" => Ok(Some(parse_tree(&object.data))),
+            _ => Ok(None),
+        }
+    }
+
+    /// The commit `spec` resolves to
+    pub fn commit(&self, repo_path: &Path, spec: &str) -> io::Result<Option<Commit>> {
+        match self.read(repo_path, &format!("{}^{{commit}}", spec))? {
+            Some(object) if object.kind == "commit" => {
+                Ok(Some(parse_commit(&object.id, &object.data)))
+            }
+            _ => Ok(None),
+        }
+    }
+
+    /// Up to `limit` commits reachable from `rev`, newest first by committer
+    /// date, like `git log`
+    pub fn log(&self, repo_path: &Path, rev: &str, limit: usize) -> io::Result<Vec<Commit>> {
+        let mut commits = Vec::new();
+        let mut queue = BinaryHeap::new();
+        let mut seen = HashSet::new();
+
+        if let Some(commit) = self.commit(repo_path, rev)? {
+            seen.insert(commit.id.clone());
+            queue.push(Queued(commit));
+        }
+
+        while let Some(Queued(commit)) = queue.pop() {
+            if commits.len() >= limit {
+                break;
+            }
+            for parent in &commit.parents {
+                if seen.insert(parent.clone()) {
+                    if let Some(parent) = self.commit(repo_path, parent)? {
+                        queue.push(Queued(parent));
+                    }
+                }
+            }
+            commits.push(commit);
+        }
+
+        Ok(commits)
+    }
+}
+
+/// Orders commits by committer time for the log walk
+struct Queued(Commit);
+
+impl PartialEq for Queued {
+    fn eq(&self, other: &Self) -> bool {
+        self.0.committer_time == other.0.committer_time
+    }
+}
+
+impl Eq for Queued {}
+
+impl PartialOrd for Queued {
+    fn partial_cmp(&self, other: &Self) -> Option<std::cmp::Ordering> {
+        Some(self.cmp(other))
+    }
+}
+
+impl Ord for Queued {
+    fn cmp(&self, other: &Self) -> std::cmp::Ordering {
+        self.0.committer_time.cmp(&other.0.committer_time)
+    }
+}
+
+/// Parse the binary tree format: `<mode> <name>\0<20-byte id>` repeated
+fn parse_tree(data: &[u8]) -> Vec<TreeEntry> {
+    let mut entries = Vec::new();
+    let mut rest = data;
+
+    while let Some(space) = rest.iter().position(|&b| b == b' ') {
+        let mode = String::from_utf8_lossy(&rest[..space]).to_string();
+        rest = &rest[space + 1..];
+
+        let nul = match rest.iter().position(|&b| b == 0) {
+            Some(nul) => nul,
+            None => break,
+        };
+        let name = String::from_utf8_lossy(&rest[..nul]).to_string();
+        rest = &rest[nul + 1..];
+
+        // SHA-1 repositories use 20-byte ids; SHA-256 ones aren't supported here
+        if rest.len() < 20 {
+            break;
+        }
+        let id = rest[..20].iter().map(|b| format!("{:02x}", b)).collect();
+        rest = &rest[20..];
+
+        let kind = match mode.as_str() {
+            "40000" => "tree",
+            "160000" => "commit",
+            _ => "blob",
+        };
+        entries.push(TreeEntry {
+            mode,
+            kind,
+            name,
+            id,
+        });
+    }
+
+    entries
+}
+
+fn parse_commit(id: &str, data: &[u8]) -> Commit {
+    let text = String::from_utf8_lossy(data);
+    let (headers, message) = text.split_once("\n\n").unwrap_or((&text, ""));
+
+    let mut commit = Commit {
+        id: id.to_string(),
+        parents: Vec::new(),
+        author_name: String::new(),
+        author_email: String::new(),
+        author_time: 0,
+        committer_time: 0,
+        message: message.to_string(),
+    };
+
+    for line in headers.lines() {
+        if let Some(parent) = line.strip_prefix("parent ") {
+            commit.parents.push(parent.to_string());
+        } else if let Some(author) = line.strip_prefix("author ") {
+            let (name, email, time) = parse_signature(author);
+            commit.author_name = name;
+            commit.author_email = email;
+            commit.author_time = time;
+        } else if let Some(committer) = line.strip_prefix("committer ") {
+            commit.committer_time = parse_signature(committer).2;
+        }
+    }
+
+    commit
+}
+
+/// Split `Name <email> 1700000000 +0100`
+fn parse_signature(value: &str) -> (String, String, i64) {
+    let (name, rest) = value.split_once(" <").unwrap_or((value, ""));
+    let (email, rest) = rest.split_once("> ").unwrap_or((rest, ""));
+    let time = rest
+        .split_whitespace()
+        .next()
+        .and_then(|t| t.parse().ok())
+        .unwrap_or(0);
+    (name.to_string(), email.to_string(), time)
+}
@@ -0,0 +1,298 @@
+//! Limits on the git processes running at once, so that fifty clones
+//! starting together can't take all the memory and CPU of a small server.
+//!
+//! Processes are counted in three pools, each with its own cap:
+//!
+//! - uploads: `git-upload-pack`, serving clones and fetches
+//! - receives: `git-receive-pack`, taking pushes
+//! - web: git run to answer a web page or API request
+//!
+//! A process over its pool's cap waits for one of the running ones to
+//! finish, and gives up once it has waited for the queue timeout. A process
+//! that runs longer than its pool's timeout is stopped, along with whatever
+//! it started (see [`super::process`]). Git run by background jobs, such as
+//! maintenance and mirroring, isn't counted or timed, nor are the
+//! long-lived `git cat-file` processes of [`super::batch`], which has its
+//! own pool.
+
+use crate::config::Shared;
+use crate::metrics;
+use std::cell::Cell;
+use std::fmt;
+use std::future::Future;
+use std::io;
+use std::sync::{Arc, Condvar, Mutex};
+use std::time::{Duration, Instant};
+
+/// How long a git process waits for a place when no timeout is configured
+pub const DEFAULT_QUEUE_TIMEOUT: Duration = Duration::from_secs(30);
+
+/// How long git may take to answer a web page or API request when no
+/// timeout is configured
+pub const DEFAULT_WEB_TIMEOUT: Duration = Duration::from_secs(60);
+
+/// How long a clone, fetch or push may take when no timeout is configured
+pub const DEFAULT_TRANSFER_TIMEOUT: Duration = Duration::from_secs(60 * 60);
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum Pool {
+    Upload,
+    Receive,
+    Web,
+}
+
+impl Pool {
+    pub const ALL: [Pool; 3] = [Pool::Upload, Pool::Receive, Pool::Web];
+
+    pub fn name(&self) -> &'static str {
+        match self {
+            Pool::Upload => "uploads",
+            Pool::Receive => "receives",
+            Pool::Web => "web",
+        }
+    }
+
+    fn index(self) -> usize {
+        self as usize
+    }
+
+    /// What the pool's processes do, for refusals
+    fn describe(&self) -> &'static str {
+        match self {
+            Pool::Upload => "clones and fetches",
+            Pool::Receive => "pushes",
+            Pool::Web => "requests reading repositories",
+        }
+    }
+}
+
+/// The caps; None leaves a pool unlimited
+#[derive(Clone, Debug)]
+pub struct Config {
+    pub uploads: Option<usize>,
+    pub receives: Option<usize>,
+    pub web: Option<usize>,
+    /// How long a process waits for a place before it is turned away
+    pub queue_timeout: Duration,
+    /// How long a process of each pool may run before it is stopped; None
+    /// lets it take as long as it needs
+    pub upload_timeout: Option<Duration>,
+    pub receive_timeout: Option<Duration>,
+    pub web_timeout: Option<Duration>,
+}
+
+impl Default for Config {
+    fn default() -> Self {
+        Self {
+            uploads: None,
+            receives: None,
+            web: None,
+            queue_timeout: DEFAULT_QUEUE_TIMEOUT,
+            upload_timeout: Some(DEFAULT_TRANSFER_TIMEOUT),
+            receive_timeout: Some(DEFAULT_TRANSFER_TIMEOUT),
+            web_timeout: Some(DEFAULT_WEB_TIMEOUT),
+        }
+    }
+}
+
+impl Config {
+    fn cap(&self, pool: Pool) -> Option<usize> {
+        match pool {
+            Pool::Upload => self.uploads,
+            Pool::Receive => self.receives,
+            Pool::Web => self.web,
+        }
+        .map(|cap| cap.max(1))
+    }
+
+    fn timeout(&self, pool: Pool) -> Option<Duration> {
+        match pool {
+            Pool::Upload => self.upload_timeout,
+            Pool::Receive => self.receive_timeout,
+            Pool::Web => self.web_timeout,
+        }
+    }
+}
+
+#[derive(Default)]
+struct Counts {
+    running: [usize; 3],
+    waiting: [usize; 3],
+}
+
+/// A git process waited for the queue timeout without getting a place
+#[derive(Debug)]
+pub struct Busy {
+    pub pool: Pool,
+    pub waited: Duration,
+}
+
+impl fmt::Display for Busy {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "The server is busy with other {}; try again shortly",
+            self.pool.describe()
+        )
+    }
+}
+
+impl std::error::Error for Busy {}
+
+impl From<Busy> for io::Error {
+    fn from(busy: Busy) -> Self {
+        io::Error::new(io::ErrorKind::TimedOut, busy.to_string())
+    }
+}
+
+/// Enforces the caps. Clones share their counts, so the web and SSH servers
+/// can hold one between them.
+#[derive(Clone, Default)]
+pub struct Pools {
+    config: Shared<Config>,
+    counts: Arc<(Mutex<Counts>, Condvar)>,
+}
+
+impl Pools {
+    pub fn new(config: Config) -> Self {
+        Self {
+            config: Shared::new(config),
+            counts: Arc::default(),
+        }
+    }
+
+    /// Apply new caps; processes running keep their places, and waiting
+    /// ones are let in if the caps grew
+    pub fn reconfigure(&self, config: Config) {
+        self.config.set(config);
+        self.counts.1.notify_all();
+    }
+
+    /// Wait for a place in `pool`, for up to the queue timeout. The process
+    /// counts as running until the returned permit is dropped.
+    pub fn acquire(&self, pool: Pool) -> Result<Permit, Busy> {
+        let (lock, freed) = &*self.counts;
+        let start = Instant::now();
+        let mut counts = lock.lock().unwrap();
+        counts.waiting[pool.index()] += 1;
+        loop {
+            let config = self.config.get();
+            match config.cap(pool) {
+                Some(cap) if counts.running[pool.index()] >= cap => {}
+                _ => break,
+            }
+            let waited = start.elapsed();
+            if waited >= config.queue_timeout {
+                counts.waiting[pool.index()] -= 1;
+                metrics::global().rate_limited(&format!("git-{}", pool.name()));
+                tracing::warn!(
+                    pool = pool.name(),
+                    waited_ms = waited.as_millis() as u64,
+                    "No place for a git process"
+                );
+                return Err(Busy { pool, waited });
+            }
+            counts = freed
+                .wait_timeout(counts, config.queue_timeout - waited)
+                .unwrap()
+                .0;
+        }
+        counts.waiting[pool.index()] -= 1;
+        counts.running[pool.index()] += 1;
+        Ok(Permit {
+            counts: self.counts.clone(),
+            pool,
+        })
+    }
+
+    /// [`Pools::acquire`] for async code, waiting on a blocking thread so
+    /// the runtime's workers stay free
+    pub async fn acquire_async(&self, pool: Pool) -> Result<Permit, Busy> {
+        let pools = self.clone();
+        tokio::task::spawn_blocking(move || pools.acquire(pool))
+            .await
+            .expect("waiting for a git process place panicked")
+    }
+
+    /// How long a process of `pool` may run
+    pub fn timeout(&self, pool: Pool) -> Option<Duration> {
+        self.config.get().timeout(pool)
+    }
+
+    /// Processes running and waiting in `pool`
+    pub fn load(&self, pool: Pool) -> (usize, usize) {
+        let counts = self.counts.0.lock().unwrap();
+        (counts.running[pool.index()], counts.waiting[pool.index()])
+    }
+
+    /// Run `future`, such as a web request, with the git it runs through
+    /// [`super::run`] counted in `pool`
+    pub async fn scope<F: Future>(&self, pool: Pool, future: F) -> F::Output {
+        CURRENT
+            .scope(
+                Scope {
+                    pools: self.clone(),
+                    pool,
+                    refused: Cell::new(false),
+                },
+                future,
+            )
+            .await
+    }
+}
+
+/// Holds a place in a pool until dropped
+pub struct Permit {
+    counts: Arc<(Mutex<Counts>, Condvar)>,
+    pool: Pool,
+}
+
+impl Drop for Permit {
+    fn drop(&mut self) {
+        let (lock, freed) = &*self.counts;
+        lock.lock().unwrap().running[self.pool.index()] -= 1;
+        // Waiters of every pool share the condition variable
+        freed.notify_all();
+    }
+}
+
+struct Scope {
+    pools: Pools,
+    pool: Pool,
+    refused: Cell<bool>,
+}
+
+tokio::task_local! {
+    static CURRENT: Scope;
+}
+
+/// A place for a git process in the pool of the current task, if it runs in
+/// [`Pools::scope`]
+pub(crate) fn enter() -> Result<Option<Permit>, Busy> {
+    CURRENT
+        .try_with(|scope| {
+            scope
+                .pools
+                .acquire(scope.pool)
+                .map(Some)
+                .inspect_err(|_| scope.refused.set(true))
+        })
+        .unwrap_or(Ok(None))
+}
+
+/// How long a git process of the current task may run, if it runs in
+/// [`Pools::scope`]
+pub(crate) fn timeout() -> Option<Duration> {
+    CURRENT
+        .try_with(|scope| scope.pools.timeout(scope.pool))
+        .ok()
+        .flatten()
+}
+
+/// Whether a git process of the current task was turned away, so the
+/// request failed because the server is busy
+pub fn refused() -> bool {
+    CURRENT
+        .try_with(|scope| scope.refused.get())
+        .unwrap_or(false)
+}
@@ -0,0 +1,89 @@
+//! Stopping git together with everything it started.
+//!
+//! git runs in a process group of its own, so that stopping the group also
+//! stops the `pack-objects`, hooks and helpers it spawned, which would
+//! otherwise run on without anyone to read their output. Requests stop their
+//! git when the client goes away, and when the timeout of its pool passes
+//! (see [`super::limits::Config`]).
+
+use std::io;
+use std::ops::{Deref, DerefMut};
+use tokio::io::{AsyncRead, AsyncReadExt};
+use tokio::time::Instant;
+
+/// Give `command` a process group of its own, led by the process it starts
+pub fn isolate(command: &mut std::process::Command) {
+    std::os::unix::process::CommandExt::process_group(command, 0);
+}
+
+/// Kill every process in the group `pid` leads
+pub fn kill_group(pid: u32) {
+    // SAFETY: kill only sends a signal
+    unsafe {
+        libc::kill(-(pid as libc::pid_t), libc::SIGKILL);
+    }
+}
+
+/// A git started by async code, which stops with its whole group when
+/// dropped before it has exited: when the client of a web request or SSH
+/// session hangs up, or its timeout passes
+pub struct Child(tokio::process::Child);
+
+impl Child {
+    pub fn spawn(command: &mut tokio::process::Command) -> io::Result<Self> {
+        command
+            .process_group(0)
+            .kill_on_drop(true)
+            .spawn()
+            .map(Self)
+    }
+
+    /// Stop git and everything it started, unless it has exited. Only while
+    /// git runs is its id sure to still name the group.
+    pub fn stop(&mut self) {
+        if let (Ok(None), Some(pid)) = (self.0.try_wait(), self.0.id()) {
+            tracing::debug!(pid, "Stopping a git process group");
+            kill_group(pid);
+        }
+    }
+}
+
+impl Deref for Child {
+    type Target = tokio::process::Child;
+
+    fn deref(&self) -> &Self::Target {
+        &self.0
+    }
+}
+
+impl DerefMut for Child {
+    fn deref_mut(&mut self) -> &mut Self::Target {
+        &mut self.0
+    }
+}
+
+impl Drop for Child {
+    fn drop(&mut self) {
+        self.stop();
+    }
+}
+
+/// Read from one of git's pipes, failing with `TimedOut` once `deadline`
+/// passes
+pub async fn read<R: AsyncRead + Unpin>(
+    pipe: &mut R,
+    buf: &mut [u8],
+    deadline: Option<Instant>,
+) -> io::Result<usize> {
+    match deadline {
+        Some(deadline) => tokio::time::timeout_at(deadline, pipe.read(buf))
+            .await
+            .unwrap_or_else(|_| {
+                Err(io::Error::new(
+                    io::ErrorKind::TimedOut,
+                    "git took too long and was stopped",
+                ))
+            }),
+        None => pipe.read(buf).await,
+    }
+}
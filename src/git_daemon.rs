@@ -0,0 +1,307 @@
+//! A listener for the git protocol (`git://`), for the quickest anonymous
+//! clones of public projects: no keys, no TLS and no HTTP in the way.
+//!
+//! Like `git daemon`, it only serves `git-upload-pack`, and only for
+//! repositories marked with a `git-daemon-export-ok` file. Agito also
+//! requires them to be public, since anyone can connect. Clones take the same
+//! rate limits, process pools and pack cache as those over SSH.
+
+use crate::git::limits::{Pool, Pools};
+use crate::git::process;
+use crate::ip_access::{self, Filter};
+use crate::metrics;
+use crate::orgs;
+use crate::pack_cache::PackCache;
+use crate::rate_limit::Limiter;
+use crate::redirects::Resolver;
+use crate::telemetry;
+use crate::wire;
+use anyhow::Result;
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+use std::process::Stdio;
+use std::time::Duration;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+use tokio::process::Command;
+use tracing::Instrument;
+
+/// The file that marks a repository as served, as `git daemon` knows it
+const EXPORT_OK: &str = "git-daemon-export-ok";
+
+/// How long a client may take to say what it wants
+const REQUEST_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// Seconds git may go without hearing from the client before giving up
+const IDLE_TIMEOUT_SECS: u32 = 300;
+
+/// Longest request line, as a pkt-line can be
+const MAX_REQUEST: usize = 65516;
+
+/// Whether a repository is marked to be served over `git://`
+pub fn is_exported(repo_path: &Path) -> bool {
+    repo_path.join(EXPORT_OK).is_file()
+}
+
+/// Mark a repository to be served over `git://`, or stop serving it
+pub fn set_exported(repo_path: &Path, exported: bool) -> io::Result<()> {
+    let marker = repo_path.join(EXPORT_OK);
+    if exported {
+        fs::write(marker, "")
+    } else {
+        match fs::remove_file(marker) {
+            Err(e) if e.kind() != io::ErrorKind::NotFound => Err(e),
+            _ => Ok(()),
+        }
+    }
+}
+
+/// What a client asks for in its first packet:
+/// `git-upload-pack /team/webshop.git\0host=example.com\0\0version=2\0`
+#[derive(Debug)]
+struct Request {
+    service: String,
+    path: String,
+    /// Extra parameters after the host, for GIT_PROTOCOL
+    extra: Vec<String>,
+}
+
+impl Request {
+    fn parse(payload: &[u8]) -> Option<Self> {
+        let payload = std::str::from_utf8(payload).ok()?;
+        let mut fields = payload.split('\0');
+        let (service, path) = fields.next()?.split_once(' ')?;
+        let extra = fields
+            .skip_while(|field| !field.is_empty())
+            .filter(|field| !field.is_empty())
+            .map(str::to_string)
+            .collect();
+        Some(Self {
+            service: service.to_string(),
+            path: path.to_string(),
+            extra,
+        })
+    }
+}
+
+pub struct Server {
+    repos_dir: PathBuf,
+    data_dir: PathBuf,
+    resolver: Resolver,
+    rate_limiter: Limiter,
+    git_pools: Pools,
+    pack_cache: PackCache,
+    ip_filter: Filter,
+}
+
+impl Server {
+    pub fn new(repos_dir: PathBuf, data_dir: PathBuf) -> Self {
+        Self {
+            resolver: Resolver {
+                repos_dir: repos_dir.clone(),
+                ..Default::default()
+            },
+            repos_dir,
+            data_dir,
+            rate_limiter: Limiter::default(),
+            git_pools: Pools::default(),
+            pack_cache: PackCache::default(),
+            ip_filter: Filter::default(),
+        }
+    }
+
+    /// Look up repositories with this resolver, following renames
+    pub fn with_resolver(mut self, resolver: Resolver) -> Self {
+        self.resolver = resolver;
+        self
+    }
+
+    /// Limit concurrent clones with `limiter`, shared with the other servers
+    pub fn with_rate_limiter(mut self, limiter: Limiter) -> Self {
+        self.rate_limiter = limiter;
+        self
+    }
+
+    /// Run upload-pack within these pools, shared with the other servers
+    pub fn with_git_pools(mut self, pools: Pools) -> Self {
+        self.git_pools = pools;
+        self
+    }
+
+    /// Build clones' packs through this cache
+    pub fn with_pack_cache(mut self, pack_cache: PackCache) -> Self {
+        self.pack_cache = pack_cache;
+        self
+    }
+
+    /// Close connections from addresses `filter` refuses
+    pub fn with_ip_filter(mut self, filter: Filter) -> Self {
+        self.ip_filter = filter;
+        self
+    }
+
+    /// Serve on `listener` until `shutdown` completes, then stop accepting
+    /// connections and return once the clones in flight are done
+    pub async fn start(
+        self,
+        listener: std::net::TcpListener,
+        shutdown: impl std::future::Future<Output = ()>,
+    ) -> Result<()> {
+        let listener = tokio::net::TcpListener::from_std(listener)?;
+        tracing::info!("git daemon listening on {}", listener.local_addr()?);
+        let server = std::sync::Arc::new(self);
+        let mut sessions = tokio::task::JoinSet::new();
+        tokio::pin!(shutdown);
+        loop {
+            let (stream, addr) = tokio::select! {
+                accepted = listener.accept() => accepted?,
+                () = &mut shutdown => break,
+                Some(_) = sessions.join_next(), if !sessions.is_empty() => continue,
+            };
+            if !server
+                .ip_filter
+                .permits(ip_access::Listener::Git, addr.ip())
+            {
+                continue;
+            }
+            let span = tracing::info_span!(
+                "git_daemon",
+                component = "git",
+                session = %telemetry::new_id(),
+                peer = %addr,
+                repo = tracing::field::Empty,
+            );
+            let server = server.clone();
+            sessions.spawn(
+                async move {
+                    if let Err(e) = server.serve(stream, addr.ip().to_string()).await {
+                        tracing::debug!("git daemon connection failed: {}", e);
+                    }
+                }
+                .instrument(span),
+            );
+        }
+
+        drop(listener);
+        if !sessions.is_empty() {
+            tracing::info!("Waiting for {} git:// clones to finish", sessions.len());
+        }
+        while sessions.join_next().await.is_some() {}
+        Ok(())
+    }
+
+    async fn serve(&self, mut stream: TcpStream, peer: String) -> Result<()> {
+        let payload = match tokio::time::timeout(REQUEST_TIMEOUT, read_pkt_line(&mut stream)).await
+        {
+            Ok(payload) => payload?,
+            Err(_) => return Ok(()),
+        };
+        let request = match Request::parse(&payload) {
+            Some(request) => request,
+            None => return refuse(&mut stream, "invalid request").await,
+        };
+        if request.service != "git-upload-pack" {
+            return refuse(&mut stream, "service not enabled").await;
+        }
+
+        // Repositories that aren't served look the same as missing ones
+        let not_found = format!("access denied or repository not exported: {}", request.path);
+        let name = match self.resolver.resolve(&request.path) {
+            Some(name) => name,
+            None => return refuse(&mut stream, &not_found).await,
+        };
+        let repo_path = self.repos_dir.join(&name);
+        if !is_exported(&repo_path) || !orgs::is_public(&self.data_dir, &self.repos_dir, &name) {
+            return refuse(&mut stream, &not_found).await;
+        }
+        tracing::Span::current().record("repo", name.as_str());
+
+        let _clone = match self.rate_limiter.clone_started(&peer, None) {
+            Ok(guard) => guard,
+            Err(msg) => return refuse(&mut stream, &msg).await,
+        };
+        let _permit = match self.git_pools.acquire_async(Pool::Upload).await {
+            Ok(permit) => permit,
+            Err(busy) => return refuse(&mut stream, &busy.to_string()).await,
+        };
+
+        let start = std::time::Instant::now();
+        let git_protocol = Some(request.extra.join(":")).filter(|extra| !extra.is_empty());
+        let version = wire::record("git", git_protocol.as_deref());
+        let mut child = process::Child::spawn(
+            Command::new("git-upload-pack")
+                .arg("--strict")
+                .arg(format!("--timeout={}", IDLE_TIMEOUT_SECS))
+                .arg(&repo_path)
+                .envs(wire::env(git_protocol.as_deref(), Some(&self.pack_cache)))
+                .stdin(Stdio::piped())
+                .stdout(Stdio::piped())
+                .stderr(Stdio::null()),
+        )?;
+        let mut stdin = child.stdin.take().unwrap();
+        let mut stdout = child.stdout.take().unwrap();
+        let (mut reader, mut writer) = stream.split();
+
+        // The client hangs up once it has its pack, which ends git's input
+        let to_git = async {
+            let _ = tokio::io::copy(&mut reader, &mut stdin).await;
+            drop(stdin);
+        };
+        let from_git = async {
+            let sent = tokio::io::copy(&mut stdout, &mut writer).await;
+            let _ = writer.shutdown().await;
+            sent.unwrap_or(0)
+        };
+        // Beyond the idle timeout, the whole transfer has the pool's
+        let transfer = async { tokio::join!(to_git, from_git).1 };
+        let sent = match self.git_pools.timeout(Pool::Upload) {
+            Some(timeout) => match tokio::time::timeout(timeout, transfer).await {
+                Ok(sent) => sent,
+                Err(_) => {
+                    tracing::warn!("git-upload-pack took too long and was stopped");
+                    child.stop();
+                    0
+                }
+            },
+            None => transfer.await,
+        };
+        let status = child.wait().await?;
+        metrics::global().git_subprocess("git-upload-pack", start.elapsed());
+        tracing::info!(
+            bytes = sent,
+            elapsed_ms = start.elapsed().as_millis() as u64,
+            exit_code = status.code().unwrap_or(-1),
+            protocol = version.name(),
+            "git-upload-pack finished"
+        );
+        Ok(())
+    }
+}
+
+/// Read one pkt-line and return what it carries
+async fn read_pkt_line(stream: &mut TcpStream) -> io::Result<Vec<u8>> {
+    let mut length = [0u8; 4];
+    stream.read_exact(&mut length).await?;
+    let length = std::str::from_utf8(&length)
+        .ok()
+        .and_then(|length| usize::from_str_radix(length, 16).ok())
+        .filter(|length| (4..=MAX_REQUEST + 4).contains(length))
+        .ok_or_else(|| io::Error::new(io::ErrorKind::InvalidData, "invalid pkt-line length"))?;
+    let mut payload = vec![0u8; length - 4];
+    stream.read_exact(&mut payload).await?;
+    if payload.last() == Some(&b'\n') {
+        payload.pop();
+    }
+    Ok(payload)
+}
+
+/// Tell the client why it gets nothing, the way `git daemon` does, which git
+/// shows as "remote error: ..."
+async fn refuse(stream: &mut TcpStream, message: &str) -> Result<()> {
+    tracing::debug!("Refused: {}", message);
+    let line = format!("ERR {}", message);
+    let packet = format!("{:04x}{}", line.len() + 4, line);
+    stream.write_all(packet.as_bytes()).await?;
+    Ok(())
+}
@@ -0,0 +1,284 @@
+//! Server-side git hooks.
+//!
+//! Each hook in a repository is a small dispatcher that runs the executables
+//! in `hooks/<hook>.d/` in name order. `00-agito` in there is rendered from a
+//! template, built in or from `--hook-templates`; anything else is the
+//! repository's own and is left alone when templates are re-applied.
+
+use anyhow::{Context, Result};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+/// Hooks git runs on the server side of a push
+pub const HOOKS: &[&str] = &["pre-receive", "update", "post-receive", "post-update"];
+
+/// File in `<hook>.d/` rendered from the template
+const MANAGED: &str = "00-agito";
+
+/// First line of every dispatcher, to recognize hooks agito may overwrite
+const MARKER: &str = "# Managed by agito";
+
+/// Where hook templates come from, and what their variables expand to
+#[derive(Clone, Debug, Default)]
+pub struct Templates {
+    /// Directory of templates named after the hook (e.g. `pre-receive`);
+    /// hooks without one there use the built-in template
+    pub dir: Option<PathBuf>,
+    /// Repositories directory, to name repositories in `{{repo}}`
+    pub repos_dir: PathBuf,
+    /// URL of the web interface, for `{{public_url}}`
+    pub public_url: String,
+}
+
+impl Templates {
+    /// Template for a hook, or None if the hook has neither a template file
+    /// nor a built-in one
+    fn template(&self, hook: &str) -> Result<Option<String>> {
+        if let Some(dir) = &self.dir {
+            let path = dir.join(hook);
+            if path.exists() {
+                return fs::read_to_string(&path)
+                    .map(Some)
+                    .with_context(|| format!("Failed to read {}", path.display()));
+            }
+        }
+        Ok(builtin(hook).map(str::to_string))
+    }
+
+    /// Expand `{{repo}}`, `{{repo_path}}` and `{{public_url}}`
+    fn render(&self, hook: &str, template: &str, repo_path: &Path) -> Result<String> {
+        let repo = repo_path
+            .strip_prefix(&self.repos_dir)
+            .ok()
+            .filter(|_| !self.repos_dir.as_os_str().is_empty())
+            .unwrap_or_else(|| Path::new(repo_path.file_name().unwrap_or_default()))
+            .to_string_lossy()
+            .to_string();
+
+        let mut out = String::with_capacity(template.len());
+        let mut rest = template;
+        while let Some(start) = rest.find("{{") {
+            out.push_str(&rest[..start]);
+            let end = rest[start..]
+                .find("}}")
+                .with_context(|| format!("Unclosed {{{{ in the {} template", hook))?;
+            let value = match rest[start + 2..start + end].trim() {
+                "repo" => repo.clone(),
+                "repo_path" => repo_path.display().to_string(),
+                "public_url" => self.public_url.clone(),
+                name => anyhow::bail!(
+                    "Unknown variable {{{{{}}}}} in the {} template (expected repo, repo_path or public_url)",
+                    name,
+                    hook
+                ),
+            };
+            out.push_str(&value);
+            rest = &rest[start + end + 2..];
+        }
+        out.push_str(rest);
+        Ok(out)
+    }
+
+    /// Write the dispatchers and rendered templates into a repository. A hook
+    /// that agito did not write is kept, moved into `<hook>.d/50-local`.
+    pub fn install(&self, repo_path: &Path) -> Result<()> {
+        let hooks_dir = repo_path.join("hooks");
+        for hook in HOOKS {
+            let chain = hooks_dir.join(format!("{}.d", hook));
+            fs::create_dir_all(&chain)?;
+
+            let dispatcher = hooks_dir.join(hook);
+            if let Ok(existing) = fs::read_to_string(&dispatcher) {
+                if !existing.contains(MARKER) && !is_legacy(&existing) {
+                    fs::rename(&dispatcher, chain.join("50-local"))?;
+                }
+            }
+            write_executable(&dispatcher, &dispatcher_script(hook))?;
+
+            let managed = chain.join(MANAGED);
+            match self.template(hook)? {
+                Some(template) => {
+                    write_executable(&managed, &self.render(hook, &template, repo_path)?)?
+                }
+                None if managed.exists() => fs::remove_file(&managed)?,
+                None => {}
+            }
+        }
+        Ok(())
+    }
+
+    /// What is wrong with a repository's hooks: dispatchers agito did not
+    /// write, and templates missing or rendered differently. Empty if they
+    /// are as `install` would leave them.
+    pub fn check(&self, repo_path: &Path) -> Result<Vec<String>> {
+        let hooks_dir = repo_path.join("hooks");
+        let mut problems = Vec::new();
+        for hook in HOOKS {
+            let dispatcher = fs::read_to_string(hooks_dir.join(hook)).unwrap_or_default();
+            if !dispatcher.contains(MARKER) {
+                problems.push(format!("{} is not installed", hook));
+                continue;
+            }
+            let managed = fs::read_to_string(hooks_dir.join(format!("{}.d", hook)).join(MANAGED));
+            match (self.template(hook)?, managed) {
+                (Some(_), Err(_)) => problems.push(format!("{} template is missing", hook)),
+                (Some(template), Ok(managed)) => {
+                    if managed != self.render(hook, &template, repo_path)? {
+                        problems.push(format!("{} template is out of date", hook));
+                    }
+                }
+                (None, _) => {}
+            }
+        }
+        Ok(problems)
+    }
+
+    /// Re-apply the templates to every repository below `repos_dir`,
+    /// returning the number updated and the ones that failed
+    pub fn sync(&self, repos_dir: &Path) -> Result<(usize, Vec<(String, anyhow::Error)>)> {
+        let mut updated = 0;
+        let mut failures = Vec::new();
+        for (name, path) in crate::git::find_repositories(repos_dir)? {
+            match self.install(&path) {
+                Ok(()) => updated += 1,
+                Err(e) => failures.push((name, e)),
+            }
+        }
+        Ok((updated, failures))
+    }
+}
+
+/// Hooks written by agito before hook chains existed, which are replaced
+fn is_legacy(content: &str) -> bool {
+    content.lines().nth(1).map_or(false, |line| {
+        line.starts_with("# Agito ") && line.ends_with(" hook")
+    })
+}
+
+fn write_executable(path: &Path, content: &str) -> Result<()> {
+    fs::write(path, content).with_context(|| format!("Failed to write {}", path.display()))?;
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        fs::set_permissions(path, fs::Permissions::from_mode(0o755))?;
+    }
+    Ok(())
+}
+
+/// Shell script running a hook's chain. Every script gets the hook's
+/// arguments and standard input. A failure rejects the push in hooks that
+/// can, and is reported after the rest of the chain in the others.
+fn dispatcher_script(hook: &str) -> String {
+    let on_failure = match hook {
+        "pre-receive" | "update" => "exit $?",
+        _ => "status=$?",
+    };
+    format!(
+        r#"#!/bin/sh
+{MARKER}; re-applied by `agito-server hooks sync`.
+# Runs every executable in {hook}.d/ in name order.
+input=$(mktemp) || exit 1
+trap 'rm -f "$input"' EXIT
+cat > "$input"
+status=0
+for script in "$0.d"/*; do
+    [ -f "$script" ] && [ -x "$script" ] || continue
+    "$script" "$@" < "$input" || {on_failure}
+done
+exit $status
+"#
+    )
+}
+
+fn builtin(hook: &str) -> Option<&'static str> {
+    match hook {
+        "pre-receive" => Some(PRE_RECEIVE),
+        "update" => Some(UPDATE),
+        "post-receive" => Some(POST_RECEIVE),
+        _ => None,
+    }
+}
+
+const POST_RECEIVE: &str = r#"#!/bin/sh
+# Agito post-receive hook
+# This hook is called after a push is completed
+
+echo "Running post-receive hook..."
+
+refs=$(cat)
+
+# Record the updates in the event stream behind ref feeds and watches, and
+# queue CI builds of pushed branches for the server's runners
+if command -v agito-admin >/dev/null 2>&1; then
+    printf '%s\n' "$refs" | agito-admin events record "$GIT_DIR"
+    printf '%s\n' "$refs" | agito-admin ci enqueue "$GIT_DIR"
+fi
+
+# Read the pushed refs
+printf '%s\n' "$refs" | while read oldrev newrev refname; do
+    echo "Processing: $refname"
+    echo "  Old: $oldrev"
+    echo "  New: $newrev"
+done
+
+echo "Post-receive hook completed."
+"#;
+
+const PRE_RECEIVE: &str = r#"#!/bin/sh
+# Agito pre-receive hook
+# This hook is called before a push is accepted
+
+echo "Running pre-receive hook..."
+
+refs=$(cat)
+
+# Read the refs being pushed
+printf '%s\n' "$refs" | while read oldrev newrev refname; do
+    echo "Validating: $refname"
+
+    # Add custom validation logic here
+    # Return non-zero to reject the push
+done
+
+# The checks below need agito-admin; without it the push is refused rather
+# than let through unchecked
+if ! command -v agito-admin >/dev/null 2>&1; then
+    echo "error: agito-admin is not on the server's PATH; cannot check policies" >&2
+    exit 1
+fi
+
+# Apply the built-in policies enabled for this repository
+printf '%s\n' "$refs" | agito-admin policy check "$GIT_DIR" || exit 1
+
+# Enforce repository and user quotas on pushes through agito-server
+if [ -n "$AGITO_REPOS_DIR" ]; then
+    agito-admin quota check "$GIT_DIR" || exit 1
+fi
+
+echo "Pre-receive validation passed."
+exit 0
+"#;
+
+const UPDATE: &str = r#"#!/bin/sh
+# Agito update hook
+# This hook is called for each ref being updated
+
+refname="$1"
+oldrev="$2"
+newrev="$3"
+
+echo "Update hook: $refname"
+
+# Enforce the repository's protected branches, refusing the update if they
+# can't be checked
+if ! command -v agito-admin >/dev/null 2>&1; then
+    echo "error: agito-admin is not on the server's PATH; cannot check protected branches" >&2
+    exit 1
+fi
+agito-admin protect check "$GIT_DIR" "$refname" "$oldrev" "$newrev" || exit 1
+
+# Add custom update checks here
+# Return non-zero to reject the update
+
+exit 0
+"#;
@@ -0,0 +1,202 @@
+//! The SSH server's host keys, as clients see them.
+//!
+//! The first time ssh connects to a server it shows the host key's
+//! fingerprint and asks whether to trust it, which few people can answer
+//! without something to compare it to. The web server publishes the
+//! fingerprints at `/host-keys` and `GET /api/v1/host-keys`, and
+//! `agito trust` (see [`crate::trust`]) fetches the keys over SSH, checks
+//! them against that list and adds them to `~/.ssh/known_hosts`, so the
+//! first clone doesn't ask.
+//!
+//! The server serves a key of each type, so that old clients and new ones
+//! both find one they prefer: the key `--ssh-key` names, RSA unless it was
+//! put there by hand, and next to it one for each other type, such as
+//! `host_key_ed25519` (see [`files`]). Missing ones are generated when the
+//! SSH server starts.
+
+use anyhow::{Context, Result};
+use russh_keys::PublicKeyBase64;
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+
+/// Types of host key the server serves
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum KeyType {
+    Ed25519,
+    Ecdsa,
+    Rsa,
+}
+
+impl KeyType {
+    pub const ALL: [Self; 3] = [Self::Ed25519, Self::Ecdsa, Self::Rsa];
+
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::Ed25519 => "ed25519",
+            Self::Ecdsa => "ecdsa",
+            Self::Rsa => "rsa",
+        }
+    }
+
+    /// The type of a key with this algorithm, as `.pub` files name it
+    pub fn of(algorithm: &str) -> Option<Self> {
+        match algorithm {
+            "ssh-ed25519" => Some(Self::Ed25519),
+            "ssh-rsa" | "rsa-sha2-256" | "rsa-sha2-512" => Some(Self::Rsa),
+            _ if algorithm.starts_with("ecdsa-sha2-") => Some(Self::Ecdsa),
+            _ => None,
+        }
+    }
+
+    /// ssh-keygen's arguments for a new key of the type
+    fn keygen_args(self) -> &'static [&'static str] {
+        match self {
+            Self::Ed25519 => &["-t", "ed25519"],
+            Self::Ecdsa => &["-t", "ecdsa", "-b", "256"],
+            Self::Rsa => &["-t", "rsa", "-b", "4096"],
+        }
+    }
+}
+
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct HostKey {
+    /// e.g. `ssh-ed25519`
+    pub algorithm: String,
+    /// `SHA256:<base64>`, as ssh shows it
+    pub fingerprint: String,
+    /// The key in base64, as in known_hosts
+    pub public_key: String,
+}
+
+impl HostKey {
+    /// A key given as `<algorithm> <base64> [comment]`, as in `.pub` files
+    /// and after the host names in known_hosts
+    pub fn parse(line: &str) -> Option<Self> {
+        let mut fields = line.split_whitespace();
+        let (algorithm, data) = (fields.next()?, fields.next()?);
+        let key = russh_keys::parse_public_key_base64(data).ok()?;
+        Some(Self {
+            algorithm: algorithm.to_string(),
+            fingerprint: format!("SHA256:{}", key.fingerprint()),
+            public_key: data.to_string(),
+        })
+    }
+
+    /// The known_hosts line trusting the key for `host` on `port`
+    pub fn known_hosts_line(&self, host: &str, port: &str) -> String {
+        format!(
+            "{} {} {}",
+            known_hosts_name(host, port),
+            self.algorithm,
+            self.public_key
+        )
+    }
+}
+
+/// How known_hosts names `host`: bare on port 22, else `[host]:port`
+pub fn known_hosts_name(host: &str, port: &str) -> String {
+    match port {
+        "22" => host.to_string(),
+        port => format!("[{}]:{}", host, port),
+    }
+}
+
+/// The public half of the host key at `path`: from the `.pub` file next to
+/// it, which ssh-keygen writes, or else worked out from the key itself
+pub fn read(path: &Path) -> Result<HostKey> {
+    let mut public_path = path.as_os_str().to_owned();
+    public_path.push(".pub");
+    if let Ok(line) = fs::read_to_string(&public_path) {
+        if let Some(key) = HostKey::parse(&line) {
+            return Ok(key);
+        }
+    }
+
+    let data = fs::read_to_string(path)
+        .with_context(|| format!("Failed to read host key {}", path.display()))?;
+    let key = russh_keys::decode_secret_key(&data, None)
+        .with_context(|| format!("Failed to parse host key {}", path.display()))?;
+    let public = key
+        .clone_public_key()
+        .context("Failed to get the host key's public key")?;
+    Ok(HostKey {
+        algorithm: public.name().to_string(),
+        fingerprint: format!("SHA256:{}", public.fingerprint()),
+        public_key: public.public_key_base64(),
+    })
+}
+
+/// `<path>_<type>`, where the key of a type goes next to the one `--ssh-key`
+/// names
+pub fn typed_path(path: &Path, key_type: KeyType) -> PathBuf {
+    let mut name = path.as_os_str().to_owned();
+    name.push(format!("_{}", key_type.name()));
+    PathBuf::from(name)
+}
+
+/// The files of the server's host keys, given the one `--ssh-key` names,
+/// with the type each is generated as: that key, which is RSA until it
+/// exists, then one of each other type next to it
+pub fn files(path: &Path) -> Vec<(PathBuf, KeyType)> {
+    let first = match read(path) {
+        Ok(key) => KeyType::of(&key.algorithm),
+        Err(_) => Some(KeyType::Rsa),
+    };
+    let mut files = vec![(path.to_path_buf(), first.unwrap_or(KeyType::Rsa))];
+    files.extend(
+        KeyType::ALL
+            .into_iter()
+            .filter(|key_type| Some(*key_type) != first)
+            .map(|key_type| (typed_path(path, key_type), key_type)),
+    );
+    files
+}
+
+/// The paths of [`files`]
+pub fn paths(path: &Path) -> Vec<PathBuf> {
+    files(path).into_iter().map(|(path, _)| path).collect()
+}
+
+/// Generate a host key of `key_type` at `path`, and its `.pub` file
+pub fn generate(path: &Path, key_type: KeyType) -> Result<()> {
+    tracing::info!(
+        "Generating new {} SSH host key at {:?}",
+        key_type.name(),
+        path
+    );
+    if let Some(dir) = path.parent() {
+        fs::create_dir_all(dir)?;
+    }
+    let output = Command::new("ssh-keygen")
+        .args(key_type.keygen_args())
+        .arg("-f")
+        .arg(path)
+        .args(["-N", "", "-q"])
+        .output()
+        .context("Failed to generate host key")?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "Failed to generate {} host key: {}",
+            key_type.name(),
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(())
+}
+
+/// The host keys at `paths` that can be read; the SSH server generates them
+/// on its first start, so they may not be there yet
+pub fn read_all(paths: &[impl AsRef<Path>]) -> Vec<HostKey> {
+    paths
+        .iter()
+        .filter_map(|path| match read(path.as_ref()) {
+            Ok(key) => Some(key),
+            Err(e) => {
+                tracing::debug!("{:#}", e);
+                None
+            }
+        })
+        .collect()
+}
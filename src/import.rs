@@ -0,0 +1,267 @@
+//! Importing repositories from other servers.
+//!
+//! An import is a `git clone --mirror` done in steps, so that very large
+//! upstreams survive interruptions: the repository is built up in
+//! `<name>.partial` one branch at a time, and running the import again picks
+//! up after the last branch that was fetched completely. Only once everything
+//! is there is it moved into place and given agito's hooks.
+
+use crate::hooks::Templates;
+use crate::mirror;
+use anyhow::{Context, Result};
+use std::fs::{self, OpenOptions};
+use std::io::Read;
+use std::path::{Path, PathBuf};
+use std::process::{Command, Stdio};
+
+/// Remote the upstream is fetched through while importing
+const REMOTE: &str = "origin";
+
+/// Transports users may import over SSH; local paths and `file://` would let
+/// them copy any repository the server can read
+const REMOTE_PROTOCOLS: &str = "http:https:git";
+
+/// An upstream repository to import
+#[derive(Clone, Debug)]
+pub struct Import {
+    pub repos_dir: PathBuf,
+    /// Name of the new repository relative to `repos_dir`, with the .git suffix
+    pub name: String,
+    pub url: String,
+    /// Only allow network transports, for imports requested by users
+    pub remote_only: bool,
+}
+
+/// Removes the lock that keeps two imports of one repository apart
+struct Lock(PathBuf);
+
+impl Drop for Lock {
+    fn drop(&mut self) {
+        let _ = fs::remove_file(&self.0);
+    }
+}
+
+impl Import {
+    /// Clone the upstream, install hooks from `templates` and return the path
+    /// of the new repository. Progress from git and between steps is passed
+    /// to `progress` as it arrives.
+    pub fn run(&self, templates: &Templates, progress: &mut dyn FnMut(&[u8])) -> Result<PathBuf> {
+        if self.url.starts_with('-') {
+            anyhow::bail!("Invalid URL '{}'", self.url);
+        }
+        let target = self.repos_dir.join(&self.name);
+        if target.exists() {
+            anyhow::bail!("Repository already exists: {}", self.name);
+        }
+        let partial = self.repos_dir.join(format!("{}.partial", self.name));
+        let lock_path = self.repos_dir.join(format!("{}.import.lock", self.name));
+        if let Some(parent) = partial.parent() {
+            fs::create_dir_all(parent)?;
+        }
+        let _lock = match OpenOptions::new()
+            .write(true)
+            .create_new(true)
+            .open(&lock_path)
+        {
+            Ok(_) => Lock(lock_path),
+            Err(e) if e.kind() == std::io::ErrorKind::AlreadyExists => {
+                anyhow::bail!("{} is already being imported", self.name)
+            }
+            Err(e) => return Err(e).context("Failed to lock the import"),
+        };
+
+        let resuming = crate::git::is_repository(&partial);
+        if resuming {
+            let url = crate::git::config_get(&partial, &format!("remote.{}.url", REMOTE));
+            if url.as_deref() != Some(self.url.as_str()) {
+                anyhow::bail!(
+                    "An import of {} from another URL was interrupted; remove {} to start over",
+                    self.name,
+                    partial.display()
+                );
+            }
+            progress(format!("Resuming the import of {}\n", self.name).as_bytes());
+        } else {
+            self.start(&partial)?;
+        }
+
+        // Branches first, one at a time, so an interruption loses at most one
+        let branches = match self.remote_branches(&partial) {
+            Ok(branches) => branches,
+            Err(e) => {
+                // Nothing to resume if the upstream could not even be reached
+                if !resuming {
+                    let _ = fs::remove_dir_all(&partial);
+                }
+                return Err(e);
+            }
+        };
+        for (i, (branch, oid)) in branches.iter().enumerate() {
+            let local = crate::git::run(&partial, &["rev-parse", "--verify", "--quiet", branch])
+                .map(|output| String::from_utf8_lossy(&output.stdout).trim() == oid)
+                .unwrap_or(false);
+            if local {
+                continue;
+            }
+            progress(
+                format!(
+                    "Fetching branch {} of {}: {}\n",
+                    i + 1,
+                    branches.len(),
+                    branch.trim_start_matches("refs/heads/")
+                )
+                .as_bytes(),
+            );
+            self.git(
+                &partial,
+                &[
+                    "fetch",
+                    "--progress",
+                    "--no-tags",
+                    REMOTE,
+                    &format!("+{}:{}", branch, branch),
+                ],
+                progress,
+            )?;
+        }
+
+        // Then everything else: tags, notes and refs removed meanwhile
+        progress(b"Fetching remaining refs\n");
+        self.git(
+            &partial,
+            &["fetch", "--progress", "--prune", REMOTE],
+            progress,
+        )?;
+        self.set_head(&partial);
+
+        // The URL may hold credentials, and the upstream is not a mirror
+        crate::git::run(
+            &partial,
+            &["config", "--remove-section", &format!("remote.{}", REMOTE)],
+        )?;
+        fs::rename(&partial, &target)
+            .with_context(|| format!("Failed to move the import into {}", target.display()))?;
+        templates.install(&target)?;
+        Ok(target)
+    }
+
+    /// Create the partial repository, set up like `git clone --mirror` would
+    fn start(&self, partial: &Path) -> Result<()> {
+        if partial.exists() {
+            fs::remove_dir_all(partial)?;
+        }
+        fs::create_dir_all(partial)?;
+        let output = Command::new("git")
+            .arg("init")
+            .arg("--bare")
+            .arg("--quiet")
+            .arg(partial)
+            .output()
+            .context("Failed to init repository")?;
+        if !output.status.success() {
+            anyhow::bail!(
+                "Failed to init repository: {}",
+                String::from_utf8_lossy(&output.stderr).trim()
+            );
+        }
+        let output = crate::git::run(
+            partial,
+            &["remote", "add", "--mirror=fetch", REMOTE, &self.url],
+        )?;
+        if !output.status.success() {
+            anyhow::bail!(
+                "Failed to add the upstream: {}",
+                String::from_utf8_lossy(&output.stderr).trim()
+            );
+        }
+        Ok(())
+    }
+
+    /// Environment keeping git from prompting, and from leaving the network
+    /// for user imports
+    fn env(&self) -> Vec<(&'static str, &'static str)> {
+        let mut env = vec![("GIT_TERMINAL_PROMPT", "0")];
+        if self.remote_only {
+            env.push(("GIT_ALLOW_PROTOCOL", REMOTE_PROTOCOLS));
+        }
+        env
+    }
+
+    /// Branches of the upstream and the commits they point to
+    fn remote_branches(&self, partial: &Path) -> Result<Vec<(String, String)>> {
+        let output =
+            crate::git::run_with_env(partial, &["ls-remote", "--heads", REMOTE], &self.env())?;
+        if !output.status.success() {
+            anyhow::bail!(
+                "Failed to list the branches of {}: {}",
+                mirror::redact(&self.url),
+                self.redact(String::from_utf8_lossy(&output.stderr).trim())
+            );
+        }
+        Ok(String::from_utf8_lossy(&output.stdout)
+            .lines()
+            .filter_map(|line| {
+                let (oid, name) = line.split_once('\t')?;
+                Some((name.to_string(), oid.to_string()))
+            })
+            .collect())
+    }
+
+    /// Point HEAD at the upstream's default branch, as a clone would
+    fn set_head(&self, partial: &Path) {
+        let head = crate::git::run_with_env(
+            partial,
+            &["ls-remote", "--symref", REMOTE, "HEAD"],
+            &self.env(),
+        )
+        .ok()
+        .and_then(|output| {
+            String::from_utf8_lossy(&output.stdout)
+                .lines()
+                .find_map(|line| {
+                    let (target, _) = line.strip_prefix("ref: ")?.split_once('\t')?;
+                    Some(target.to_string())
+                })
+        });
+        if let Some(head) = head {
+            let _ = crate::git::run(partial, &["symbolic-ref", "HEAD", &head]);
+        }
+    }
+
+    /// Run git in the partial repository, passing its progress on
+    fn git(&self, partial: &Path, args: &[&str], progress: &mut dyn FnMut(&[u8])) -> Result<()> {
+        let mut child = Command::new("git")
+            .arg("-C")
+            .arg(partial)
+            .args(args)
+            .envs(self.env())
+            .stdin(Stdio::null())
+            .stdout(Stdio::null())
+            .stderr(Stdio::piped())
+            .spawn()
+            .context("Failed to run git")?;
+
+        let mut stderr = child.stderr.take().unwrap();
+        let mut buf = [0u8; 8192];
+        loop {
+            match stderr.read(&mut buf) {
+                Ok(0) | Err(_) => break,
+                Ok(n) => progress(self.redact(&String::from_utf8_lossy(&buf[..n])).as_bytes()),
+            }
+        }
+
+        if !child.wait()?.success() {
+            anyhow::bail!(
+                "git {} from {} failed; run the import again to resume it",
+                args[0],
+                mirror::redact(&self.url)
+            );
+        }
+        Ok(())
+    }
+
+    /// Git output with any credentials in the upstream URL removed
+    fn redact(&self, output: &str) -> String {
+        output.replace(&self.url, &mirror::redact(&self.url))
+    }
+}
@@ -0,0 +1,172 @@
+//! Allowing and denying client addresses, for servers that must only be
+//! reached from a VPN or an office network and have no firewall in front
+//! to see to it.
+//!
+//! Rules are CIDR ranges, such as `10.0.0.0/8` or `2001:db8::/32`, or single
+//! addresses. A client is turned away if its address is in a denied range,
+//! or if there are allowed ranges and it is in none of them. Global rules
+//! apply to every listener, and each listener can add its own: a client must
+//! pass both. SSH and `git://` clients are checked as they connect, SSH
+//! before the handshake; web clients on every request.
+
+use crate::config::Shared;
+use std::fmt;
+use std::net::IpAddr;
+use std::str::FromStr;
+
+/// A range of addresses: a network address and the length of its prefix
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub struct Cidr {
+    network: IpAddr,
+    prefix: u8,
+}
+
+impl Cidr {
+    pub fn contains(&self, ip: IpAddr) -> bool {
+        // IPv4 clients of a dual-stack socket show up as ::ffff:a.b.c.d
+        match (self.network, ip.to_canonical()) {
+            (IpAddr::V4(network), IpAddr::V4(ip)) => {
+                mask_eq(&network.octets(), &ip.octets(), self.prefix)
+            }
+            (IpAddr::V6(network), IpAddr::V6(ip)) => {
+                mask_eq(&network.octets(), &ip.octets(), self.prefix)
+            }
+            _ => false,
+        }
+    }
+}
+
+/// Whether the first `prefix` bits of `a` and `b` are the same
+fn mask_eq(a: &[u8], b: &[u8], prefix: u8) -> bool {
+    let (bytes, bits) = ((prefix / 8) as usize, prefix % 8);
+    if a[..bytes] != b[..bytes] {
+        return false;
+    }
+    bits == 0 || (a[bytes] ^ b[bytes]) >> (8 - bits) == 0
+}
+
+impl FromStr for Cidr {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let invalid = || format!("Invalid address or CIDR range '{}'", s);
+        let (addr, prefix) = match s.trim().split_once('/') {
+            Some((addr, prefix)) => (addr, Some(prefix)),
+            None => (s.trim(), None),
+        };
+        let network = addr
+            .parse::<IpAddr>()
+            .map_err(|_| invalid())?
+            .to_canonical();
+        let bits = if network.is_ipv4() { 32 } else { 128 };
+        let prefix = match prefix {
+            Some(prefix) => prefix.parse::<u8>().map_err(|_| invalid())?,
+            None => bits,
+        };
+        if prefix > bits {
+            return Err(invalid());
+        }
+        Ok(Self { network, prefix })
+    }
+}
+
+impl fmt::Display for Cidr {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}/{}", self.network, self.prefix)
+    }
+}
+
+/// Allowed and denied ranges; no rules let everyone in
+#[derive(Clone, Debug, Default)]
+pub struct Rules {
+    pub allow: Vec<Cidr>,
+    pub deny: Vec<Cidr>,
+}
+
+impl Rules {
+    pub fn permits(&self, ip: IpAddr) -> bool {
+        if self.deny.iter().any(|cidr| cidr.contains(ip)) {
+            return false;
+        }
+        self.allow.is_empty() || self.allow.iter().any(|cidr| cidr.contains(ip))
+    }
+
+    fn is_empty(&self) -> bool {
+        self.allow.is_empty() && self.deny.is_empty()
+    }
+}
+
+/// Where a client connects
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum Listener {
+    Ssh,
+    Http,
+    /// The `git://` daemon
+    Git,
+}
+
+impl Listener {
+    pub fn name(&self) -> &'static str {
+        match self {
+            Listener::Ssh => "ssh",
+            Listener::Http => "http",
+            Listener::Git => "git",
+        }
+    }
+}
+
+/// The rules of every listener
+#[derive(Clone, Debug, Default)]
+pub struct Config {
+    pub global: Rules,
+    pub ssh: Rules,
+    pub http: Rules,
+    pub git: Rules,
+}
+
+impl Config {
+    fn rules(&self, listener: Listener) -> &Rules {
+        match listener {
+            Listener::Ssh => &self.ssh,
+            Listener::Http => &self.http,
+            Listener::Git => &self.git,
+        }
+    }
+}
+
+/// Checks clients against the rules. Clones share them, so a reload reaches
+/// every listener.
+#[derive(Clone, Default)]
+pub struct Filter {
+    config: Shared<Config>,
+}
+
+impl Filter {
+    pub fn new(config: Config) -> Self {
+        Self {
+            config: Shared::new(config),
+        }
+    }
+
+    /// Apply new rules; they hold for the next connection or request
+    pub fn reconfigure(&self, config: Config) {
+        self.config.set(config);
+    }
+
+    /// Whether a client at `ip` may use `listener`
+    pub fn permits(&self, listener: Listener, ip: IpAddr) -> bool {
+        let config = self.config.get();
+        let permitted = config.global.permits(ip) && config.rules(listener).permits(ip);
+        if !permitted {
+            tracing::debug!(listener = listener.name(), %ip, "Client address refused");
+        }
+        permitted
+    }
+
+    /// Whether any rules apply to `listener`, so that clients whose address
+    /// is unknown must be turned away
+    pub fn restricts(&self, listener: Listener) -> bool {
+        let config = self.config.get();
+        !config.global.is_empty() || !config.rules(listener).is_empty()
+    }
+}
@@ -0,0 +1,450 @@
+//! Issues: a lightweight tracker next to each repository.
+//!
+//! Every issue is a JSON file, `<repo>/agito/issues/<number>.json`, holding
+//! its title, Markdown body, labels, milestone, state and comments. Numbers
+//! count up from 1 per repository and are never reused. Changes are sent to
+//! issues webhooks, and new issues to subscribers.
+//!
+//! Labels need no setup, but may be given a color and description in
+//! `agito/labels.json`. Milestones are kept in `agito/milestones.json`, and
+//! issues name theirs by title.
+
+use crate::git;
+use crate::subscriptions::{self, Kind};
+use crate::webhooks::{self, Event};
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use serde_json::json;
+use std::collections::{BTreeMap, BTreeSet};
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+
+/// Longest title accepted
+const MAX_TITLE: usize = 256;
+
+/// Longest label accepted
+const MAX_LABEL: usize = 50;
+
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum State {
+    #[default]
+    Open,
+    Closed,
+}
+
+impl FromStr for State {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "open" => Ok(Self::Open),
+            "closed" => Ok(Self::Closed),
+            _ => Err(format!(
+                "unknown issue state '{}' (expected open or closed)",
+                s
+            )),
+        }
+    }
+}
+
+impl State {
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::Open => "open",
+            Self::Closed => "closed",
+        }
+    }
+}
+
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Comment {
+    pub author: String,
+    /// Markdown
+    pub body: String,
+    /// Unix time
+    pub created: i64,
+}
+
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Issue {
+    pub number: u64,
+    pub title: String,
+    /// Markdown
+    #[serde(default)]
+    pub body: String,
+    pub author: String,
+    #[serde(default)]
+    pub state: State,
+    #[serde(default, skip_serializing_if = "BTreeSet::is_empty")]
+    pub labels: BTreeSet<String>,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub comments: Vec<Comment>,
+    /// Unix time
+    pub created: i64,
+    /// Unix time of the last change or comment
+    pub updated: i64,
+    /// Who closed the issue, while it is closed
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub closed_by: Option<String>,
+    /// Title of the milestone the issue belongs to
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub milestone: Option<String>,
+}
+
+/// How a label looks, where it has been described
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Label {
+    pub name: String,
+    /// CSS color, e.g. #d73a4a
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub color: Option<String>,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub description: String,
+}
+
+/// A goal issues are grouped under
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Milestone {
+    pub title: String,
+    /// Markdown
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub description: String,
+    #[serde(default)]
+    pub state: State,
+    /// Unix time it is due
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub due: Option<i64>,
+}
+
+impl Issue {
+    pub fn set_title(&mut self, title: &str) -> Result<()> {
+        self.title = valid_title(title)?;
+        Ok(())
+    }
+
+    /// Replace the labels with a comma-separated list
+    pub fn set_labels(&mut self, labels: &str) -> Result<()> {
+        self.labels = parse_labels(labels)?;
+        Ok(())
+    }
+
+    pub fn comment(&mut self, author: &str, body: &str) -> Result<()> {
+        if body.trim().is_empty() {
+            anyhow::bail!("Comments cannot be empty");
+        }
+        self.comments.push(Comment {
+            author: author.to_string(),
+            body: body.trim_end().to_string(),
+            created: chrono::Utc::now().timestamp(),
+        });
+        Ok(())
+    }
+
+    pub fn set_state(&mut self, state: State, by: &str) {
+        self.state = state;
+        self.closed_by = match state {
+            State::Open => None,
+            State::Closed => Some(by.to_string()),
+        };
+    }
+}
+
+/// A trimmed title, or why it is not acceptable
+pub fn valid_title(title: &str) -> Result<String> {
+    let title = title.trim();
+    if title.is_empty() {
+        anyhow::bail!("Issues need a title");
+    }
+    if title.chars().count() > MAX_TITLE {
+        anyhow::bail!("Titles can be at most {} characters long", MAX_TITLE);
+    }
+    Ok(title.to_string())
+}
+
+/// Labels from a comma-separated list, such as "bug, help wanted"
+pub fn parse_labels(labels: &str) -> Result<BTreeSet<String>> {
+    labels
+        .split(',')
+        .map(str::trim)
+        .filter(|label| !label.is_empty())
+        .map(|label| {
+            if label.chars().count() > MAX_LABEL || label.chars().any(char::is_control) {
+                anyhow::bail!("Invalid label '{}'", label);
+            }
+            Ok(label.to_string())
+        })
+        .collect()
+}
+
+/// Which issues to list
+#[derive(Clone, Debug, Default)]
+pub struct Filter {
+    /// Only issues in this state; all if None
+    pub state: Option<State>,
+    /// Only issues with this label
+    pub label: Option<String>,
+    /// Only issues in this milestone
+    pub milestone: Option<String>,
+}
+
+impl Filter {
+    fn matches(&self, issue: &Issue) -> bool {
+        self.state.map_or(true, |state| issue.state == state)
+            && self
+                .label
+                .as_ref()
+                .map_or(true, |label| issue.labels.contains(label))
+            && self.milestone.as_ref().map_or(true, |milestone| {
+                issue.milestone.as_ref() == Some(milestone)
+            })
+    }
+}
+
+fn issues_dir(repo_path: &Path) -> PathBuf {
+    git::data_dir(repo_path).join("issues")
+}
+
+fn issue_path(repo_path: &Path, number: u64) -> PathBuf {
+    issues_dir(repo_path).join(format!("{}.json", number))
+}
+
+/// Issues matching a filter, newest first
+pub fn list(repo_path: &Path, filter: &Filter) -> Result<Vec<Issue>> {
+    let mut issues = Vec::new();
+    for number in numbers(repo_path)? {
+        if let Some(issue) = get(repo_path, number)? {
+            if filter.matches(&issue) {
+                issues.push(issue);
+            }
+        }
+    }
+    issues.sort_by(|a, b| b.number.cmp(&a.number));
+    Ok(issues)
+}
+
+fn numbers(repo_path: &Path) -> Result<Vec<u64>> {
+    let entries = match fs::read_dir(issues_dir(repo_path)) {
+        Ok(entries) => entries,
+        Err(e) if e.kind() == io::ErrorKind::NotFound => return Ok(Vec::new()),
+        Err(e) => return Err(e.into()),
+    };
+    Ok(entries
+        .filter_map(|entry| entry.ok())
+        .filter_map(|entry| {
+            entry
+                .file_name()
+                .to_str()?
+                .strip_suffix(".json")?
+                .parse()
+                .ok()
+        })
+        .collect())
+}
+
+pub fn get(repo_path: &Path, number: u64) -> Result<Option<Issue>> {
+    let path = issue_path(repo_path, number);
+    match fs::read_to_string(&path) {
+        // Just claimed by create() and not written yet
+        Ok(content) if content.is_empty() => Ok(None),
+        Ok(content) => serde_json::from_str(&content)
+            .map(Some)
+            .with_context(|| format!("Failed to parse {}", path.display())),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(None),
+        Err(e) => Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    }
+}
+
+/// Open an issue under the next free number
+pub fn create(
+    repo_path: &Path,
+    author: &str,
+    title: &str,
+    body: &str,
+    labels: BTreeSet<String>,
+) -> Result<Issue> {
+    let now = chrono::Utc::now().timestamp();
+    let mut issue = Issue {
+        number: 0,
+        title: valid_title(title)?,
+        body: body.trim_end().to_string(),
+        author: author.to_string(),
+        state: State::Open,
+        labels,
+        comments: Vec::new(),
+        created: now,
+        updated: now,
+        closed_by: None,
+        milestone: None,
+    };
+
+    let dir = issues_dir(repo_path);
+    fs::create_dir_all(&dir)?;
+    let mut number = numbers(repo_path)?.into_iter().max().unwrap_or(0) + 1;
+    // Claim the number by creating its file, so concurrent issues can't get
+    // the same one
+    loop {
+        match fs::OpenOptions::new()
+            .write(true)
+            .create_new(true)
+            .open(issue_path(repo_path, number))
+        {
+            Ok(_) => break,
+            Err(e) if e.kind() == io::ErrorKind::AlreadyExists => number += 1,
+            Err(e) => return Err(e).context("Failed to create the issue"),
+        }
+    }
+    issue.number = number;
+    save(repo_path, &issue)?;
+    webhooks::trigger(
+        repo_path,
+        Event::Issues,
+        || json!({"action": "opened", "issue": issue, "sender": issue.author}),
+    );
+    subscriptions::record(
+        repo_path,
+        Kind::Issue,
+        issue.number,
+        &issue.title,
+        "opened",
+        Some(&issue.author),
+        &issue.body,
+    );
+    Ok(issue)
+}
+
+/// Add an issue brought over from elsewhere under its own number, without
+/// telling webhooks or subscribers. Returns false, leaving the repository
+/// alone, if the number is taken.
+pub fn import(repo_path: &Path, issue: &Issue) -> Result<bool> {
+    if issue.number == 0 {
+        anyhow::bail!("Issues are numbered from 1");
+    }
+    fs::create_dir_all(issues_dir(repo_path))?;
+    match fs::OpenOptions::new()
+        .write(true)
+        .create_new(true)
+        .open(issue_path(repo_path, issue.number))
+    {
+        Ok(_) => {}
+        Err(e) if e.kind() == io::ErrorKind::AlreadyExists => return Ok(false),
+        Err(e) => return Err(e).context("Failed to create the issue"),
+    }
+    save(repo_path, issue)?;
+    Ok(true)
+}
+
+/// Change an issue and save it, returning the result
+pub fn update(
+    repo_path: &Path,
+    number: u64,
+    change: impl FnOnce(&mut Issue) -> Result<()>,
+) -> Result<Issue> {
+    let before = get(repo_path, number)?.with_context(|| format!("No such issue: #{}", number))?;
+    let mut issue = before.clone();
+    change(&mut issue)?;
+    issue.updated = chrono::Utc::now().timestamp();
+    save(repo_path, &issue)?;
+    webhooks::trigger(repo_path, Event::Issues, || {
+        webhook_payload(&before, &issue)
+    });
+    Ok(issue)
+}
+
+/// Body of the issues webhook for a change from `before` to `issue`
+fn webhook_payload(before: &Issue, issue: &Issue) -> serde_json::Value {
+    let comment = issue.comments.get(before.comments.len());
+    let (action, sender) = if issue.state != before.state {
+        match issue.state {
+            State::Open => ("reopened", None),
+            State::Closed => ("closed", issue.closed_by.as_deref()),
+        }
+    } else if let Some(comment) = comment {
+        ("commented", Some(comment.author.as_str()))
+    } else {
+        ("edited", None)
+    };
+    json!({"action": action, "issue": issue, "comment": comment, "sender": sender})
+}
+
+fn save(repo_path: &Path, issue: &Issue) -> Result<()> {
+    let path = issue_path(repo_path, issue.number);
+    let tmp = path.with_extension("json.tmp");
+    fs::write(&tmp, serde_json::to_string_pretty(issue)?)?;
+    fs::rename(&tmp, &path)?;
+    Ok(())
+}
+
+fn read_list<T: serde::de::DeserializeOwned>(path: &Path) -> Result<Vec<T>> {
+    match fs::read_to_string(path) {
+        Ok(content) => serde_json::from_str(&content)
+            .with_context(|| format!("Failed to parse {}", path.display())),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(Vec::new()),
+        Err(e) => Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    }
+}
+
+fn write_list<T: Serialize>(path: &Path, list: &[T]) -> Result<()> {
+    if let Some(dir) = path.parent() {
+        fs::create_dir_all(dir)?;
+    }
+    let tmp = path.with_extension("json.tmp");
+    fs::write(&tmp, serde_json::to_string_pretty(list)?)?;
+    fs::rename(&tmp, path)?;
+    Ok(())
+}
+
+fn labels_path(repo_path: &Path) -> PathBuf {
+    git::data_dir(repo_path).join("labels.json")
+}
+
+fn milestones_path(repo_path: &Path) -> PathBuf {
+    git::data_dir(repo_path).join("milestones.json")
+}
+
+/// Labels that have been given a color or description
+pub fn label_definitions(repo_path: &Path) -> Result<Vec<Label>> {
+    read_list(&labels_path(repo_path))
+}
+
+/// Describe labels, replacing earlier descriptions of the same names
+pub fn define_labels(repo_path: &Path, labels: Vec<Label>) -> Result<()> {
+    let mut defined = label_definitions(repo_path)?;
+    for label in labels {
+        parse_labels(&label.name)?;
+        defined.retain(|l| l.name != label.name);
+        defined.push(label);
+    }
+    defined.sort_by(|a, b| a.name.cmp(&b.name));
+    write_list(&labels_path(repo_path), &defined)
+}
+
+/// The repository's milestones, by due date and then title
+pub fn milestones(repo_path: &Path) -> Result<Vec<Milestone>> {
+    read_list(&milestones_path(repo_path))
+}
+
+/// Add milestones, replacing those with the same titles
+pub fn save_milestones(repo_path: &Path, milestones: Vec<Milestone>) -> Result<()> {
+    let mut all = self::milestones(repo_path)?;
+    for milestone in milestones {
+        let title = valid_title(&milestone.title)?;
+        all.retain(|m| m.title != title);
+        all.push(Milestone { title, ..milestone });
+    }
+    all.sort_by(|a, b| (a.due.is_none(), a.due, &a.title).cmp(&(b.due.is_none(), b.due, &b.title)));
+    write_list(&milestones_path(repo_path), &all)
+}
+
+/// Labels in use, with how many open issues carry each
+pub fn labels(repo_path: &Path) -> Result<BTreeMap<String, usize>> {
+    let mut labels = BTreeMap::new();
+    for issue in list(repo_path, &Filter::default())? {
+        for label in issue.labels {
+            *labels.entry(label).or_insert(0) += (issue.state == State::Open) as usize;
+        }
+    }
+    Ok(labels)
+}
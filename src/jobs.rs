@@ -0,0 +1,47 @@
+use anyhow::Result;
+use std::time::{Duration, Instant};
+
+/// Run a blocking job every `interval`, starting immediately.
+///
+/// Each run happens on the blocking thread pool inside a `job` span, with the
+/// job's name as its `component`, so runs appear in traces and their duration
+/// is logged. Failures are logged and the
+/// job is retried at the next tick.
+pub fn spawn_periodic<F>(
+    name: &'static str,
+    interval: Duration,
+    job: F,
+) -> tokio::task::JoinHandle<()>
+where
+    F: Fn() -> Result<()> + Send + Sync + 'static,
+{
+    let job = std::sync::Arc::new(job);
+    tokio::spawn(async move {
+        let mut ticker = tokio::time::interval(interval);
+        ticker.set_missed_tick_behavior(tokio::time::MissedTickBehavior::Delay);
+        loop {
+            ticker.tick().await;
+
+            let job = job.clone();
+            let span = tracing::info_span!("job", component = name);
+            let result = tokio::task::spawn_blocking(move || {
+                let _enter = span.enter();
+                let start = Instant::now();
+                let result = job();
+                tracing::debug!(
+                    elapsed_ms = start.elapsed().as_millis() as u64,
+                    "Job {} finished",
+                    name
+                );
+                result
+            })
+            .await;
+
+            match result {
+                Ok(Ok(())) => {}
+                Ok(Err(e)) => tracing::warn!("Job {} failed: {:#}", name, e),
+                Err(e) => tracing::warn!("Job {} panicked: {}", name, e),
+            }
+        }
+    })
+}
@@ -0,0 +1,114 @@
+//! What a repository is written in: the languages of the files on its
+//! default branch, weighted by their size, as GitHub's linguist does.
+//!
+//! Files are recognized by extension, as code search recognizes them (see
+//! [`crate::search::language`]). Documentation and data such as Markdown,
+//! JSON and YAML don't count, nor do vendored dependencies and minified
+//! files, so the breakdown shows the code the project itself wrote. It is
+//! worked out with the repository's statistics (see [`crate::stats`]),
+//! again whenever the default branch moves.
+
+use crate::{git, search};
+use anyhow::Result;
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::path::Path;
+
+/// Languages that describe or configure a project rather than make it up
+const NOT_CODE: &[&str] = &["Markdown", "JSON", "YAML", "TOML"];
+
+/// Directories of code copied in from elsewhere, anywhere in the tree
+const VENDORED_DIRS: &[&str] = &["vendor", "node_modules", "third_party", "bower_components"];
+
+/// Colors of the language bar, as linguist has them
+const COLORS: &[(&str, &str)] = &[
+    ("Rust", "#dea584"),
+    ("Go", "#00add8"),
+    ("Python", "#3572a5"),
+    ("JavaScript", "#f1e05a"),
+    ("TypeScript", "#3178c6"),
+    ("C", "#555555"),
+    ("C++", "#f34b7d"),
+    ("Java", "#b07219"),
+    ("Kotlin", "#a97bff"),
+    ("Ruby", "#701516"),
+    ("PHP", "#4f5d95"),
+    ("C#", "#178600"),
+    ("Swift", "#f05138"),
+    ("Shell", "#89e051"),
+    ("SQL", "#e38c00"),
+    ("HTML", "#e34c26"),
+    ("CSS", "#563d7c"),
+    ("HCL", "#844fba"),
+    ("Nix", "#7e7eff"),
+    ("Dockerfile", "#384d54"),
+    ("Makefile", "#427819"),
+];
+
+/// Color of languages not in [`COLORS`]
+const OTHER_COLOR: &str = "#cccccc";
+
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Language {
+    pub name: String,
+    /// Size of its files
+    pub bytes: u64,
+}
+
+/// The color a language is shown in
+pub fn color(name: &str) -> &'static str {
+    COLORS
+        .iter()
+        .find(|(language, _)| *language == name)
+        .map_or(OTHER_COLOR, |(_, color)| *color)
+}
+
+/// Whether a file was copied in from elsewhere or generated, rather than
+/// written for the project
+fn vendored(path: &str) -> bool {
+    let mut dirs = path.split('/');
+    dirs.next_back();
+    dirs.any(|dir| VENDORED_DIRS.contains(&dir)) || path.ends_with(".min.js")
+}
+
+/// The languages of the files at `commit`, most used first
+pub fn detect(repo_path: &Path, commit: &str) -> Result<Vec<Language>> {
+    let output = git::run(repo_path, &["ls-tree", "-r", "-l", "-z", commit])?;
+    if !output.status.success() {
+        anyhow::bail!("Failed to list the files of {}", commit);
+    }
+
+    // <mode> SP <type> SP <object> SP+ <size> TAB <path> NUL
+    let mut bytes: HashMap<&'static str, u64> = HashMap::new();
+    for entry in output.stdout.split(|&b| b == 0) {
+        let entry = String::from_utf8_lossy(entry);
+        let Some((info, path)) = entry.split_once('\t') else {
+            continue;
+        };
+        let mut fields = info.split_whitespace();
+        if fields.nth(1) != Some("blob") || vendored(path) {
+            continue;
+        }
+        let size: u64 = fields
+            .nth(1)
+            .and_then(|size| size.parse().ok())
+            .unwrap_or(0);
+        match search::language(path) {
+            Some(language) if !NOT_CODE.contains(&language) => {
+                *bytes.entry(language).or_default() += size;
+            }
+            _ => {}
+        }
+    }
+
+    let mut languages: Vec<Language> = bytes
+        .into_iter()
+        .filter(|(_, bytes)| *bytes > 0)
+        .map(|(name, bytes)| Language {
+            name: name.to_string(),
+            bytes,
+        })
+        .collect();
+    languages.sort_by(|a, b| b.bytes.cmp(&a.bytes).then(a.name.cmp(&b.name)));
+    Ok(languages)
+}
@@ -0,0 +1,119 @@
+//! Git LFS object storage and the short-lived tokens that authorize HTTP
+//! transfers after authenticating over SSH (`git-lfs-authenticate`).
+
+use crate::keys;
+use anyhow::Result;
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+use std::sync::Arc;
+
+/// Seconds a token handed out over SSH stays valid
+pub const TOKEN_TTL: i64 = 3600;
+
+/// What a client wants to do with LFS objects
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum Operation {
+    Download,
+    Upload,
+}
+
+impl FromStr for Operation {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "download" => Ok(Self::Download),
+            "upload" => Ok(Self::Upload),
+            _ => Err(format!(
+                "unknown LFS operation '{}' (expected download or upload)",
+                s
+            )),
+        }
+    }
+}
+
+impl Operation {
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::Download => "download",
+            Self::Upload => "upload",
+        }
+    }
+}
+
+/// LFS object ids are lowercase hex SHA-256 digests
+pub fn valid_oid(oid: &str) -> bool {
+    oid.len() == 64 && oid.bytes().all(|b| matches!(b, b'0'..=b'9' | b'a'..=b'f'))
+}
+
+/// Where an object is stored: `lfs/objects/ab/cd/abcd...` inside the bare
+/// repository, the same layout git-lfs uses locally
+pub fn object_path(repo_path: &Path, oid: &str) -> PathBuf {
+    repo_path
+        .join("lfs")
+        .join("objects")
+        .join(&oid[0..2])
+        .join(&oid[2..4])
+        .join(oid)
+}
+
+/// Scratch space for uploads in progress, on the same filesystem as the objects
+pub fn tmp_dir(repo_path: &Path) -> PathBuf {
+    repo_path.join("lfs").join("tmp")
+}
+
+/// Signs and checks transfer tokens with a key kept in the data directory, so
+/// tokens issued by the SSH server are accepted by the web server
+#[derive(Clone)]
+pub struct Tokens {
+    key: Arc<Vec<u8>>,
+}
+
+impl Tokens {
+    /// Load `<data_dir>/lfs.key`, generating a random key on first use
+    pub fn load_or_create(data_dir: &Path) -> Result<Self> {
+        let key = keys::load_or_create(&data_dir.join("lfs.key"))?;
+        Ok(Self { key: Arc::new(key) })
+    }
+
+    /// Token allowing `operation` on `repo` until `TOKEN_TTL` seconds from now
+    pub fn issue(&self, repo: &str, operation: Operation) -> String {
+        let expires = chrono::Utc::now().timestamp() + TOKEN_TTL;
+        format!(
+            "{}.{}.{}",
+            operation.name(),
+            expires,
+            self.sign(repo, operation, expires)
+        )
+    }
+
+    /// Whether a token permits `operation` on `repo`. Upload tokens also
+    /// allow downloads, as clients check what the server already has.
+    pub fn verify(&self, repo: &str, operation: Operation, token: &str) -> bool {
+        let mut parts = token.splitn(3, '.');
+        let (granted, expires, signature) = match (parts.next(), parts.next(), parts.next()) {
+            (Some(granted), Some(expires), Some(signature)) => (granted, expires, signature),
+            _ => return false,
+        };
+        let granted: Operation = match granted.parse() {
+            Ok(granted) => granted,
+            Err(_) => return false,
+        };
+        let expires: i64 = match expires.parse() {
+            Ok(expires) => expires,
+            Err(_) => return false,
+        };
+
+        expires > chrono::Utc::now().timestamp()
+            && (granted == operation || granted == Operation::Upload)
+            && keys::constant_time_eq(
+                self.sign(repo, granted, expires).as_bytes(),
+                signature.as_bytes(),
+            )
+    }
+
+    fn sign(&self, repo: &str, operation: Operation, expires: i64) -> String {
+        let message = format!("{}\n{}\n{}", repo, operation.name(), expires);
+        keys::hex(&keys::hmac_sha256(&self.key, message.as_bytes()))
+    }
+}
@@ -1,3 +1,78 @@
+pub mod activity;
+pub mod archive;
+pub mod audit;
+pub mod backup;
+pub mod bench;
+pub mod bundle;
+pub mod ci;
+pub mod clone_all;
+pub mod clone_urls;
+pub mod config;
+pub mod create;
+pub mod credential;
+pub mod deploy_keys;
+pub mod digest;
+pub mod doctor;
+pub mod events;
+pub mod federation;
 pub mod git;
+pub mod git_daemon;
+pub mod glob;
+pub mod hooks;
+pub mod host_keys;
+pub mod import;
+pub mod ip_access;
+pub mod issues;
+pub mod jobs;
+pub mod keys;
+pub mod languages;
+pub mod lfs;
+pub mod listeners;
+pub mod mail;
+pub mod merge;
+pub mod migrate;
+pub mod maintenance;
+pub mod maintenance_mode;
+pub mod metrics;
+pub mod mirror;
+pub mod namespaces;
+pub mod notifications;
+pub mod orgs;
+pub mod pack_cache;
+pub mod policies;
+pub mod preferences;
+pub mod profile;
+pub mod protection;
+pub mod pulls;
+pub mod releases;
+pub mod reviews;
+pub mod push_check;
+pub mod quota;
+pub mod rate_limit;
+pub mod redirects;
+pub mod rest;
+pub mod retention;
+pub mod search;
+pub mod seed;
+pub mod serve;
+pub mod signatures;
 pub mod ssh;
+pub mod stars;
+pub mod stats;
+pub mod subscriptions;
+pub mod sync;
+pub mod telemetry;
+pub mod templates;
+pub mod tokens;
+pub mod topics;
+pub mod trash;
+pub mod trust;
+pub mod tui;
+pub mod usage;
+pub mod users;
+pub mod version;
+pub mod visibility;
+pub mod watch;
+pub mod webhooks;
 pub mod web;
+pub mod wire;
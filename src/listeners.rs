@@ -0,0 +1,256 @@
+//! Listening sockets passed in by systemd socket activation or by the
+//! previous server process, and restarts that hand them over to a new one.
+//!
+//! Under socket activation the sockets arrive as file descriptors 3 and up,
+//! counted by `LISTEN_FDS` and named by `LISTEN_FDNAMES`, i.e. the
+//! `FileDescriptorName=` of the socket units: `ssh`, `http` and `git`. Unnamed
+//! sockets are taken in order, SSH first. Sockets that aren't passed in are
+//! bound as usual.
+//!
+//! On restart the server starts a new copy of itself with the same arguments,
+//! passing its sockets the same way, and waits until the new process is
+//! accepting connections. Only then does it stop accepting and finish the
+//! connections in flight. Clients connecting in between wait in the sockets'
+//! queues, so none are refused.
+
+use anyhow::{Context, Result};
+use std::env;
+use std::io::{Read, Write};
+use std::net::TcpListener;
+use std::os::fd::{AsRawFd, FromRawFd, RawFd};
+use std::os::unix::net::UnixDatagram;
+use std::os::unix::process::CommandExt;
+use std::process::{Child, Command};
+use std::time::Duration;
+
+pub const SSH: &str = "ssh";
+pub const HTTP: &str = "http";
+pub const GIT: &str = "git";
+
+/// Order of unnamed sockets
+const DEFAULT_NAMES: [&str; 2] = [SSH, HTTP];
+
+/// First descriptor of passed sockets, after stdin, stdout and stderr
+const FIRST_FD: RawFd = 3;
+
+/// Most descriptors passed to a new process, including its readiness pipe
+const MAX_PASSED: usize = 8;
+
+/// Descriptor of the pipe the new process reports on during a restart
+const READY_FD_VAR: &str = "AGITO_READY_FD";
+
+/// Sockets passed to this process
+#[derive(Debug, Default)]
+pub struct Listeners {
+    inherited: Vec<(String, TcpListener)>,
+}
+
+impl Listeners {
+    /// Take the sockets described by `LISTEN_FDS`, if they are meant for this
+    /// process. The variables are removed so git and hooks don't see them.
+    pub fn from_env() -> Result<Self> {
+        let count = env::var("LISTEN_FDS").ok();
+        let pid = env::var("LISTEN_PID").ok();
+        let names = env::var("LISTEN_FDNAMES").unwrap_or_default();
+        for var in ["LISTEN_FDS", "LISTEN_PID", "LISTEN_FDNAMES"] {
+            env::remove_var(var);
+        }
+
+        let count: RawFd = match count {
+            Some(count) => count
+                .parse::<RawFd>()
+                .with_context(|| format!("Invalid LISTEN_FDS '{}'", count))?,
+            None => return Ok(Self::default()),
+        };
+        // Meant for the process that started us, e.g. a shell wrapper
+        if pid.map_or(false, |pid| pid != std::process::id().to_string()) {
+            return Ok(Self::default());
+        }
+
+        let names: Vec<&str> = names.split(':').collect();
+        let mut inherited = Vec::new();
+        for i in 0..count {
+            let fd = FIRST_FD + i;
+            set_cloexec(fd)?;
+            // SAFETY: systemd, or the previous process, passed this socket to
+            // us alone, and nothing else in the process owns the descriptor
+            let listener = unsafe { TcpListener::from_raw_fd(fd) };
+            let name = names
+                .get(i as usize)
+                .filter(|name| !name.is_empty() && **name != "unknown")
+                .copied()
+                .or_else(|| DEFAULT_NAMES.get(i as usize).copied())
+                .unwrap_or("unknown");
+            tracing::info!(
+                "Using {} socket passed in as descriptor {} ({})",
+                name,
+                fd,
+                listener
+                    .local_addr()
+                    .map(|addr| addr.to_string())
+                    .unwrap_or_default()
+            );
+            inherited.push((name.to_string(), listener));
+        }
+        Ok(Self { inherited })
+    }
+
+    /// The socket passed in under `name`, or a new one bound to `addr`
+    pub fn take_or_bind(&mut self, name: &str, addr: &str) -> Result<TcpListener> {
+        let listener = match self.inherited.iter().position(|(n, _)| n == name) {
+            Some(index) => self.inherited.remove(index).1,
+            None => TcpListener::bind(addr).with_context(|| format!("Failed to bind {}", addr))?,
+        };
+        listener.set_nonblocking(true)?;
+        Ok(listener)
+    }
+
+    /// Sockets passed in that no server asked for
+    pub fn unused(&self) -> impl Iterator<Item = &str> {
+        self.inherited.iter().map(|(name, _)| name.as_str())
+    }
+}
+
+fn set_cloexec(fd: RawFd) -> Result<()> {
+    // SAFETY: fcntl on a descriptor number only inspects and sets its flags
+    let flags = unsafe { libc::fcntl(fd, libc::F_GETFD) };
+    if flags < 0 || unsafe { libc::fcntl(fd, libc::F_SETFD, flags | libc::FD_CLOEXEC) } < 0 {
+        return Err(std::io::Error::last_os_error())
+            .with_context(|| format!("Descriptor {} is not open", fd));
+    }
+    Ok(())
+}
+
+/// Tell systemd the server is ready, when it runs as a `Type=notify`
+/// service. After a restart the new process also becomes the service's main
+/// process, which needs `NotifyAccess=all`.
+pub fn notify_ready() {
+    let path = match env::var_os("NOTIFY_SOCKET") {
+        Some(path) => path,
+        None => return,
+    };
+    let message = format!("READY=1\nMAINPID={}\n", std::process::id());
+    let sent = UnixDatagram::unbound().and_then(|socket| {
+        #[cfg(target_os = "linux")]
+        if let Some(name) = path.as_encoded_bytes().strip_prefix(b"@") {
+            // An abstract socket
+            use std::os::linux::net::SocketAddrExt;
+            let addr = std::os::unix::net::SocketAddr::from_abstract_name(name)?;
+            return socket.send_to_addr(message.as_bytes(), &addr);
+        }
+        socket.send_to(message.as_bytes(), std::path::Path::new(&path))
+    });
+    if let Err(e) = sent {
+        tracing::warn!("Failed to notify systemd: {}", e);
+    }
+}
+
+/// Let the process that started this one in a restart know that it may stop
+/// accepting connections
+pub fn report_ready() {
+    let fd: RawFd = match env::var(READY_FD_VAR).ok().and_then(|fd| fd.parse().ok()) {
+        Some(fd) => fd,
+        None => return,
+    };
+    env::remove_var(READY_FD_VAR);
+    // SAFETY: the previous process passed this pipe to us alone
+    let mut pipe = unsafe { std::fs::File::from_raw_fd(fd) };
+    if let Err(e) = pipe.write_all(b"1") {
+        tracing::warn!("Failed to report readiness to the previous process: {}", e);
+    }
+}
+
+/// Start a new server process with the same arguments, passing it
+/// `listeners`, and wait up to `timeout` until it is accepting connections.
+/// A new process that fails to start in time is killed.
+pub fn spawn_successor(listeners: &[(&str, &TcpListener)], timeout: Duration) -> Result<u32> {
+    let mut fds = [0; 2];
+    // SAFETY: pipe writes two descriptors into the array
+    if unsafe { libc::pipe(fds.as_mut_ptr()) } < 0 {
+        return Err(std::io::Error::last_os_error()).context("Failed to create a pipe");
+    }
+    set_cloexec(fds[0])?;
+    set_cloexec(fds[1])?;
+    // SAFETY: both descriptors were just created and are owned here
+    let (mut ready, report) = unsafe {
+        (
+            std::fs::File::from_raw_fd(fds[0]),
+            std::fs::File::from_raw_fd(fds[1]),
+        )
+    };
+
+    let mut passed: Vec<RawFd> = listeners.iter().map(|(_, l)| l.as_raw_fd()).collect();
+    passed.push(report.as_raw_fd());
+    if passed.len() > MAX_PASSED {
+        anyhow::bail!("Too many sockets to pass on");
+    }
+    let names: Vec<&str> = listeners.iter().map(|(name, _)| *name).collect();
+    // Run the binary by the name it was started with rather than the path of
+    // this process's, so an upgrade that replaced the file takes effect
+    let mut args = env::args_os();
+    let program = args.next().context("Failed to find the server binary")?;
+    let mut command = Command::new(program);
+    command
+        .args(args)
+        .env("LISTEN_FDS", listeners.len().to_string())
+        .env("LISTEN_FDNAMES", names.join(":"))
+        .env_remove("LISTEN_PID")
+        .env(
+            READY_FD_VAR,
+            (FIRST_FD + listeners.len() as RawFd).to_string(),
+        );
+    // SAFETY: only async-signal-safe calls between fork and exec
+    unsafe {
+        command.pre_exec(move || {
+            // Move everything out of the way first, as the target numbers may
+            // be taken by descriptors still to be moved. No allocating here.
+            let target = FIRST_FD + passed.len() as RawFd;
+            let mut moved = [0; MAX_PASSED];
+            for (i, fd) in passed.iter().enumerate() {
+                moved[i] = libc::fcntl(*fd, libc::F_DUPFD_CLOEXEC, target);
+                if moved[i] < 0 {
+                    return Err(std::io::Error::last_os_error());
+                }
+            }
+            // dup2 leaves the copies open across exec
+            for (i, fd) in moved[..passed.len()].iter().enumerate() {
+                if libc::dup2(*fd, FIRST_FD + i as RawFd) < 0 {
+                    return Err(std::io::Error::last_os_error());
+                }
+            }
+            Ok(())
+        });
+    }
+    let mut child = command
+        .spawn()
+        .context("Failed to start the new server process")?;
+    drop(report);
+
+    if wait_ready(&mut ready, &mut child, timeout) {
+        Ok(child.id())
+    } else {
+        let _ = child.kill();
+        let _ = child.wait();
+        anyhow::bail!(
+            "The new server process did not start accepting connections within {} seconds",
+            timeout.as_secs()
+        )
+    }
+}
+
+/// Whether the new process reported readiness before exiting or timing out
+fn wait_ready(ready: &mut std::fs::File, child: &mut Child, timeout: Duration) -> bool {
+    let mut poll = libc::pollfd {
+        fd: ready.as_raw_fd(),
+        events: libc::POLLIN,
+        revents: 0,
+    };
+    let millis = timeout.as_millis().min(i32::MAX as u128) as i32;
+    // SAFETY: polls the one descriptor described by `poll`
+    if unsafe { libc::poll(&mut poll, 1, millis) } <= 0 {
+        return false;
+    }
+    // A new process that exits early closes the pipe without writing
+    let mut byte = [0u8; 1];
+    matches!(ready.read(&mut byte), Ok(1)) && matches!(child.try_wait(), Ok(None))
+}
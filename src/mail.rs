@@ -0,0 +1,184 @@
+use crate::keys;
+use anyhow::{Context, Result};
+use std::fs;
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::process::{Command, Stdio};
+
+/// Outgoing mail, handed to a local sendmail-compatible MTA (sendmail,
+/// msmtp, postfix, ...) or sent to an SMTP server
+#[derive(Clone, Debug)]
+pub struct Mailer {
+    /// Path of the sendmail binary; it is run as `sendmail -t -i`
+    pub sendmail: PathBuf,
+    /// Sender address for every message
+    pub from: String,
+    /// SMTP server to send through instead of sendmail
+    pub smtp: Option<Smtp>,
+}
+
+/// An SMTP server, spoken to with curl
+#[derive(Clone, Debug)]
+pub struct Smtp {
+    /// `smtp://host:port`, upgraded with STARTTLS, or `smtps://host:port`
+    pub url: String,
+    pub username: Option<String>,
+    pub password: Option<String>,
+    /// Send over plain `smtp://` if the server does not offer STARTTLS
+    pub allow_plaintext: bool,
+    /// Path of the curl binary
+    pub curl: PathBuf,
+}
+
+impl Smtp {
+    /// Check the URL's scheme and that it names a host
+    pub fn parse_url(url: &str) -> Result<String, String> {
+        let rest = url
+            .strip_prefix("smtp://")
+            .or_else(|| url.strip_prefix("smtps://"))
+            .ok_or_else(|| format!("invalid SMTP URL '{}' (expected smtp:// or smtps://)", url))?;
+        if rest.trim_end_matches('/').is_empty() {
+            return Err(format!("invalid SMTP URL '{}' (no host)", url));
+        }
+        Ok(url.trim_end_matches('/').to_string())
+    }
+
+    /// Read a password from the first line of a file, so it stays out of
+    /// command lines
+    pub fn read_password(path: &Path) -> Result<String> {
+        let content = fs::read_to_string(path)
+            .with_context(|| format!("Failed to read {}", path.display()))?;
+        Ok(content.lines().next().unwrap_or("").to_string())
+    }
+
+    fn send(&self, from: &str, to: &str, message: &str) -> Result<()> {
+        let mut command = Command::new(&self.curl);
+        command
+            .args(["--silent", "--show-error", "--url", &self.url])
+            .arg(if self.allow_plaintext {
+                "--ssl"
+            } else {
+                "--ssl-reqd"
+            })
+            .args(["--mail-from", address(from), "--mail-rcpt", address(to)])
+            .args(["--upload-file", "-"]);
+
+        // Credentials go through a config file only we can read, so they
+        // don't show up in the process list
+        let config = match &self.username {
+            Some(username) => {
+                let path = std::env::temp_dir()
+                    .join(format!("agito-smtp-{}", keys::hex(&keys::random_bytes(8)?)));
+                let mut file = {
+                    let mut options = fs::OpenOptions::new();
+                    options.write(true).create_new(true);
+                    #[cfg(unix)]
+                    std::os::unix::fs::OpenOptionsExt::mode(&mut options, 0o600);
+                    options.open(&path)?
+                };
+                let user = format!("{}:{}", username, self.password.as_deref().unwrap_or(""));
+                writeln!(
+                    file,
+                    "user = \"{}\"",
+                    user.replace('\\', "\\\\").replace('"', "\\\"")
+                )?;
+                command.arg("--config").arg(&path);
+                Some(path)
+            }
+            None => None,
+        };
+
+        let result = (|| {
+            let mut child = command
+                .stdin(Stdio::piped())
+                .stdout(Stdio::null())
+                .stderr(Stdio::piped())
+                .spawn()
+                .with_context(|| format!("Failed to run {}", self.curl.display()))?;
+            child
+                .stdin
+                .take()
+                .unwrap()
+                // SMTP wants every line ended with CRLF
+                .write_all(
+                    message
+                        .replace("\r\n", "\n")
+                        .replace('\n', "\r\n")
+                        .as_bytes(),
+                )
+                .context("Failed to write message to curl")?;
+            let output = child.wait_with_output()?;
+            if !output.status.success() {
+                anyhow::bail!(
+                    "SMTP delivery failed: {}",
+                    String::from_utf8_lossy(&output.stderr).trim()
+                );
+            }
+            Ok(())
+        })();
+        if let Some(config) = config {
+            let _ = fs::remove_file(config);
+        }
+        result
+    }
+}
+
+impl Mailer {
+    /// Send a plain-text message
+    pub fn send(&self, to: &str, subject: &str, body: &str) -> Result<()> {
+        let message = format!(
+            "From: {}\r\nTo: {}\r\nSubject: {}\r\nDate: {}\r\nContent-Type: text/plain; charset=utf-8\r\nAuto-Submitted: auto-generated\r\n\r\n{}",
+            header(&self.from),
+            header(to),
+            header(subject),
+            chrono::Utc::now().to_rfc2822(),
+            body
+        );
+
+        match &self.smtp {
+            Some(smtp) => smtp.send(&self.from, to, &message)?,
+            None => self.sendmail(&message)?,
+        }
+        tracing::info!("Sent mail to {}: {}", to, subject);
+        Ok(())
+    }
+
+    fn sendmail(&self, message: &str) -> Result<()> {
+        let mut child = Command::new(&self.sendmail)
+            .args(["-t", "-i"])
+            .stdin(Stdio::piped())
+            .stdout(Stdio::null())
+            .stderr(Stdio::piped())
+            .spawn()
+            .with_context(|| format!("Failed to run {}", self.sendmail.display()))?;
+
+        child
+            .stdin
+            .take()
+            .unwrap()
+            .write_all(message.as_bytes())
+            .context("Failed to write message to sendmail")?;
+
+        let output = child.wait_with_output()?;
+        if !output.status.success() {
+            anyhow::bail!(
+                "sendmail failed: {}",
+                String::from_utf8_lossy(&output.stderr).trim()
+            );
+        }
+        Ok(())
+    }
+}
+
+/// Keep header values on one line so they can't inject extra headers
+fn header(value: &str) -> String {
+    value.replace(['\r', '\n'], " ")
+}
+
+/// The bare address of `Name <address>`, for the SMTP envelope
+fn address(value: &str) -> &str {
+    match (value.rfind('<'), value.rfind('>')) {
+        (Some(start), Some(end)) if start < end => &value[start + 1..end],
+        _ => value.trim(),
+    }
+}
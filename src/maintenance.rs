@@ -0,0 +1,213 @@
+use crate::{git, jobs};
+use serde::Serialize;
+use std::io;
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
+
+/// A housekeeping step run on each repository
+#[derive(Clone, Copy, Debug, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "kebab-case")]
+pub enum Task {
+    /// `git gc --auto`: packs loose objects and prunes only when git's own
+    /// thresholds are exceeded, so it is cheap on tidy repositories
+    Gc,
+    /// Full `git repack` into a single pack with a bitmap index. Unreachable
+    /// objects are kept loose so forks borrowing them via alternates still work.
+    Repack,
+    /// Incremental commit-graph, which speeds up history walks and clones
+    CommitGraph,
+    /// `git fsck`: checks every object and their connectivity; slow on large
+    /// repositories, so not meant for every run
+    Fsck,
+    /// Rewrite the commit-graph from scratch, for when it is out of date or
+    /// damaged
+    Caches,
+}
+
+impl FromStr for Task {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "gc" => Ok(Self::Gc),
+            "repack" => Ok(Self::Repack),
+            "commit-graph" => Ok(Self::CommitGraph),
+            "fsck" => Ok(Self::Fsck),
+            "caches" => Ok(Self::Caches),
+            _ => Err(format!(
+                "unknown maintenance task '{}' (expected gc, repack, commit-graph, fsck or caches)",
+                s
+            )),
+        }
+    }
+}
+
+impl Task {
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::Gc => "gc",
+            Self::Repack => "repack",
+            Self::CommitGraph => "commit-graph",
+            Self::Fsck => "fsck",
+            Self::Caches => "caches",
+        }
+    }
+
+    fn args(self) -> &'static [&'static str] {
+        match self {
+            Self::Gc => &["gc", "--auto", "--quiet"],
+            Self::Repack => &["repack", "-A", "-d", "-l", "-q", "--write-bitmap-index"],
+            Self::CommitGraph => &["commit-graph", "write", "--reachable", "--split"],
+            Self::Fsck => &["fsck", "--no-progress", "--no-dangling"],
+            Self::Caches => &["commit-graph", "write", "--reachable", "--split=replace"],
+        }
+    }
+}
+
+/// Which tasks to run, and on how many repositories at once
+#[derive(Clone, Debug)]
+pub struct Schedule {
+    pub tasks: Vec<Task>,
+    pub concurrency: usize,
+}
+
+impl Default for Schedule {
+    fn default() -> Self {
+        Self {
+            tasks: vec![Task::Gc, Task::CommitGraph],
+            concurrency: 2,
+        }
+    }
+}
+
+/// Outcome of one task on one repository
+#[derive(Clone, Debug, Serialize)]
+pub struct TaskRun {
+    pub repo: String,
+    pub task: Task,
+    pub elapsed_ms: u64,
+    /// Why the task failed, if it did
+    pub error: Option<String>,
+}
+
+/// Result of a maintenance run
+#[derive(Clone, Debug, Default, Serialize)]
+pub struct Report {
+    pub runs: Vec<TaskRun>,
+}
+
+impl Report {
+    pub fn failures(&self) -> usize {
+        self.runs.iter().filter(|r| r.error.is_some()).count()
+    }
+
+    /// Print one line per repository and task
+    pub fn print(&self) {
+        for run in &self.runs {
+            println!(
+                "{:>8.1}s  {}  {}{}",
+                run.elapsed_ms as f64 / 1000.0,
+                run.repo,
+                run.task.name(),
+                match &run.error {
+                    Some(e) => format!("  FAILED: {}", e),
+                    None => String::new(),
+                }
+            );
+        }
+        println!("{} tasks, {} failed", self.runs.len(), self.failures());
+    }
+}
+
+/// Whether maintenance is enabled for a repository. Set
+/// `agito.maintenance = false` in its git config to opt out.
+pub fn enabled(repo_path: &Path) -> bool {
+    git::config_get(repo_path, "agito.maintenance").as_deref() != Some("false")
+}
+
+/// Run the scheduled tasks on every repository below `repos_dir`, or only on
+/// those named in `only`, with at most `schedule.concurrency` repositories
+/// being worked on at a time
+pub fn run(repos_dir: &Path, schedule: &Schedule, only: &[String]) -> io::Result<Report> {
+    let repos: Vec<(String, PathBuf)> = git::find_repositories(repos_dir)?
+        .into_iter()
+        .filter(|(name, _)| only.is_empty() || only.contains(name))
+        .filter(|(_, path)| enabled(path))
+        .collect();
+
+    let next = AtomicUsize::new(0);
+    let runs = Mutex::new(Vec::new());
+    let span = tracing::Span::current();
+
+    std::thread::scope(|scope| {
+        for _ in 0..schedule.concurrency.max(1).min(repos.len()) {
+            scope.spawn(|| {
+                let _enter = span.enter();
+                while let Some((name, path)) = repos.get(next.fetch_add(1, Ordering::Relaxed)) {
+                    let results = run_repo(name, path, &schedule.tasks);
+                    runs.lock().unwrap().extend(results);
+                }
+            });
+        }
+    });
+
+    let mut runs = runs.into_inner().unwrap();
+    runs.sort_by(|a, b| a.repo.cmp(&b.repo));
+    Ok(Report { runs })
+}
+
+fn run_repo(name: &str, repo_path: &Path, tasks: &[Task]) -> Vec<TaskRun> {
+    tasks
+        .iter()
+        .map(|&task| {
+            let start = Instant::now();
+            let error = match git::run(repo_path, task.args()) {
+                Ok(output) if output.status.success() => None,
+                Ok(output) => Some(String::from_utf8_lossy(&output.stderr).trim().to_string()),
+                Err(e) => Some(e.to_string()),
+            };
+            TaskRun {
+                repo: name.to_string(),
+                task,
+                elapsed_ms: start.elapsed().as_millis() as u64,
+                error,
+            }
+        })
+        .collect()
+}
+
+/// Run maintenance every `interval`, logging failed tasks
+pub fn spawn(
+    repos_dir: PathBuf,
+    schedule: Schedule,
+    interval: Duration,
+) -> tokio::task::JoinHandle<()> {
+    jobs::spawn_periodic("repository_maintenance", interval, move || {
+        let report = run(&repos_dir, &schedule, &[])?;
+        for run in &report.runs {
+            match &run.error {
+                Some(e) => tracing::warn!(
+                    repo = %run.repo,
+                    task = run.task.name(),
+                    "Maintenance task failed: {}",
+                    e
+                ),
+                None => tracing::debug!(
+                    repo = %run.repo,
+                    task = run.task.name(),
+                    elapsed_ms = run.elapsed_ms,
+                    "Maintenance task finished"
+                ),
+            }
+        }
+        tracing::info!(
+            "Maintenance ran {} tasks, {} failed",
+            report.runs.len(),
+            report.failures()
+        );
+        Ok(())
+    })
+}
@@ -0,0 +1,136 @@
+//! Maintenance mode: the whole server, or one repository, keeps serving
+//! clones, fetches and pages but refuses changes, so operators can migrate
+//! data or move storage without pushes landing halfway through.
+//!
+//! The server's flag is `<data_dir>/maintenance.json`, and a repository's
+//! `agito/maintenance.json` inside it. Each holds a [`Notice`] saying why and
+//! since when. While one is set, pushes and server-side merges are refused
+//! with its message and the web interface shows it as a banner; the
+//! server-wide flag also stops new repositories and imports.
+
+use crate::git;
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+
+/// Why changes are refused, and since when
+#[derive(Clone, Debug, Serialize, Deserialize)]
+pub struct Notice {
+    /// Shown to users; may be empty
+    #[serde(default)]
+    pub message: String,
+    /// Unix time maintenance started
+    pub since: i64,
+    /// Who started it
+    #[serde(default)]
+    pub by: Option<String>,
+}
+
+impl Notice {
+    pub fn new(message: &str, by: Option<&str>) -> Self {
+        Self {
+            message: message.trim().to_string(),
+            since: chrono::Utc::now().timestamp(),
+            by: by.map(str::to_string),
+        }
+    }
+
+    /// The message in parentheses, or nothing without one
+    fn reason(&self) -> String {
+        if self.message.is_empty() {
+            String::new()
+        } else {
+            format!(" ({})", self.message)
+        }
+    }
+}
+
+fn server_path(data_dir: &Path) -> PathBuf {
+    data_dir.join("maintenance.json")
+}
+
+fn repo_notice_path(repo_path: &Path) -> PathBuf {
+    git::data_dir(repo_path).join("maintenance.json")
+}
+
+fn load(path: &Path) -> Option<Notice> {
+    let content = fs::read_to_string(path).ok()?;
+    match serde_json::from_str(&content) {
+        Ok(notice) => Some(notice),
+        Err(e) => {
+            // A damaged flag still means maintenance
+            tracing::warn!("Failed to parse {}: {}", path.display(), e);
+            Some(Notice {
+                message: String::new(),
+                since: 0,
+                by: None,
+            })
+        }
+    }
+}
+
+fn store(path: &Path, notice: Option<&Notice>) -> Result<()> {
+    let notice = match notice {
+        Some(notice) => notice,
+        None => {
+            return match fs::remove_file(path) {
+                Err(e) if e.kind() != io::ErrorKind::NotFound => {
+                    Err(e).with_context(|| format!("Failed to remove {}", path.display()))
+                }
+                _ => Ok(()),
+            }
+        }
+    };
+    if let Some(dir) = path.parent() {
+        fs::create_dir_all(dir)?;
+    }
+    let tmp = path.with_extension("json.tmp");
+    fs::write(&tmp, serde_json::to_string_pretty(notice)?)?;
+    fs::rename(&tmp, path).with_context(|| format!("Failed to write {}", path.display()))?;
+    Ok(())
+}
+
+/// The server's maintenance notice, if it is in maintenance
+pub fn server(data_dir: &Path) -> Option<Notice> {
+    load(&server_path(data_dir))
+}
+
+/// Put the server in maintenance, or end it with None
+pub fn set_server(data_dir: &Path, notice: Option<&Notice>) -> Result<()> {
+    store(&server_path(data_dir), notice)
+}
+
+/// A repository's own maintenance notice, if it is in maintenance
+pub fn repo(repo_path: &Path) -> Option<Notice> {
+    load(&repo_notice_path(repo_path))
+}
+
+/// Put a repository in maintenance, or end it with None
+pub fn set_repo(repo_path: &Path, notice: Option<&Notice>) -> Result<()> {
+    store(&repo_notice_path(repo_path), notice)
+}
+
+/// Why the server refuses changes while in maintenance
+pub fn server_refusal(notice: &Notice) -> String {
+    format!(
+        "The server is in maintenance{}; changes are refused until it is over, while clones and fetches work as usual",
+        notice.reason()
+    )
+}
+
+/// Why a change to the repository `repo_name` is refused, if the server or
+/// the repository is in maintenance
+pub fn refusal(data_dir: &Path, repo_name: &str, repo_path: &Path) -> Option<String> {
+    if let Some(notice) = server(data_dir) {
+        return Some(server_refusal(&notice));
+    }
+    repo(repo_path).map(|notice| {
+        format!(
+            "{} is in maintenance{}; changes are refused until it is over, while clones and fetches work as usual",
+            repo_name,
+            notice.reason()
+        )
+    })
+}
@@ -0,0 +1,618 @@
+//! Merging one branch into another on the server.
+//!
+//! The merge is done in a temporary worktree below `agito/merge/`, so git's
+//! own machinery resolves what it can and reports the rest as conflicts.
+//! Three strategies are offered, chosen per merge or defaulting to the
+//! repository's `agito.mergeStrategy`:
+//!
+//! - merge: a merge commit, authored and committed by the merging user
+//! - squash: one commit with all changes of the head, authored by the
+//!   author of its first commit and committed by the merging user
+//! - rebase: the head's commits replayed onto the base, keeping their
+//!   authors, with the merging user as committer; the base then fast-forwards
+//!
+//! The result is checked against the repository's protected branches and
+//! push policies and recorded like a push. The base branch is only moved if nobody pushed to
+//! it meanwhile.
+//!
+//! [`trial`] and [`preview`] merge without moving any branch, to tell
+//! whether a pull request merges cleanly and to build its merge ref.
+
+use crate::{ci, events, git, policies, protection, pulls};
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::process::Output;
+use std::str::FromStr;
+
+/// Name and email written into commits made by the server
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct Identity {
+    pub name: String,
+    pub email: String,
+}
+
+impl Identity {
+    /// Identity of an agito user, who has no email address on the server
+    pub fn for_user(user: &str) -> Self {
+        Self {
+            name: user.to_string(),
+            email: format!("{}@agito.invalid", user),
+        }
+    }
+
+    /// Environment making this identity the committer
+    fn committer_env(&self) -> [(&'static str, &str); 2] {
+        [
+            ("GIT_COMMITTER_NAME", &self.name),
+            ("GIT_COMMITTER_EMAIL", &self.email),
+        ]
+    }
+
+    /// Environment making this identity the author
+    fn author_env(&self) -> [(&'static str, &str); 2] {
+        [
+            ("GIT_AUTHOR_NAME", &self.name),
+            ("GIT_AUTHOR_EMAIL", &self.email),
+        ]
+    }
+}
+
+/// How the head's changes land on the base
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "kebab-case")]
+pub enum Strategy {
+    /// A merge commit with both branches as parents
+    #[default]
+    Merge,
+    /// A single new commit on the base with all of the head's changes
+    Squash,
+    /// The head's commits replayed onto the base, which fast-forwards to them
+    Rebase,
+}
+
+impl FromStr for Strategy {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "merge" => Ok(Self::Merge),
+            "squash" => Ok(Self::Squash),
+            "rebase" => Ok(Self::Rebase),
+            _ => Err(format!(
+                "unknown merge strategy '{}' (expected merge, squash or rebase)",
+                s
+            )),
+        }
+    }
+}
+
+impl Strategy {
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::Merge => "merge",
+            Self::Squash => "squash",
+            Self::Rebase => "rebase",
+        }
+    }
+
+    /// The repository's default, from `agito.mergeStrategy`
+    pub fn default_for(repo_path: &Path) -> Self {
+        git::config_get(repo_path, "agito.mergeStrategy")
+            .and_then(|value| {
+                value
+                    .parse()
+                    .map_err(|e| tracing::warn!("Ignoring agito.mergeStrategy: {}", e))
+                    .ok()
+            })
+            .unwrap_or_default()
+    }
+}
+
+/// A merge to perform
+#[derive(Clone, Debug)]
+pub struct Merge {
+    /// Branch merged into, which moves to the result
+    pub base: String,
+    /// Branch or commit merged
+    pub head: String,
+    /// The repository's default if None
+    pub strategy: Option<Strategy>,
+    /// Commit message of the merge or squash commit; generated if None
+    pub message: Option<String>,
+    /// User doing the merge, recorded as the pusher
+    pub user: Option<String>,
+    /// Committer of the new commits
+    pub identity: Identity,
+    /// What protected branches take the update as
+    pub via: protection::Via,
+}
+
+/// A file git could not merge on its own
+#[derive(Clone, Debug, PartialEq, Eq, Serialize)]
+pub struct Conflict {
+    pub path: String,
+    /// What both sides did, e.g. "both modified" or "deleted by them"
+    pub kind: String,
+}
+
+/// What a merge did
+#[derive(Clone, Debug, PartialEq, Eq, Serialize)]
+#[serde(tag = "status", rename_all = "kebab-case")]
+pub enum Outcome {
+    /// The base branch now points at `commit`
+    Merged { commit: String, strategy: Strategy },
+    /// The head is already part of the base; nothing changed
+    UpToDate,
+    /// Nothing changed because these files conflict
+    Conflicts { conflicts: Vec<Conflict> },
+}
+
+/// Removes the temporary worktree, however the merge ends
+struct Worktree<'a> {
+    repo_path: &'a Path,
+    dir: PathBuf,
+}
+
+impl Drop for Worktree<'_> {
+    fn drop(&mut self) {
+        let _ = git::run(
+            self.repo_path,
+            &["worktree", "remove", "--force", &self.dir.to_string_lossy()],
+        );
+        let _ = fs::remove_dir_all(&self.dir);
+        let _ = git::run(self.repo_path, &["worktree", "prune"]);
+    }
+}
+
+impl Merge {
+    pub fn run(&self, repo_path: &Path) -> Result<Outcome> {
+        let (base_ref, base, head) = self.resolve(repo_path)?;
+        if is_ancestor(repo_path, &head, &base)? {
+            return Ok(Outcome::UpToDate);
+        }
+
+        let strategy = self
+            .strategy
+            .unwrap_or_else(|| Strategy::default_for(repo_path));
+        let result = match strategy {
+            Strategy::Merge => self.merge_commit(repo_path, &base, &head)?,
+            Strategy::Squash => self.squash(repo_path, &base, &head)?,
+            Strategy::Rebase => self.rebase(repo_path, &base, &head)?,
+        };
+        let commit = match result {
+            Ok(commit) => commit,
+            Err(conflicts) => return Ok(Outcome::Conflicts { conflicts }),
+        };
+
+        self.update(repo_path, &base_ref, &base, &commit, strategy)?;
+        Ok(Outcome::Merged { commit, strategy })
+    }
+
+    /// Replay the base's own commits onto the head and move the base to the
+    /// result, the way a pull request's branch catches up with its target
+    /// by rebasing. The base branch is rewritten, so if it is protected this
+    /// needs `allow-force-push`.
+    pub fn rebase_onto(&self, repo_path: &Path) -> Result<Outcome> {
+        let (base_ref, base, head) = self.resolve(repo_path)?;
+        if is_ancestor(repo_path, &head, &base)? {
+            return Ok(Outcome::UpToDate);
+        }
+        let commit = match self.rebase(repo_path, &head, &base)? {
+            Ok(commit) => commit,
+            Err(conflicts) => return Ok(Outcome::Conflicts { conflicts }),
+        };
+        self.update(repo_path, &base_ref, &base, &commit, Strategy::Rebase)?;
+        Ok(Outcome::Merged {
+            commit,
+            strategy: Strategy::Rebase,
+        })
+    }
+
+    /// The base's ref name and the commits of the base and head
+    fn resolve(&self, repo_path: &Path) -> Result<(String, String, String)> {
+        for name in [&self.base, &self.head] {
+            if name.is_empty() || name.starts_with('-') {
+                anyhow::bail!("Invalid branch name '{}'", name);
+            }
+        }
+        let base_ref = format!("refs/heads/{}", self.base);
+        let base = rev_parse(repo_path, &base_ref)
+            .with_context(|| format!("Branch not found: {}", self.base))?;
+        let head = rev_parse(repo_path, &format!("refs/heads/{}", self.head))
+            .or_else(|| rev_parse(repo_path, &self.head))
+            .with_context(|| format!("Branch or commit not found: {}", self.head))?;
+        Ok((base_ref, base, head))
+    }
+
+    /// A merge commit of the head into the base
+    fn merge_commit(
+        &self,
+        repo_path: &Path,
+        base: &str,
+        head: &str,
+    ) -> Result<Result<String, Vec<Conflict>>> {
+        let worktree = self.checkout(repo_path, base)?;
+        // git wants a committer even though it doesn't commit here
+        let output = git::run_with_env(
+            &worktree.dir,
+            &["merge", "--no-ff", "--no-commit", "--quiet", head],
+            &self.identity.committer_env(),
+        )?;
+        if !output.status.success() {
+            return Ok(Err(failed(&worktree.dir, "merge", &output)?));
+        }
+
+        let message = self
+            .message
+            .clone()
+            .unwrap_or_else(|| format!("Merge branch '{}' into {}", self.head, self.base));
+        let env: Vec<_> = self
+            .identity
+            .author_env()
+            .into_iter()
+            .chain(self.identity.committer_env())
+            .collect();
+        commit_tree(&worktree.dir, &[base, head], &message, &env).map(Ok)
+    }
+
+    /// One commit on the base with all of the head's changes
+    fn squash(
+        &self,
+        repo_path: &Path,
+        base: &str,
+        head: &str,
+    ) -> Result<Result<String, Vec<Conflict>>> {
+        // Author, email and subject of each commit being squashed, oldest first
+        let log = stdout(
+            git::run(
+                repo_path,
+                &[
+                    "log",
+                    "--reverse",
+                    "--format=%an%x1f%ae%x1f%s",
+                    &format!("{}..{}", base, head),
+                ],
+            )?,
+            "log",
+        )?;
+        let commits: Vec<Vec<&str>> = log
+            .lines()
+            .map(|line| line.splitn(3, '\x1f').collect())
+            .filter(|fields: &Vec<&str>| fields.len() == 3)
+            .collect();
+
+        let worktree = self.checkout(repo_path, base)?;
+        let output = git::run_with_env(
+            &worktree.dir,
+            &["merge", "--squash", "--quiet", head],
+            &self.identity.committer_env(),
+        )?;
+        if !output.status.success() {
+            return Ok(Err(failed(&worktree.dir, "merge", &output)?));
+        }
+
+        // The first commit's author wrote the change; others are credited
+        let author = match commits.first() {
+            Some(first) => Identity {
+                name: first[0].to_string(),
+                email: first[1].to_string(),
+            },
+            None => self.identity.clone(),
+        };
+        let mut message = match (&self.message, &commits[..]) {
+            (Some(message), _) => message.clone(),
+            // A single commit keeps its whole message
+            (None, [_]) => stdout(
+                git::run(repo_path, &["log", "-1", "--format=%B", head])?,
+                "log",
+            )?,
+            (None, _) => {
+                let mut message = format!("Squash branch '{}' into {}\n", self.head, self.base);
+                for commit in &commits {
+                    message.push_str(&format!("\n* {}", commit[2]));
+                }
+                message
+            }
+        };
+        let mut co_authors: Vec<String> = Vec::new();
+        for commit in &commits {
+            let co_author = format!("Co-authored-by: {} <{}>", commit[0], commit[1]);
+            if commit[1] != author.email && !co_authors.contains(&co_author) {
+                co_authors.push(co_author);
+            }
+        }
+        if !co_authors.is_empty() {
+            message = format!("{}\n\n{}", message.trim_end(), co_authors.join("\n"));
+        }
+
+        let env: Vec<_> = author
+            .author_env()
+            .into_iter()
+            .chain(self.identity.committer_env())
+            .collect();
+        commit_tree(&worktree.dir, &[base], &message, &env).map(Ok)
+    }
+
+    /// The head's commits replayed onto the base; their new tip
+    fn rebase(
+        &self,
+        repo_path: &Path,
+        base: &str,
+        head: &str,
+    ) -> Result<Result<String, Vec<Conflict>>> {
+        // Already on top of the base: fast-forward without rewriting
+        if is_ancestor(repo_path, base, head)? {
+            return Ok(Ok(head.to_string()));
+        }
+
+        let worktree = self.checkout(repo_path, head)?;
+        // Only the committer is set, so the commits keep their authors
+        let output = git::run_with_env(
+            &worktree.dir,
+            &[
+                "rebase",
+                "--no-autosquash",
+                "--no-autostash",
+                "--quiet",
+                base,
+            ],
+            &self.identity.committer_env(),
+        )?;
+        if !output.status.success() {
+            return Ok(Err(failed(&worktree.dir, "rebase", &output)?));
+        }
+        stdout(
+            git::run(&worktree.dir, &["rev-parse", "HEAD"])?,
+            "rev-parse",
+        )
+        .map(Ok)
+    }
+
+    /// Check out `commit` in a new temporary worktree
+    fn checkout<'a>(&self, repo_path: &'a Path, commit: &str) -> Result<Worktree<'a>> {
+        let parent = git::data_dir(repo_path).join("merge");
+        fs::create_dir_all(&parent)?;
+        // git resolves a relative path from inside the repository
+        let parent = parent.canonicalize()?;
+        let dir = parent.join(format!(
+            "{}-{}",
+            std::process::id(),
+            chrono::Utc::now().timestamp_nanos_opt().unwrap_or_default()
+        ));
+        let worktree = Worktree { repo_path, dir };
+        let output = git::run(
+            repo_path,
+            &[
+                "worktree",
+                "add",
+                "--detach",
+                "--quiet",
+                &worktree.dir.to_string_lossy(),
+                commit,
+            ],
+        )?;
+        if !output.status.success() {
+            anyhow::bail!("Failed to check out {}: {}", commit, stderr(&output));
+        }
+        Ok(worktree)
+    }
+
+    /// Move the base branch to the result, as a push would
+    fn update(
+        &self,
+        repo_path: &Path,
+        base_ref: &str,
+        old: &str,
+        new: &str,
+        strategy: Strategy,
+    ) -> Result<()> {
+        let updates = [(old.to_string(), new.to_string(), base_ref.to_string())];
+        let mut violations = protection::check(repo_path, &updates, self.via)?;
+        violations.extend(policies::check(repo_path, &updates)?);
+        if !violations.is_empty() {
+            anyhow::bail!("{}", policies::report(&violations).trim_end());
+        }
+
+        let reflog = format!("{} {}: by agito", strategy.name(), self.head);
+        let output = git::run(
+            repo_path,
+            &["update-ref", "-m", &reflog, base_ref, new, old],
+        )?;
+        if !output.status.success() {
+            anyhow::bail!(
+                "{} changed while merging; try again ({})",
+                self.base,
+                stderr(&output)
+            );
+        }
+        if let Err(e) = events::record(repo_path, &updates, self.user.as_deref()) {
+            tracing::warn!("Failed to record merge into {}: {:#}", base_ref, e);
+        }
+        if let Err(e) = pulls::sync(repo_path, &updates, self.user.as_deref()) {
+            tracing::warn!("Failed to update pull requests after merge: {:#}", e);
+        }
+        if let Err(e) = ci::enqueue(repo_path, &updates, self.user.as_deref()) {
+            tracing::warn!("Failed to queue builds after merge: {:#}", e);
+        }
+        Ok(())
+    }
+}
+
+/// Merge `head` into `base` without touching any ref or worktree: the
+/// merged tree, or the files that conflict
+pub fn trial(repo_path: &Path, base: &str, head: &str) -> Result<Result<String, Vec<Conflict>>> {
+    let output = git::run(
+        repo_path,
+        &[
+            "-c",
+            "core.quotePath=false",
+            "merge-tree",
+            "--write-tree",
+            base,
+            head,
+        ],
+    )?;
+    let stdout = String::from_utf8_lossy(&output.stdout);
+    let mut lines = stdout.lines();
+    let tree = lines.next().unwrap_or("").to_string();
+    match output.status.code() {
+        Some(0) => return Ok(Ok(tree)),
+        Some(1) => {}
+        _ => anyhow::bail!("git merge-tree failed: {}", stderr(&output)),
+    }
+
+    // `<mode> <object> <stage>\t<path>` for every unmerged file, then a
+    // blank line and git's messages
+    let mut stages: Vec<(String, Vec<char>)> = Vec::new();
+    for line in lines.take_while(|line| !line.is_empty()) {
+        let (info, path) = match line.split_once('\t') {
+            Some(split) => split,
+            None => continue,
+        };
+        let stage = info.rsplit(' ').next().and_then(|s| s.chars().next());
+        match (stages.iter_mut().find(|(p, _)| p == path), stage) {
+            (Some((_, found)), Some(stage)) => found.push(stage),
+            (None, Some(stage)) => stages.push((path.to_string(), vec![stage])),
+            _ => {}
+        }
+    }
+    Ok(Err(stages
+        .into_iter()
+        .map(|(path, stages)| {
+            let has = |stage| stages.contains(&stage);
+            // Stage 1 is the common ancestor, 2 the base and 3 the head
+            let kind = match (has('1'), has('2'), has('3')) {
+                (true, true, true) => "both modified",
+                (false, true, true) => "both added",
+                (true, true, false) => "deleted by them",
+                (true, false, true) => "deleted by us",
+                (false, true, false) => "added by us",
+                (false, false, true) => "added by them",
+                _ => "both deleted",
+            };
+            Conflict {
+                path,
+                kind: kind.to_string(),
+            }
+        })
+        .collect()))
+}
+
+/// A merge commit of `head` into `base` that no branch points to, such as
+/// the trial merge of a pull request, or the files that conflict
+pub fn preview(
+    repo_path: &Path,
+    base: &str,
+    head: &str,
+    message: &str,
+    identity: &Identity,
+) -> Result<Result<String, Vec<Conflict>>> {
+    let tree = match trial(repo_path, base, head)? {
+        Ok(tree) => tree,
+        Err(conflicts) => return Ok(Err(conflicts)),
+    };
+    let env: Vec<_> = identity
+        .author_env()
+        .into_iter()
+        .chain(identity.committer_env())
+        .collect();
+    stdout(
+        git::run_with_env(
+            repo_path,
+            &["commit-tree", &tree, "-p", base, "-p", head, "-m", message],
+            &env,
+        )?,
+        "commit-tree",
+    )
+    .map(Ok)
+}
+
+/// Conflicts left in the worktree by a failed merge or rebase, or an error
+/// if git failed for another reason
+fn failed(worktree: &Path, command: &str, output: &Output) -> Result<Vec<Conflict>> {
+    let conflicts = conflicts(worktree)?;
+    if conflicts.is_empty() {
+        anyhow::bail!("git {} failed: {}", command, stderr(output));
+    }
+    Ok(conflicts)
+}
+
+/// Unmerged files left in a worktree by a failed merge
+fn conflicts(worktree: &Path) -> Result<Vec<Conflict>> {
+    let output = git::run(
+        worktree,
+        &["-c", "core.quotePath=false", "status", "--porcelain"],
+    )?;
+    Ok(String::from_utf8_lossy(&output.stdout)
+        .lines()
+        .filter_map(|line| {
+            let kind = match line.get(..2)? {
+                "UU" => "both modified",
+                "AA" => "both added",
+                "DD" => "both deleted",
+                "AU" => "added by us",
+                "UA" => "added by them",
+                "DU" => "deleted by us",
+                "UD" => "deleted by them",
+                _ => return None,
+            };
+            Some(Conflict {
+                path: line.get(3..)?.to_string(),
+                kind: kind.to_string(),
+            })
+        })
+        .collect())
+}
+
+/// Commit the worktree's index with the given parents
+fn commit_tree(
+    worktree: &Path,
+    parents: &[&str],
+    message: &str,
+    env: &[(&str, &str)],
+) -> Result<String> {
+    let tree = stdout(git::run(worktree, &["write-tree"])?, "write-tree")?;
+    let mut args = vec!["commit-tree", tree.as_str()];
+    for parent in parents {
+        args.extend(["-p", parent]);
+    }
+    args.extend(["-m", message]);
+    stdout(git::run_with_env(worktree, &args, env)?, "commit-tree")
+}
+
+pub fn is_ancestor(repo_path: &Path, ancestor: &str, descendant: &str) -> Result<bool> {
+    let output = git::run(
+        repo_path,
+        &["merge-base", "--is-ancestor", ancestor, descendant],
+    )?;
+    Ok(output.status.success())
+}
+
+/// Commit a revision points to
+pub fn rev_parse(repo_path: &Path, rev: &str) -> Option<String> {
+    let output = git::run(
+        repo_path,
+        &[
+            "rev-parse",
+            "--verify",
+            "--quiet",
+            &format!("{}^{{commit}}", rev),
+        ],
+    )
+    .ok()?;
+    stdout(output, "rev-parse").ok()
+}
+
+/// Trimmed standard output of a git command that must succeed
+fn stdout(output: Output, command: &str) -> Result<String> {
+    if !output.status.success() {
+        anyhow::bail!("git {} failed: {}", command, stderr(&output));
+    }
+    Ok(String::from_utf8_lossy(&output.stdout).trim().to_string())
+}
+
+fn stderr(output: &Output) -> String {
+    String::from_utf8_lossy(&output.stderr).trim().to_string()
+}
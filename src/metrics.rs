@@ -0,0 +1,377 @@
+use crate::git::limits::{Pool, Pools};
+use crate::usage;
+use std::collections::BTreeMap;
+use std::fmt::Write;
+use std::sync::atomic::{AtomicI64, AtomicU64, Ordering};
+use std::sync::{Mutex, OnceLock};
+use std::time::Duration;
+
+/// Upper bounds (seconds) of the latency histogram buckets
+const BUCKETS: [f64; 12] = [
+    0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0, 10.0, 30.0,
+];
+
+#[derive(Clone, Default)]
+struct Histogram {
+    buckets: [u64; BUCKETS.len()],
+    count: u64,
+    sum: f64,
+}
+
+impl Histogram {
+    fn observe(&mut self, value: f64) {
+        for (bucket, bound) in self.buckets.iter_mut().zip(BUCKETS) {
+            if value <= bound {
+                *bucket += 1;
+            }
+        }
+        self.count += 1;
+        self.sum += value;
+    }
+}
+
+/// Process-wide counters, exported in the Prometheus text format on /metrics
+#[derive(Default)]
+pub struct Metrics {
+    http_requests: Mutex<BTreeMap<(String, String, u16), u64>>,
+    http_duration: Mutex<BTreeMap<(String, String), Histogram>>,
+    ssh_sessions_active: AtomicI64,
+    ssh_sessions: AtomicU64,
+    ssh_commands: Mutex<BTreeMap<String, u64>>,
+    git_duration: Mutex<BTreeMap<String, Histogram>>,
+    auth_failures: Mutex<BTreeMap<String, u64>>,
+    rate_limited: Mutex<BTreeMap<String, u64>>,
+    git_protocols: Mutex<BTreeMap<(String, String), u64>>,
+}
+
+/// The metrics registry shared by the HTTP and SSH servers
+pub fn global() -> &'static Metrics {
+    static METRICS: OnceLock<Metrics> = OnceLock::new();
+    METRICS.get_or_init(Metrics::default)
+}
+
+/// Keeps an SSH session counted as active until dropped
+pub struct SessionGuard(());
+
+impl Drop for SessionGuard {
+    fn drop(&mut self) {
+        global().ssh_sessions_active.fetch_sub(1, Ordering::Relaxed);
+    }
+}
+
+impl Metrics {
+    /// Record a finished HTTP request. `route` should be the matched route
+    /// pattern, not the raw path, to keep the number of series bounded.
+    pub fn http_request(&self, method: &str, route: &str, status: u16, elapsed: Duration) {
+        // Clients may send any method; unknown ones would each add a series
+        let method = match method {
+            "GET" | "HEAD" | "POST" | "PUT" | "PATCH" | "DELETE" | "OPTIONS" => method,
+            _ => "other",
+        };
+        *self
+            .http_requests
+            .lock()
+            .unwrap()
+            .entry((method.to_string(), route.to_string(), status))
+            .or_default() += 1;
+        self.http_duration
+            .lock()
+            .unwrap()
+            .entry((method.to_string(), route.to_string()))
+            .or_default()
+            .observe(elapsed.as_secs_f64());
+    }
+
+    /// Count a new SSH session; it stays active until the guard is dropped
+    pub fn ssh_session_started(&self) -> SessionGuard {
+        self.ssh_sessions.fetch_add(1, Ordering::Relaxed);
+        self.ssh_sessions_active.fetch_add(1, Ordering::Relaxed);
+        SessionGuard(())
+    }
+
+    /// Count a command executed over SSH, by program name
+    pub fn ssh_command(&self, command: &str) {
+        let program = command.split_whitespace().next().unwrap_or("");
+        let program = match program {
+            "git-upload-pack"
+            | "git-receive-pack"
+            | "git-upload-archive"
+            | "agito-create-repo"
+            | "agito-info"
+            | "agito-bundle"
+            | "agito-ping"
+            | "git-lfs-authenticate" => program,
+            _ => "other",
+        };
+        *self
+            .ssh_commands
+            .lock()
+            .unwrap()
+            .entry(program.to_string())
+            .or_default() += 1;
+    }
+
+    /// Record a finished git subprocess, by git subcommand
+    pub fn git_subprocess(&self, command: &str, elapsed: Duration) {
+        self.git_duration
+            .lock()
+            .unwrap()
+            .entry(command.to_string())
+            .or_default()
+            .observe(elapsed.as_secs_f64());
+    }
+
+    /// Count a rejected authentication attempt
+    pub fn auth_failure(&self, protocol: &str) {
+        *self
+            .auth_failures
+            .lock()
+            .unwrap()
+            .entry(protocol.to_string())
+            .or_default() += 1;
+    }
+
+    /// Count a request turned away by a rate limit, by the kind of limit
+    pub fn rate_limited(&self, limit: &str) {
+        *self
+            .rate_limited
+            .lock()
+            .unwrap()
+            .entry(limit.to_string())
+            .or_default() += 1;
+    }
+
+    /// Count a clone, fetch or push by transport and the wire protocol
+    /// version the client asked for
+    pub fn git_protocol(&self, transport: &str, version: &str) {
+        *self
+            .git_protocols
+            .lock()
+            .unwrap()
+            .entry((transport.to_string(), version.to_string()))
+            .or_default() += 1;
+    }
+
+    /// Render all metrics in the Prometheus text exposition format.
+    /// Repository gauges come from the repository count and the last disk usage scan,
+    /// and git process gauges from the pools limiting them. The scan names
+    /// every repository, private ones too, so it is only given for admins.
+    pub fn render(
+        &self,
+        repositories: usize,
+        disk_usage: Option<&usage::Snapshot>,
+        git_pools: &Pools,
+    ) -> String {
+        let mut out = String::new();
+
+        header(
+            &mut out,
+            "agito_http_requests_total",
+            "counter",
+            "HTTP requests by method, route and status",
+        );
+        for ((method, route, status), count) in self.http_requests.lock().unwrap().iter() {
+            let _ = writeln!(
+                out,
+                "agito_http_requests_total{{method=\"{}\",route=\"{}\",status=\"{}\"}} {}",
+                escape(method),
+                escape(route),
+                status,
+                count
+            );
+        }
+
+        header(
+            &mut out,
+            "agito_http_request_duration_seconds",
+            "histogram",
+            "HTTP request latency by method and route",
+        );
+        for ((method, route), histogram) in self.http_duration.lock().unwrap().iter() {
+            let labels = format!("method=\"{}\",route=\"{}\"", escape(method), escape(route));
+            write_histogram(
+                &mut out,
+                "agito_http_request_duration_seconds",
+                &labels,
+                histogram,
+            );
+        }
+
+        header(
+            &mut out,
+            "agito_ssh_sessions_active",
+            "gauge",
+            "SSH sessions currently open",
+        );
+        let _ = writeln!(
+            out,
+            "agito_ssh_sessions_active {}",
+            self.ssh_sessions_active.load(Ordering::Relaxed)
+        );
+
+        header(
+            &mut out,
+            "agito_ssh_sessions_total",
+            "counter",
+            "SSH sessions accepted",
+        );
+        let _ = writeln!(
+            out,
+            "agito_ssh_sessions_total {}",
+            self.ssh_sessions.load(Ordering::Relaxed)
+        );
+
+        header(
+            &mut out,
+            "agito_ssh_commands_total",
+            "counter",
+            "Commands executed over SSH by program",
+        );
+        for (command, count) in self.ssh_commands.lock().unwrap().iter() {
+            let _ = writeln!(
+                out,
+                "agito_ssh_commands_total{{command=\"{}\"}} {}",
+                escape(command),
+                count
+            );
+        }
+
+        header(
+            &mut out,
+            "agito_git_subprocess_duration_seconds",
+            "histogram",
+            "Duration of git subprocesses by subcommand",
+        );
+        for (command, histogram) in self.git_duration.lock().unwrap().iter() {
+            let labels = format!("command=\"{}\"", escape(command));
+            write_histogram(
+                &mut out,
+                "agito_git_subprocess_duration_seconds",
+                &labels,
+                histogram,
+            );
+        }
+
+        header(
+            &mut out,
+            "agito_git_protocol_total",
+            "counter",
+            "Clones, fetches and pushes by transport and wire protocol version",
+        );
+        for ((transport, version), count) in self.git_protocols.lock().unwrap().iter() {
+            let _ = writeln!(
+                out,
+                "agito_git_protocol_total{{transport=\"{}\",version=\"{}\"}} {}",
+                escape(transport),
+                escape(version),
+                count
+            );
+        }
+
+        header(
+            &mut out,
+            "agito_git_processes",
+            "gauge",
+            "Git processes running and waiting for a place, by pool",
+        );
+        for pool in Pool::ALL {
+            let (running, waiting) = git_pools.load(pool);
+            for (state, count) in [("running", running), ("waiting", waiting)] {
+                let _ = writeln!(
+                    out,
+                    "agito_git_processes{{pool=\"{}\",state=\"{}\"}} {}",
+                    pool.name(),
+                    state,
+                    count
+                );
+            }
+        }
+
+        header(
+            &mut out,
+            "agito_auth_failures_total",
+            "counter",
+            "Rejected authentication attempts by protocol",
+        );
+        for (protocol, count) in self.auth_failures.lock().unwrap().iter() {
+            let _ = writeln!(
+                out,
+                "agito_auth_failures_total{{protocol=\"{}\"}} {}",
+                escape(protocol),
+                count
+            );
+        }
+
+        header(
+            &mut out,
+            "agito_rate_limited_total",
+            "counter",
+            "Requests turned away by rate limits, by limit",
+        );
+        for (limit, count) in self.rate_limited.lock().unwrap().iter() {
+            let _ = writeln!(
+                out,
+                "agito_rate_limited_total{{limit=\"{}\"}} {}",
+                escape(limit),
+                count
+            );
+        }
+
+        header(
+            &mut out,
+            "agito_repositories",
+            "gauge",
+            "Repositories hosted by the server",
+        );
+        let _ = writeln!(out, "agito_repositories {}", repositories);
+
+        if let Some(disk_usage) = disk_usage {
+            header(
+                &mut out,
+                "agito_repository_size_bytes",
+                "gauge",
+                "Disk space used by each repository at the last scan",
+            );
+            for (name, repo) in &disk_usage.repos {
+                let _ = writeln!(
+                    out,
+                    "agito_repository_size_bytes{{repo=\"{}\"}} {}",
+                    escape(name),
+                    repo.bytes
+                );
+            }
+        }
+
+        out
+    }
+}
+
+fn header(out: &mut String, name: &str, kind: &str, help: &str) {
+    let _ = writeln!(out, "# HELP {} {}", name, help);
+    let _ = writeln!(out, "# TYPE {} {}", name, kind);
+}
+
+fn write_histogram(out: &mut String, name: &str, labels: &str, histogram: &Histogram) {
+    for (bound, count) in BUCKETS.iter().zip(histogram.buckets) {
+        let _ = writeln!(
+            out,
+            "{}_bucket{{{},le=\"{}\"}} {}",
+            name, labels, bound, count
+        );
+    }
+    let _ = writeln!(
+        out,
+        "{}_bucket{{{},le=\"+Inf\"}} {}",
+        name, labels, histogram.count
+    );
+    let _ = writeln!(out, "{}_sum{{{}}} {}", name, labels, histogram.sum);
+    let _ = writeln!(out, "{}_count{{{}}} {}", name, labels, histogram.count);
+}
+
+/// Escape a label value
+fn escape(value: &str) -> String {
+    value
+        .replace('\\', "\\\\")
+        .replace('"', "\\\"")
+        .replace('\n', "\\n")
+}
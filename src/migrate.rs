@@ -0,0 +1,592 @@
+//! Migrating a project's discussion history from GitHub or GitLab: labels,
+//! milestones, issues with their comments, and releases, read from the
+//! forge's REST API into agito's stores.
+//!
+//! Issues keep their numbers, so references like `#12` still point at the
+//! right issue, and their original times. Pull requests are not brought
+//! over; on GitHub they share numbers with issues and leave gaps. Users are
+//! mapped to accounts by the public email address of their forge profile,
+//! or as given explicitly; others are recorded as `github:<login>` or
+//! `gitlab:<username>`, which no account can be. Whatever exists already,
+//! such as an issue with the same number or a release of the same tag, is
+//! left alone, so an interrupted migration can be run again.
+//!
+//! Requests are made with curl. A token is needed for private projects and
+//! raises the API's rate limits.
+
+use crate::issues::{self, Comment, Issue, Label, Milestone, State};
+use crate::releases::{self, Release};
+use crate::users;
+use anyhow::{Context, Result};
+use serde_json::Value;
+use std::collections::{BTreeMap, HashMap};
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::process::{Command, Stdio};
+use std::str::FromStr;
+use std::time::Duration;
+
+/// Items asked for per page
+const PAGE_SIZE: usize = 100;
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum Forge {
+    GitHub,
+    GitLab,
+}
+
+impl FromStr for Forge {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "github" => Ok(Self::GitHub),
+            "gitlab" => Ok(Self::GitLab),
+            _ => Err(format!("unknown forge '{}' (expected github or gitlab)", s)),
+        }
+    }
+}
+
+impl Forge {
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::GitHub => "github",
+            Self::GitLab => "gitlab",
+        }
+    }
+}
+
+/// A project on a forge
+#[derive(Clone, Debug)]
+pub struct Source {
+    pub forge: Forge,
+    /// Base URL of the web interface, e.g. https://github.com
+    pub web_url: String,
+    /// Base URL of the REST API
+    pub api_url: String,
+    /// Owner and name, e.g. acme/webshop; GitLab groups may nest
+    pub project: String,
+    /// Access token, sent as a bearer token
+    pub token: Option<String>,
+    /// Path of the curl binary
+    pub curl: PathBuf,
+    /// Longest a request may take
+    pub timeout: Duration,
+}
+
+impl Source {
+    /// A project given as `github:<owner>/<repo>`, `gitlab:<group>/<repo>` or
+    /// the URL of its page. URLs on other hosts are taken for a self-managed
+    /// GitLab unless `forge` says otherwise.
+    pub fn parse(source: &str, forge: Option<Forge>) -> Result<Self> {
+        let (forge, web_url, project) = if let Some(project) = source.strip_prefix("github:") {
+            (Forge::GitHub, "https://github.com".to_string(), project)
+        } else if let Some(project) = source.strip_prefix("gitlab:") {
+            (Forge::GitLab, "https://gitlab.com".to_string(), project)
+        } else {
+            let rest = source
+                .strip_prefix("https://")
+                .or_else(|| source.strip_prefix("http://"))
+                .with_context(|| {
+                    format!(
+                        "Unknown source '{}' (expected github:<owner>/<repo>, gitlab:<group>/<repo> or a project URL)",
+                        source
+                    )
+                })?;
+            let (host, project) = rest
+                .split_once('/')
+                .with_context(|| format!("No project in '{}'", source))?;
+            let scheme = &source[..source.len() - rest.len()];
+            let forge = forge.unwrap_or(if host.eq_ignore_ascii_case("github.com") {
+                Forge::GitHub
+            } else {
+                Forge::GitLab
+            });
+            (forge, format!("{}{}", scheme, host), project)
+        };
+        let project = project.trim_matches('/');
+        let project = project.strip_suffix(".git").unwrap_or(project).to_string();
+        if project.split('/').count() < 2 || project.split('/').any(str::is_empty) {
+            anyhow::bail!("Expected <owner>/<repo>, not '{}'", project);
+        }
+        let api_url = match forge {
+            Forge::GitHub if web_url == "https://github.com" => {
+                "https://api.github.com".to_string()
+            }
+            // GitHub Enterprise Server
+            Forge::GitHub => format!("{}/api/v3", web_url),
+            Forge::GitLab => format!("{}/api/v4", web_url),
+        };
+        Ok(Source {
+            forge,
+            web_url,
+            api_url,
+            project,
+            token: None,
+            curl: PathBuf::from("curl"),
+            timeout: Duration::from_secs(60),
+        })
+    }
+
+    pub fn with_token(mut self, token: Option<String>) -> Self {
+        self.token = token;
+        self
+    }
+
+    /// URL to clone the repository from, with the token in it if there is one
+    pub fn clone_url(&self) -> String {
+        let (scheme, host) = self
+            .web_url
+            .split_once("://")
+            .unwrap_or(("https", &self.web_url));
+        match &self.token {
+            Some(token) => {
+                let user = match self.forge {
+                    Forge::GitHub => "x-access-token",
+                    Forge::GitLab => "oauth2",
+                };
+                format!(
+                    "{}://{}:{}@{}/{}.git",
+                    scheme, user, token, host, self.project
+                )
+            }
+            None => format!("{}/{}.git", self.web_url, self.project),
+        }
+    }
+
+    /// API path of the project
+    fn project_path(&self) -> String {
+        match self.forge {
+            Forge::GitHub => format!("/repos/{}", self.project),
+            Forge::GitLab => format!("/projects/{}", self.project.replace('/', "%2F")),
+        }
+    }
+
+    /// GET an API path, returning the JSON response
+    fn get(&self, path: &str) -> Result<Value> {
+        let url = format!("{}{}", self.api_url, path);
+        let mut command = Command::new(&self.curl);
+        command
+            .args(["--silent", "--show-error", "--fail-with-body", "--location"])
+            .args(["--proto", "=http,https", "--max-time"])
+            .arg(self.timeout.as_secs().max(1).to_string())
+            .args(["--user-agent", "agito-migrate", "--header"])
+            .arg(match self.forge {
+                Forge::GitHub => "Accept: application/vnd.github+json",
+                Forge::GitLab => "Accept: application/json",
+            });
+        // The token goes in on stdin, where other users can't see it
+        if self.token.is_some() {
+            command.args(["--header", "@-"]);
+        }
+        let mut child = command
+            .arg("--")
+            .arg(&url)
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::piped())
+            .spawn()
+            .with_context(|| format!("Failed to run {}", self.curl.display()))?;
+        if let (Some(mut stdin), Some(token)) = (child.stdin.take(), &self.token) {
+            let _ = writeln!(stdin, "Authorization: Bearer {}", token.trim());
+        }
+        let output = child.wait_with_output()?;
+        if !output.status.success() {
+            anyhow::bail!(
+                "GET {} failed: {} {}",
+                url,
+                String::from_utf8_lossy(&output.stderr).trim(),
+                String::from_utf8_lossy(&output.stdout)
+                    .chars()
+                    .take(200)
+                    .collect::<String>()
+            );
+        }
+        serde_json::from_slice(&output.stdout).with_context(|| format!("{} sent invalid JSON", url))
+    }
+
+    /// Every item of a paged list
+    fn get_all(&self, path: &str) -> Result<Vec<Value>> {
+        let separator = if path.contains('?') { '&' } else { '?' };
+        let mut items = Vec::new();
+        for page in 1.. {
+            let response = self.get(&format!(
+                "{}{}per_page={}&page={}",
+                path, separator, PAGE_SIZE, page
+            ))?;
+            let batch = match response {
+                Value::Array(batch) => batch,
+                other => anyhow::bail!("Expected a list from {}, got {}", path, other),
+            };
+            let last = batch.len() < PAGE_SIZE;
+            items.extend(batch);
+            if last {
+                break;
+            }
+        }
+        Ok(items)
+    }
+}
+
+/// What a migration brought over
+#[derive(Clone, Debug, Default)]
+pub struct Summary {
+    pub labels: usize,
+    pub milestones: usize,
+    pub issues: usize,
+    pub comments: usize,
+    /// Issues left alone because their number was taken
+    pub skipped_issues: usize,
+    pub releases: usize,
+    /// Forge users mapped to accounts, by their forge name
+    pub mapped_users: BTreeMap<String, String>,
+    /// Forge users without an account
+    pub unmapped_users: Vec<String>,
+}
+
+/// Bringing a project's history into a repository
+pub struct Migration<'a> {
+    pub source: &'a Source,
+    pub repo_path: &'a Path,
+    /// Holds the accounts users are mapped to
+    pub data_dir: &'a Path,
+    /// Accounts for forge users, overriding the email lookup
+    pub user_map: BTreeMap<String, String>,
+}
+
+/// Unix time of an ISO 8601 timestamp or date
+fn timestamp(value: &Value) -> Option<i64> {
+    let text = value.as_str()?;
+    chrono::DateTime::parse_from_rfc3339(text)
+        .map(|t| t.timestamp())
+        .ok()
+        .or_else(|| {
+            chrono::NaiveDate::parse_from_str(text, "%Y-%m-%d")
+                .ok()?
+                .and_hms_opt(0, 0, 0)
+                .map(|t| t.and_utc().timestamp())
+        })
+}
+
+fn text(value: &Value) -> String {
+    value.as_str().unwrap_or("").trim_end().to_string()
+}
+
+impl Migration<'_> {
+    pub fn run(&self, progress: &mut dyn FnMut(&str)) -> Result<Summary> {
+        let mut summary = Summary::default();
+        let mut users = Users {
+            migration: self,
+            known: HashMap::new(),
+        };
+        let project = self.source.project_path();
+
+        progress("Labels\n");
+        let labels: Vec<Label> = self
+            .source
+            .get_all(&format!("{}/labels", project))?
+            .iter()
+            .filter_map(|label| {
+                let name = label["name"].as_str()?.trim().to_string();
+                // Labels with commas can't be told apart in a list of labels
+                if name.is_empty() || name.contains(',') {
+                    return None;
+                }
+                let color = label["color"].as_str().map(|color| {
+                    format!("#{}", color.trim_start_matches('#').to_ascii_lowercase())
+                });
+                Some(Label {
+                    name,
+                    color,
+                    description: text(&label["description"]),
+                })
+            })
+            .collect();
+        summary.labels = labels.len();
+        issues::define_labels(self.repo_path, labels)?;
+
+        progress("Milestones\n");
+        let milestones: Vec<Milestone> = self
+            .source
+            .get_all(&match self.source.forge {
+                Forge::GitHub => format!("{}/milestones?state=all", project),
+                Forge::GitLab => format!("{}/milestones", project),
+            })?
+            .iter()
+            .filter_map(|milestone| {
+                Some(Milestone {
+                    title: milestone["title"].as_str()?.to_string(),
+                    description: text(&milestone["description"]),
+                    state: match milestone["state"].as_str() {
+                        Some("closed") => State::Closed,
+                        _ => State::Open,
+                    },
+                    due: timestamp(&milestone["due_on"])
+                        .or_else(|| timestamp(&milestone["due_date"])),
+                })
+            })
+            .collect();
+        summary.milestones = milestones.len();
+        issues::save_milestones(self.repo_path, milestones)?;
+
+        progress("Issues\n");
+        let mut found = match self.source.forge {
+            Forge::GitHub => self.github_issues(&mut users)?,
+            Forge::GitLab => self.gitlab_issues(&mut users, progress)?,
+        };
+        found.sort_by_key(|issue| issue.number);
+        for issue in &found {
+            if issues::import(self.repo_path, issue)? {
+                summary.issues += 1;
+                summary.comments += issue.comments.len();
+            } else {
+                summary.skipped_issues += 1;
+            }
+        }
+
+        progress("Releases\n");
+        let existing: Vec<String> = releases::list(self.repo_path)?
+            .into_iter()
+            .map(|release| release.tag)
+            .collect();
+        for release in self.source.get_all(&format!("{}/releases", project))? {
+            let tag = match release["tag_name"].as_str() {
+                Some(tag) if !existing.iter().any(|t| t == tag) => tag.to_string(),
+                _ => continue,
+            };
+            releases::save(
+                self.repo_path,
+                Release {
+                    tag,
+                    name: text(&release["name"]),
+                    body: text(if release["body"].is_string() {
+                        &release["body"]
+                    } else {
+                        &release["description"]
+                    }),
+                    author: users.name(&release["author"])?,
+                    created: timestamp(&release["published_at"])
+                        .or_else(|| timestamp(&release["released_at"]))
+                        .or_else(|| timestamp(&release["created_at"]))
+                        .unwrap_or_default(),
+                    prerelease: release["prerelease"].as_bool().unwrap_or(false)
+                        || release["upcoming_release"].as_bool().unwrap_or(false),
+                    draft: release["draft"].as_bool().unwrap_or(false),
+                    assets: Vec::new(),
+                },
+            )?;
+            summary.releases += 1;
+        }
+
+        for (forge_user, account) in users.known {
+            match account {
+                Some(account) => {
+                    summary.mapped_users.insert(forge_user, account);
+                }
+                None => summary.unmapped_users.push(forge_user),
+            }
+        }
+        summary.unmapped_users.sort();
+        Ok(summary)
+    }
+
+    fn github_issues(&self, users: &mut Users) -> Result<Vec<Issue>> {
+        let project = self.source.project_path();
+        let mut found = BTreeMap::new();
+        for item in self
+            .source
+            .get_all(&format!("{}/issues?state=all&direction=asc", project))?
+        {
+            // Pull requests are issues too in this API
+            if !item["pull_request"].is_null() {
+                continue;
+            }
+            let issue = self.issue(users, &item, item["number"].as_u64(), &item["body"])?;
+            if let Some(issue) = issue {
+                found.insert(issue.number, issue);
+            }
+        }
+        // All comments at once, rather than a request per issue
+        for comment in self.source.get_all(&format!(
+            "{}/issues/comments?sort=created&direction=asc",
+            project
+        ))? {
+            let number = comment["issue_url"]
+                .as_str()
+                .and_then(|url| url.rsplit('/').next())
+                .and_then(|number| number.parse::<u64>().ok());
+            if let Some(issue) = number.and_then(|number| found.get_mut(&number)) {
+                issue.comments.push(Comment {
+                    author: users.name(&comment["user"])?,
+                    body: text(&comment["body"]),
+                    created: timestamp(&comment["created_at"]).unwrap_or_default(),
+                });
+            }
+        }
+        Ok(found.into_values().collect())
+    }
+
+    fn gitlab_issues(
+        &self,
+        users: &mut Users,
+        progress: &mut dyn FnMut(&str),
+    ) -> Result<Vec<Issue>> {
+        let project = self.source.project_path();
+        let items = self
+            .source
+            .get_all(&format!("{}/issues?scope=all&state=all&sort=asc", project))?;
+        let mut found = Vec::new();
+        for (i, item) in items.iter().enumerate() {
+            let mut issue =
+                match self.issue(users, item, item["iid"].as_u64(), &item["description"])? {
+                    Some(issue) => issue,
+                    None => continue,
+                };
+            if (i + 1) % 50 == 0 {
+                progress(&format!(
+                    "Comments of {} of {} issues\n",
+                    i + 1,
+                    items.len()
+                ));
+            }
+            if item["user_notes_count"].as_u64() != Some(0) {
+                for note in self.source.get_all(&format!(
+                    "{}/issues/{}/notes?sort=asc&order_by=created_at",
+                    project, issue.number
+                ))? {
+                    // Changes of labels, assignees and the like
+                    if note["system"].as_bool() == Some(true) {
+                        continue;
+                    }
+                    issue.comments.push(Comment {
+                        author: users.name(&note["author"])?,
+                        body: text(&note["body"]),
+                        created: timestamp(&note["created_at"]).unwrap_or_default(),
+                    });
+                }
+            }
+            found.push(issue);
+        }
+        Ok(found)
+    }
+
+    /// An issue from the forge's description of it, without comments
+    fn issue(
+        &self,
+        users: &mut Users,
+        item: &Value,
+        number: Option<u64>,
+        body: &Value,
+    ) -> Result<Option<Issue>> {
+        let number = match number {
+            Some(number) if number > 0 => number,
+            _ => return Ok(None),
+        };
+        let title =
+            issues::valid_title(item["title"].as_str().unwrap_or("")).unwrap_or_else(|_| {
+                let title: String = item["title"]
+                    .as_str()
+                    .unwrap_or("")
+                    .chars()
+                    .take(256)
+                    .collect();
+                if title.trim().is_empty() {
+                    format!("Issue {}", number)
+                } else {
+                    title.trim().to_string()
+                }
+            });
+        let labels = item["labels"]
+            .as_array()
+            .map(|labels| {
+                labels
+                    .iter()
+                    // Objects on GitHub, names on GitLab
+                    .filter_map(|label| label["name"].as_str().or_else(|| label.as_str()))
+                    .filter_map(|name| issues::parse_labels(name).ok())
+                    .flatten()
+                    .collect()
+            })
+            .unwrap_or_default();
+        let state = match item["state"].as_str() {
+            Some("closed") => State::Closed,
+            _ => State::Open,
+        };
+        let created = timestamp(&item["created_at"]).unwrap_or_default();
+        let closed_by = match state {
+            State::Closed if item["closed_by"].is_object() => Some(users.name(&item["closed_by"])?),
+            _ => None,
+        };
+        Ok(Some(Issue {
+            number,
+            title,
+            body: text(body),
+            author: users.name(if item["user"].is_object() {
+                &item["user"]
+            } else {
+                &item["author"]
+            })?,
+            state,
+            labels,
+            comments: Vec::new(),
+            created,
+            updated: timestamp(&item["updated_at"]).unwrap_or(created),
+            closed_by,
+            milestone: item["milestone"]["title"].as_str().map(str::to_string),
+        }))
+    }
+}
+
+/// Accounts of forge users, looked up once each
+struct Users<'a> {
+    migration: &'a Migration<'a>,
+    /// Forge user name to account, if they have one
+    known: HashMap<String, Option<String>>,
+}
+
+impl Users<'_> {
+    /// The account of the forge user described by `user`, or their name on
+    /// the forge marked as such
+    fn name(&mut self, user: &Value) -> Result<String> {
+        let source = self.migration.source;
+        let login = match user["login"].as_str().or_else(|| user["username"].as_str()) {
+            Some(login) => login.to_string(),
+            None => return Ok(format!("{}:ghost", source.forge.name())),
+        };
+        if !self.known.contains_key(&login) {
+            let account = match self.migration.user_map.get(&login) {
+                Some(account) => Some(account.clone()),
+                None => self
+                    .email(user)?
+                    .and_then(|email| users::by_email(self.migration.data_dir, &email)),
+            };
+            self.known.insert(login.clone(), account);
+        }
+        Ok(match &self.known[&login] {
+            Some(account) => account.clone(),
+            None => format!("{}:{}", source.forge.name(), login),
+        })
+    }
+
+    /// Public email address on the user's profile; lists only give names
+    fn email(&self, user: &Value) -> Result<Option<String>> {
+        let source = self.migration.source;
+        let path = match (source.forge, user["login"].as_str(), user["id"].as_u64()) {
+            (Forge::GitHub, Some(login), _) => format!("/users/{}", login),
+            (Forge::GitLab, _, Some(id)) => format!("/users/{}", id),
+            _ => return Ok(None),
+        };
+        let profile = match source.get(&path) {
+            Ok(profile) => profile,
+            Err(e) => {
+                tracing::warn!("Failed to look up {}: {:#}", path, e);
+                return Ok(None);
+            }
+        };
+        Ok(profile["email"]
+            .as_str()
+            .or_else(|| profile["public_email"].as_str())
+            .filter(|email| !email.is_empty())
+            .map(str::to_string))
+    }
+}
@@ -0,0 +1,545 @@
+//! Repository mirrors: pull mirrors fetch everything from an upstream on a
+//! schedule, push mirrors send branches and tags to another remote after each
+//! push.
+//!
+//! Mirrors are ordinary git remotes, marked with
+//! `remote.<name>.agitoMirror = pull|push` so other remotes are left alone.
+//! Pull mirrors are created with `--mirror=fetch`. Push mirrors push
+//! `refs/heads/*` and `refs/tags/*` with `--prune`, as GitHub and others
+//! refuse hidden refs such as `refs/pull/*`; push mirrors from before that
+//! were created with `--mirror=push` and still push every ref.
+//!
+//! Credentials for a remote are stored next to the mirror's status, readable
+//! only by the server, rather than in the URL, where git config and
+//! `git remote -v` would show them. Tokens reach git as an HTTP header in its
+//! environment, SSH keys through `GIT_SSH_COMMAND`.
+
+use crate::{archive, git, jobs, keys};
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+use std::time::Duration;
+
+/// Seconds between fetches of a pull mirror unless configured otherwise
+pub const DEFAULT_INTERVAL: u64 = 3600;
+
+/// Keep git from waiting for credentials no one can type, and to network
+/// transports: local paths, `file://` and helpers such as `ext::` would let a
+/// mirror read or overwrite any repository the server can reach
+const NON_INTERACTIVE: &[(&str, &str)] = &[
+    ("GIT_TERMINAL_PROMPT", "0"),
+    ("GIT_ALLOW_PROTOCOL", "http:https:ssh:git"),
+];
+
+/// Refs a push mirror sends
+const PUSH_REFSPECS: [&str; 2] = ["+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"];
+
+/// User name sent with a token when none is given; GitHub and GitLab only
+/// look at the token
+pub const DEFAULT_TOKEN_USER: &str = "git";
+
+/// Which way a mirror copies refs
+#[derive(Clone, Copy, Debug, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Direction {
+    /// Fetch from the remote, replacing all local refs
+    Pull,
+    /// Push all refs to the remote after every push to this repository
+    Push,
+}
+
+impl FromStr for Direction {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "pull" => Ok(Self::Pull),
+            "push" => Ok(Self::Push),
+            _ => Err(format!(
+                "unknown mirror direction '{}' (expected pull or push)",
+                s
+            )),
+        }
+    }
+}
+
+impl Direction {
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::Pull => "pull",
+            Self::Push => "push",
+        }
+    }
+}
+
+/// A mirror configured on a repository
+#[derive(Clone, Debug)]
+pub struct Mirror {
+    /// Name of the git remote
+    pub name: String,
+    pub direction: Direction,
+    pub url: String,
+    /// Seconds between fetches, for pull mirrors
+    pub interval: u64,
+}
+
+/// Outcome of the latest syncs, kept in `agito/mirrors/<name>.json`
+#[derive(Clone, Debug, Default, Serialize, Deserialize)]
+pub struct Status {
+    /// Unix time of the latest attempt
+    pub last_attempt: Option<i64>,
+    /// Unix time of the latest successful sync
+    pub last_success: Option<i64>,
+    /// Why the latest attempt failed; None if it succeeded
+    pub error: Option<String>,
+    /// Unix time of the first of the attempts that have failed in a row
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub failing_since: Option<i64>,
+}
+
+/// How a mirror authenticates to its remote
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case", tag = "type")]
+pub enum Credentials {
+    /// HTTP basic authentication, e.g. with a GitHub personal access token
+    Token { username: String, token: String },
+    /// A private SSH key, in OpenSSH format
+    SshKey { key: String },
+}
+
+impl Credentials {
+    pub fn kind(&self) -> &'static str {
+        match self {
+            Self::Token { .. } => "token",
+            Self::SshKey { .. } => "SSH key",
+        }
+    }
+}
+
+/// Mirrors configured on a repository, sorted by name
+pub fn list(repo_path: &Path) -> Vec<Mirror> {
+    let output = match git::run(
+        repo_path,
+        &["config", "--get-regexp", r"^remote\..*\.agitomirror$"],
+    ) {
+        Ok(output) if output.status.success() => output,
+        _ => return Vec::new(),
+    };
+
+    let mut mirrors: Vec<Mirror> = String::from_utf8_lossy(&output.stdout)
+        .lines()
+        .filter_map(|line| {
+            let (key, direction) = line.split_once(' ')?;
+            let name = key.strip_prefix("remote.")?.strip_suffix(".agitomirror")?;
+            let url = git::config_get(repo_path, &format!("remote.{}.url", name))?;
+            let interval = git::config_get(repo_path, &format!("remote.{}.agitoInterval", name))
+                .and_then(|v| v.parse().ok())
+                .unwrap_or(DEFAULT_INTERVAL);
+            Some(Mirror {
+                name: name.to_string(),
+                direction: direction.trim().parse().ok()?,
+                url,
+                interval,
+            })
+        })
+        .collect();
+    mirrors.sort_by(|a, b| a.name.cmp(&b.name));
+    mirrors
+}
+
+/// Whether the repository is a pull mirror, whose refs belong to the upstream
+pub fn is_pull_mirror(repo_path: &Path) -> bool {
+    list(repo_path)
+        .iter()
+        .any(|mirror| mirror.direction == Direction::Pull)
+}
+
+fn valid_name(name: &str) -> bool {
+    !name.is_empty()
+        && name
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || c == '-' || c == '_')
+}
+
+fn git_ok(repo_path: &Path, args: &[&str]) -> Result<()> {
+    let output = git::run(repo_path, args)?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "git {} failed: {}",
+            args[0],
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(())
+}
+
+/// The URL a mirror URL stands for: `github:<owner>/<repo>` and
+/// `gitlab:<owner>/<repo>` are short for the HTTPS URLs of those services
+pub fn expand_url(url: &str) -> String {
+    let hosts = [("github:", "github.com"), ("gitlab:", "gitlab.com")];
+    for (prefix, host) in hosts {
+        if let Some(path) = url.strip_prefix(prefix) {
+            let path = path.trim_matches('/');
+            let path = path.strip_suffix(".git").unwrap_or(path);
+            return format!("https://{}/{}.git", host, path);
+        }
+    }
+    url.to_string()
+}
+
+/// Whether git reaches `url` over the network: an http, https, ssh or git
+/// URL, or scp-like `[user@]host:path`
+pub fn is_network_url(url: &str) -> bool {
+    if let Some((scheme, _)) = url.split_once("://") {
+        return matches!(
+            scheme.to_ascii_lowercase().as_str(),
+            "http" | "https" | "ssh" | "git" | "git+ssh" | "ssh+git"
+        );
+    }
+    // scp-like URLs have their colon before any slash; `::` picks a remote
+    // helper
+    match url.split_once(':') {
+        Some((host, _)) => !host.is_empty() && !host.contains('/') && !url.contains("::"),
+        None => false,
+    }
+}
+
+/// Configure a new mirror as a git remote
+pub fn add(
+    repo_path: &Path,
+    name: &str,
+    direction: Direction,
+    url: &str,
+    interval: u64,
+) -> Result<()> {
+    if !valid_name(name) {
+        anyhow::bail!(
+            "Invalid mirror name '{}' (use letters, digits, - and _)",
+            name
+        );
+    }
+    if direction == Direction::Pull && is_pull_mirror(repo_path) {
+        anyhow::bail!("Repository already has a pull mirror");
+    }
+
+    let url = expand_url(url);
+    if !is_network_url(&url) {
+        anyhow::bail!(
+            "Mirror URLs must be http, https, ssh or git URLs, not '{}'",
+            redact(&url)
+        );
+    }
+    match direction {
+        Direction::Pull => git_ok(repo_path, &["remote", "add", "--mirror=fetch", name, &url])?,
+        Direction::Push => {
+            git_ok(repo_path, &["remote", "add", name, &url])?;
+            // Pushing, not fetching: drop the fetch refspec `remote add` set
+            git_ok(
+                repo_path,
+                &["config", "--unset-all", &format!("remote.{}.fetch", name)],
+            )?;
+            for refspec in PUSH_REFSPECS {
+                git_ok(
+                    repo_path,
+                    &["config", "--add", &format!("remote.{}.push", name), refspec],
+                )?;
+            }
+        }
+    }
+    git_ok(
+        repo_path,
+        &[
+            "config",
+            &format!("remote.{}.agitoMirror", name),
+            direction.name(),
+        ],
+    )?;
+    if direction == Direction::Pull && interval != DEFAULT_INTERVAL {
+        git_ok(
+            repo_path,
+            &[
+                "config",
+                &format!("remote.{}.agitoInterval", name),
+                &interval.to_string(),
+            ],
+        )?;
+    }
+    Ok(())
+}
+
+/// Remove a mirror and its recorded status
+pub fn remove(repo_path: &Path, name: &str) -> Result<()> {
+    if !list(repo_path).iter().any(|mirror| mirror.name == name) {
+        anyhow::bail!("No mirror named '{}'", name);
+    }
+    git_ok(repo_path, &["remote", "remove", name])?;
+    let _ = fs::remove_file(status_path(repo_path, name));
+    set_credentials(repo_path, name, None)?;
+    Ok(())
+}
+
+fn mirrors_dir(repo_path: &Path) -> PathBuf {
+    git::data_dir(repo_path).join("mirrors")
+}
+
+fn credentials_path(repo_path: &Path, name: &str) -> PathBuf {
+    mirrors_dir(repo_path).join(format!("{}.credentials", name))
+}
+
+/// Where an SSH key is written for git to use
+fn ssh_key_path(repo_path: &Path, name: &str) -> PathBuf {
+    mirrors_dir(repo_path).join(format!("{}.key", name))
+}
+
+/// Credentials stored for a mirror
+pub fn credentials(repo_path: &Path, name: &str) -> Option<Credentials> {
+    fs::read_to_string(credentials_path(repo_path, name))
+        .ok()
+        .and_then(|content| serde_json::from_str(&content).ok())
+}
+
+/// Write a file only the server may read
+fn write_secret(path: &Path, content: &str) -> Result<()> {
+    let tmp = path.with_extension("tmp");
+    fs::write(&tmp, "")?;
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        fs::set_permissions(&tmp, fs::Permissions::from_mode(0o600))?;
+    }
+    fs::write(&tmp, content)?;
+    fs::rename(&tmp, path)?;
+    Ok(())
+}
+
+/// Store the credentials a mirror authenticates with, or forget them
+pub fn set_credentials(
+    repo_path: &Path,
+    name: &str,
+    credentials: Option<&Credentials>,
+) -> Result<()> {
+    let (path, key_path) = (
+        credentials_path(repo_path, name),
+        ssh_key_path(repo_path, name),
+    );
+    let credentials = match credentials {
+        Some(credentials) => credentials,
+        None => {
+            let _ = fs::remove_file(&path);
+            let _ = fs::remove_file(&key_path);
+            return Ok(());
+        }
+    };
+    if !list(repo_path).iter().any(|mirror| mirror.name == name) {
+        anyhow::bail!("No mirror named '{}'", name);
+    }
+    fs::create_dir_all(mirrors_dir(repo_path))?;
+    match credentials {
+        Credentials::Token { username, token } => {
+            if token.trim().is_empty() || username.contains(':') {
+                anyhow::bail!("A token and a user name without ':' are needed");
+            }
+            let _ = fs::remove_file(&key_path);
+        }
+        Credentials::SshKey { key } => {
+            if !key.contains("PRIVATE KEY-----") {
+                anyhow::bail!("Not a private SSH key");
+            }
+            // ssh refuses keys without a final newline
+            write_secret(&key_path, &format!("{}\n", key.trim_end()))?;
+        }
+    }
+    write_secret(&path, &serde_json::to_string_pretty(credentials)?)
+}
+
+/// Quote a word for the shell that runs `GIT_SSH_COMMAND`
+fn shell_quote(word: &str) -> String {
+    format!("'{}'", word.replace('\'', "'\\''"))
+}
+
+/// Environment git runs in to sync a mirror: never prompting, over the
+/// network only, and with the mirror's credentials if it has any
+fn sync_env(repo_path: &Path, mirror: &Mirror) -> Vec<(String, String)> {
+    let mut env: Vec<(String, String)> = NON_INTERACTIVE
+        .iter()
+        .map(|(key, value)| (key.to_string(), value.to_string()))
+        .collect();
+    match credentials(repo_path, &mirror.name) {
+        Some(Credentials::Token { username, token }) => {
+            let basic = keys::encode_base64(format!("{}:{}", username, token.trim()).as_bytes());
+            env.extend([
+                ("GIT_CONFIG_COUNT".to_string(), "1".to_string()),
+                (
+                    "GIT_CONFIG_KEY_0".to_string(),
+                    "http.extraHeader".to_string(),
+                ),
+                (
+                    "GIT_CONFIG_VALUE_0".to_string(),
+                    format!("Authorization: Basic {}", basic),
+                ),
+            ]);
+        }
+        Some(Credentials::SshKey { .. }) => {
+            let key = ssh_key_path(repo_path, &mirror.name);
+            env.push((
+                "GIT_SSH_COMMAND".to_string(),
+                format!(
+                    "ssh -i {} -o IdentitiesOnly=yes -o BatchMode=yes -o StrictHostKeyChecking=accept-new",
+                    shell_quote(&key.to_string_lossy())
+                ),
+            ));
+        }
+        None => {}
+    }
+    env
+}
+
+fn status_path(repo_path: &Path, name: &str) -> PathBuf {
+    mirrors_dir(repo_path).join(format!("{}.json", name))
+}
+
+/// Recorded outcome of a mirror's syncs
+pub fn status(repo_path: &Path, name: &str) -> Status {
+    fs::read_to_string(status_path(repo_path, name))
+        .ok()
+        .and_then(|content| serde_json::from_str(&content).ok())
+        .unwrap_or_default()
+}
+
+fn save_status(repo_path: &Path, name: &str, status: &Status) -> Result<()> {
+    let path = status_path(repo_path, name);
+    if let Some(dir) = path.parent() {
+        fs::create_dir_all(dir)?;
+    }
+    let tmp = path.with_extension("json.tmp");
+    fs::write(&tmp, serde_json::to_string_pretty(status)?)?;
+    fs::rename(&tmp, &path)?;
+    Ok(())
+}
+
+/// A URL with any credentials removed, safe to show in the UI and logs.
+/// SSH user names are kept, as they are not secret.
+pub fn redact(url: &str) -> String {
+    match url.split_once("://") {
+        Some((scheme, rest)) if scheme != "ssh" => {
+            let (authority, path) = rest.split_at(rest.find('/').unwrap_or(rest.len()));
+            match authority.rsplit_once('@') {
+                Some((_, host)) => format!("{}://{}{}", scheme, host, path),
+                None => url.to_string(),
+            }
+        }
+        _ => url.to_string(),
+    }
+}
+
+/// Fetch or push a mirror now and record the outcome
+pub fn sync(repo_path: &Path, mirror: &Mirror) -> Result<()> {
+    let args: &[&str] = match mirror.direction {
+        Direction::Pull => &["fetch", "--prune", "--quiet", &mirror.name],
+        // The remote's refspecs, or every ref for remotes made with --mirror
+        Direction::Push => &["push", "--prune", "--quiet", &mirror.name],
+    };
+    let env = sync_env(repo_path, mirror);
+    let env: Vec<(&str, &str)> = env
+        .iter()
+        .map(|(key, value)| (key.as_str(), value.as_str()))
+        .collect();
+    let result = git::run_with_env(repo_path, args, &env)
+        .context("Failed to run git")
+        .and_then(|output| {
+            if output.status.success() {
+                Ok(())
+            } else {
+                let stderr = String::from_utf8_lossy(&output.stderr);
+                Err(anyhow::anyhow!(
+                    "{}",
+                    stderr.trim().replace(&mirror.url, &redact(&mirror.url))
+                ))
+            }
+        });
+
+    let now = chrono::Utc::now().timestamp();
+    let mut status = status(repo_path, &mirror.name);
+    status.last_attempt = Some(now);
+    match &result {
+        Ok(()) => {
+            status.last_success = Some(now);
+            status.error = None;
+            status.failing_since = None;
+        }
+        Err(e) => {
+            status.error = Some(format!("{:#}", e));
+            status.failing_since.get_or_insert(now);
+        }
+    }
+    save_status(repo_path, &mirror.name, &status)?;
+    result
+}
+
+/// Push mirrors whose latest push failed, with their status
+pub fn failing(repo_path: &Path) -> Vec<(Mirror, Status)> {
+    list(repo_path)
+        .into_iter()
+        .filter(|mirror| mirror.direction == Direction::Push)
+        .map(|mirror| {
+            let status = status(repo_path, &mirror.name);
+            (mirror, status)
+        })
+        .filter(|(_, status)| status.error.is_some())
+        .collect()
+}
+
+/// Push to every push mirror of a repository, e.g. after it received a push
+pub fn push_all(repo_path: &Path) {
+    for mirror in list(repo_path) {
+        if mirror.direction != Direction::Push {
+            continue;
+        }
+        if let Err(e) = sync(repo_path, &mirror) {
+            tracing::warn!(
+                "Push mirror {} of {} failed: {:#}",
+                mirror.name,
+                repo_path.display(),
+                e
+            );
+        }
+    }
+}
+
+/// Fetch every pull mirror below `repos_dir` whose interval has passed,
+/// except in archived repositories. Returns the number of mirrors fetched.
+pub fn sync_due(repos_dir: &Path, now: i64) -> Result<usize> {
+    let mut synced = 0;
+    for (name, repo_path) in git::find_repositories(repos_dir)? {
+        if archive::is_archived(&repo_path) {
+            continue;
+        }
+        for mirror in list(&repo_path) {
+            if mirror.direction != Direction::Pull {
+                continue;
+            }
+            let last = status(&repo_path, &mirror.name).last_attempt.unwrap_or(0);
+            if now - last < mirror.interval as i64 {
+                continue;
+            }
+            match sync(&repo_path, &mirror) {
+                Ok(()) => synced += 1,
+                Err(e) => tracing::warn!("Pull mirror of {} failed: {:#}", name, e),
+            }
+        }
+    }
+    Ok(synced)
+}
+
+/// Check for due pull mirrors every `interval` in the background
+pub fn spawn(repos_dir: PathBuf, interval: Duration) -> tokio::task::JoinHandle<()> {
+    jobs::spawn_periodic("mirrors", interval, move || {
+        let synced = sync_due(&repos_dir, chrono::Utc::now().timestamp())?;
+        if synced > 0 {
+            tracing::info!("Synced {} pull mirrors", synced);
+        }
+        Ok(())
+    })
+}
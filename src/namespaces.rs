@@ -0,0 +1,250 @@
+//! Personal namespaces and limits on creating repositories.
+//!
+//! Every user owns the directory `<repos>/<user>/`, where repositories they
+//! create land unless they ask for a top-level one. Per-user overrides of the
+//! server's defaults live in `<data_dir>/namespaces.json`.
+
+use crate::{git, orgs};
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+
+/// Who may create top-level repositories, outside any namespace
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq)]
+pub enum TopLevel {
+    /// Every user
+    #[default]
+    Anyone,
+    /// Only users granted it with `agito-admin namespace set --top-level`
+    Granted,
+}
+
+impl FromStr for TopLevel {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "anyone" => Ok(Self::Anyone),
+            "granted" => Ok(Self::Granted),
+            _ => Err(format!(
+                "unknown top-level policy '{}' (expected anyone or granted)",
+                s
+            )),
+        }
+    }
+}
+
+impl TopLevel {
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::Anyone => "anyone",
+            Self::Granted => "granted",
+        }
+    }
+}
+
+/// A user's overrides of the server defaults
+#[derive(Clone, Debug, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct UserLimits {
+    /// Most repositories in the user's namespace; 0 for unlimited
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub max_repos: Option<usize>,
+    /// May create top-level repositories even under [`TopLevel::Granted`]
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub top_level: bool,
+}
+
+/// Server-wide rules for creating repositories
+#[derive(Clone, Debug, Default)]
+pub struct Limits {
+    pub repos_dir: PathBuf,
+    /// Holds `namespaces.json` with per-user overrides
+    pub data_dir: PathBuf,
+    /// Default limit of repositories per namespace (unlimited if None)
+    pub max_repos: Option<usize>,
+    pub top_level: TopLevel,
+}
+
+impl Limits {
+    /// Most repositories `user` may have in their namespace
+    pub fn max_repos(&self, user: &str) -> Option<usize> {
+        load(&self.data_dir)
+            .ok()
+            .and_then(|users| users.get(user).and_then(|limits| limits.max_repos))
+            .map(|max| Some(max).filter(|&m| m > 0))
+            .unwrap_or(self.max_repos)
+    }
+
+    /// Whether `user` may create top-level repositories; users not known by
+    /// name only may if anyone can
+    pub fn may_create_top_level(&self, user: Option<&str>) -> bool {
+        self.top_level == TopLevel::Anyone
+            || user.map_or(false, |user| {
+                load(&self.data_dir)
+                    .ok()
+                    .and_then(|users| users.get(user).map(|limits| limits.top_level))
+                    .unwrap_or(false)
+            })
+    }
+
+    /// Name, relative to the repositories directory, of the repository `user`
+    /// asks for as `requested`: `name` lands in their namespace, `org/name`
+    /// in an organization's, `/name` at the top level. Users not known by
+    /// name have no namespace and create top-level repositories. Fails if the
+    /// name is invalid or the user may not create the repository there.
+    pub fn place(&self, user: Option<&str>, requested: &str) -> Result<String> {
+        self.place_moving(user, requested, None)
+    }
+
+    /// Like [`Limits::place`], for the new name of the existing repository
+    /// `from`, which doesn't count against the limit of its own namespace
+    pub fn place_renamed(&self, user: Option<&str>, requested: &str, from: &str) -> Result<String> {
+        self.place_moving(user, requested, Some(from))
+    }
+
+    fn place_moving(
+        &self,
+        user: Option<&str>,
+        requested: &str,
+        from: Option<&str>,
+    ) -> Result<String> {
+        let (namespace, name) = match (user, requested.strip_prefix('/')) {
+            (Some(user), None) => {
+                let (namespace, name) = requested.split_once('/').unwrap_or((user, requested));
+                if namespace != user {
+                    match orgs::get(&self.data_dir, namespace) {
+                        Some(org) if org.may_create_repos(user) => {}
+                        Some(_) => anyhow::bail!(
+                            "Only owners and admin teams of {} may create repositories in it",
+                            namespace
+                        ),
+                        None => anyhow::bail!(
+                            "Repositories can only be created in your own namespace ({}/) or an organization's",
+                            user
+                        ),
+                    }
+                }
+                (namespace, repo_name(name)?)
+            }
+            (user, name) => {
+                let name = repo_name(name.unwrap_or(requested))?;
+                if self.may_create_top_level(user) {
+                    return Ok(name);
+                }
+                match user {
+                    Some(user) => anyhow::bail!(
+                        "You may not create top-level repositories; leave out the leading / to create {}/{}",
+                        user,
+                        name
+                    ),
+                    None => anyhow::bail!(
+                        "Your SSH key has no user name (AGITO_USER), so you have no namespace to create repositories in"
+                    ),
+                }
+            }
+        };
+        if !valid_user(namespace) {
+            anyhow::bail!("'{}' cannot be used as a namespace", namespace);
+        }
+
+        let moving_within = from.map_or(false, |from| {
+            from.split_once('/')
+                .map(|(from_namespace, _)| from_namespace)
+                == Some(namespace)
+        });
+        if let Some(max) = self.max_repos(namespace).filter(|_| !moving_within) {
+            let count = count_repos(&self.repos_dir.join(namespace))?;
+            if count >= max {
+                anyhow::bail!(
+                    "{} already has {} of at most {} repositories",
+                    namespace,
+                    count,
+                    max
+                );
+            }
+        }
+        Ok(format!("{}/{}", namespace, name))
+    }
+}
+
+/// Name of a repository the server administrator creates, who may place it
+/// at the top level (`name`) or in any namespace (`user/name`)
+pub fn qualified_name(requested: &str) -> Result<String> {
+    match requested.trim_start_matches('/').split_once('/') {
+        Some((user, name)) if valid_user(user) => Ok(format!("{}/{}", user, repo_name(name)?)),
+        Some((user, _)) => anyhow::bail!("'{}' cannot be used as a namespace", user),
+        None => repo_name(requested.trim_start_matches('/')),
+    }
+}
+
+/// `name` with the .git suffix, if it is a valid repository name
+fn repo_name(name: &str) -> Result<String> {
+    let name = if name.ends_with(".git") {
+        name.to_string()
+    } else {
+        format!("{}.git", name)
+    };
+    if !valid_name(&name) {
+        anyhow::bail!("Invalid repository name '{}'", name);
+    }
+    Ok(name)
+}
+
+/// Repository names: letters, digits, `-`, `_` and `.`, not starting with `.`
+fn valid_name(name: &str) -> bool {
+    !name.starts_with('.')
+        && !name.contains("..")
+        && name
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || matches!(c, '-' | '_' | '.'))
+}
+
+/// User names usable as namespace directories, which must not look like a
+/// repository themselves
+pub fn valid_user(user: &str) -> bool {
+    !user.is_empty() && !user.ends_with(".git") && valid_name(user)
+}
+
+/// Repositories directly inside a namespace directory
+fn count_repos(namespace_dir: &Path) -> Result<usize> {
+    match git::find_repositories(namespace_dir) {
+        Ok(repos) => Ok(repos.iter().filter(|(name, _)| !name.contains('/')).count()),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(0),
+        Err(e) => Err(e.into()),
+    }
+}
+
+fn namespaces_path(data_dir: &Path) -> PathBuf {
+    data_dir.join("namespaces.json")
+}
+
+/// Per-user overrides, by user name
+pub fn load(data_dir: &Path) -> Result<BTreeMap<String, UserLimits>> {
+    let path = namespaces_path(data_dir);
+    match fs::read_to_string(&path) {
+        Ok(content) => serde_json::from_str(&content)
+            .with_context(|| format!("Failed to parse {}", path.display())),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(BTreeMap::new()),
+        Err(e) => Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    }
+}
+
+/// Replace a user's overrides, or with `None` fall back to the defaults
+pub fn set(data_dir: &Path, user: &str, limits: Option<UserLimits>) -> Result<()> {
+    let mut users = load(data_dir)?;
+    match limits {
+        Some(limits) => users.insert(user.to_string(), limits),
+        None => users.remove(user),
+    };
+
+    fs::create_dir_all(data_dir)?;
+    let path = namespaces_path(data_dir);
+    let tmp = path.with_extension("json.tmp");
+    fs::write(&tmp, serde_json::to_string_pretty(&users)?)?;
+    fs::rename(&tmp, &path)?;
+    Ok(())
+}
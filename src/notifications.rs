@@ -0,0 +1,192 @@
+use anyhow::{Context, Result};
+use regex::Regex;
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeSet;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+use std::sync::OnceLock;
+
+/// Oldest read notifications beyond this many are dropped from an inbox
+const MAX_NOTIFICATIONS: usize = 500;
+
+/// Why a user was notified
+#[derive(Clone, Copy, Debug, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "kebab-case")]
+pub enum Reason {
+    Mention,
+    ReviewRequest,
+    /// A comment on a change under review
+    ReviewComment,
+    CiFailure,
+}
+
+impl FromStr for Reason {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "mention" => Ok(Self::Mention),
+            "review-request" => Ok(Self::ReviewRequest),
+            "review-comment" => Ok(Self::ReviewComment),
+            "ci-failure" => Ok(Self::CiFailure),
+            _ => Err(format!(
+                "unknown notification reason '{}' (expected mention, review-request, review-comment or ci-failure)",
+                s
+            )),
+        }
+    }
+}
+
+impl Reason {
+    pub const ALL: [Reason; 4] = [
+        Reason::Mention,
+        Reason::ReviewRequest,
+        Reason::ReviewComment,
+        Reason::CiFailure,
+    ];
+
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::Mention => "mention",
+            Self::ReviewRequest => "review-request",
+            Self::ReviewComment => "review-comment",
+            Self::CiFailure => "ci-failure",
+        }
+    }
+
+    pub fn label(self) -> &'static str {
+        match self {
+            Self::Mention => "Mention",
+            Self::ReviewRequest => "Review request",
+            Self::ReviewComment => "Review comment",
+            Self::CiFailure => "CI failure",
+        }
+    }
+}
+
+/// One entry in a user's inbox
+#[derive(Clone, Debug, Serialize, Deserialize)]
+pub struct Notification {
+    pub id: u64,
+    pub reason: Reason,
+    pub repo: String,
+    pub title: String,
+    /// Page the notification links to, if any
+    #[serde(default)]
+    pub url: Option<String>,
+    /// Unix time the notification was created
+    pub created_at: i64,
+    #[serde(default)]
+    pub read: bool,
+}
+
+/// Usernames double as inbox file names, so only a safe subset is allowed
+pub fn valid_username(user: &str) -> bool {
+    !user.is_empty()
+        && !user.starts_with('.')
+        && user
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || matches!(c, '.' | '_' | '-' | '@'))
+}
+
+/// Users mentioned as `@name` in a text such as a comment
+pub fn mentions(text: &str) -> BTreeSet<String> {
+    static MENTION: OnceLock<Regex> = OnceLock::new();
+    let mention = MENTION
+        .get_or_init(|| Regex::new(r"(?:^|[^\w@`])@([A-Za-z0-9][A-Za-z0-9._-]*)").unwrap());
+    mention
+        .captures_iter(text)
+        .map(|c| c[1].trim_end_matches('.').to_string())
+        .filter(|user| valid_username(user))
+        .collect()
+}
+
+fn inbox_path(data_dir: &Path, user: &str) -> Result<PathBuf> {
+    if !valid_username(user) {
+        anyhow::bail!("Invalid user name: {}", user);
+    }
+    Ok(data_dir
+        .join("notifications")
+        .join(format!("{}.json", user)))
+}
+
+/// All notifications for a user, newest first
+pub fn list(data_dir: &Path, user: &str) -> Result<Vec<Notification>> {
+    let path = inbox_path(data_dir, user)?;
+    match fs::read_to_string(&path) {
+        Ok(content) => serde_json::from_str(&content)
+            .with_context(|| format!("Failed to parse {}", path.display())),
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => Ok(Vec::new()),
+        Err(e) => Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    }
+}
+
+fn save(data_dir: &Path, user: &str, notifications: &[Notification]) -> Result<()> {
+    let path = inbox_path(data_dir, user)?;
+    if let Some(parent) = path.parent() {
+        fs::create_dir_all(parent)?;
+    }
+    let tmp = path.with_extension("json.tmp");
+    fs::write(&tmp, serde_json::to_string(notifications)?)?;
+    fs::rename(&tmp, &path)?;
+    Ok(())
+}
+
+/// Number of unread notifications for a user
+pub fn unread_count(data_dir: &Path, user: &str) -> usize {
+    list(data_dir, user)
+        .map(|n| n.iter().filter(|n| !n.read).count())
+        .unwrap_or(0)
+}
+
+/// Add a notification to a user's inbox
+pub fn push(
+    data_dir: &Path,
+    user: &str,
+    reason: Reason,
+    repo: &str,
+    title: &str,
+    url: Option<String>,
+) -> Result<Notification> {
+    let mut notifications = list(data_dir, user)?;
+    let notification = Notification {
+        id: notifications.iter().map(|n| n.id).max().unwrap_or(0) + 1,
+        reason,
+        repo: repo.to_string(),
+        title: title.to_string(),
+        url,
+        created_at: chrono::Utc::now().timestamp(),
+        read: false,
+    };
+    notifications.insert(0, notification.clone());
+
+    // Trim the oldest read notifications; unread ones are never lost
+    while notifications.len() > MAX_NOTIFICATIONS {
+        match notifications.iter().rposition(|n| n.read) {
+            Some(idx) => {
+                notifications.remove(idx);
+            }
+            None => break,
+        }
+    }
+
+    save(data_dir, user, &notifications)?;
+    Ok(notification)
+}
+
+/// Mark one notification (or all, with `None`) as read. Returns how many changed.
+pub fn mark_read(data_dir: &Path, user: &str, id: Option<u64>) -> Result<usize> {
+    let mut notifications = list(data_dir, user)?;
+    let mut changed = 0;
+    for notification in notifications.iter_mut() {
+        if !notification.read && id.map_or(true, |id| notification.id == id) {
+            notification.read = true;
+            changed += 1;
+        }
+    }
+    if changed > 0 {
+        save(data_dir, user, &notifications)?;
+    }
+    Ok(changed)
+}
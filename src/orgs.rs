@@ -0,0 +1,411 @@
+//! Organizations and teams.
+//!
+//! An organization owns the namespace `<repos>/<org>/` the way a user owns
+//! theirs, and decides who may do what with the repositories in it. Its
+//! owners administer all of them; other members get the organization's base
+//! role on every repository, and more through teams, each of which grants a
+//! [`Role`] on a list of the organization's repositories. Users without a
+//! role cannot even see a repository. Organizations live in
+//! `<data_dir>/orgs.json`, keyed by name.
+//!
+//! Outside organizations, the user owning the namespace administers its
+//! repositories. Anyone else needs to be made a collaborator of a repository
+//! to push to it, and whether they may read it depends on its
+//! [`visibility`](crate::visibility).
+
+use crate::visibility::{self, Visibility};
+use crate::{namespaces, users};
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, BTreeSet};
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+
+/// What a user may do with a repository; each role includes the ones before
+#[derive(Clone, Copy, Debug, PartialEq, Eq, PartialOrd, Ord, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Role {
+    /// Clone, fetch and browse
+    Read,
+    /// Push and merge as well
+    Write,
+    /// Change the repository's settings as well
+    Admin,
+}
+
+impl FromStr for Role {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "read" => Ok(Self::Read),
+            "write" => Ok(Self::Write),
+            "admin" => Ok(Self::Admin),
+            _ => Err(format!(
+                "unknown role '{}' (expected read, write or admin)",
+                s
+            )),
+        }
+    }
+}
+
+impl Role {
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::Read => "read",
+            Self::Write => "write",
+            Self::Admin => "admin",
+        }
+    }
+}
+
+/// A group of an organization's members with a role on some of its
+/// repositories
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Team {
+    pub role: Role,
+    #[serde(default, skip_serializing_if = "BTreeSet::is_empty")]
+    pub members: BTreeSet<String>,
+    /// Repository names within the organization, with the .git suffix
+    #[serde(default, skip_serializing_if = "BTreeSet::is_empty")]
+    pub repos: BTreeSet<String>,
+}
+
+/// An organization
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Org {
+    #[serde(default)]
+    pub display_name: String,
+    /// Administer the organization and all of its repositories
+    pub owners: BTreeSet<String>,
+    /// Members who are not owners
+    #[serde(default, skip_serializing_if = "BTreeSet::is_empty")]
+    pub members: BTreeSet<String>,
+    /// Role every member has on every repository; None to leave it to teams
+    #[serde(default)]
+    pub base_role: Option<Role>,
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub teams: BTreeMap<String, Team>,
+    /// Unix time of creation
+    pub created: i64,
+}
+
+impl Org {
+    pub fn new(display_name: &str, owner: &str) -> Self {
+        Self {
+            display_name: display_name.trim().to_string(),
+            owners: BTreeSet::from([owner.to_string()]),
+            members: BTreeSet::new(),
+            base_role: Some(Role::Read),
+            teams: BTreeMap::new(),
+            created: chrono::Utc::now().timestamp(),
+        }
+    }
+
+    pub fn is_member(&self, user: &str) -> bool {
+        self.owners.contains(user) || self.members.contains(user)
+    }
+
+    /// Best role `user` has on the organization's repository `repo`, from
+    /// ownership, the base role and their teams
+    pub fn role_of(&self, user: &str, repo: &str) -> Option<Role> {
+        if self.owners.contains(user) {
+            return Some(Role::Admin);
+        }
+        if !self.members.contains(user) {
+            return None;
+        }
+        self.teams
+            .values()
+            .filter(|team| team.members.contains(user) && team.repos.contains(repo))
+            .map(|team| team.role)
+            .chain(self.base_role)
+            .max()
+    }
+
+    /// Whether `user` may create repositories in the organization: owners,
+    /// and members of teams with the admin role
+    pub fn may_create_repos(&self, user: &str) -> bool {
+        self.owners.contains(user)
+            || self
+                .teams
+                .values()
+                .any(|team| team.role == Role::Admin && team.members.contains(user))
+    }
+
+    /// Add a member, or make them an owner
+    pub fn add_member(&mut self, user: &str, owner: bool) -> Result<()> {
+        if !namespaces::valid_user(user) {
+            anyhow::bail!("Invalid user name '{}'", user);
+        }
+        if owner {
+            self.members.remove(user);
+            self.owners.insert(user.to_string());
+        } else if !self.owners.contains(user) {
+            self.members.insert(user.to_string());
+        }
+        Ok(())
+    }
+
+    /// Remove a member from the organization and its teams; the last owner
+    /// cannot leave
+    pub fn remove_member(&mut self, user: &str) -> Result<()> {
+        if self.owners.contains(user) && self.owners.len() == 1 {
+            anyhow::bail!("{} is the organization's last owner", user);
+        }
+        self.owners.remove(user);
+        self.members.remove(user);
+        for team in self.teams.values_mut() {
+            team.members.remove(user);
+        }
+        Ok(())
+    }
+
+    /// Turn an owner into a plain member; the last owner stays one
+    pub fn demote(&mut self, user: &str) -> Result<()> {
+        if !self.owners.contains(user) {
+            anyhow::bail!("{} is not an owner", user);
+        }
+        if self.owners.len() == 1 {
+            anyhow::bail!("{} is the organization's last owner", user);
+        }
+        self.owners.remove(user);
+        self.members.insert(user.to_string());
+        Ok(())
+    }
+
+    /// Create a team, or change the role of an existing one
+    pub fn set_team(&mut self, team: &str, role: Role) -> Result<()> {
+        if !namespaces::valid_user(team) {
+            anyhow::bail!("Invalid team name '{}'", team);
+        }
+        self.teams
+            .entry(team.to_string())
+            .and_modify(|t| t.role = role)
+            .or_insert(Team {
+                role,
+                members: BTreeSet::new(),
+                repos: BTreeSet::new(),
+            });
+        Ok(())
+    }
+
+    pub fn team_mut(&mut self, team: &str) -> Result<&mut Team> {
+        self.teams
+            .get_mut(team)
+            .with_context(|| format!("No such team: {}", team))
+    }
+
+    /// Add a member of the organization to a team
+    pub fn add_to_team(&mut self, team: &str, user: &str) -> Result<()> {
+        if !self.is_member(user) {
+            anyhow::bail!("{} is not a member of the organization", user);
+        }
+        self.team_mut(team)?.members.insert(user.to_string());
+        Ok(())
+    }
+
+    /// Give a team its role on a repository of the organization
+    pub fn grant(&mut self, team: &str, repo: &str) -> Result<()> {
+        let repo = repo_name(repo);
+        self.team_mut(team)?.repos.insert(repo);
+        Ok(())
+    }
+
+    pub fn revoke(&mut self, team: &str, repo: &str) -> Result<()> {
+        let repo = repo_name(repo);
+        self.team_mut(team)?.repos.remove(&repo);
+        Ok(())
+    }
+}
+
+/// Repository names in teams: without the organization, with the .git suffix
+fn repo_name(repo: &str) -> String {
+    let repo = repo.rsplit('/').next().unwrap_or(repo);
+    if repo.ends_with(".git") {
+        repo.to_string()
+    } else {
+        format!("{}.git", repo)
+    }
+}
+
+/// What `user` may do with the repository `repo`, named relative to
+/// `repos_dir`; None if they may not even read it. Account admins administer
+/// every repository; others get the best of what the namespace's owner or
+/// organization, the repository's collaborators and its visibility allow.
+pub fn role(data_dir: &Path, repos_dir: &Path, repo: &str, user: Option<&str>) -> Option<Role> {
+    if user.map_or(false, |user| users::is_admin(data_dir, user)) {
+        return Some(Role::Admin);
+    }
+    let repo = repo.trim_start_matches('/');
+    let repo_path = repos_dir.join(repo);
+    let org = repo
+        .split_once('/')
+        .and_then(|(namespace, name)| Some((get(data_dir, namespace)?, name)));
+    let granted = user.and_then(|user| {
+        let from_namespace = match (&org, repo.split_once('/')) {
+            (Some((org, name)), _) => org.role_of(user, name),
+            (None, Some((namespace, _))) if namespace == user => Some(Role::Admin),
+            _ => None,
+        };
+        from_namespace.max(visibility::collaborator(&repo_path, user))
+    });
+    let visible = visibility::effective(&repo_path, org.is_some()).floor(user.is_some());
+    granted.max(visible)
+}
+
+/// Whether the repository `repo` is in an organization's namespace
+pub fn in_org(data_dir: &Path, repo: &str) -> bool {
+    repo.trim_start_matches('/')
+        .split_once('/')
+        .map_or(false, |(namespace, _)| get(data_dir, namespace).is_some())
+}
+
+/// Whether anyone, signed in or not, may read the repository `repo`
+pub fn is_public(data_dir: &Path, repos_dir: &Path, repo: &str) -> bool {
+    visibility::effective(&repos_dir.join(repo), in_org(data_dir, repo)) == Visibility::Public
+}
+
+fn orgs_path(data_dir: &Path) -> PathBuf {
+    data_dir.join("orgs.json")
+}
+
+/// All organizations, by name
+pub fn load(data_dir: &Path) -> Result<BTreeMap<String, Org>> {
+    let path = orgs_path(data_dir);
+    match fs::read_to_string(&path) {
+        Ok(content) => serde_json::from_str(&content)
+            .with_context(|| format!("Failed to parse {}", path.display())),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(BTreeMap::new()),
+        Err(e) => Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    }
+}
+
+fn save(data_dir: &Path, orgs: &BTreeMap<String, Org>) -> Result<()> {
+    fs::create_dir_all(data_dir)?;
+    let path = orgs_path(data_dir);
+    let tmp = path.with_extension("json.tmp");
+    fs::write(&tmp, serde_json::to_string_pretty(orgs)?)?;
+    fs::rename(&tmp, &path)?;
+    Ok(())
+}
+
+pub fn get(data_dir: &Path, name: &str) -> Option<Org> {
+    load(data_dir).ok()?.remove(name)
+}
+
+/// Add an organization. Its name must not be taken by another organization,
+/// a user account or an existing namespace.
+pub fn create(data_dir: &Path, repos_dir: &Path, name: &str, org: Org) -> Result<()> {
+    if !namespaces::valid_user(name) {
+        anyhow::bail!(
+            "Invalid organization name '{}': use letters, digits, '-', '_' and '.'",
+            name
+        );
+    }
+    let mut orgs = load(data_dir)?;
+    if orgs.contains_key(name) || users::get(data_dir, name).is_some() {
+        anyhow::bail!("The name {} is taken", name);
+    }
+    if repos_dir.join(name).exists() {
+        anyhow::bail!("{} is already a namespace of repositories", name);
+    }
+    orgs.insert(name.to_string(), org);
+    save(data_dir, &orgs)
+}
+
+/// Change an organization and save it, returning the result
+pub fn update(
+    data_dir: &Path,
+    name: &str,
+    change: impl FnOnce(&mut Org) -> Result<()>,
+) -> Result<Org> {
+    let mut orgs = load(data_dir)?;
+    let org = orgs
+        .get_mut(name)
+        .with_context(|| format!("No such organization: {}", name))?;
+    change(org)?;
+    let org = org.clone();
+    save(data_dir, &orgs)?;
+    Ok(org)
+}
+
+/// Delete an organization. Its repositories must be gone first, as they
+/// would otherwise fall back to the open model.
+pub fn delete(data_dir: &Path, repos_dir: &Path, name: &str) -> Result<bool> {
+    let mut orgs = load(data_dir)?;
+    if !orgs.contains_key(name) {
+        return Ok(false);
+    }
+    let namespace = repos_dir.join(name);
+    if namespace.is_dir() && fs::read_dir(&namespace)?.next().is_some() {
+        anyhow::bail!(
+            "{} still has repositories; move or delete them first",
+            namespace.display()
+        );
+    }
+    orgs.remove(name);
+    save(data_dir, &orgs)?;
+    Ok(true)
+}
+
+/// Give the admin teams of the user who created the organization repository
+/// `repo` their role on it, so that they can use what they made; owners
+/// already can. The creator of a top-level repository becomes its admin.
+pub fn created(data_dir: &Path, repos_dir: &Path, repo: &str, user: &str) -> Result<()> {
+    let (namespace, name) = match repo.split_once('/') {
+        Some(split) => split,
+        None => {
+            return visibility::set_collaborator(&repos_dir.join(repo), user, Some(Role::Admin))
+        }
+    };
+    let org = match get(data_dir, namespace) {
+        Some(org) if !org.owners.contains(user) => org,
+        _ => return Ok(()),
+    };
+    let teams: Vec<String> = org
+        .teams
+        .iter()
+        .filter(|(_, team)| team.role == Role::Admin && team.members.contains(user))
+        .map(|(team, _)| team.clone())
+        .collect();
+    update(data_dir, namespace, |org| {
+        for team in &teams {
+            org.grant(team, name)?;
+        }
+        Ok(())
+    })?;
+    Ok(())
+}
+
+/// Keep team grants on a repository renamed within its organization; moved
+/// out of it, the grants are dropped
+pub fn rename_repo(data_dir: &Path, from: &str, to: &str) -> Result<()> {
+    let (namespace, name) = match from.split_once('/') {
+        Some(split) => split,
+        None => return Ok(()),
+    };
+    let org = match get(data_dir, namespace) {
+        Some(org) => org,
+        None => return Ok(()),
+    };
+    let (old, new) = (repo_name(name), to.split_once('/'));
+    if !org.teams.values().any(|team| team.repos.contains(&old)) {
+        return Ok(());
+    }
+    update(data_dir, namespace, |org| {
+        for team in org.teams.values_mut() {
+            if team.repos.remove(&old) {
+                if let Some((to_namespace, to_name)) = new {
+                    if to_namespace == namespace {
+                        team.repos.insert(repo_name(to_name));
+                    }
+                }
+            }
+        }
+        Ok(())
+    })?;
+    Ok(())
+}
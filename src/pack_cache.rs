@@ -0,0 +1,223 @@
+//! Caching the packs sent for clones, so a CI farm cloning the same
+//! repository over and over doesn't make the server build the same pack
+//! each time.
+//!
+//! The server sets `uploadpack.packObjectsHook` for `git-upload-pack`, which
+//! then runs `agito-admin pack-cache git pack-objects ...` instead of
+//! `git pack-objects ...`. The hook keys the request on the pack-objects
+//! arguments and the objects wanted, and answers from
+//! `agito/pack-cache/<key>.pack` when it has built that pack before. Only
+//! requests without `have`s are cached: full clones, which ask for the same
+//! objects whoever makes them, unlike fetches.
+//!
+//! Packs are kept up to a size per repository, and the least recently used
+//! are removed to make room.
+
+use crate::git;
+use anyhow::{Context, Result};
+use sha2::{Digest, Sha256};
+use std::env;
+use std::fs::{self, File};
+use std::io::{self, Read, Write};
+use std::path::{Path, PathBuf};
+use std::process::{Command, Stdio};
+use std::time::SystemTime;
+
+/// Environment carrying the cache size to the hook
+const ENV_MAX_BYTES: &str = "AGITO_PACK_CACHE_BYTES";
+
+/// What git runs in place of `git pack-objects`, with its command line after
+const HOOK: &str = "agito-admin pack-cache";
+
+/// Pack cache settings for `git-upload-pack`
+#[derive(Clone, Debug, Default)]
+pub struct PackCache {
+    /// Bytes of packs kept per repository; None turns caching off
+    pub max_bytes: Option<u64>,
+}
+
+impl PackCache {
+    /// The setting that makes `git-upload-pack` build packs through the
+    /// cache, which git only accepts like `git -c`; none when caching is off.
+    /// [`crate::wire::env`] passes it on with [`PackCache::env`].
+    pub fn config(&self) -> Option<(&'static str, String)> {
+        match self.max_bytes {
+            Some(bytes) if bytes > 0 => Some(("uploadpack.packObjectsHook", HOOK.to_string())),
+            _ => None,
+        }
+    }
+
+    /// Variables that carry the settings to the hook; none when caching is
+    /// off
+    pub fn env(&self) -> Vec<(&'static str, String)> {
+        match self.max_bytes {
+            Some(bytes) if bytes > 0 => vec![(ENV_MAX_BYTES, bytes.to_string())],
+            _ => Vec::new(),
+        }
+    }
+
+    /// Settings passed down by the server, or None outside a server-run git
+    /// process
+    pub fn from_env() -> Option<Self> {
+        let bytes = env::var(ENV_MAX_BYTES).ok()?.parse().ok()?;
+        Some(Self {
+            max_bytes: Some(bytes),
+        })
+    }
+}
+
+fn cache_dir(repo_path: &Path) -> PathBuf {
+    git::data_dir(repo_path).join("pack-cache")
+}
+
+/// Cache key of a pack-objects run, or None if it has `have`s and isn't
+/// worth caching. The input lists the wanted objects, then `--not` and the
+/// objects the client has.
+fn key(args: &[String], input: &[u8]) -> Option<String> {
+    let text = std::str::from_utf8(input).ok()?;
+    let haves = text
+        .lines()
+        .skip_while(|line| *line != "--not")
+        .skip(1)
+        .any(|line| !line.trim().is_empty());
+    if haves {
+        return None;
+    }
+    let mut hasher = Sha256::new();
+    // Progress goes to stderr and doesn't change the pack
+    for arg in args.iter().filter(|arg| arg.as_str() != "--progress") {
+        hasher.update(arg.as_bytes());
+        hasher.update([0]);
+    }
+    hasher.update(input);
+    Some(format!("{:x}", hasher.finalize()))
+}
+
+/// Remove the least recently used packs until the cache fits in `max_bytes`
+fn evict(dir: &Path, max_bytes: u64) -> io::Result<()> {
+    let mut packs = Vec::new();
+    for entry in fs::read_dir(dir)? {
+        let entry = entry?;
+        if entry.path().extension().map_or(false, |ext| ext == "pack") {
+            let metadata = entry.metadata()?;
+            packs.push((metadata.modified()?, metadata.len(), entry.path()));
+        }
+    }
+    packs.sort();
+    let mut total: u64 = packs.iter().map(|(_, len, _)| len).sum();
+    for (_, len, path) in packs {
+        if total <= max_bytes {
+            break;
+        }
+        fs::remove_file(&path)?;
+        total -= len;
+    }
+    Ok(())
+}
+
+/// Run `command`, the `git pack-objects` that `git-upload-pack` asked for,
+/// in the repository at `repo_path`: send a cached pack to `output` if there
+/// is one, or run it, feeding it `input`, and keep its pack if it may be
+/// asked for again. Returns whether the pack came from the cache.
+pub fn serve(
+    repo_path: &Path,
+    max_bytes: u64,
+    command: &[String],
+    mut input: impl Read,
+    output: &mut impl Write,
+) -> Result<bool> {
+    let (program, args) = command
+        .split_first()
+        .context("No pack-objects command to run")?;
+    let mut request = Vec::new();
+    input.read_to_end(&mut request)?;
+
+    let dir = cache_dir(repo_path);
+    let key = key(args, &request);
+    if let Some(key) = &key {
+        let path = dir.join(format!("{}.pack", key));
+        if let Ok(mut file) = File::open(&path) {
+            // Mark it as used, so it's the last to go
+            let _ = File::options()
+                .append(true)
+                .open(&path)
+                .and_then(|file| file.set_modified(SystemTime::now()));
+            io::copy(&mut file, output)?;
+            output.flush()?;
+            return Ok(true);
+        }
+    }
+
+    let mut child = Command::new(program)
+        .args(args)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .spawn()
+        .with_context(|| format!("Failed to run {}", program))?;
+    let mut stdin = child.stdin.take().unwrap();
+    let writer = std::thread::spawn(move || stdin.write_all(&request));
+
+    let mut spool = match &key {
+        Some(key) => {
+            fs::create_dir_all(&dir)?;
+            let tmp = dir.join(format!("{}.{}.tmp", key, std::process::id()));
+            Some((File::create(&tmp)?, tmp))
+        }
+        None => None,
+    };
+    let mut stdout = child.stdout.take().unwrap();
+    let mut buf = vec![0u8; 64 * 1024];
+    let mut size = 0u64;
+    loop {
+        let n = stdout.read(&mut buf)?;
+        if n == 0 {
+            break;
+        }
+        output.write_all(&buf[..n])?;
+        size += n as u64;
+        if size > max_bytes {
+            // Too big to keep; stop spooling and just pass it on
+            if let Some((_, tmp)) = spool.take() {
+                let _ = fs::remove_file(tmp);
+            }
+        }
+        if let Some((file, _)) = &mut spool {
+            file.write_all(&buf[..n])?;
+        }
+    }
+    output.flush()?;
+    let _ = writer.join();
+    let status = child.wait()?;
+
+    if let (Some((file, tmp)), Some(key)) = (spool, &key) {
+        drop(file);
+        if status.success() {
+            fs::rename(&tmp, dir.join(format!("{}.pack", key)))?;
+            evict(&dir, max_bytes)?;
+        } else {
+            let _ = fs::remove_file(&tmp);
+        }
+    }
+    if !status.success() {
+        anyhow::bail!("{} failed: {}", program, status);
+    }
+    Ok(false)
+}
+
+/// Remove a repository's cached packs, returning the bytes freed
+pub fn clear(repo_path: &Path) -> io::Result<u64> {
+    let dir = cache_dir(repo_path);
+    let mut freed = 0;
+    match fs::read_dir(&dir) {
+        Ok(entries) => {
+            for entry in entries {
+                let entry = entry?;
+                freed += entry.metadata()?.len();
+            }
+            fs::remove_dir_all(&dir)?;
+        }
+        Err(e) if e.kind() == io::ErrorKind::NotFound => {}
+        Err(e) => return Err(e),
+    }
+    Ok(freed)
+}
@@ -0,0 +1,727 @@
+//! Built-in push policies that repositories can switch on instead of writing
+//! their own hook scripts.
+//!
+//! Each policy takes one parameter and is enabled by setting it in the
+//! repository's git config, e.g. `agito.policy.maxFileSize = 10M`; removing
+//! the setting turns the policy off again. The pre-receive hook checks the
+//! commits a push brings in through `agito-admin policy check`.
+
+use crate::{archive, git, glob, usage};
+use anyhow::{Context, Result};
+use regex::Regex;
+use serde::Serialize;
+use std::io::{BufRead, BufReader, Read, Write};
+use std::path::Path;
+use std::process::{Command, Stdio};
+use std::str::FromStr;
+
+/// Violations reported per push; the rest are only counted
+const MAX_REPORTED: usize = 20;
+
+/// A built-in policy
+#[derive(Clone, Copy, Debug, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "kebab-case")]
+pub enum Policy {
+    /// Reject files larger than the given size
+    MaxFileSize,
+    /// Reject merge commits on branches matching the given globs
+    LinearHistory,
+    /// Reject files whose path matches none of the given globs
+    PathConventions,
+    /// Reject changes to files matching the given globs, such as generated
+    /// directories or executables
+    DeniedPaths,
+    /// Reject files containing the given kinds of credentials
+    Secrets,
+    /// Reject commits whose message does not match the given regex
+    CommitMessage,
+    /// Reject commits without a Signed-off-by line, from their author or
+    /// anyone
+    SignedOffBy,
+}
+
+/// Kinds of secrets the secrets policy recognizes, as (name, description,
+/// regex)
+const SECRETS: [(&str, &str, &str); 4] = [
+    (
+        "private-key",
+        "a private key",
+        r"-----BEGIN ((RSA|DSA|EC|OPENSSH|PGP|ENCRYPTED) )?PRIVATE KEY( BLOCK)?-----",
+    ),
+    (
+        "aws-key",
+        "an AWS access key",
+        r"\b(AKIA|ASIA)[0-9A-Z]{16}\b",
+    ),
+    (
+        "github-token",
+        "a GitHub token",
+        r"\b(gh[pousr]_[A-Za-z0-9]{36}|github_pat_[A-Za-z0-9_]{82})\b",
+    ),
+    (
+        "slack-token",
+        "a Slack token",
+        r"\bxox[abposr]-[A-Za-z0-9-]{10,}",
+    ),
+];
+
+/// Larger files are not scanned for secrets
+const SECRETS_SCAN_LIMIT: u64 = 1024 * 1024;
+
+impl FromStr for Policy {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        Self::ALL
+            .iter()
+            .copied()
+            .find(|policy| policy.name() == s)
+            .ok_or_else(|| {
+                format!(
+                    "unknown policy '{}' (expected max-file-size, linear-history, path-conventions, denied-paths, secrets, commit-message or signed-off-by)",
+                    s
+                )
+            })
+    }
+}
+
+impl Policy {
+    pub const ALL: [Policy; 7] = [
+        Self::MaxFileSize,
+        Self::LinearHistory,
+        Self::PathConventions,
+        Self::DeniedPaths,
+        Self::Secrets,
+        Self::CommitMessage,
+        Self::SignedOffBy,
+    ];
+
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::MaxFileSize => "max-file-size",
+            Self::LinearHistory => "linear-history",
+            Self::PathConventions => "path-conventions",
+            Self::DeniedPaths => "denied-paths",
+            Self::Secrets => "secrets",
+            Self::CommitMessage => "commit-message",
+            Self::SignedOffBy => "signed-off-by",
+        }
+    }
+
+    pub fn label(self) -> &'static str {
+        match self {
+            Self::MaxFileSize => "Block large files",
+            Self::LinearHistory => "Require linear history",
+            Self::PathConventions => "Enforce file path conventions",
+            Self::DeniedPaths => "Block file patterns",
+            Self::Secrets => "Block secrets",
+            Self::CommitMessage => "Require a commit message format",
+            Self::SignedOffBy => "Require Signed-off-by",
+        }
+    }
+
+    /// What the parameter means, for help texts and the settings page
+    pub fn parameter(self) -> &'static str {
+        match self {
+            Self::MaxFileSize => "Largest file allowed, e.g. 10M",
+            Self::LinearHistory => "Branches without merge commits, e.g. main release-*",
+            Self::PathConventions => {
+                "Globs every new or changed file must match, e.g. src/*.rs docs/*"
+            }
+            Self::DeniedPaths => "Globs no new or changed file may match, e.g. dist/* *.exe",
+            Self::Secrets => {
+                "Kinds of secrets to reject: private-key, aws-key, github-token, slack-token"
+            }
+            Self::CommitMessage => {
+                "Regex every commit message must match, e.g. ^(feat|fix|docs)(\\(.+\\))?: "
+            }
+            Self::SignedOffBy => "author, for a Signed-off-by line naming the author, or any",
+        }
+    }
+
+    /// Parameter offered when switching the policy on
+    pub fn default_value(self) -> &'static str {
+        match self {
+            Self::MaxFileSize => "10M",
+            Self::LinearHistory => "main",
+            Self::PathConventions => "*",
+            Self::DeniedPaths => "dist/* build/* *.exe",
+            Self::Secrets => "private-key aws-key github-token slack-token",
+            Self::CommitMessage => "^[^\\n]{1,72}(\\n\\n|$)",
+            Self::SignedOffBy => "author",
+        }
+    }
+
+    /// Git config key holding the parameter
+    pub fn config_key(self) -> &'static str {
+        match self {
+            Self::MaxFileSize => "agito.policy.maxFileSize",
+            Self::LinearHistory => "agito.policy.linearHistory",
+            Self::PathConventions => "agito.policy.allowedPaths",
+            Self::DeniedPaths => "agito.policy.deniedPaths",
+            Self::Secrets => "agito.policy.secrets",
+            Self::CommitMessage => "agito.policy.commitMessage",
+            Self::SignedOffBy => "agito.policy.signedOffBy",
+        }
+    }
+
+    /// Check that a parameter is valid for the policy
+    pub fn validate(self, value: &str) -> Result<(), String> {
+        match self {
+            Self::MaxFileSize => usage::parse_size(value).map(|_| ()),
+            Self::Secrets => {
+                let mut kinds = value.split_whitespace().peekable();
+                if kinds.peek().is_none() {
+                    return Err("expected at least one kind of secret".to_string());
+                }
+                for kind in kinds {
+                    if !SECRETS.iter().any(|(name, _, _)| *name == kind) {
+                        return Err(format!(
+                            "unknown secret '{}' (expected private-key, aws-key, github-token or slack-token)",
+                            kind
+                        ));
+                    }
+                }
+                Ok(())
+            }
+            Self::CommitMessage => Regex::new(value).map(|_| ()).map_err(|e| e.to_string()),
+            Self::SignedOffBy => match value {
+                "author" | "any" => Ok(()),
+                _ => Err(format!("expected author or any, not '{}'", value)),
+            },
+            _ if value.split_whitespace().next().is_none() => {
+                Err("expected at least one glob".to_string())
+            }
+            _ => Ok(()),
+        }
+    }
+}
+
+/// The policies enabled for a repository, with their parameters
+#[derive(Clone, Debug, Default, PartialEq, Eq)]
+pub struct Settings {
+    pub max_file_size: Option<u64>,
+    pub linear_history: Vec<String>,
+    pub allowed_paths: Vec<String>,
+    pub denied_paths: Vec<String>,
+    /// Names of the kinds of secrets to reject
+    pub secrets: Vec<String>,
+    pub commit_message: Option<String>,
+    /// "author" or "any"
+    pub signed_off_by: Option<String>,
+}
+
+impl Settings {
+    /// Read the settings from a repository's git config; invalid parameters
+    /// are ignored with a warning
+    pub fn load(repo_path: &Path) -> Self {
+        let globs = |policy: Policy| -> Vec<String> {
+            value(repo_path, policy)
+                .map(|v| v.split_whitespace().map(str::to_string).collect())
+                .unwrap_or_default()
+        };
+        let valid = |policy: Policy| -> Option<String> {
+            value(repo_path, policy).filter(|v| {
+                policy
+                    .validate(v)
+                    .map_err(|e| tracing::warn!("Ignoring {}: {}", policy.config_key(), e))
+                    .is_ok()
+            })
+        };
+        Self {
+            max_file_size: value(repo_path, Policy::MaxFileSize).and_then(|v| {
+                usage::parse_size(&v)
+                    .map_err(|e| {
+                        tracing::warn!("Ignoring {}: {}", Policy::MaxFileSize.config_key(), e)
+                    })
+                    .ok()
+            }),
+            linear_history: globs(Policy::LinearHistory),
+            allowed_paths: globs(Policy::PathConventions),
+            denied_paths: globs(Policy::DeniedPaths),
+            secrets: valid(Policy::Secrets)
+                .map(|v| v.split_whitespace().map(str::to_string).collect())
+                .unwrap_or_default(),
+            commit_message: valid(Policy::CommitMessage),
+            signed_off_by: valid(Policy::SignedOffBy),
+        }
+    }
+
+    pub fn is_empty(&self) -> bool {
+        *self == Self::default()
+    }
+}
+
+/// A policy's parameter, or None if it is switched off
+pub fn value(repo_path: &Path, policy: Policy) -> Option<String> {
+    git::config_get(repo_path, policy.config_key())
+}
+
+/// Switch a policy on with the given parameter, or off with None
+pub fn set(repo_path: &Path, policy: Policy, value: Option<&str>) -> Result<()> {
+    let output = match value {
+        Some(value) => {
+            policy
+                .validate(value)
+                .map_err(|e| anyhow::anyhow!("{}: {}", policy.name(), e))?;
+            git::run(repo_path, &["config", policy.config_key(), value.trim()])?
+        }
+        None => {
+            if self::value(repo_path, policy).is_none() {
+                return Ok(());
+            }
+            git::run(repo_path, &["config", "--unset", policy.config_key()])?
+        }
+    };
+    if !output.status.success() {
+        anyhow::bail!(
+            "Failed to update {}: {}",
+            policy.config_key(),
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(())
+}
+
+/// A reason to reject a push
+#[derive(Clone, Debug, PartialEq, Eq, Serialize)]
+pub struct Violation {
+    /// Name of the broken policy, `protected-branch` or `archived`
+    pub policy: &'static str,
+    pub message: String,
+}
+
+/// Check the ref updates of a push, given as (old, new, refname) like the
+/// pre-receive hook receives them, against the repository's policies. Must
+/// run before the refs are updated, since commits already reachable from a
+/// ref are not checked again.
+pub fn check(repo_path: &Path, updates: &[(String, String, String)]) -> Result<Vec<Violation>> {
+    check_with_env(repo_path, updates, &[])
+}
+
+/// Like [`check`], with extra environment variables for git, e.g. to see
+/// objects that are not in the repository yet
+pub fn check_with_env(
+    repo_path: &Path,
+    updates: &[(String, String, String)],
+    env: &[(&str, &str)],
+) -> Result<Vec<Violation>> {
+    // Nothing may change in an archived repository
+    if archive::is_archived(repo_path) && !updates.is_empty() {
+        return Ok(vec![Violation {
+            policy: "archived",
+            message: "The repository is archived and read-only".to_string(),
+        }]);
+    }
+
+    let settings = Settings::load(repo_path);
+    let mut violations = Vec::new();
+    if settings.is_empty() {
+        return Ok(violations);
+    }
+    let secrets: Vec<(&str, Regex)> = SECRETS
+        .iter()
+        .filter(|(name, _, _)| settings.secrets.iter().any(|s| s == name))
+        .map(|(_, description, pattern)| (*description, Regex::new(pattern).unwrap()))
+        .collect();
+    let commit_message = match &settings.commit_message {
+        Some(pattern) => Some(Regex::new(pattern)?),
+        None => None,
+    };
+
+    for (old, new, refname) in updates {
+        if git::is_zero(new) {
+            continue;
+        }
+
+        if let Some(branch) = refname.strip_prefix("refs/heads/") {
+            if settings
+                .linear_history
+                .iter()
+                .any(|pattern| glob::glob_match(pattern, branch))
+            {
+                // Commits the branch gains, even if other refs already have
+                // them, so fast-forwarding to a merge is caught as well
+                let since = if git::is_zero(old) {
+                    "--all"
+                } else {
+                    old.as_str()
+                };
+                for commit in lines(
+                    repo_path,
+                    &["rev-list", "--min-parents=2", new, "--not", since],
+                    env,
+                )? {
+                    violations.push(Violation {
+                        policy: Policy::LinearHistory.name(),
+                        message: format!(
+                            "{}: merge commit {} on {}, which requires linear history",
+                            refname,
+                            short(&commit),
+                            branch
+                        ),
+                    });
+                }
+            }
+        }
+
+        if settings.max_file_size.is_some() || !secrets.is_empty() {
+            let blobs = new_blobs(repo_path, new, env)?;
+            if let Some(limit) = settings.max_file_size {
+                for blob in blobs.iter().filter(|blob| blob.size > limit) {
+                    violations.push(Violation {
+                        policy: Policy::MaxFileSize.name(),
+                        message: format!(
+                            "{}: {} is {}, larger than the limit of {}",
+                            refname,
+                            blob.path,
+                            usage::format_bytes(blob.size),
+                            usage::format_bytes(limit)
+                        ),
+                    });
+                }
+            }
+            if !secrets.is_empty() {
+                for (path, line, description) in find_secrets(repo_path, &blobs, &secrets, env)? {
+                    violations.push(Violation {
+                        policy: Policy::Secrets.name(),
+                        message: format!(
+                            "{}: {} contains what looks like {} on line {}; remove it from the commits and revoke it",
+                            refname, path, description, line
+                        ),
+                    });
+                }
+            }
+        }
+
+        if commit_message.is_some() || settings.signed_off_by.is_some() {
+            for commit in new_commits(repo_path, new, env)? {
+                let subject = commit.message.lines().next().unwrap_or("");
+                if let Some(pattern) = &commit_message {
+                    if !pattern.is_match(&commit.message) {
+                        violations.push(Violation {
+                            policy: Policy::CommitMessage.name(),
+                            message: format!(
+                                "{}: the message of commit {} (\"{}\") does not match {}",
+                                refname,
+                                short(&commit.id),
+                                subject,
+                                pattern.as_str()
+                            ),
+                        });
+                    }
+                }
+                let author_only = match settings.signed_off_by.as_deref() {
+                    Some(mode) => mode == "author",
+                    None => continue,
+                };
+                let email = format!("<{}>", commit.email.to_lowercase());
+                let signed = commit.message.lines().any(|line| {
+                    line.strip_prefix("Signed-off-by:").is_some_and(|by| {
+                        !author_only || by.trim().to_lowercase().ends_with(&email)
+                    })
+                });
+                if !signed {
+                    violations.push(Violation {
+                        policy: Policy::SignedOffBy.name(),
+                        message: if author_only {
+                            format!(
+                                "{}: commit {} has no Signed-off-by line from its author {}; add one with git commit --amend -s",
+                                refname,
+                                short(&commit.id),
+                                email
+                            )
+                        } else {
+                            format!(
+                                "{}: commit {} has no Signed-off-by line; add one with git commit --amend -s",
+                                refname,
+                                short(&commit.id)
+                            )
+                        },
+                    });
+                }
+            }
+        }
+
+        if settings.allowed_paths.is_empty() && settings.denied_paths.is_empty() {
+            continue;
+        }
+        for (commit, path) in changed_paths(repo_path, new, env)? {
+            if settings
+                .denied_paths
+                .iter()
+                .any(|pattern| glob::glob_match(pattern, &path))
+            {
+                violations.push(Violation {
+                    policy: Policy::DeniedPaths.name(),
+                    message: format!(
+                        "{}: commit {} changes {}, which may not be committed",
+                        refname,
+                        short(&commit),
+                        path
+                    ),
+                });
+            } else if !settings.allowed_paths.is_empty()
+                && !settings
+                    .allowed_paths
+                    .iter()
+                    .any(|pattern| glob::glob_match(pattern, &path))
+            {
+                violations.push(Violation {
+                    policy: Policy::PathConventions.name(),
+                    message: format!(
+                        "{}: commit {} changes {}, which matches none of {}",
+                        refname,
+                        short(&commit),
+                        path,
+                        settings.allowed_paths.join(" ")
+                    ),
+                });
+            }
+        }
+    }
+    Ok(violations)
+}
+
+/// Message rejecting a push, listing its violations
+pub fn report(violations: &[Violation]) -> String {
+    let mut out = String::from("Push rejected by repository policies:\n");
+    for violation in violations.iter().take(MAX_REPORTED) {
+        out.push_str(&format!("  [{}] {}\n", violation.policy, violation.message));
+    }
+    if violations.len() > MAX_REPORTED {
+        out.push_str(&format!(
+            "  ... and {} more\n",
+            violations.len() - MAX_REPORTED
+        ));
+    }
+    out
+}
+
+fn short(oid: &str) -> &str {
+    &oid[..oid.len().min(8)]
+}
+
+fn lines(repo_path: &Path, args: &[&str], env: &[(&str, &str)]) -> Result<Vec<String>> {
+    let output = git::run_with_env(repo_path, args, env)?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "git {} failed: {}",
+            args[0],
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(String::from_utf8_lossy(&output.stdout)
+        .lines()
+        .map(str::to_string)
+        .collect())
+}
+
+/// Files added or changed by the commits `new` brings in, as (commit, path).
+/// Deleting files is always allowed, so that offending ones can be removed.
+fn changed_paths(
+    repo_path: &Path,
+    new: &str,
+    env: &[(&str, &str)],
+) -> Result<Vec<(String, String)>> {
+    let mut paths = Vec::new();
+    let mut commit = String::new();
+    for line in lines(
+        repo_path,
+        &[
+            "-c",
+            "core.quotePath=false",
+            "log",
+            "--format=%x01%H",
+            "--name-only",
+            "--no-renames",
+            "--diff-filter=d",
+            new,
+            "--not",
+            "--all",
+        ],
+        env,
+    )? {
+        if let Some(id) = line.strip_prefix('\x01') {
+            commit = id.to_string();
+        } else if !line.is_empty() {
+            paths.push((commit.clone(), line));
+        }
+    }
+    Ok(paths)
+}
+
+/// A file among the objects a push brings in
+struct Blob {
+    id: String,
+    size: u64,
+    path: String,
+}
+
+/// The blobs `new` brings in, with a path each was found at
+fn new_blobs(repo_path: &Path, new: &str, env: &[(&str, &str)]) -> Result<Vec<Blob>> {
+    let objects = lines(
+        repo_path,
+        &["rev-list", "--objects", new, "--not", "--all"],
+        env,
+    )?;
+    if objects.is_empty() {
+        return Ok(Vec::new());
+    }
+
+    let mut child = Command::new("git")
+        .arg("-C")
+        .arg(repo_path)
+        .args([
+            "cat-file",
+            "--batch-check=%(objecttype) %(objectname) %(objectsize) %(rest)",
+        ])
+        .envs(env.iter().copied())
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::null())
+        .spawn()
+        .context("Failed to run git cat-file")?;
+
+    // Feed the object list from another thread so neither pipe fills up
+    let mut stdin = child.stdin.take().unwrap();
+    let writer = std::thread::spawn(move || -> std::io::Result<()> {
+        for line in objects {
+            stdin.write_all(line.as_bytes())?;
+            stdin.write_all(b"\n")?;
+        }
+        Ok(())
+    });
+
+    let mut blobs = Vec::new();
+    for line in BufReader::new(child.stdout.take().unwrap()).lines() {
+        let line = line?;
+        let mut fields = line.splitn(4, ' ');
+        if fields.next() != Some("blob") {
+            continue;
+        }
+        let (id, size, path) = (fields.next(), fields.next(), fields.next());
+        blobs.push(Blob {
+            id: id.unwrap_or("").to_string(),
+            size: size.and_then(|s| s.parse().ok()).unwrap_or(0),
+            path: path.unwrap_or("").to_string(),
+        });
+    }
+    writer
+        .join()
+        .map_err(|_| anyhow::anyhow!("Failed to list objects"))??;
+    if !child.wait()?.success() {
+        anyhow::bail!("git cat-file failed");
+    }
+    Ok(blobs)
+}
+
+/// Secrets in the text files among `blobs`, as (path, line, description of
+/// the secret)
+fn find_secrets(
+    repo_path: &Path,
+    blobs: &[Blob],
+    secrets: &[(&str, Regex)],
+    env: &[(&str, &str)],
+) -> Result<Vec<(String, usize, String)>> {
+    let scanned: Vec<&Blob> = blobs
+        .iter()
+        .filter(|blob| blob.size <= SECRETS_SCAN_LIMIT)
+        .collect();
+    if scanned.is_empty() {
+        return Ok(Vec::new());
+    }
+
+    let mut child = Command::new("git")
+        .arg("-C")
+        .arg(repo_path)
+        .args(["cat-file", "--batch"])
+        .envs(env.iter().copied())
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::null())
+        .spawn()
+        .context("Failed to run git cat-file")?;
+
+    let mut stdin = child.stdin.take().unwrap();
+    let ids: Vec<String> = scanned.iter().map(|blob| blob.id.clone()).collect();
+    let writer = std::thread::spawn(move || -> std::io::Result<()> {
+        for id in ids {
+            stdin.write_all(id.as_bytes())?;
+            stdin.write_all(b"\n")?;
+        }
+        Ok(())
+    });
+
+    // Each blob comes as "<id> blob <size>", its content and a newline
+    let mut found = Vec::new();
+    let mut stdout = BufReader::new(child.stdout.take().unwrap());
+    for blob in scanned {
+        let mut header = String::new();
+        stdout.read_line(&mut header)?;
+        let size = match header.split_whitespace().nth(2) {
+            Some(size) => size.parse::<usize>()?,
+            None => continue,
+        };
+        let mut content = vec![0; size + 1];
+        stdout.read_exact(&mut content)?;
+        content.pop();
+        if content.iter().take(8000).any(|&b| b == 0) {
+            continue;
+        }
+        let text = String::from_utf8_lossy(&content);
+        for (description, pattern) in secrets {
+            if let Some(m) = pattern.find(&text) {
+                let line = text[..m.start()].matches('\n').count() + 1;
+                found.push((blob.path.clone(), line, description.to_string()));
+            }
+        }
+    }
+    writer
+        .join()
+        .map_err(|_| anyhow::anyhow!("Failed to read objects"))??;
+    if !child.wait()?.success() {
+        anyhow::bail!("git cat-file failed");
+    }
+    Ok(found)
+}
+
+/// A commit among those a push brings in
+struct Commit {
+    id: String,
+    /// Author email
+    email: String,
+    message: String,
+}
+
+fn new_commits(repo_path: &Path, new: &str, env: &[(&str, &str)]) -> Result<Vec<Commit>> {
+    let output = git::run_with_env(
+        repo_path,
+        &[
+            "log",
+            "-z",
+            "--format=%H%x01%ae%x01%B",
+            new,
+            "--not",
+            "--all",
+        ],
+        env,
+    )?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "git log failed: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(String::from_utf8_lossy(&output.stdout)
+        .split('\0')
+        .filter_map(|entry| {
+            let mut fields = entry.splitn(3, '\x01');
+            Some(Commit {
+                id: fields.next().filter(|id| !id.is_empty())?.to_string(),
+                email: fields.next()?.to_string(),
+                message: fields.next()?.trim().to_string(),
+            })
+        })
+        .collect())
+}
@@ -0,0 +1,87 @@
+//! Users' preferences for the web interface, such as how diffs are shown.
+//!
+//! Each user's are kept in `<data_dir>/preferences/<user>.json`, apart from
+//! users.json: they change on a page view, and rewriting the accounts for
+//! that could undo an admin's change to them made meanwhile.
+
+use crate::notifications;
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+
+/// How the web interface shows diffs
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum DiffView {
+    /// Old and new lines one after the other
+    #[default]
+    Unified,
+    /// The old file on the left and the new one on the right
+    Split,
+}
+
+impl FromStr for DiffView {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "unified" => Ok(Self::Unified),
+            "split" => Ok(Self::Split),
+            _ => Err(format!(
+                "unknown diff view '{}' (expected unified or split)",
+                s
+            )),
+        }
+    }
+}
+
+impl DiffView {
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::Unified => "unified",
+            Self::Split => "split",
+        }
+    }
+}
+
+#[derive(Clone, Debug, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Preferences {
+    /// How the user last chose to see diffs; unified until they do
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub diff_view: Option<DiffView>,
+}
+
+fn preferences_dir(data_dir: &Path) -> PathBuf {
+    data_dir.join("preferences")
+}
+
+fn preferences_path(data_dir: &Path, user: &str) -> Result<PathBuf> {
+    if !notifications::valid_username(user) {
+        anyhow::bail!("Invalid user name: {}", user);
+    }
+    Ok(preferences_dir(data_dir).join(format!("{}.json", user)))
+}
+
+/// A user's preferences; the defaults until they set any
+pub fn get(data_dir: &Path, user: &str) -> Result<Preferences> {
+    let path = preferences_path(data_dir, user)?;
+    match fs::read_to_string(&path) {
+        Ok(content) => serde_json::from_str(&content)
+            .with_context(|| format!("Failed to parse {}", path.display())),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(Preferences::default()),
+        Err(e) => Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    }
+}
+
+/// Replace a user's preferences
+pub fn set(data_dir: &Path, user: &str, preferences: &Preferences) -> Result<()> {
+    let path = preferences_path(data_dir, user)?;
+    fs::create_dir_all(preferences_dir(data_dir))?;
+    let tmp = path.with_extension("json.tmp");
+    fs::write(&tmp, serde_json::to_string_pretty(preferences)?)?;
+    fs::rename(&tmp, &path)?;
+    Ok(())
+}
@@ -0,0 +1,176 @@
+//! Client profiles: which agito server the `agito` CLI talks to, and how.
+//!
+//! Profiles live in `$XDG_CONFIG_HOME/agito/config` (by default
+//! `~/.config/agito/config`) as `name = value` lines, with `#` starting a
+//! comment. Settings before the first `[name]` header make up the default
+//! profile; `AGITO_PROFILE` picks another, which starts from the default's
+//! settings. Each setting can also be given as an environment variable,
+//! which wins over the file:
+//!
+//! - `server` (`AGITO_SERVER`): host and SSH port, `localhost:2222` unless set
+//! - `user` (`AGITO_USER`): SSH user, `git` unless set
+//! - `protocol` (`AGITO_PROTOCOL`): `ssh`, or `https` to manage repositories
+//!   through the REST API instead, for machines that can't open SSH
+//!   connections
+//! - `url` (`AGITO_URL`): the web server's address, for `https`
+//! - `token` (`AGITO_TOKEN`): a personal access token, for `https`
+
+use anyhow::{Context, Result};
+use std::collections::HashMap;
+use std::fs;
+use std::path::PathBuf;
+use std::str::FromStr;
+
+/// How management commands reach the server
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq)]
+pub enum Protocol {
+    /// The `agito-*` SSH commands
+    #[default]
+    Ssh,
+    /// The REST API, with a personal access token
+    Https,
+}
+
+impl FromStr for Protocol {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "ssh" => Ok(Self::Ssh),
+            "https" => Ok(Self::Https),
+            _ => Err(format!("unknown protocol '{}' (expected ssh or https)", s)),
+        }
+    }
+}
+
+impl Protocol {
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::Ssh => "ssh",
+            Self::Https => "https",
+        }
+    }
+}
+
+/// The settings of one profile
+#[derive(Clone, Debug)]
+pub struct Profile {
+    pub server: String,
+    pub user: String,
+    pub protocol: Protocol,
+    /// Base URL of the web server, e.g. `https://git.example.com`
+    pub url: Option<String>,
+    pub token: Option<String>,
+}
+
+impl Profile {
+    /// The profile `AGITO_PROFILE` names, or the default one
+    pub fn load() -> Result<Self> {
+        let name = std::env::var("AGITO_PROFILE")
+            .ok()
+            .filter(|name| !name.is_empty());
+        let path = config_path();
+        let settings = match fs::read_to_string(&path) {
+            Ok(content) => parse(&content, name.as_deref())
+                .with_context(|| format!("Failed to read {}", path.display()))?,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => match &name {
+                Some(name) => {
+                    anyhow::bail!("No profile {}: {} does not exist", name, path.display())
+                }
+                None => HashMap::new(),
+            },
+            Err(e) => return Err(e).with_context(|| format!("Failed to read {}", path.display())),
+        };
+        Self::from_settings(&settings, true)
+    }
+
+    /// Every profile in the config file, the default one first, as the file
+    /// has them without the environment's settings
+    pub fn all() -> Result<Vec<Self>> {
+        let path = config_path();
+        let content = match fs::read_to_string(&path) {
+            Ok(content) => content,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(Vec::new()),
+            Err(e) => return Err(e).with_context(|| format!("Failed to read {}", path.display())),
+        };
+        let mut names = vec![None];
+        names.extend(content.lines().filter_map(|line| {
+            let line = line.split('#').next().unwrap_or("").trim();
+            let header = line.strip_prefix('[')?.strip_suffix(']')?;
+            Some(Some(header.trim().to_string()))
+        }));
+        names
+            .iter()
+            .map(|name| {
+                let settings = parse(&content, name.as_deref())
+                    .with_context(|| format!("Failed to read {}", path.display()))?;
+                Self::from_settings(&settings, false)
+            })
+            .collect()
+    }
+
+    /// A profile with `settings`, over which the environment's win if `env`
+    fn from_settings(settings: &HashMap<String, String>, env: bool) -> Result<Self> {
+        let setting = |key: &str| {
+            env.then(|| std::env::var(format!("AGITO_{}", key.to_uppercase())).ok())
+                .flatten()
+                .or_else(|| settings.get(key).cloned())
+                .filter(|value| !value.is_empty())
+        };
+        let protocol = match setting("protocol") {
+            Some(protocol) => protocol.parse().map_err(anyhow::Error::msg)?,
+            None => Protocol::Ssh,
+        };
+        Ok(Self {
+            server: setting("server").unwrap_or_else(|| "localhost:2222".to_string()),
+            user: setting("user").unwrap_or_else(|| "git".to_string()),
+            protocol,
+            url: setting("url").map(|url| url.trim_end_matches('/').to_string()),
+            token: setting("token"),
+        })
+    }
+}
+
+/// The settings of profile `name`, over those of the default profile
+fn parse(content: &str, name: Option<&str>) -> Result<HashMap<String, String>> {
+    let mut settings = HashMap::new();
+    let mut section: Option<String> = None;
+    let mut found = name.is_none();
+    for (number, line) in content.lines().enumerate() {
+        let line = line.split('#').next().unwrap_or("").trim();
+        if line.is_empty() {
+            continue;
+        }
+        if let Some(header) = line
+            .strip_prefix('[')
+            .and_then(|line| line.strip_suffix(']'))
+        {
+            section = Some(header.trim().to_string());
+            found |= section.as_deref() == name;
+            continue;
+        }
+        let (key, value) = line
+            .split_once('=')
+            .with_context(|| format!("line {}: expected name = value", number + 1))?;
+        let key = key.trim();
+        if !["server", "user", "protocol", "url", "token"].contains(&key) {
+            anyhow::bail!("line {}: unknown setting '{}'", number + 1, key);
+        }
+        if section.is_none() || section.as_deref() == name {
+            settings.insert(key.to_string(), value.trim().to_string());
+        }
+    }
+    if !found {
+        anyhow::bail!("no profile [{}]", name.unwrap_or_default());
+    }
+    Ok(settings)
+}
+
+/// Where profiles are kept
+pub fn config_path() -> PathBuf {
+    let base = match std::env::var_os("XDG_CONFIG_HOME") {
+        Some(dir) => PathBuf::from(dir),
+        None => PathBuf::from(std::env::var_os("HOME").unwrap_or_default()).join(".config"),
+    };
+    base.join("agito").join("config")
+}
@@ -0,0 +1,253 @@
+//! Protected branches.
+//!
+//! A repository protects branches by listing rules in its git config, one
+//! per `agito.protectedBranch` value:
+//!
+//! ```text
+//! [agito]
+//!     protectedBranch = main
+//!     protectedBranch = release/* allow-deletion require-pull-request
+//! ```
+//!
+//! Each rule is a branch glob followed by what it still allows. Protected
+//! branches can neither be force-pushed nor deleted unless the rule says so,
+//! and with `require-pull-request` they only move by merging a pull request;
+//! pushes and other merges on the server are refused. The update hook checks every ref of a push through
+//! `agito-admin protect check`; server-side merges and dry runs check the
+//! same rules themselves.
+
+use crate::policies::Violation;
+use crate::{git, glob};
+use anyhow::Result;
+use serde::Serialize;
+use std::fmt;
+use std::path::Path;
+use std::str::FromStr;
+
+/// Git config key holding the rules, one per value
+const CONFIG_KEY: &str = "agito.protectedBranch";
+
+/// Name protection violations are reported under
+const NAME: &str = "protected-branch";
+
+/// How a set of branches is protected
+#[derive(Clone, Debug, Default, PartialEq, Eq, Serialize)]
+pub struct Rule {
+    /// Glob of the branch names, without `refs/heads/`
+    pub pattern: String,
+    pub allow_force_push: bool,
+    pub allow_deletion: bool,
+    /// Only merged pull requests may update the branch, not pushes or other
+    /// merges
+    pub require_pull_request: bool,
+}
+
+impl FromStr for Rule {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let mut words = s.split_whitespace();
+        let mut rule = Rule {
+            pattern: words
+                .next()
+                .ok_or_else(|| "expected a branch pattern".to_string())?
+                .trim_start_matches("refs/heads/")
+                .to_string(),
+            ..Default::default()
+        };
+        for word in words {
+            match word {
+                "allow-force-push" => rule.allow_force_push = true,
+                "allow-deletion" => rule.allow_deletion = true,
+                "require-pull-request" => rule.require_pull_request = true,
+                _ => {
+                    return Err(format!(
+                        "unknown option '{}' (expected allow-force-push, allow-deletion or require-pull-request)",
+                        word
+                    ))
+                }
+            }
+        }
+        Ok(rule)
+    }
+}
+
+impl fmt::Display for Rule {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}", self.pattern)?;
+        for (set, option) in [
+            (self.allow_force_push, "allow-force-push"),
+            (self.allow_deletion, "allow-deletion"),
+            (self.require_pull_request, "require-pull-request"),
+        ] {
+            if set {
+                write!(f, " {}", option)?;
+            }
+        }
+        Ok(())
+    }
+}
+
+impl Rule {
+    pub fn matches(&self, branch: &str) -> bool {
+        glob::glob_match(&self.pattern, branch)
+    }
+}
+
+/// How ref updates reach the repository
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum Via {
+    /// A push, or a dry run of one
+    Push,
+    /// A merge done by the server, other than of a pull request
+    Merge,
+    /// The merge of a pull request
+    PullRequest,
+}
+
+/// The repository's rules, in config order; invalid ones are ignored with a
+/// warning
+pub fn rules(repo_path: &Path) -> Vec<Rule> {
+    let output = match git::run(repo_path, &["config", "--get-all", CONFIG_KEY]) {
+        Ok(output) if output.status.success() => output,
+        _ => return Vec::new(),
+    };
+    String::from_utf8_lossy(&output.stdout)
+        .lines()
+        .filter(|line| !line.trim().is_empty())
+        .filter_map(|line| {
+            line.parse()
+                .map_err(|e| tracing::warn!("Ignoring {} '{}': {}", CONFIG_KEY, line, e))
+                .ok()
+        })
+        .collect()
+}
+
+/// Protect the branches matching a rule's pattern, replacing any rule with
+/// the same pattern
+pub fn protect(repo_path: &Path, rule: &Rule) -> Result<()> {
+    let mut rules: Vec<Rule> = rules(repo_path)
+        .into_iter()
+        .filter(|r| r.pattern != rule.pattern)
+        .collect();
+    rules.push(rule.clone());
+    write(repo_path, &rules)
+}
+
+/// Remove the rule for a pattern; returns whether there was one
+pub fn unprotect(repo_path: &Path, pattern: &str) -> Result<bool> {
+    let pattern = pattern.trim_start_matches("refs/heads/");
+    let mut rules = rules(repo_path);
+    let before = rules.len();
+    rules.retain(|r| r.pattern != pattern);
+    if rules.len() == before {
+        return Ok(false);
+    }
+    write(repo_path, &rules)?;
+    Ok(true)
+}
+
+fn write(repo_path: &Path, rules: &[Rule]) -> Result<()> {
+    // Exit status 5 means there was nothing to unset
+    let output = git::run(repo_path, &["config", "--unset-all", CONFIG_KEY])?;
+    if !output.status.success() && output.status.code() != Some(5) {
+        anyhow::bail!(
+            "Failed to update {}: {}",
+            CONFIG_KEY,
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    for rule in rules {
+        let output = git::run(
+            repo_path,
+            &["config", "--add", CONFIG_KEY, &rule.to_string()],
+        )?;
+        if !output.status.success() {
+            anyhow::bail!(
+                "Failed to update {}: {}",
+                CONFIG_KEY,
+                String::from_utf8_lossy(&output.stderr).trim()
+            );
+        }
+    }
+    Ok(())
+}
+
+/// Check ref updates, given as (old, new, refname), against the protected
+/// branches
+pub fn check(
+    repo_path: &Path,
+    updates: &[(String, String, String)],
+    via: Via,
+) -> Result<Vec<Violation>> {
+    check_with_env(repo_path, updates, via, &[])
+}
+
+/// Like [`check`], with extra environment variables for git, e.g. to see
+/// objects that are not in the repository yet
+pub fn check_with_env(
+    repo_path: &Path,
+    updates: &[(String, String, String)],
+    via: Via,
+    env: &[(&str, &str)],
+) -> Result<Vec<Violation>> {
+    let rules = rules(repo_path);
+    let mut violations = Vec::new();
+    if rules.is_empty() {
+        return Ok(violations);
+    }
+
+    for (old, new, refname) in updates {
+        let branch = match refname.strip_prefix("refs/heads/") {
+            Some(branch) => branch,
+            None => continue,
+        };
+        // A branch under several rules gets only what all of them allow
+        let matching: Vec<&Rule> = rules.iter().filter(|r| r.matches(branch)).collect();
+        if matching.is_empty() {
+            continue;
+        }
+        let mut violation = |message: String| {
+            violations.push(Violation {
+                policy: NAME,
+                message: format!("{}: {}", refname, message),
+            })
+        };
+
+        if git::is_zero(new) {
+            if !matching.iter().all(|r| r.allow_deletion) {
+                violation(format!("{} is protected and cannot be deleted", branch));
+            }
+            continue;
+        }
+        if via != Via::PullRequest && matching.iter().any(|r| r.require_pull_request) {
+            violation(format!(
+                "{} only accepts changes through pull requests",
+                branch
+            ));
+            continue;
+        }
+        if git::is_zero(old) || matching.iter().all(|r| r.allow_force_push) {
+            continue;
+        }
+        let output = git::run_with_env(repo_path, &["merge-base", "--is-ancestor", old, new], env)?;
+        match output.status.code() {
+            Some(0) => {}
+            Some(1) => violation(format!(
+                "{} is protected and cannot be force-pushed; {} is not based on {}",
+                branch,
+                short(new),
+                short(old)
+            )),
+            _ => anyhow::bail!(
+                "git merge-base failed: {}",
+                String::from_utf8_lossy(&output.stderr).trim()
+            ),
+        }
+    }
+    Ok(violations)
+}
+
+fn short(oid: &str) -> &str {
+    &oid[..oid.len().min(8)]
+}
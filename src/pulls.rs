@@ -0,0 +1,652 @@
+//! Pull requests: proposals to merge one branch of a repository into another.
+//!
+//! Every pull request is a JSON file, `<repo>/agito/pulls/<number>.json`,
+//! numbered from 1 per repository like issues, but on its own count. While
+//! it exists the repository keeps two refs for it, so CI systems and
+//! reviewers can fetch it with plain git:
+//!
+//! - `refs/pull/<number>/head`: the tip of the head branch
+//! - `refs/pull/<number>/merge`: a trial merge of the head into the base,
+//!   while the pull request is open and merges cleanly
+//!
+//! Both follow pushes and server-side merges through [`sync`], and pushes
+//! to `refs/pull/` are refused. Head and base are branches of the same
+//! repository; pull requests from forks are not supported yet. Changes are
+//! sent to pull_request webhooks and subscribers.
+
+use crate::issues::{self, Comment};
+use crate::merge::{self, Conflict, Identity, Merge, Outcome, Strategy};
+use crate::subscriptions::{self, Kind};
+use crate::webhooks::{self, Event};
+use crate::{archive, git, mirror, protection};
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use serde_json::json;
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+
+/// Prefix of the refs kept for pull requests
+const REF_PREFIX: &str = "refs/pull/";
+
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum State {
+    #[default]
+    Open,
+    Closed,
+    Merged,
+}
+
+impl FromStr for State {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "open" => Ok(Self::Open),
+            "closed" => Ok(Self::Closed),
+            "merged" => Ok(Self::Merged),
+            _ => Err(format!(
+                "unknown pull request state '{}' (expected open, closed or merged)",
+                s
+            )),
+        }
+    }
+}
+
+impl State {
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::Open => "open",
+            Self::Closed => "closed",
+            Self::Merged => "merged",
+        }
+    }
+}
+
+/// How a pull request was merged
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Merged {
+    /// Who merged it; None if a push made the base contain the head
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub by: Option<String>,
+    /// Tip of the base after the merge
+    pub commit: String,
+    /// None if a push made the base contain the head
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub strategy: Option<Strategy>,
+    /// Unix time
+    pub time: i64,
+}
+
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Pull {
+    pub number: u64,
+    pub title: String,
+    /// Markdown
+    #[serde(default)]
+    pub body: String,
+    pub author: String,
+    /// Branch the changes are merged into
+    pub base: String,
+    /// Branch with the changes
+    pub head: String,
+    /// Last known tip of the base; it stops following the branch once the
+    /// pull request is closed or merged
+    pub base_commit: String,
+    /// Last known tip of the head, as kept in `refs/pull/<number>/head`
+    pub head_commit: String,
+    #[serde(default)]
+    pub state: State,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub comments: Vec<Comment>,
+    /// Unix time
+    pub created: i64,
+    /// Unix time of the last change or comment
+    pub updated: i64,
+    /// Who closed the pull request without merging it, while it is closed
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub closed_by: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub merged: Option<Merged>,
+}
+
+impl Pull {
+    pub fn set_title(&mut self, title: &str) -> Result<()> {
+        self.title = issues::valid_title(title)?;
+        Ok(())
+    }
+
+    pub fn comment(&mut self, author: &str, body: &str) -> Result<()> {
+        if body.trim().is_empty() {
+            anyhow::bail!("Comments cannot be empty");
+        }
+        self.comments.push(Comment {
+            author: author.to_string(),
+            body: body.trim_end().to_string(),
+            created: chrono::Utc::now().timestamp(),
+        });
+        Ok(())
+    }
+
+    /// Close or reopen the pull request; merging goes through [`merge`]
+    pub fn set_state(&mut self, state: State, by: &str) -> Result<()> {
+        match (self.state, state) {
+            (State::Merged, _) => anyhow::bail!("#{} is already merged", self.number),
+            (_, State::Merged) => anyhow::bail!("Pull requests are merged, not marked as merged"),
+            (_, State::Open) => self.closed_by = None,
+            (_, State::Closed) => self.closed_by = Some(by.to_string()),
+        }
+        self.state = state;
+        Ok(())
+    }
+
+    fn head_ref(&self) -> String {
+        format!("{}{}/head", REF_PREFIX, self.number)
+    }
+
+    fn merge_ref(&self) -> String {
+        format!("{}{}/merge", REF_PREFIX, self.number)
+    }
+}
+
+/// Whether an open pull request can be merged as it is
+#[derive(Clone, Debug, PartialEq, Eq, Serialize)]
+#[serde(tag = "status", rename_all = "kebab-case")]
+pub enum Mergeability {
+    /// The head merges into the base without conflicts
+    Clean,
+    /// Merging needs these conflicts resolved first
+    Conflicts { conflicts: Vec<Conflict> },
+    /// The base already contains the head
+    UpToDate,
+    /// The base or head branch no longer exists
+    MissingBranch { branch: String },
+}
+
+fn pulls_dir(repo_path: &Path) -> PathBuf {
+    git::data_dir(repo_path).join("pulls")
+}
+
+fn pull_path(repo_path: &Path, number: u64) -> PathBuf {
+    pulls_dir(repo_path).join(format!("{}.json", number))
+}
+
+/// Pull requests, in a given state or all, newest first
+pub fn list(repo_path: &Path, state: Option<State>) -> Result<Vec<Pull>> {
+    let mut pulls = Vec::new();
+    for number in numbers(repo_path)? {
+        if let Some(pull) = get(repo_path, number)? {
+            if state.map_or(true, |state| pull.state == state) {
+                pulls.push(pull);
+            }
+        }
+    }
+    pulls.sort_by(|a, b| b.number.cmp(&a.number));
+    Ok(pulls)
+}
+
+fn numbers(repo_path: &Path) -> Result<Vec<u64>> {
+    let entries = match fs::read_dir(pulls_dir(repo_path)) {
+        Ok(entries) => entries,
+        Err(e) if e.kind() == io::ErrorKind::NotFound => return Ok(Vec::new()),
+        Err(e) => return Err(e.into()),
+    };
+    Ok(entries
+        .filter_map(|entry| entry.ok())
+        .filter_map(|entry| {
+            entry
+                .file_name()
+                .to_str()?
+                .strip_suffix(".json")?
+                .parse()
+                .ok()
+        })
+        .collect())
+}
+
+pub fn get(repo_path: &Path, number: u64) -> Result<Option<Pull>> {
+    let path = pull_path(repo_path, number);
+    match fs::read_to_string(&path) {
+        // Just claimed by create() and not written yet
+        Ok(content) if content.is_empty() => Ok(None),
+        Ok(content) => serde_json::from_str(&content)
+            .map(Some)
+            .with_context(|| format!("Failed to parse {}", path.display())),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(None),
+        Err(e) => Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    }
+}
+
+fn branch_commit(repo_path: &Path, branch: &str) -> Option<String> {
+    if branch.is_empty() || branch.starts_with('-') {
+        return None;
+    }
+    merge::rev_parse(repo_path, &format!("refs/heads/{}", branch))
+}
+
+/// Propose merging `head` into `base`
+pub fn create(
+    repo_path: &Path,
+    author: &str,
+    base: &str,
+    head: &str,
+    title: &str,
+    body: &str,
+) -> Result<Pull> {
+    if archive::is_archived(repo_path) {
+        anyhow::bail!("The repository is archived and read-only");
+    }
+    let title = issues::valid_title(title)?;
+    let base_commit =
+        branch_commit(repo_path, base).with_context(|| format!("Branch not found: {}", base))?;
+    let head_commit =
+        branch_commit(repo_path, head).with_context(|| format!("Branch not found: {}", head))?;
+    if base == head {
+        anyhow::bail!("Choose two different branches");
+    }
+    if merge::is_ancestor(repo_path, &head_commit, &base_commit)? {
+        anyhow::bail!("{} already contains everything on {}", base, head);
+    }
+    if let Some(open) = list(repo_path, Some(State::Open))?
+        .into_iter()
+        .find(|pull| pull.base == base && pull.head == head)
+    {
+        anyhow::bail!(
+            "#{} already proposes merging {} into {}",
+            open.number,
+            head,
+            base
+        );
+    }
+
+    let now = chrono::Utc::now().timestamp();
+    let mut pull = Pull {
+        number: 0,
+        title,
+        body: body.trim_end().to_string(),
+        author: author.to_string(),
+        base: base.to_string(),
+        head: head.to_string(),
+        base_commit,
+        head_commit,
+        state: State::Open,
+        comments: Vec::new(),
+        created: now,
+        updated: now,
+        closed_by: None,
+        merged: None,
+    };
+
+    let dir = pulls_dir(repo_path);
+    fs::create_dir_all(&dir)?;
+    let mut number = numbers(repo_path)?.into_iter().max().unwrap_or(0) + 1;
+    // Claim the number by creating its file, so concurrent pull requests
+    // can't get the same one
+    loop {
+        match fs::OpenOptions::new()
+            .write(true)
+            .create_new(true)
+            .open(pull_path(repo_path, number))
+        {
+            Ok(_) => break,
+            Err(e) if e.kind() == io::ErrorKind::AlreadyExists => number += 1,
+            Err(e) => return Err(e).context("Failed to create the pull request"),
+        }
+    }
+    pull.number = number;
+    hide_refs(repo_path)?;
+    update_refs(repo_path, &pull);
+    save(repo_path, &pull)?;
+    webhooks::trigger(
+        repo_path,
+        Event::PullRequest,
+        || json!({"action": "opened", "pull_request": pull, "sender": pull.author}),
+    );
+    subscriptions::record(
+        repo_path,
+        Kind::PullRequest,
+        pull.number,
+        &pull.title,
+        "opened",
+        Some(&pull.author),
+        &pull.body,
+    );
+    Ok(pull)
+}
+
+/// Change a pull request and save it, returning the result. Reopening
+/// brings its refs up to date again and closing drops its merge ref.
+pub fn update(
+    repo_path: &Path,
+    number: u64,
+    change: impl FnOnce(&mut Pull) -> Result<()>,
+) -> Result<Pull> {
+    let before =
+        get(repo_path, number)?.with_context(|| format!("No such pull request: #{}", number))?;
+    let mut pull = before.clone();
+    let was = pull.state;
+    change(&mut pull)?;
+    if pull.state == State::Open && was != State::Open {
+        if let Some(base) = branch_commit(repo_path, &pull.base) {
+            pull.base_commit = base;
+        }
+        if let Some(head) = branch_commit(repo_path, &pull.head) {
+            pull.head_commit = head;
+        }
+    }
+    if pull.state != was {
+        update_refs(repo_path, &pull);
+    }
+    pull.updated = chrono::Utc::now().timestamp();
+    save(repo_path, &pull)?;
+    if let Some((action, sender)) = change_action(&before, &pull) {
+        let comment = pull.comments.get(before.comments.len());
+        webhooks::trigger(repo_path, Event::PullRequest, || {
+            json!({
+                "action": action,
+                "pull_request": pull,
+                "comment": comment,
+                "sender": sender,
+            })
+        });
+        if action != "edited" {
+            subscriptions::record(
+                repo_path,
+                Kind::PullRequest,
+                pull.number,
+                &pull.title,
+                action,
+                sender,
+                comment.map_or("", |comment| comment.body.as_str()),
+            );
+        }
+    }
+    Ok(pull)
+}
+
+/// Action and sender of a change from `before` to `pull`, for webhooks and
+/// subscribers; None when only the last known tip of the base moved
+fn change_action<'a>(before: &Pull, pull: &'a Pull) -> Option<(&'static str, Option<&'a str>)> {
+    if pull.state != before.state {
+        return Some(match pull.state {
+            State::Open => ("reopened", None),
+            State::Closed => ("closed", pull.closed_by.as_deref()),
+            State::Merged => ("merged", pull.merged.as_ref().and_then(|m| m.by.as_deref())),
+        });
+    }
+    if let Some(comment) = pull.comments.get(before.comments.len()) {
+        return Some(("commented", Some(&comment.author)));
+    }
+    if pull.state == State::Open && pull.head_commit != before.head_commit {
+        return Some(("synchronize", None));
+    }
+    if pull.title != before.title || pull.body != before.body {
+        return Some(("edited", None));
+    }
+    None
+}
+
+fn save(repo_path: &Path, pull: &Pull) -> Result<()> {
+    let path = pull_path(repo_path, pull.number);
+    let tmp = path.with_extension("json.tmp");
+    fs::write(&tmp, serde_json::to_string_pretty(pull)?)?;
+    fs::rename(&tmp, &path)?;
+    Ok(())
+}
+
+/// Refuse pushes to `refs/pull/`, which only the server maintains
+fn hide_refs(repo_path: &Path) -> Result<()> {
+    let output = git::run(repo_path, &["config", "--get-all", "receive.hideRefs"])?;
+    if String::from_utf8_lossy(&output.stdout)
+        .lines()
+        .any(|line| line.trim() == REF_PREFIX.trim_end_matches('/'))
+    {
+        return Ok(());
+    }
+    let output = git::run(
+        repo_path,
+        &[
+            "config",
+            "--add",
+            "receive.hideRefs",
+            REF_PREFIX.trim_end_matches('/'),
+        ],
+    )?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "Failed to set receive.hideRefs: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(())
+}
+
+/// Point the pull request's refs at its head and trial merge. Failing to
+/// is logged rather than returned, as the pull request itself is fine.
+fn update_refs(repo_path: &Path, pull: &Pull) {
+    let set =
+        |refname: &str, commit: &str| match git::run(repo_path, &["update-ref", refname, commit]) {
+            Ok(output) if output.status.success() => {}
+            Ok(output) => tracing::warn!(
+                "Failed to update {}: {}",
+                refname,
+                String::from_utf8_lossy(&output.stderr).trim()
+            ),
+            Err(e) => tracing::warn!("Failed to update {}: {}", refname, e),
+        };
+    let delete = |refname: &str| {
+        let _ = git::run(repo_path, &["update-ref", "-d", refname]);
+    };
+
+    set(&pull.head_ref(), &pull.head_commit);
+    if pull.state != State::Open {
+        delete(&pull.merge_ref());
+        return;
+    }
+    let message = format!(
+        "Merge {} into {}\n\nTrial merge of pull request #{}",
+        pull.head_commit, pull.base_commit, pull.number
+    );
+    match merge::preview(
+        repo_path,
+        &pull.base_commit,
+        &pull.head_commit,
+        &message,
+        &Identity::for_user("agito"),
+    ) {
+        Ok(Ok(commit)) => set(&pull.merge_ref(), &commit),
+        Ok(Err(_)) => delete(&pull.merge_ref()),
+        Err(e) => {
+            tracing::warn!("Failed to merge pull request #{}: {:#}", pull.number, e);
+            delete(&pull.merge_ref());
+        }
+    }
+}
+
+/// Bring open pull requests up to date with ref updates, given as (old, new,
+/// refname), made by a push or a merge on the server. Pull requests whose
+/// head is now part of their base count as merged by `pusher`.
+pub fn sync(
+    repo_path: &Path,
+    updates: &[(String, String, String)],
+    pusher: Option<&str>,
+) -> Result<()> {
+    let branches: Vec<&str> = updates
+        .iter()
+        .filter_map(|(_, _, refname)| refname.strip_prefix("refs/heads/"))
+        .collect();
+    if branches.is_empty() {
+        return Ok(());
+    }
+    for pull in list(repo_path, Some(State::Open))? {
+        if !branches.contains(&pull.base.as_str()) && !branches.contains(&pull.head.as_str()) {
+            continue;
+        }
+        let base = branch_commit(repo_path, &pull.base);
+        let head = branch_commit(repo_path, &pull.head);
+        update(repo_path, pull.number, |pull| {
+            if let Some(head) = head {
+                pull.head_commit = head;
+            }
+            match base {
+                Some(base) if merge::is_ancestor(repo_path, &pull.head_commit, &base)? => {
+                    pull.state = State::Merged;
+                    pull.closed_by = None;
+                    pull.merged = Some(Merged {
+                        by: pusher.map(str::to_string),
+                        commit: base,
+                        strategy: None,
+                        time: chrono::Utc::now().timestamp(),
+                    });
+                }
+                Some(base) => pull.base_commit = base,
+                None => {}
+            }
+            Ok(())
+        })?;
+        if let Some(pull) = get(repo_path, pull.number)? {
+            if pull.state == State::Open {
+                update_refs(repo_path, &pull);
+            }
+        }
+    }
+    Ok(())
+}
+
+/// Whether an open pull request merges cleanly into its base as the
+/// branches are now
+pub fn mergeability(repo_path: &Path, pull: &Pull) -> Result<Mergeability> {
+    let base = match branch_commit(repo_path, &pull.base) {
+        Some(base) => base,
+        None => {
+            return Ok(Mergeability::MissingBranch {
+                branch: pull.base.clone(),
+            })
+        }
+    };
+    let head = match branch_commit(repo_path, &pull.head) {
+        Some(head) => head,
+        None => {
+            return Ok(Mergeability::MissingBranch {
+                branch: pull.head.clone(),
+            })
+        }
+    };
+    if merge::is_ancestor(repo_path, &head, &base)? {
+        return Ok(Mergeability::UpToDate);
+    }
+    Ok(match merge::trial(repo_path, &base, &head)? {
+        Ok(_) => Mergeability::Clean,
+        Err(conflicts) => Mergeability::Conflicts { conflicts },
+    })
+}
+
+/// The two commits to compare for a pull request's changes: the live
+/// branches while it is open, and where they were when it closed otherwise
+pub fn compared(repo_path: &Path, pull: &Pull) -> (String, String) {
+    let live = |branch: &str, known: &str| match pull.state {
+        State::Open => branch_commit(repo_path, branch).unwrap_or_else(|| known.to_string()),
+        _ => known.to_string(),
+    };
+    (
+        live(&pull.base, &pull.base_commit),
+        live(&pull.head, &pull.head_commit),
+    )
+}
+
+fn open(repo_path: &Path, number: u64) -> Result<Pull> {
+    let pull =
+        get(repo_path, number)?.with_context(|| format!("No such pull request: #{}", number))?;
+    if pull.state != State::Open {
+        anyhow::bail!("#{} is {}", number, pull.state.name());
+    }
+    if mirror::is_pull_mirror(repo_path) {
+        anyhow::bail!("The repository is a pull mirror; merge in its upstream instead");
+    }
+    if archive::is_archived(repo_path) {
+        anyhow::bail!("The repository is archived and read-only");
+    }
+    Ok(pull)
+}
+
+/// Merge a pull request into its base on the server, as `user`. Conflicts
+/// leave everything unchanged.
+pub fn merge(
+    repo_path: &Path,
+    number: u64,
+    strategy: Option<Strategy>,
+    message: Option<String>,
+    user: &str,
+) -> Result<Outcome> {
+    let pull = open(repo_path, number)?;
+    let strategy = strategy.unwrap_or_else(|| Strategy::default_for(repo_path));
+    let message = message.or_else(|| match strategy {
+        Strategy::Merge => Some(format!(
+            "Merge pull request #{} from {}\n\n{}",
+            pull.number, pull.head, pull.title
+        )),
+        Strategy::Squash => Some(
+            format!("{} (#{})\n\n{}", pull.title, pull.number, pull.body)
+                .trim_end()
+                .to_string(),
+        ),
+        Strategy::Rebase => None,
+    });
+    let outcome = Merge {
+        base: pull.base.clone(),
+        head: pull.head.clone(),
+        strategy: Some(strategy),
+        message,
+        user: Some(user.to_string()),
+        identity: Identity::for_user(user),
+        via: protection::Via::PullRequest,
+    }
+    .run(repo_path)?;
+
+    if let Outcome::Merged { commit, strategy } = &outcome {
+        let head_commit = branch_commit(repo_path, &pull.head);
+        update(repo_path, number, |pull| {
+            if let Some(head) = head_commit {
+                pull.head_commit = head;
+            }
+            pull.state = State::Merged;
+            pull.closed_by = None;
+            pull.merged = Some(Merged {
+                by: Some(user.to_string()),
+                commit: commit.clone(),
+                strategy: Some(*strategy),
+                time: chrono::Utc::now().timestamp(),
+            });
+            Ok(())
+        })?;
+    }
+    Ok(outcome)
+}
+
+/// Bring a pull request's head branch up to date with its base, by merging
+/// the base into it or rebasing it onto the base, as `user`. The head branch
+/// is checked against protected branches and push policies like any merge.
+pub fn update_branch(
+    repo_path: &Path,
+    number: u64,
+    strategy: Strategy,
+    user: &str,
+) -> Result<Outcome> {
+    let pull = open(repo_path, number)?;
+    let merge = Merge {
+        base: pull.head.clone(),
+        head: pull.base.clone(),
+        strategy: Some(strategy),
+        message: None,
+        user: Some(user.to_string()),
+        identity: Identity::for_user(user),
+        via: protection::Via::Merge,
+    };
+    match strategy {
+        Strategy::Merge => merge.run(repo_path),
+        Strategy::Rebase => merge.rebase_onto(repo_path),
+        Strategy::Squash => anyhow::bail!("Branches are updated by merge or rebase, not squash"),
+    }
+}
@@ -0,0 +1,168 @@
+//! Checking a push against the repository's rules without making it.
+//!
+//! The client sends the refs it would update and a pack of the objects the
+//! server lacks:
+//!
+//! ```text
+//! <new> <refname>
+//! ...
+//! <empty line>
+//! <pack, as written by git pack-objects --stdout>
+//! ```
+//!
+//! The pack is indexed into a quarantine directory that the repository's
+//! objects are visible from but never reach, the same way git keeps the
+//! objects of a push apart until its hooks accept it, and the updates are
+//! evaluated against the protected branches and policies as the hooks
+//! would.
+
+use crate::git;
+use crate::policies::{self, Violation};
+use crate::protection::{self, Via};
+use anyhow::{Context, Result};
+use std::fs;
+use std::io::{self, BufRead};
+use std::path::{Path, PathBuf};
+use std::process::{Command, Stdio};
+
+/// Object ID git passes for refs that do not exist
+const ZERO_OID: &str = "0000000000000000000000000000000000000000";
+
+/// Outcome of a dry run
+#[derive(Debug, Default)]
+pub struct Report {
+    /// The updates the push would make, as (old, new, refname)
+    pub updates: Vec<(String, String, String)>,
+    pub violations: Vec<Violation>,
+}
+
+impl Report {
+    pub fn accepted(&self) -> bool {
+        self.violations.is_empty()
+    }
+
+    /// Human-readable result, as printed by `agito push --check`
+    pub fn describe(&self) -> String {
+        if self.accepted() {
+            let mut out = String::from("The push would be accepted:\n");
+            for (old, new, refname) in &self.updates {
+                let change = if git::is_zero(new) {
+                    "delete".to_string()
+                } else if git::is_zero(old) {
+                    format!("create at {}", &new[..new.len().min(8)])
+                } else {
+                    format!("{}..{}", &old[..old.len().min(8)], &new[..new.len().min(8)])
+                };
+                out.push_str(&format!("  {} ({})\n", refname, change));
+            }
+            out
+        } else {
+            policies::report(&self.violations)
+                .replace("Push rejected", "The push would be rejected")
+        }
+    }
+}
+
+/// Removes the quarantined objects, however the check ends
+struct Quarantine(PathBuf);
+
+impl Drop for Quarantine {
+    fn drop(&mut self) {
+        let _ = fs::remove_dir_all(&self.0);
+    }
+}
+
+/// Evaluate a push read from `input` in the format described above
+pub fn run(repo_path: &Path, input: &mut dyn BufRead) -> Result<Report> {
+    let mut requested = Vec::new();
+    loop {
+        let mut line = String::new();
+        if input.read_line(&mut line)? == 0 || line.trim().is_empty() {
+            break;
+        }
+        let mut fields = line.split_whitespace();
+        match (fields.next(), fields.next(), fields.next()) {
+            (Some(new), Some(refname), None)
+                if new.len() >= 40
+                    && new.chars().all(|c| c.is_ascii_hexdigit())
+                    && refname.starts_with("refs/") =>
+            {
+                requested.push((new.to_string(), refname.to_string()))
+            }
+            _ => anyhow::bail!("Invalid ref update '{}'", line.trim()),
+        }
+    }
+    if requested.is_empty() {
+        anyhow::bail!("No refs to check");
+    }
+
+    let repo_path = repo_path
+        .canonicalize()
+        .with_context(|| format!("Repository not found: {}", repo_path.display()))?;
+    let dir = git::data_dir(&repo_path).join("push-check").join(format!(
+        "{}-{}",
+        std::process::id(),
+        chrono::Utc::now().timestamp_nanos_opt().unwrap_or_default()
+    ));
+    fs::create_dir_all(dir.join("pack"))?;
+    let quarantine = Quarantine(dir);
+    let objects = repo_path.join("objects");
+    let (quarantined, objects) = (quarantine.0.to_string_lossy(), objects.to_string_lossy());
+    let env = [
+        ("GIT_OBJECT_DIRECTORY", quarantined.as_ref()),
+        ("GIT_ALTERNATE_OBJECT_DIRECTORIES", objects.as_ref()),
+    ];
+
+    if !input.fill_buf()?.is_empty() {
+        index_pack(&repo_path, input, &env)?;
+    }
+
+    let mut report = Report::default();
+    for (new, refname) in requested {
+        if !git::is_zero(&new) {
+            let exists = git::run_with_env(&repo_path, &["cat-file", "-e", &new], &env)?;
+            if !exists.status.success() {
+                anyhow::bail!(
+                    "{} is neither on the server nor in the pack; fetch and try again",
+                    new
+                );
+            }
+        }
+        let old = git::run(&repo_path, &["rev-parse", "--verify", "--quiet", &refname])
+            .ok()
+            .filter(|output| output.status.success())
+            .map(|output| String::from_utf8_lossy(&output.stdout).trim().to_string())
+            .unwrap_or_else(|| ZERO_OID.to_string());
+        report.updates.push((old, new, refname));
+    }
+    report.violations = protection::check_with_env(&repo_path, &report.updates, Via::Push, &env)?;
+    report
+        .violations
+        .extend(policies::check_with_env(&repo_path, &report.updates, &env)?);
+    Ok(report)
+}
+
+/// Store the pack on `input` in the quarantine
+fn index_pack(repo_path: &Path, input: &mut dyn BufRead, env: &[(&str, &str)]) -> Result<()> {
+    let mut child = Command::new("git")
+        .arg("-C")
+        .arg(repo_path)
+        .args(["index-pack", "--stdin", "--fix-thin"])
+        .envs(env.iter().copied())
+        .stdin(Stdio::piped())
+        .stdout(Stdio::null())
+        .stderr(Stdio::piped())
+        .spawn()
+        .context("Failed to run git index-pack")?;
+    let copied = io::copy(input, child.stdin.as_mut().unwrap());
+    drop(child.stdin.take());
+    let output = child.wait_with_output()?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "Invalid pack: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    copied.context("Failed to read the pack")?;
+    Ok(())
+}
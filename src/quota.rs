@@ -0,0 +1,223 @@
+use crate::{git, usage};
+use anyhow::{Context, Result};
+use std::collections::BTreeMap;
+use std::env;
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+
+/// Environment passed to git subprocesses so the pre-receive hook can apply
+/// the server's quota settings
+const ENV_REPOS_DIR: &str = "AGITO_REPOS_DIR";
+const ENV_DATA_DIR: &str = "AGITO_DATA_DIR";
+const ENV_REPO_QUOTA: &str = "AGITO_REPO_QUOTA";
+const ENV_USER_QUOTA: &str = "AGITO_USER_QUOTA";
+
+/// Disk space limits for repositories and for users' namespaces
+#[derive(Clone, Debug, Default)]
+pub struct Quotas {
+    pub repos_dir: PathBuf,
+    /// Holds `quotas.json` with per-user overrides
+    pub data_dir: PathBuf,
+    /// Default limit per repository; `agito.quota` in a repository's git config overrides it
+    pub repo_bytes: Option<u64>,
+    /// Default limit for all repositories in a user's namespace
+    pub user_bytes: Option<u64>,
+}
+
+/// Usage and limits for one repository and the namespace it belongs to
+#[derive(Clone, Debug)]
+pub struct Status {
+    pub repo_bytes: u64,
+    pub repo_limit: Option<u64>,
+    /// Owner of the repository: the namespace directory it lives in, if any
+    pub user: Option<String>,
+    pub user_bytes: u64,
+    pub user_limit: Option<u64>,
+}
+
+impl Status {
+    /// Why a push has to be rejected, if a limit is exceeded
+    pub fn exceeded(&self) -> Option<String> {
+        if let Some(limit) = self.repo_limit.filter(|&limit| self.repo_bytes > limit) {
+            return Some(format!(
+                "repository size {} exceeds its quota of {}",
+                usage::format_bytes(self.repo_bytes),
+                usage::format_bytes(limit)
+            ));
+        }
+        if let (Some(user), Some(limit)) = (&self.user, self.user_limit) {
+            if self.user_bytes > limit {
+                return Some(format!(
+                    "repositories of {} use {}, exceeding the quota of {}",
+                    user,
+                    usage::format_bytes(self.user_bytes),
+                    usage::format_bytes(limit)
+                ));
+            }
+        }
+        None
+    }
+
+    /// The usage of repository `name`, as `agito-info --json` and the API
+    /// report it
+    pub fn json(&self, name: &str) -> serde_json::Value {
+        serde_json::json!({
+            "name": name,
+            "size_bytes": self.repo_bytes,
+            "quota_bytes": self.repo_limit,
+            "namespace": self.user,
+            "namespace_bytes": self.user.as_ref().map(|_| self.user_bytes),
+            "namespace_quota_bytes": self.user_limit.filter(|_| self.user.is_some()),
+        })
+    }
+
+    /// Human-readable report, as shown by `agito info`
+    pub fn describe(&self) -> String {
+        let mut out = format!("Size: {}\n", with_limit(self.repo_bytes, self.repo_limit));
+        if let Some(user) = &self.user {
+            out.push_str(&format!(
+                "Namespace {}: {}\n",
+                user,
+                with_limit(self.user_bytes, self.user_limit)
+            ));
+        }
+        out
+    }
+}
+
+/// "12.0 MiB of 1.0 GiB (1%)", or just the size without a limit
+pub fn with_limit(bytes: u64, limit: Option<u64>) -> String {
+    match limit {
+        Some(limit) if limit > 0 => format!(
+            "{} of {} ({}%)",
+            usage::format_bytes(bytes),
+            usage::format_bytes(limit),
+            bytes * 100 / limit
+        ),
+        _ => usage::format_bytes(bytes),
+    }
+}
+
+/// Parse a quota setting; "none" or "0" means unlimited
+fn parse_limit(value: &str) -> Option<Option<u64>> {
+    match value.trim() {
+        "none" | "0" => Some(None),
+        value => usage::parse_size(value).ok().map(Some),
+    }
+}
+
+impl Quotas {
+    /// Variables that carry these settings to hooks run by git subprocesses
+    pub fn env(&self) -> Vec<(&'static str, String)> {
+        let mut env = vec![
+            (ENV_REPOS_DIR, self.repos_dir.display().to_string()),
+            (ENV_DATA_DIR, self.data_dir.display().to_string()),
+        ];
+        if let Some(bytes) = self.repo_bytes {
+            env.push((ENV_REPO_QUOTA, bytes.to_string()));
+        }
+        if let Some(bytes) = self.user_bytes {
+            env.push((ENV_USER_QUOTA, bytes.to_string()));
+        }
+        env
+    }
+
+    /// Settings passed down by the server, or None outside a server-run git process
+    pub fn from_env() -> Option<Self> {
+        let limit = |name| env::var(name).ok().and_then(|v| v.parse().ok());
+        Some(Self {
+            repos_dir: env::var_os(ENV_REPOS_DIR)?.into(),
+            data_dir: env::var_os(ENV_DATA_DIR)?.into(),
+            repo_bytes: limit(ENV_REPO_QUOTA),
+            user_bytes: limit(ENV_USER_QUOTA),
+        })
+    }
+
+    /// Limit for one repository: `agito.quota` from its git config, else the default
+    pub fn repo_limit(&self, repo_path: &Path) -> Option<u64> {
+        git::config_get(repo_path, "agito.quota")
+            .and_then(|value| parse_limit(&value))
+            .unwrap_or(self.repo_bytes)
+    }
+
+    /// Limit for a user's namespace: their entry in `quotas.json`, else the default
+    pub fn user_limit(&self, user: &str) -> Option<u64> {
+        load_user_quotas(&self.data_dir)
+            .ok()
+            .and_then(|quotas| quotas.get(user).copied())
+            .map(|bytes| Some(bytes).filter(|&b| b > 0))
+            .unwrap_or(self.user_bytes)
+    }
+
+    /// Measure a repository and its namespace against their limits
+    pub fn status(&self, repo_path: &Path) -> io::Result<Status> {
+        let repo_bytes = usage::scan_repo(repo_path)?.bytes;
+        let user = owner(&self.repos_dir, repo_path);
+
+        let user_bytes = match &user {
+            Some(user) => {
+                let mut total = 0;
+                for (_, path) in git::find_repositories(&self.repos_dir.join(user))? {
+                    total += usage::scan_repo(&path)?.bytes;
+                }
+                total
+            }
+            None => 0,
+        };
+
+        Ok(Status {
+            repo_bytes,
+            repo_limit: self.repo_limit(repo_path),
+            user_limit: user.as_deref().and_then(|u| self.user_limit(u)),
+            user,
+            user_bytes,
+        })
+    }
+}
+
+/// The namespace a repository lives in below `repos_dir`, which is the
+/// user owning it. Top-level repositories have no owner.
+pub fn owner(repos_dir: &Path, repo_path: &Path) -> Option<String> {
+    let repos_dir = repos_dir.canonicalize().ok()?;
+    let repo_path = repo_path.canonicalize().ok()?;
+    let parent = repo_path.parent()?;
+    if parent == repos_dir || !parent.starts_with(&repos_dir) {
+        return None;
+    }
+    parent
+        .strip_prefix(&repos_dir)
+        .ok()
+        .map(|ns| ns.to_string_lossy().to_string())
+}
+
+fn quotas_path(data_dir: &Path) -> PathBuf {
+    data_dir.join("quotas.json")
+}
+
+/// Per-user quota overrides in bytes; 0 means unlimited
+pub fn load_user_quotas(data_dir: &Path) -> Result<BTreeMap<String, u64>> {
+    let path = quotas_path(data_dir);
+    match fs::read_to_string(&path) {
+        Ok(content) => serde_json::from_str(&content)
+            .with_context(|| format!("Failed to parse {}", path.display())),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(BTreeMap::new()),
+        Err(e) => Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    }
+}
+
+/// Set a user's quota (0 for unlimited), or with `None` fall back to the default
+pub fn set_user_quota(data_dir: &Path, user: &str, bytes: Option<u64>) -> Result<()> {
+    let mut quotas = load_user_quotas(data_dir)?;
+    match bytes {
+        Some(bytes) => quotas.insert(user.to_string(), bytes),
+        None => quotas.remove(user),
+    };
+
+    fs::create_dir_all(data_dir)?;
+    let path = quotas_path(data_dir);
+    let tmp = path.with_extension("json.tmp");
+    fs::write(&tmp, serde_json::to_string_pretty(&quotas)?)?;
+    fs::rename(&tmp, &path)?;
+    Ok(())
+}
@@ -0,0 +1,273 @@
+//! Rate limits shared by the web and SSH servers, so that a single client,
+//! such as a crawler or a script stuck in a loop, can't take the whole
+//! server for itself.
+//!
+//! Three limits can be set independently:
+//!
+//! - requests per second to the web interface and API, per client address,
+//!   with short bursts above it allowed
+//! - clones and fetches running at once, per client address and per user
+//! - pushes per minute, per user, or per address for anonymous clients
+//!
+//! Requests and pushes are counted with token buckets: each client has a
+//! bucket that refills at the allowed rate up to its burst size, and a
+//! request takes one token out or is turned away. IPv6 clients are counted
+//! by their /64, as one host usually holds a whole /64 and could otherwise
+//! pick a fresh address for every request. Counts live in memory and start
+//! over when the server restarts. The limits themselves can change with
+//! [`Limiter::reconfigure`] when the server reloads its configuration.
+//!
+//! Full buckets are the same as no bucket, and [`Limiter::spawn_sweeper`]
+//! drops them in the background. Past [`MAX_BUCKETS`] clients the least
+//! recently seen ones are forgotten, so a flood of addresses can't grow the
+//! counts without bound.
+
+use crate::config::Shared;
+use crate::{jobs, metrics};
+use std::collections::HashMap;
+use std::net::{IpAddr, Ipv6Addr};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+
+/// Buckets kept per kind of limit; past it the least recently used are
+/// dropped
+pub const MAX_BUCKETS: usize = 10_000;
+
+/// The limits; None leaves a kind of request unlimited
+#[derive(Clone, Debug, Default)]
+pub struct Config {
+    /// Web and API requests per second per client address
+    pub requests_per_second: Option<f64>,
+    /// Requests a client may make at once above the rate; twice the rate if
+    /// None
+    pub request_burst: Option<f64>,
+    /// Clones and fetches running at once per client address and per user
+    pub concurrent_clones: Option<usize>,
+    /// Pushes per minute per user, or per address without one
+    pub pushes_per_minute: Option<f64>,
+}
+
+struct Bucket {
+    tokens: f64,
+    updated: Instant,
+}
+
+impl Bucket {
+    /// Refill the bucket for the time passed, up to `burst`
+    fn refill(&mut self, rate: f64, burst: f64, now: Instant) {
+        let elapsed = now.duration_since(self.updated).as_secs_f64();
+        self.tokens = (self.tokens + elapsed * rate).min(burst);
+        self.updated = now;
+    }
+}
+
+#[derive(Default)]
+struct State {
+    /// Request buckets by client address
+    requests: HashMap<String, Bucket>,
+    /// Push buckets by user or address
+    pushes: HashMap<String, Bucket>,
+    /// Clones in progress by client address and by user
+    clones: HashMap<String, usize>,
+}
+
+/// The address a client is counted under: IPv6 addresses are cut to their
+/// /64, IPv4 ones (also when mapped into IPv6) are kept whole
+fn client_key(remote: &str) -> String {
+    match remote.parse::<IpAddr>() {
+        Ok(IpAddr::V6(addr)) => match addr.to_ipv4_mapped() {
+            Some(addr) => addr.to_string(),
+            None => {
+                let prefix = u128::from(addr) & !(u64::MAX as u128);
+                format!("{}/64", Ipv6Addr::from(prefix))
+            }
+        },
+        _ => remote.to_string(),
+    }
+}
+
+/// Take a token from the bucket of `key`, or say how long until there is one
+fn take(
+    buckets: &mut HashMap<String, Bucket>,
+    key: &str,
+    rate: f64,
+    burst: f64,
+) -> Result<(), Duration> {
+    let now = Instant::now();
+    if buckets.len() >= MAX_BUCKETS && !buckets.contains_key(key) {
+        evict(buckets);
+    }
+    let bucket = buckets.entry(key.to_string()).or_insert(Bucket {
+        tokens: burst,
+        updated: now,
+    });
+    bucket.refill(rate, burst, now);
+    if bucket.tokens >= 1.0 {
+        bucket.tokens -= 1.0;
+        Ok(())
+    } else {
+        Err(Duration::from_secs_f64((1.0 - bucket.tokens) / rate))
+    }
+}
+
+/// Drop the least recently used eighth of `buckets`, so that evicting is
+/// rare rather than needed for every new client once the cap is reached
+fn evict(buckets: &mut HashMap<String, Bucket>) {
+    let mut used: Vec<(Instant, String)> = buckets
+        .iter()
+        .map(|(key, bucket)| (bucket.updated, key.clone()))
+        .collect();
+    let count = (used.len() / 8).max(1);
+    used.select_nth_unstable_by_key(count - 1, |(updated, _)| *updated);
+    for (_, key) in &used[..count] {
+        buckets.remove(key);
+    }
+}
+
+/// Drop the buckets that have refilled, which are the same as no bucket;
+/// all of them if the limit is off
+fn sweep(buckets: &mut HashMap<String, Bucket>, rate: Option<(f64, f64)>, now: Instant) {
+    match rate {
+        Some((rate, burst)) => buckets.retain(|_, bucket| {
+            bucket.refill(rate, burst, now);
+            bucket.tokens < burst
+        }),
+        None => buckets.clear(),
+    }
+}
+
+/// Enforces the limits. Clones share their counts, so the web and SSH
+/// servers can hold one limiter between them.
+#[derive(Clone, Default)]
+pub struct Limiter {
+    config: Shared<Config>,
+    state: Arc<Mutex<State>>,
+}
+
+impl Limiter {
+    pub fn new(config: Config) -> Self {
+        Self {
+            config: Shared::new(config),
+            state: Arc::default(),
+        }
+    }
+
+    /// Apply new limits; counts so far are kept
+    pub fn reconfigure(&self, config: Config) {
+        self.config.set(config);
+    }
+
+    /// Drop refilled buckets every `interval` in the background
+    pub fn spawn_sweeper(&self, interval: Duration) -> tokio::task::JoinHandle<()> {
+        let limiter = self.clone();
+        jobs::spawn_periodic("rate_limit_sweep", interval, move || {
+            limiter.sweep();
+            Ok(())
+        })
+    }
+
+    /// Drop the buckets that have refilled since they were last used
+    pub fn sweep(&self) {
+        let config = self.config.get();
+        let now = Instant::now();
+        let mut state = self.state.lock().unwrap();
+        sweep(&mut state.requests, request_rate(&config), now);
+        sweep(&mut state.pushes, push_rate(&config), now);
+    }
+
+    /// Count a web or API request from `remote`; Err says how long the
+    /// client should wait before trying again
+    pub fn request(&self, remote: &str) -> Result<(), Duration> {
+        let (rate, burst) = match request_rate(&self.config.get()) {
+            Some(rate) => rate,
+            None => return Ok(()),
+        };
+        let mut state = self.state.lock().unwrap();
+        take(&mut state.requests, &client_key(remote), rate, burst).inspect_err(|_| {
+            metrics::global().rate_limited("requests");
+        })
+    }
+
+    /// Count a push by `user`, or by `remote` if anonymous
+    pub fn push(&self, remote: &str, user: Option<&str>) -> Result<(), Duration> {
+        let (rate, burst) = match push_rate(&self.config.get()) {
+            Some(rate) => rate,
+            None => return Ok(()),
+        };
+        let key = match user {
+            Some(user) => format!("user:{}", user),
+            None => format!("addr:{}", client_key(remote)),
+        };
+        let mut state = self.state.lock().unwrap();
+        take(&mut state.pushes, &key, rate, burst).inspect_err(|_| {
+            metrics::global().rate_limited("pushes");
+        })
+    }
+
+    /// Start a clone or fetch by `user` from `remote`, which counts as
+    /// running until the returned guard is dropped; Err explains the refusal
+    pub fn clone_started(&self, remote: &str, user: Option<&str>) -> Result<CloneGuard, String> {
+        let keys: Vec<String> = std::iter::once(format!("addr:{}", client_key(remote)))
+            .chain(user.map(|user| format!("user:{}", user)))
+            .collect();
+        let mut state = self.state.lock().unwrap();
+        if let Some(max) = self.config.get().concurrent_clones {
+            let busy = keys
+                .iter()
+                .any(|key| state.clones.get(key).copied().unwrap_or(0) >= max);
+            if busy {
+                metrics::global().rate_limited("clones");
+                return Err(format!(
+                    "Too many clones at once; at most {} may run at a time, try again when one has finished",
+                    max
+                ));
+            }
+        }
+        for key in &keys {
+            *state.clones.entry(key.clone()).or_default() += 1;
+        }
+        Ok(CloneGuard {
+            state: self.state.clone(),
+            keys,
+        })
+    }
+}
+
+/// Refill rate per second and burst size of request buckets, if limited
+fn request_rate(config: &Config) -> Option<(f64, f64)> {
+    let rate = config.requests_per_second.filter(|&rate| rate > 0.0)?;
+    Some((rate, config.request_burst.unwrap_or(rate * 2.0).max(1.0)))
+}
+
+/// Refill rate per second and burst size of push buckets, if limited
+fn push_rate(config: &Config) -> Option<(f64, f64)> {
+    let per_minute = config
+        .pushes_per_minute
+        .filter(|&per_minute| per_minute > 0.0)?;
+    Some((per_minute / 60.0, per_minute.max(1.0)))
+}
+
+/// Counts a clone as running until dropped
+pub struct CloneGuard {
+    state: Arc<Mutex<State>>,
+    keys: Vec<String>,
+}
+
+impl Drop for CloneGuard {
+    fn drop(&mut self) {
+        let mut state = self.state.lock().unwrap();
+        for key in &self.keys {
+            if let Some(count) = state.clones.get_mut(key) {
+                *count -= 1;
+                if *count == 0 {
+                    state.clones.remove(key);
+                }
+            }
+        }
+    }
+}
+
+/// Seconds to put in a Retry-After header, rounded up
+pub fn retry_after(wait: Duration) -> u64 {
+    wait.as_secs() + u64::from(wait.subsec_nanos() > 0)
+}
@@ -0,0 +1,281 @@
+//! Lookup of repositories by the names clients use: optionally ignoring
+//! case, and following a table of old names for renamed or moved
+//! repositories so existing links and remotes keep working.
+//!
+//! Renaming a repository adds a redirect from its old name that lasts a
+//! limited time, so clients have a while to update their remotes and links.
+//! Expired redirects are ignored, and dropped from the table on the next
+//! change to it.
+
+use crate::{git, orgs, stars, subscriptions, watch};
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+
+/// Redirects followed before giving up, in case the table contains a loop
+const MAX_HOPS: usize = 8;
+
+/// Days a redirect left by a rename lasts unless configured otherwise
+pub const DEFAULT_DAYS: u64 = 365;
+
+/// Where clients asking for an old name are sent
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Redirect {
+    pub to: String,
+    /// Unix time the redirect was added, if known
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub created: Option<i64>,
+    /// Unix time after which the redirect is ignored; None for ever
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub expires: Option<i64>,
+}
+
+impl Redirect {
+    pub fn is_expired(&self, now: i64) -> bool {
+        self.expires.map_or(false, |expires| expires <= now)
+    }
+}
+
+/// A table entry: a plain name in tables written before redirects expired
+#[derive(Deserialize)]
+#[serde(untagged)]
+enum Stored {
+    Name(String),
+    Redirect(Redirect),
+}
+
+impl From<Stored> for Redirect {
+    fn from(stored: Stored) -> Self {
+        match stored {
+            Stored::Name(to) => Redirect {
+                to,
+                created: None,
+                expires: None,
+            },
+            Stored::Redirect(redirect) => redirect,
+        }
+    }
+}
+
+/// A repository found by [`Resolver::find`]
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct Found {
+    /// The repository's current name
+    pub name: String,
+    /// Whether it was found through redirects, i.e. under an old name
+    pub moved: bool,
+    /// When the first of the redirects followed expires
+    pub expires: Option<i64>,
+}
+
+/// Finds the repository a name refers to
+#[derive(Clone, Debug, Default)]
+pub struct Resolver {
+    pub repos_dir: PathBuf,
+    /// Holds `redirects.json`; without it no redirects are followed
+    pub data_dir: Option<PathBuf>,
+    /// Match names that differ from the repository only in case
+    pub case_insensitive: bool,
+    /// Days the redirect left by a rename lasts; None keeps it for ever
+    pub redirect_days: Option<u64>,
+}
+
+impl Resolver {
+    /// Name of the existing repository `name` refers to, relative to the
+    /// repositories directory. Names may omit the `.git` suffix.
+    pub fn resolve(&self, name: &str) -> Option<String> {
+        self.find(name).map(|found| found.name)
+    }
+
+    /// The existing repository `name` refers to, and whether that is an old
+    /// name of it
+    pub fn find(&self, name: &str) -> Option<Found> {
+        let mut name = normalize(name)?;
+        let table = match &self.data_dir {
+            Some(data_dir) => load(data_dir).unwrap_or_else(|e| {
+                tracing::warn!("Ignoring repository redirects: {:#}", e);
+                BTreeMap::new()
+            }),
+            None => BTreeMap::new(),
+        };
+        let now = chrono::Utc::now().timestamp();
+
+        let mut found = Found {
+            name: String::new(),
+            moved: false,
+            expires: None,
+        };
+        for _ in 0..MAX_HOPS {
+            if let Some(existing) = self.existing(&name) {
+                found.name = existing;
+                return Some(found);
+            }
+            let redirect = table
+                .iter()
+                .find(|(from, redirect)| self.same_name(from, &name) && !redirect.is_expired(now))
+                .map(|(_, redirect)| redirect)?;
+            found.moved = true;
+            found.expires = match (found.expires, redirect.expires) {
+                (Some(a), Some(b)) => Some(a.min(b)),
+                (a, b) => a.or(b),
+            };
+            name = redirect.to.clone();
+        }
+        None
+    }
+
+    /// The repository called `name` or `name.git`, if there is one
+    fn existing(&self, name: &str) -> Option<String> {
+        let candidates = [name.to_string(), format!("{}.git", name)];
+        if let Some(found) = candidates
+            .iter()
+            .find(|n| self.repos_dir.join(n).join("HEAD").exists())
+        {
+            return Some(found.clone());
+        }
+
+        if !self.case_insensitive {
+            return None;
+        }
+        git::find_repositories(&self.repos_dir)
+            .ok()?
+            .into_iter()
+            .map(|(found, _)| found)
+            .find(|found| candidates.iter().any(|n| n.eq_ignore_ascii_case(found)))
+    }
+
+    fn same_name(&self, a: &str, b: &str) -> bool {
+        let (a, b) = (strip_git(a), strip_git(b));
+        if self.case_insensitive {
+            a.eq_ignore_ascii_case(b)
+        } else {
+            a == b
+        }
+    }
+}
+
+fn strip_git(name: &str) -> &str {
+    name.strip_suffix(".git").unwrap_or(name)
+}
+
+/// Strip the slashes clients put around paths, rejecting names that could
+/// escape the repositories directory
+fn normalize(name: &str) -> Option<String> {
+    let name = name.trim_matches('/');
+    let valid = !name.is_empty()
+        && !name.contains('\\')
+        && name
+            .split('/')
+            .all(|part| !part.is_empty() && !part.starts_with('.'));
+    valid.then(|| name.to_string())
+}
+
+fn table_path(data_dir: &Path) -> PathBuf {
+    data_dir.join("redirects.json")
+}
+
+/// Old repository name to where it moved, including expired redirects
+pub fn load(data_dir: &Path) -> Result<BTreeMap<String, Redirect>> {
+    let path = table_path(data_dir);
+    match fs::read_to_string(&path) {
+        Ok(content) => serde_json::from_str::<BTreeMap<String, Stored>>(&content)
+            .map(|table| {
+                table
+                    .into_iter()
+                    .map(|(from, stored)| (from, stored.into()))
+                    .collect()
+            })
+            .with_context(|| format!("Failed to parse {}", path.display())),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(BTreeMap::new()),
+        Err(e) => Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    }
+}
+
+/// Write the table, leaving out expired redirects
+fn save(data_dir: &Path, table: &BTreeMap<String, Redirect>) -> Result<()> {
+    let now = chrono::Utc::now().timestamp();
+    let table: BTreeMap<_, _> = table
+        .iter()
+        .filter(|(_, redirect)| !redirect.is_expired(now))
+        .collect();
+    fs::create_dir_all(data_dir)?;
+    let path = table_path(data_dir);
+    let tmp = path.with_extension("json.tmp");
+    fs::write(&tmp, serde_json::to_string_pretty(&table)?)?;
+    fs::rename(&tmp, &path)?;
+    Ok(())
+}
+
+/// Send clients asking for `from` to `to`, e.g. after a rename, for `days`
+/// or for ever
+pub fn add(data_dir: &Path, from: &str, to: &str, days: Option<u64>) -> Result<Redirect> {
+    let from = normalize(from).with_context(|| format!("Invalid repository name '{}'", from))?;
+    let to = normalize(to).with_context(|| format!("Invalid repository name '{}'", to))?;
+    if strip_git(&from) == strip_git(&to) {
+        anyhow::bail!("A repository cannot redirect to itself");
+    }
+
+    let now = chrono::Utc::now().timestamp();
+    let redirect = Redirect {
+        to,
+        created: Some(now),
+        expires: days.map(|days| now + days as i64 * 24 * 3600),
+    };
+    let mut table = load(data_dir)?;
+    table.insert(from, redirect.clone());
+    save(data_dir, &table)?;
+    Ok(redirect)
+}
+
+/// Rename the repository `from` to `to`, both names relative to the
+/// repositories directory, and redirect the old name for `days` or for ever.
+/// Watches, subscriptions, stars and team grants follow the repository.
+pub fn rename(
+    repos_dir: &Path,
+    data_dir: &Path,
+    from: &str,
+    to: &str,
+    days: Option<u64>,
+) -> Result<Redirect> {
+    let (source, target) = (repos_dir.join(from), repos_dir.join(to));
+    if !git::is_repository(&source) {
+        anyhow::bail!("Repository not found: {}", from);
+    }
+    if target.exists() {
+        anyhow::bail!("{} exists already", to);
+    }
+    if let Some(parent) = target.parent() {
+        fs::create_dir_all(parent)?;
+    }
+    fs::rename(&source, &target).with_context(|| format!("Failed to rename {} to {}", from, to))?;
+
+    // A redirect from the new name would now be shadowed by the repository
+    remove(data_dir, to)?;
+    let redirect = add(data_dir, from, to, days)?;
+    watch::rename_repo(data_dir, from, to)?;
+    subscriptions::rename_repo(data_dir, from, to)?;
+    stars::rename_repo(data_dir, from, to)?;
+    orgs::rename_repo(data_dir, from, to)?;
+    Ok(redirect)
+}
+
+/// Drop the redirect for `from`; false if there was none
+pub fn remove(data_dir: &Path, from: &str) -> Result<bool> {
+    let mut table = load(data_dir)?;
+    let from = from.trim_matches('/');
+    let key = table
+        .keys()
+        .find(|key| strip_git(key) == strip_git(from))
+        .cloned();
+    match key {
+        Some(key) => {
+            table.remove(&key);
+            save(data_dir, &table)?;
+            Ok(true)
+        }
+        None => Ok(false),
+    }
+}
@@ -0,0 +1,376 @@
+//! Releases: notes published for a tag, such as the changelog of a version.
+//!
+//! A repository's releases are kept in `agito/releases.json`, keyed by tag.
+//! The tag itself lives in git; a release whose tag is deleted stays, so its
+//! notes are not lost, until it is removed.
+//!
+//! Releases can carry assets: uploaded files such as built binaries or
+//! tarballs. Their content is stored in `agito/release-assets/`, named after
+//! its SHA-256, so the same file attached to several releases is kept once.
+//!
+//! Annotated tags without a release are releases too, as far as readers are
+//! concerned: their message stands in for the notes. Each release's
+//! changelog is made of the commits since the tag before it.
+
+use crate::{git, keys};
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use std::collections::{BTreeMap, HashMap};
+use std::fs;
+use std::io::{self, Read};
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex, OnceLock};
+
+/// A file attached to a release
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Asset {
+    /// File name it is downloaded as
+    pub name: String,
+    pub size: u64,
+    /// Hex SHA-256 of the content
+    pub sha256: String,
+    pub uploader: String,
+    /// Unix time
+    pub uploaded: i64,
+}
+
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Release {
+    /// Tag the release is of, without refs/tags/
+    pub tag: String,
+    /// Title; the tag if empty
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub name: String,
+    /// Release notes, in Markdown
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub body: String,
+    pub author: String,
+    /// Unix time
+    pub created: i64,
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub prerelease: bool,
+    /// Not published yet
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub draft: bool,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub assets: Vec<Asset>,
+}
+
+impl Release {
+    /// The name to show: the title, or the tag if it has none
+    pub fn title(&self) -> &str {
+        if self.name.is_empty() {
+            &self.tag
+        } else {
+            &self.name
+        }
+    }
+
+    pub fn asset(&self, name: &str) -> Option<&Asset> {
+        self.assets.iter().find(|asset| asset.name == name)
+    }
+}
+
+/// A tag, as releases are listed from
+#[derive(Clone, Debug)]
+pub struct Tag {
+    /// Without refs/tags/
+    pub name: String,
+    /// Whether it has a message of its own, rather than only naming a commit
+    pub annotated: bool,
+    /// The tagger, or the author of the commit of a lightweight tag
+    pub tagger: String,
+    /// Unix time it was tagged, or the commit's for lightweight tags
+    pub time: i64,
+    /// The message of an annotated tag, without its signature
+    pub message: String,
+}
+
+/// A commit in a changelog
+#[derive(Clone, Debug)]
+pub struct Change {
+    pub hash: String,
+    pub author: String,
+    pub subject: String,
+}
+
+/// All of the repository's tags, newest first
+pub fn tags(repo_path: &Path) -> Result<Vec<Tag>> {
+    let output = git::run(
+        repo_path,
+        &[
+            "for-each-ref",
+            "--sort=-creatordate",
+            "--format=%(refname:lstrip=2)%00%(objecttype)%00%(creatordate:unix)%00%(if)%(taggername)%(then)%(taggername)%(else)%(authorname)%(end)%00%(contents:subject)%00%(contents:body)%1e",
+            "refs/tags",
+        ],
+    )?;
+    if !output.status.success() {
+        anyhow::bail!("Failed to list tags");
+    }
+    Ok(String::from_utf8_lossy(&output.stdout)
+        .split('\x1e')
+        .filter_map(|record| {
+            let fields: Vec<&str> = record.trim_start_matches('\n').splitn(6, '\0').collect();
+            if fields.len() < 6 {
+                return None;
+            }
+            let annotated = fields[1] == "tag";
+            Some(Tag {
+                name: fields[0].to_string(),
+                annotated,
+                tagger: fields[3].to_string(),
+                time: fields[2].parse().unwrap_or(0),
+                message: if annotated {
+                    format!("{}\n\n{}", fields[4], fields[5]).trim().to_string()
+                } else {
+                    String::new()
+                },
+            })
+        })
+        .collect())
+}
+
+/// The tag before `tag` in `tags`, as [`tags`] lists them, whose commits a
+/// changelog leaves out
+pub fn previous<'a>(tags: &'a [Tag], tag: &str) -> Option<&'a str> {
+    let index = tags.iter().position(|t| t.name == tag)?;
+    tags.get(index + 1).map(|t| t.name.as_str())
+}
+
+/// The commits of `tag` that are not in `previous`, or all of them for the
+/// first tag, newest first
+pub fn changelog(
+    repo_path: &Path,
+    tag: &str,
+    previous: Option<&str>,
+    limit: usize,
+) -> Result<Vec<Change>> {
+    let mut args = vec![
+        "log".to_string(),
+        format!("--max-count={}", limit),
+        "--format=%H%x1f%an%x1f%s".to_string(),
+        format!("refs/tags/{}", tag),
+    ];
+    if let Some(previous) = previous {
+        args.push(format!("^refs/tags/{}", previous));
+    }
+    args.push("--".to_string());
+    let args: Vec<&str> = args.iter().map(String::as_str).collect();
+    let output = git::run(repo_path, &args)?;
+    if !output.status.success() {
+        anyhow::bail!("Failed to list the commits of {}", tag);
+    }
+    Ok(String::from_utf8_lossy(&output.stdout)
+        .lines()
+        .filter_map(|line| {
+            let mut fields = line.splitn(3, '\x1f');
+            Some(Change {
+                hash: fields.next()?.to_string(),
+                author: fields.next()?.to_string(),
+                subject: fields.next()?.to_string(),
+            })
+        })
+        .collect())
+}
+
+/// Whether the repository has a tag named `tag`
+pub fn tag_exists(repo_path: &Path, tag: &str) -> bool {
+    let tag_ref = format!("refs/tags/{}", tag);
+    git::run(repo_path, &["rev-parse", "--verify", "--quiet", &tag_ref])
+        .map_or(false, |output| output.status.success())
+}
+
+/// Whether `name` can name an asset: a plain file name, without path
+/// separators or control characters
+pub fn valid_asset_name(name: &str) -> bool {
+    !name.is_empty()
+        && name.len() <= 255
+        && !name.starts_with('.')
+        && !name
+            .chars()
+            .any(|c| c == '/' || c == '\\' || c.is_control())
+}
+
+fn assets_dir(repo_path: &Path) -> PathBuf {
+    git::data_dir(repo_path).join("release-assets")
+}
+
+/// Where the content of an asset is stored
+pub fn asset_path(repo_path: &Path, asset: &Asset) -> PathBuf {
+    assets_dir(repo_path).join(&asset.sha256)
+}
+
+/// Directory for uploads in progress, on the same file system as the assets
+/// so they can be moved into place
+pub fn upload_dir(repo_path: &Path) -> PathBuf {
+    assets_dir(repo_path).join("tmp")
+}
+
+/// Delete the stored content of an asset that was removed or replaced,
+/// unless another asset has the same content
+fn forget_asset(repo_path: &Path, releases: &BTreeMap<String, Release>, asset: &Asset) {
+    let used = releases
+        .values()
+        .flat_map(|release| &release.assets)
+        .any(|other| other.sha256 == asset.sha256);
+    if !used {
+        let _ = fs::remove_file(asset_path(repo_path, asset));
+    }
+}
+
+/// The lock held while a repository's releases are read, changed and written
+/// back, so concurrent changes don't undo each other
+fn lock(repo_path: &Path) -> Arc<Mutex<()>> {
+    static LOCKS: OnceLock<Mutex<HashMap<PathBuf, Arc<Mutex<()>>>>> = OnceLock::new();
+    LOCKS
+        .get_or_init(Default::default)
+        .lock()
+        .unwrap()
+        .entry(repo_path.to_path_buf())
+        .or_default()
+        .clone()
+}
+
+fn releases_path(repo_path: &Path) -> PathBuf {
+    git::data_dir(repo_path).join("releases.json")
+}
+
+fn load(repo_path: &Path) -> Result<BTreeMap<String, Release>> {
+    let path = releases_path(repo_path);
+    match fs::read_to_string(&path) {
+        Ok(content) => serde_json::from_str(&content)
+            .with_context(|| format!("Failed to parse {}", path.display())),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(BTreeMap::new()),
+        Err(e) => Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    }
+}
+
+fn store(repo_path: &Path, releases: &BTreeMap<String, Release>) -> Result<()> {
+    let path = releases_path(repo_path);
+    if let Some(dir) = path.parent() {
+        fs::create_dir_all(dir)?;
+    }
+    let tmp = path.with_extension(format!("json.{}.tmp", keys::hex(&keys::random_bytes(4)?)));
+    fs::write(&tmp, serde_json::to_string_pretty(releases)?)?;
+    fs::rename(&tmp, &path)?;
+    Ok(())
+}
+
+/// All releases, newest first
+pub fn list(repo_path: &Path) -> Result<Vec<Release>> {
+    let mut releases: Vec<Release> = load(repo_path)?.into_values().collect();
+    releases.sort_by(|a, b| b.created.cmp(&a.created).then(b.tag.cmp(&a.tag)));
+    Ok(releases)
+}
+
+pub fn get(repo_path: &Path, tag: &str) -> Result<Option<Release>> {
+    Ok(load(repo_path)?.remove(tag))
+}
+
+/// Add a release, or replace the release of the same tag, keeping its
+/// assets
+pub fn save(repo_path: &Path, mut release: Release) -> Result<()> {
+    if release.tag.is_empty() || release.tag.starts_with("refs/") {
+        anyhow::bail!("Invalid tag '{}'", release.tag);
+    }
+    let lock = lock(repo_path);
+    let _guard = lock.lock().unwrap();
+    let mut releases = load(repo_path)?;
+    if let Some(existing) = releases.remove(&release.tag) {
+        release.assets = existing.assets;
+    }
+    releases.insert(release.tag.clone(), release);
+    store(repo_path, &releases)
+}
+
+/// Remove the release of a tag, with its assets, returning it
+pub fn remove(repo_path: &Path, tag: &str) -> Result<Option<Release>> {
+    let lock = lock(repo_path);
+    let _guard = lock.lock().unwrap();
+    let mut releases = load(repo_path)?;
+    let removed = releases.remove(tag);
+    if let Some(removed) = &removed {
+        store(repo_path, &releases)?;
+        for asset in &removed.assets {
+            forget_asset(repo_path, &releases, asset);
+        }
+    }
+    Ok(removed)
+}
+
+/// Attach the file at `upload`, which is moved away, to the release of
+/// `tag` as `name`, replacing an asset of the same name
+pub fn add_asset(
+    repo_path: &Path,
+    tag: &str,
+    name: &str,
+    upload: &Path,
+    uploader: &str,
+) -> Result<Asset> {
+    if !valid_asset_name(name) {
+        anyhow::bail!("Invalid asset name '{}'", name);
+    }
+    let mut file =
+        fs::File::open(upload).with_context(|| format!("Failed to read {}", upload.display()))?;
+    let mut hasher = Sha256::new();
+    let mut size = 0;
+    let mut buf = vec![0u8; 64 * 1024];
+    loop {
+        let n = file.read(&mut buf)?;
+        if n == 0 {
+            break;
+        }
+        hasher.update(&buf[..n]);
+        size += n as u64;
+    }
+    let asset = Asset {
+        name: name.to_string(),
+        size,
+        sha256: keys::hex(&hasher.finalize()),
+        uploader: uploader.to_string(),
+        uploaded: chrono::Utc::now().timestamp(),
+    };
+
+    let lock = lock(repo_path);
+    let _guard = lock.lock().unwrap();
+    let mut releases = load(repo_path)?;
+    let release = releases
+        .get_mut(tag)
+        .ok_or_else(|| anyhow::anyhow!("No release for tag '{}'", tag))?;
+    let path = asset_path(repo_path, &asset);
+    fs::create_dir_all(assets_dir(repo_path))?;
+    fs::rename(upload, &path).with_context(|| format!("Failed to store {}", path.display()))?;
+
+    let replaced = release
+        .assets
+        .iter()
+        .position(|existing| existing.name == name)
+        .map(|index| release.assets.remove(index));
+    release.assets.push(asset.clone());
+    store(repo_path, &releases)?;
+    if let Some(replaced) = replaced {
+        forget_asset(repo_path, &releases, &replaced);
+    }
+    Ok(asset)
+}
+
+/// Remove an asset from the release of `tag`, returning it
+pub fn remove_asset(repo_path: &Path, tag: &str, name: &str) -> Result<Option<Asset>> {
+    let lock = lock(repo_path);
+    let _guard = lock.lock().unwrap();
+    let mut releases = load(repo_path)?;
+    let release = match releases.get_mut(tag) {
+        Some(release) => release,
+        None => return Ok(None),
+    };
+    let index = match release.assets.iter().position(|asset| asset.name == name) {
+        Some(index) => index,
+        None => return Ok(None),
+    };
+    let removed = release.assets.remove(index);
+    store(repo_path, &releases)?;
+    forget_asset(repo_path, &releases, &removed);
+    Ok(Some(removed))
+}
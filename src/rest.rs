@@ -0,0 +1,156 @@
+//! The `agito` client's HTTPS transport: managing repositories through the
+//! server's REST API with a personal access token, for profiles with
+//! `protocol = https` (see [`crate::profile`]).
+//!
+//! Requests are made with curl. The token goes in on stdin, where other
+//! users can't see it.
+
+use crate::profile::Profile;
+use crate::quota::Status;
+use anyhow::{Context, Result};
+use serde_json::Value;
+use std::io::Write;
+use std::process::{Command, Stdio};
+
+/// Longest a request may take, in seconds
+const TIMEOUT_SECS: &str = "300";
+
+pub struct Client {
+    url: String,
+    token: String,
+}
+
+impl Client {
+    /// A client for the web server a profile names
+    pub fn new(profile: &Profile) -> Result<Self> {
+        let url = profile
+            .url
+            .clone()
+            .context("The profile uses https but has no url of the web server")?;
+        let token = profile.token.clone().context(
+            "The profile uses https but has no token; create one on the web interface's Access tokens page",
+        )?;
+        Ok(Self { url, token })
+    }
+
+    /// The web server's address
+    pub fn url(&self) -> &str {
+        &self.url
+    }
+
+    /// The repositories the user may read, with `name`, `visibility` and
+    /// `archived`
+    pub fn list(&self) -> Result<Value> {
+        self.request("GET", "/api/v1/repos", None)
+    }
+
+    /// Create a repository, returning it as `GET /api/v1/repos/<name>`
+    /// describes it
+    pub fn create(
+        &self,
+        name: &str,
+        visibility: Option<&str>,
+        template: Option<&str>,
+        with_hooks: bool,
+    ) -> Result<Value> {
+        let name = if name.ends_with(".git") {
+            name.to_string()
+        } else {
+            format!("{}.git", name)
+        };
+        let body = serde_json::json!({
+            "name": name,
+            "visibility": visibility,
+            "template": template,
+            "with_hooks": with_hooks,
+        });
+        self.request("POST", "/api/v1/repos", Some(&body))
+    }
+
+    /// A repository's size and quota
+    pub fn quota(&self, name: &str) -> Result<Value> {
+        self.request("GET", &format!("/api/v1/repos/{}/quota", path(name)), None)
+    }
+
+    /// Move a repository to the trash, returning its id there
+    pub fn delete(&self, name: &str) -> Result<String> {
+        let reply = self.request("DELETE", &format!("/api/v1/repos/{}", path(name)), None)?;
+        Ok(reply["trash_id"].as_str().unwrap_or_default().to_string())
+    }
+
+    /// Send a request, returning the JSON response
+    fn request(&self, method: &str, api_path: &str, body: Option<&Value>) -> Result<Value> {
+        let url = format!("{}{}", self.url, api_path);
+        let mut command = Command::new("curl");
+        command
+            .args(["--silent", "--show-error", "--proto", "=http,https"])
+            .args(["--max-time", TIMEOUT_SECS, "--request", method])
+            .args(["--user-agent", concat!("agito/", env!("CARGO_PKG_VERSION"))])
+            .args(["--write-out", "\n%{http_code}", "--header", "@-"]);
+        if let Some(body) = body {
+            command
+                .args([
+                    "--header",
+                    "Content-Type: application/json",
+                    "--data-binary",
+                ])
+                .arg(body.to_string());
+        }
+        let mut child = command
+            .arg("--")
+            .arg(&url)
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::piped())
+            .spawn()
+            .context("Failed to run curl")?;
+        if let Some(mut stdin) = child.stdin.take() {
+            let _ = writeln!(stdin, "Authorization: Bearer {}", self.token.trim());
+        }
+        let output = child.wait_with_output()?;
+        if !output.status.success() {
+            anyhow::bail!(
+                "Failed to reach {}: {}",
+                self.url,
+                String::from_utf8_lossy(&output.stderr).trim()
+            );
+        }
+
+        // The status comes last, after the body
+        let mut stdout = output.stdout;
+        let split = stdout.iter().rposition(|&b| b == b'\n').unwrap_or(0);
+        let status: u16 = String::from_utf8_lossy(&stdout[split..]).trim().parse()?;
+        stdout.truncate(split);
+        if !(200..300).contains(&status) {
+            let message = String::from_utf8_lossy(&stdout).trim().to_string();
+            match status {
+                401 => anyhow::bail!("{} (is the token valid?)", message),
+                404 if message.is_empty() => anyhow::bail!(
+                    "{} has no {}; it may need a newer agito-server",
+                    self.url,
+                    api_path
+                ),
+                _ => anyhow::bail!("{}", message),
+            }
+        }
+        serde_json::from_slice(&stdout).with_context(|| format!("{} sent invalid JSON", url))
+    }
+}
+
+/// A repository's size and quota from [`Client::quota`], to describe
+pub fn quota_status(reply: &Value) -> Status {
+    Status {
+        repo_bytes: reply["size_bytes"].as_u64().unwrap_or(0),
+        repo_limit: reply["quota_bytes"].as_u64(),
+        user: reply["namespace"].as_str().map(str::to_string),
+        user_bytes: reply["namespace_bytes"].as_u64().unwrap_or(0),
+        user_limit: reply["namespace_quota_bytes"].as_u64(),
+    }
+}
+
+/// A repository name as one segment of an API path
+fn path(name: &str) -> String {
+    name.trim_start_matches('/')
+        .replace('%', "%25")
+        .replace('/', "%2F")
+}
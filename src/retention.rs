@@ -0,0 +1,229 @@
+use crate::{git, jobs, usage};
+use serde::Serialize;
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+use std::time::{Duration, SystemTime};
+
+/// Kinds of auxiliary data kept next to a repository, in its agito data directory
+#[derive(Clone, Copy, Debug, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "kebab-case")]
+pub enum Kind {
+    CiLogs,
+    Artifacts,
+    WebhookDeliveries,
+}
+
+impl Kind {
+    pub const ALL: [Kind; 3] = [Kind::CiLogs, Kind::Artifacts, Kind::WebhookDeliveries];
+
+    pub fn name(self) -> &'static str {
+        match self {
+            Kind::CiLogs => "ci-logs",
+            Kind::Artifacts => "artifacts",
+            Kind::WebhookDeliveries => "webhook-deliveries",
+        }
+    }
+
+    /// Location below the repository's agito data directory. Every direct
+    /// child (a file or a directory per run or delivery) expires as a whole.
+    pub fn dir(self) -> &'static str {
+        match self {
+            Kind::CiLogs => "ci/logs",
+            Kind::Artifacts => "ci/artifacts",
+            Kind::WebhookDeliveries => "webhooks/deliveries",
+        }
+    }
+
+    /// Git config key that overrides the server-wide policy for one repository
+    fn config_key(self) -> &'static str {
+        match self {
+            Kind::CiLogs => "agito.retention.ciLogsDays",
+            Kind::Artifacts => "agito.retention.artifactsDays",
+            Kind::WebhookDeliveries => "agito.retention.webhookDeliveriesDays",
+        }
+    }
+}
+
+/// How many days each kind of data is kept; 0 keeps it forever
+#[derive(Clone, Debug)]
+pub struct Policy {
+    pub ci_logs_days: u64,
+    pub artifacts_days: u64,
+    pub webhook_deliveries_days: u64,
+}
+
+impl Default for Policy {
+    fn default() -> Self {
+        Self {
+            ci_logs_days: 90,
+            artifacts_days: 30,
+            webhook_deliveries_days: 14,
+        }
+    }
+}
+
+impl Policy {
+    pub fn days(&self, kind: Kind) -> u64 {
+        match kind {
+            Kind::CiLogs => self.ci_logs_days,
+            Kind::Artifacts => self.artifacts_days,
+            Kind::WebhookDeliveries => self.webhook_deliveries_days,
+        }
+    }
+
+    /// Retention for a repository: the server-wide value unless its git
+    /// config sets `agito.retention.<kind>Days`
+    pub fn days_for_repo(&self, repo_path: &Path, kind: Kind) -> u64 {
+        git::config_get(repo_path, kind.config_key())
+            .and_then(|value| value.parse().ok())
+            .unwrap_or_else(|| self.days(kind))
+    }
+}
+
+/// What was (or, in a dry run, would be) removed for one kind of data in one repository
+#[derive(Clone, Debug, Serialize)]
+pub struct Cleanup {
+    pub repo: String,
+    pub kind: Kind,
+    pub entries: usize,
+    pub bytes: u64,
+}
+
+/// Result of a retention run
+#[derive(Clone, Debug, Default, Serialize)]
+pub struct Report {
+    pub dry_run: bool,
+    pub cleanups: Vec<Cleanup>,
+}
+
+impl Report {
+    pub fn entries(&self) -> usize {
+        self.cleanups.iter().map(|c| c.entries).sum()
+    }
+
+    pub fn bytes(&self) -> u64 {
+        self.cleanups.iter().map(|c| c.bytes).sum()
+    }
+
+    /// Print one line per repository and kind, then the total
+    pub fn print(&self) {
+        for cleanup in &self.cleanups {
+            println!(
+                "{:>10}  {}  {} ({} entries)",
+                usage::format_bytes(cleanup.bytes),
+                cleanup.repo,
+                cleanup.kind.name(),
+                cleanup.entries,
+            );
+        }
+        println!(
+            "{:>10}  total {} ({} entries)",
+            usage::format_bytes(self.bytes()),
+            if self.dry_run {
+                "that would be reclaimed"
+            } else {
+                "reclaimed"
+            },
+            self.entries()
+        );
+    }
+}
+
+/// Apply the retention policy to every repository below `repos_dir`.
+/// With `dry_run`, only report what would be removed.
+pub fn run(repos_dir: &Path, policy: &Policy, dry_run: bool) -> io::Result<Report> {
+    let mut report = Report {
+        dry_run,
+        ..Default::default()
+    };
+
+    for (name, repo_path) in git::find_repositories(repos_dir)? {
+        let data_dir = git::data_dir(&repo_path);
+        if !data_dir.is_dir() {
+            continue;
+        }
+
+        for kind in Kind::ALL {
+            let days = policy.days_for_repo(&repo_path, kind);
+            if days == 0 {
+                continue;
+            }
+
+            let dir = data_dir.join(kind.dir());
+            match expire(&dir, Duration::from_secs(days * 24 * 3600), dry_run) {
+                Ok((entries, bytes)) if entries > 0 => report.cleanups.push(Cleanup {
+                    repo: name.clone(),
+                    kind,
+                    entries,
+                    bytes,
+                }),
+                Ok(_) => {}
+                Err(e) => tracing::warn!("Retention cleanup of {:?} failed: {}", dir, e),
+            }
+        }
+    }
+
+    Ok(report)
+}
+
+/// Remove the direct children of `dir` last modified longer than `max_age` ago
+fn expire(dir: &Path, max_age: Duration, dry_run: bool) -> io::Result<(usize, u64)> {
+    let cutoff = SystemTime::now() - max_age;
+    let mut expired: Vec<PathBuf> = Vec::new();
+
+    let entries = match fs::read_dir(dir) {
+        Ok(entries) => entries,
+        Err(e) if e.kind() == io::ErrorKind::NotFound => return Ok((0, 0)),
+        Err(e) => return Err(e),
+    };
+    for entry in entries {
+        let entry = entry?;
+        if entry.metadata()?.modified()? < cutoff {
+            expired.push(entry.path());
+        }
+    }
+
+    let mut bytes = 0;
+    for path in &expired {
+        bytes += usage::path_size(path)?;
+        if dry_run {
+            continue;
+        }
+        if fs::symlink_metadata(path)?.is_dir() {
+            fs::remove_dir_all(path)?;
+        } else {
+            fs::remove_file(path)?;
+        }
+    }
+
+    Ok((expired.len(), bytes))
+}
+
+/// Apply the policy every `interval`, logging how much space was reclaimed
+pub fn spawn(
+    repos_dir: PathBuf,
+    policy: Policy,
+    interval: Duration,
+) -> tokio::task::JoinHandle<()> {
+    jobs::spawn_periodic("retention_cleanup", interval, move || {
+        let report = run(&repos_dir, &policy, false)?;
+        for cleanup in &report.cleanups {
+            tracing::info!(
+                repo = %cleanup.repo,
+                kind = cleanup.kind.name(),
+                entries = cleanup.entries,
+                bytes = cleanup.bytes,
+                "Expired old data"
+            );
+        }
+        if report.entries() > 0 {
+            tracing::info!(
+                "Retention cleanup reclaimed {} in {} entries",
+                usage::format_bytes(report.bytes()),
+                report.entries()
+            );
+        }
+        Ok(())
+    })
+}
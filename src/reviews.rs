@@ -0,0 +1,400 @@
+//! Code review: comment threads on lines of a commit's or pull request's diff.
+//!
+//! A thread starts with a comment on one line of one file, on the old or the
+//! new side of the diff, and collects replies until someone resolves it. Each
+//! thread is a JSON file, `<repo>/agito/reviews/<target>/<id>.json`, where the
+//! target is `commit-<id>` or `pull-<number>`.
+//!
+//! Lines are numbered as in the files themselves. A thread remembers the
+//! commit it was written against and the diff line itself, so when a pull
+//! request moves on, threads whose line changed or moved are outdated.
+
+use crate::git;
+use crate::issues::Comment;
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+
+/// What a thread comments on
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub enum Target {
+    Commit(String),
+    Pull(u64),
+}
+
+impl Target {
+    fn dir_name(&self) -> String {
+        match self {
+            Self::Commit(id) => format!("commit-{}", id),
+            Self::Pull(number) => format!("pull-{}", number),
+        }
+    }
+}
+
+/// Which version of a file a line number counts in: the old side holds
+/// removed lines, the new side added and unchanged ones
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq, Hash, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Side {
+    Old,
+    #[default]
+    New,
+}
+
+impl FromStr for Side {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "old" => Ok(Self::Old),
+            "new" => Ok(Self::New),
+            _ => Err(format!("unknown diff side '{}' (expected old or new)", s)),
+        }
+    }
+}
+
+impl Side {
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::Old => "old",
+            Self::New => "new",
+        }
+    }
+}
+
+/// A line of a file in a diff
+#[derive(Clone, Debug, PartialEq, Eq, Hash, Serialize, Deserialize)]
+pub struct Position {
+    pub path: String,
+    #[serde(default)]
+    pub side: Side,
+    pub line: u32,
+}
+
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Thread {
+    pub id: u64,
+    #[serde(flatten)]
+    pub position: Position,
+    /// The commit whose diff was commented on: the commit itself, or the
+    /// pull request's head at the time
+    pub commit: String,
+    /// The diff line commented on, with its +, - or space
+    pub code: String,
+    pub author: String,
+    /// Markdown
+    pub body: String,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub replies: Vec<Comment>,
+    #[serde(default)]
+    pub resolved: bool,
+    /// Who resolved the thread, while it is resolved
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub resolved_by: Option<String>,
+    /// Unix time
+    pub created: i64,
+    /// Unix time of the last reply or change
+    pub updated: i64,
+}
+
+impl Thread {
+    pub fn reply(&mut self, author: &str, body: &str) -> Result<()> {
+        if body.trim().is_empty() {
+            anyhow::bail!("Comments cannot be empty");
+        }
+        self.replies.push(Comment {
+            author: author.to_string(),
+            body: body.trim_end().to_string(),
+            created: chrono::Utc::now().timestamp(),
+        });
+        Ok(())
+    }
+
+    pub fn set_resolved(&mut self, resolved: bool, by: &str) {
+        self.resolved = resolved;
+        self.resolved_by = resolved.then(|| by.to_string());
+    }
+
+    /// Everyone who took part, starting with the author
+    pub fn participants(&self) -> Vec<&str> {
+        let mut participants = vec![self.author.as_str()];
+        for reply in &self.replies {
+            if !participants.contains(&reply.author.as_str()) {
+                participants.push(&reply.author);
+            }
+        }
+        participants
+    }
+}
+
+/// What a line of a unified diff is
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum Kind {
+    /// `diff --git`, `index`, `---`, `+++` and the like
+    File,
+    /// `@@ -1,4 +1,5 @@`
+    Hunk,
+    Added,
+    Removed,
+    Context,
+    /// Anything else, like `--stat` output before the first file
+    Other,
+}
+
+/// A line of a unified diff and, for lines of a hunk, where it sits in the
+/// file
+#[derive(Clone, Debug)]
+pub struct Line<'a> {
+    pub text: &'a str,
+    pub kind: Kind,
+    pub position: Option<Position>,
+    /// Its number in the old file, for context lines, whose position is in
+    /// the new one, and removed lines
+    pub old_line: Option<u32>,
+}
+
+/// Number the lines of a diff as printed by `git diff` or `git show`
+pub fn lines(diff: &str) -> Vec<Line<'_>> {
+    let mut lines = Vec::new();
+    let mut path = String::new();
+    // Whether any file started yet, which ends --stat output
+    let mut files = false;
+    // Next line numbers on each side while inside a hunk
+    let mut hunk: Option<(u32, u32)> = None;
+    for text in diff.lines() {
+        if text.starts_with("diff --git ") {
+            hunk = None;
+            files = true;
+            path.clear();
+        } else if text.starts_with("@@") {
+            hunk = parse_hunk(text);
+            lines.push(Line {
+                text,
+                kind: Kind::Hunk,
+                position: None,
+                old_line: None,
+            });
+            continue;
+        }
+        let mut old_line = None;
+        let (kind, position) = match hunk.as_mut() {
+            Some((old, new)) => match text.chars().next() {
+                Some('+') => {
+                    *new += 1;
+                    (Kind::Added, Some((Side::New, *new - 1)))
+                }
+                Some('-') => {
+                    *old += 1;
+                    old_line = Some(*old - 1);
+                    (Kind::Removed, Some((Side::Old, *old - 1)))
+                }
+                Some(' ') | None => {
+                    *old += 1;
+                    *new += 1;
+                    old_line = Some(*old - 1);
+                    (Kind::Context, Some((Side::New, *new - 1)))
+                }
+                // "\ No newline at end of file"
+                _ => (Kind::Other, None),
+            },
+            None => {
+                if let Some(name) = text.strip_prefix("--- ") {
+                    path = diff_path(name, "a/");
+                    (Kind::File, None)
+                } else if let Some(name) = text.strip_prefix("+++ ") {
+                    if name != "/dev/null" {
+                        path = diff_path(name, "b/");
+                    }
+                    (Kind::File, None)
+                } else if files {
+                    (Kind::File, None)
+                } else {
+                    (Kind::Other, None)
+                }
+            }
+        };
+        lines.push(Line {
+            text,
+            kind,
+            position: position.map(|(side, line)| Position {
+                path: path.clone(),
+                side,
+                line,
+            }),
+            old_line,
+        });
+    }
+    lines
+}
+
+/// The first old and new line numbers of a hunk header
+fn parse_hunk(header: &str) -> Option<(u32, u32)> {
+    let mut ranges = header.split_whitespace().skip(1);
+    let start = |range: Option<&str>, sign: char| -> Option<u32> {
+        range?.strip_prefix(sign)?.split(',').next()?.parse().ok()
+    };
+    let old = start(ranges.next(), '-')?;
+    let new = start(ranges.next(), '+')?;
+    // An empty side starts at 0; its first line would be 1
+    Some((old.max(1), new.max(1)))
+}
+
+/// A file name from a `---`/`+++` line, without git's a/ or b/ prefix and
+/// quoting
+fn diff_path(name: &str, prefix: &str) -> String {
+    let name = name.trim_end_matches('\t');
+    let name = match name.strip_prefix('"').and_then(|n| n.strip_suffix('"')) {
+        Some(quoted) => quoted.replace("\\\"", "\"").replace("\\\\", "\\"),
+        None => name.to_string(),
+    };
+    name.strip_prefix(prefix).unwrap_or(&name).to_string()
+}
+
+/// The line of a diff at `position`
+pub fn find<'a, 'b>(lines: &'a [Line<'b>], position: &Position) -> Option<&'a Line<'b>> {
+    lines
+        .iter()
+        .find(|line| line.position.as_ref() == Some(position))
+}
+
+/// Whether a thread's line is still in a diff, unchanged and in the same place
+pub fn is_current(lines: &[Line], thread: &Thread) -> bool {
+    find(lines, &thread.position).map_or(false, |line| line.text == thread.code)
+}
+
+fn target_dir(repo_path: &Path, target: &Target) -> PathBuf {
+    git::data_dir(repo_path)
+        .join("reviews")
+        .join(target.dir_name())
+}
+
+fn thread_path(repo_path: &Path, target: &Target, id: u64) -> PathBuf {
+    target_dir(repo_path, target).join(format!("{}.json", id))
+}
+
+/// Threads on a commit or pull request, oldest first
+pub fn list(repo_path: &Path, target: &Target) -> Result<Vec<Thread>> {
+    let dir = target_dir(repo_path, target);
+    let entries = match fs::read_dir(&dir) {
+        Ok(entries) => entries,
+        Err(e) if e.kind() == io::ErrorKind::NotFound => return Ok(Vec::new()),
+        Err(e) => return Err(e).with_context(|| format!("Failed to read {}", dir.display())),
+    };
+    let mut ids: Vec<u64> = entries
+        .filter_map(|entry| {
+            entry
+                .ok()?
+                .file_name()
+                .to_str()?
+                .strip_suffix(".json")?
+                .parse()
+                .ok()
+        })
+        .collect();
+    ids.sort_unstable();
+    let mut threads = Vec::new();
+    for id in ids {
+        threads.extend(get(repo_path, target, id)?);
+    }
+    Ok(threads)
+}
+
+pub fn get(repo_path: &Path, target: &Target, id: u64) -> Result<Option<Thread>> {
+    let path = thread_path(repo_path, target, id);
+    match fs::read_to_string(&path) {
+        // Just claimed by start() and not written yet
+        Ok(content) if content.is_empty() => Ok(None),
+        Ok(content) => serde_json::from_str(&content)
+            .map(Some)
+            .with_context(|| format!("Failed to parse {}", path.display())),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(None),
+        Err(e) => Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    }
+}
+
+/// Start a thread on a line of `diff`, the diff of `commit`
+pub fn start(
+    repo_path: &Path,
+    target: &Target,
+    diff: &str,
+    commit: &str,
+    position: Position,
+    author: &str,
+    body: &str,
+) -> Result<Thread> {
+    if body.trim().is_empty() {
+        anyhow::bail!("Comments cannot be empty");
+    }
+    let lines = lines(diff);
+    let code = match find(&lines, &position) {
+        Some(line) => line.text.to_string(),
+        None => anyhow::bail!(
+            "The diff has no line {} on the {} side of {}",
+            position.line,
+            position.side.name(),
+            position.path
+        ),
+    };
+    let now = chrono::Utc::now().timestamp();
+    let mut thread = Thread {
+        id: 0,
+        position,
+        commit: commit.to_string(),
+        code,
+        author: author.to_string(),
+        body: body.trim_end().to_string(),
+        replies: Vec::new(),
+        resolved: false,
+        resolved_by: None,
+        created: now,
+        updated: now,
+    };
+
+    fs::create_dir_all(target_dir(repo_path, target))?;
+    let mut id = list(repo_path, target)?
+        .last()
+        .map_or(0, |thread| thread.id)
+        + 1;
+    // Claim the id by creating its file, so concurrent threads can't get the
+    // same one
+    loop {
+        match fs::OpenOptions::new()
+            .write(true)
+            .create_new(true)
+            .open(thread_path(repo_path, target, id))
+        {
+            Ok(_) => break,
+            Err(e) if e.kind() == io::ErrorKind::AlreadyExists => id += 1,
+            Err(e) => return Err(e).context("Failed to start the thread"),
+        }
+    }
+    thread.id = id;
+    save(repo_path, target, &thread)?;
+    Ok(thread)
+}
+
+/// Change a thread and save it, returning the result
+pub fn update(
+    repo_path: &Path,
+    target: &Target,
+    id: u64,
+    change: impl FnOnce(&mut Thread) -> Result<()>,
+) -> Result<Thread> {
+    let mut thread =
+        get(repo_path, target, id)?.with_context(|| format!("No such review thread: {}", id))?;
+    change(&mut thread)?;
+    thread.updated = chrono::Utc::now().timestamp();
+    save(repo_path, target, &thread)?;
+    Ok(thread)
+}
+
+fn save(repo_path: &Path, target: &Target, thread: &Thread) -> Result<()> {
+    let path = thread_path(repo_path, target, thread.id);
+    let tmp = path.with_extension("json.tmp");
+    fs::write(&tmp, serde_json::to_string_pretty(thread)?)?;
+    fs::rename(&tmp, &path)?;
+    Ok(())
+}
@@ -0,0 +1,577 @@
+//! Code search: a trigram index of the default branch of each repository.
+//!
+//! For every text file the index records which three-byte sequences
+//! (trigrams) occur in it, ignoring ASCII case. A query is looked up by
+//! intersecting the files of each of its trigrams, and only those candidates
+//! are read and searched line by line, so a search touches a handful of
+//! files instead of the whole tree as `git grep` would.
+//!
+//! The index of a repository lives in `agito/search/`:
+//!
+//! - `files.json`: the branch and commit indexed, and the files with their
+//!   blob ids and languages
+//! - `trigrams.bin`: for each trigram, the files containing it, as
+//!   delta-encoded varints
+//! - `head`: the branch and commit indexed, written last, so the indexer
+//!   can tell whether the index is current without reading the rest
+//!
+//! The server's indexer ([`spawn`]) checks every repository periodically and
+//! indexes it again once its default branch has moved, so pushes become
+//! searchable shortly after they land. Indexes are only read, never
+//! required: repositories without one are left out of searches.
+
+use crate::{git, jobs};
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, HashMap, HashSet};
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex, OnceLock};
+use std::time::{Duration, SystemTime};
+
+/// Version of the index layout; indexes of other versions are rebuilt
+const VERSION: u32 = 1;
+
+/// Files larger than this are not indexed
+const MAX_FILE_SIZE: u64 = 512 * 1024;
+
+/// Files indexed per repository; the rest of a larger tree is skipped
+const MAX_FILES: usize = 100_000;
+
+/// Matching lines shown per file
+const MAX_LINES_PER_FILE: usize = 5;
+
+/// Longest line shown in results; longer ones are cut
+const MAX_LINE_LENGTH: usize = 300;
+
+/// Indexes kept in memory between searches
+const MAX_CACHED: usize = 32;
+
+const MAGIC: &[u8] = b"agito-trigrams\n";
+
+/// Languages by file extension, or by whole file name
+const LANGUAGES: &[(&str, &str)] = &[
+    ("rs", "Rust"),
+    ("go", "Go"),
+    ("py", "Python"),
+    ("js", "JavaScript"),
+    ("mjs", "JavaScript"),
+    ("jsx", "JavaScript"),
+    ("ts", "TypeScript"),
+    ("tsx", "TypeScript"),
+    ("c", "C"),
+    ("h", "C"),
+    ("cc", "C++"),
+    ("cpp", "C++"),
+    ("hpp", "C++"),
+    ("java", "Java"),
+    ("kt", "Kotlin"),
+    ("rb", "Ruby"),
+    ("php", "PHP"),
+    ("cs", "C#"),
+    ("swift", "Swift"),
+    ("sh", "Shell"),
+    ("bash", "Shell"),
+    ("sql", "SQL"),
+    ("html", "HTML"),
+    ("css", "CSS"),
+    ("md", "Markdown"),
+    ("json", "JSON"),
+    ("yml", "YAML"),
+    ("yaml", "YAML"),
+    ("toml", "TOML"),
+    ("tf", "HCL"),
+    ("hcl", "HCL"),
+    ("nix", "Nix"),
+    ("Dockerfile", "Dockerfile"),
+    ("Makefile", "Makefile"),
+];
+
+/// Language of a file from its name, if known
+pub fn language(path: &str) -> Option<&'static str> {
+    let name = path.rsplit('/').next().unwrap_or(path);
+    let extension = name.rsplit_once('.').map(|(_, extension)| extension);
+    LANGUAGES
+        .iter()
+        .find(|(key, _)| *key == name || Some(*key) == extension)
+        .map(|(_, language)| *language)
+}
+
+/// The language named `name`, ignoring case, such as "rust" for Rust
+pub fn find_language(name: &str) -> Option<&'static str> {
+    LANGUAGES
+        .iter()
+        .map(|(_, language)| *language)
+        .find(|language| language.eq_ignore_ascii_case(name))
+}
+
+#[derive(Clone, Debug, Serialize, Deserialize)]
+pub struct File {
+    pub path: String,
+    /// Id of the blob indexed
+    pub blob: String,
+    pub size: u64,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub language: Option<String>,
+}
+
+/// What an index covers
+#[derive(Clone, Debug, Serialize, Deserialize)]
+pub struct Meta {
+    pub version: u32,
+    pub branch: String,
+    pub commit: String,
+    /// Unix time
+    pub indexed: i64,
+    pub files: Vec<File>,
+    /// Files skipped because they are too large or binary
+    #[serde(default)]
+    pub skipped: usize,
+}
+
+fn index_dir(repo_path: &Path) -> PathBuf {
+    git::data_dir(repo_path).join("search")
+}
+
+fn meta_path(repo_path: &Path) -> PathBuf {
+    index_dir(repo_path).join("files.json")
+}
+
+fn trigrams_path(repo_path: &Path) -> PathBuf {
+    index_dir(repo_path).join("trigrams.bin")
+}
+
+/// What the repository's index covers, if it has one
+pub fn meta(repo_path: &Path) -> Option<Meta> {
+    let content = fs::read_to_string(meta_path(repo_path)).ok()?;
+    serde_json::from_str::<Meta>(&content)
+        .ok()
+        .filter(|meta| meta.version == VERSION)
+}
+
+/// Trigrams of text, lowercased, leaving out those spanning lines
+fn trigrams(text: &[u8]) -> HashSet<u32> {
+    text.windows(3)
+        .filter(|window| !window.contains(&b'\n'))
+        .map(|window| {
+            let [a, b, c] = [0, 1, 2].map(|i| window[i].to_ascii_lowercase() as u32);
+            a << 16 | b << 8 | c
+        })
+        .collect()
+}
+
+fn write_varint(out: &mut Vec<u8>, mut value: u32) {
+    while value >= 0x80 {
+        out.push((value as u8 & 0x7f) | 0x80);
+        value >>= 7;
+    }
+    out.push(value as u8);
+}
+
+fn read_varint(data: &[u8], pos: &mut usize) -> Option<u32> {
+    let mut value = 0u32;
+    for shift in (0..35).step_by(7) {
+        let byte = *data.get(*pos)?;
+        *pos += 1;
+        value |= ((byte & 0x7f) as u32) << shift;
+        if byte & 0x80 == 0 {
+            return Some(value);
+        }
+    }
+    None
+}
+
+fn encode(postings: &BTreeMap<u32, Vec<u32>>) -> Vec<u8> {
+    let mut out = MAGIC.to_vec();
+    write_varint(&mut out, postings.len() as u32);
+    for (trigram, files) in postings {
+        write_varint(&mut out, *trigram);
+        write_varint(&mut out, files.len() as u32);
+        let mut previous = 0;
+        for &file in files {
+            write_varint(&mut out, file - previous);
+            previous = file;
+        }
+    }
+    out
+}
+
+fn decode(data: &[u8]) -> Option<HashMap<u32, Vec<u32>>> {
+    let mut pos = MAGIC.len();
+    if data.get(..pos)? != MAGIC {
+        return None;
+    }
+    let count = read_varint(data, &mut pos)?;
+    let mut postings = HashMap::with_capacity(count as usize);
+    for _ in 0..count {
+        let trigram = read_varint(data, &mut pos)?;
+        let len = read_varint(data, &mut pos)?;
+        let mut files = Vec::with_capacity(len as usize);
+        let mut file = 0;
+        for _ in 0..len {
+            file += read_varint(data, &mut pos)?;
+            files.push(file);
+        }
+        postings.insert(trigram, files);
+    }
+    Some(postings)
+}
+
+/// Commit the default branch points to
+fn branch_head(repo_path: &Path) -> Option<(String, String)> {
+    let branch = git::head_branch(repo_path)?;
+    let object = git::batch::pool()
+        .check(repo_path, &format!("refs/heads/{}^{{commit}}", branch))
+        .ok()??;
+    Some((branch, object.id))
+}
+
+fn head_path(repo_path: &Path) -> PathBuf {
+    index_dir(repo_path).join("head")
+}
+
+/// Whether the repository's default branch has a commit to index
+pub fn indexable(repo_path: &Path) -> bool {
+    branch_head(repo_path).is_some()
+}
+
+/// Whether the repository has no index of its default branch's head
+pub fn is_stale(repo_path: &Path) -> bool {
+    match branch_head(repo_path) {
+        Some((branch, commit)) => {
+            let indexed = fs::read_to_string(head_path(repo_path)).unwrap_or_default();
+            indexed.trim() != format!("{} {} {}", VERSION, branch, commit)
+        }
+        // Empty repositories have nothing to index
+        None => false,
+    }
+}
+
+/// Index the head of the repository's default branch
+pub fn build(repo_path: &Path) -> Result<Meta> {
+    let (branch, commit) =
+        branch_head(repo_path).context("The repository has no default branch to index")?;
+    let output = git::run(repo_path, &["ls-tree", "-r", "-l", "-z", &commit])?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "git ls-tree failed: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+
+    let mut files = Vec::new();
+    let mut postings: BTreeMap<u32, Vec<u32>> = BTreeMap::new();
+    let mut skipped = 0;
+    for entry in output.stdout.split(|&b| b == 0) {
+        // <mode> SP <type> SP <object> SP+ <size> TAB <path>
+        let entry = String::from_utf8_lossy(entry);
+        let Some((info, path)) = entry.split_once('\t') else {
+            continue;
+        };
+        let fields: Vec<&str> = info.split_whitespace().collect();
+        let [_, "blob", blob, size] = fields[..] else {
+            continue;
+        };
+        let size: u64 = size.parse().unwrap_or(u64::MAX);
+        if size > MAX_FILE_SIZE || files.len() >= MAX_FILES {
+            skipped += 1;
+            continue;
+        }
+        let data = match git::batch::pool().read(repo_path, blob)? {
+            Some(object) => object.data,
+            None => continue,
+        };
+        if data[..data.len().min(8000)].contains(&0) {
+            skipped += 1;
+            continue;
+        }
+        let id = files.len() as u32;
+        for trigram in trigrams(&data) {
+            postings.entry(trigram).or_default().push(id);
+        }
+        files.push(File {
+            path: path.to_string(),
+            blob: blob.to_string(),
+            size,
+            language: language(path).map(str::to_string),
+        });
+    }
+
+    let meta = Meta {
+        version: VERSION,
+        branch,
+        commit,
+        indexed: chrono::Utc::now().timestamp(),
+        files,
+        skipped,
+    };
+    let dir = index_dir(repo_path);
+    fs::create_dir_all(&dir)?;
+    // The trigrams go first, so the file list never names files the
+    // trigrams don't know about
+    let tmp = dir.join("trigrams.bin.tmp");
+    fs::write(&tmp, encode(&postings))?;
+    fs::rename(&tmp, trigrams_path(repo_path))?;
+    let tmp = dir.join("files.json.tmp");
+    fs::write(&tmp, serde_json::to_vec(&meta)?)?;
+    fs::rename(&tmp, meta_path(repo_path))?;
+    let tmp = dir.join("head.tmp");
+    fs::write(
+        &tmp,
+        format!("{} {} {}\n", VERSION, meta.branch, meta.commit),
+    )?;
+    fs::rename(&tmp, head_path(repo_path))?;
+    Ok(meta)
+}
+
+/// Drop a repository's index
+pub fn remove(repo_path: &Path) -> Result<()> {
+    match fs::remove_dir_all(index_dir(repo_path)) {
+        Err(e) if e.kind() != io::ErrorKind::NotFound => Err(e.into()),
+        _ => Ok(()),
+    }
+}
+
+/// An index loaded for searching
+struct Loaded {
+    modified: SystemTime,
+    meta: Meta,
+    postings: HashMap<u32, Vec<u32>>,
+}
+
+/// Indexes kept in memory between searches, by repository, until their
+/// files change
+fn cache() -> &'static Mutex<HashMap<PathBuf, Arc<Loaded>>> {
+    static CACHE: OnceLock<Mutex<HashMap<PathBuf, Arc<Loaded>>>> = OnceLock::new();
+    CACHE.get_or_init(Default::default)
+}
+
+fn load(repo_path: &Path) -> Option<Arc<Loaded>> {
+    let modified = fs::metadata(meta_path(repo_path))
+        .and_then(|metadata| metadata.modified())
+        .ok()?;
+    if let Some(loaded) = cache().lock().unwrap().get(repo_path) {
+        if loaded.modified == modified {
+            return Some(loaded.clone());
+        }
+    }
+    let meta = meta(repo_path)?;
+    let postings = decode(&fs::read(trigrams_path(repo_path)).ok()?)?;
+    let loaded = Arc::new(Loaded {
+        modified,
+        meta,
+        postings,
+    });
+    let mut cache = cache().lock().unwrap();
+    if cache.len() >= MAX_CACHED {
+        cache.clear();
+    }
+    cache.insert(repo_path.to_path_buf(), loaded.clone());
+    Some(loaded)
+}
+
+/// What to search for
+#[derive(Clone, Debug, Default)]
+pub struct Query {
+    /// Text to find, ignoring ASCII case; at least three characters
+    pub text: String,
+    /// Only files in this language, as [`find_language`] names it
+    pub language: Option<String>,
+    /// Only files whose path starts with this
+    pub path: Option<String>,
+}
+
+impl Query {
+    pub fn check(&self) -> Result<(), String> {
+        if self.text.trim().len() < 3 {
+            return Err("Search for at least three characters".to_string());
+        }
+        Ok(())
+    }
+}
+
+/// A line that matched
+#[derive(Clone, Debug, Serialize)]
+pub struct Line {
+    pub number: usize,
+    pub text: String,
+}
+
+/// A file that matched
+#[derive(Clone, Debug, Serialize)]
+pub struct Hit {
+    pub path: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub language: Option<String>,
+    /// The first matching lines
+    pub lines: Vec<Line>,
+    /// Matching lines in all
+    pub matches: usize,
+}
+
+/// Search a repository's index, returning up to `limit` files with the
+/// branch they are on, or None if the repository has no index
+pub fn search(repo_path: &Path, query: &Query, limit: usize) -> Option<(String, Vec<Hit>)> {
+    let loaded = load(repo_path)?;
+    let needle = query.text.trim().to_ascii_lowercase();
+
+    // Files with every trigram of the query, smallest posting list first
+    let mut lists: Vec<&Vec<u32>> = Vec::new();
+    for trigram in trigrams(needle.as_bytes()) {
+        match loaded.postings.get(&trigram) {
+            Some(files) => lists.push(files),
+            None => return Some((loaded.meta.branch.clone(), Vec::new())),
+        }
+    }
+    lists.sort_by_key(|files| files.len());
+    let mut candidates: Vec<u32> = match lists.first() {
+        Some(files) => files.to_vec(),
+        None => (0..loaded.meta.files.len() as u32).collect(),
+    };
+    for files in lists.iter().skip(1) {
+        candidates.retain(|file| files.binary_search(file).is_ok());
+    }
+
+    let mut hits = Vec::new();
+    for id in candidates {
+        if hits.len() >= limit {
+            break;
+        }
+        let Some(file) = loaded.meta.files.get(id as usize) else {
+            continue;
+        };
+        if let Some(language) = &query.language {
+            if file.language.as_deref() != Some(language.as_str()) {
+                continue;
+            }
+        }
+        if let Some(prefix) = &query.path {
+            if !file.path.starts_with(prefix.as_str()) {
+                continue;
+            }
+        }
+        let data = match git::batch::pool().read(repo_path, &file.blob) {
+            Ok(Some(object)) => object.data,
+            _ => continue,
+        };
+        let text = String::from_utf8_lossy(&data);
+        let mut lines = Vec::new();
+        let mut matches = 0;
+        for (index, line) in text.lines().enumerate() {
+            if !line.to_ascii_lowercase().contains(&needle) {
+                continue;
+            }
+            matches += 1;
+            if lines.len() < MAX_LINES_PER_FILE {
+                lines.push(Line {
+                    number: index + 1,
+                    text: line.chars().take(MAX_LINE_LENGTH).collect(),
+                });
+            }
+        }
+        if matches > 0 {
+            hits.push(Hit {
+                path: file.path.clone(),
+                language: file.language.clone(),
+                lines,
+                matches,
+            });
+        }
+    }
+    Some((loaded.meta.branch.clone(), hits))
+}
+
+/// Search the default branch of a repository with `git grep`, for those
+/// without a current index: the same results as [`search`], only slower.
+/// None if the repository has no default branch.
+pub fn grep(repo_path: &Path, query: &Query, limit: usize) -> Option<(String, Vec<Hit>)> {
+    let (branch, commit) = branch_head(repo_path)?;
+    let needle = query.text.trim();
+    let output = git::run(
+        repo_path,
+        &["grep", "-I", "-n", "-i", "-F", "-z", "--full-name", "-e", needle, &commit],
+    )
+    .ok()?;
+
+    // <commit>:<path> NUL <number> NUL <text>
+    let mut hits: Vec<Hit> = Vec::new();
+    let prefix = format!("{}:", commit);
+    for line in String::from_utf8_lossy(&output.stdout).lines() {
+        let mut fields = line.strip_prefix(prefix.as_str()).unwrap_or(line).splitn(3, '\0');
+        let (Some(path), Some(number), Some(text)) = (fields.next(), fields.next(), fields.next())
+        else {
+            continue;
+        };
+        if query.path.as_ref().is_some_and(|prefix| !path.starts_with(prefix.as_str())) {
+            continue;
+        }
+        if query.language.is_some() && language(path) != query.language.as_deref() {
+            continue;
+        }
+        if hits.last().map_or(true, |hit| hit.path != path) {
+            if hits.len() >= limit {
+                break;
+            }
+            hits.push(Hit {
+                path: path.to_string(),
+                language: language(path).map(str::to_string),
+                lines: Vec::new(),
+                matches: 0,
+            });
+        }
+        let hit = hits.last_mut().expect("pushed above");
+        hit.matches += 1;
+        if hit.lines.len() < MAX_LINES_PER_FILE {
+            hit.lines.push(Line {
+                number: number.parse().unwrap_or(0),
+                text: text.chars().take(MAX_LINE_LENGTH).collect(),
+            });
+        }
+    }
+    Some((branch, hits))
+}
+
+/// Search a repository with its index if that is current, and with
+/// [`grep`] otherwise
+pub fn find(repo_path: &Path, query: &Query, limit: usize) -> Option<(String, Vec<Hit>)> {
+    if !is_stale(repo_path) {
+        if let Some(found) = search(repo_path, query, limit) {
+            return Some(found);
+        }
+    }
+    grep(repo_path, query, limit)
+}
+
+/// Index repositories whose default branch moved since they were indexed,
+/// returning how many were indexed
+pub fn update_all(repos_dir: &Path) -> Result<usize> {
+    let mut indexed = 0;
+    for (name, repo_path) in git::find_repositories(repos_dir)? {
+        if !is_stale(&repo_path) {
+            continue;
+        }
+        match build(&repo_path) {
+            Ok(meta) => {
+                indexed += 1;
+                tracing::info!(
+                    repo = %name,
+                    commit = %meta.commit,
+                    files = meta.files.len(),
+                    "Indexed {} for code search",
+                    meta.branch
+                );
+            }
+            Err(e) => tracing::warn!(repo = %name, "Failed to index for code search: {:#}", e),
+        }
+    }
+    Ok(indexed)
+}
+
+/// Keep every repository's index up to date, checking every `interval`
+pub fn spawn(repos_dir: PathBuf, interval: Duration) -> tokio::task::JoinHandle<()> {
+    jobs::spawn_periodic("search_index", interval, move || {
+        update_all(&repos_dir)?;
+        Ok(())
+    })
+}
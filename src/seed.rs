@@ -0,0 +1,255 @@
+use crate::{git, hooks};
+use anyhow::{Context, Result};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::process::{Command, Stdio};
+
+const AUTHORS: &[(&str, &str)] = &[
+    ("Alice Johnson", "alice@example.com"),
+    ("Bob Smith", "bob@example.com"),
+    ("Carol Nakamura", "carol@example.com"),
+    ("Dave Müller", "dave@example.com"),
+    ("Eve Martin", "eve@example.com"),
+];
+
+const PROJECTS: &[(&str, &str)] = &[
+    ("webshop", "Small storefront with cart and checkout"),
+    ("infra", "Terraform and Ansible for the staging cluster"),
+    ("docs", "Team handbook and onboarding guides"),
+    (
+        "api-gateway",
+        "Edge proxy routing requests to backend services",
+    ),
+    ("mobile-app", "Cross-platform companion app"),
+    ("data-pipeline", "Nightly ETL jobs feeding the warehouse"),
+    ("design-system", "Shared UI components and tokens"),
+    ("cli-tools", "Assorted developer scripts"),
+];
+
+const VERBS: &[&str] = &[
+    "Add", "Fix", "Refactor", "Update", "Remove", "Document", "Tune",
+];
+
+const NOUNS: &[&str] = &[
+    "login flow",
+    "config loader",
+    "retry logic",
+    "error messages",
+    "build script",
+    "cache layer",
+    "unit tests",
+    "README",
+    "logging",
+    "input validation",
+];
+
+/// Settings for `agito-admin seed`
+pub struct SeedConfig {
+    /// Directory holding the server's bare repositories
+    pub repos_dir: PathBuf,
+    /// Number of repositories to create
+    pub repos: usize,
+    /// Number of commits on the default branch of each repository
+    pub commits: usize,
+    /// Seed for the pseudo-random generator, so runs are reproducible
+    pub seed: u64,
+}
+
+/// Deterministic xorshift generator; demo data doesn't need anything stronger
+struct Rng(u64);
+
+impl Rng {
+    fn next(&mut self) -> u64 {
+        self.0 ^= self.0 << 13;
+        self.0 ^= self.0 >> 7;
+        self.0 ^= self.0 << 17;
+        self.0
+    }
+
+    fn below(&mut self, n: usize) -> usize {
+        (self.next() % n.max(1) as u64) as usize
+    }
+
+    fn pick<'a, T>(&mut self, items: &'a [T]) -> &'a T {
+        &items[self.below(items.len())]
+    }
+}
+
+/// Generate demo repositories with history, branches, tags and READMEs.
+/// Returns the names of the repositories that were created.
+pub fn run(config: &SeedConfig) -> Result<Vec<String>> {
+    let mut rng = Rng(config.seed.max(1));
+    let mut created = Vec::new();
+
+    for i in 0..config.repos {
+        let (project, description) = PROJECTS[i % PROJECTS.len()];
+        let name = if i < PROJECTS.len() {
+            format!("{}.git", project)
+        } else {
+            format!("{}-{}.git", project, i / PROJECTS.len() + 1)
+        };
+
+        let repo_path = config.repos_dir.join(&name);
+        if repo_path.exists() {
+            println!("Skipping {}: already exists", name);
+            continue;
+        }
+
+        seed_repo(&repo_path, project, description, config.commits, &mut rng)
+            .with_context(|| format!("Failed to seed {}", name))?;
+        println!("Created {} ({} commits)", name, config.commits);
+        created.push(name);
+    }
+
+    Ok(created)
+}
+
+fn seed_repo(
+    repo_path: &Path,
+    project: &str,
+    description: &str,
+    commits: usize,
+    rng: &mut Rng,
+) -> Result<()> {
+    git::init_bare_repo(repo_path, &hooks::Templates::default())?;
+    fs::write(repo_path.join("description"), format!("{}\n", description))?;
+
+    let work =
+        std::env::temp_dir().join(format!("agito-seed-{}-{}", std::process::id(), rng.next()));
+    let result = populate(repo_path, &work, project, description, commits, rng);
+    let _ = fs::remove_dir_all(&work);
+    result
+}
+
+fn populate(
+    repo_path: &Path,
+    work: &Path,
+    project: &str,
+    description: &str,
+    commits: usize,
+    rng: &mut Rng,
+) -> Result<()> {
+    run_git(None, &["init", "-q", "-b", "main", &work.to_string_lossy()])?;
+
+    // Spread history over the last year, oldest first
+    let now = chrono::Utc::now().timestamp();
+    let span = 365 * 24 * 3600;
+    let step = span / commits.max(1) as i64;
+    let mut time = now - span;
+    let mut tag = 0;
+
+    fs::write(
+        work.join("README.md"),
+        format!(
+            "# {}\n\n{}.\n\n## Getting started\n\n```\nmake build\n```\n",
+            project, description
+        ),
+    )?;
+
+    for n in 0..commits.max(1) {
+        let message = if n == 0 {
+            "Initial commit".to_string()
+        } else {
+            let file = work.join("src").join(format!("module{}.txt", rng.below(6)));
+            fs::create_dir_all(work.join("src"))?;
+            let mut content = fs::read_to_string(&file).unwrap_or_default();
+            content.push_str(&format!("change {} ({})\n", n, rng.next()));
+            fs::write(&file, content)?;
+            format!("{} {}", rng.pick(VERBS), rng.pick(NOUNS))
+        };
+
+        time += step / 2 + rng.below(step.max(1) as usize) as i64 / 2;
+        commit(work, &message, rng.pick(AUTHORS), time)?;
+
+        // Tag roughly every tenth commit as a release
+        if n > 0 && n % 10 == 0 {
+            tag += 1;
+            run_git(
+                Some(work),
+                &[
+                    "tag",
+                    "-a",
+                    &format!("v0.{}.0", tag),
+                    "-m",
+                    &format!("Release 0.{}.0", tag),
+                ],
+            )?;
+        }
+    }
+
+    // A couple of feature branches diverging from main
+    for branch in ["feature/dark-mode", "fix/flaky-tests"] {
+        run_git(Some(work), &["checkout", "-q", "-b", branch, "main"])?;
+        for n in 0..1 + rng.below(3) {
+            let file = work.join(format!("{}.md", branch.replace('/', "-")));
+            let mut content = fs::read_to_string(&file).unwrap_or_default();
+            content.push_str(&format!("- step {}\n", n + 1));
+            fs::write(&file, content)?;
+            time += 600;
+            commit(
+                work,
+                &format!("WIP {} step {}", branch, n + 1),
+                rng.pick(AUTHORS),
+                time,
+            )?;
+        }
+    }
+    run_git(Some(work), &["checkout", "-q", "main"])?;
+
+    let target = repo_path.to_string_lossy().to_string();
+    run_git(Some(work), &["push", "-q", &target, "--all"])?;
+    run_git(Some(work), &["push", "-q", &target, "--tags"])?;
+    run_git(
+        None,
+        &["-C", &target, "symbolic-ref", "HEAD", "refs/heads/main"],
+    )?;
+
+    Ok(())
+}
+
+fn commit(work: &Path, message: &str, author: &(&str, &str), time: i64) -> Result<()> {
+    run_git(Some(work), &["add", "-A"])?;
+
+    let date = format!("{} +0000", time);
+    let status = Command::new("git")
+        .arg("-C")
+        .arg(work)
+        .args(["commit", "-q", "--allow-empty", "-m", message])
+        .env("GIT_AUTHOR_NAME", author.0)
+        .env("GIT_AUTHOR_EMAIL", author.1)
+        .env("GIT_COMMITTER_NAME", author.0)
+        .env("GIT_COMMITTER_EMAIL", author.1)
+        .env("GIT_AUTHOR_DATE", &date)
+        .env("GIT_COMMITTER_DATE", &date)
+        .stdout(Stdio::null())
+        .status()
+        .context("Failed to execute git commit")?;
+
+    if !status.success() {
+        anyhow::bail!("git commit failed with status: {}", status);
+    }
+    Ok(())
+}
+
+fn run_git(dir: Option<&Path>, args: &[&str]) -> Result<()> {
+    let mut cmd = Command::new("git");
+    if let Some(dir) = dir {
+        cmd.arg("-C").arg(dir);
+    }
+    // Tags need a committer identity even when no commit is made
+    let output = cmd
+        .args(args)
+        .env("GIT_COMMITTER_NAME", "agito-seed")
+        .env("GIT_COMMITTER_EMAIL", "seed@agito.invalid")
+        .output()
+        .context("Failed to execute git")?;
+
+    if !output.status.success() {
+        anyhow::bail!(
+            "git {} failed: {}",
+            args.join(" "),
+            String::from_utf8_lossy(&output.stderr)
+        );
+    }
+    Ok(())
+}
@@ -0,0 +1,135 @@
+//! `agito serve`: a throwaway server for a directory of bare repositories,
+//! to share them on a LAN or read them in the web viewer without setting up
+//! agito-server.
+//!
+//! It serves the web viewer and clones over HTTP, and optionally SSH with the
+//! keys in the user's `~/.ssh/authorized_keys`. Everything the server keeps
+//! besides the repositories lives in a temporary directory that goes away
+//! when it stops.
+
+use crate::clone_urls::CloneUrls;
+use crate::{git, host_keys, ssh, web};
+use anyhow::{Context, Result};
+use std::net::TcpListener;
+use std::path::{Path, PathBuf};
+
+pub struct Options {
+    /// Directory of bare repositories to serve
+    pub dir: PathBuf,
+    /// Address to listen on
+    pub bind: String,
+    pub http_port: u16,
+    /// Also serve SSH on this port
+    pub ssh_port: Option<u16>,
+}
+
+/// Serve until interrupted
+pub async fn run(options: Options) -> Result<()> {
+    let dir = options
+        .dir
+        .canonicalize()
+        .with_context(|| format!("No such directory: {}", options.dir.display()))?;
+    let repos = git::find_repositories(&dir)?;
+    if repos.is_empty() {
+        eprintln!(
+            "warning: no bare repositories in {}; clone some with `git clone --bare`",
+            dir.display()
+        );
+    }
+
+    let scratch = std::env::temp_dir().join(format!("agito-serve-{}", std::process::id()));
+    std::fs::create_dir_all(&scratch)?;
+    let result = serve(&options, dir, &repos, &scratch).await;
+    let _ = std::fs::remove_dir_all(&scratch);
+    result
+}
+
+async fn serve(
+    options: &Options,
+    dir: PathBuf,
+    repos: &[(String, PathBuf)],
+    scratch: &Path,
+) -> Result<()> {
+    let bind = |port: u16| -> Result<TcpListener> {
+        let addr = format!("{}:{}", options.bind, port);
+        let listener =
+            TcpListener::bind(&addr).with_context(|| format!("Failed to bind {}", addr))?;
+        listener.set_nonblocking(true)?;
+        Ok(listener)
+    };
+    let http_listener = bind(options.http_port)?;
+    let ssh_listener = options.ssh_port.map(bind).transpose()?;
+
+    let host = local_host();
+    let base = format!("http://{}:{}", host, options.http_port);
+    let clone_urls = CloneUrls {
+        host: host.clone(),
+        ssh_port: options.ssh_port,
+        git_port: None,
+        http_base: Some(base.clone()),
+    };
+
+    let (stop_tx, stop_rx) = tokio::sync::watch::channel(false);
+    let stopped = |mut rx: tokio::sync::watch::Receiver<bool>| async move {
+        let _ = rx.wait_for(|stop| *stop).await;
+    };
+
+    let web_server = web::WebServer::new(dir.clone())
+        .with_data_dir(scratch.join("data"))
+        .with_public_url(Some(base.clone()))
+        .with_clone_urls(clone_urls.clone())
+        .with_host_keys(host_keys::paths(&scratch.join("host_key")));
+    let web_stopped = stopped(stop_rx.clone());
+    let mut handles = vec![tokio::spawn(async move {
+        if let Err(e) = web_server.start(http_listener, web_stopped).await {
+            eprintln!("Web server error: {}", e);
+        }
+    })];
+
+    if let Some(listener) = ssh_listener {
+        let home = std::env::var_os("HOME")
+            .map(PathBuf::from)
+            .unwrap_or_default();
+        let ssh_server = ssh::Server::new(
+            options.ssh_port.unwrap_or(22).to_string(),
+            scratch.join("host_key"),
+            home.join(".ssh").join("authorized_keys"),
+            dir.clone(),
+        )
+        .with_clone_urls(clone_urls.clone())
+        .with_listener(listener);
+        let ssh_stopped = stopped(stop_rx);
+        handles.push(tokio::spawn(async move {
+            if let Err(e) = ssh_server.start(ssh_stopped).await {
+                eprintln!("SSH server error: {}", e);
+            }
+        }));
+    }
+
+    println!("Serving {} at {}", dir.display(), base);
+    for (name, _) in repos {
+        println!("  git clone {}/{}", base, name);
+        if let Some(url) = clone_urls.ssh(name) {
+            println!("  git clone {}", url);
+        }
+    }
+    println!("Press Ctrl-C to stop");
+
+    tokio::signal::ctrl_c().await?;
+    let _ = stop_tx.send(true);
+    for handle in handles {
+        let _ = handle.await;
+    }
+    Ok(())
+}
+
+/// A name others on the network can reach this machine by
+fn local_host() -> String {
+    std::process::Command::new("hostname")
+        .output()
+        .ok()
+        .filter(|output| output.status.success())
+        .map(|output| String::from_utf8_lossy(&output.stdout).trim().to_string())
+        .filter(|host| !host.is_empty())
+        .unwrap_or_else(|| "localhost".to_string())
+}
@@ -0,0 +1,228 @@
+//! Verification of GPG and SSH signatures on commits and tags.
+//!
+//! Git does the checking, with the server's keyring (`GNUPGHOME`) for GPG
+//! signatures and its allowed signers file for SSH signatures. Every key in
+//! the keyring is trusted: the keyring is the server administrator's list of
+//! known signers, not a web of trust.
+
+use crate::git;
+use serde::Serialize;
+use std::collections::HashMap;
+use std::io;
+use std::path::{Path, PathBuf};
+use std::process::Output;
+
+/// Whether a signature could be checked against a known key
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum State {
+    #[default]
+    Unsigned,
+    /// Signed with a key the server knows, and the signature is good
+    Verified,
+    /// Signed, but the signature is bad or the key unknown, expired or revoked
+    Unverified,
+}
+
+/// Outcome of checking the signature of a commit or tag
+#[derive(Clone, Debug, Default, PartialEq, Eq, Serialize)]
+pub struct Signature {
+    pub state: State,
+    /// Who signed, as named by the key: a GPG user ID or an SSH principal
+    pub signer: Option<String>,
+    /// GPG key ID or SSH key fingerprint
+    pub key: Option<String>,
+    /// Why the signature is not verified
+    pub reason: Option<String>,
+}
+
+impl Signature {
+    fn unverified(reason: &str, signer: Option<String>, key: Option<String>) -> Self {
+        Self {
+            state: State::Unverified,
+            signer,
+            key,
+            reason: Some(reason.to_string()),
+        }
+    }
+}
+
+/// Keys that signatures are checked against
+#[derive(Clone, Debug, Default)]
+pub struct Verifier {
+    /// GnuPG home directory holding the public keys of trusted signers;
+    /// the server user's own keyring if unset
+    pub gpg_home: Option<PathBuf>,
+    /// `ssh-keygen` allowed signers file mapping principals to SSH keys;
+    /// SSH signatures cannot be verified without one
+    pub allowed_signers: Option<PathBuf>,
+}
+
+impl Verifier {
+    /// Run git with the configured keyring and allowed signers
+    fn git(&self, repo_path: &Path, args: &[&str]) -> io::Result<Output> {
+        let gpg_home = self
+            .gpg_home
+            .as_ref()
+            .map(|dir| dir.to_string_lossy().to_string());
+        // Without an allowed signers file git reports SSH-signed objects as
+        // unsigned; an empty one makes them show up as unverified instead
+        let allowed_signers = self
+            .allowed_signers
+            .as_ref()
+            .map(|file| file.to_string_lossy().to_string())
+            .unwrap_or_else(|| "/dev/null".to_string());
+
+        let mut env = vec![
+            ("GIT_CONFIG_COUNT", "1"),
+            ("GIT_CONFIG_KEY_0", "gpg.ssh.allowedSignersFile"),
+            ("GIT_CONFIG_VALUE_0", allowed_signers.as_str()),
+        ];
+        if let Some(dir) = &gpg_home {
+            env.push(("GNUPGHOME", dir.as_str()));
+        }
+        git::run_with_env(repo_path, args, &env)
+    }
+
+    /// Check the signatures of several commits at once, by full commit ID.
+    /// Commits that could not be checked are left out.
+    pub fn commits(&self, repo_path: &Path, ids: &[&str]) -> HashMap<String, Signature> {
+        if ids.is_empty() {
+            return HashMap::new();
+        }
+        let mut args = vec![
+            "log",
+            "--no-walk=unsorted",
+            "--format=%H%x00%G?%x00%GS%x00%GK",
+        ];
+        args.extend(ids.iter().filter(|id| !id.starts_with('-')));
+        args.push("--");
+
+        let output = match self.git(repo_path, &args) {
+            Ok(output) if output.status.success() => output,
+            _ => return HashMap::new(),
+        };
+        String::from_utf8_lossy(&output.stdout)
+            .lines()
+            .filter_map(|line| {
+                let fields: Vec<&str> = line.split('\0').collect();
+                match fields.as_slice() {
+                    [id, status, signer, key] => {
+                        Some((id.to_string(), from_status(status, signer, key)))
+                    }
+                    _ => None,
+                }
+            })
+            .collect()
+    }
+
+    /// Check the signature of an annotated tag
+    pub fn tag(&self, repo_path: &Path, tag: &str) -> Signature {
+        if tag.starts_with('-') {
+            return Signature::default();
+        }
+        let object = format!("refs/tags/{}", tag);
+        let signed = git::run(repo_path, &["cat-file", "tag", &object])
+            .map(|output| {
+                let content = String::from_utf8_lossy(&output.stdout);
+                output.status.success()
+                    && (content.contains("-----BEGIN PGP SIGNATURE-----")
+                        || content.contains("-----BEGIN SSH SIGNATURE-----"))
+            })
+            .unwrap_or(false);
+        if !signed {
+            return Signature::default();
+        }
+
+        match self.git(repo_path, &["verify-tag", "--raw", &object]) {
+            Ok(output) => from_raw(
+                &String::from_utf8_lossy(&output.stderr),
+                output.status.success(),
+            ),
+            Err(_) => Signature::unverified("the signature could not be checked", None, None),
+        }
+    }
+}
+
+/// Signature from git's `%G?`, `%GS` and `%GK` placeholders
+fn from_status(status: &str, signer: &str, key: &str) -> Signature {
+    let signer = Some(signer.to_string()).filter(|s| !s.is_empty());
+    let key = Some(key.to_string()).filter(|k| !k.is_empty());
+    let ssh = key.as_deref().map_or(false, |k| k.starts_with("SHA256:"));
+    match status {
+        "N" => Signature::default(),
+        "G" => Signature {
+            state: State::Verified,
+            signer,
+            key,
+            reason: None,
+        },
+        // For GPG, U is a good signature by a key in the keyring nobody
+        // certified; for SSH, a good signature by a key not in allowed signers
+        "U" if !ssh => Signature {
+            state: State::Verified,
+            signer,
+            key,
+            reason: None,
+        },
+        "U" => Signature::unverified("the key is not in the allowed signers file", signer, key),
+        "B" => Signature::unverified("the signature is bad", signer, key),
+        "X" => Signature::unverified("the signature has expired", signer, key),
+        "Y" => Signature::unverified("the key has expired", signer, key),
+        "R" => Signature::unverified("the key has been revoked", signer, key),
+        _ => Signature::unverified("the signer's key is not known to the server", signer, key),
+    }
+}
+
+/// Signature from the output of `git verify-tag --raw`: GnuPG status lines,
+/// or ssh-keygen's messages
+fn from_raw(output: &str, success: bool) -> Signature {
+    for line in output.lines() {
+        let line = line.trim();
+        if let Some(status) = line.strip_prefix("[GNUPG:] ") {
+            let (keyword, rest) = status.split_once(' ').unwrap_or((status, ""));
+            let (key, signer) = match rest.split_once(' ') {
+                Some((key, signer)) => (Some(key.to_string()), Some(signer.to_string())),
+                None => (Some(rest.to_string()).filter(|k| !k.is_empty()), None),
+            };
+            let reason = match keyword {
+                "GOODSIG" if success => {
+                    return Signature {
+                        state: State::Verified,
+                        signer,
+                        key,
+                        reason: None,
+                    }
+                }
+                "BADSIG" => "the signature is bad",
+                "EXPSIG" => "the signature has expired",
+                "EXPKEYSIG" => "the key has expired",
+                "REVKEYSIG" => "the key has been revoked",
+                "ERRSIG" | "NO_PUBKEY" => {
+                    return Signature::unverified(
+                        "the signer's key is not known to the server",
+                        None,
+                        key,
+                    )
+                }
+                _ => continue,
+            };
+            return Signature::unverified(reason, signer, key);
+        }
+
+        // Good "git" signature for alice@example.com with ED25519 key SHA256:...
+        if let Some(rest) = line.strip_prefix("Good \"git\" signature ") {
+            let key = rest.rsplit_once(" key ").map(|(_, key)| key.to_string());
+            return match rest.strip_prefix("for ") {
+                Some(rest) if success => Signature {
+                    state: State::Verified,
+                    signer: rest.split_once(" with ").map(|(p, _)| p.to_string()),
+                    key,
+                    reason: None,
+                },
+                _ => Signature::unverified("the key is not in the allowed signers file", None, key),
+            };
+        }
+    }
+    Signature::unverified("the signature could not be checked", None, None)
+}
@@ -1,20 +1,75 @@
+use crate::archive;
+use crate::audit::{self, Action, Via};
+use crate::bundle;
+use crate::ci;
+use crate::clone_urls::CloneUrls;
+use crate::create;
+use crate::deploy_keys;
+use crate::git::limits::{Pool, Pools};
+use crate::git::process;
+use crate::git_daemon;
+use crate::hooks::Templates;
+use crate::host_keys;
+use crate::import::Import;
+use crate::issues;
+use crate::ip_access::{self, Filter};
+use crate::lfs::{self, Tokens};
+use crate::maintenance_mode;
+use crate::merge::{self, Merge};
+use crate::metrics;
+use crate::mirror;
+use crate::namespaces::Limits;
+use crate::orgs::{self, Role};
+use crate::pack_cache::PackCache;
+use crate::pulls;
+use crate::push_check;
+use crate::quota::Quotas;
+use crate::rate_limit::{self, Limiter};
+use crate::search;
+use crate::redirects::{self, Found, Resolver};
+use crate::releases::{self, Release};
+use crate::telemetry;
+use crate::templates;
+use crate::trash;
+use crate::usage::DiskUsage;
+use crate::users;
+use crate::version;
+use crate::visibility::{self, Visibility};
+use crate::wire;
 use anyhow::{Context, Result};
 use async_trait::async_trait;
 use russh::server::{Auth, Msg, Session};
 use russh::{Channel, ChannelId};
 use russh_keys::key;
+use std::collections::HashMap;
 use std::fs;
-use std::path::PathBuf;
+use std::io::Write;
+use std::path::{Path, PathBuf};
 use std::process::Stdio;
 use std::sync::Arc;
 use tokio::io::AsyncReadExt;
 use tokio::process::Command;
+use tracing::Instrument;
 
 pub struct Server {
     port: String,
     host_key_path: PathBuf,
     authorized_keys_path: PathBuf,
     repos_dir: PathBuf,
+    quotas: Quotas,
+    disk_usage: DiskUsage,
+    lfs_tokens: Option<Tokens>,
+    public_url: String,
+    resolver: Resolver,
+    hook_templates: Templates,
+    limits: Limits,
+    rate_limiter: Limiter,
+    git_pools: Pools,
+    pack_cache: PackCache,
+    ip_filter: Filter,
+    default_visibility: Visibility,
+    clone_urls: CloneUrls,
+    listener: Option<std::net::TcpListener>,
 }
 
 impl Server {
@@ -28,87 +83,298 @@ impl Server {
             port,
             host_key_path,
             authorized_keys_path,
+            resolver: Resolver {
+                repos_dir: repos_dir.clone(),
+                ..Default::default()
+            },
+            hook_templates: Templates {
+                repos_dir: repos_dir.clone(),
+                ..Default::default()
+            },
+            limits: Limits {
+                repos_dir: repos_dir.clone(),
+                ..Default::default()
+            },
             repos_dir,
+            quotas: Quotas::default(),
+            disk_usage: DiskUsage::default(),
+            lfs_tokens: None,
+            public_url: String::new(),
+            rate_limiter: Limiter::default(),
+            git_pools: Pools::default(),
+            pack_cache: PackCache::default(),
+            ip_filter: Filter::default(),
+            default_visibility: Visibility::Public,
+            clone_urls: CloneUrls::default(),
+            listener: None,
         }
     }
 
-    pub async fn start(self) -> Result<()> {
-        let host_key = self.get_host_key().await?;
+    /// Accept connections on this socket, e.g. one passed in by systemd,
+    /// instead of binding the port
+    pub fn with_listener(mut self, listener: std::net::TcpListener) -> Self {
+        self.listener = Some(listener);
+        self
+    }
+
+    /// Enforce these quotas on pushes and report them in `agito-info`
+    pub fn with_quotas(mut self, quotas: Quotas) -> Self {
+        self.quotas = quotas;
+        self
+    }
+
+    /// Update repository sizes shown by the web server after each push
+    pub fn with_disk_usage(mut self, disk_usage: DiskUsage) -> Self {
+        self.disk_usage = disk_usage;
+        self
+    }
+
+    /// Look up repositories named in commands with this resolver, e.g. to
+    /// follow redirects for renamed repositories
+    pub fn with_resolver(mut self, resolver: Resolver) -> Self {
+        self.resolver = resolver;
+        self
+    }
+
+    /// Install hooks from these templates into repositories created over SSH
+    pub fn with_hook_templates(mut self, templates: Templates) -> Self {
+        self.hook_templates = templates;
+        self
+    }
+
+    /// Decide where `agito-create-repo` creates repositories and how many
+    pub fn with_limits(mut self, limits: Limits) -> Self {
+        self.limits = limits;
+        self
+    }
+
+    /// Limit clones and pushes with `limiter`, shared with the web server
+    pub fn with_rate_limiter(mut self, limiter: Limiter) -> Self {
+        self.rate_limiter = limiter;
+        self
+    }
+
+    /// Cap the clones, fetches and pushes running at once with `pools`,
+    /// shared with the web server
+    pub fn with_git_pools(mut self, pools: Pools) -> Self {
+        self.git_pools = pools;
+        self
+    }
+
+    /// Serve clones from cached packs where it can
+    pub fn with_pack_cache(mut self, pack_cache: PackCache) -> Self {
+        self.pack_cache = pack_cache;
+        self
+    }
+
+    /// Close connections from addresses `filter` refuses, before the handshake
+    pub fn with_ip_filter(mut self, filter: Filter) -> Self {
+        self.ip_filter = filter;
+        self
+    }
+
+    /// Give repositories created or imported over SSH this visibility unless
+    /// the command names one
+    pub fn with_default_visibility(mut self, visibility: Visibility) -> Self {
+        self.default_visibility = visibility;
+        self
+    }
+
+    /// Tell users of repositories they create or import where to clone them
+    pub fn with_clone_urls(mut self, clone_urls: CloneUrls) -> Self {
+        self.clone_urls = clone_urls;
+        self
+    }
+
+    /// Answer `git-lfs-authenticate` with tokens for the web server at `public_url`
+    pub fn with_lfs(mut self, tokens: Tokens, public_url: String) -> Self {
+        self.lfs_tokens = Some(tokens);
+        self.public_url = public_url.trim_end_matches('/').to_string();
+        self
+    }
+
+    /// Serve until `shutdown` completes, then stop accepting connections and
+    /// return once the sessions in flight are done
+    pub async fn start(mut self, shutdown: impl std::future::Future<Output = ()>) -> Result<()> {
+        let host_keys = self.get_host_keys().await?;
 
         let config = russh::server::Config {
             inactivity_timeout: Some(std::time::Duration::from_secs(3600)),
             auth_rejection_time: std::time::Duration::from_secs(3),
             auth_rejection_time_initial: Some(std::time::Duration::from_secs(0)),
-            keys: vec![host_key],
+            keys: host_keys,
             ..Default::default()
         };
 
         let config = Arc::new(config);
 
-        let addr = format!("0.0.0.0:{}", self.port);
-        tracing::info!("SSH server listening on {}", addr);
-
         // Start listening manually
-        let listener = tokio::net::TcpListener::bind(&addr).await?;
+        let listener = match self.listener.take() {
+            Some(listener) => tokio::net::TcpListener::from_std(listener)?,
+            None => tokio::net::TcpListener::bind(format!("0.0.0.0:{}", self.port)).await?,
+        };
+        tracing::info!("SSH server listening on {}", listener.local_addr()?);
         
         let repos_dir = Arc::new(self.repos_dir);
         let authorized_keys_path = Arc::new(self.authorized_keys_path);
+        let quotas = Arc::new(self.quotas);
+        let limits = Arc::new(self.limits);
+        let mut sessions = tokio::task::JoinSet::new();
+        tokio::pin!(shutdown);
         
         loop {
-            let (stream, _addr) = listener.accept().await?;
+            let (stream, addr) = tokio::select! {
+                accepted = listener.accept() => accepted?,
+                () = &mut shutdown => break,
+                // Reap finished sessions as they go
+                Some(_) = sessions.join_next(), if !sessions.is_empty() => continue,
+            };
+            // Dropping the stream closes it without a word of SSH
+            if !self.ip_filter.permits(ip_access::Listener::Ssh, addr.ip()) {
+                continue;
+            }
             let config = config.clone();
             let repos_dir = repos_dir.clone();
             let authorized_keys_path = authorized_keys_path.clone();
+            let quotas = quotas.clone();
+            let limits = limits.clone();
+            let disk_usage = self.disk_usage.clone();
+            let lfs_tokens = self.lfs_tokens.clone();
+            let public_url = self.public_url.clone();
+            let resolver = self.resolver.clone();
+            let hook_templates = self.hook_templates.clone();
+            let rate_limiter = self.rate_limiter.clone();
+            let git_pools = self.git_pools.clone();
+            let pack_cache = self.pack_cache.clone();
+            let default_visibility = self.default_visibility;
+            let clone_urls = self.clone_urls.clone();
             
-            tokio::spawn(async move {
-                let handler = SessionHandler {
-                    repos_dir: (*repos_dir).clone(),
-                    authorized_keys_path: (*authorized_keys_path).clone(),
-                };
-                let session = russh::server::run_stream(config, stream, handler).await;
-                if let Err(e) = session {
-                    tracing::error!("Session error: {}", e);
+            let span = tracing::info_span!(
+                "ssh_session",
+                component = "ssh",
+                session = %telemetry::new_id(),
+                peer = %addr,
+                user = tracing::field::Empty,
+                otel.kind = "server",
+            );
+
+            sessions.spawn(
+                async move {
+                    let handler = SessionHandler {
+                        repos_dir: (*repos_dir).clone(),
+                        authorized_keys_path: (*authorized_keys_path).clone(),
+                        quotas,
+                        disk_usage,
+                        lfs_tokens,
+                        public_url,
+                        resolver,
+                        hook_templates,
+                        limits,
+                        rate_limiter,
+                        git_pools,
+                        pack_cache,
+                        default_visibility,
+                        clone_urls,
+                        peer: addr.ip().to_string(),
+                        user: None,
+                        deploy_repo: None,
+                        push_checks: HashMap::new(),
+                        uploads: HashMap::new(),
+                        git_protocols: HashMap::new(),
+                        span: tracing::Span::current(),
+                        _active: metrics::global().ssh_session_started(),
+                    };
+                    let session = russh::server::run_stream(config, stream, handler).await;
+                    if let Err(e) = session {
+                        tracing::error!("Session error: {}", e);
+                    }
                 }
-            });
+                .instrument(span),
+            );
         }
-    }
-
-    async fn get_host_key(&self) -> Result<key::KeyPair> {
-        // Check if host key exists
-        if !self.host_key_path.exists() {
-            // Generate new host key
-            tracing::info!("Generating new SSH host key at {:?}", self.host_key_path);
-
-            let status = Command::new("ssh-keygen")
-                .arg("-t")
-                .arg("rsa")
-                .arg("-b")
-                .arg("4096")
-                .arg("-f")
-                .arg(&self.host_key_path)
-                .arg("-N")
-                .arg("")
-                .status()
-                .await
-                .context("Failed to generate host key")?;
 
-            if !status.success() {
-                anyhow::bail!("Failed to generate host key");
-            }
+        drop(listener);
+        if !sessions.is_empty() {
+            tracing::info!("Waiting for {} SSH sessions to finish", sessions.len());
         }
+        while sessions.join_next().await.is_some() {}
+        Ok(())
+    }
 
-        // Load host key
-        let key_data = fs::read(&self.host_key_path).context("Failed to read host key")?;
-        let key = russh_keys::decode_secret_key(&String::from_utf8_lossy(&key_data), None)
-            .context("Failed to parse host key")?;
-
-        Ok(key)
+    /// A host key of each type, generating the ones missing
+    async fn get_host_keys(&self) -> Result<Vec<key::KeyPair>> {
+        let host_key_path = self.host_key_path.clone();
+        tokio::task::spawn_blocking(move || {
+            let mut keys = Vec::new();
+            for (path, key_type) in host_keys::files(&host_key_path) {
+                if !path.exists() {
+                    host_keys::generate(&path, key_type)?;
+                }
+                let key_data = fs::read(&path)
+                    .with_context(|| format!("Failed to read host key {}", path.display()))?;
+                let key = russh_keys::decode_secret_key(&String::from_utf8_lossy(&key_data), None)
+                    .with_context(|| format!("Failed to parse host key {}", path.display()))?;
+                tracing::debug!(path = %path.display(), "Loaded {} host key", key.name());
+                keys.push(key);
+            }
+            Ok(keys)
+        })
+        .await?
     }
 }
 
 struct SessionHandler {
     repos_dir: PathBuf,
     authorized_keys_path: PathBuf,
+    quotas: Arc<Quotas>,
+    disk_usage: DiskUsage,
+    lfs_tokens: Option<Tokens>,
+    public_url: String,
+    resolver: Resolver,
+    hook_templates: Templates,
+    limits: Arc<Limits>,
+    rate_limiter: Limiter,
+    git_pools: Pools,
+    pack_cache: PackCache,
+    default_visibility: Visibility,
+    clone_urls: CloneUrls,
+    /// Client address, for the audit log and rate limits
+    peer: String,
+    /// User the authenticated key belongs to, from its `AGITO_USER` option
+    user: Option<String>,
+    /// Repository the authenticated deploy key may fetch; such sessions can
+    /// do nothing else
+    deploy_repo: Option<String>,
+    /// `agito-push-check` commands still receiving their input
+    push_checks: HashMap<ChannelId, PendingCheck>,
+    /// `agito-release <repo> upload` commands still receiving the file
+    uploads: HashMap<ChannelId, PendingUpload>,
+    /// The wire protocol each channel's client asked for with `GIT_PROTOCOL`
+    git_protocols: HashMap<ChannelId, String>,
+    /// Connection span; russh drives the handler on its own task, so
+    /// per-request spans are parented here explicitly
+    span: tracing::Span,
+    /// Counts the session as active in /metrics while the handler lives
+    _active: metrics::SessionGuard,
+}
+
+/// Input of an `agito-push-check`, spooled to a file until the client is done
+/// sending it
+struct PendingCheck {
+    repo_path: PathBuf,
+    spool: PathBuf,
+    file: fs::File,
+}
+
+/// A release asset sent with `agito-release <repo> upload`, spooled to a file
+/// until the client is done sending it
+struct PendingUpload {
+    name: String,
+    repo_path: PathBuf,
+    tag: String,
+    asset: String,
+    spool: PathBuf,
+    file: fs::File,
 }
 
 #[async_trait]
@@ -120,30 +386,69 @@ impl russh::server::Handler for SessionHandler {
         user: &str,
         public_key: &key::PublicKey,
     ) -> Result<Auth, Self::Error> {
+        let _enter = self.span.enter();
         tracing::info!("Public key auth attempt for user: {}", user);
 
-        // Read authorized keys
-        if !self.authorized_keys_path.exists() {
-            return Ok(Auth::Reject {
-                proceed_with_methods: None,
-            });
-        }
+        let data_dir = &self.limits.data_dir;
 
-        let auth_keys = fs::read_to_string(&self.authorized_keys_path)?;
+        // Read authorized keys
+        let auth_keys = if self.authorized_keys_path.exists() {
+            fs::read_to_string(&self.authorized_keys_path)?
+        } else {
+            String::new()
+        };
 
         for line in auth_keys.lines() {
             if line.trim().is_empty() || line.starts_with('#') {
                 continue;
             }
 
-            if let Ok(auth_key) = russh_keys::parse_public_key_base64(line) {
+            if let Some((auth_key, key_user)) = parse_authorized_key(line) {
+                if &auth_key == public_key {
+                    let name = key_user.as_deref().unwrap_or(user);
+                    // Pending and disabled accounts keep their keys but may not use them
+                    if users::is_locked(data_dir, name) {
+                        tracing::warn!("Rejecting key of locked account {}", name);
+                        break;
+                    }
+                    self.span.record("user", name);
+                    tracing::info!("User {} authenticated successfully", name);
+                    self.user = key_user;
+                    return Ok(Auth::Accept);
+                }
+            }
+        }
+
+        // Keys users added to their accounts
+        for (name, line) in users::active_keys(data_dir) {
+            if let Some((auth_key, _)) = parse_authorized_key(&line) {
+                if &auth_key == public_key {
+                    self.span.record("user", name.as_str());
+                    tracing::info!("User {} authenticated successfully", name);
+                    self.user = Some(name);
+                    return Ok(Auth::Accept);
+                }
+            }
+        }
+
+        // Deploy keys, good for fetching one repository
+        for (repo, deploy_key) in deploy_keys::all(&self.repos_dir) {
+            if let Some((auth_key, _)) = parse_authorized_key(&deploy_key.key) {
                 if &auth_key == public_key {
-                    tracing::info!("User {} authenticated successfully", user);
+                    self.span.record("user", format!("deploy key {}", deploy_key.id).as_str());
+                    tracing::info!("Deploy key {} ({}) of {} authenticated", deploy_key.id, deploy_key.title, repo);
+                    self.deploy_repo = Some(repo);
                     return Ok(Auth::Accept);
                 }
             }
         }
 
+        metrics::global().auth_failure("ssh");
+        audit::Entry::new(Action::AuthFailure, Via::Ssh, Some(user))
+            .with_target(&format!("SHA256:{}", public_key.fingerprint()))
+            .with_detail("Unknown SSH key")
+            .with_remote(Some(self.peer.clone()))
+            .record(data_dir);
         Ok(Auth::Reject {
             proceed_with_methods: None,
         })
@@ -157,32 +462,145 @@ impl russh::server::Handler for SessionHandler {
         Ok(true)
     }
 
+    /// git sends `GIT_PROTOCOL` to ask for version 2 of the wire protocol;
+    /// other variables are ignored
+    async fn env_request(
+        &mut self,
+        channel: ChannelId,
+        variable_name: &str,
+        variable_value: &str,
+        _session: &mut Session,
+    ) -> Result<(), Self::Error> {
+        if variable_name == "GIT_PROTOCOL" {
+            self.git_protocols
+                .insert(channel, variable_value.to_string());
+        }
+        Ok(())
+    }
+
     async fn exec_request(
         &mut self,
         channel: ChannelId,
         data: &[u8],
         session: &mut Session,
     ) -> Result<(), Self::Error> {
-        let command = String::from_utf8_lossy(data);
-        tracing::info!("Executing command: {}", command);
+        let command = String::from_utf8_lossy(data).to_string();
+        let span = tracing::info_span!(parent: &self.span, "ssh_exec", command = %command);
 
-        if command.starts_with("git-upload-pack") || command.starts_with("git-receive-pack") {
-            self.handle_git_command(channel, &command, session).await?;
-        } else if command.starts_with("agito-create-repo") {
-            self.handle_create_repo(channel, &command, session).await?;
-        } else {
-            let msg = format!("Unknown command: {}\n", command);
-            session.data(channel, msg.into_bytes().into());
-            session.exit_status_request(channel, 1);
-            session.eof(channel);
-            session.close(channel);
+        async {
+            tracing::info!("Executing command: {}", command);
+            metrics::global().ssh_command(&command);
+
+            // Deploy keys fetch, and LFS objects come with fetches
+            let fetching = command.starts_with("git-upload-pack")
+                || command.starts_with("agito-bundle ")
+                || command.starts_with("git-lfs-authenticate")
+                || command.split_whitespace().next() == Some("agito-ping")
+                || command.split_whitespace().next() == Some("agito-list")
+                || command.split_whitespace().next() == Some("agito-version");
+            if self.deploy_repo.is_some() && !fetching {
+                session.data(channel, b"Deploy keys can only fetch\n".to_vec().into());
+                session.exit_status_request(channel, 1);
+                session.eof(channel);
+                session.close(channel);
+            } else if command.starts_with("git-upload-pack") || command.starts_with("git-receive-pack") {
+                self.handle_git_command(channel, &command, session).await?;
+            } else if command.starts_with("agito-create-repo") {
+                self.handle_create_repo(channel, &command, session).await?;
+            } else if command.starts_with("agito-import") {
+                self.handle_import(channel, &command, session).await?;
+            } else if command.starts_with("agito-merge") {
+                self.handle_merge(channel, &command, session).await?;
+            } else if command.starts_with("agito-pr ") {
+                self.handle_pr(channel, &command, session).await?;
+            } else if command.starts_with("agito-grep ") {
+                self.handle_grep(channel, &command, session).await?;
+            } else if ["agito-issue ", "agito-ci ", "agito-log "].iter().any(|prefix| command.starts_with(prefix)) {
+                self.handle_read(channel, &command, session).await?;
+            } else if command.starts_with("agito-deploy-key ") {
+                self.handle_deploy_key(channel, &command, session).await?;
+            } else if ["agito-repo ", "agito-set-default-branch ", "agito-set-visibility "].iter().any(|prefix| command.starts_with(prefix)) {
+                self.handle_repo(channel, &command, session).await?;
+            } else if command.starts_with("agito-release ") {
+                self.handle_release(channel, &command, session).await?;
+            } else if command.starts_with("agito-bundle ") {
+                self.handle_bundle(channel, &command, session).await?;
+            } else if command.starts_with("agito-push-check") {
+                self.start_push_check(channel, &command, session);
+            } else if command.starts_with("agito-info") {
+                self.handle_info(channel, &command, session).await?;
+            } else if command.starts_with("git-lfs-authenticate") {
+                self.handle_lfs_authenticate(channel, &command, session);
+            } else if command.split_whitespace().next() == Some("agito-ping") {
+                self.handle_ping(channel, &command, session);
+            } else if command.split_whitespace().next() == Some("agito-list") {
+                self.handle_list(channel, &command, session);
+            } else if command.split_whitespace().next() == Some("agito-version") {
+                session.data(channel, version::reply().into_bytes().into());
+                session.exit_status_request(channel, 0);
+                session.eof(channel);
+                session.close(channel);
+            } else {
+                let msg = format!("Unknown command: {}\n", command);
+                session.data(channel, msg.into_bytes().into());
+                session.exit_status_request(channel, 1);
+                session.eof(channel);
+                session.close(channel);
+            }
+
+            Ok(())
+        }
+        .instrument(span)
+        .await
+    }
+
+    async fn data(
+        &mut self,
+        channel: ChannelId,
+        data: &[u8],
+        _session: &mut Session,
+    ) -> Result<(), Self::Error> {
+        if let Some(pending) = self.push_checks.get_mut(&channel) {
+            pending.file.write_all(data)?;
+        } else if let Some(pending) = self.uploads.get_mut(&channel) {
+            pending.file.write_all(data)?;
         }
+        Ok(())
+    }
 
+    async fn channel_eof(
+        &mut self,
+        channel: ChannelId,
+        session: &mut Session,
+    ) -> Result<(), Self::Error> {
+        if let Some(pending) = self.push_checks.remove(&channel) {
+            let span = tracing::info_span!(parent: &self.span, "push_check");
+            self.finish_push_check(channel, pending, session)
+                .instrument(span)
+                .await?;
+        } else if let Some(pending) = self.uploads.remove(&channel) {
+            let span = tracing::info_span!(parent: &self.span, "release_upload");
+            self.finish_upload(channel, pending, session)
+                .instrument(span)
+                .await?;
+        }
         Ok(())
     }
 }
 
 impl SessionHandler {
+    #[tracing::instrument(
+        name = "git",
+        skip(self, channel, session),
+        fields(
+            repo = tracing::field::Empty,
+            operation = tracing::field::Empty,
+            protocol = tracing::field::Empty,
+            bytes = tracing::field::Empty,
+            duration_ms = tracing::field::Empty,
+            exit_code = tracing::field::Empty,
+        )
+    )]
     async fn handle_git_command(
         &mut self,
         channel: ChannelId,
@@ -201,9 +619,36 @@ impl SessionHandler {
         let git_cmd = parts[0];
         let repo_path = parts[1].trim_matches('\'').trim_matches('"');
 
-        // Clean and validate repo path
-        let repo_path = repo_path.trim_start_matches('/');
-        let full_path = self.repos_dir.join(repo_path);
+        // Resolve the name as given, or through redirects for moved repositories
+        let asked = repo_path.trim_start_matches('/');
+        let (repo_path, moved) = match self.resolver.find(repo_path) {
+            Some(found) => (found.name.clone(), found.moved.then_some(found)),
+            None => {
+                let msg = format!("Repository not found: {}\n", repo_path.trim_start_matches('/'));
+                session.data(channel, msg.into_bytes().into());
+                session.exit_status_request(channel, 1);
+                session.eof(channel);
+                session.close(channel);
+                return Ok(());
+            }
+        };
+        let full_path = self.repos_dir.join(&repo_path);
+        let span = tracing::Span::current();
+        span.record("repo", repo_path.as_str());
+        span.record("operation", git_cmd.strip_prefix("git-").unwrap_or(git_cmd));
+
+        let needed = if git_cmd == "git-receive-pack" { Role::Write } else { Role::Read };
+        if let Err(msg) = self.check_role(&repo_path, needed) {
+            session.data(channel, msg.into_bytes().into());
+            session.exit_status_request(channel, 1);
+            session.eof(channel);
+            session.close(channel);
+            return Ok(());
+        }
+        // The old name works for now; on stderr, which git shows the user
+        if let Some(found) = &moved {
+            session.extended_data(channel, 1, moved_warning(asked, found).into_bytes().into());
+        }
 
         // Security check: ensure path is within repos_dir
         if !full_path.starts_with(&self.repos_dir) {
@@ -214,23 +659,98 @@ impl SessionHandler {
             return Ok(());
         }
 
-        // Check if repository exists
-        if !full_path.exists() {
-            let msg = format!("Repository not found: {}\n", repo_path);
+        // A pull mirror's refs come from its upstream and would be overwritten
+        if git_cmd == "git-receive-pack" && mirror::is_pull_mirror(&full_path) {
+            let msg = format!("{} is a pull mirror; push to its upstream instead\n", repo_path);
+            session.data(channel, msg.into_bytes().into());
+            session.exit_status_request(channel, 1);
+            session.eof(channel);
+            session.close(channel);
+            return Ok(());
+        }
+        if git_cmd == "git-receive-pack" && archive::is_archived(&full_path) {
+            let msg = format!("{}\n", archive::refusal(&repo_path));
             session.data(channel, msg.into_bytes().into());
             session.exit_status_request(channel, 1);
             session.eof(channel);
             session.close(channel);
             return Ok(());
         }
+        if git_cmd == "git-receive-pack" {
+            if let Some(msg) = maintenance_mode::refusal(&self.limits.data_dir, &repo_path, &full_path) {
+                session.data(channel, format!("{}\n", msg).into_bytes().into());
+                session.exit_status_request(channel, 1);
+                session.eof(channel);
+                session.close(channel);
+                return Ok(());
+            }
+        }
+
+        // Held until git is done, so the clone counts as running until then
+        let _clone = if git_cmd == "git-receive-pack" {
+            if let Err(wait) = self.rate_limiter.push(&self.peer, self.user.as_deref()) {
+                let msg = format!(
+                    "Too many pushes; try again in {} seconds\n",
+                    rate_limit::retry_after(wait)
+                );
+                session.data(channel, msg.into_bytes().into());
+                session.exit_status_request(channel, 1);
+                session.eof(channel);
+                session.close(channel);
+                return Ok(());
+            }
+            None
+        } else {
+            match self.rate_limiter.clone_started(&self.peer, self.user.as_deref()) {
+                Ok(guard) => Some(guard),
+                Err(msg) => {
+                    session.data(channel, format!("{}\n", msg).into_bytes().into());
+                    session.exit_status_request(channel, 1);
+                    session.eof(channel);
+                    session.close(channel);
+                    return Ok(());
+                }
+            }
+        };
+
+        // Wait for a place among the clones, or the pushes, running now
+        let pool = if git_cmd == "git-receive-pack" { Pool::Receive } else { Pool::Upload };
+        let _permit = match self.git_pools.acquire_async(pool).await {
+            Ok(permit) => permit,
+            Err(busy) => {
+                session.data(channel, format!("{}\n", busy).into_bytes().into());
+                session.exit_status_request(channel, 1);
+                session.eof(channel);
+                session.close(channel);
+                return Ok(());
+            }
+        };
 
         // Execute git command
-        let mut child = Command::new(git_cmd)
-            .arg(&full_path)
-            .stdin(Stdio::piped())
-            .stdout(Stdio::piped())
-            .stderr(Stdio::piped())
-            .spawn()?;
+        let start = std::time::Instant::now();
+        // The quota settings reach the pre-receive hook through the environment,
+        // and the pusher's name the post-receive hook; clones build their
+        // pack through the cache, in the protocol version the client asked for
+        let git_protocol = self.git_protocols.remove(&channel);
+        let version = wire::record("ssh", git_protocol.as_deref());
+        span.record("protocol", version.name());
+        let upload = (git_cmd == "git-upload-pack").then_some(&self.pack_cache);
+        // git and what it started stop with the session, or once the
+        // transfer takes longer than the pool's timeout
+        let mut child = process::Child::spawn(
+            Command::new(git_cmd)
+                .arg(&full_path)
+                .envs(self.quotas.env())
+                .envs(wire::env(git_protocol.as_deref(), upload))
+                .envs(self.user.iter().map(|user| ("AGITO_USER", user)))
+                .stdin(Stdio::piped())
+                .stdout(Stdio::piped())
+                .stderr(Stdio::piped()),
+        )?;
+        let deadline = self
+            .git_pools
+            .timeout(pool)
+            .map(|timeout| tokio::time::Instant::now() + timeout);
 
         let _stdin = child.stdin.take().unwrap();
         let mut stdout = child.stdout.take().unwrap();
@@ -242,10 +762,12 @@ impl SessionHandler {
 
         // Forward stdout from git process to SSH channel
         let mut buf = vec![0u8; 8192];
+        let mut sent = 0u64;
         loop {
-            match stdout.read(&mut buf).await {
+            match process::read(&mut stdout, &mut buf, deadline).await {
                 Ok(0) => break,
                 Ok(n) => {
+                    sent += n as u64;
                     session.data(channel, buf[..n].to_vec().into());
                 }
                 Err(_) => break,
@@ -255,7 +777,7 @@ impl SessionHandler {
         // Forward stderr
         let mut buf = vec![0u8; 8192];
         loop {
-            match stderr.read(&mut buf).await {
+            match process::read(&mut stderr, &mut buf, deadline).await {
                 Ok(0) => break,
                 Ok(n) => {
                     session.data(channel, buf[..n].to_vec().into());
@@ -263,8 +785,44 @@ impl SessionHandler {
                 Err(_) => break,
             }
         }
+        if deadline.map_or(false, |deadline| tokio::time::Instant::now() >= deadline) {
+            child.stop();
+            session.extended_data(
+                channel,
+                1,
+                format!("{} took too long and was stopped\n", git_cmd).into_bytes().into(),
+            );
+        }
 
         let status = child.wait().await?;
+        metrics::global().git_subprocess(git_cmd, start.elapsed());
+        span.record("bytes", sent);
+        span.record("duration_ms", start.elapsed().as_millis() as u64);
+        span.record("exit_code", status.code().unwrap_or(-1));
+        tracing::info!(
+            bytes = sent,
+            elapsed_ms = start.elapsed().as_millis() as u64,
+            protocol = version.name(),
+            "{} finished",
+            git_cmd
+        );
+
+        if git_cmd == "git-receive-pack" && status.success() {
+            // This push goes to the mirrors in the background; tell the pusher
+            // if the last one didn't get through
+            for (m, mirror_status) in mirror::failing(&full_path) {
+                session.extended_data(channel, 1, mirror_warning(&m, &mirror_status).into_bytes().into());
+            }
+            let usage = self.disk_usage.clone();
+            let name = repo_path.clone();
+            tokio::task::spawn_blocking(move || {
+                if let Err(e) = usage.refresh_repo(&name, &full_path) {
+                    tracing::warn!("Failed to measure {} after push: {}", name, e);
+                }
+                mirror::push_all(&full_path);
+            });
+        }
+
         let exit_code = status.code().unwrap_or(1);
         session.exit_status_request(channel, exit_code as u32);
         session.eof(channel);
@@ -273,67 +831,2099 @@ impl SessionHandler {
         Ok(())
     }
 
-    async fn handle_create_repo(
+    /// Import a repository from another server into the user's namespace:
+    /// `agito-import <repo-name> <url>`. The import runs in the background,
+    /// with git's progress sent to stderr as it goes.
+    async fn handle_import(
         &mut self,
         channel: ChannelId,
         command: &str,
         session: &mut Session,
     ) -> Result<()> {
         let parts: Vec<&str> = command.split_whitespace().collect();
-        if parts.len() < 2 {
-            session.data(channel, b"Usage: agito-create-repo <repo-name>\n".to_vec().into());
+        if parts.len() < 3 {
+            session.data(channel, b"Usage: agito-import <repo-name> <url>\n".to_vec().into());
             session.exit_status_request(channel, 1);
             session.eof(channel);
             session.close(channel);
             return Ok(());
         }
-
-        let mut repo_name = parts[1].to_string();
-
-        // Ensure repo name ends with .git
-        if !repo_name.ends_with(".git") {
-            repo_name.push_str(".git");
-        }
-
-        // Validate repo name
-        if repo_name.contains("..") || repo_name.contains('/') {
-            session.data(channel, b"Invalid repository name\n".to_vec().into());
+        if let Some(notice) = maintenance_mode::server(&self.limits.data_dir) {
+            let msg = format!("{}\n", maintenance_mode::server_refusal(&notice));
+            session.data(channel, msg.into_bytes().into());
             session.exit_status_request(channel, 1);
             session.eof(channel);
             session.close(channel);
             return Ok(());
         }
 
-        let repo_path = self.repos_dir.join(&repo_name);
+        let import = match self.limits.place(self.user.as_deref(), parts[1]) {
+            Ok(name) => Import {
+                repos_dir: self.repos_dir.clone(),
+                name,
+                url: parts[2].trim_matches('\'').to_string(),
+                remote_only: true,
+            },
+            Err(e) => {
+                let msg = format!("{}\n", e);
+                session.data(channel, msg.into_bytes().into());
+                session.exit_status_request(channel, 1);
+                session.eof(channel);
+                session.close(channel);
+                return Ok(());
+            }
+        };
 
-        // Check if repository already exists
-        if repo_path.exists() {
-            let msg = format!("Repository already exists: {}\n", repo_name);
-            session.data(channel, msg.into_bytes().into());
-            session.exit_status_request(channel, 1);
-            session.eof(channel);
-            session.close(channel);
-            return Ok(());
+        let handle = session.handle();
+        let hook_templates = self.hook_templates.clone();
+        let usage = self.disk_usage.clone();
+        let (data_dir, user) = (self.limits.data_dir.clone(), self.user.clone());
+        let (repos_dir, visibility) = (self.repos_dir.clone(), self.default_visibility);
+        let peer = self.peer.clone();
+        let clone_urls = self.clone_urls.clone();
+        let (progress_tx, mut progress_rx) = tokio::sync::mpsc::unbounded_channel::<Vec<u8>>();
+        let task = tokio::task::spawn_blocking(move || {
+            let result = import.run(&hook_templates, &mut |progress| {
+                let _ = progress_tx.send(progress.to_vec());
+            });
+            if let Ok(path) = &result {
+                if let Err(e) = usage.refresh_repo(&import.name, path) {
+                    tracing::warn!("Failed to measure {} after import: {}", import.name, e);
+                }
+                if let Err(e) = visibility::set(path, visibility) {
+                    tracing::warn!("Failed to make {} {}: {}", import.name, visibility.name(), e);
+                }
+                if let Some(user) = &user {
+                    if let Err(e) = orgs::created(&data_dir, &repos_dir, &import.name, user) {
+                        tracing::warn!("Failed to grant {} to its creator: {}", import.name, e);
+                    }
+                }
+                audit::Entry::new(Action::RepoImport, Via::Ssh, user.as_deref())
+                    .with_repo(&import.name)
+                    .with_detail(format!("from {}", mirror::redact(&import.url)))
+                    .with_remote(Some(peer))
+                    .record(&data_dir);
+            }
+            (import.name, result)
+        });
+
+        tokio::spawn(
+            async move {
+                while let Some(progress) = progress_rx.recv().await {
+                    let _ = handle.extended_data(channel, 1, progress.into()).await;
+                }
+                let (msg, code) = match task.await {
+                    Ok((name, Ok(path))) => {
+                        tracing::info!("Imported repository: {:?}", path);
+                        let mut msg = format!("Repository imported: {}\n", name);
+                        if let Some(url) = clone_urls.ssh(&name) {
+                            msg.push_str(&format!("Clone URL: {}\n", url));
+                        }
+                        (msg, 0)
+                    }
+                    Ok((_, Err(e))) => (format!("Import failed: {:#}\n", e), 1),
+                    Err(e) => (format!("Import failed: {}\n", e), 1),
+                };
+                let _ = handle.data(channel, msg.into_bytes().into()).await;
+                let _ = handle.exit_status_request(channel, code).await;
+                let _ = handle.eof(channel).await;
+                let _ = handle.close(channel).await;
+            }
+            .in_current_span(),
+        );
+
+        Ok(())
+    }
+
+    /// Merge a branch into another inside the repository:
+    /// `agito-merge <repo> <base> <head> [--strategy=<s>] [message]`.
+    /// Conflicting files are listed and leave the repository unchanged.
+    async fn handle_merge(
+        &mut self,
+        channel: ChannelId,
+        command: &str,
+        session: &mut Session,
+    ) -> Result<()> {
+        let parts: Vec<&str> = command.trim().splitn(5, ' ').collect();
+        let found = if parts.len() < 4 {
+            Err("Usage: agito-merge <repo> <base> <head> [--strategy=merge|squash|rebase] [message]\n".to_string())
+        } else {
+            self.find_repo(command, Role::Write).and_then(|(name, path)| {
+                if mirror::is_pull_mirror(&path) {
+                    Err(format!("{} is a pull mirror; merge in its upstream instead\n", name))
+                } else if archive::is_archived(&path) {
+                    Err(format!("{}\n", archive::refusal(&name)))
+                } else if let Some(msg) = maintenance_mode::refusal(&self.limits.data_dir, &name, &path) {
+                    Err(format!("{}\n", msg))
+                } else {
+                    Ok((name, path))
+                }
+            })
+        };
+        let (name, repo_path) = match found {
+            Ok(found) => found,
+            Err(msg) => {
+                session.data(channel, msg.into_bytes().into());
+                session.exit_status_request(channel, 1);
+                session.eof(channel);
+                session.close(channel);
+                return Ok(());
+            }
+        };
+
+        let unquote = |s: &str| s.trim_matches('\'').to_string();
+        let mut rest = parts.get(4).map(|r| r.trim()).unwrap_or("");
+        let mut strategy = None;
+        if let Some(option) = rest.strip_prefix("--strategy=") {
+            let (value, message) = option.split_once(' ').unwrap_or((option, ""));
+            match unquote(value).parse() {
+                Ok(s) => strategy = Some(s),
+                Err(e) => {
+                    session.data(channel, format!("{}\n", e).into_bytes().into());
+                    session.exit_status_request(channel, 1);
+                    session.eof(channel);
+                    session.close(channel);
+                    return Ok(());
+                }
+            }
+            rest = message.trim();
         }
+        let merge = Merge {
+            base: unquote(parts[2]),
+            head: unquote(parts[3]),
+            strategy,
+            message: Some(unquote(rest)).filter(|m| !m.is_empty()),
+            user: self.user.clone(),
+            identity: merge::Identity::for_user(self.user.as_deref().unwrap_or("agito")),
+            via: crate::protection::Via::Merge,
+        };
+        let usage = self.disk_usage.clone();
+        let outcome = tokio::task::spawn_blocking(move || {
+            let outcome = merge.run(&repo_path);
+            if let Ok(merge::Outcome::Merged { .. }) = &outcome {
+                if let Err(e) = usage.refresh_repo(&name, &repo_path) {
+                    tracing::warn!("Failed to measure {} after merge: {}", name, e);
+                }
+                mirror::push_all(&repo_path);
+            }
+            (merge, outcome)
+        })
+        .await?;
 
-        // Create the repository
-        if let Err(e) = crate::git::init_bare_repo(&repo_path) {
-            let msg = format!("Failed to create repository: {}\n", e);
-            session.data(channel, msg.into_bytes().into());
-            session.exit_status_request(channel, 1);
+        let (msg, code) = match outcome {
+            (merge, Ok(merge::Outcome::Merged { commit, strategy })) => {
+                let verb = match strategy {
+                    merge::Strategy::Merge => "Merged",
+                    merge::Strategy::Squash => "Squashed",
+                    merge::Strategy::Rebase => "Rebased",
+                };
+                (format!("{} {} into {}: {}\n", verb, merge.head, merge.base, commit), 0)
+            }
+            (merge, Ok(merge::Outcome::UpToDate)) => {
+                (format!("{} already contains {}\n", merge.base, merge.head), 0)
+            }
+            (merge, Ok(merge::Outcome::Conflicts { conflicts })) => {
+                let mut msg = format!("Cannot merge {} into {}; conflicts in:\n", merge.head, merge.base);
+                for conflict in conflicts {
+                    msg.push_str(&format!("  {} ({})\n", conflict.path, conflict.kind));
+                }
+                (msg, 1)
+            }
+            (_, Err(e)) => (format!("Merge failed: {:#}\n", e), 1),
+        };
+        session.data(channel, msg.into_bytes().into());
+        session.exit_status_request(channel, code);
+        session.eof(channel);
+        session.close(channel);
+
+        Ok(())
+    }
+
+    /// Work with pull requests: `agito-pr <repo> <action> [arguments]`, see
+    /// [`pr_command`]. Reading needs read access, opening and commenting a
+    /// signed-in user, and merging write access.
+    async fn handle_pr(
+        &mut self,
+        channel: ChannelId,
+        command: &str,
+        session: &mut Session,
+    ) -> Result<()> {
+        let reply = match self.find_repo(command, Role::Read) {
+            Ok((name, repo_path)) => {
+                let mut args = split_args(command);
+                let json = take_json(&mut args);
+                // Merging and updating move branches, which maintenance stops
+                let moves_branch = matches!(args.get(2).map(String::as_str), Some("merge" | "update"));
+                let paused = maintenance_mode::refusal(&self.limits.data_dir, &name, &repo_path)
+                    .filter(|_| moves_branch);
+                if let Some(msg) = paused {
+                    Err(format!("{}\n", msg))
+                } else {
+                    let user = self.user.clone();
+                    let writable = self.check_role(&name, Role::Write).is_ok();
+                    let usage = self.disk_usage.clone();
+                    tokio::task::spawn_blocking(move || {
+                        pr_command(&name, &repo_path, args.get(2..).unwrap_or_default(), json, user.as_deref(), writable, &usage)
+                    })
+                    .await?
+                }
+            }
+            Err(msg) => Err(msg),
+        };
+
+        let (msg, code) = match reply {
+            Ok(msg) => (msg, 0),
+            Err(msg) => (msg, 1),
+        };
+        session.data(channel, msg.into_bytes().into());
+        session.exit_status_request(channel, code);
+        session.eof(channel);
+        session.close(channel);
+
+        Ok(())
+    }
+
+    /// Search the default branch of one repository, or of every one the user
+    /// may read, for text: `agito-grep <text> [<repo>] [--lang=<language>]
+    /// [--path=<prefix>] [--json]`. Matches are `[<repo>:]<path>:<line>:<text>`
+    /// lines; like grep, it exits 1 if nothing matched and 2 on errors, which
+    /// go to stderr.
+    async fn handle_grep(
+        &mut self,
+        channel: ChannelId,
+        command: &str,
+        session: &mut Session,
+    ) -> Result<()> {
+        let fail = |session: &mut Session, msg: String| {
+            session.extended_data(channel, 1, msg.into_bytes().into());
+            session.exit_status_request(channel, 2);
             session.eof(channel);
             session.close(channel);
+        };
+        let mut args = split_args(command);
+        let json = take_json(&mut args);
+        let mut query = search::Query::default();
+        let mut positional = Vec::new();
+        for arg in args.into_iter().skip(1) {
+            if let Some(lang) = arg.strip_prefix("--lang=") {
+                match search::find_language(lang) {
+                    Some(language) => query.language = Some(language.to_string()),
+                    None => {
+                        fail(session, format!("Unknown language '{}'\n", lang));
+                        return Ok(());
+                    }
+                }
+            } else if let Some(path) = arg.strip_prefix("--path=") {
+                query.path = Some(path.to_string()).filter(|path| !path.is_empty());
+            } else {
+                positional.push(arg);
+            }
+        }
+        let one_repo = match positional.as_slice() {
+            [text] => {
+                query.text = text.clone();
+                None
+            }
+            [text, repo] => {
+                query.text = text.clone();
+                Some(repo.trim_start_matches('/').to_string())
+            }
+            _ => {
+                fail(session, GREP_USAGE.to_string());
+                return Ok(());
+            }
+        };
+        if let Err(e) = query.check() {
+            fail(session, format!("{}\n", e));
             return Ok(());
         }
 
-        let msg = format!("Repository created: {}\n", repo_name);
-        tracing::info!("Created repository: {:?}", repo_path);
+        let repos = match &one_repo {
+            Some(name) => {
+                let found = self
+                    .resolver
+                    .resolve(name)
+                    .ok_or_else(|| format!("Repository not found: {}\n", name))
+                    .and_then(|found| self.check_role(&found, Role::Read).map(|_| found));
+                match found {
+                    Ok(found) => vec![(found.clone(), self.repos_dir.join(found))],
+                    Err(msg) => {
+                        fail(session, msg);
+                        return Ok(());
+                    }
+                }
+            }
+            None => crate::git::find_repositories(&self.repos_dir)?
+                .into_iter()
+                .filter(|(name, _)| self.check_role(name, Role::Read).is_ok())
+                .collect(),
+        };
+
+        let found = tokio::task::spawn_blocking(move || {
+            let mut found = Vec::new();
+            let mut remaining = MAX_GREP_FILES;
+            for (repo, repo_path) in repos {
+                if remaining == 0 {
+                    break;
+                }
+                if let Some((branch, hits)) = search::find(&repo_path, &query, remaining) {
+                    if !hits.is_empty() {
+                        remaining -= hits.len();
+                        found.push((repo, branch, hits));
+                    }
+                }
+            }
+            found
+        })
+        .await?;
+
+        let msg = if json {
+            let repos: Vec<_> = found
+                .iter()
+                .map(|(repo, branch, hits)| serde_json::json!({ "repo": repo, "branch": branch, "files": hits }))
+                .collect();
+            format!("{}\n", serde_json::Value::from(repos))
+        } else {
+            let mut msg = String::new();
+            for (repo, _, hits) in &found {
+                let prefix = if one_repo.is_some() { String::new() } else { format!("{}:", repo) };
+                for hit in hits {
+                    for line in &hit.lines {
+                        msg.push_str(&format!("{}{}:{}:{}\n", prefix, hit.path, line.number, line.text));
+                    }
+                    if hit.matches > hit.lines.len() {
+                        msg.push_str(&format!(
+                            "{}{}: {} more matching lines\n",
+                            prefix,
+                            hit.path,
+                            hit.matches - hit.lines.len()
+                        ));
+                    }
+                }
+            }
+            msg
+        };
         session.data(channel, msg.into_bytes().into());
-        session.exit_status_request(channel, 0);
+        session.exit_status_request(channel, if found.is_empty() && !json { 1 } else { 0 });
+        session.eof(channel);
+        session.close(channel);
+
+        Ok(())
+    }
+
+    /// Read a repository's issues, builds or history: `agito-issue <repo> ...`,
+    /// `agito-ci <repo> ...` and `agito-log <repo> ...`
+    async fn handle_read(
+        &mut self,
+        channel: ChannelId,
+        command: &str,
+        session: &mut Session,
+    ) -> Result<()> {
+        let reply = match self.find_repo(command, Role::Read) {
+            Ok((name, repo_path)) => {
+                let mut args = split_args(command);
+                let json = take_json(&mut args);
+                tokio::task::spawn_blocking(move || {
+                    let rest = args.get(2..).unwrap_or_default();
+                    match args[0].as_str() {
+                        "agito-issue" => issue_command(&name, &repo_path, rest, json),
+                        "agito-ci" => ci_command(&name, &repo_path, rest, json),
+                        _ => log_command(&name, &repo_path, rest, json),
+                    }
+                })
+                .await?
+            }
+            Err(msg) => Err(msg),
+        };
+
+        let (msg, code) = match reply {
+            Ok(msg) => (msg, 0),
+            Err(msg) => (msg, 1),
+        };
+        session.data(channel, msg.into_bytes().into());
+        session.exit_status_request(channel, code);
         session.eof(channel);
         session.close(channel);
 
         Ok(())
     }
-}
 
+    /// Manage a repository's deploy keys: `agito-deploy-key <repo> list`,
+    /// `add <key> [title]` or `remove <id>`. Needs admin access.
+    async fn handle_deploy_key(
+        &mut self,
+        channel: ChannelId,
+        command: &str,
+        session: &mut Session,
+    ) -> Result<()> {
+        let reply = match self.find_repo(command, Role::Admin) {
+            Ok((name, repo_path)) => {
+                let args = split_args(command);
+                let user = self.user.clone();
+                let (repos_dir, data_dir) = (self.repos_dir.clone(), self.limits.data_dir.clone());
+                tokio::task::spawn_blocking(move || {
+                    deploy_key_command(&name, &repos_dir, &data_dir, &repo_path, args.get(2..).unwrap_or_default(), user.as_deref())
+                })
+                .await?
+            }
+            Err(msg) => Err(msg),
+        };
+
+        let (msg, code) = match reply {
+            Ok(msg) => (msg, 0),
+            Err(msg) => (msg, 1),
+        };
+        session.data(channel, msg.into_bytes().into());
+        session.exit_status_request(channel, code);
+        session.eof(channel);
+        session.close(channel);
+
+        Ok(())
+    }
+
+    /// Manage a repository: `agito-repo <repo> <action> [arguments]`, see
+    /// [`repo_command`]. `agito-set-default-branch <repo> <branch>` and
+    /// `agito-set-visibility <repo> <visibility>` are the same as
+    /// `agito-repo <repo> default-branch|visibility <value>`.
+    async fn handle_repo(
+        &mut self,
+        channel: ChannelId,
+        command: &str,
+        session: &mut Session,
+    ) -> Result<()> {
+        let reply = match self.find_repo(command, Role::Admin) {
+            Ok((name, _)) => {
+                let mut args = split_args(command);
+                if let Some(setting) = args[0].strip_prefix("agito-set-") {
+                    let setting = setting.to_string();
+                    args.insert(2, setting);
+                }
+                let (user, peer) = (self.user.clone(), self.peer.clone());
+                let (limits, redirect_days) = (self.limits.clone(), self.resolver.redirect_days);
+                tokio::task::spawn_blocking(move || {
+                    repo_command(&name, &limits, redirect_days, args.get(2..).unwrap_or_default(), user.as_deref(), &peer)
+                })
+                .await?
+            }
+            Err(msg) => Err(msg),
+        };
+
+        let (msg, code) = match reply {
+            Ok(msg) => (msg, 0),
+            Err(msg) => (msg, 1),
+        };
+        session.data(channel, msg.into_bytes().into());
+        session.exit_status_request(channel, code);
+        session.eof(channel);
+        session.close(channel);
+
+        Ok(())
+    }
+
+    /// Send a bundle of a repository on stdout, with any error on stderr:
+    /// `agito-bundle <repo> [--since <rev>] [<ref>...]`
+    async fn handle_bundle(
+        &mut self,
+        channel: ChannelId,
+        command: &str,
+        session: &mut Session,
+    ) -> Result<()> {
+        let fail = |session: &mut Session, msg: String| {
+            session.extended_data(channel, 1, msg.into_bytes().into());
+            session.exit_status_request(channel, 1);
+            session.eof(channel);
+            session.close(channel);
+        };
+        let (_, repo_path) = match self.find_repo(command, Role::Read) {
+            Ok(found) => found,
+            Err(msg) => {
+                fail(session, msg);
+                return Ok(());
+            }
+        };
+        let mut request = bundle::Request::default();
+        let mut words = command.split_whitespace().skip(2).map(|word| word.trim_matches('\''));
+        while let Some(word) = words.next() {
+            if word == "--since" {
+                request.since = words.next().map(str::to_string);
+            } else {
+                request.refs.push(word.to_string());
+            }
+        }
+        let path = repo_path.clone();
+        let args = match tokio::task::spawn_blocking(move || request.resolve(&path)).await? {
+            Ok(args) => args,
+            Err(e) => {
+                fail(session, format!("{}\n", e));
+                return Ok(());
+            }
+        };
+
+        // A bundle costs the server as much as a clone
+        let _permit = match self.git_pools.acquire_async(Pool::Upload).await {
+            Ok(permit) => permit,
+            Err(busy) => {
+                fail(session, format!("{}\n", busy));
+                return Ok(());
+            }
+        };
+        // git and what it started stop with the session, or once the bundle
+        // takes longer than a clone may
+        let mut child = process::Child::spawn(
+            Command::from(bundle::command(&repo_path, &args))
+                .stdin(Stdio::null())
+                .stdout(Stdio::piped())
+                .stderr(Stdio::piped()),
+        )?;
+        let deadline = self
+            .git_pools
+            .timeout(Pool::Upload)
+            .map(|timeout| tokio::time::Instant::now() + timeout);
+        let mut stdout = child.stdout.take().unwrap();
+        // Collect git's errors while the bundle is sent, so that git can't
+        // stall on a full stderr pipe
+        let mut stderr = child.stderr.take().unwrap();
+        let errors = tokio::spawn(async move {
+            let mut errors = Vec::new();
+            let _ = stderr.read_to_end(&mut errors).await;
+            errors
+        });
+        let mut buf = vec![0u8; 64 * 1024];
+        loop {
+            match process::read(&mut stdout, &mut buf, deadline).await {
+                Ok(0) | Err(_) => break,
+                Ok(n) => session.data(channel, buf[..n].to_vec().into()),
+            }
+        }
+        let timed_out = deadline.map_or(false, |deadline| tokio::time::Instant::now() >= deadline);
+        if timed_out {
+            child.stop();
+        }
+        let errors = errors.await.unwrap_or_default();
+        if !errors.is_empty() {
+            session.extended_data(channel, 1, errors.into());
+        }
+        if timed_out {
+            session.extended_data(
+                channel,
+                1,
+                b"git bundle took too long and was stopped\n".to_vec().into(),
+            );
+        }
+
+        let status = child.wait().await?;
+        session.exit_status_request(channel, status.code().unwrap_or(1) as u32);
+        session.eof(channel);
+        session.close(channel);
+        Ok(())
+    }
+
+    /// Work with releases: `agito-release <repo> <action> [arguments]`, see
+    /// [`release_command`]. Reading needs read access, and publishing write
+    /// access. `upload <tag> <name>` takes the file on standard input and
+    /// stores it once the client closes its side of the channel.
+    async fn handle_release(
+        &mut self,
+        channel: ChannelId,
+        command: &str,
+        session: &mut Session,
+    ) -> Result<()> {
+        let args = split_args(command);
+        let reply = match self.find_repo(command, Role::Read) {
+            Ok((name, repo_path)) if args.get(2).map(String::as_str) == Some("upload") => {
+                match self.start_upload(&name, repo_path, &args[3..]) {
+                    Ok(pending) => {
+                        self.uploads.insert(channel, pending);
+                        return Ok(());
+                    }
+                    Err(msg) => Err(msg),
+                }
+            }
+            Ok((name, repo_path)) => {
+                let writable = self.check_role(&name, Role::Write).is_ok();
+                let (user, peer) = (self.user.clone(), self.peer.clone());
+                let data_dir = self.limits.data_dir.clone();
+                tokio::task::spawn_blocking(move || {
+                    release_command(&name, &repo_path, args.get(2..).unwrap_or_default(), user.as_deref(), writable, &data_dir, &peer)
+                })
+                .await?
+            }
+            Err(msg) => Err(msg),
+        };
+
+        let (msg, code) = match reply {
+            Ok(msg) => (msg, 0),
+            Err(msg) => (msg, 1),
+        };
+        session.data(channel, msg.into_bytes().into());
+        session.exit_status_request(channel, code);
+        session.eof(channel);
+        session.close(channel);
+
+        Ok(())
+    }
+
+    /// Check an `upload <tag> <name>` and open the file its input goes to
+    fn start_upload(
+        &self,
+        name: &str,
+        repo_path: PathBuf,
+        args: &[String],
+    ) -> std::result::Result<PendingUpload, String> {
+        let (tag, asset) = match args {
+            [tag, asset] => (tag.clone(), asset.clone()),
+            _ => return Err(RELEASE_USAGE.to_string()),
+        };
+        self.check_role(name, Role::Write)?;
+        if self.user.is_none() {
+            return Err("Sign in with a registered key to do that\n".to_string());
+        }
+        if archive::is_archived(&repo_path) {
+            return Err(format!("{}\n", archive::refusal(name)));
+        }
+        if !releases::valid_asset_name(&asset) {
+            return Err(format!("Invalid asset name '{}'\n", asset));
+        }
+        match releases::get(&repo_path, &tag) {
+            Ok(Some(_)) => {}
+            Ok(None) => return Err(format!("No release of {} in {}\n", tag, name)),
+            Err(e) => return Err(format!("{:#}\n", e)),
+        }
+        let dir = releases::upload_dir(&repo_path);
+        let spool = dir.join(format!(
+            "{}-{}",
+            std::process::id(),
+            chrono::Utc::now().timestamp_nanos_opt().unwrap_or_default()
+        ));
+        fs::create_dir_all(&dir)
+            .and_then(|()| fs::File::create(&spool))
+            .map(|file| PendingUpload {
+                name: name.to_string(),
+                repo_path,
+                tag,
+                asset,
+                spool,
+                file,
+            })
+            .map_err(|e| format!("Failed to start the upload: {}\n", e))
+    }
+
+    async fn finish_upload(
+        &mut self,
+        channel: ChannelId,
+        pending: PendingUpload,
+        session: &mut Session,
+    ) -> Result<()> {
+        let PendingUpload {
+            name,
+            repo_path,
+            tag,
+            asset,
+            spool,
+            file,
+        } = pending;
+        drop(file);
+        let quotas = self.quotas.clone();
+        let (user, peer) = (self.user.clone().unwrap_or_default(), self.peer.clone());
+        let data_dir = self.limits.data_dir.clone();
+        let disk_usage = self.disk_usage.clone();
+        let result = tokio::task::spawn_blocking(move || {
+            let size = fs::metadata(&spool).map(|m| m.len()).unwrap_or(0);
+            if let Ok(mut status) = quotas.status(&repo_path) {
+                status.repo_bytes += size;
+                status.user_bytes += size;
+                if let Some(reason) = status.exceeded() {
+                    let _ = fs::remove_file(&spool);
+                    return Err(format!("Upload rejected: {}\n", reason));
+                }
+            }
+            let stored = releases::add_asset(&repo_path, &tag, &asset, &spool, &user);
+            let stored = stored.map_err(|e| {
+                let _ = fs::remove_file(&spool);
+                format!("{:#}\n", e)
+            })?;
+            audit::Entry::new(Action::ReleaseChange, Via::Ssh, Some(&user))
+                .with_repo(&name)
+                .with_target(&tag)
+                .with_detail(format!("uploaded asset {}", stored.name))
+                .with_remote(Some(peer))
+                .record(&data_dir);
+            let _ = disk_usage.refresh_repo(&name, &repo_path);
+            Ok(format!(
+                "Uploaded {} to the release of {} ({}, sha256 {})\n",
+                stored.name,
+                tag,
+                crate::usage::format_bytes(stored.size),
+                stored.sha256
+            ))
+        })
+        .await?;
+
+        let (msg, code) = match result {
+            Ok(msg) => (msg, 0),
+            Err(msg) => (msg, 1),
+        };
+        session.data(channel, msg.into_bytes().into());
+        session.exit_status_request(channel, code);
+        session.eof(channel);
+        session.close(channel);
+        Ok(())
+    }
+
+    /// Check a push without making it: `agito-push-check <repo>`, with the
+    /// refs and pack described in [`push_check`] on standard input. The check
+    /// runs once the client closes its side of the channel.
+    fn start_push_check(&mut self, channel: ChannelId, command: &str, session: &mut Session) {
+        let pending = self.find_repo(command, Role::Write).and_then(|(_, repo_path)| {
+            let dir = crate::git::data_dir(&repo_path).join("push-check");
+            let spool = dir.join(format!(
+                "{}-{}.spool",
+                std::process::id(),
+                chrono::Utc::now().timestamp_nanos_opt().unwrap_or_default()
+            ));
+            fs::create_dir_all(&dir)
+                .and_then(|()| fs::File::create(&spool))
+                .map(|file| PendingCheck {
+                    repo_path,
+                    spool,
+                    file,
+                })
+                .map_err(|e| format!("Failed to start the check: {}\n", e))
+        });
+        match pending {
+            Ok(pending) => {
+                self.push_checks.insert(channel, pending);
+            }
+            Err(msg) => {
+                session.data(channel, msg.into_bytes().into());
+                session.exit_status_request(channel, 1);
+                session.eof(channel);
+                session.close(channel);
+            }
+        }
+    }
+
+    async fn finish_push_check(
+        &mut self,
+        channel: ChannelId,
+        pending: PendingCheck,
+        session: &mut Session,
+    ) -> Result<()> {
+        let PendingCheck {
+            repo_path,
+            spool,
+            file,
+        } = pending;
+        drop(file);
+        let result = tokio::task::spawn_blocking(move || {
+            let result = fs::File::open(&spool).map_err(anyhow::Error::from).and_then(|file| {
+                push_check::run(&repo_path, &mut std::io::BufReader::new(file))
+            });
+            let _ = fs::remove_file(&spool);
+            result
+        })
+        .await?;
+
+        let (msg, code) = match result {
+            Ok(report) if report.accepted() => (report.describe(), 0),
+            Ok(report) => (report.describe(), 1),
+            Err(e) => (format!("Check failed: {:#}\n", e), 1),
+        };
+        session.data(channel, msg.into_bytes().into());
+        session.exit_status_request(channel, code);
+        session.eof(channel);
+        session.close(channel);
+        Ok(())
+    }
+
+    /// Report a repository's disk usage and quotas: `agito-info <repo>`
+    async fn handle_info(
+        &mut self,
+        channel: ChannelId,
+        command: &str,
+        session: &mut Session,
+    ) -> Result<()> {
+        let (name, repo_path) = match self.find_repo(command, Role::Read) {
+            Ok(found) => found,
+            Err(msg) => {
+                session.data(channel, msg.into_bytes().into());
+                session.exit_status_request(channel, 1);
+                session.eof(channel);
+                session.close(channel);
+                return Ok(());
+            }
+        };
+
+        let quotas = self.quotas.clone();
+        let status = tokio::task::spawn_blocking(move || quotas.status(&repo_path)).await??;
+        let msg = if split_args(command).iter().any(|arg| arg == "--json") {
+            format!("{}\n", status.json(&name))
+        } else {
+            format!("Repository: {}\n{}", name, status.describe())
+        };
+        session.data(channel, msg.into_bytes().into());
+        session.exit_status_request(channel, 0);
+        session.eof(channel);
+        session.close(channel);
+
+        Ok(())
+    }
+
+    /// Hand git-lfs a token for the web server's LFS endpoints:
+    /// `git-lfs-authenticate <repo> <upload|download>`
+    fn handle_lfs_authenticate(&mut self, channel: ChannelId, command: &str, session: &mut Session) {
+        let operation = command.split_whitespace().nth(2).unwrap_or("");
+        let needed = if operation == "upload" { Role::Write } else { Role::Read };
+        let reply = match (&self.lfs_tokens, self.find_repo(command, needed), operation.parse::<lfs::Operation>()) {
+            (None, _, _) => Err("Git LFS is not enabled on this server\n".to_string()),
+            (_, Err(msg), _) => Err(msg),
+            (_, _, Err(e)) => Err(format!("{}\n", e)),
+            (Some(tokens), Ok((name, _)), Ok(operation)) => Ok(serde_json::json!({
+                "href": format!("{}/{}/info/lfs", self.public_url, name),
+                "header": {
+                    "Authorization": format!("RemoteAuth {}", tokens.issue(&name, operation)),
+                },
+                "expires_in": lfs::TOKEN_TTL,
+            })),
+        };
+
+        match reply {
+            Ok(json) => {
+                session.data(channel, format!("{}\n", json).into_bytes().into());
+                session.exit_status_request(channel, 0);
+            }
+            Err(msg) => {
+                session.data(channel, msg.into_bytes().into());
+                session.exit_status_request(channel, 1);
+            }
+        }
+        session.eof(channel);
+        session.close(channel);
+    }
+
+    /// Resolve the repository named by a command's first argument, with or
+    /// without the .git suffix, if the user has the `needed` role on it
+    fn find_repo(&self, command: &str, needed: Role) -> std::result::Result<(String, PathBuf), String> {
+        let name = command
+            .split_whitespace()
+            .nth(1)
+            .unwrap_or("")
+            .trim_matches('\'')
+            .trim_start_matches('/');
+        let found = self
+            .resolver
+            .resolve(name)
+            .ok_or_else(|| format!("Repository not found: {}\n", name))?;
+        self.check_role(&found, needed)?;
+        Ok((found.clone(), self.repos_dir.join(found)))
+    }
+
+    /// Make sure the user has the `needed` role on a repository; those who
+    /// may not read it are told it does not exist
+    fn check_role(&self, repo: &str, needed: Role) -> std::result::Result<(), String> {
+        // A deploy key knows of its own repository only, and only reads it
+        if let Some(deploy_repo) = &self.deploy_repo {
+            return match (deploy_repo == repo, needed) {
+                (false, _) => Err(format!("Repository not found: {}\n", repo)),
+                (true, Role::Read) => Ok(()),
+                (true, _) => Err(format!("Deploy keys are read-only; you need {} access to {}\n", needed.name(), repo)),
+            };
+        }
+        let data_dir = &self.limits.data_dir;
+        let mut role = orgs::role(data_dir, &self.repos_dir, repo, self.user.as_deref());
+        // Keys without a user are the operator's, and push anywhere outside organizations
+        if self.user.is_none() && !orgs::in_org(data_dir, repo) {
+            role = role.max(Some(Role::Write));
+        }
+        match role {
+            Some(role) if role >= needed => Ok(()),
+            Some(_) => Err(format!("You need {} access to {}\n", needed.name(), repo)),
+            None => Err(format!("Repository not found: {}\n", repo)),
+        }
+    }
+
+    /// A template repository the user may read, to create a repository from
+    fn find_template(&self, name: &str) -> std::result::Result<(String, PathBuf), String> {
+        let name = name.trim_start_matches('/');
+        let found = self
+            .resolver
+            .resolve(name)
+            .ok_or_else(|| format!("Repository not found: {}\n", name))?;
+        self.check_role(&found, Role::Read)?;
+        let path = self.repos_dir.join(&found);
+        if !templates::is_template(&path) {
+            return Err(format!("{} is not a template; its admins can make it one with agito repo {} template on\n", found, found));
+        }
+        Ok((found, path))
+    }
+
+    /// Reply with the server's unix time and version so clients can check
+    /// connectivity, clock skew and compatibility: `agito-ping [<repo>]`.
+    /// With a repository, also report whether its hooks are installed.
+    fn handle_ping(&mut self, channel: ChannelId, command: &str, session: &mut Session) {
+        let now = std::time::SystemTime::now()
+            .duration_since(std::time::UNIX_EPOCH)
+            .map(|d| d.as_secs())
+            .unwrap_or(0);
+        let mut msg = format!("pong {}\nversion {}\n", now, env!("CARGO_PKG_VERSION"));
+        if command.split_whitespace().nth(1).is_some() {
+            match self.find_repo(command, Role::Read) {
+                Ok((_, repo_path)) => match self.hook_templates.check(&repo_path) {
+                    Ok(problems) if problems.is_empty() => msg.push_str("hooks ok\n"),
+                    Ok(problems) => {
+                        for problem in problems {
+                            msg.push_str(&format!("hooks {}\n", problem));
+                        }
+                    }
+                    Err(e) => msg.push_str(&format!("hooks {:#}\n", e)),
+                },
+                Err(e) => msg.push_str(&format!("repo {}", e)),
+            }
+        }
+        session.data(channel, msg.into_bytes().into());
+        session.exit_status_request(channel, 0);
+        session.eof(channel);
+        session.close(channel);
+    }
+
+    /// Reply with the names of the repositories the user may read, one per
+    /// line: `agito-list [--json]`. As JSON, each also has its visibility and
+    /// whether it is archived.
+    fn handle_list(&mut self, channel: ChannelId, command: &str, session: &mut Session) {
+        let json = split_args(command).iter().any(|arg| arg == "--json");
+        let (msg, status) = match crate::git::find_repositories(&self.repos_dir) {
+            Ok(repos) => {
+                let readable = repos
+                    .into_iter()
+                    .filter(|(name, _)| self.check_role(name, Role::Read).is_ok());
+                if json {
+                    let data_dir = &self.limits.data_dir;
+                    let repos: Vec<_> = readable
+                        .map(|(name, path)| {
+                            let visibility = visibility::effective(&path, orgs::in_org(data_dir, &name));
+                            serde_json::json!({
+                                "name": name,
+                                "visibility": visibility.name(),
+                                "archived": archive::is_archived(&path),
+                            })
+                        })
+                        .collect();
+                    (format!("{}\n", serde_json::Value::from(repos)), 0)
+                } else {
+                    (readable.map(|(name, _)| format!("{}\n", name)).collect(), 0)
+                }
+            }
+            Err(e) => (format!("Failed to list repositories: {}\n", e), 1),
+        };
+        session.data(channel, msg.into_bytes().into());
+        session.exit_status_request(channel, status);
+        session.eof(channel);
+        session.close(channel);
+    }
+
+    async fn handle_create_repo(
+        &mut self,
+        channel: ChannelId,
+        command: &str,
+        session: &mut Session,
+    ) -> Result<()> {
+        let parts: Vec<&str> = command.split_whitespace().collect();
+        if parts.len() < 2 || parts.len() > 5 {
+            session.data(channel, CREATE_USAGE.as_bytes().to_vec().into());
+            session.exit_status_request(channel, 1);
+            session.eof(channel);
+            session.close(channel);
+            return Ok(());
+        }
+        let mut visibility = Ok(self.default_visibility);
+        let (mut template, mut with_hooks) = (None, false);
+        for arg in parts[2..].iter().map(|arg| arg.trim_matches('\'')) {
+            if let Some(value) = arg.strip_prefix("--visibility=") {
+                visibility = value.parse::<Visibility>();
+            } else if let Some(value) = arg.strip_prefix("--template=") {
+                template = Some(value);
+            } else if arg == "--with-hooks" {
+                with_hooks = true;
+            } else {
+                visibility = Err(CREATE_USAGE.trim_end().to_string());
+            }
+        }
+        if with_hooks && template.is_none() {
+            visibility = Err("--with-hooks needs --template".to_string());
+        }
+        let visibility = match visibility {
+            Ok(visibility) => visibility,
+            Err(e) => {
+                let msg = format!("{}\n", e);
+                session.data(channel, msg.into_bytes().into());
+                session.exit_status_request(channel, 1);
+                session.eof(channel);
+                session.close(channel);
+                return Ok(());
+            }
+        };
+        if let Some(notice) = maintenance_mode::server(&self.limits.data_dir) {
+            let msg = format!("{}\n", maintenance_mode::server_refusal(&notice));
+            session.data(channel, msg.into_bytes().into());
+            session.exit_status_request(channel, 1);
+            session.eof(channel);
+            session.close(channel);
+            return Ok(());
+        }
+
+        // Lands in the user's namespace unless a top-level name (/name) is asked for
+        let repo_name = match self.limits.place(self.user.as_deref(), parts[1]) {
+            Ok(name) => name,
+            Err(e) => {
+                let msg = format!("{}\n", e);
+                session.data(channel, msg.into_bytes().into());
+                session.exit_status_request(channel, 1);
+                session.eof(channel);
+                session.close(channel);
+                return Ok(());
+            }
+        };
+
+        // The template must be one the user may read
+        let template = match template {
+            None => None,
+            Some(template) => match self.find_template(template) {
+                Ok(found) => Some(found),
+                Err(msg) => {
+                    session.data(channel, msg.into_bytes().into());
+                    session.exit_status_request(channel, 1);
+                    session.eof(channel);
+                    session.close(channel);
+                    return Ok(());
+                }
+            },
+        };
+
+        let request = create::Request {
+            name: &repo_name,
+            visibility,
+            template: template.as_ref().map(|(_, path)| path.as_path()),
+            with_hooks,
+            user: self.user.as_deref(),
+        };
+        if let Err(e) = create::create(&self.limits, &self.hook_templates, &request) {
+            let msg = format!("{:#}\n", e);
+            session.data(channel, msg.into_bytes().into());
+            session.exit_status_request(channel, 1);
+            session.eof(channel);
+            session.close(channel);
+            return Ok(());
+        }
+        let detail = match &template {
+            Some((template_name, _)) => format!("{} from template {}", visibility.name(), template_name),
+            None => visibility.name().to_string(),
+        };
+        audit::Entry::new(Action::RepoCreate, Via::Ssh, self.user.as_deref())
+            .with_repo(&repo_name)
+            .with_detail(detail)
+            .with_remote(Some(self.peer.clone()))
+            .record(&self.limits.data_dir);
+
+        let mut msg = format!("Repository created: {}\n", repo_name);
+        if let Some(url) = self.clone_urls.ssh(&repo_name) {
+            msg.push_str(&format!("Clone URL: {}\n", url));
+        }
+        session.data(channel, msg.into_bytes().into());
+        session.exit_status_request(channel, 0);
+        session.eof(channel);
+        session.close(channel);
+
+        Ok(())
+    }
+}
+
+const CREATE_USAGE: &str = "Usage: agito-create-repo <repo-name> [--visibility=public|internal|private] [--template=<repo> [--with-hooks]]\n";
+
+const PR_USAGE: &str = "Usage: agito-pr <repo> list [--state=open|closed|merged|all] [--json]
+       agito-pr <repo> show <number> [--json]
+       agito-pr <repo> create <base> <head> <title> [description]
+       agito-pr <repo> comment <number> <text>
+       agito-pr <repo> close|reopen <number>
+       agito-pr <repo> merge <number> [--strategy=merge|squash|rebase] [message]
+       agito-pr <repo> update <number> [--rebase]
+";
+
+const GREP_USAGE: &str = "Usage: agito-grep <text> [<repo>] [--lang=<language>] [--path=<prefix>] [--json]\n";
+
+/// Files listed by one `agito-grep`, across all repositories searched
+const MAX_GREP_FILES: usize = 100;
+
+const ISSUE_USAGE: &str = "Usage: agito-issue <repo> list [--state=open|closed|all] [--label=<label>] [--json]
+       agito-issue <repo> show <number> [--json]
+";
+
+/// Read a repository's issues: `agito-issue <repo> list|show`
+fn issue_command(name: &str, repo_path: &Path, args: &[String], json: bool) -> std::result::Result<String, String> {
+    let failed = |e: anyhow::Error| format!("{:#}\n", e);
+    match args.first().map(String::as_str) {
+        Some("list") => {
+            let mut filter = issues::Filter {
+                state: Some(issues::State::Open),
+                ..Default::default()
+            };
+            for arg in &args[1..] {
+                if let Some(state) = arg.strip_prefix("--state=") {
+                    filter.state = match state {
+                        "all" => None,
+                        state => Some(state.parse().map_err(|e| format!("{}\n", e))?),
+                    };
+                } else if let Some(label) = arg.strip_prefix("--label=") {
+                    filter.label = Some(label.to_string());
+                } else {
+                    return Err(ISSUE_USAGE.to_string());
+                }
+            }
+            let found = issues::list(repo_path, &filter).map_err(failed)?;
+            if json {
+                return to_json(&found);
+            }
+            if found.is_empty() {
+                return Ok("No issues\n".to_string());
+            }
+            Ok(found
+                .iter()
+                .map(|issue| {
+                    let labels: Vec<&str> = issue.labels.iter().map(String::as_str).collect();
+                    let labels = if labels.is_empty() { String::new() } else { format!(" [{}]", labels.join(", ")) };
+                    format!("#{}\t{}\t{}{} by {}\n", issue.number, issue.state.name(), issue.title, labels, issue.author)
+                })
+                .collect())
+        }
+        Some("show") => {
+            let number = args
+                .get(1)
+                .and_then(|n| n.trim_start_matches('#').parse().ok())
+                .ok_or_else(|| ISSUE_USAGE.to_string())?;
+            let issue = issues::get(repo_path, number)
+                .map_err(failed)?
+                .ok_or_else(|| format!("No issue #{} in {}\n", number, name))?;
+            if json {
+                return to_json(&issue);
+            }
+            let mut msg = format!("#{} {}\n{} by {}\n", issue.number, issue.title, issue.state.name(), issue.author);
+            if !issue.labels.is_empty() {
+                let labels: Vec<&str> = issue.labels.iter().map(String::as_str).collect();
+                msg.push_str(&format!("Labels: {}\n", labels.join(", ")));
+            }
+            if let Some(milestone) = &issue.milestone {
+                msg.push_str(&format!("Milestone: {}\n", milestone));
+            }
+            if !issue.body.is_empty() {
+                msg.push_str(&format!("\n{}\n", issue.body));
+            }
+            for comment in &issue.comments {
+                msg.push_str(&format!("\n--- {}:\n{}\n", comment.author, comment.body));
+            }
+            Ok(msg)
+        }
+        _ => Err(ISSUE_USAGE.to_string()),
+    }
+}
+
+const CI_USAGE: &str = "Usage: agito-ci <repo> list [--branch=<branch>] [--json]
+       agito-ci <repo> show <build> [--json]
+";
+
+/// Read a repository's builds: `agito-ci <repo> list|show`
+fn ci_command(name: &str, repo_path: &Path, args: &[String], json: bool) -> std::result::Result<String, String> {
+    let failed = |e: anyhow::Error| format!("{:#}\n", e);
+    match args.first().map(String::as_str) {
+        Some("list") => {
+            let branch = match args.get(1).map(|arg| arg.strip_prefix("--branch=")) {
+                None => None,
+                Some(Some(branch)) if args.len() == 2 => Some(branch),
+                Some(_) => return Err(CI_USAGE.to_string()),
+            };
+            let builds: Vec<ci::Build> = ci::list(repo_path)
+                .map_err(failed)?
+                .into_iter()
+                .filter(|build| branch.map_or(true, |branch| build.branch() == branch))
+                .collect();
+            if json {
+                return to_json(&builds);
+            }
+            if builds.is_empty() {
+                return Ok("No builds\n".to_string());
+            }
+            Ok(builds
+                .iter()
+                .map(|build| {
+                    let commit = build.commit.get(..12).unwrap_or(&build.commit);
+                    format!("#{}\t{}\t{} {}\n", build.id, build.status_name(), build.branch(), commit)
+                })
+                .collect())
+        }
+        Some("show") => {
+            let id = args
+                .get(1)
+                .and_then(|n| n.trim_start_matches('#').parse().ok())
+                .ok_or_else(|| CI_USAGE.to_string())?;
+            let build = ci::get(repo_path, id)
+                .map_err(failed)?
+                .ok_or_else(|| format!("No build #{} in {}\n", id, name))?;
+            if json {
+                return to_json(&build);
+            }
+            let mut msg = format!("Build #{}: {}\n{} at {}\n", build.id, build.status_name(), build.branch(), build.commit);
+            if let Some(pusher) = &build.pusher {
+                msg.push_str(&format!("Pushed by {}\n", pusher));
+            }
+            for step in &build.steps {
+                let exit = step.exit_code.map(|code| format!(", exit {}", code)).unwrap_or_default();
+                msg.push_str(&format!("  {}\t{} ({}s{})\n", step.name, step.state.name(), step.duration, exit));
+            }
+            if let Some(error) = &build.error {
+                msg.push_str(&format!("Error: {}\n", error));
+            }
+            Ok(msg)
+        }
+        _ => Err(CI_USAGE.to_string()),
+    }
+}
+
+const LOG_USAGE: &str = "Usage: agito-log <repo> [<ref>] [-n <count>] [--stat] [--json]\n";
+
+/// Commits shown by `agito-log` when not told how many
+const LOG_DEFAULT: usize = 20;
+
+/// Most commits one `agito-log` shows
+const LOG_MAX: usize = 500;
+
+/// Show the latest commits of a branch, tag or commit, the default branch
+/// if none: `agito-log <repo> [<ref>] [-n <count>] [--stat]`
+fn log_command(name: &str, repo_path: &Path, args: &[String], json: bool) -> std::result::Result<String, String> {
+    let mut rev = None;
+    let mut limit = LOG_DEFAULT;
+    let mut stat = false;
+    let mut rest = args.iter();
+    while let Some(arg) = rest.next() {
+        match arg.as_str() {
+            "--stat" => stat = true,
+            "-n" => {
+                limit = rest
+                    .next()
+                    .and_then(|n| n.parse().ok())
+                    .filter(|&n| n > 0)
+                    .ok_or_else(|| LOG_USAGE.to_string())?
+            }
+            arg if !arg.starts_with('-') && rev.is_none() => rev = Some(arg),
+            _ => return Err(LOG_USAGE.to_string()),
+        }
+    }
+    let rev = rev.unwrap_or("HEAD");
+    let log = crate::git::batch::pool()
+        .log(repo_path, rev, limit.min(LOG_MAX))
+        .map_err(|e| format!("{}\n", e))?;
+    if log.is_empty() {
+        return Err(format!("Unknown revision {} in {}\n", rev, name));
+    }
+
+    // Files changed by each commit, against its first parent
+    let files = |commit: &crate::git::batch::Commit| -> Vec<(String, Option<u64>, Option<u64>)> {
+        let mut diff_args = vec!["diff-tree", "-r", "--numstat", "--no-commit-id", "--root"];
+        if let Some(parent) = commit.parents.first() {
+            diff_args.push(parent);
+        }
+        diff_args.push(&commit.id);
+        let output = match crate::git::run(repo_path, &diff_args) {
+            Ok(output) if output.status.success() => output.stdout,
+            _ => return Vec::new(),
+        };
+        String::from_utf8_lossy(&output)
+            .lines()
+            .filter_map(|line| {
+                // <added> TAB <deleted> TAB <path>, with - for binary files
+                let mut fields = line.splitn(3, '\t');
+                let (added, deleted, path) = (fields.next()?, fields.next()?, fields.next()?);
+                Some((path.to_string(), added.parse().ok(), deleted.parse().ok()))
+            })
+            .collect()
+    };
+
+    if json {
+        let commits: Vec<_> = log
+            .iter()
+            .map(|commit| {
+                let mut value = serde_json::json!({
+                    "id": commit.id,
+                    "parents": commit.parents,
+                    "author": commit.author_name,
+                    "email": commit.author_email,
+                    "date": commit.author_time,
+                    "subject": commit.subject(),
+                });
+                if stat {
+                    value["files"] = files(commit)
+                        .into_iter()
+                        .map(|(path, added, deleted)| serde_json::json!({ "path": path, "added": added, "deleted": deleted }))
+                        .collect::<Vec<_>>()
+                        .into();
+                }
+                value
+            })
+            .collect();
+        return to_json(&commits);
+    }
+
+    let mut msg = String::new();
+    for commit in &log {
+        let date = chrono::DateTime::from_timestamp(commit.author_time, 0)
+            .map(|t| t.format("%Y-%m-%d").to_string())
+            .unwrap_or_default();
+        let short = commit.id.get(..12).unwrap_or(&commit.id);
+        msg.push_str(&format!("{} {} {}  {}\n", short, date, commit.author_name, commit.subject()));
+        if stat {
+            for (path, added, deleted) in files(commit) {
+                match (added, deleted) {
+                    (Some(added), Some(deleted)) => msg.push_str(&format!("    +{} -{}\t{}\n", added, deleted, path)),
+                    _ => msg.push_str(&format!("    binary\t{}\n", path)),
+                }
+            }
+        }
+    }
+    Ok(msg)
+}
+
+/// Run an `agito-pr` action on a repository the user may read, returning
+/// what to print or why it failed
+fn pr_command(
+    name: &str,
+    repo_path: &Path,
+    args: &[String],
+    json: bool,
+    user: Option<&str>,
+    writable: bool,
+    usage: &DiskUsage,
+) -> std::result::Result<String, String> {
+    let action = args.first().map(String::as_str).unwrap_or("");
+    let args = args.get(1..).unwrap_or_default();
+    let number = || -> std::result::Result<u64, String> {
+        args.first()
+            .and_then(|n| n.trim_start_matches('#').parse().ok())
+            .ok_or_else(|| PR_USAGE.to_string())
+    };
+    let signed_in = || user.ok_or_else(|| "Sign in with a registered key to do that\n".to_string());
+    let failed = |e: anyhow::Error| format!("{:#}\n", e);
+    if json && !matches!(action, "list" | "show") {
+        return Err("--json only works with list and show\n".to_string());
+    }
+
+    match action {
+        "list" => {
+            let state = match args.first().and_then(|a| a.strip_prefix("--state=")) {
+                None => Some(pulls::State::Open),
+                Some("all") => None,
+                Some(state) => Some(state.parse().map_err(|e| format!("{}\n", e))?),
+            };
+            let found = pulls::list(repo_path, state).map_err(failed)?;
+            if json {
+                return to_json(&found);
+            }
+            if found.is_empty() {
+                return Ok("No pull requests\n".to_string());
+            }
+            Ok(found
+                .iter()
+                .map(|pull| {
+                    format!(
+                        "#{}\t{}\t{} ({} -> {}) by {}\n",
+                        pull.number, pull.state.name(), pull.title, pull.head, pull.base, pull.author
+                    )
+                })
+                .collect())
+        }
+        "show" => {
+            let pull = pulls::get(repo_path, number()?)
+                .map_err(failed)?
+                .ok_or_else(|| format!("No pull request #{} in {}\n", args[0], name))?;
+            if json {
+                let mut value = serde_json::to_value(&pull).map_err(|e| format!("{}\n", e))?;
+                if pull.state == pulls::State::Open {
+                    let (base, head) = pulls::compared(repo_path, &pull);
+                    if let Some((ahead, behind)) = crate::git::ahead_behind(repo_path, &base, &head) {
+                        value["ahead"] = ahead.into();
+                        value["behind"] = behind.into();
+                    }
+                    if let Ok(mergeability) = pulls::mergeability(repo_path, &pull) {
+                        value["mergeability"] = serde_json::to_value(mergeability).unwrap_or_default();
+                    }
+                }
+                return to_json(&value);
+            }
+            let mut msg = format!(
+                "#{} {}\n{} by {}: {} -> {}\n",
+                pull.number, pull.title, pull.state.name(), pull.author, pull.head, pull.base
+            );
+            if let Some(merged) = &pull.merged {
+                msg.push_str(&format!("Merged as {}\n", merged.commit));
+            } else if pull.state == pulls::State::Open {
+                let (base, head) = pulls::compared(repo_path, &pull);
+                if let Some((ahead, behind)) = crate::git::ahead_behind(repo_path, &base, &head) {
+                    msg.push_str(&format!("{} ahead, {} behind {}\n", ahead, behind, pull.base));
+                }
+                match pulls::mergeability(repo_path, &pull) {
+                    Ok(pulls::Mergeability::Clean) => msg.push_str("Mergeable\n"),
+                    Ok(pulls::Mergeability::UpToDate) => {
+                        msg.push_str(&format!("{} already contains {}\n", pull.base, pull.head))
+                    }
+                    Ok(pulls::Mergeability::MissingBranch { branch }) => {
+                        msg.push_str(&format!("Branch {} no longer exists\n", branch))
+                    }
+                    Ok(pulls::Mergeability::Conflicts { conflicts }) => {
+                        msg.push_str("Conflicts in:\n");
+                        for conflict in conflicts {
+                            msg.push_str(&format!("  {} ({})\n", conflict.path, conflict.kind));
+                        }
+                    }
+                    Err(e) => msg.push_str(&format!("Could not check for conflicts: {:#}\n", e)),
+                }
+            }
+            if !pull.body.is_empty() {
+                msg.push_str(&format!("\n{}\n", pull.body));
+            }
+            for comment in &pull.comments {
+                msg.push_str(&format!("\n--- {}:\n{}\n", comment.author, comment.body));
+            }
+            Ok(msg)
+        }
+        "create" => {
+            let user = signed_in()?;
+            if args.len() < 3 {
+                return Err(PR_USAGE.to_string());
+            }
+            let body = args.get(3).map(String::as_str).unwrap_or("");
+            let pull = pulls::create(repo_path, user, &args[0], &args[1], &args[2], body)
+                .map_err(failed)?;
+            Ok(format!("Pull request opened: #{}\n", pull.number))
+        }
+        "comment" => {
+            let user = signed_in()?;
+            let number = number()?;
+            let text = args.get(1).ok_or_else(|| PR_USAGE.to_string())?;
+            pulls::update(repo_path, number, |pull| pull.comment(user, text)).map_err(failed)?;
+            Ok(format!("Commented on #{}\n", number))
+        }
+        "close" | "reopen" => {
+            let user = signed_in()?;
+            let number = number()?;
+            let state = if action == "close" {
+                pulls::State::Closed
+            } else {
+                pulls::State::Open
+            };
+            pulls::update(repo_path, number, |pull| {
+                if pull.author != user && !writable {
+                    anyhow::bail!("Only the author and users with write access may {} #{}", action, number);
+                }
+                pull.set_state(state, user)
+            })
+            .map_err(failed)?;
+            Ok(format!("#{} is {}\n", number, state.name()))
+        }
+        "merge" | "update" => {
+            let user = signed_in()?;
+            let number = number()?;
+            if !writable {
+                return Err(format!("You need write access to {}\n", name));
+            }
+            let outcome = if action == "merge" {
+                let mut rest = &args[1..];
+                let mut strategy = None;
+                if let Some(value) = rest.first().and_then(|a| a.strip_prefix("--strategy=")) {
+                    strategy = Some(value.parse().map_err(|e| format!("{}\n", e))?);
+                    rest = &rest[1..];
+                }
+                let message = Some(rest.join(" ")).filter(|m| !m.trim().is_empty());
+                pulls::merge(repo_path, number, strategy, message, user)
+            } else {
+                let strategy = if args[1..].iter().any(|a| a == "--rebase") {
+                    merge::Strategy::Rebase
+                } else {
+                    merge::Strategy::Merge
+                };
+                pulls::update_branch(repo_path, number, strategy, user)
+            }
+            .map_err(failed)?;
+            match outcome {
+                merge::Outcome::Merged { commit, .. } => {
+                    if let Err(e) = usage.refresh_repo(name, repo_path) {
+                        tracing::warn!("Failed to measure {} after merge: {}", name, e);
+                    }
+                    mirror::push_all(repo_path);
+                    Ok(if action == "merge" {
+                        format!("Merged #{}: {}\n", number, commit)
+                    } else {
+                        format!("Updated the branch of #{}: {}\n", number, commit)
+                    })
+                }
+                merge::Outcome::UpToDate => Ok(format!("#{} is already up to date\n", number)),
+                merge::Outcome::Conflicts { conflicts } => {
+                    let mut msg = format!("Nothing changed; #{} has conflicts in:\n", number);
+                    for conflict in conflicts {
+                        msg.push_str(&format!("  {} ({})\n", conflict.path, conflict.kind));
+                    }
+                    Err(msg)
+                }
+            }
+        }
+        _ => Err(PR_USAGE.to_string()),
+    }
+}
+
+const DEPLOY_KEY_USAGE: &str = "Usage: agito-deploy-key <repo> list
+       agito-deploy-key <repo> add <public-key> [title]
+       agito-deploy-key <repo> remove <id>
+";
+
+/// Run an `agito-deploy-key` action on a repository the user administers,
+/// returning what to print or why it failed
+fn deploy_key_command(
+    name: &str,
+    repos_dir: &Path,
+    data_dir: &Path,
+    repo_path: &Path,
+    args: &[String],
+    user: Option<&str>,
+) -> std::result::Result<String, String> {
+    let failed = |e: anyhow::Error| format!("{:#}\n", e);
+    match (args.first().map(String::as_str), args.get(1..).unwrap_or_default()) {
+        (Some("list"), []) => {
+            let keys = deploy_keys::list(repo_path).map_err(failed)?;
+            if keys.is_empty() {
+                return Ok(format!("{} has no deploy keys\n", name));
+            }
+            Ok(keys
+                .iter()
+                .map(|key| format!("{}\t{}\t{}\n", key.id, key.fingerprint, key.title))
+                .collect())
+        }
+        (Some("add"), [key, title @ ..]) if title.len() <= 1 => {
+            let title = title.first().map(String::as_str).unwrap_or("");
+            let added = deploy_keys::add(repos_dir, data_dir, repo_path, title, key, user).map_err(failed)?;
+            tracing::info!(repo = %name, user = ?user, "Added deploy key {} ({})", added.id, added.fingerprint);
+            audit::Entry::new(Action::DeployKeyAdd, Via::Ssh, user)
+                .with_repo(name)
+                .with_target(&added.fingerprint)
+                .with_detail(format!("deploy key {} ({})", added.id, added.title))
+                .record(data_dir);
+            Ok(format!("Added deploy key {} to {}: {} {}\n", added.id, name, added.fingerprint, added.title))
+        }
+        (Some("remove"), [id]) => {
+            let id = id.parse().map_err(|_| DEPLOY_KEY_USAGE.to_string())?;
+            let removed = deploy_keys::remove(repo_path, id).map_err(failed)?;
+            tracing::info!(repo = %name, user = ?user, "Removed deploy key {} ({})", removed.id, removed.fingerprint);
+            audit::Entry::new(Action::DeployKeyRemove, Via::Ssh, user)
+                .with_repo(name)
+                .with_target(&removed.fingerprint)
+                .with_detail(format!("deploy key {} ({})", removed.id, removed.title))
+                .record(data_dir);
+            Ok(format!("Removed deploy key {} from {}: {}\n", removed.id, name, removed.title))
+        }
+        _ => Err(DEPLOY_KEY_USAGE.to_string()),
+    }
+}
+
+const REPO_USAGE: &str = "Usage: agito-repo <repo> archive
+       agito-repo <repo> unarchive
+       agito-repo <repo> delete
+       agito-repo <repo> rename <new-name>
+       agito-repo <repo> visibility [public|internal|private]
+       agito-repo <repo> default-branch [<branch>]
+       agito-repo <repo> export|unexport
+       agito-repo <repo> template [on|off]
+       agito-repo <repo> collaborators
+       agito-repo <repo> collaborator add <user> <read|write|admin>
+       agito-repo <repo> collaborator remove <user>
+";
+
+/// Carry out an `agito-repo` command, returning the reply for the client
+fn repo_command(
+    name: &str,
+    limits: &Limits,
+    redirect_days: Option<u64>,
+    args: &[String],
+    user: Option<&str>,
+    peer: &str,
+) -> std::result::Result<String, String> {
+    let (repos_dir, data_dir) = (&limits.repos_dir, &limits.data_dir);
+    if let [action, to] = args {
+        if action == "rename" {
+            let to = limits.place_renamed(user, to, name).map_err(|e| format!("{:#}\n", e))?;
+            let redirect = redirects::rename(repos_dir, data_dir, name, &to, redirect_days)
+                .map_err(|e| format!("{:#}\n", e))?;
+            tracing::info!(repo = %to, user = ?user, "Repository renamed from {}", name);
+            audit::Entry::new(Action::RepoRename, Via::Ssh, user)
+                .with_repo(&to)
+                .with_target(name)
+                .with_detail(format!("renamed from {}", name))
+                .with_remote(Some(peer.to_string()))
+                .record(data_dir);
+            let until = redirect
+                .expires
+                .and_then(|expires| chrono::DateTime::from_timestamp(expires, 0))
+                .map(|t| format!(" until {}", t.format("%Y-%m-%d")))
+                .unwrap_or_default();
+            return Ok(format!(
+                "Renamed {} to {}; the old name keeps working{}, but clones should update their remote\n",
+                name, to, until
+            ));
+        }
+    }
+    if matches!(args, [action] if action == "delete") {
+        let deleted = trash::delete(repos_dir, name, user).map_err(|e| format!("{:#}\n", e))?;
+        tracing::info!(repo = %name, user = ?user, id = %deleted.id, "Repository moved to the trash");
+        audit::Entry::new(Action::RepoDelete, Via::Ssh, user)
+            .with_repo(name)
+            .with_detail(format!("moved to the trash as {}", deleted.id))
+            .with_remote(Some(peer.to_string()))
+            .record(data_dir);
+        return Ok(format!(
+            "Deleted {}; a server admin can restore it from the trash as {}\n",
+            name, deleted.id
+        ));
+    }
+
+    let repo_path = &repos_dir.join(name);
+    if let Some(reply) = access_command(name, repo_path, data_dir, args, user, peer) {
+        return reply;
+    }
+    match args {
+        [action] if action == "default-branch" => {
+            return Ok(format!("{}\n", crate::git::head_branch(repo_path).unwrap_or_default()));
+        }
+        [action, branch] if action == "default-branch" => {
+            if crate::git::head_branch(repo_path).as_deref() == Some(branch.as_str()) {
+                return Ok(format!("{} is already the default branch of {}\n", branch, name));
+            }
+            crate::git::set_head_branch(repo_path, branch).map_err(|e| format!("{:#}\n", e))?;
+            tracing::info!(repo = %name, user = ?user, "Default branch set to {}", branch);
+            audit::Entry::new(Action::RepoSettings, Via::Ssh, user)
+                .with_repo(name)
+                .with_detail(format!("default branch {}", branch))
+                .with_remote(Some(peer.to_string()))
+                .record(data_dir);
+            return Ok(format!("{} is now the default branch of {}\n", branch, name));
+        }
+        _ => {}
+    }
+    let archived = match args {
+        [action] if action == "archive" => true,
+        [action] if action == "unarchive" => false,
+        _ => return Err(REPO_USAGE.to_string()),
+    };
+    if archive::is_archived(repo_path) == archived {
+        return Ok(format!("{} is already {}\n", name, if archived { "archived" } else { "not archived" }));
+    }
+    archive::set(repo_path, archived).map_err(|e| format!("{:#}\n", e))?;
+    let change = if archived { "archived" } else { "unarchived" };
+    tracing::info!(repo = %name, user = ?user, "Repository {}", change);
+    audit::Entry::new(Action::RepoArchive, Via::Ssh, user)
+        .with_repo(name)
+        .with_detail(change)
+        .with_remote(Some(peer.to_string()))
+        .record(data_dir);
+    Ok(if archived {
+        format!("Archived {}; it is now read-only\n", name)
+    } else {
+        format!("Unarchived {}; it takes pushes again\n", name)
+    })
+}
+
+/// Show or change who may use a repository: its visibility and
+/// collaborators. None if `args` are not such a command.
+fn access_command(
+    name: &str,
+    repo_path: &Path,
+    data_dir: &Path,
+    args: &[String],
+    user: Option<&str>,
+    peer: &str,
+) -> Option<std::result::Result<String, String>> {
+    let args: Vec<&str> = args.iter().map(String::as_str).collect();
+    let (detail, reply) = match args.as_slice() {
+        ["visibility"] => {
+            let visibility = visibility::effective(repo_path, orgs::in_org(data_dir, name));
+            return Some(Ok(format!("{}\n", visibility.name())));
+        }
+        ["collaborators"] => {
+            return Some(
+                visibility::collaborators(repo_path)
+                    .map(|collaborators| {
+                        if collaborators.is_empty() {
+                            return format!("{} has no collaborators\n", name);
+                        }
+                        collaborators
+                            .iter()
+                            .map(|(user, role)| format!("{:<20} {}\n", user, role.name()))
+                            .collect()
+                    })
+                    .map_err(|e| format!("{:#}\n", e)),
+            )
+        }
+        ["visibility", value] => {
+            let visibility = match value.parse::<Visibility>() {
+                Ok(visibility) => visibility,
+                Err(e) => return Some(Err(format!("{}\n", e))),
+            };
+            if let Err(e) = visibility::set(repo_path, visibility) {
+                return Some(Err(format!("{:#}\n", e)));
+            }
+            (
+                format!("visibility {}", visibility.name()),
+                format!("{} is now {}\n", name, visibility.name()),
+            )
+        }
+        [action @ ("export" | "unexport")] => {
+            let exported = *action == "export";
+            if let Err(e) = git_daemon::set_exported(repo_path, exported) {
+                return Some(Err(format!("{}\n", e)));
+            }
+            let reply = if !exported {
+                format!("{} is no longer served over git://\n", name)
+            } else if visibility::effective(repo_path, orgs::in_org(data_dir, name)) == Visibility::Public {
+                format!("{} is served over git:// if the server runs the git daemon\n", name)
+            } else {
+                format!("{} is marked for git://, but is only served once it is public\n", name)
+            };
+            (format!("{} over git://", if exported { "exported" } else { "unexported" }), reply)
+        }
+        ["template"] => {
+            let template = templates::is_template(repo_path);
+            return Some(Ok(format!("{}\n", if template { "on" } else { "off" })));
+        }
+        ["template", value @ ("on" | "off")] => {
+            let template = *value == "on";
+            if let Err(e) = templates::set(repo_path, template) {
+                return Some(Err(format!("{:#}\n", e)));
+            }
+            let reply = if template {
+                format!("{} is now a template; create repositories from it with agito create <name> --template {}\n", name, name)
+            } else {
+                format!("{} is no longer a template\n", name)
+            };
+            (format!("template {}", value), reply)
+        }
+        ["collaborator", "add", collaborator, role] => {
+            let role = match role.parse::<Role>() {
+                Ok(role) => role,
+                Err(e) => return Some(Err(format!("{}\n", e))),
+            };
+            if !crate::namespaces::valid_user(collaborator) {
+                return Some(Err(format!("Invalid user name '{}'\n", collaborator)));
+            }
+            if let Err(e) = visibility::set_collaborator(repo_path, collaborator, Some(role)) {
+                return Some(Err(format!("{:#}\n", e)));
+            }
+            (
+                format!("collaborator {} {}", collaborator, role.name()),
+                format!("{} now has {} access to {}\n", collaborator, role.name(), name),
+            )
+        }
+        ["collaborator", "remove", collaborator] => {
+            match visibility::collaborators(repo_path) {
+                Ok(collaborators) if !collaborators.contains_key(*collaborator) => {
+                    return Some(Err(format!("{} is not a collaborator of {}\n", collaborator, name)))
+                }
+                Err(e) => return Some(Err(format!("{:#}\n", e))),
+                Ok(_) => {}
+            }
+            if let Err(e) = visibility::set_collaborator(repo_path, collaborator, None) {
+                return Some(Err(format!("{:#}\n", e)));
+            }
+            (
+                format!("collaborator {} removed", collaborator),
+                format!("Removed {} from the collaborators of {}\n", collaborator, name),
+            )
+        }
+        _ => return None,
+    };
+    tracing::info!(repo = %name, user = ?user, "Repository access changed: {}", detail);
+    audit::Entry::new(Action::RepoAccess, Via::Ssh, user)
+        .with_repo(name)
+        .with_detail(detail)
+        .with_remote(Some(peer.to_string()))
+        .record(data_dir);
+    Some(Ok(reply))
+}
+
+const RELEASE_USAGE: &str = "Usage: agito-release <repo> list
+       agito-release <repo> show <tag>
+       agito-release <repo> create <tag> [title] [notes] [--prerelease] [--draft]
+       agito-release <repo> upload <tag> <file name>   (the file on standard input)
+       agito-release <repo> remove-asset <tag> <file name>
+       agito-release <repo> delete <tag>
+";
+
+/// Run an `agito-release` action on a repository the user may read,
+/// returning what to print or why it failed
+fn release_command(
+    name: &str,
+    repo_path: &Path,
+    args: &[String],
+    user: Option<&str>,
+    writable: bool,
+    data_dir: &Path,
+    peer: &str,
+) -> std::result::Result<String, String> {
+    let action = args.first().map(String::as_str).unwrap_or("");
+    let (flags, args): (Vec<&String>, Vec<&String>) =
+        args.iter().skip(1).partition(|arg| arg.starts_with("--"));
+    let failed = |e: anyhow::Error| format!("{:#}\n", e);
+    let tag = || args.first().map(|tag| tag.as_str()).ok_or_else(|| RELEASE_USAGE.to_string());
+    let shown = |release: Release| {
+        if release.draft && !writable {
+            None
+        } else {
+            Some(release)
+        }
+    };
+    let publish = || -> std::result::Result<&str, String> {
+        let user = user.ok_or_else(|| "Sign in with a registered key to do that\n".to_string())?;
+        if !writable {
+            return Err(format!("You need write access to {} to change its releases\n", name));
+        }
+        if archive::is_archived(repo_path) {
+            return Err(format!("{}\n", archive::refusal(name)));
+        }
+        Ok(user)
+    };
+    let record = |user: &str, tag: &str, change: String| {
+        audit::Entry::new(Action::ReleaseChange, Via::Ssh, Some(user))
+            .with_repo(name)
+            .with_target(tag)
+            .with_detail(change)
+            .with_remote(Some(peer.to_string()))
+            .record(data_dir);
+    };
+
+    match action {
+        "list" => {
+            let found: Vec<Release> =
+                releases::list(repo_path).map_err(failed)?.into_iter().filter_map(shown).collect();
+            if found.is_empty() {
+                return Ok("No releases\n".to_string());
+            }
+            Ok(found
+                .iter()
+                .map(|release| {
+                    let mut kind = String::new();
+                    if release.draft {
+                        kind.push_str(" (draft)");
+                    }
+                    if release.prerelease {
+                        kind.push_str(" (pre-release)");
+                    }
+                    format!(
+                        "{}\t{}{}\t{} assets\n",
+                        release.tag,
+                        release.title(),
+                        kind,
+                        release.assets.len()
+                    )
+                })
+                .collect())
+        }
+        "show" => {
+            let tag = tag()?;
+            let release = releases::get(repo_path, tag)
+                .map_err(failed)?
+                .and_then(shown)
+                .ok_or_else(|| format!("No release of {} in {}\n", tag, name))?;
+            let created = chrono::DateTime::from_timestamp(release.created, 0)
+                .map(|t| t.format("%Y-%m-%d").to_string())
+                .unwrap_or_default();
+            let mut msg = format!(
+                "{} ({})\nBy {} on {}\n",
+                release.title(),
+                release.tag,
+                release.author,
+                created
+            );
+            if !release.body.is_empty() {
+                msg.push_str(&format!("\n{}\n", release.body));
+            }
+            for asset in &release.assets {
+                msg.push_str(&format!(
+                    "\n{}\t{}\tsha256 {}",
+                    asset.name,
+                    crate::usage::format_bytes(asset.size),
+                    asset.sha256
+                ));
+            }
+            if !release.assets.is_empty() {
+                msg.push('\n');
+            }
+            Ok(msg)
+        }
+        "create" => {
+            let user = publish()?;
+            let tag = tag()?;
+            if !releases::tag_exists(repo_path, tag) {
+                return Err(format!("No tag named {} in {}; push it first\n", tag, name));
+            }
+            if releases::get(repo_path, tag).map_err(failed)?.is_some() {
+                return Err(format!("There is already a release of {}\n", tag));
+            }
+            let text = |i: usize| args.get(i).map(|s| s.to_string()).unwrap_or_default();
+            let release = Release {
+                tag: tag.to_string(),
+                name: text(1),
+                body: text(2),
+                author: user.to_string(),
+                created: chrono::Utc::now().timestamp(),
+                prerelease: flags.iter().any(|flag| *flag == "--prerelease"),
+                draft: flags.iter().any(|flag| *flag == "--draft"),
+                assets: Vec::new(),
+            };
+            releases::save(repo_path, release).map_err(failed)?;
+            record(user, tag, "published".to_string());
+            Ok(format!("Published a release of {}\n", tag))
+        }
+        "remove-asset" => {
+            let user = publish()?;
+            let (tag, asset) = match args.as_slice() {
+                [tag, asset] => (tag.as_str(), asset.as_str()),
+                _ => return Err(RELEASE_USAGE.to_string()),
+            };
+            releases::remove_asset(repo_path, tag, asset)
+                .map_err(failed)?
+                .ok_or_else(|| format!("The release of {} has no asset {}\n", tag, asset))?;
+            record(user, tag, format!("removed asset {}", asset));
+            Ok(format!("Removed {} from the release of {}\n", asset, tag))
+        }
+        "delete" => {
+            let user = publish()?;
+            let tag = tag()?;
+            releases::remove(repo_path, tag)
+                .map_err(failed)?
+                .ok_or_else(|| format!("No release of {} in {}\n", tag, name))?;
+            record(user, tag, "deleted".to_string());
+            Ok(format!("Deleted the release of {}; the tag stays\n", tag))
+        }
+        _ => Err(RELEASE_USAGE.to_string()),
+    }
+}
+
+/// Warning for pushers about a push mirror that is failing
+fn mirror_warning(m: &mirror::Mirror, status: &mirror::Status) -> String {
+    let since = status
+        .failing_since
+        .and_then(|since| chrono::DateTime::from_timestamp(since, 0))
+        .map(|t| format!(" since {}", t.format("%Y-%m-%d %H:%M UTC")))
+        .unwrap_or_default();
+    format!(
+        "warning: push mirror {} ({}) has been failing{}: {}\n",
+        m.name,
+        mirror::redact(&m.url),
+        since,
+        status.error.as_deref().unwrap_or("").lines().next().unwrap_or("")
+    )
+}
+
+/// Warning for clients using the old name of a renamed repository
+fn moved_warning(asked: &str, found: &Found) -> String {
+    let when = found
+        .expires
+        .and_then(|expires| chrono::DateTime::from_timestamp(expires, 0))
+        .map(|t| format!("stops working on {}", t.format("%Y-%m-%d")))
+        .unwrap_or_else(|| "is deprecated".to_string());
+    format!(
+        "warning: {} has been renamed to {}; the old name {}.\nwarning: Update your remote with `git remote set-url <remote> <URL ending in {}>`.\n",
+        asked, found.name, when, found.name
+    )
+}
+
+/// Split an exec command into words the way a POSIX shell would for
+/// single-quoted arguments and backslash escapes, which is how clients quote
+/// them
+/// Take `--json` out of a command's arguments, saying whether it was there
+fn take_json(args: &mut Vec<String>) -> bool {
+    let before = args.len();
+    args.retain(|arg| arg != "--json");
+    args.len() != before
+}
+
+/// A reply as a line of JSON, for `--json`
+fn to_json(value: &impl serde::Serialize) -> std::result::Result<String, String> {
+    serde_json::to_string(value)
+        .map(|json| format!("{}\n", json))
+        .map_err(|e| format!("{}\n", e))
+}
+
+fn split_args(command: &str) -> Vec<String> {
+    let mut args = Vec::new();
+    let mut current = None::<String>;
+    let mut quoted = false;
+    let mut chars = command.chars();
+    while let Some(c) = chars.next() {
+        match c {
+            '\\' if !quoted => current.get_or_insert_with(String::new).extend(chars.next()),
+            '\'' => {
+                quoted = !quoted;
+                current.get_or_insert_with(String::new);
+            }
+            c if c.is_whitespace() && !quoted => {
+                if let Some(arg) = current.take() {
+                    args.push(arg);
+                }
+            }
+            c => current.get_or_insert_with(String::new).push(c),
+        }
+    }
+    args.extend(current);
+    args
+}
+
+/// Count the keys in an authorized_keys file, also returning the numbers of
+/// the lines that are neither keys, comments nor blank. A missing file has
+/// no keys.
+pub fn check_authorized_keys(path: &Path) -> Result<(usize, Vec<usize>)> {
+    let content = match fs::read_to_string(path) {
+        Ok(content) => content,
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok((0, Vec::new())),
+        Err(e) => return Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    };
+    let mut keys = 0;
+    let mut invalid = Vec::new();
+    for (number, line) in content.lines().enumerate() {
+        if line.trim().is_empty() || line.starts_with('#') {
+            continue;
+        }
+        match parse_authorized_key(line) {
+            Some(_) => keys += 1,
+            None => invalid.push(number + 1),
+        }
+    }
+    Ok((keys, invalid))
+}
+
+/// Parse an authorized_keys line, `[options] <type> <base64> [comment]`, into
+/// the key and the user it belongs to, given as `environment="AGITO_USER=<name>"`.
+/// A line holding just the base64 key is accepted too.
+fn parse_authorized_key(line: &str) -> Option<(key::PublicKey, Option<String>)> {
+    let line = line.trim();
+    if let Ok(key) = russh_keys::parse_public_key_base64(line) {
+        return Some((key, None));
+    }
+
+    // The base64 key follows the key type; anything before the type is options
+    let fields: Vec<&str> = line.split_whitespace().collect();
+    let (index, key) = fields
+        .iter()
+        .enumerate()
+        .skip(1)
+        .find_map(|(i, field)| Some((i, russh_keys::parse_public_key_base64(field).ok()?)))?;
+    let options = fields[..index - 1].join(" ");
+    let user = options.find("AGITO_USER=").map(|start| {
+        options[start + "AGITO_USER=".len()..]
+            .chars()
+            .take_while(|c| !matches!(c, '"' | ',' | ' '))
+            .collect::<String>()
+    });
+    Some((key, user.filter(|user| crate::namespaces::valid_user(user))))
+}
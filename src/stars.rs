@@ -0,0 +1,109 @@
+//! Stars: users marking repositories they like or want to find again.
+//!
+//! Stars are kept in `<data_dir>/stars.json`, which maps each repository
+//! name to the users who starred it. The index sorts repositories by their
+//! stars, and every user can list the ones they starred.
+
+use crate::notifications;
+use anyhow::{Context, Result};
+use std::collections::{BTreeMap, BTreeSet};
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+
+/// Starring reads and rewrites the whole file, so one change at a time
+static LOCK: Mutex<()> = Mutex::new(());
+
+fn stars_path(data_dir: &Path) -> PathBuf {
+    data_dir.join("stars.json")
+}
+
+fn load(data_dir: &Path) -> Result<BTreeMap<String, BTreeSet<String>>> {
+    let path = stars_path(data_dir);
+    match fs::read_to_string(&path) {
+        Ok(content) => serde_json::from_str(&content)
+            .with_context(|| format!("Failed to parse {}", path.display())),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(BTreeMap::new()),
+        Err(e) => Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    }
+}
+
+fn save(data_dir: &Path, stars: &BTreeMap<String, BTreeSet<String>>) -> Result<()> {
+    fs::create_dir_all(data_dir)?;
+    let path = stars_path(data_dir);
+    let tmp = path.with_extension("json.tmp");
+    fs::write(&tmp, serde_json::to_string_pretty(stars)?)?;
+    fs::rename(&tmp, &path)?;
+    Ok(())
+}
+
+/// Star or unstar a repository for a user; false if nothing changed
+pub fn set(data_dir: &Path, user: &str, repo: &str, starred: bool) -> Result<bool> {
+    if !notifications::valid_username(user) {
+        anyhow::bail!("Invalid user name: {}", user);
+    }
+    let _lock = LOCK.lock().unwrap();
+    let mut stars = load(data_dir)?;
+    let changed = if starred {
+        stars
+            .entry(repo.to_string())
+            .or_default()
+            .insert(user.to_string())
+    } else {
+        let removed = stars
+            .get_mut(repo)
+            .map_or(false, |users| users.remove(user));
+        if stars.get(repo).map_or(false, BTreeSet::is_empty) {
+            stars.remove(repo);
+        }
+        removed
+    };
+    if changed {
+        save(data_dir, &stars)?;
+    }
+    Ok(changed)
+}
+
+pub fn is_starred(data_dir: &Path, user: &str, repo: &str) -> bool {
+    load(data_dir)
+        .ok()
+        .and_then(|stars| stars.get(repo).map(|users| users.contains(user)))
+        .unwrap_or(false)
+}
+
+/// Users who starred a repository, by name
+pub fn stargazers(data_dir: &Path, repo: &str) -> Result<Vec<String>> {
+    Ok(load(data_dir)?
+        .remove(repo)
+        .map(|users| users.into_iter().collect())
+        .unwrap_or_default())
+}
+
+/// Number of stars of every starred repository
+pub fn counts(data_dir: &Path) -> Result<BTreeMap<String, usize>> {
+    Ok(load(data_dir)?
+        .into_iter()
+        .map(|(repo, users)| (repo, users.len()))
+        .collect())
+}
+
+/// Repositories a user starred, by name
+pub fn starred_by(data_dir: &Path, user: &str) -> Result<Vec<String>> {
+    Ok(load(data_dir)?
+        .into_iter()
+        .filter(|(_, users)| users.contains(user))
+        .map(|(repo, _)| repo)
+        .collect())
+}
+
+/// Move the stars of the repository `from` to its new name `to`
+pub fn rename_repo(data_dir: &Path, from: &str, to: &str) -> Result<()> {
+    let _lock = LOCK.lock().unwrap();
+    let mut stars = load(data_dir)?;
+    if let Some(users) = stars.remove(from) {
+        stars.entry(to.to_string()).or_default().extend(users);
+        save(data_dir, &stars)?;
+    }
+    Ok(())
+}
@@ -0,0 +1,258 @@
+//! Statistics of each repository: commits, contributors and languages on its
+//! default branch, branches, tags, size and when it was last active.
+//!
+//! They are kept in `agito/stats.json`, so that the index and repository
+//! pages read one small file instead of running git for every repository on
+//! every view. The server's job ([`spawn`]) checks every repository
+//! periodically and computes its statistics again once its branches or tags
+//! have moved, so they follow pushes shortly after they land. Until a
+//! repository's have been computed, pages do without them.
+
+use crate::languages::{self, Language};
+use crate::{git, jobs, keys, usage};
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::time::Duration;
+
+/// Version of what is computed; statistics of other versions are computed
+/// again
+const VERSION: u32 = 1;
+
+/// The newest commit on the default branch
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct LastCommit {
+    pub id: String,
+    pub subject: String,
+    /// Unix time it was committed
+    pub time: i64,
+}
+
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Stats {
+    #[serde(default)]
+    pub version: u32,
+    /// Digest of the branches and tags the statistics are of
+    pub refs: String,
+    /// Unix time they were computed
+    pub computed: i64,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub default_branch: Option<String>,
+    /// Commits on the default branch
+    pub commits: u64,
+    /// Authors of commits on the default branch, told apart by email
+    pub contributors: u64,
+    pub branches: u64,
+    pub tags: u64,
+    pub size_bytes: u64,
+    /// Unix time of the newest commit on any branch
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub last_activity: Option<i64>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub last_commit: Option<LastCommit>,
+    /// Languages of the default branch's files, most used first
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub languages: Vec<Language>,
+}
+
+impl Stats {
+    /// The language most of the code is in
+    pub fn language(&self) -> Option<&str> {
+        self.languages
+            .first()
+            .map(|language| language.name.as_str())
+    }
+}
+
+fn stats_path(repo_path: &Path) -> PathBuf {
+    git::data_dir(repo_path).join("stats.json")
+}
+
+/// The repository's statistics as last computed, if they have been
+pub fn get(repo_path: &Path) -> Option<Stats> {
+    let content = fs::read_to_string(stats_path(repo_path)).ok()?;
+    serde_json::from_str(&content).ok()
+}
+
+/// The repository's branches and tags: a digest of their names and
+/// targets and of the default branch, how many there are of each, and the
+/// newest commit date of the branches
+struct Refs {
+    digest: String,
+    branches: u64,
+    tags: u64,
+    last_activity: Option<i64>,
+}
+
+fn refs(repo_path: &Path) -> Result<Refs> {
+    let output = git::run(
+        repo_path,
+        &[
+            "for-each-ref",
+            "--format=%(objectname) %(refname)%00%(committerdate:unix)",
+            "refs/heads",
+            "refs/tags",
+        ],
+    )?;
+    if !output.status.success() {
+        anyhow::bail!("Failed to list refs");
+    }
+    let mut hasher = Sha256::new();
+    let mut refs = Refs {
+        digest: String::new(),
+        branches: 0,
+        tags: 0,
+        last_activity: None,
+    };
+    for line in String::from_utf8_lossy(&output.stdout).lines() {
+        let (target, date) = line.split_once('\0').unwrap_or((line, ""));
+        hasher.update(target.as_bytes());
+        hasher.update(b"\n");
+        let refname = target.split_once(' ').map_or("", |(_, refname)| refname);
+        if refname.starts_with("refs/heads/") {
+            refs.branches += 1;
+            if let Ok(date) = date.parse::<i64>() {
+                refs.last_activity = refs.last_activity.max(Some(date));
+            }
+        } else {
+            refs.tags += 1;
+        }
+    }
+    // A new default branch changes what is counted
+    hasher.update(git::head_branch(repo_path).unwrap_or_default().as_bytes());
+    refs.digest = keys::hex(&hasher.finalize());
+    Ok(refs)
+}
+
+/// Whether the repository's branches, tags or default branch changed since
+/// its statistics were computed, or they never were
+pub fn is_stale(repo_path: &Path) -> bool {
+    match (get(repo_path), refs(repo_path)) {
+        (Some(stats), Ok(refs)) => stats.version != VERSION || stats.refs != refs.digest,
+        (None, _) => true,
+        (_, Err(_)) => false,
+    }
+}
+
+/// Run git and return its trimmed output, or None if it fails
+fn git_output(repo_path: &Path, args: &[&str]) -> Option<String> {
+    let output = git::run(repo_path, args).ok()?;
+    if !output.status.success() {
+        return None;
+    }
+    Some(String::from_utf8_lossy(&output.stdout).trim().to_string())
+}
+
+/// Work out the repository's statistics
+pub fn compute(repo_path: &Path) -> Result<Stats> {
+    let refs = refs(repo_path)?;
+    let default_branch = git::head_branch(repo_path);
+    let branch_ref = default_branch
+        .as_ref()
+        .map(|branch| format!("refs/heads/{}", branch))
+        .filter(|branch_ref| {
+            git_output(repo_path, &["rev-parse", "--verify", "--quiet", branch_ref]).is_some()
+        });
+
+    let (commits, contributors, last_commit) = match &branch_ref {
+        Some(branch_ref) => {
+            let commits = git_output(repo_path, &["rev-list", "--count", branch_ref, "--"])
+                .and_then(|count| count.parse().ok())
+                .unwrap_or(0);
+            let contributors = git_output(
+                repo_path,
+                &["shortlog", "--summary", "--email", branch_ref, "--"],
+            )
+            .map_or(0, |output| output.lines().count() as u64);
+            let last_commit = git_output(
+                repo_path,
+                &["log", "-1", "--format=%H%x1f%ct%x1f%s", branch_ref, "--"],
+            )
+            .and_then(|line| {
+                let mut fields = line.splitn(3, '\x1f');
+                Some(LastCommit {
+                    id: fields.next()?.to_string(),
+                    time: fields.next()?.parse().ok()?,
+                    subject: fields.next().unwrap_or_default().to_string(),
+                })
+            });
+            (commits, contributors, last_commit)
+        }
+        None => (0, 0, None),
+    };
+
+    // Languages only change with the default branch
+    let languages = match (&last_commit, get(repo_path)) {
+        (Some(commit), Some(previous))
+            if previous.version == VERSION
+                && previous.last_commit.as_ref() == Some(commit)
+                && !previous.languages.is_empty() =>
+        {
+            previous.languages
+        }
+        (Some(commit), _) => languages::detect(repo_path, &commit.id).unwrap_or_default(),
+        (None, _) => Vec::new(),
+    };
+
+    Ok(Stats {
+        version: VERSION,
+        refs: refs.digest,
+        computed: chrono::Utc::now().timestamp(),
+        default_branch,
+        commits,
+        contributors,
+        branches: refs.branches,
+        tags: refs.tags,
+        size_bytes: usage::scan_repo(repo_path).map_or(0, |usage| usage.bytes),
+        last_activity: refs.last_activity,
+        last_commit,
+        languages,
+    })
+}
+
+/// Compute the repository's statistics and store them
+pub fn update(repo_path: &Path) -> Result<Stats> {
+    let stats = compute(repo_path)?;
+    let path = stats_path(repo_path);
+    if let Some(dir) = path.parent() {
+        fs::create_dir_all(dir)?;
+    }
+    let tmp = path.with_extension("json.tmp");
+    fs::write(&tmp, serde_json::to_string_pretty(&stats)?)?;
+    fs::rename(&tmp, &path).with_context(|| format!("Failed to write {}", path.display()))?;
+    Ok(stats)
+}
+
+/// Compute the statistics of repositories whose refs moved since they were
+/// last computed, returning how many were
+pub fn update_all(repos_dir: &Path) -> Result<usize> {
+    let mut updated = 0;
+    for (name, repo_path) in git::find_repositories(repos_dir)? {
+        if !is_stale(&repo_path) {
+            continue;
+        }
+        match update(&repo_path) {
+            Ok(stats) => {
+                updated += 1;
+                tracing::debug!(
+                    repo = %name,
+                    commits = stats.commits,
+                    "Computed repository statistics"
+                );
+            }
+            Err(e) => tracing::warn!(repo = %name, "Failed to compute statistics: {:#}", e),
+        }
+    }
+    Ok(updated)
+}
+
+/// Keep every repository's statistics up to date, checking every
+/// `interval`
+pub fn spawn(repos_dir: PathBuf, interval: Duration) -> tokio::task::JoinHandle<()> {
+    jobs::spawn_periodic("stats", interval, move || {
+        update_all(&repos_dir)?;
+        Ok(())
+    })
+}
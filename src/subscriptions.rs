@@ -0,0 +1,503 @@
+//! Email notifications for accounts subscribed to a repository.
+//!
+//! Each user picks, per repository, what is mailed to their account's
+//! address: pushes to branches matching some patterns, new issues, and pull
+//! request activity. Subscriptions are kept in
+//! `<data_dir>/subscriptions/<user>.json`.
+//!
+//! Issues and pull requests append their activity to the repository's
+//! `agito/mail/activity.jsonl`; pushes come from the event stream. The server
+//! mails both to subscribers who may still read the repository, and keeps
+//! the last of each it mailed in `agito/mail/cursor`. Nobody is mailed about
+//! what they did themselves.
+
+use crate::events::{self, RefUpdate};
+use crate::mail::Mailer;
+use crate::{git, notifications, orgs, users, watch};
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeSet;
+use std::fs::{self, OpenOptions};
+use std::io::{self, Write};
+use std::path::{Path, PathBuf};
+
+/// Activity kept per repository; older entries are dropped
+const MAX_ACTIVITY: usize = 1000;
+
+/// Longest excerpt of an issue, pull request or comment in a mail
+const MAX_TEXT: usize = 4000;
+
+/// What a user wants mailed about one repository
+#[derive(Clone, Debug, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Subscription {
+    /// Repository name relative to the repositories directory
+    pub repo: String,
+    /// Patterns of the branches whose pushes are mailed, see
+    /// [`events::ref_matches`]
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub branches: Vec<String>,
+    /// Mail new issues
+    #[serde(default)]
+    pub issues: bool,
+    /// Mail pull requests opened, commented on, updated, closed or merged
+    #[serde(default)]
+    pub pulls: bool,
+}
+
+impl Subscription {
+    /// Watching a repository: pushes to every branch, issues and pull
+    /// requests
+    pub fn everything(repo: &str) -> Self {
+        Self {
+            repo: repo.to_string(),
+            branches: vec!["*".to_string()],
+            issues: true,
+            pulls: true,
+        }
+    }
+
+    pub fn is_everything(&self) -> bool {
+        self.branches.iter().any(|pattern| pattern == "*") && self.issues && self.pulls
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.branches.is_empty() && !self.issues && !self.pulls
+    }
+
+    /// Whether a push to `refname` is mailed
+    pub fn wants_push(&self, refname: &str) -> bool {
+        refname.starts_with("refs/heads/")
+            && self
+                .branches
+                .iter()
+                .any(|pattern| events::ref_matches(pattern, refname))
+    }
+
+    pub fn wants(&self, activity: &Activity) -> bool {
+        match activity.kind {
+            Kind::Issue => self.issues,
+            Kind::PullRequest => self.pulls,
+        }
+    }
+}
+
+/// Branch patterns from a comma- or whitespace-separated list
+pub fn parse_branches(list: &str) -> Vec<String> {
+    list.split(|c: char| c == ',' || c.is_whitespace())
+        .map(|pattern| pattern.trim().trim_start_matches("refs/heads/"))
+        .filter(|pattern| !pattern.is_empty())
+        .map(str::to_string)
+        .collect()
+}
+
+fn subscriptions_dir(data_dir: &Path) -> PathBuf {
+    data_dir.join("subscriptions")
+}
+
+fn subscriptions_path(data_dir: &Path, user: &str) -> Result<PathBuf> {
+    if !notifications::valid_username(user) {
+        anyhow::bail!("Invalid user name: {}", user);
+    }
+    Ok(subscriptions_dir(data_dir).join(format!("{}.json", user)))
+}
+
+/// A user's subscriptions
+pub fn list(data_dir: &Path, user: &str) -> Result<Vec<Subscription>> {
+    let path = subscriptions_path(data_dir, user)?;
+    match fs::read_to_string(&path) {
+        Ok(content) => serde_json::from_str(&content)
+            .with_context(|| format!("Failed to parse {}", path.display())),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(Vec::new()),
+        Err(e) => Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    }
+}
+
+/// A user's subscription to one repository, if any
+pub fn get(data_dir: &Path, user: &str, repo: &str) -> Result<Option<Subscription>> {
+    Ok(list(data_dir, user)?.into_iter().find(|s| s.repo == repo))
+}
+
+/// Replace a user's subscription to a repository; one that asks for
+/// nothing unsubscribes
+pub fn set(data_dir: &Path, user: &str, subscription: Subscription) -> Result<()> {
+    let mut subscriptions = list(data_dir, user)?;
+    subscriptions.retain(|s| s.repo != subscription.repo);
+    if !subscription.is_empty() {
+        subscriptions.push(subscription);
+        subscriptions.sort_by(|a, b| a.repo.cmp(&b.repo));
+    }
+
+    let path = subscriptions_path(data_dir, user)?;
+    fs::create_dir_all(subscriptions_dir(data_dir))?;
+    let tmp = path.with_extension("json.tmp");
+    fs::write(&tmp, serde_json::to_string_pretty(&subscriptions)?)?;
+    fs::rename(&tmp, &path)?;
+    Ok(())
+}
+
+/// Move every user's subscription to the repository `from` to its new name
+/// `to`
+pub fn rename_repo(data_dir: &Path, from: &str, to: &str) -> Result<()> {
+    for (user, subscription) in all(data_dir)? {
+        if subscription.repo != from {
+            continue;
+        }
+        set(
+            data_dir,
+            &user,
+            Subscription {
+                repo: to.to_string(),
+                ..subscription
+            },
+        )?;
+        // Asking for nothing drops the old one
+        set(
+            data_dir,
+            &user,
+            Subscription {
+                repo: from.to_string(),
+                ..Default::default()
+            },
+        )?;
+    }
+    Ok(())
+}
+
+/// Every user's subscriptions, as (user, subscription)
+pub fn all(data_dir: &Path) -> Result<Vec<(String, Subscription)>> {
+    let entries = match fs::read_dir(subscriptions_dir(data_dir)) {
+        Ok(entries) => entries,
+        Err(e) if e.kind() == io::ErrorKind::NotFound => return Ok(Vec::new()),
+        Err(e) => return Err(e).context("Failed to read subscriptions"),
+    };
+    let mut found = Vec::new();
+    for entry in entries {
+        let name = entry?.file_name().to_string_lossy().to_string();
+        let Some(user) = name.strip_suffix(".json") else {
+            continue;
+        };
+        for subscription in list(data_dir, user)? {
+            found.push((user.to_string(), subscription));
+        }
+    }
+    found.sort_by(|a, b| (&a.1.repo, &a.0).cmp(&(&b.1.repo, &b.0)));
+    Ok(found)
+}
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Kind {
+    Issue,
+    PullRequest,
+}
+
+impl Kind {
+    fn label(self) -> &'static str {
+        match self {
+            Self::Issue => "issue",
+            Self::PullRequest => "pull request",
+        }
+    }
+
+    fn path(self) -> &'static str {
+        match self {
+            Self::Issue => "issues",
+            Self::PullRequest => "pulls",
+        }
+    }
+}
+
+/// Something that happened to an issue or pull request
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Activity {
+    /// Increases by one with every activity in the repository
+    pub id: u64,
+    /// Unix time
+    pub time: i64,
+    pub kind: Kind,
+    pub number: u64,
+    pub title: String,
+    /// opened, commented, closed, reopened, merged or synchronize
+    pub action: String,
+    /// Who did it, if known
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub actor: Option<String>,
+    /// The description or comment, if any
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub text: String,
+}
+
+fn mail_dir(repo_path: &Path) -> PathBuf {
+    git::data_dir(repo_path).join("mail")
+}
+
+fn activity_path(repo_path: &Path) -> PathBuf {
+    mail_dir(repo_path).join("activity.jsonl")
+}
+
+fn cursor_path(repo_path: &Path) -> PathBuf {
+    mail_dir(repo_path).join("cursor")
+}
+
+/// Every recorded activity, oldest first
+pub fn activity(repo_path: &Path) -> Vec<Activity> {
+    fs::read_to_string(activity_path(repo_path))
+        .map(|content| {
+            content
+                .lines()
+                .filter_map(|line| serde_json::from_str(line).ok())
+                .collect()
+        })
+        .unwrap_or_default()
+}
+
+/// Append to the repository's activity for subscribers. Failures are
+/// logged, as they must not fail the change itself.
+pub fn record(
+    repo_path: &Path,
+    kind: Kind,
+    number: u64,
+    title: &str,
+    action: &str,
+    actor: Option<&str>,
+    text: &str,
+) {
+    if let Err(e) = append(repo_path, kind, number, title, action, actor, text) {
+        tracing::warn!(
+            "Failed to record {} #{} for subscribers: {:#}",
+            kind.label(),
+            number,
+            e
+        );
+    }
+}
+
+fn append(
+    repo_path: &Path,
+    kind: Kind,
+    number: u64,
+    title: &str,
+    action: &str,
+    actor: Option<&str>,
+    text: &str,
+) -> Result<()> {
+    let mut all = activity(repo_path);
+    let mut text = text.trim_end().to_string();
+    if text.len() > MAX_TEXT {
+        let mut end = MAX_TEXT;
+        while !text.is_char_boundary(end) {
+            end -= 1;
+        }
+        text.truncate(end);
+        text.push_str("\n...");
+    }
+    let entry = Activity {
+        id: all.last().map_or(1, |last| last.id + 1),
+        time: chrono::Utc::now().timestamp(),
+        kind,
+        number,
+        title: title.to_string(),
+        action: action.to_string(),
+        actor: actor.map(str::to_string),
+        text,
+    };
+
+    let path = activity_path(repo_path);
+    fs::create_dir_all(mail_dir(repo_path))?;
+    // Rewrite the whole file only once it is well past the limit
+    if all.len() >= MAX_ACTIVITY * 2 {
+        all.push(entry);
+        let keep = all.split_off(all.len() - MAX_ACTIVITY);
+        let mut lines = String::new();
+        for entry in &keep {
+            lines.push_str(&serde_json::to_string(entry)?);
+            lines.push('\n');
+        }
+        let tmp = path.with_extension("jsonl.tmp");
+        fs::write(&tmp, lines)?;
+        fs::rename(&tmp, &path)?;
+    } else {
+        let mut line = serde_json::to_string(&entry)?;
+        line.push('\n');
+        OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(&path)?
+            .write_all(line.as_bytes())?;
+    }
+    Ok(())
+}
+
+/// Last push event and activity mailed for a repository
+#[derive(Clone, Copy, Debug, Default, Serialize, Deserialize)]
+struct Cursor {
+    events: u64,
+    activity: u64,
+}
+
+fn cursor(repo_path: &Path) -> Option<Cursor> {
+    fs::read_to_string(cursor_path(repo_path))
+        .ok()
+        .and_then(|content| serde_json::from_str(&content).ok())
+}
+
+fn set_cursor(repo_path: &Path, cursor: Cursor) -> Result<()> {
+    fs::create_dir_all(mail_dir(repo_path))?;
+    fs::write(cursor_path(repo_path), serde_json::to_string(&cursor)?)?;
+    Ok(())
+}
+
+/// Footer of every mail, saying why it was sent and where to change that
+fn footer(repo: &str, what: &str, public_url: &str) -> String {
+    format!(
+        "You receive this because you subscribed to {} in {}.\nChange your subscription at {}/repo/{}/subscription\n",
+        what,
+        repo,
+        public_url.trim_end_matches('/'),
+        repo
+    )
+}
+
+/// Subject and plain-text body of the mail for a push
+pub fn render_push(
+    repo: &str,
+    repo_path: &Path,
+    event: &RefUpdate,
+    public_url: &str,
+) -> (String, String) {
+    let (subject, mut body) = watch::describe(repo, repo_path, event);
+    body.push_str(&footer(repo, "pushes to some branches", public_url));
+    (subject, body)
+}
+
+/// Subject and plain-text body of the mail for an issue or pull request
+/// activity
+pub fn render_activity(repo: &str, activity: &Activity, public_url: &str) -> (String, String) {
+    let subject = format!(
+        "[agito] {} {}#{}: {}",
+        repo,
+        if activity.kind == Kind::PullRequest {
+            "PR "
+        } else {
+            ""
+        },
+        activity.number,
+        activity.title
+    );
+    let what = match activity.action.as_str() {
+        "commented" => "commented on",
+        "synchronize" => "pushed new commits to",
+        action => action,
+    };
+    let mut body = format!(
+        "{} {} {} #{} in {}: {}\n\n",
+        activity.actor.as_deref().unwrap_or("Someone"),
+        what,
+        activity.kind.label(),
+        activity.number,
+        repo,
+        activity.title
+    );
+    if !activity.text.is_empty() {
+        body.push_str(&activity.text);
+        body.push_str("\n\n");
+    }
+    body.push_str(&format!(
+        "{}/repo/{}/{}/{}\n\n",
+        public_url.trim_end_matches('/'),
+        repo,
+        activity.kind.path(),
+        activity.number
+    ));
+    body.push_str(&footer(
+        repo,
+        match activity.kind {
+            Kind::Issue => "new issues",
+            Kind::PullRequest => "pull request activity",
+        },
+        public_url,
+    ));
+    (subject, body)
+}
+
+/// Mail subscribers what happened since the last run. A repository gaining
+/// its first subscriber starts from its latest push and activity rather
+/// than mailing its history. Returns the number of mails sent.
+pub fn deliver(
+    repos_dir: &Path,
+    data_dir: &Path,
+    mailer: &Mailer,
+    public_url: &str,
+) -> Result<usize> {
+    let subscriptions = all(data_dir)?;
+    let repos: BTreeSet<&str> = subscriptions.iter().map(|(_, s)| s.repo.as_str()).collect();
+    let accounts = users::load(data_dir)?;
+    let mut sent = 0;
+
+    for repo in repos {
+        let repo_path = repos_dir.join(repo);
+        if !git::is_repository(&repo_path) {
+            continue;
+        }
+        let mut position = match cursor(&repo_path) {
+            Some(position) => position,
+            None => {
+                set_cursor(
+                    &repo_path,
+                    Cursor {
+                        events: events::latest_id(&repo_path),
+                        activity: activity(&repo_path).last().map_or(0, |last| last.id),
+                    },
+                )?;
+                continue;
+            }
+        };
+
+        // Active accounts with an address that may still read the repository
+        let recipients: Vec<(&str, &str, &Subscription)> = subscriptions
+            .iter()
+            .filter(|(_, s)| s.repo == repo)
+            .filter_map(|(user, s)| {
+                let account = accounts.get(user).filter(|a| a.is_active())?;
+                orgs::role(data_dir, repos_dir, repo, Some(user))?;
+                Some((user.as_str(), account.email.as_str(), s))
+            })
+            .filter(|(_, email, _)| email.contains('@'))
+            .collect();
+        let mut send = |to: &str, subject: &str, body: &str| match mailer.send(to, subject, body) {
+            Ok(()) => sent += 1,
+            Err(e) => tracing::warn!("Failed to mail subscriber {}: {:#}", to, e),
+        };
+
+        for event in events::since(&repo_path, position.events) {
+            let mut rendered = None;
+            for (user, email, _) in recipients.iter().filter(|(user, _, s)| {
+                s.wants_push(&event.refname) && event.pusher.as_deref() != Some(user)
+            }) {
+                let (subject, body) = rendered
+                    .get_or_insert_with(|| render_push(repo, &repo_path, &event, public_url));
+                tracing::debug!(repo, user, "Mailing push to {}", event.refname);
+                send(email, subject, body);
+            }
+            position.events = event.id;
+            set_cursor(&repo_path, position)?;
+        }
+
+        let seen = position.activity;
+        for entry in activity(&repo_path)
+            .into_iter()
+            .filter(|entry| entry.id > seen)
+        {
+            let (subject, body) = render_activity(repo, &entry, public_url);
+            for (_, email, _) in recipients
+                .iter()
+                .filter(|(user, _, s)| s.wants(&entry) && entry.actor.as_deref() != Some(user))
+            {
+                send(email, &subject, &body);
+            }
+            position.activity = entry.id;
+            set_cursor(&repo_path, position)?;
+        }
+    }
+    Ok(sent)
+}
@@ -0,0 +1,146 @@
+//! `agito sync`: copy a collection of local repositories to the server,
+//! creating those it doesn't have yet and pushing every branch and tag.
+//!
+//! The repositories are the ones directly in a directory, working copies
+//! and bare ones alike, or those listed in a manifest: one per line, its
+//! path (relative to the manifest) and optionally the name to give it on the
+//! server, with `#` starting comments. Branches and tags are only ever added
+//! or moved forward; nothing on the server is deleted, and branches that
+//! diverged are reported rather than overwritten.
+
+use crate::git;
+use anyhow::{Context, Result};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+
+/// A local repository and the name it has on the server
+pub struct Entry {
+    pub path: PathBuf,
+    pub name: String,
+}
+
+/// What syncing one repository did
+pub struct Synced {
+    /// The name the server has it under
+    pub name: String,
+    pub created: bool,
+    /// Refs created or moved on the server
+    pub updated: usize,
+    /// Refs the server refused, with why
+    pub rejected: Vec<String>,
+}
+
+/// The repositories directly in `dir`
+pub fn walk(dir: &Path) -> Result<Vec<Entry>> {
+    let mut entries = Vec::new();
+    for entry in fs::read_dir(dir).with_context(|| format!("Failed to read {}", dir.display()))? {
+        let path = entry?.path();
+        let file_name = path
+            .file_name()
+            .unwrap_or_default()
+            .to_string_lossy()
+            .to_string();
+        if !path.is_dir() || file_name.starts_with('.') {
+            continue;
+        }
+        if path.join(".git").exists() || git::is_repository(&path) {
+            entries.push(Entry {
+                name: file_name.trim_end_matches(".git").to_string(),
+                path,
+            });
+        }
+    }
+    entries.sort_by(|a, b| a.name.cmp(&b.name));
+    Ok(entries)
+}
+
+/// The repositories a manifest lists
+pub fn read_manifest(manifest: &Path) -> Result<Vec<Entry>> {
+    let content = fs::read_to_string(manifest)
+        .with_context(|| format!("Failed to read {}", manifest.display()))?;
+    let base = manifest.parent().unwrap_or(Path::new("."));
+    let mut entries = Vec::new();
+    for (number, line) in content.lines().enumerate() {
+        let line = line.split('#').next().unwrap_or("").trim();
+        let mut fields = line.split_whitespace();
+        let path = match fields.next() {
+            Some(path) => base.join(path),
+            None => continue,
+        };
+        let name = match fields.next() {
+            Some(name) => name.to_string(),
+            None => path
+                .file_name()
+                .map(|name| name.to_string_lossy().trim_end_matches(".git").to_string())
+                .with_context(|| {
+                    format!("{}:{}: no repository name", manifest.display(), number + 1)
+                })?,
+        };
+        if fields.next().is_some() {
+            anyhow::bail!(
+                "{}:{}: expected a path and optionally a name",
+                manifest.display(),
+                number + 1
+            );
+        }
+        entries.push(Entry { path, name });
+    }
+    Ok(entries)
+}
+
+/// Create the repository on the server if it isn't there yet, then push its
+/// branches and tags
+pub fn sync(server: &str, user: &str, entry: &Entry, visibility: Option<&str>) -> Result<Synced> {
+    if !entry.path.is_dir() {
+        anyhow::bail!("{} does not exist", entry.path.display());
+    }
+    let (name, created) =
+        match git::create_remote_repo(server, user, &entry.name, visibility, None, false) {
+            Ok(repo) => (repo.name, true),
+            Err(e) => match e.to_string().strip_prefix("Repository already exists: ") {
+                Some(name) => (name.trim().to_string(), false),
+                None => return Err(e),
+            },
+        };
+
+    let url = format!("ssh://{}@{}/{}", user, server, name);
+    let output = Command::new("git")
+        .arg("-C")
+        .arg(&entry.path)
+        .args(["push", "--porcelain", &url])
+        .args(["refs/heads/*:refs/heads/*", "refs/tags/*:refs/tags/*"])
+        .output()
+        .context("Failed to run git push")?;
+
+    // Lines are "<flag>\t<from>:<to>\t<summary>"; `=` is up to date and `!`
+    // rejected
+    let stdout = String::from_utf8_lossy(&output.stdout);
+    let mut synced = Synced {
+        name,
+        created,
+        updated: 0,
+        rejected: Vec::new(),
+    };
+    for line in stdout.lines() {
+        let mut fields = line.split('\t');
+        let (flag, refs, summary) = match (fields.next(), fields.next(), fields.next()) {
+            (Some(flag), Some(refs), summary) => (flag, refs, summary.unwrap_or("")),
+            _ => continue,
+        };
+        let to = refs.rsplit(':').next().unwrap_or(refs);
+        match flag {
+            "=" => {}
+            "!" => synced.rejected.push(format!("{} ({})", to, summary)),
+            _ => synced.updated += 1,
+        }
+    }
+    if !output.status.success() && synced.rejected.is_empty() {
+        let stderr = String::from_utf8_lossy(&output.stderr);
+        anyhow::bail!(
+            "push failed: {}",
+            stderr.lines().last().unwrap_or("git push failed").trim()
+        );
+    }
+    Ok(synced)
+}
@@ -0,0 +1,140 @@
+use anyhow::Result;
+use axum::http::HeaderMap;
+use opentelemetry::propagation::{Extractor, TextMapPropagator};
+use opentelemetry::KeyValue;
+use opentelemetry_otlp::WithExportConfig;
+use opentelemetry_sdk::propagation::TraceContextPropagator;
+use opentelemetry_sdk::{trace, Resource};
+use std::str::FromStr;
+use tracing_opentelemetry::OpenTelemetrySpanExt;
+use tracing_subscriber::{layer::SubscriberExt, util::SubscriberInitExt, EnvFilter, Layer};
+
+/// Output format of the server log
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq)]
+pub enum LogFormat {
+    /// Human-readable lines, with the fields of enclosing spans in front
+    #[default]
+    Text,
+    /// One JSON object per event, with its fields and those of its spans, for
+    /// log aggregators
+    Json,
+}
+
+impl LogFormat {
+    pub fn name(self) -> &'static str {
+        match self {
+            LogFormat::Text => "text",
+            LogFormat::Json => "json",
+        }
+    }
+}
+
+impl FromStr for LogFormat {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "text" => Ok(LogFormat::Text),
+            "json" => Ok(LogFormat::Json),
+            _ => Err(format!(
+                "unknown log format '{}' (expected text or json)",
+                s
+            )),
+        }
+    }
+}
+
+/// Install the global tracing subscriber.
+///
+/// `level` is a filter such as `debug` or `info,agito::ssh=debug`; without it
+/// `RUST_LOG` applies, defaulting to `info`. When an OTLP endpoint is given,
+/// spans are additionally exported over gRPC to a collector such as Jaeger,
+/// Tempo or the OpenTelemetry Collector, and HTTP requests carrying a W3C
+/// `traceparent` header continue the caller's trace.
+pub fn init(
+    service_name: &str,
+    otlp_endpoint: Option<&str>,
+    format: LogFormat,
+    level: Option<&str>,
+) -> Result<()> {
+    let filter = match level {
+        Some(level) => EnvFilter::try_new(level)?,
+        None => EnvFilter::try_from_default_env().unwrap_or_else(|_| EnvFilter::new("info")),
+    };
+    let output = match format {
+        LogFormat::Text => tracing_subscriber::fmt::layer().boxed(),
+        LogFormat::Json => tracing_subscriber::fmt::layer()
+            .json()
+            .with_current_span(false)
+            .with_span_list(true)
+            .boxed(),
+    };
+    let registry = tracing_subscriber::registry().with(filter).with(output);
+
+    match otlp_endpoint {
+        Some(endpoint) => {
+            opentelemetry::global::set_text_map_propagator(TraceContextPropagator::new());
+            let tracer = opentelemetry_otlp::new_pipeline()
+                .tracing()
+                .with_exporter(
+                    opentelemetry_otlp::new_exporter()
+                        .tonic()
+                        .with_endpoint(endpoint),
+                )
+                .with_trace_config(trace::config().with_resource(Resource::new(vec![
+                    KeyValue::new("service.name", service_name.to_string()),
+                ])))
+                .install_batch(opentelemetry_sdk::runtime::Tokio)?;
+
+            registry
+                .with(tracing_opentelemetry::layer().with_tracer(tracer))
+                .init();
+            tracing::info!("Exporting traces to {}", endpoint);
+        }
+        None => registry.init(),
+    }
+
+    Ok(())
+}
+
+/// A random ID tying together the log lines of one HTTP request or SSH session
+pub fn new_id() -> String {
+    match crate::keys::random_bytes(8) {
+        Ok(bytes) => crate::keys::hex(&bytes),
+        Err(_) => format!(
+            "{:016x}",
+            chrono::Utc::now().timestamp_nanos_opt().unwrap_or_default()
+        ),
+    }
+}
+
+/// Reads trace context from HTTP request headers
+struct HeaderExtractor<'a>(&'a HeaderMap);
+
+impl Extractor for HeaderExtractor<'_> {
+    fn get(&self, key: &str) -> Option<&str> {
+        self.0.get(key).and_then(|value| value.to_str().ok())
+    }
+
+    fn keys(&self) -> Vec<&str> {
+        self.0.keys().map(|name| name.as_str()).collect()
+    }
+}
+
+/// Make `span` part of the trace a caller, such as a proxy or a CI job,
+/// started, if the request names one in its `traceparent` header; without
+/// an OTLP endpoint this does nothing
+pub fn continue_trace(span: &tracing::Span, headers: &HeaderMap) {
+    if !headers.contains_key("traceparent") {
+        return;
+    }
+    let context = opentelemetry::global::get_text_map_propagator(|propagator| {
+        propagator.extract(&HeaderExtractor(headers))
+    });
+    span.set_parent(context);
+}
+
+/// Flush spans that are still buffered for export
+pub fn shutdown() {
+    opentelemetry::global::shutdown_tracer_provider();
+}
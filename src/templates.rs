@@ -0,0 +1,265 @@
+//! Template repositories: project scaffolding a new repository can start
+//! from.
+//!
+//! A template has `agito.template = true` in its git config. Creating a
+//! repository from one gives it a single commit with the files on the
+//! template's default branch, with `{{project_name}}`, `{{owner}}` and
+//! `{{year}}` expanded in text files and in paths. Its own hooks and legacy
+//! `agito-ci.sh` can come along too; `.agito-ci.yml` is a file in the tree
+//! and always does.
+
+use crate::git;
+use crate::merge::Identity;
+use anyhow::{Context, Result};
+use std::fs;
+use std::io::Write;
+use std::path::Path;
+use std::process::{Command, Stdio};
+
+const CONFIG_KEY: &str = "agito.template";
+
+/// Files larger than this are copied as they are, without expanding
+/// placeholders
+const MAX_EXPAND_BYTES: usize = 1024 * 1024;
+
+pub fn is_template(repo_path: &Path) -> bool {
+    git::config_get(repo_path, CONFIG_KEY).as_deref() == Some("true")
+}
+
+/// Mark a repository as a template, or stop offering it as one
+pub fn set(repo_path: &Path, template: bool) -> Result<()> {
+    let output = if template {
+        git::run(repo_path, &["config", CONFIG_KEY, "true"])?
+    } else {
+        if git::config_get(repo_path, CONFIG_KEY).is_none() {
+            return Ok(());
+        }
+        git::run(repo_path, &["config", "--unset-all", CONFIG_KEY])?
+    };
+    if !output.status.success() {
+        anyhow::bail!(
+            "Failed to update {}: {}",
+            CONFIG_KEY,
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(())
+}
+
+/// What placeholders in a template expand to
+pub struct Vars {
+    /// `{{project_name}}`: the new repository's name, without its namespace
+    /// or `.git`
+    pub project_name: String,
+    /// `{{owner}}`: its namespace, or the user creating it at the top level
+    pub owner: String,
+    /// `{{year}}`: the current year
+    pub year: String,
+}
+
+impl Vars {
+    /// The placeholders for repository `name` created by `user`
+    pub fn new(name: &str, user: Option<&str>) -> Self {
+        let name = name.trim_end_matches(".git");
+        let (owner, project_name) = match name.rsplit_once('/') {
+            Some((namespace, project)) => (namespace.to_string(), project.to_string()),
+            None => (user.unwrap_or_default().to_string(), name.to_string()),
+        };
+        Self {
+            project_name,
+            owner,
+            year: chrono::Utc::now().format("%Y").to_string(),
+        }
+    }
+
+    fn expand(&self, text: &str) -> String {
+        text.replace("{{project_name}}", &self.project_name)
+            .replace("{{owner}}", &self.owner)
+            .replace("{{year}}", &self.year)
+    }
+
+    /// Expand placeholders in a file, leaving binary and very large files
+    /// alone
+    fn expand_bytes(&self, data: Vec<u8>) -> Vec<u8> {
+        if data.len() > MAX_EXPAND_BYTES || data.contains(&0) {
+            return data;
+        }
+        match String::from_utf8(data) {
+            Ok(text) => self.expand(&text).into_bytes(),
+            Err(e) => e.into_bytes(),
+        }
+    }
+}
+
+/// A file on the template's default branch
+struct File {
+    mode: String,
+    id: String,
+    path: String,
+}
+
+/// Give the empty repository at `repo_path` an initial commit with the
+/// template's files, on a branch named like the template's default one.
+/// Returns the branch.
+pub fn instantiate(
+    template_path: &Path,
+    repo_path: &Path,
+    vars: &Vars,
+    identity: &Identity,
+    with_hooks: bool,
+) -> Result<String> {
+    let branch = git::head_branch(template_path).unwrap_or_else(|| "main".to_string());
+    let files = list_files(template_path, &branch)?;
+    if files.is_empty() {
+        anyhow::bail!("The template has no files on {}", branch);
+    }
+
+    let mut stream = Vec::new();
+    let message = format!("Create {} from template\n", vars.project_name);
+    let when = format!("{} +0000", chrono::Utc::now().timestamp());
+    writeln!(stream, "commit refs/heads/{}", branch)?;
+    for role in ["author", "committer"] {
+        writeln!(
+            stream,
+            "{} {} <{}> {}",
+            role, identity.name, identity.email, when
+        )?;
+    }
+    writeln!(stream, "data {}\n{}", message.len(), message)?;
+    for file in &files {
+        let path = quote(&vars.expand(&file.path));
+        if file.mode == "160000" {
+            // Submodules are commits in another repository; keep the pointer
+            writeln!(stream, "M {} {} {}", file.mode, file.id, path)?;
+            continue;
+        }
+        let object = git::batch::pool()
+            .read(template_path, &file.id)?
+            .with_context(|| format!("Missing object {} in the template", file.id))?;
+        let data = if file.mode == "120000" {
+            object.data
+        } else {
+            vars.expand_bytes(object.data)
+        };
+        writeln!(stream, "M {} inline {}", file.mode, path)?;
+        writeln!(stream, "data {}", data.len())?;
+        stream.extend_from_slice(&data);
+        stream.push(b'\n');
+    }
+    writeln!(stream, "done")?;
+    fast_import(repo_path, &stream)?;
+
+    let head = format!("refs/heads/{}", branch);
+    let output = git::run(repo_path, &["symbolic-ref", "HEAD", &head])?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "Failed to point HEAD at {}: {}",
+            branch,
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+
+    if with_hooks {
+        copy_hooks(template_path, repo_path)?;
+    }
+    Ok(branch)
+}
+
+/// Every file on `branch` of the template
+fn list_files(template_path: &Path, branch: &str) -> Result<Vec<File>> {
+    let output = git::run(
+        template_path,
+        &["ls-tree", "-r", "-z", "--full-tree", branch],
+    )?;
+    if !output.status.success() {
+        anyhow::bail!("The template has no {} branch", branch);
+    }
+    // Entries are "<mode> <type> <id>\t<path>\0"
+    let mut files = Vec::new();
+    for entry in output.stdout.split(|&byte| byte == 0) {
+        let entry = String::from_utf8_lossy(entry);
+        let Some((meta, path)) = entry.split_once('\t') else {
+            continue;
+        };
+        let mut meta = meta.split(' ');
+        if let (Some(mode), Some(_), Some(id)) = (meta.next(), meta.next(), meta.next()) {
+            files.push(File {
+                mode: mode.to_string(),
+                id: id.to_string(),
+                path: path.to_string(),
+            });
+        }
+    }
+    Ok(files)
+}
+
+/// Quote a path for a fast-import command
+fn quote(path: &str) -> String {
+    let mut quoted = String::with_capacity(path.len() + 2);
+    quoted.push('"');
+    for c in path.chars() {
+        match c {
+            '"' => quoted.push_str("\\\""),
+            '\\' => quoted.push_str("\\\\"),
+            '\n' => quoted.push_str("\\n"),
+            c => quoted.push(c),
+        }
+    }
+    quoted.push('"');
+    quoted
+}
+
+/// Feed `stream` to `git fast-import` in the repository. Unlike a push,
+/// this runs no hooks.
+fn fast_import(repo_path: &Path, stream: &[u8]) -> Result<()> {
+    let mut child = Command::new("git")
+        .arg("-C")
+        .arg(repo_path)
+        .args(["fast-import", "--quiet", "--done"])
+        .stdin(Stdio::piped())
+        .stdout(Stdio::null())
+        .stderr(Stdio::piped())
+        .spawn()
+        .context("Failed to run git fast-import")?;
+    child
+        .stdin
+        .take()
+        .context("git fast-import has no stdin")?
+        .write_all(stream)
+        .context("Failed to write to git fast-import")?;
+    let output = child.wait_with_output()?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "Failed to write the initial commit: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(())
+}
+
+/// Copy the template's own hooks and legacy `agito-ci.sh`, leaving the
+/// new repository's managed hooks as they are
+fn copy_hooks(template_path: &Path, repo_path: &Path) -> Result<()> {
+    for hook in crate::hooks::HOOKS {
+        let dir = template_path.join("hooks").join(format!("{}.d", hook));
+        let Ok(entries) = fs::read_dir(&dir) else {
+            continue;
+        };
+        let target = repo_path.join("hooks").join(format!("{}.d", hook));
+        for entry in entries {
+            let entry = entry?;
+            if entry.file_name() == "00-agito" || !entry.path().is_file() {
+                continue;
+            }
+            fs::create_dir_all(&target)?;
+            fs::copy(entry.path(), target.join(entry.file_name()))
+                .with_context(|| format!("Failed to copy {}", entry.path().display()))?;
+        }
+    }
+    let ci_script = template_path.join("agito-ci.sh");
+    if ci_script.is_file() {
+        fs::copy(&ci_script, repo_path.join("agito-ci.sh"))
+            .context("Failed to copy agito-ci.sh")?;
+    }
+    Ok(())
+}
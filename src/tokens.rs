@@ -0,0 +1,224 @@
+//! Personal access tokens, for scripts and tools that can't sign in with a
+//! password.
+//!
+//! A token acts as its user with at most its scope: `read`, `write` or
+//! `admin`, see [`Role`]. Clients send it as `Authorization: Bearer <token>`,
+//! or as the password of HTTP basic auth. Tokens are kept in
+//! `<data_dir>/tokens.json` as SHA-256 hashes; the token itself is shown once,
+//! when it is created. Tokens of pending or disabled accounts, and expired
+//! tokens, are refused.
+//!
+//! When each token was last used is kept apart, in `tokens-used.json`, which
+//! only [`verify`] writes: requests record uses all the time, and rewriting
+//! tokens.json for them could undo a token created or revoked meanwhile.
+
+use crate::orgs::Role;
+use crate::{keys, users};
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use std::collections::BTreeMap;
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+
+/// Start of every token, so they are easy to recognize, e.g. by secret scanners
+pub const PREFIX: &str = "agito_";
+
+/// How often a token's last use is written back at most
+const LAST_USED_RESOLUTION: i64 = 3600;
+
+/// A token as stored; the secret itself is not kept
+#[derive(Clone, Debug, Serialize, Deserialize)]
+pub struct Token {
+    pub id: u64,
+    pub user: String,
+    /// What the token is for, e.g. "deploy script"
+    pub name: String,
+    /// Most the token may do; never more than its user may
+    pub scope: Role,
+    /// SHA-256 of the token, hex-encoded
+    hash: String,
+    /// Unix time the token was created
+    pub created: i64,
+    /// Unix time after which the token is refused
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub expires: Option<i64>,
+    /// Unix time the token was last used, to the hour
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub last_used: Option<i64>,
+}
+
+impl Token {
+    pub fn expired(&self, now: i64) -> bool {
+        self.expires.map_or(false, |expires| expires <= now)
+    }
+}
+
+fn tokens_path(data_dir: &Path) -> PathBuf {
+    data_dir.join("tokens.json")
+}
+
+/// When tokens were last used, by hash
+fn used_path(data_dir: &Path) -> PathBuf {
+    data_dir.join("tokens-used.json")
+}
+
+fn hash(secret: &str) -> String {
+    keys::hex(&Sha256::digest(secret.as_bytes()))
+}
+
+/// Every token on the server
+pub fn load(data_dir: &Path) -> Result<Vec<Token>> {
+    let path = tokens_path(data_dir);
+    let mut tokens: Vec<Token> = match fs::read_to_string(&path) {
+        Ok(content) => serde_json::from_str(&content)
+            .with_context(|| format!("Failed to parse {}", path.display()))?,
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Vec::new(),
+        Err(e) => return Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    };
+    // tokens.json itself has the last uses of before they were kept apart
+    let used = load_used(data_dir);
+    for token in &mut tokens {
+        token.last_used = token.last_used.max(used.get(&token.hash).copied());
+    }
+    Ok(tokens)
+}
+
+fn load_used(data_dir: &Path) -> BTreeMap<String, i64> {
+    fs::read_to_string(used_path(data_dir))
+        .ok()
+        .and_then(|content| serde_json::from_str(&content).ok())
+        .unwrap_or_default()
+}
+
+/// Record when tokens were last used, dropping those no longer in `tokens`.
+/// Concurrent requests may each write the file; the one written last wins,
+/// which at worst loses the other's use.
+fn save_used(data_dir: &Path, tokens: &[Token], mut used: BTreeMap<String, i64>) -> Result<()> {
+    used.retain(|hash, _| tokens.iter().any(|token| &token.hash == hash));
+    let path = used_path(data_dir);
+    let tmp = path.with_extension(format!("json.{}.tmp", keys::hex(&keys::random_bytes(4)?)));
+    fs::write(&tmp, serde_json::to_string_pretty(&used)?)?;
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        fs::set_permissions(&tmp, fs::Permissions::from_mode(0o600))?;
+    }
+    fs::rename(&tmp, &path)?;
+    Ok(())
+}
+
+fn save(data_dir: &Path, tokens: &[Token]) -> Result<()> {
+    fs::create_dir_all(data_dir)?;
+    let path = tokens_path(data_dir);
+    let tmp = path.with_extension("json.tmp");
+    fs::write(&tmp, serde_json::to_string_pretty(tokens)?)?;
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        fs::set_permissions(&tmp, fs::Permissions::from_mode(0o600))?;
+    }
+    fs::rename(&tmp, &path)?;
+    Ok(())
+}
+
+/// A user's tokens
+pub fn list(data_dir: &Path, user: &str) -> Result<Vec<Token>> {
+    Ok(load(data_dir)?
+        .into_iter()
+        .filter(|token| token.user == user)
+        .collect())
+}
+
+/// Issue a token to a user, returning it with its secret, which can't be
+/// recovered later
+pub fn create(
+    data_dir: &Path,
+    user: &str,
+    name: &str,
+    scope: Role,
+    expires: Option<i64>,
+) -> Result<(Token, String)> {
+    if users::get(data_dir, user).is_none() {
+        anyhow::bail!("No such user: {}", user);
+    }
+    let name = name.trim();
+    if name.is_empty() {
+        anyhow::bail!("Give the token a name, e.g. what it is for");
+    }
+    let now = chrono::Utc::now().timestamp();
+    if expires.map_or(false, |expires| expires <= now) {
+        anyhow::bail!("The expiry date has passed");
+    }
+
+    let secret = format!("{}{}", PREFIX, keys::hex(&keys::random_bytes(20)?));
+    let mut tokens = load(data_dir)?;
+    let token = Token {
+        id: tokens.iter().map(|token| token.id).max().unwrap_or(0) + 1,
+        user: user.to_string(),
+        name: name.to_string(),
+        scope,
+        hash: hash(&secret),
+        created: now,
+        expires,
+        last_used: None,
+    };
+    tokens.push(token.clone());
+    save(data_dir, &tokens)?;
+    Ok((token, secret))
+}
+
+/// Revoke a token; with `user`, only one of theirs
+pub fn revoke(data_dir: &Path, user: Option<&str>, id: u64) -> Result<Token> {
+    let mut tokens = load(data_dir)?;
+    let index = tokens
+        .iter()
+        .position(|token| token.id == id && user.map_or(true, |user| token.user == user))
+        .with_context(|| format!("No such token: {}", id))?;
+    let revoked = tokens.remove(index);
+    save(data_dir, &tokens)?;
+    Ok(revoked)
+}
+
+/// Revoke all of a user's tokens, returning how many there were
+pub fn revoke_all(data_dir: &Path, user: &str) -> Result<usize> {
+    let mut tokens = load(data_dir)?;
+    let before = tokens.len();
+    tokens.retain(|token| token.user != user);
+    if tokens.len() != before {
+        save(data_dir, &tokens)?;
+    }
+    Ok(before - tokens.len())
+}
+
+/// The token a secret belongs to, if it may be used: not expired, and its
+/// user's account active
+pub fn verify(data_dir: &Path, secret: &str) -> Option<Token> {
+    if !secret.starts_with(PREFIX) {
+        return None;
+    }
+    let hashed = hash(secret);
+    let tokens = load(data_dir).ok()?;
+    let now = chrono::Utc::now().timestamp();
+    let mut token = tokens
+        .iter()
+        .find(|token| keys::constant_time_eq(token.hash.as_bytes(), hashed.as_bytes()))?
+        .clone();
+    if token.expired(now) || !users::get(data_dir, &token.user).map_or(false, |u| u.is_active()) {
+        return None;
+    }
+
+    if token
+        .last_used
+        .map_or(true, |used| now - used >= LAST_USED_RESOLUTION)
+    {
+        token.last_used = Some(now);
+        let mut used = load_used(data_dir);
+        used.insert(token.hash.clone(), now);
+        if let Err(e) = save_used(data_dir, &tokens, used) {
+            tracing::warn!("Failed to record use of token {}: {:#}", token.id, e);
+        }
+    }
+    Some(token)
+}
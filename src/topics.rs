@@ -0,0 +1,91 @@
+//! Topics: short labels such as `infra` or `rust` that group repositories,
+//! so the index can be filtered by them.
+//!
+//! A repository's topics are kept in `agito/topics`, one per line.
+
+use crate::git;
+use anyhow::{Context, Result};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+/// Topics a repository may have
+pub const MAX_TOPICS: usize = 20;
+
+/// Longest topic
+const MAX_LENGTH: usize = 35;
+
+fn topics_path(repo_path: &Path) -> PathBuf {
+    git::data_dir(repo_path).join("topics")
+}
+
+/// Whether `topic` is a lowercase letter or digit followed by lowercase
+/// letters, digits and hyphens
+pub fn valid(topic: &str) -> bool {
+    topic.len() <= MAX_LENGTH
+        && topic
+            .chars()
+            .next()
+            .map_or(false, |c| c.is_ascii_lowercase() || c.is_ascii_digit())
+        && topic
+            .chars()
+            .all(|c| c.is_ascii_lowercase() || c.is_ascii_digit() || c == '-')
+}
+
+/// Topics from a comma- or whitespace-separated list, lowercased, sorted and
+/// without duplicates
+pub fn parse(list: &str) -> Result<Vec<String>, String> {
+    let mut topics: Vec<String> = list
+        .split(|c: char| c == ',' || c.is_whitespace())
+        .filter(|topic| !topic.is_empty())
+        .map(str::to_lowercase)
+        .collect();
+    if let Some(topic) = topics.iter().find(|topic| !valid(topic)) {
+        return Err(format!(
+            "Invalid topic '{}': topics are at most {} lowercase letters, digits and hyphens, starting with a letter or digit",
+            topic, MAX_LENGTH
+        ));
+    }
+    topics.sort();
+    topics.dedup();
+    if topics.len() > MAX_TOPICS {
+        return Err(format!(
+            "A repository can have at most {} topics",
+            MAX_TOPICS
+        ));
+    }
+    Ok(topics)
+}
+
+/// A repository's topics, sorted
+pub fn get(repo_path: &Path) -> Vec<String> {
+    fs::read_to_string(topics_path(repo_path))
+        .map(|content| {
+            content
+                .lines()
+                .map(str::trim)
+                .filter(|topic| valid(topic))
+                .map(str::to_string)
+                .collect()
+        })
+        .unwrap_or_default()
+}
+
+/// Replace a repository's topics; none removes the file
+pub fn set(repo_path: &Path, topics: &[String]) -> Result<()> {
+    let path = topics_path(repo_path);
+    if topics.is_empty() {
+        return match fs::remove_file(&path) {
+            Err(e) if e.kind() != std::io::ErrorKind::NotFound => {
+                Err(e).with_context(|| format!("Failed to remove {}", path.display()))
+            }
+            _ => Ok(()),
+        };
+    }
+    if let Some(dir) = path.parent() {
+        fs::create_dir_all(dir)?;
+    }
+    let tmp = path.with_extension("tmp");
+    fs::write(&tmp, format!("{}\n", topics.join("\n")))?;
+    fs::rename(&tmp, &path).with_context(|| format!("Failed to write {}", path.display()))?;
+    Ok(())
+}
@@ -0,0 +1,178 @@
+//! Deleted repositories, kept for a while so a mistaken deletion can be
+//! undone.
+//!
+//! Deleting a repository moves it to `<repos_dir>/.trash/<id>/repo.git`, next
+//! to a `deleted.json` saying what it was called, when it was deleted and by
+//! whom. The trash is on the same file system as the repositories, so moving
+//! in and out is instant, and being a dot directory it is not mistaken for a
+//! namespace. Server admins restore or purge deleted repositories; those past
+//! the retention period are purged in the background.
+
+use crate::{git, jobs, usage};
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+use std::time::Duration;
+
+/// Days deleted repositories are kept unless configured otherwise
+pub const DEFAULT_RETENTION_DAYS: u64 = 30;
+
+/// A repository in the trash
+#[derive(Clone, Debug, Serialize, Deserialize)]
+pub struct Deleted {
+    /// Identifies the deleted repository in the trash, e.g. for restoring
+    pub id: String,
+    /// Name the repository had
+    pub name: String,
+    /// Unix time it was deleted
+    pub deleted: i64,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub deleted_by: Option<String>,
+    /// Size on disk
+    #[serde(default)]
+    pub bytes: u64,
+}
+
+fn trash_dir(repos_dir: &Path) -> PathBuf {
+    repos_dir.join(".trash")
+}
+
+fn entry_dir(repos_dir: &Path, id: &str) -> Result<PathBuf> {
+    if id.is_empty() || id.starts_with('.') || id.contains(['/', '\\']) {
+        anyhow::bail!("Invalid trash ID: {}", id);
+    }
+    Ok(trash_dir(repos_dir).join(id))
+}
+
+/// Move a repository to the trash
+pub fn delete(repos_dir: &Path, name: &str, user: Option<&str>) -> Result<Deleted> {
+    let repo_path = repos_dir.join(name);
+    if !git::is_repository(&repo_path) {
+        anyhow::bail!("Repository not found: {}", name);
+    }
+
+    let now = chrono::Utc::now().timestamp();
+    let base = format!("{}-{}", now, name.replace('/', "_"));
+    let trash = trash_dir(repos_dir);
+    fs::create_dir_all(&trash)?;
+    // Claim a directory; a repository of the same name deleted in the same
+    // second gets a suffix
+    let (id, dir) = (1..)
+        .map(|n| match n {
+            1 => base.clone(),
+            n => format!("{}-{}", base, n),
+        })
+        .map(|id| (id.clone(), trash.join(id)))
+        .find_map(|(id, dir)| match fs::create_dir(&dir) {
+            Ok(()) => Some(Ok((id, dir))),
+            Err(e) if e.kind() == io::ErrorKind::AlreadyExists => None,
+            Err(e) => Some(Err(e)),
+        })
+        .expect("one of the names is free")?;
+
+    let deleted = Deleted {
+        id,
+        name: name.to_string(),
+        deleted: now,
+        deleted_by: user.map(str::to_string),
+        bytes: usage::path_size(&repo_path).unwrap_or(0),
+    };
+    fs::write(
+        dir.join("deleted.json"),
+        serde_json::to_string_pretty(&deleted)?,
+    )?;
+    if let Err(e) = fs::rename(&repo_path, dir.join("repo.git")) {
+        let _ = fs::remove_dir_all(&dir);
+        return Err(e).with_context(|| format!("Failed to move {} to the trash", name));
+    }
+    Ok(deleted)
+}
+
+/// Everything in the trash, most recently deleted first
+pub fn list(repos_dir: &Path) -> Result<Vec<Deleted>> {
+    let entries = match fs::read_dir(trash_dir(repos_dir)) {
+        Ok(entries) => entries,
+        Err(e) if e.kind() == io::ErrorKind::NotFound => return Ok(Vec::new()),
+        Err(e) => return Err(e.into()),
+    };
+    let mut deleted = Vec::new();
+    for entry in entries {
+        let path = entry?.path().join("deleted.json");
+        match fs::read_to_string(&path) {
+            Ok(content) => match serde_json::from_str(&content) {
+                Ok(entry) => deleted.push(entry),
+                Err(e) => tracing::warn!("Ignoring {}: {}", path.display(), e),
+            },
+            // Being moved in or purged
+            Err(e) if e.kind() == io::ErrorKind::NotFound => {}
+            Err(e) => return Err(e.into()),
+        }
+    }
+    deleted.sort_by(|a: &Deleted, b| b.deleted.cmp(&a.deleted).then(b.id.cmp(&a.id)));
+    Ok(deleted)
+}
+
+fn get(repos_dir: &Path, id: &str) -> Result<Deleted> {
+    let path = entry_dir(repos_dir, id)?.join("deleted.json");
+    let content = match fs::read_to_string(&path) {
+        Ok(content) => content,
+        Err(e) if e.kind() == io::ErrorKind::NotFound => anyhow::bail!("Not in the trash: {}", id),
+        Err(e) => return Err(e.into()),
+    };
+    serde_json::from_str(&content).with_context(|| format!("Failed to parse {}", path.display()))
+}
+
+/// Put a deleted repository back, under its old name or `name`, returning the
+/// name it is restored as
+pub fn restore(repos_dir: &Path, id: &str, name: Option<&str>) -> Result<String> {
+    let deleted = get(repos_dir, id)?;
+    let name = name.unwrap_or(&deleted.name).trim_matches('/');
+    let target = repos_dir.join(name);
+    if target.exists() {
+        anyhow::bail!("{} exists; restore under another name with --as", name);
+    }
+    if let Some(parent) = target.parent() {
+        fs::create_dir_all(parent)?;
+    }
+    let dir = entry_dir(repos_dir, id)?;
+    fs::rename(dir.join("repo.git"), &target)
+        .with_context(|| format!("Failed to restore {}", name))?;
+    fs::remove_dir_all(&dir)?;
+    Ok(name.to_string())
+}
+
+/// Delete a repository in the trash for good
+pub fn purge(repos_dir: &Path, id: &str) -> Result<Deleted> {
+    let deleted = get(repos_dir, id)?;
+    fs::remove_dir_all(entry_dir(repos_dir, id)?)?;
+    Ok(deleted)
+}
+
+/// Purge what was deleted more than `days` ago, returning what was purged
+pub fn purge_expired(repos_dir: &Path, days: u64, now: i64) -> Result<Vec<Deleted>> {
+    let cutoff = now - (days * 24 * 3600) as i64;
+    let mut purged = Vec::new();
+    for deleted in list(repos_dir)? {
+        if deleted.deleted < cutoff {
+            purged.push(purge(repos_dir, &deleted.id)?);
+        }
+    }
+    Ok(purged)
+}
+
+/// Purge expired deleted repositories every `interval` in the background
+pub fn spawn(repos_dir: PathBuf, days: u64, interval: Duration) -> tokio::task::JoinHandle<()> {
+    jobs::spawn_periodic("trash", interval, move || {
+        for deleted in purge_expired(&repos_dir, days, chrono::Utc::now().timestamp())? {
+            tracing::info!(
+                repo = %deleted.name,
+                id = %deleted.id,
+                bytes = deleted.bytes,
+                "Purged deleted repository"
+            );
+        }
+        Ok(())
+    })
+}
@@ -0,0 +1,140 @@
+//! `agito trust`: trusting a server's SSH host keys before the first clone.
+//!
+//! The keys are fetched with ssh-keyscan and, when the profile has the web
+//! server's address, checked against the fingerprints it publishes (see
+//! [`crate::host_keys`]); with nothing to check them against, the user is
+//! left to compare them with what the server's admin hands out. Trusted
+//! keys go into `~/.ssh/known_hosts`, replacing any the host had there.
+
+use crate::git;
+use crate::host_keys::{self, HostKey};
+use anyhow::{Context, Result};
+use std::fs::{self, OpenOptions};
+use std::io::Write;
+use std::path::PathBuf;
+use std::process::Command;
+
+/// Seconds ssh-keyscan and curl wait for the server
+const TIMEOUT_SECS: &str = "10";
+
+/// The host keys `server` (`host[:port]`) offers
+pub fn scan(server: &str) -> Result<Vec<HostKey>> {
+    let (host, port) = git::split_server(server);
+    let output = Command::new("ssh-keyscan")
+        .args(["-T", TIMEOUT_SECS, "-p", port, "--", host])
+        .output()
+        .context("Failed to run ssh-keyscan; is OpenSSH installed?")?;
+    // `<host> <algorithm> <base64>`, with comments on stderr
+    let keys: Vec<HostKey> = String::from_utf8_lossy(&output.stdout)
+        .lines()
+        .filter(|line| !line.starts_with('#'))
+        .filter_map(|line| HostKey::parse(line.split_once(' ')?.1))
+        .collect();
+    if keys.is_empty() {
+        anyhow::bail!(
+            "{} offered no host keys: {}",
+            server,
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(keys)
+}
+
+/// The host keys the web server at `url` publishes
+pub fn published(url: &str) -> Result<Vec<HostKey>> {
+    let api_url = format!("{}/api/v1/host-keys", url.trim_end_matches('/'));
+    let output = Command::new("curl")
+        .args([
+            "--silent",
+            "--show-error",
+            "--fail",
+            "--proto",
+            "=http,https",
+        ])
+        .args(["--max-time", TIMEOUT_SECS, "--"])
+        .arg(&api_url)
+        .output()
+        .context("Failed to run curl")?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "Failed to fetch {}: {}",
+            api_url,
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    serde_json::from_slice(&output.stdout).with_context(|| format!("{} sent invalid JSON", api_url))
+}
+
+/// The keys known_hosts trusts for `server`
+pub fn known(server: &str) -> Vec<HostKey> {
+    let (host, port) = git::split_server(server);
+    let output = match Command::new("ssh-keygen")
+        .arg("-F")
+        .arg(host_keys::known_hosts_name(host, port))
+        .arg("-f")
+        .arg(known_hosts_path())
+        .output()
+    {
+        Ok(output) => output,
+        Err(_) => return Vec::new(),
+    };
+    // `# Host ... found: line N` comments, then each line as it is, with
+    // markers such as @revoked left out here
+    String::from_utf8_lossy(&output.stdout)
+        .lines()
+        .filter(|line| !line.starts_with('#') && !line.starts_with('@'))
+        .filter_map(|line| HostKey::parse(line.split_once(' ')?.1))
+        .collect()
+}
+
+/// Whether `key` is among `keys`, by fingerprint
+pub fn listed(key: &HostKey, keys: &[HostKey]) -> bool {
+    keys.iter().any(|other| other.fingerprint == key.fingerprint)
+}
+
+fn known_hosts_path() -> PathBuf {
+    let home = std::env::var_os("HOME").unwrap_or_default();
+    PathBuf::from(home).join(".ssh").join("known_hosts")
+}
+
+/// Trust `keys` for `server` in known_hosts instead of whatever it trusted
+/// for it before, returning the file
+pub fn pin(server: &str, keys: &[HostKey]) -> Result<PathBuf> {
+    let (host, port) = git::split_server(server);
+    let path = known_hosts_path();
+    if !known(server).is_empty() {
+        let status = Command::new("ssh-keygen")
+            .arg("-R")
+            .arg(host_keys::known_hosts_name(host, port))
+            .arg("-f")
+            .arg(&path)
+            .output()
+            .context("Failed to run ssh-keygen")?
+            .status;
+        if !status.success() {
+            anyhow::bail!(
+                "Failed to remove the old keys of {} from {}",
+                server,
+                path.display()
+            );
+        }
+    }
+
+    if let Some(dir) = path.parent() {
+        fs::create_dir_all(dir)?;
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            let _ = fs::set_permissions(dir, fs::Permissions::from_mode(0o700));
+        }
+    }
+    let mut file = OpenOptions::new()
+        .create(true)
+        .append(true)
+        .open(&path)
+        .with_context(|| format!("Failed to open {}", path.display()))?;
+    for key in keys {
+        writeln!(file, "{}", key.known_hosts_line(host, port))?;
+    }
+    Ok(path)
+}
@@ -0,0 +1,632 @@
+//! `agito tui`: a keyboard-driven browser for the repositories on the
+//! server, for when opening the web viewer is too slow.
+//!
+//! It lists the repositories the user may read, and browses a repository's
+//! branches and tags, commits and files from a bare copy it fetches over SSH
+//! into the user's cache directory, without blobs, which git fetches as
+//! files are opened. From the list, repositories can also be cloned into the
+//! current directory and new ones created.
+
+use crate::git;
+use anyhow::{Context, Result};
+use crossterm::event::{self, Event, KeyCode, KeyEvent, KeyEventKind, KeyModifiers};
+use crossterm::style::{Attribute, Print, SetAttribute};
+use crossterm::{cursor, execute, queue, terminal};
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+
+/// Browse the server until the user quits
+pub fn run(server: &str, user: &str) -> Result<()> {
+    let names = git::list_remote_repos(server, user)?;
+    let mut app = App {
+        server: server.to_string(),
+        user: user.to_string(),
+        repos: names,
+        filter: String::new(),
+        stack: Vec::new(),
+        prompt: None,
+        status: String::new(),
+    };
+    app.stack.push(app.repos_screen());
+
+    let _terminal = Terminal::enter()?;
+    let mut out = std::io::stdout();
+    loop {
+        app.draw(&mut out)?;
+        if let Event::Key(key) = event::read()? {
+            if key.kind == KeyEventKind::Press && !app.key(key, &mut out)? {
+                return Ok(());
+            }
+        }
+    }
+}
+
+/// Raw mode on the alternate screen, restored however the browser exits
+struct Terminal;
+
+impl Terminal {
+    fn enter() -> Result<Self> {
+        terminal::enable_raw_mode().context("Failed to set up the terminal")?;
+        execute!(
+            std::io::stdout(),
+            terminal::EnterAlternateScreen,
+            cursor::Hide
+        )?;
+        Ok(Terminal)
+    }
+}
+
+impl Drop for Terminal {
+    fn drop(&mut self) {
+        let _ = execute!(
+            std::io::stdout(),
+            cursor::Show,
+            terminal::LeaveAlternateScreen
+        );
+        let _ = terminal::disable_raw_mode();
+    }
+}
+
+/// A repository and the local copy it is browsed from
+#[derive(Clone)]
+struct Repo {
+    name: String,
+    cache: PathBuf,
+}
+
+enum Kind {
+    Repos,
+    /// Full ref names, in the order shown
+    Refs {
+        repo: Repo,
+        refs: Vec<String>,
+    },
+    /// Commit ids, in the order shown
+    Commits {
+        repo: Repo,
+        ids: Vec<String>,
+    },
+    /// Entries of the directory `path` at `rev`: whether each is a
+    /// directory, and its name
+    Tree {
+        repo: Repo,
+        rev: String,
+        path: String,
+        entries: Vec<(bool, String)>,
+    },
+    /// Text to scroll through
+    Text,
+}
+
+struct Screen {
+    title: String,
+    lines: Vec<String>,
+    /// The selected line, or for text the first one shown
+    selected: usize,
+    /// The first line shown
+    top: usize,
+    kind: Kind,
+}
+
+impl Screen {
+    fn new(title: String, lines: Vec<String>, kind: Kind) -> Self {
+        Screen {
+            title,
+            lines,
+            selected: 0,
+            top: 0,
+            kind,
+        }
+    }
+
+    fn help(&self) -> &'static str {
+        match self.kind {
+            Kind::Repos => "enter open  c clone  n new  / filter  r refresh  q quit",
+            Kind::Refs { .. } => "enter commits  f files  esc back  q quit",
+            Kind::Commits { .. } => "enter show  f files  esc back  q quit",
+            Kind::Tree { .. } => "enter open  esc back  q quit",
+            Kind::Text => "arrows scroll  esc back  q quit",
+        }
+    }
+
+    /// Move the selection, or scroll text, by `delta` lines
+    fn move_by(&mut self, delta: isize, rows: usize) {
+        let last = match self.kind {
+            Kind::Text => self.lines.len().saturating_sub(rows),
+            _ => self.lines.len().saturating_sub(1),
+        };
+        self.selected = self.selected.saturating_add_signed(delta).min(last);
+    }
+}
+
+enum Prompt {
+    Filter,
+    Create(String),
+}
+
+struct App {
+    server: String,
+    user: String,
+    repos: Vec<String>,
+    filter: String,
+    stack: Vec<Screen>,
+    prompt: Option<Prompt>,
+    status: String,
+}
+
+impl App {
+    fn screen(&mut self) -> &mut Screen {
+        self.stack
+            .last_mut()
+            .expect("the repository list is never closed")
+    }
+
+    fn repos_screen(&self) -> Screen {
+        let lines = self
+            .repos
+            .iter()
+            .filter(|name| name.contains(self.filter.as_str()))
+            .cloned()
+            .collect();
+        let title = match self.filter.as_str() {
+            "" => format!("Repositories on {}", self.server),
+            filter => format!("Repositories on {} matching '{}'", self.server, filter),
+        };
+        Screen::new(title, lines, Kind::Repos)
+    }
+
+    fn url(&self, name: &str) -> String {
+        format!("ssh://{}@{}/{}", self.user, self.server, name)
+    }
+
+    fn draw(&mut self, out: &mut impl Write) -> Result<()> {
+        let (width, height) = terminal::size()?;
+        let (width, rows) = (width as usize, (height as usize).saturating_sub(2));
+        let footer = match &self.prompt {
+            Some(Prompt::Filter) => format!("/{}", self.filter),
+            Some(Prompt::Create(name)) => format!("New repository name: {}", name),
+            None if !self.status.is_empty() => self.status.clone(),
+            None => self.screen().help().to_string(),
+        };
+
+        let screen = self.screen();
+        let text = matches!(screen.kind, Kind::Text);
+        if text {
+            screen.top = screen.selected;
+        } else if screen.selected < screen.top {
+            screen.top = screen.selected;
+        } else if screen.selected >= screen.top + rows {
+            screen.top = screen.selected + 1 - rows;
+        }
+
+        queue!(
+            out,
+            terminal::Clear(terminal::ClearType::All),
+            cursor::MoveTo(0, 0),
+            SetAttribute(Attribute::Reverse),
+            Print(format!("{:width$}", fit(&screen.title, width))),
+            SetAttribute(Attribute::Reset)
+        )?;
+        for (row, index) in (screen.top..screen.lines.len()).take(rows).enumerate() {
+            queue!(out, cursor::MoveTo(0, row as u16 + 1))?;
+            let line = fit(&screen.lines[index], width);
+            if !text && index == screen.selected {
+                queue!(
+                    out,
+                    SetAttribute(Attribute::Reverse),
+                    Print(format!("{:width$}", line)),
+                    SetAttribute(Attribute::Reset)
+                )?;
+            } else {
+                queue!(out, Print(line))?;
+            }
+        }
+        if screen.lines.is_empty() && !text {
+            queue!(out, cursor::MoveTo(0, 1), Print("(nothing here)"))?;
+        }
+        queue!(
+            out,
+            cursor::MoveTo(0, height.saturating_sub(1)),
+            Print(fit(&footer, width))
+        )?;
+        out.flush()?;
+        Ok(())
+    }
+
+    /// Handle a key press; false once the user quits
+    fn key(&mut self, key: KeyEvent, out: &mut impl Write) -> Result<bool> {
+        if key.code == KeyCode::Char('c') && key.modifiers.contains(KeyModifiers::CONTROL) {
+            return Ok(false);
+        }
+        if self.prompt.is_some() {
+            self.prompt_key(key, out)?;
+            return Ok(true);
+        }
+        self.status.clear();
+
+        let rows = terminal::size()?.1.saturating_sub(2) as usize;
+        let screen = self.screen();
+        match key.code {
+            KeyCode::Char('q') => return Ok(false),
+            KeyCode::Up | KeyCode::Char('k') => screen.move_by(-1, rows),
+            KeyCode::Down | KeyCode::Char('j') => screen.move_by(1, rows),
+            KeyCode::PageUp => screen.move_by(-(rows as isize), rows),
+            KeyCode::PageDown | KeyCode::Char(' ') => screen.move_by(rows as isize, rows),
+            KeyCode::Home | KeyCode::Char('g') => screen.selected = 0,
+            KeyCode::End | KeyCode::Char('G') => screen.move_by(isize::MAX, rows),
+            KeyCode::Esc | KeyCode::Backspace | KeyCode::Left | KeyCode::Char('h') => {
+                if self.stack.len() > 1 {
+                    self.stack.pop();
+                }
+            }
+            KeyCode::Enter | KeyCode::Right | KeyCode::Char('l') => {
+                self.busy(out, "Loading...")?;
+                if let Err(e) = self.open() {
+                    self.status = format!("{:#}", e);
+                }
+            }
+            KeyCode::Char('f') => {
+                self.busy(out, "Loading...")?;
+                if let Err(e) = self.files() {
+                    self.status = format!("{:#}", e);
+                }
+            }
+            KeyCode::Char('/') if matches!(screen.kind, Kind::Repos) => {
+                self.prompt = Some(Prompt::Filter)
+            }
+            KeyCode::Char('n') if matches!(screen.kind, Kind::Repos) => {
+                self.prompt = Some(Prompt::Create(String::new()))
+            }
+            KeyCode::Char('c') if matches!(screen.kind, Kind::Repos) => {
+                self.busy(out, "Cloning...")?;
+                self.status = match self.clone_selected() {
+                    Ok(message) => message,
+                    Err(e) => format!("{:#}", e),
+                };
+            }
+            KeyCode::Char('r') if matches!(screen.kind, Kind::Repos) => {
+                self.busy(out, "Refreshing...")?;
+                match git::list_remote_repos(&self.server, &self.user) {
+                    Ok(names) => {
+                        self.repos = names;
+                        self.stack[0] = self.repos_screen();
+                    }
+                    Err(e) => self.status = format!("{:#}", e),
+                }
+            }
+            _ => {}
+        }
+        Ok(true)
+    }
+
+    fn prompt_key(&mut self, key: KeyEvent, out: &mut impl Write) -> Result<()> {
+        let text = match self.prompt.as_mut() {
+            Some(Prompt::Filter) => &mut self.filter,
+            Some(Prompt::Create(name)) => name,
+            None => return Ok(()),
+        };
+        match key.code {
+            KeyCode::Char(c) => text.push(c),
+            KeyCode::Backspace => {
+                text.pop();
+            }
+            KeyCode::Esc => {
+                if let Some(Prompt::Filter) = self.prompt {
+                    self.filter.clear();
+                }
+                self.prompt = None;
+            }
+            KeyCode::Enter => {
+                if let Some(Prompt::Create(name)) = self.prompt.take() {
+                    self.busy(out, "Creating...")?;
+                    self.status = match self.create(name.trim()) {
+                        Ok(message) => message,
+                        Err(e) => format!("{:#}", e),
+                    };
+                }
+                self.prompt = None;
+            }
+            _ => {}
+        }
+        if let Some(Prompt::Filter) = self.prompt {
+            self.stack[0] = self.repos_screen();
+        } else if self.prompt.is_none() && self.stack.len() == 1 {
+            let selected = self.stack[0].selected;
+            self.stack[0] = self.repos_screen();
+            self.stack[0].selected = selected.min(self.stack[0].lines.len().saturating_sub(1));
+        }
+        Ok(())
+    }
+
+    /// Show what a slow action is doing while it runs
+    fn busy(&mut self, out: &mut impl Write, message: &str) -> Result<()> {
+        self.status = message.to_string();
+        self.draw(out)?;
+        self.status.clear();
+        Ok(())
+    }
+
+    /// Open the selected line in a new screen
+    fn open(&mut self) -> Result<()> {
+        let screen = self
+            .stack
+            .last()
+            .expect("the repository list is never closed");
+        let selected = screen.selected;
+        let next = match &screen.kind {
+            Kind::Repos => match screen.lines.get(selected) {
+                Some(name) => refs_screen(self.fetch(name)?)?,
+                None => return Ok(()),
+            },
+            Kind::Refs { repo, refs } => match refs.get(selected) {
+                Some(rev) => commits_screen(repo.clone(), rev)?,
+                None => return Ok(()),
+            },
+            Kind::Commits { repo, ids } => match ids.get(selected) {
+                Some(id) => {
+                    let text = git_output(
+                        &repo.cache,
+                        &["show", "--stat", "--patch", "--format=fuller", id],
+                    )?;
+                    Screen::new(format!("{} {}", repo.name, id), lines(&text), Kind::Text)
+                }
+                None => return Ok(()),
+            },
+            Kind::Tree {
+                repo,
+                rev,
+                path,
+                entries,
+            } => match entries.get(selected) {
+                Some((true, name)) => tree_screen(repo.clone(), rev, &join(path, name))?,
+                Some((false, name)) => {
+                    let file = join(path, name);
+                    let content = git_bytes(&repo.cache, &["show", &format!("{}:{}", rev, file)])?;
+                    let text = if content.contains(&0) {
+                        format!("(binary file, {} bytes)", content.len())
+                    } else {
+                        String::from_utf8_lossy(&content).to_string()
+                    };
+                    Screen::new(
+                        format!("{} {}:{}", repo.name, short(rev), file),
+                        lines(&text),
+                        Kind::Text,
+                    )
+                }
+                None => return Ok(()),
+            },
+            Kind::Text => return Ok(()),
+        };
+        self.stack.push(next);
+        Ok(())
+    }
+
+    /// Browse the files of the selected ref or commit
+    fn files(&mut self) -> Result<()> {
+        let screen = self
+            .stack
+            .last()
+            .expect("the repository list is never closed");
+        let next = match &screen.kind {
+            Kind::Refs { repo, refs } => refs.get(screen.selected).map(|rev| (repo, rev)),
+            Kind::Commits { repo, ids } => ids.get(screen.selected).map(|id| (repo, id)),
+            _ => None,
+        };
+        if let Some((repo, rev)) = next {
+            let screen = tree_screen(repo.clone(), rev, "")?;
+            self.stack.push(screen);
+        }
+        Ok(())
+    }
+
+    /// Bring the local copy of a repository up to date
+    fn fetch(&self, name: &str) -> Result<Repo> {
+        let server = self.server.replace([':', '/'], "_");
+        let cache = cache_dir().join(server).join(name);
+        if cache.exists() {
+            git_output(
+                &cache,
+                &[
+                    "fetch",
+                    "--quiet",
+                    "--prune",
+                    &self.url(name),
+                    "+refs/heads/*:refs/heads/*",
+                    "+refs/tags/*:refs/tags/*",
+                ],
+            )?;
+        } else {
+            std::fs::create_dir_all(&cache)?;
+            let result = git_output(
+                &cache,
+                &[
+                    "clone",
+                    "--quiet",
+                    "--bare",
+                    "--filter=blob:none",
+                    &self.url(name),
+                    ".",
+                ],
+            );
+            if let Err(e) = result {
+                let _ = std::fs::remove_dir_all(&cache);
+                return Err(e);
+            }
+        }
+        Ok(Repo {
+            name: name.to_string(),
+            cache,
+        })
+    }
+
+    fn clone_selected(&self) -> Result<String> {
+        let screen = &self.stack[0];
+        let name = match screen.lines.get(screen.selected) {
+            Some(name) => name,
+            None => return Ok(String::new()),
+        };
+        let dir = name
+            .rsplit('/')
+            .next()
+            .unwrap_or(name)
+            .trim_end_matches(".git");
+        git_output(Path::new("."), &["clone", "--quiet", &self.url(name), dir])?;
+        Ok(format!("Cloned {} into ./{}", name, dir))
+    }
+
+    fn create(&mut self, name: &str) -> Result<String> {
+        if name.is_empty() {
+            return Ok(String::new());
+        }
+        let created = git::create_remote_repo(&self.server, &self.user, name, None, None, false)?;
+        self.repos = git::list_remote_repos(&self.server, &self.user)?;
+        Ok(format!("Created {}", created.name))
+    }
+}
+
+fn refs_screen(repo: Repo) -> Result<Screen> {
+    let output = git_output(
+        &repo.cache,
+        &[
+            "for-each-ref",
+            "--format=%(refname)",
+            "--sort=-creatordate",
+            "refs/heads",
+            "refs/tags",
+        ],
+    )?;
+    let refs: Vec<String> = output.lines().map(str::to_string).collect();
+    let lines = refs
+        .iter()
+        .map(|name| match name.strip_prefix("refs/tags/") {
+            Some(tag) => format!("{} (tag)", tag),
+            None => short(name).to_string(),
+        })
+        .collect();
+    Ok(Screen::new(
+        format!("{}: branches and tags", repo.name),
+        lines,
+        Kind::Refs { repo, refs },
+    ))
+}
+
+fn commits_screen(repo: Repo, rev: &str) -> Result<Screen> {
+    let output = git_output(
+        &repo.cache,
+        &[
+            "log",
+            "-n",
+            "1000",
+            "--date=short",
+            "--format=%H%x09%h %ad %<(16,trunc)%an %s",
+            rev,
+            "--",
+        ],
+    )?;
+    let (ids, lines) = output
+        .lines()
+        .filter_map(|line| line.split_once('\t'))
+        .map(|(id, line)| (id.to_string(), line.to_string()))
+        .unzip();
+    Ok(Screen::new(
+        format!("{}: commits on {}", repo.name, short(rev)),
+        lines,
+        Kind::Commits { repo, ids },
+    ))
+}
+
+fn tree_screen(repo: Repo, rev: &str, path: &str) -> Result<Screen> {
+    let output = git_output(&repo.cache, &["ls-tree", &format!("{}:{}", rev, path)])?;
+    let mut entries: Vec<(bool, String)> = output
+        .lines()
+        .filter_map(|line| {
+            let (info, name) = line.split_once('\t')?;
+            Some((info.split(' ').nth(1) == Some("tree"), name.to_string()))
+        })
+        .collect();
+    entries.sort_by(|a, b| b.0.cmp(&a.0).then_with(|| a.1.cmp(&b.1)));
+    let lines = entries
+        .iter()
+        .map(|(dir, name)| {
+            if *dir {
+                format!("{}/", name)
+            } else {
+                name.clone()
+            }
+        })
+        .collect();
+    Ok(Screen::new(
+        format!("{} {}:/{}", repo.name, short(rev), path),
+        lines,
+        Kind::Tree {
+            repo,
+            rev: rev.to_string(),
+            path: path.to_string(),
+            entries,
+        },
+    ))
+}
+
+/// Where local copies of repositories are kept
+fn cache_dir() -> PathBuf {
+    let base = match std::env::var_os("XDG_CACHE_HOME") {
+        Some(dir) => PathBuf::from(dir),
+        None => PathBuf::from(std::env::var_os("HOME").unwrap_or_default()).join(".cache"),
+    };
+    base.join("agito").join("tui")
+}
+
+fn git_bytes(dir: &Path, args: &[&str]) -> Result<Vec<u8>> {
+    let output = Command::new("git")
+        .arg("-C")
+        .arg(dir)
+        .args(args)
+        .stdin(std::process::Stdio::null())
+        .output()
+        .context("Failed to run git")?;
+    if !output.status.success() {
+        let stderr = String::from_utf8_lossy(&output.stderr);
+        anyhow::bail!("{}", stderr.lines().last().unwrap_or("git failed").trim());
+    }
+    Ok(output.stdout)
+}
+
+fn git_output(dir: &Path, args: &[&str]) -> Result<String> {
+    Ok(String::from_utf8_lossy(&git_bytes(dir, args)?).to_string())
+}
+
+fn join(path: &str, name: &str) -> String {
+    match path {
+        "" => name.to_string(),
+        path => format!("{}/{}", path, name),
+    }
+}
+
+/// A ref without its `refs/heads/` or `refs/tags/`, or an abbreviated id
+fn short(rev: &str) -> &str {
+    if let Some(name) = rev
+        .strip_prefix("refs/heads/")
+        .or_else(|| rev.strip_prefix("refs/tags/"))
+    {
+        name
+    } else if rev.len() == 40 && rev.bytes().all(|b| b.is_ascii_hexdigit()) {
+        &rev[..12]
+    } else {
+        rev
+    }
+}
+
+fn lines(text: &str) -> Vec<String> {
+    text.lines().map(str::to_string).collect()
+}
+
+/// A line as it fits on the screen: tabs expanded, control characters
+/// dropped and cut at `width`
+fn fit(line: &str, width: usize) -> String {
+    line.replace('\t', "    ")
+        .chars()
+        .filter(|c| !c.is_control())
+        .take(width)
+        .collect()
+}
@@ -0,0 +1,243 @@
+use crate::{git, jobs};
+use serde::Serialize;
+use std::collections::{BTreeMap, HashSet};
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, RwLock};
+use std::time::Duration;
+
+/// Disk usage of a single bare repository
+#[derive(Clone, Debug, Default, Serialize)]
+pub struct RepoUsage {
+    /// Bytes allocated on disk for everything inside the repository directory
+    pub bytes: u64,
+    /// Part of `bytes` taken up by the object store (packs and loose objects)
+    pub objects_bytes: u64,
+    /// Object directories this repository borrows from via objects/info/alternates.
+    /// Their size is not included in `bytes`, so shared objects are only counted
+    /// once, in the repository that owns them. Not serialized, as the paths
+    /// reveal the server's filesystem layout.
+    #[serde(skip_serializing)]
+    pub alternates: Vec<PathBuf>,
+}
+
+/// Combined usage of the repositories in one namespace
+#[derive(Clone, Debug, Default, Serialize)]
+pub struct NamespaceUsage {
+    pub repos: usize,
+    pub bytes: u64,
+}
+
+/// Result of the most recent scan
+#[derive(Clone, Debug, Default, Serialize)]
+pub struct Snapshot {
+    /// Repository name (relative to the repositories directory) to usage
+    pub repos: BTreeMap<String, RepoUsage>,
+    /// Unix time the scan finished
+    pub scanned_at: Option<i64>,
+}
+
+impl Snapshot {
+    /// Total bytes used by all repositories
+    pub fn total(&self) -> u64 {
+        self.repos.values().map(|usage| usage.bytes).sum()
+    }
+
+    /// Usage grouped by namespace, the directory part of the repository name.
+    /// Repositories at the top level belong to the empty namespace.
+    pub fn namespaces(&self) -> BTreeMap<String, NamespaceUsage> {
+        let mut namespaces: BTreeMap<String, NamespaceUsage> = BTreeMap::new();
+        for (name, usage) in &self.repos {
+            let namespace = name.rsplit_once('/').map(|(ns, _)| ns).unwrap_or("");
+            let entry = namespaces.entry(namespace.to_string()).or_default();
+            entry.repos += 1;
+            entry.bytes += usage.bytes;
+        }
+        namespaces
+    }
+}
+
+/// Repository sizes, refreshed by a background scanner and shared with the
+/// web server
+#[derive(Clone, Default)]
+pub struct DiskUsage {
+    snapshot: Arc<RwLock<Snapshot>>,
+}
+
+impl DiskUsage {
+    /// Usage of one repository from the last scan
+    pub fn repo(&self, name: &str) -> Option<RepoUsage> {
+        self.snapshot.read().unwrap().repos.get(name).cloned()
+    }
+
+    /// Copy of the last scan
+    pub fn snapshot(&self) -> Snapshot {
+        self.snapshot.read().unwrap().clone()
+    }
+
+    /// Scan every repository below `repos_dir` and replace the snapshot
+    pub fn refresh(&self, repos_dir: &Path) -> io::Result<()> {
+        let snapshot = scan(repos_dir)?;
+        *self.snapshot.write().unwrap() = snapshot;
+        Ok(())
+    }
+
+    /// Measure one repository again, e.g. after a push, without waiting for the next scan
+    pub fn refresh_repo(&self, name: &str, repo_path: &Path) -> io::Result<()> {
+        let usage = scan_repo(repo_path)?;
+        self.snapshot
+            .write()
+            .unwrap()
+            .repos
+            .insert(name.to_string(), usage);
+        Ok(())
+    }
+
+    /// Rescan `repos_dir` every `interval` in the background
+    pub fn spawn_scanner(
+        &self,
+        repos_dir: PathBuf,
+        interval: Duration,
+    ) -> tokio::task::JoinHandle<()> {
+        let usage = self.clone();
+        jobs::spawn_periodic("disk_usage_scan", interval, move || {
+            usage.refresh(&repos_dir)?;
+            Ok(())
+        })
+    }
+}
+
+/// Measure every repository below `repos_dir`
+pub fn scan(repos_dir: &Path) -> io::Result<Snapshot> {
+    let mut snapshot = Snapshot::default();
+    for (name, path) in git::find_repositories(repos_dir)? {
+        match scan_repo(&path) {
+            Ok(usage) => {
+                snapshot.repos.insert(name, usage);
+            }
+            Err(e) => tracing::warn!("Failed to measure {}: {}", name, e),
+        }
+    }
+    snapshot.scanned_at = Some(chrono::Utc::now().timestamp());
+    Ok(snapshot)
+}
+
+/// Measure a single repository, like `du -s` without following symlinks
+pub fn scan_repo(repo_path: &Path) -> io::Result<RepoUsage> {
+    let mut seen = HashSet::new();
+    let objects = repo_path.join("objects");
+    let objects_bytes = if objects.is_dir() {
+        dir_size(&objects, None, &mut seen)?
+    } else {
+        0
+    };
+    let bytes = objects_bytes + dir_size(repo_path, Some("objects"), &mut seen)?;
+
+    Ok(RepoUsage {
+        bytes,
+        objects_bytes,
+        alternates: alternates(repo_path),
+    })
+}
+
+/// Object directories listed in objects/info/alternates, resolved against
+/// the objects directory as git does
+fn alternates(repo_path: &Path) -> Vec<PathBuf> {
+    let objects = repo_path.join("objects");
+    fs::read_to_string(objects.join("info").join("alternates"))
+        .unwrap_or_default()
+        .lines()
+        .map(|line| line.trim())
+        .filter(|line| !line.is_empty() && !line.starts_with('#'))
+        .map(|line| objects.join(line))
+        .collect()
+}
+
+/// Size of a directory's contents, optionally leaving out one top-level entry
+fn dir_size(dir: &Path, skip: Option<&str>, seen: &mut HashSet<(u64, u64)>) -> io::Result<u64> {
+    let mut total = 0;
+    for entry in fs::read_dir(dir)? {
+        let entry = entry?;
+        if skip.is_some_and(|skip| entry.file_name() == skip) {
+            continue;
+        }
+        total += entry_size(&entry.path(), seen)?;
+    }
+    Ok(total)
+}
+
+/// Bytes allocated for a file or directory tree
+pub fn path_size(path: &Path) -> io::Result<u64> {
+    entry_size(path, &mut HashSet::new())
+}
+
+fn entry_size(path: &Path, seen: &mut HashSet<(u64, u64)>) -> io::Result<u64> {
+    let metadata = fs::symlink_metadata(path)?;
+    if metadata.is_dir() {
+        return Ok(allocated(&metadata, seen) + dir_size(path, None, seen)?);
+    }
+    Ok(allocated(&metadata, seen))
+}
+
+/// Bytes allocated for a file, counting a hard-linked file (as left behind by
+/// local clones) only once per repository
+#[cfg(unix)]
+fn allocated(metadata: &fs::Metadata, seen: &mut HashSet<(u64, u64)>) -> u64 {
+    use std::os::unix::fs::MetadataExt;
+    if metadata.nlink() > 1 && !metadata.is_dir() && !seen.insert((metadata.dev(), metadata.ino()))
+    {
+        return 0;
+    }
+    metadata.blocks() * 512
+}
+
+#[cfg(not(unix))]
+fn allocated(metadata: &fs::Metadata, _seen: &mut HashSet<(u64, u64)>) -> u64 {
+    metadata.len()
+}
+
+/// Human-readable size using binary units, e.g. "12.3 MiB"
+pub fn format_bytes(bytes: u64) -> String {
+    const UNITS: &[&str] = &["KiB", "MiB", "GiB", "TiB"];
+    if bytes < 1024 {
+        return format!("{} B", bytes);
+    }
+    let mut value = bytes as f64;
+    let mut unit = "B";
+    for u in UNITS {
+        if value < 1024.0 {
+            break;
+        }
+        value /= 1024.0;
+        unit = u;
+    }
+    format!("{:.1} {}", value, unit)
+}
+
+/// Parse a size such as "500M", "2G" or "1048576" (bytes). Units are binary
+/// and may be written as K/KB/KiB and so on.
+pub fn parse_size(s: &str) -> Result<u64, String> {
+    let s = s.trim();
+    let split = s
+        .find(|c: char| !c.is_ascii_digit() && c != '.')
+        .unwrap_or(s.len());
+    let (number, unit) = s.split_at(split);
+    let number: f64 = number
+        .parse()
+        .map_err(|_| format!("invalid size '{}'", s))?;
+    let multiplier: u64 = match unit.trim().to_ascii_uppercase().as_str() {
+        "" | "B" => 1,
+        "K" | "KB" | "KIB" => 1 << 10,
+        "M" | "MB" | "MIB" => 1 << 20,
+        "G" | "GB" | "GIB" => 1 << 30,
+        "T" | "TB" | "TIB" => 1 << 40,
+        _ => {
+            return Err(format!(
+                "invalid size unit in '{}' (expected K, M, G or T)",
+                s
+            ))
+        }
+    };
+    Ok((number * multiplier as f64) as u64)
+}
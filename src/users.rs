@@ -0,0 +1,407 @@
+//! User accounts.
+//!
+//! Accounts live in `<data_dir>/users.json`, keyed by user name. A user signs
+//! in to the web interface with a password and pushes over SSH with the keys
+//! on their account; key-only accounts have no password. Depending on the
+//! server's [`Registration`] mode, people sign up themselves and wait for an
+//! admin to approve them. Users named in authorized_keys without an account
+//! keep working as before, but a pending or disabled account locks its user
+//! out everywhere.
+//!
+//! The first admin account is created with `agito-admin user add --admin`,
+//! or through the one-time bootstrap link the server logs while no admin
+//! account exists.
+
+use crate::{keys, namespaces, orgs, tokens};
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+use std::sync::Arc;
+
+/// PBKDF2 rounds for new password hashes
+const PASSWORD_ROUNDS: u32 = 100_000;
+
+/// Seconds a web session lasts
+pub const SESSION_TTL: i64 = 30 * 24 * 3600;
+
+/// Where an account stands
+#[derive(Clone, Copy, Debug, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum State {
+    /// Registered and waiting for an admin's approval
+    Pending,
+    Active,
+    /// Locked out by an admin
+    Disabled,
+}
+
+impl State {
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::Pending => "pending",
+            Self::Active => "active",
+            Self::Disabled => "disabled",
+        }
+    }
+}
+
+/// Who may create an account from the web interface
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq)]
+pub enum Registration {
+    /// Nobody; admins add accounts with `agito-admin user add`
+    Closed,
+    /// Anyone, but accounts stay pending until an admin approves them
+    #[default]
+    Approval,
+    /// Anyone, with immediately active accounts
+    Open,
+}
+
+impl FromStr for Registration {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "closed" => Ok(Self::Closed),
+            "approval" => Ok(Self::Approval),
+            "open" => Ok(Self::Open),
+            _ => Err(format!(
+                "unknown registration mode '{}' (expected closed, approval or open)",
+                s
+            )),
+        }
+    }
+}
+
+impl Registration {
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::Closed => "closed",
+            Self::Approval => "approval",
+            Self::Open => "open",
+        }
+    }
+}
+
+/// An account
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct User {
+    pub display_name: String,
+    pub email: String,
+    /// Password hash; None for key-only accounts
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub password: Option<String>,
+    /// SSH public keys in authorized_keys format, without options
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub keys: Vec<String>,
+    pub state: State,
+    /// May administer the server and every repository
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub admin: bool,
+    /// Unix time of registration
+    pub created: i64,
+}
+
+impl User {
+    pub fn new(display_name: &str, email: &str, state: State) -> Self {
+        Self {
+            display_name: display_name.trim().to_string(),
+            email: email.trim().to_string(),
+            password: None,
+            keys: Vec::new(),
+            state,
+            admin: false,
+            created: chrono::Utc::now().timestamp(),
+        }
+    }
+
+    pub fn is_active(&self) -> bool {
+        self.state == State::Active
+    }
+}
+
+fn users_path(data_dir: &Path) -> PathBuf {
+    data_dir.join("users.json")
+}
+
+/// All accounts, by user name
+pub fn load(data_dir: &Path) -> Result<BTreeMap<String, User>> {
+    let path = users_path(data_dir);
+    match fs::read_to_string(&path) {
+        Ok(content) => serde_json::from_str(&content)
+            .with_context(|| format!("Failed to parse {}", path.display())),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(BTreeMap::new()),
+        Err(e) => Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    }
+}
+
+fn save(data_dir: &Path, users: &BTreeMap<String, User>) -> Result<()> {
+    fs::create_dir_all(data_dir)?;
+    let path = users_path(data_dir);
+    let tmp = path.with_extension("json.tmp");
+    fs::write(&tmp, serde_json::to_string_pretty(users)?)?;
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        fs::set_permissions(&tmp, fs::Permissions::from_mode(0o600))?;
+    }
+    fs::rename(&tmp, &path)?;
+    Ok(())
+}
+
+pub fn get(data_dir: &Path, name: &str) -> Option<User> {
+    load(data_dir).ok()?.remove(name)
+}
+
+/// The name of the active account with an email address, such as a commit's
+/// author
+pub fn by_email(data_dir: &Path, email: &str) -> Option<String> {
+    load(data_dir)
+        .ok()?
+        .into_iter()
+        .find(|(_, user)| user.is_active() && user.email.eq_ignore_ascii_case(email.trim()))
+        .map(|(name, _)| name)
+}
+
+/// Add an account; fails if the name is taken or invalid
+pub fn create(data_dir: &Path, name: &str, user: User) -> Result<()> {
+    if !namespaces::valid_user(name) {
+        anyhow::bail!(
+            "Invalid user name '{}': use letters, digits, '-', '_' and '.'",
+            name
+        );
+    }
+    if !user.email.contains('@') {
+        anyhow::bail!("Invalid email address '{}'", user.email);
+    }
+    let mut users = load(data_dir)?;
+    if users.contains_key(name) || orgs::get(data_dir, name).is_some() {
+        anyhow::bail!("The user name {} is taken", name);
+    }
+    users.insert(name.to_string(), user);
+    save(data_dir, &users)
+}
+
+/// Change an account and save it, returning the result
+pub fn update(
+    data_dir: &Path,
+    name: &str,
+    change: impl FnOnce(&mut User) -> Result<()>,
+) -> Result<User> {
+    let mut users = load(data_dir)?;
+    let user = users
+        .get_mut(name)
+        .with_context(|| format!("No such user: {}", name))?;
+    change(user)?;
+    let user = user.clone();
+    save(data_dir, &users)?;
+    Ok(user)
+}
+
+/// Delete an account and revoke its tokens, so that an account later
+/// created under the same name doesn't inherit them. Repositories in the
+/// user's namespace and their memberships are left alone.
+pub fn remove(data_dir: &Path, name: &str) -> Result<User> {
+    let mut users = load(data_dir)?;
+    let user = users
+        .remove(name)
+        .with_context(|| format!("No such user: {}", name))?;
+    tokens::revoke_all(data_dir, name)?;
+    save(data_dir, &users)?;
+    Ok(user)
+}
+
+/// Whether a user has an active admin account
+pub fn is_admin(data_dir: &Path, name: &str) -> bool {
+    get(data_dir, name).map_or(false, |user| user.is_active() && user.admin)
+}
+
+/// Whether a user has an account that may not be used, because it is pending
+/// or disabled; users without an account are not locked out
+pub fn is_locked(data_dir: &Path, name: &str) -> bool {
+    get(data_dir, name).map_or(false, |user| !user.is_active())
+}
+
+/// Check a user's password, returning the account if it may sign in
+pub fn authenticate(data_dir: &Path, name: &str, password: &str) -> Result<User, String> {
+    let invalid = || "Invalid user name or password".to_string();
+    let user = get(data_dir, name).ok_or_else(invalid)?;
+    if !user
+        .password
+        .as_deref()
+        .map_or(false, |hash| verify_password(hash, password))
+    {
+        return Err(invalid());
+    }
+    match user.state {
+        State::Active => Ok(user),
+        State::Pending => Err("Your account is waiting for an admin's approval".to_string()),
+        State::Disabled => Err("Your account has been disabled".to_string()),
+    }
+}
+
+/// Hash a password for storing, as `pbkdf2-sha256$<rounds>$<salt>$<hash>`
+pub fn hash_password(password: &str) -> Result<String> {
+    if password.chars().count() < 8 {
+        anyhow::bail!("Passwords need at least 8 characters");
+    }
+    let salt = keys::random_bytes(16)?;
+    Ok(format!(
+        "pbkdf2-sha256${}${}${}",
+        PASSWORD_ROUNDS,
+        keys::hex(&salt),
+        keys::hex(&pbkdf2(password.as_bytes(), &salt, PASSWORD_ROUNDS))
+    ))
+}
+
+/// Whether `password` matches a hash made by [`hash_password`]
+pub fn verify_password(hash: &str, password: &str) -> bool {
+    let parts: Vec<&str> = hash.split('$').collect();
+    let (rounds, salt, expected) = match parts[..] {
+        ["pbkdf2-sha256", rounds, salt, expected] => (rounds, salt, expected),
+        _ => return false,
+    };
+    let (rounds, salt) = match (rounds.parse(), unhex(salt)) {
+        (Ok(rounds), Some(salt)) => (rounds, salt),
+        _ => return false,
+    };
+    keys::constant_time_eq(
+        keys::hex(&pbkdf2(password.as_bytes(), &salt, rounds)).as_bytes(),
+        expected.as_bytes(),
+    )
+}
+
+/// PBKDF2-HMAC-SHA256 with a single output block
+fn pbkdf2(password: &[u8], salt: &[u8], rounds: u32) -> [u8; 32] {
+    let mut block = salt.to_vec();
+    block.extend_from_slice(&1u32.to_be_bytes());
+    let mut u = keys::hmac_sha256(password, &block);
+    let mut out = u;
+    for _ in 1..rounds {
+        u = keys::hmac_sha256(password, &u);
+        for (o, b) in out.iter_mut().zip(u) {
+            *o ^= b;
+        }
+    }
+    out
+}
+
+fn unhex(s: &str) -> Option<Vec<u8>> {
+    (0..s.len())
+        .step_by(2)
+        .map(|i| u8::from_str_radix(s.get(i..i + 2)?, 16).ok())
+        .collect()
+}
+
+/// An SSH public key line as stored on an account: `<type> <base64>
+/// [comment]`, with anything after the comment's first word dropped
+pub fn normalize_key(line: &str) -> Result<String> {
+    let fields: Vec<&str> = line.split_whitespace().collect();
+    match fields[..] {
+        [_, base64, ..] if russh_keys::parse_public_key_base64(base64).is_ok() => {
+            Ok(fields[..fields.len().min(3)].join(" "))
+        }
+        _ => {
+            anyhow::bail!("Not an SSH public key; paste a line like 'ssh-ed25519 AAAA... you@host'")
+        }
+    }
+}
+
+/// Keys of active accounts, as (user, key)
+pub fn active_keys(data_dir: &Path) -> Vec<(String, String)> {
+    load(data_dir)
+        .unwrap_or_default()
+        .into_iter()
+        .filter(|(_, user)| user.is_active())
+        .flat_map(|(name, user)| user.keys.into_iter().map(move |key| (name.clone(), key)))
+        .collect()
+}
+
+fn bootstrap_path(data_dir: &Path) -> PathBuf {
+    data_dir.join("bootstrap.token")
+}
+
+/// Token for registering the first admin account, created while no active
+/// admin account exists; None once one does
+pub fn bootstrap_token(data_dir: &Path) -> Result<Option<String>> {
+    let path = bootstrap_path(data_dir);
+    if has_admin(data_dir) {
+        let _ = fs::remove_file(&path);
+        return Ok(None);
+    }
+    if !path.exists() {
+        fs::write(&path, keys::hex(&keys::random_bytes(16)?))
+            .with_context(|| format!("Failed to write {}", path.display()))?;
+    }
+    Ok(Some(fs::read_to_string(&path)?.trim().to_string()))
+}
+
+/// Whether `token` is the bootstrap token and no admin account is active yet
+pub fn valid_bootstrap(data_dir: &Path, token: &str) -> bool {
+    let matches = fs::read_to_string(bootstrap_path(data_dir)).map_or(false, |expected| {
+        !token.is_empty() && keys::constant_time_eq(expected.trim().as_bytes(), token.as_bytes())
+    });
+    matches && !has_admin(data_dir)
+}
+
+fn has_admin(data_dir: &Path) -> bool {
+    load(data_dir)
+        .map(|users| users.values().any(|user| user.is_active() && user.admin))
+        .unwrap_or(false)
+}
+
+/// Signs and checks web session cookies with a key kept in the data
+/// directory. Sessions end when they expire, when the account stops being
+/// active, and when its password changes.
+#[derive(Clone)]
+pub struct Sessions {
+    key: Arc<Vec<u8>>,
+    data_dir: PathBuf,
+}
+
+impl Sessions {
+    /// Load `<data_dir>/session.key`, generating a random key on first use
+    pub fn load_or_create(data_dir: &Path) -> Result<Self> {
+        let key = keys::load_or_create(&data_dir.join("session.key"))?;
+        Ok(Self {
+            key: Arc::new(key),
+            data_dir: data_dir.to_path_buf(),
+        })
+    }
+
+    /// Session for a signed-in user, valid for [`SESSION_TTL`] seconds
+    pub fn issue(&self, name: &str, user: &User) -> String {
+        let expires = chrono::Utc::now().timestamp() + SESSION_TTL;
+        format!("{}.{}.{}", name, expires, self.sign(name, user, expires))
+    }
+
+    /// The user a session belongs to, if it is still valid
+    pub fn verify(&self, token: &str) -> Option<String> {
+        let mut parts = token.rsplitn(3, '.');
+        let (signature, expires, name) = (parts.next()?, parts.next()?, parts.next()?);
+        let expires: i64 = expires.parse().ok()?;
+        if expires <= chrono::Utc::now().timestamp() {
+            return None;
+        }
+        let user = get(&self.data_dir, name).filter(User::is_active)?;
+        keys::constant_time_eq(
+            self.sign(name, &user, expires).as_bytes(),
+            signature.as_bytes(),
+        )
+        .then(|| name.to_string())
+    }
+
+    fn sign(&self, name: &str, user: &User, expires: i64) -> String {
+        let message = format!(
+            "{}\n{}\n{}",
+            name,
+            expires,
+            user.password.as_deref().unwrap_or("")
+        );
+        keys::hex(&keys::hmac_sha256(&self.key, message.as_bytes()))
+    }
+}
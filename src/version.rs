@@ -0,0 +1,216 @@
+//! Which release a server runs and which commands it understands, so a
+//! client can tell "the server is too old for this" apart from an error.
+//!
+//! Servers answer `agito-version` over SSH and `GET /api/v1/version` with
+//! their version and capabilities: the names of the `agito-*` SSH commands
+//! they understand, without the prefix. Servers from before capabilities
+//! were advertised only report their version through `agito-ping`, and are
+//! assumed to understand everything.
+
+use crate::git::split_server;
+use anyhow::{Context, Result};
+use std::path::PathBuf;
+use std::process::Command;
+use std::time::{Duration, SystemTime};
+
+/// This build's release
+pub const VERSION: &str = env!("CARGO_PKG_VERSION");
+
+/// The SSH commands this build's server understands
+pub const CAPABILITIES: &[&str] = &[
+    "bundle",
+    "ci",
+    "create-repo",
+    "deploy-key",
+    "grep",
+    "import",
+    "info",
+    "issue",
+    "list",
+    "log",
+    "merge",
+    "ping",
+    "pr",
+    "push-check",
+    "release",
+    "repo",
+    "set-default-branch",
+    "set-visibility",
+    "version",
+];
+
+/// How long a client trusts what it learned about a server before asking
+/// again. A capability missing from the cached answer is always asked again,
+/// so an upgraded server is noticed at once.
+const CACHE_TTL: Duration = Duration::from_secs(60 * 60);
+
+/// The reply to `agito-version`
+pub fn reply() -> String {
+    format!(
+        "version {}\ncapabilities {}\n",
+        VERSION,
+        CAPABILITIES.join(" ")
+    )
+}
+
+/// What a server said about itself
+pub struct ServerVersion {
+    /// Its release, if it said
+    pub version: Option<String>,
+    /// What it understands; `None` for servers too old to say
+    pub capabilities: Option<Vec<String>>,
+}
+
+impl ServerVersion {
+    /// Read an `agito-version` or `agito-ping` reply
+    pub fn parse(reply: &str) -> Self {
+        let mut server = ServerVersion {
+            version: None,
+            capabilities: None,
+        };
+        for line in reply.lines() {
+            match line.split_once(' ') {
+                Some(("version", version)) => server.version = Some(version.trim().to_string()),
+                Some(("capabilities", names)) => {
+                    server.capabilities =
+                        Some(names.split_whitespace().map(str::to_string).collect())
+                }
+                _ => {}
+            }
+        }
+        server
+    }
+
+    pub fn supports(&self, capability: &str) -> bool {
+        match &self.capabilities {
+            Some(capabilities) => capabilities.iter().any(|name| name == capability),
+            None => true,
+        }
+    }
+
+    /// Whether this client and the server are releases that work together
+    pub fn compatible(&self) -> bool {
+        self.version
+            .as_deref()
+            .map_or(true, |version| compatible(VERSION, version))
+    }
+
+    /// The server's release, for messages
+    pub fn describe(&self) -> &str {
+        self.version.as_deref().unwrap_or("an unknown version")
+    }
+}
+
+/// Whether two releases work together: the same major version, or for
+/// 0.x releases the same minor one
+pub fn compatible(a: &str, b: &str) -> bool {
+    let parts = |version: &str| -> Vec<u64> {
+        version
+            .split(['.', '-', '+'])
+            .take(2)
+            .map(|part| part.parse().unwrap_or(0))
+            .collect()
+    };
+    let (a, b) = (parts(a), parts(b));
+    match (a.first(), b.first()) {
+        (Some(0), Some(0)) => a.get(1) == b.get(1),
+        (major_a, major_b) => major_a == major_b,
+    }
+}
+
+/// Ask the server what it runs and understands
+pub fn remote(server: &str, user: &str) -> Result<ServerVersion> {
+    let reply = ssh(server, user, "agito-version")?;
+    match reply {
+        Some(reply) => Ok(ServerVersion::parse(&reply)),
+        // Older servers report their version, if anything, in the ping reply
+        None => Ok(ServerVersion::parse(
+            &ssh(server, user, "agito-ping")?.unwrap_or_default(),
+        )),
+    }
+}
+
+/// Make sure the server understands `capability` before running `command`,
+/// warning if it runs a release this client may not work with
+pub fn require(server: &str, user: &str, capability: &str, command: &str) -> Result<()> {
+    let cache = cache_path(server);
+    let cached = std::fs::metadata(&cache)
+        .and_then(|meta| meta.modified())
+        .ok()
+        .filter(|modified| {
+            SystemTime::now()
+                .duration_since(*modified)
+                .map_or(false, |age| age < CACHE_TTL)
+        })
+        .and_then(|_| std::fs::read_to_string(&cache).ok())
+        .map(|reply| ServerVersion::parse(&reply));
+    if let Some(cached) = cached {
+        if cached.capabilities.is_some() && cached.supports(capability) {
+            return Ok(());
+        }
+    }
+
+    let found = remote(server, user)?;
+    if let Some(capabilities) = &found.capabilities {
+        if let Some(parent) = cache.parent() {
+            let _ = std::fs::create_dir_all(parent);
+        }
+        let mut reply = format!("capabilities {}\n", capabilities.join(" "));
+        if let Some(version) = &found.version {
+            reply.push_str(&format!("version {}\n", version));
+        }
+        let _ = std::fs::write(&cache, reply);
+    }
+    if !found.compatible() {
+        eprintln!(
+            "warning: {} runs agito {} and this is agito {}; upgrade whichever is older",
+            server,
+            found.describe(),
+            VERSION
+        );
+    }
+    if !found.supports(capability) {
+        anyhow::bail!(
+            "{} runs agito {}, which does not support `agito {}`; it needs a newer agito-server",
+            server,
+            found.describe(),
+            command
+        );
+    }
+    Ok(())
+}
+
+/// Run an SSH command on the server; `None` if the server doesn't know it
+fn ssh(server: &str, user: &str, command: &str) -> Result<Option<String>> {
+    let (host, port) = split_server(server);
+    let output = Command::new("ssh")
+        .arg("-p")
+        .arg(port)
+        .arg(format!("{}@{}", user, host))
+        .arg(command)
+        .stderr(std::process::Stdio::inherit())
+        .output()
+        .context("Failed to execute ssh command")?;
+
+    let reply = String::from_utf8_lossy(&output.stdout).to_string();
+    if output.status.success() {
+        Ok(Some(reply))
+    } else if reply.starts_with("Unknown command") {
+        Ok(None)
+    } else if output.status.code() == Some(255) {
+        anyhow::bail!("Failed to connect to {}", server)
+    } else {
+        anyhow::bail!("{}", reply.trim())
+    }
+}
+
+/// Where what a server said about itself is kept between commands
+fn cache_path(server: &str) -> PathBuf {
+    let base = match std::env::var_os("XDG_CACHE_HOME") {
+        Some(dir) => PathBuf::from(dir),
+        None => PathBuf::from(std::env::var_os("HOME").unwrap_or_default()).join(".cache"),
+    };
+    base.join("agito")
+        .join("servers")
+        .join(server.replace([':', '/'], "_"))
+}
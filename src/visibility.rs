@@ -0,0 +1,147 @@
+//! Who may see a repository without being granted a role on it.
+//!
+//! A public repository can be read by anyone, including anonymous web
+//! visitors and HTTP clones; an internal one by every signed-in user; a
+//! private one only by those with a role. Pushing always needs a role: from
+//! the namespace's owner or organization, or as one of the repository's
+//! collaborators.
+//!
+//! The visibility is `agito.visibility` in the repository's git config.
+//! Repositories without one are public, except in organizations, which have
+//! always hidden their repositories from non-members. Collaborators are kept
+//! in `agito/collaborators.json`, by user.
+
+use crate::git;
+use crate::orgs::Role;
+use anyhow::{Context, Result};
+use std::collections::BTreeMap;
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+
+const CONFIG_KEY: &str = "agito.visibility";
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum Visibility {
+    /// Anyone may read it
+    Public,
+    /// Signed-in users may read it
+    Internal,
+    /// Only users with a role may read it
+    Private,
+}
+
+impl FromStr for Visibility {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "public" => Ok(Self::Public),
+            "internal" => Ok(Self::Internal),
+            "private" => Ok(Self::Private),
+            _ => Err(format!(
+                "unknown visibility '{}' (expected public, internal or private)",
+                s
+            )),
+        }
+    }
+}
+
+impl Visibility {
+    pub const ALL: [Visibility; 3] = [Self::Public, Self::Internal, Self::Private];
+
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::Public => "public",
+            Self::Internal => "internal",
+            Self::Private => "private",
+        }
+    }
+
+    /// What a user without a role may do: read public repositories, and
+    /// internal ones once signed in
+    pub fn floor(self, signed_in: bool) -> Option<Role> {
+        match self {
+            Self::Public => Some(Role::Read),
+            Self::Internal if signed_in => Some(Role::Read),
+            Self::Internal | Self::Private => None,
+        }
+    }
+}
+
+/// The visibility set on a repository, if any
+pub fn get(repo_path: &Path) -> Option<Visibility> {
+    let value = git::config_get(repo_path, CONFIG_KEY)?;
+    match value.parse() {
+        Ok(visibility) => Some(visibility),
+        Err(e) => {
+            // Fail closed on a value from a newer version or a typo
+            tracing::warn!("{}: {}", repo_path.display(), e);
+            Some(Visibility::Private)
+        }
+    }
+}
+
+/// The visibility a repository is treated as having: what is set, or the
+/// default for where it lives
+pub fn effective(repo_path: &Path, in_org: bool) -> Visibility {
+    get(repo_path).unwrap_or(if in_org {
+        Visibility::Private
+    } else {
+        Visibility::Public
+    })
+}
+
+pub fn set(repo_path: &Path, visibility: Visibility) -> Result<()> {
+    let output = git::run(repo_path, &["config", CONFIG_KEY, visibility.name()])?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "Failed to update {}: {}",
+            CONFIG_KEY,
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(())
+}
+
+fn collaborators_path(repo_path: &Path) -> PathBuf {
+    git::data_dir(repo_path).join("collaborators.json")
+}
+
+/// Users granted a role on the repository itself, by name
+pub fn collaborators(repo_path: &Path) -> Result<BTreeMap<String, Role>> {
+    let path = collaborators_path(repo_path);
+    match fs::read_to_string(&path) {
+        Ok(content) => serde_json::from_str(&content)
+            .with_context(|| format!("Failed to parse {}", path.display())),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(BTreeMap::new()),
+        Err(e) => Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    }
+}
+
+/// The role a user was granted on the repository, if any
+pub fn collaborator(repo_path: &Path, user: &str) -> Option<Role> {
+    match collaborators(repo_path) {
+        Ok(mut collaborators) => collaborators.remove(user),
+        Err(e) => {
+            tracing::warn!("{:#}", e);
+            None
+        }
+    }
+}
+
+/// Grant a user a role on the repository, or take it away with None
+pub fn set_collaborator(repo_path: &Path, user: &str, role: Option<Role>) -> Result<()> {
+    let mut collaborators = collaborators(repo_path)?;
+    match role {
+        Some(role) => collaborators.insert(user.to_string(), role),
+        None => collaborators.remove(user),
+    };
+    let path = collaborators_path(repo_path);
+    fs::create_dir_all(git::data_dir(repo_path))?;
+    let tmp = path.with_extension("json.tmp");
+    fs::write(&tmp, serde_json::to_string_pretty(&collaborators)?)?;
+    fs::rename(&tmp, &path).with_context(|| format!("Failed to write {}", path.display()))?;
+    Ok(())
+}
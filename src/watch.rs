@@ -0,0 +1,190 @@
+//! Email alerts for pushes to particular branches or tags.
+//!
+//! A watch names an address, a repository and a ref pattern such as
+//! `tags/v*`; every matching update in the repository's event stream is
+//! mailed to the address. Watches are kept in `<data_dir>/watches.json`, and
+//! the last event mailed for each repository in `agito/watch-cursor`.
+
+use crate::events::{self, RefUpdate};
+use crate::mail::Mailer;
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeSet;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+/// Commits listed in the mail for a branch update; the rest are only counted
+const MAX_COMMITS: usize = 20;
+
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Watch {
+    pub email: String,
+    /// Repository name relative to the repositories directory, with .git
+    pub repo: String,
+    /// Ref pattern, see [`events::ref_matches`]
+    pub refs: String,
+}
+
+fn watches_path(data_dir: &Path) -> PathBuf {
+    data_dir.join("watches.json")
+}
+
+/// All watches
+pub fn load(data_dir: &Path) -> Result<Vec<Watch>> {
+    let path = watches_path(data_dir);
+    match fs::read_to_string(&path) {
+        Ok(content) => serde_json::from_str(&content)
+            .with_context(|| format!("Failed to parse {}", path.display())),
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => Ok(Vec::new()),
+        Err(e) => Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    }
+}
+
+fn save(data_dir: &Path, watches: &[Watch]) -> Result<()> {
+    fs::create_dir_all(data_dir)?;
+    let path = watches_path(data_dir);
+    let tmp = path.with_extension("json.tmp");
+    fs::write(&tmp, serde_json::to_string_pretty(watches)?)?;
+    fs::rename(&tmp, &path)?;
+    Ok(())
+}
+
+/// Add a watch; returns false if the same one exists already
+pub fn add(data_dir: &Path, watch: Watch) -> Result<bool> {
+    let mut watches = load(data_dir)?;
+    if watches.contains(&watch) {
+        return Ok(false);
+    }
+    watches.push(watch);
+    save(data_dir, &watches)?;
+    Ok(true)
+}
+
+/// Point the watches on the repository `from` at its new name `to`
+pub fn rename_repo(data_dir: &Path, from: &str, to: &str) -> Result<()> {
+    let mut watches = load(data_dir)?;
+    if !watches.iter().any(|w| w.repo == from) {
+        return Ok(());
+    }
+    for watch in watches.iter_mut().filter(|w| w.repo == from) {
+        watch.repo = to.to_string();
+    }
+    save(data_dir, &watches)
+}
+
+/// Remove a watch; returns whether it existed
+pub fn remove(data_dir: &Path, watch: &Watch) -> Result<bool> {
+    let mut watches = load(data_dir)?;
+    let before = watches.len();
+    watches.retain(|w| w != watch);
+    if watches.len() == before {
+        return Ok(false);
+    }
+    save(data_dir, &watches)?;
+    Ok(true)
+}
+
+fn cursor_path(repo_path: &Path) -> PathBuf {
+    crate::git::data_dir(repo_path).join("watch-cursor")
+}
+
+/// ID of the last event mailed, or None before the first delivery
+fn cursor(repo_path: &Path) -> Option<u64> {
+    fs::read_to_string(cursor_path(repo_path))
+        .ok()
+        .and_then(|content| content.trim().parse().ok())
+}
+
+fn set_cursor(repo_path: &Path, id: u64) -> Result<()> {
+    let path = cursor_path(repo_path);
+    if let Some(dir) = path.parent() {
+        fs::create_dir_all(dir)?;
+    }
+    fs::write(&path, id.to_string())?;
+    Ok(())
+}
+
+/// Subject and plain-text body of the mail for one ref update
+pub fn render(repo: &str, repo_path: &Path, event: &RefUpdate) -> (String, String) {
+    let (subject, mut body) = describe(repo, repo_path, event);
+    body.push_str(&format!(
+        "You receive this because you watch {} in {} on agito.\n",
+        if event.is_tag() { "tags" } else { "branches" },
+        repo
+    ));
+    (subject, body)
+}
+
+/// Subject and body describing a ref update and the commits it brought in,
+/// without saying why the mail was sent
+pub fn describe(repo: &str, repo_path: &Path, event: &RefUpdate) -> (String, String) {
+    let subject = match (event.is_tag(), event.created()) {
+        (true, true) => format!("[agito] {}: new release {}", repo, event.short_name()),
+        _ => format!("[agito] {}: {}", repo, event.summary().to_lowercase()),
+    };
+
+    let mut body = format!("{} in {}", event.summary(), repo);
+    if let Some(pusher) = &event.pusher {
+        body.push_str(&format!(", pushed by {}", pusher));
+    }
+    body.push_str(".\n\n");
+
+    let message = events::tag_message(repo_path, event);
+    if !message.is_empty() {
+        body.push_str(&message);
+        body.push_str("\n\n");
+    }
+    let commits = events::new_commits(repo_path, event, MAX_COMMITS + 1);
+    for (hash, author, subject) in commits.iter().take(MAX_COMMITS) {
+        body.push_str(&format!("  {} {} ({})\n", hash, subject, author));
+    }
+    if commits.len() > MAX_COMMITS {
+        body.push_str("  ... and more\n");
+    }
+    if !commits.is_empty() {
+        body.push('\n');
+    }
+    (subject, body)
+}
+
+/// Mail every watcher the events recorded since the last run. A repository
+/// watched for the first time starts from its latest event rather than
+/// mailing its history. Returns the number of mails sent.
+pub fn deliver(repos_dir: &Path, data_dir: &Path, mailer: &Mailer) -> Result<usize> {
+    let watches = load(data_dir)?;
+    let repos: BTreeSet<&str> = watches.iter().map(|w| w.repo.as_str()).collect();
+    let mut sent = 0;
+
+    for repo in repos {
+        let repo_path = repos_dir.join(repo);
+        if !crate::git::is_repository(&repo_path) {
+            continue;
+        }
+        let after = match cursor(&repo_path) {
+            Some(after) => after,
+            None => {
+                set_cursor(&repo_path, events::latest_id(&repo_path))?;
+                continue;
+            }
+        };
+
+        for event in events::since(&repo_path, after) {
+            let mut rendered = None;
+            for watch in watches
+                .iter()
+                .filter(|w| w.repo == repo && events::ref_matches(&w.refs, &event.refname))
+            {
+                let (subject, body) =
+                    rendered.get_or_insert_with(|| render(repo, &repo_path, &event));
+                match mailer.send(&watch.email, subject, body) {
+                    Ok(()) => sent += 1,
+                    Err(e) => {
+                        tracing::warn!("Failed to send ref alert to {}: {:#}", watch.email, e)
+                    }
+                }
+            }
+            set_cursor(&repo_path, event.id)?;
+        }
+    }
+    Ok(sent)
+}
@@ -1,20 +1,148 @@
+use crate::archive;
+use crate::clone_urls::CloneUrls;
+use crate::config::{ReloadTrigger, Shared};
+use crate::federation::Federation;
+use crate::ip_access::Filter;
+use crate::git::{self, limits::Pools};
+use crate::hooks::Templates;
+use crate::lfs::Tokens;
+use crate::maintenance_mode;
+use crate::metrics;
+use crate::mirror;
+use crate::namespaces;
+use crate::pack_cache::PackCache;
+use crate::orgs::Role;
+use crate::preferences::DiffView;
+use crate::quota::{self, Quotas};
+use crate::rate_limit::Limiter;
+use crate::redirects::Resolver;
+use crate::signatures::{self, Signature, Verifier};
+use crate::stats::{self, Stats};
+use crate::topics;
+use crate::usage::{self, DiskUsage};
+use crate::users::{self, Registration, Sessions};
+use crate::version;
+use crate::visibility::{self, Visibility};
 use anyhow::Result;
 use axum::{
-    extract::{Path, State},
-    http::StatusCode,
-    response::{Html, IntoResponse, Response},
-    routing::get,
-    Router,
+    extract::{MatchedPath, Path, Query, Request, State},
+    http::{header, HeaderMap, StatusCode},
+    middleware::{self, Next},
+    response::{Html, IntoResponse, Redirect, Response},
+    routing::{delete, get, patch, post, put},
+    Form, Router,
 };
+use std::collections::{BTreeMap, HashMap};
 use std::fs;
+use std::net::SocketAddr;
 use std::path::PathBuf;
-use std::process::Command;
 use std::sync::Arc;
-use tower_http::services::ServeDir;
+use tower_http::compression::CompressionLayer;
+use tower_http::trace::TraceLayer;
+
+mod access_log;
+mod account;
+mod activity;
+mod assets;
+mod audit;
+mod auth;
+mod avatar;
+mod branches;
+mod builds;
+mod bundle;
+mod cgit;
+mod csrf;
+mod deploy_keys;
+mod diff;
+mod embed;
+mod federation;
+mod feed;
+mod host_keys;
+mod ip_access;
+mod issues;
+mod lfs;
+mod listing;
+mod markdown;
+mod merge;
+mod mirrors;
+mod notifications;
+mod orgs;
+mod pulls;
+mod push_check;
+mod rate_limit;
+mod releases;
+mod repos;
+mod resolve;
+mod request_id;
+mod reviews;
+mod robots;
+mod search;
+mod security_headers;
+mod settings;
+mod sitemap;
+mod smart_http;
+mod stars;
+mod stream;
+mod subscription;
+mod webhooks;
+
+pub use access_log::{AccessLog, AccessLogFormat, AccessLogOutput, RemoteUser};
+use assets::StaticAssets;
+pub use avatar::AvatarSource;
+pub use listing::Listing;
+pub use robots::RobotsPolicy;
+pub use sitemap::Sitemap;
+
+/// Largest file shown on a page; larger ones are only offered raw
+const MAX_DISPLAY_BYTES: usize = 1024 * 1024;
+
+/// Most of a diff shown on a page, cut at a whole line
+const MAX_DIFF_BYTES: usize = 2 * 1024 * 1024;
+
+/// Shown under a diff cut short at [`MAX_DIFF_BYTES`]
+const DIFF_TRUNCATED: &str =
+    "<p class=\"notice\">This diff is too large to show in full; the rest is left out.</p>\n";
 
 #[derive(Clone)]
 pub struct WebServer {
     repos_dir: PathBuf,
+    assets: StaticAssets,
+    access_log: AccessLog,
+    avatars: AvatarSource,
+    cgit_urls: bool,
+    disk_usage: DiskUsage,
+    data_dir: PathBuf,
+    auth_proxy_header: Option<String>,
+    quotas: Quotas,
+    robots: RobotsPolicy,
+    public_url: Option<String>,
+    clone_urls: CloneUrls,
+    lfs_tokens: Option<Tokens>,
+    sitemap: Option<Sitemap>,
+    resolver: Resolver,
+    listing: Listing,
+    signatures: Verifier,
+    divergence: branches::Divergence,
+    admins: Shared<Vec<String>>,
+    sessions: Option<Sessions>,
+    registration: Shared<Registration>,
+    federation: Option<Federation>,
+    rate_limiter: Limiter,
+    /// Caps on git run for requests, shared with the SSH server
+    git_pools: Pools,
+    /// Packs for clones over HTTP, shared with the SSH server
+    pack_cache: PackCache,
+    /// Client addresses allowed and denied
+    ip_filter: Filter,
+    reload: Option<ReloadTrigger>,
+    /// Serve /search from the indexes the server's indexer keeps
+    code_search: bool,
+    /// The SSH server's host keys, to publish their fingerprints
+    host_keys: Vec<PathBuf>,
+    /// Where repositories created through the API land, and how many
+    limits: namespaces::Limits,
+    hook_templates: Templates,
+    default_visibility: Visibility,
 }
 
 pub struct Repository {
@@ -23,80 +151,565 @@ pub struct Repository {
     description: String,
     last_commit: String,
     branches: Vec<String>,
+    archived: bool,
+    topics: Vec<String>,
+    /// The language most of its code is in, once its statistics are computed
+    language: Option<String>,
 }
 
 impl WebServer {
     pub fn new(repos_dir: PathBuf) -> Self {
-        Self { repos_dir }
+        Self {
+            resolver: Resolver {
+                repos_dir: repos_dir.clone(),
+                ..Default::default()
+            },
+            limits: namespaces::Limits {
+                repos_dir: repos_dir.clone(),
+                ..Default::default()
+            },
+            hook_templates: Templates {
+                repos_dir: repos_dir.clone(),
+                ..Default::default()
+            },
+            repos_dir,
+            assets: StaticAssets::load("web/static"),
+            access_log: AccessLog::default(),
+            avatars: AvatarSource::default(),
+            cgit_urls: false,
+            disk_usage: DiskUsage::default(),
+            data_dir: PathBuf::from("/var/lib/agito/data"),
+            auth_proxy_header: None,
+            quotas: Quotas::default(),
+            robots: RobotsPolicy::default(),
+            public_url: None,
+            clone_urls: CloneUrls::default(),
+            lfs_tokens: None,
+            sitemap: None,
+            listing: Listing::default(),
+            signatures: Verifier::default(),
+            divergence: branches::Divergence::default(),
+            admins: Shared::default(),
+            sessions: None,
+            registration: Shared::default(),
+            federation: None,
+            rate_limiter: Limiter::default(),
+            git_pools: Pools::default(),
+            pack_cache: PackCache::default(),
+            ip_filter: Filter::default(),
+            reload: None,
+            code_search: false,
+            host_keys: Vec::new(),
+            default_visibility: Visibility::Public,
+        }
+    }
+
+    /// Configure the HTTP access log
+    pub fn with_access_log(mut self, access_log: AccessLog) -> Self {
+        self.access_log = access_log;
+        self
+    }
+
+    /// Choose where author avatars are loaded from
+    pub fn with_avatars(mut self, avatars: AvatarSource) -> Self {
+        self.avatars = avatars;
+        self
+    }
+
+    /// Also accept cgit-style URLs, redirecting them to the agito equivalents
+    pub fn with_cgit_urls(mut self, enabled: bool) -> Self {
+        self.cgit_urls = enabled;
+        self
+    }
+
+    /// Show repository sizes from a background disk usage scanner
+    pub fn with_disk_usage(mut self, disk_usage: DiskUsage) -> Self {
+        self.disk_usage = disk_usage;
+        self
+    }
+
+    /// Directory for server-wide data such as notification inboxes
+    pub fn with_data_dir(mut self, data_dir: PathBuf) -> Self {
+        self.data_dir = data_dir;
+        self
+    }
+
+    /// Trust this request header, set by an authenticating reverse proxy, as the user name
+    pub fn with_auth_proxy_header(mut self, header: Option<String>) -> Self {
+        self.auth_proxy_header = header;
+        self
+    }
+
+    /// Show repository sizes against these quotas
+    pub fn with_quotas(mut self, quotas: Quotas) -> Self {
+        self.quotas = quotas;
+        self
+    }
+
+    /// Choose whether search engines may crawl repository pages
+    pub fn with_robots(mut self, robots: RobotsPolicy) -> Self {
+        self.robots = robots;
+        self
+    }
+
+    /// Base URL clients reach the web server at, for absolute links such as
+    /// LFS transfer URLs; otherwise taken from the request's Host header
+    pub fn with_public_url(mut self, url: Option<String>) -> Self {
+        self.public_url = url.map(|url| url.trim_end_matches('/').to_string());
+        self
+    }
+
+    /// Show repositories' clone URLs with the host and ports clients use
+    pub fn with_clone_urls(mut self, clone_urls: CloneUrls) -> Self {
+        self.clone_urls = clone_urls;
+        self
+    }
+
+    /// Accept LFS uploads authorized over SSH with tokens from this key
+    pub fn with_lfs_tokens(mut self, tokens: Tokens) -> Self {
+        self.lfs_tokens = Some(tokens);
+        self
+    }
+
+    /// Redirect repository URLs that use an old name or different case
+    pub fn with_resolver(mut self, resolver: Resolver) -> Self {
+        self.resolver = resolver;
+        self
+    }
+
+    /// Serve this sitemap at /sitemap.xml, unless crawling is denied
+    pub fn with_sitemap(mut self, sitemap: Sitemap) -> Self {
+        self.sitemap = Some(sitemap);
+        self
+    }
+
+    /// Choose which repositories the index lists
+    pub fn with_listing(mut self, listing: Listing) -> Self {
+        self.listing = listing;
+        self
+    }
+
+    /// Check commit and tag signatures against these keys
+    pub fn with_signatures(mut self, signatures: Verifier) -> Self {
+        self.signatures = signatures;
+        self
+    }
+
+    /// Users who may change the settings of every repository; the list can
+    /// change when the configuration is reloaded
+    pub fn with_admins(mut self, admins: Shared<Vec<String>>) -> Self {
+        self.admins = admins;
+        self
+    }
+
+    /// Let users sign in to their accounts with session cookies signed by
+    /// `sessions`, and register as `registration` allows
+    pub fn with_accounts(
+        mut self,
+        sessions: Sessions,
+        registration: Shared<Registration>,
+    ) -> Self {
+        self.sessions = Some(sessions);
+        self.registration = registration;
+        self
+    }
+
+    /// Serve repositories as ActivityPub actors, with WebFinger to find them
+    pub fn with_federation(mut self, federation: Federation) -> Self {
+        self.federation = Some(federation);
+        self
+    }
+
+    /// Limit each client's requests with `limiter`, shared with the SSH
+    /// server
+    pub fn with_rate_limiter(mut self, limiter: Limiter) -> Self {
+        self.rate_limiter = limiter;
+        self
+    }
+
+    /// Count the git run for requests in the web pool of `pools`, shared
+    /// with the SSH server
+    pub fn with_git_pools(mut self, pools: Pools) -> Self {
+        self.git_pools = pools;
+        self
     }
 
-    pub async fn start(self, port: &str) -> Result<()> {
-        let app = Router::new()
+    /// Build the packs of clones over HTTP through this cache
+    pub fn with_pack_cache(mut self, pack_cache: PackCache) -> Self {
+        self.pack_cache = pack_cache;
+        self
+    }
+
+    /// Turn away clients whose address `filter` refuses
+    pub fn with_ip_filter(mut self, filter: Filter) -> Self {
+        self.ip_filter = filter;
+        self
+    }
+
+    /// Let admins ask for a configuration reload through the API
+    pub fn with_reload(mut self, reload: ReloadTrigger) -> Self {
+        self.reload = Some(reload);
+        self
+    }
+
+    /// Offer code search; the repositories are indexed by
+    /// [`crate::search::spawn`]
+    pub fn with_code_search(mut self, enabled: bool) -> Self {
+        self.code_search = enabled;
+        self
+    }
+
+    /// Publish the fingerprints of the SSH server's host keys at these paths
+    pub fn with_host_keys(mut self, paths: Vec<PathBuf>) -> Self {
+        self.host_keys = paths;
+        self
+    }
+
+    /// Create repositories through the API under these limits, with hooks
+    /// from these templates and this visibility unless the request names one
+    pub fn with_repo_creation(
+        mut self,
+        limits: namespaces::Limits,
+        hook_templates: Templates,
+        default_visibility: Visibility,
+    ) -> Self {
+        self.limits = limits;
+        self.hook_templates = hook_templates;
+        self.default_visibility = default_visibility;
+        self
+    }
+
+    /// Serve on `listener`, bound to the HTTP port or passed in by systemd,
+    /// until `shutdown` completes; requests in flight are finished first
+    pub async fn start(
+        self,
+        listener: std::net::TcpListener,
+        shutdown: impl std::future::Future<Output = ()> + Send + 'static,
+    ) -> Result<()> {
+        let access_log = Arc::new(self.access_log.clone());
+        let cgit_urls = self.cgit_urls;
+        let server = Arc::new(self);
+
+        let mut router = Router::new()
             .route("/", get(handle_index))
             .route("/repo/:name", get(handle_repo))
-            .route("/repo/:name/*path", get(handle_repo))
-            .nest_service("/static", ServeDir::new("web/static"))
-            .with_state(Arc::new(self));
+            .route(
+                "/repo/:name/*path",
+                get(handle_repo_page).post(handle_repo_form),
+            )
+            .route("/static/*path", get(handle_static))
+            .route("/robots.txt", get(robots::handle))
+            .route("/sitemap.xml", get(sitemap::index))
+            .route("/sitemap/:page", get(sitemap::page))
+            .route("/avatar/:file", get(avatar::handle))
+            .route("/login", get(account::login_page).post(account::login))
+            .route("/logout", post(account::logout))
+            .route(
+                "/register",
+                get(account::register_page).post(account::register),
+            )
+            .route(
+                "/account",
+                get(account::account_page).post(account::save_account),
+            )
+            .route(
+                "/admin/users",
+                get(account::admin_page).post(account::admin_save),
+            )
+            .route("/admin/audit", get(audit::page))
+            .route("/org/:name", get(orgs::page).post(orgs::save))
+            .route("/notifications", get(notifications::page))
+            .route("/search", get(search::search_page))
+            .route("/activity", get(activity::page))
+            .route("/host-keys", get(host_keys::page))
+            .route(
+                "/notifications/read",
+                post(notifications::mark_all_read_form),
+            )
+            .route(
+                "/notifications/:id/read",
+                post(notifications::mark_read_form),
+            )
+            .route("/oembed", get(embed::oembed))
+            .route("/.well-known/webfinger", get(federation::webfinger))
+            .route("/ap/*path", get(federation::get).post(federation::post))
+            .route("/api/v1/usage", get(handle_api_usage))
+            .route("/api/v1/version", get(handle_api_version))
+            .route("/api/v1/host-keys", get(host_keys::api))
+            .route("/api/v1/admin/audit", get(audit::api))
+            .route("/api/v1/admin/reload", post(handle_api_reload))
+            .route("/api/v1/repos", get(repos::api_list).post(repos::api_create))
+            .route(
+                "/api/v1/repos/:name",
+                get(handle_api_repo).delete(repos::api_delete),
+            )
+            .route("/api/v1/repos/:name/quota", get(repos::api_quota))
+            .route("/api/v1/repos/:name/stats", get(repos::api_stats))
+            .route("/api/v1/repos/:name/branches", get(branches::api))
+            .route("/api/v1/repos/:name/merge", post(merge::api))
+            .route(
+                "/api/v1/repos/:name/issues",
+                get(issues::api_list).post(issues::api_create),
+            )
+            .route(
+                "/api/v1/repos/:name/issues/:number",
+                get(issues::api_get).patch(issues::api_update),
+            )
+            .route(
+                "/api/v1/repos/:name/issues/:number/comments",
+                post(issues::api_comment),
+            )
+            .route(
+                "/api/v1/repos/:name/pulls",
+                get(pulls::api_list).post(pulls::api_create),
+            )
+            .route(
+                "/api/v1/repos/:name/pulls/:number",
+                get(pulls::api_get).patch(pulls::api_update),
+            )
+            .route(
+                "/api/v1/repos/:name/pulls/:number/comments",
+                post(pulls::api_comment),
+            )
+            .route(
+                "/api/v1/repos/:name/pulls/:number/diff",
+                get(pulls::api_diff),
+            )
+            .route(
+                "/api/v1/repos/:name/pulls/:number/merge",
+                post(pulls::api_merge),
+            )
+            .route(
+                "/api/v1/repos/:name/pulls/:number/update-branch",
+                post(pulls::api_update_branch),
+            )
+            .route(
+                "/api/v1/repos/:name/pulls/:number/threads",
+                get(reviews::api_pull_list).post(reviews::api_pull_start),
+            )
+            .route(
+                "/api/v1/repos/:name/pulls/:number/threads/:thread",
+                patch(reviews::api_pull_change),
+            )
+            .route(
+                "/api/v1/repos/:name/pulls/:number/threads/:thread/replies",
+                post(reviews::api_pull_reply),
+            )
+            .route(
+                "/api/v1/repos/:name/commits/:id/threads",
+                get(reviews::api_commit_list).post(reviews::api_commit_start),
+            )
+            .route(
+                "/api/v1/repos/:name/commits/:id/threads/:thread",
+                patch(reviews::api_commit_change),
+            )
+            .route(
+                "/api/v1/repos/:name/commits/:id/threads/:thread/replies",
+                post(reviews::api_commit_reply),
+            )
+            .route(
+                "/api/v1/repos/:name/releases",
+                get(releases::api_list).post(releases::api_create),
+            )
+            .route(
+                "/api/v1/repos/:name/releases/:tag",
+                get(releases::api_get)
+                    .patch(releases::api_update)
+                    .delete(releases::api_delete),
+            )
+            .route(
+                "/api/v1/repos/:name/releases/:tag/assets",
+                post(releases::api_upload),
+            )
+            .route(
+                "/api/v1/repos/:name/releases/:tag/assets/:asset",
+                delete(releases::api_delete_asset),
+            )
+            .route("/api/v1/repos/:name/builds", get(builds::api_list))
+            .route("/api/v1/repos/:name/builds/:id", get(builds::api_get))
+            .route("/api/v1/repos/:name/builds/:id/log", get(builds::api_log))
+            .route(
+                "/api/v1/repos/:name/builds/:id/retry",
+                post(builds::api_retry),
+            )
+            .route(
+                "/api/v1/repos/:name/statuses/:rev",
+                get(builds::api_statuses).post(builds::api_report_status),
+            )
+            .route(
+                "/api/v1/repos/:name/hooks",
+                get(webhooks::api_list).post(webhooks::api_create),
+            )
+            .route(
+                "/api/v1/repos/:name/hooks/:id",
+                delete(webhooks::api_delete),
+            )
+            .route(
+                "/api/v1/repos/:name/hooks/:id/deliveries",
+                get(webhooks::api_deliveries),
+            )
+            .route(
+                "/api/v1/repos/:name/hooks/:id/deliveries/:delivery",
+                get(webhooks::api_delivery),
+            )
+            .route(
+                "/api/v1/repos/:name/hooks/:id/deliveries/:delivery/redeliver",
+                post(webhooks::api_redeliver),
+            )
+            .route("/api/v1/repos/:name/mirrors", get(handle_api_mirrors))
+            .route("/api/v1/repos/:name/push-check", post(push_check::api))
+            .route("/api/v1/notifications", get(notifications::api_list))
+            .route("/api/v1/starred", get(stars::api_starred))
+            .route("/api/v1/search/code", get(search::api))
+            .route("/api/v1/repos/:name/stars", get(stars::api_list))
+            .route(
+                "/api/v1/repos/:name/topics",
+                get(settings::api_topics).put(settings::api_set_topics),
+            )
+            .route(
+                "/api/v1/repos/:name/star",
+                put(stars::api_star).delete(stars::api_unstar),
+            )
+            .route(
+                "/api/v1/repos/:name/subscription",
+                get(subscription::api_get)
+                    .put(subscription::api_set)
+                    .delete(subscription::api_delete),
+            )
+            .route(
+                "/api/v1/notifications/read",
+                post(notifications::api_mark_all_read),
+            )
+            .route(
+                "/api/v1/notifications/:id/read",
+                post(notifications::api_mark_read),
+            )
+            .route("/metrics", get(handle_metrics))
+            .route("/:repo/info/refs", get(smart_http::info_refs))
+            .route("/:repo/git-upload-pack", post(smart_http::upload_pack))
+            .route("/:repo/git-receive-pack", post(smart_http::receive_pack))
+            .route("/:repo/:name/info/refs", get(smart_http::info_refs))
+            .route("/:repo/:name/git-upload-pack", post(smart_http::upload_pack))
+            .route("/:repo/:name/git-receive-pack", post(smart_http::receive_pack))
+            .merge(lfs::routes());
+
+        if cgit_urls {
+            router = router.fallback(cgit::handle);
+        }
+
+        let app = router
+            .layer(middleware::from_fn_with_state(
+                server.clone(),
+                rate_limit::git_pools,
+            ))
+            .layer(middleware::from_fn_with_state(
+                server.clone(),
+                resolve::middleware,
+            ))
+            .layer(middleware::from_fn(track_metrics))
+            .layer(middleware::from_fn_with_state(
+                server.clone(),
+                robots::middleware,
+            ))
+            .layer(middleware::from_fn_with_state(server.clone(), csrf::middleware))
+            .layer(middleware::from_fn_with_state(
+                server.clone(),
+                rate_limit::middleware,
+            ))
+            .layer(middleware::from_fn_with_state(
+                server.clone(),
+                auth::middleware,
+            ))
+            .layer(middleware::from_fn_with_state(
+                server.clone(),
+                ip_access::middleware,
+            ))
+            .layer(middleware::from_fn(security_headers::middleware))
+            .layer(middleware::from_fn_with_state(
+                access_log,
+                access_log::middleware,
+            ))
+            .layer(CompressionLayer::new())
+            .layer(TraceLayer::new_for_http().make_span_with(request_id::make_span))
+            .layer(middleware::from_fn(request_id::middleware))
+            .with_state(server);
 
-        let addr = format!("0.0.0.0:{}", port);
+        let listener = tokio::net::TcpListener::from_std(listener)?;
+        let addr = listener.local_addr()?;
         tracing::info!("Web server listening on {}", addr);
-        tracing::info!("Visit http://localhost:{} to view repositories", port);
+        tracing::info!("Visit http://localhost:{} to view repositories", addr.port());
 
-        let listener = tokio::net::TcpListener::bind(&addr).await?;
-        axum::serve(listener, app).await?;
+        axum::serve(
+            listener,
+            app.into_make_service_with_connect_info::<SocketAddr>(),
+        )
+        .with_graceful_shutdown(shutdown)
+        .await?;
 
         Ok(())
     }
 
+    /// The repositories the index lists to the current user, by name and path
+    fn listed_repositories(&self) -> Result<Vec<(String, PathBuf)>> {
+        let mut repos = git::find_repositories(&self.repos_dir)?;
+        // The web viewer only serves top-level repositories
+        repos.retain(|(name, _)| {
+            !name.contains('/') && self.listing.shows(name) && self.role(name).is_some()
+        });
+        Ok(repos)
+    }
+
     fn list_repositories(&self) -> Result<Vec<Repository>> {
         let mut repos = Vec::new();
 
-        let entries = fs::read_dir(&self.repos_dir)?;
-
-        for entry in entries {
-            let entry = entry?;
-            if !entry.file_type()?.is_dir() {
-                continue;
-            }
-
-            let repo_path = entry.path();
-
-            // Check if it's a git repository
-            if !repo_path.join("HEAD").exists() {
-                continue;
-            }
-
+        for (name, repo_path) in self.listed_repositories()? {
             let mut repo = Repository {
-                name: entry.file_name().to_string_lossy().to_string(),
+                name,
                 path: repo_path.clone(),
                 description: String::new(),
                 last_commit: String::new(),
                 branches: Vec::new(),
+                archived: archive::is_archived(&repo_path),
+                topics: topics::get(&repo_path),
+                language: None,
             };
 
             // Get description
             let desc_path = repo_path.join("description");
             if let Ok(desc) = fs::read_to_string(&desc_path) {
                 let desc = desc.trim().to_string();
-                if desc != "Unnamed repository; edit this file 'description' to name the repository."
+                if desc
+                    != "Unnamed repository; edit this file 'description' to name the repository."
                 {
                     repo.description = desc;
                 }
             }
 
-            // Get last commit info
-            let output = Command::new("git")
-                .arg("-C")
-                .arg(&repo_path)
-                .arg("log")
-                .arg("-1")
-                .arg("--format=%h - %s (%cr)")
-                .output();
-
-            if let Ok(output) = output {
-                if output.status.success() {
-                    repo.last_commit = String::from_utf8_lossy(&output.stdout).trim().to_string();
+            // Get last commit info, from the statistics once they are
+            // computed so the index needn't ask git for every repository
+            let last_commit = match stats::get(&repo_path) {
+                Some(stats) => {
+                    repo.language = stats.language().map(str::to_string);
+                    stats
+                        .last_commit
+                        .map(|commit| (commit.id, commit.subject, commit.time))
                 }
+                None => git::batch::pool()
+                    .commit(&repo_path, "HEAD")
+                    .ok()
+                    .flatten()
+                    .map(|commit| {
+                        let subject = commit.subject().to_string();
+                        (commit.id, subject, commit.committer_time)
+                    }),
+            };
+            if let Some((id, subject, time)) = last_commit {
+                repo.last_commit = format!(
+                    "{} - {} ({})",
+                    &id[..7.min(id.len())],
+                    html_escape(&subject),
+                    relative_time(time)
+                );
             }
 
             repos.push(repo);
@@ -106,118 +719,388 @@ impl WebServer {
     }
 
     fn get_branches(&self, repo_path: &PathBuf) -> Result<Vec<String>> {
-        let output = Command::new("git")
-            .arg("-C")
-            .arg(repo_path)
-            .arg("branch")
-            .arg("-a")
-            .output()?;
+        Ok(git::branches(repo_path)?)
+    }
 
-        if !output.status.success() {
+    fn get_commits(&self, repo_path: &PathBuf, rev: &str, limit: usize) -> Result<Vec<CommitInfo>> {
+        if rev.starts_with('-') {
             return Ok(Vec::new());
         }
 
-        let branches: Vec<String> = String::from_utf8_lossy(&output.stdout)
-            .lines()
-            .map(|line| {
-                line.trim()
-                    .trim_start_matches("* ")
-                    .to_string()
+        let log = git::batch::pool().log(repo_path, rev, limit)?;
+        let ids: Vec<&str> = log.iter().map(|commit| commit.id.as_str()).collect();
+        let mut signatures = self.signatures.commits(repo_path, &ids);
+
+        let commits = log
+            .into_iter()
+            .map(|commit| CommitInfo {
+                hash: commit.id[..8.min(commit.id.len())].to_string(),
+                author: commit.author_name,
+                email: commit.author_email,
+                date: relative_time(commit.author_time),
+                message: commit.message.lines().next().unwrap_or("").to_string(),
+                signature: signatures.remove(&commit.id).unwrap_or_default(),
+                id: commit.id,
             })
-            .filter(|line| !line.is_empty() && !line.contains("->"))
             .collect();
 
-        Ok(branches)
+        Ok(commits)
     }
 
-    fn get_commits(&self, repo_path: &PathBuf, limit: usize) -> Result<Vec<CommitInfo>> {
-        let output = Command::new("git")
-            .arg("-C")
-            .arg(repo_path)
-            .arg("log")
-            .arg(format!("--max-count={}", limit))
-            .arg("--format=%H|%an|%ar|%s")
-            .output()?;
+    fn list_files(&self, repo_path: &PathBuf, branch: &str, path: &str) -> Result<Vec<FileInfo>> {
+        let tree_path = format!("{}:{}", branch, path);
+        let files = git::batch::pool()
+            .tree(repo_path, &tree_path)?
+            .unwrap_or_default()
+            .into_iter()
+            .map(|entry| FileInfo {
+                name: entry.name,
+                file_type: entry.kind.to_string(),
+            })
+            .collect();
+
+        Ok(files)
+    }
+
+    fn get_file_content(&self, repo_path: &PathBuf, branch: &str, path: &str) -> Result<String> {
+        let content = self.get_blob(repo_path, branch, path)?;
+        Ok(String::from_utf8_lossy(&content).to_string())
+    }
+
+    /// A file's content, unless it is too large to show
+    fn get_blob(&self, repo_path: &PathBuf, rev: &str, path: &str) -> Result<Vec<u8>> {
+        let blob_path = format!("{}:{}", rev, path);
+        match self.blob_size(repo_path, rev, path) {
+            Some(size) if size > MAX_DISPLAY_BYTES => {
+                anyhow::bail!("File too large to display ({} bytes)", size)
+            }
+            Some(_) => {}
+            None => anyhow::bail!("Failed to get file content"),
+        }
+        match git::batch::pool().read(repo_path, &blob_path)? {
+            Some(object) if object.kind == "blob" => Ok(object.data),
+            _ => anyhow::bail!("Failed to get file content"),
+        }
+    }
+
+    /// Size of the file at a path, or None if there is no file
+    fn blob_size(&self, repo_path: &PathBuf, rev: &str, path: &str) -> Option<usize> {
+        match git::batch::pool().check(repo_path, &format!("{}:{}", rev, path)) {
+            Ok(Some(object)) if object.kind == "blob" => Some(object.size),
+            _ => None,
+        }
+    }
+
+    /// Object type ("tree", "blob", ...) at a path, or None if it doesn't exist
+    fn object_type(&self, repo_path: &PathBuf, rev: &str, path: &str) -> Option<String> {
+        git::batch::pool()
+            .check(repo_path, &format!("{}:{}", rev, path))
+            .ok()?
+            .map(|object| object.kind)
+    }
+
+    /// Whether a user is a server admin, named with `--admin` or by their
+    /// account. Requests made with an access token need its admin scope.
+    fn is_admin(&self, user: &str) -> bool {
+        (self.admins.get().iter().any(|admin| admin == user) || users::is_admin(&self.data_dir, user))
+            && auth::scope_allows(Role::Admin)
+    }
+
+    /// What the signed-in user may do with a repository, named relative to
+    /// the repositories directory; see [`crate::orgs::role`]. Server admins
+    /// administer every repository, and anonymous visitors may read public
+    /// ones. An access token's scope caps the role.
+    fn role(&self, repo_name: &str) -> Option<Role> {
+        let user = auth::current_user();
+        let role = match user.as_deref() {
+            Some(user) if self.is_admin(user) => Some(Role::Admin),
+            user => crate::orgs::role(&self.data_dir, &self.repos_dir, repo_name, user),
+        };
+        role.map(|role| auth::token_scope().map_or(role, |scope| role.min(scope)))
+    }
+
+    /// Whether the signed-in user has at least the `needed` role on the
+    /// repository at `repo_path`
+    fn has_role(&self, repo_path: &PathBuf, needed: Role) -> bool {
+        let name = match repo_path.strip_prefix(&self.repos_dir) {
+            Ok(name) => name.to_string_lossy(),
+            Err(_) => return false,
+        };
+        auth::current_user().is_some() && self.role(&name).map_or(false, |role| role >= needed)
+    }
+
+    /// Whether the signed-in user may change a repository's settings: server
+    /// admins, the owner of the namespace the repository lives in, and those
+    /// with the admin role in an organization
+    fn may_administer(&self, repo_path: &PathBuf) -> bool {
+        self.has_role(repo_path, Role::Admin)
+    }
+
+    /// Branch that HEAD points to, used when a page doesn't name a ref
+    fn default_branch(&self, repo_path: &PathBuf) -> String {
+        git::head_branch(repo_path).unwrap_or_else(|| "master".to_string())
+    }
+
+    /// Check whether a revision resolves to a commit
+    fn rev_exists(&self, repo_path: &PathBuf, rev: &str) -> bool {
+        if rev.is_empty() || rev.starts_with('-') {
+            return false;
+        }
+
+        matches!(
+            git::batch::pool().check(repo_path, &format!("{}^{{commit}}", rev)),
+            Ok(Some(object)) if object.kind == "commit"
+        )
+    }
+
+    /// Split `<ref>/<path>` into its parts. Refs may contain slashes, so the
+    /// longest prefix that names a commit wins.
+    fn split_ref_path(&self, repo_path: &PathBuf, rest: &str) -> Option<(String, String)> {
+        let segments: Vec<&str> = rest.trim_matches('/').split('/').collect();
+
+        for i in (1..=segments.len()).rev() {
+            let rev = segments[..i].join("/");
+            if self.rev_exists(repo_path, &rev) {
+                return Some((rev, segments[i..].join("/")));
+            }
+        }
+
+        None
+    }
+
+    fn get_commit(&self, repo_path: &PathBuf, rev: &str) -> Result<CommitDetail> {
+        if !self.rev_exists(repo_path, rev) {
+            anyhow::bail!("Unknown revision: {}", rev);
+        }
+
+        let output = git::run(
+            repo_path,
+            &[
+                "log",
+                "-1",
+                "--format=%H%x00%an%x00%ae%x00%ar%x00%P%x00%B",
+                rev,
+                "--",
+            ],
+        )?;
 
         if !output.status.success() {
-            return Ok(Vec::new());
+            anyhow::bail!("Failed to read commit");
+        }
+
+        let stdout = String::from_utf8_lossy(&output.stdout);
+        let fields: Vec<&str> = stdout.splitn(6, '\0').collect();
+        if fields.len() < 6 {
+            anyhow::bail!("Unexpected git log output");
+        }
+
+        let (output, diff_truncated) = git::run_capped(
+            repo_path,
+            &[
+                "show",
+                "--format=",
+                "--stat",
+                "--patch",
+                "--no-color",
+                fields[0],
+            ],
+            MAX_DIFF_BYTES,
+        )?;
+
+        Ok(CommitDetail {
+            signature: self
+                .signatures
+                .commits(repo_path, &[fields[0]])
+                .remove(fields[0])
+                .unwrap_or_default(),
+            id: fields[0].to_string(),
+            author: fields[1].to_string(),
+            email: fields[2].to_string(),
+            date: fields[3].to_string(),
+            parents: fields[4]
+                .split_whitespace()
+                .map(|p| p.to_string())
+                .collect(),
+            message: fields[5].trim_end().to_string(),
+            diff: String::from_utf8_lossy(&output.stdout).to_string(),
+            diff_truncated,
+        })
+    }
+
+    /// Tags, newest first, with the commit each points to
+    fn get_tags(&self, repo_path: &PathBuf, pattern: &str, limit: usize) -> Result<Vec<TagInfo>> {
+        let output = git::run(
+            repo_path,
+            &[
+                "for-each-ref",
+                "--sort=-creatordate",
+                &format!("--count={}", limit),
+                "--format=%(refname:lstrip=2)%00%(objecttype)%00%(objectname)%00%(*objectname)%00%(creatordate:unix)%00%(if)%(taggername)%(then)%(taggername)%(else)%(authorname)%(end)%00%(if)%(contents:signature)%(then)signed%(end)%00%(contents:subject)",
+                pattern,
+            ],
+        )?;
+        if !output.status.success() {
+            anyhow::bail!("Failed to list tags");
         }
 
-        let commits: Vec<CommitInfo> = String::from_utf8_lossy(&output.stdout)
+        let tags = String::from_utf8_lossy(&output.stdout)
             .lines()
             .filter_map(|line| {
-                let parts: Vec<&str> = line.splitn(4, '|').collect();
-                if parts.len() == 4 {
-                    Some(CommitInfo {
-                        hash: parts[0][..8.min(parts[0].len())].to_string(),
-                        author: parts[1].to_string(),
-                        date: parts[2].to_string(),
-                        message: parts[3].to_string(),
-                    })
-                } else {
-                    None
+                let fields: Vec<&str> = line.splitn(8, '\0').collect();
+                if fields.len() < 8 {
+                    return None;
                 }
+                let annotated = fields[1] == "tag";
+                Some(TagInfo {
+                    name: fields[0].to_string(),
+                    commit: if annotated { fields[3] } else { fields[2] }.to_string(),
+                    date: relative_time(fields[4].parse().unwrap_or(0)),
+                    tagger: fields[5].to_string(),
+                    message: if annotated { fields[7] } else { "" }.to_string(),
+                    signature: if fields[6] == "signed" {
+                        self.signatures.tag(repo_path, fields[0])
+                    } else {
+                        Signature::default()
+                    },
+                })
             })
             .collect();
+        Ok(tags)
+    }
 
-        Ok(commits)
+    /// Link tag for web/static/custom.css, which operators can use to restyle the viewer
+    fn custom_stylesheet(&self) -> String {
+        self.assets
+            .url("custom.css")
+            .map(|url| format!(r#"<link rel="stylesheet" href="{}">"#, url))
+            .unwrap_or_default()
     }
 
-    fn list_files(&self, repo_path: &PathBuf, branch: &str, path: &str) -> Result<Vec<FileInfo>> {
-        let tree_path = format!("{}:{}", branch, path);
-        let output = Command::new("git")
-            .arg("-C")
-            .arg(repo_path)
-            .arg("ls-tree")
-            .arg(&tree_path)
-            .output()?;
+    /// Commit authors reachable from a revision, most active first
+    fn get_contributors(&self, repo_path: &PathBuf, rev: &str) -> Result<Vec<Contributor>> {
+        if rev.starts_with('-') {
+            return Ok(Vec::new());
+        }
+
+        let output = git::run(
+            repo_path,
+            &["shortlog", "--summary", "--numbered", "--email", rev, "--"],
+        )?;
 
         if !output.status.success() {
             return Ok(Vec::new());
         }
 
-        let files: Vec<FileInfo> = String::from_utf8_lossy(&output.stdout)
+        let contributors = String::from_utf8_lossy(&output.stdout)
             .lines()
             .filter_map(|line| {
-                let parts: Vec<&str> = line.split_whitespace().collect();
-                if parts.len() >= 4 {
-                    let file_type = parts[1];
-                    let name = parts[3..].join(" ");
-                    Some(FileInfo {
-                        name,
-                        file_type: file_type.to_string(),
-                    })
-                } else {
-                    None
-                }
+                let (count, who) = line.trim().split_once('\t')?;
+                let (name, email) = who.rsplit_once(" <")?;
+                Some(Contributor {
+                    name: name.to_string(),
+                    email: email.trim_end_matches('>').to_string(),
+                    commits: count.trim().parse().ok()?,
+                })
             })
             .collect();
 
-        Ok(files)
+        Ok(contributors)
     }
 
-    fn get_file_content(&self, repo_path: &PathBuf, branch: &str, path: &str) -> Result<String> {
-        let blob_path = format!("{}:{}", branch, path);
-        let output = Command::new("git")
-            .arg("-C")
-            .arg(repo_path)
-            .arg("show")
-            .arg(&blob_path)
-            .output()?;
+    /// Resolve a repository name from a URL to its directory: a top-level
+    /// repository, or one in a namespace (`<namespace>/<name>`). Repositories
+    /// the signed-in user may not read are not found.
+    fn repo_path(&self, name: &str) -> Option<PathBuf> {
+        let valid = |part: &str| !part.is_empty() && !part.starts_with('.') && !part.contains('\\');
+        let valid = match name.split_once('/') {
+            Some((namespace, repo)) => {
+                namespaces::valid_user(namespace) && valid(repo) && !repo.contains('/')
+            }
+            None => valid(name),
+        };
+        if !valid {
+            return None;
+        }
 
-        if !output.status.success() {
-            anyhow::bail!("Failed to get file content");
+        let path = self.repos_dir.join(name);
+        if git::is_repository(&path) && self.role(name).is_some() {
+            Some(path)
+        } else {
+            None
+        }
+    }
+
+    /// Split the name and page of a `/repo/<name>/<page>` URL, where pages of
+    /// repositories in a namespace come as `/repo/<namespace>/<name>/<page>`
+    fn find_repo_page(&self, name: &str, page: &str) -> Option<(String, PathBuf, String)> {
+        if let Some(path) = self.repo_path(name) {
+            return Some((name.to_string(), path, page.to_string()));
+        }
+        let (repo, page) = page.split_once('/').unwrap_or((page, ""));
+        let name = format!("{}/{}", name, repo);
+        let path = self.repo_path(&name)?;
+        Some((name, path, page.to_string()))
+    }
+
+    /// Resolve a repository name from a URL that may be an old name or differ
+    /// in case, returning the repository's current name and directory
+    fn resolve_repo(&self, name: &str) -> Option<(String, PathBuf)> {
+        if let Some(path) = self.repo_path(name) {
+            return Some((name.to_string(), path));
+        }
+        let found = self.resolver.resolve(name)?;
+        let path = self.repo_path(&found)?;
+        Some((found, path))
+    }
+
+    /// A repository's name relative to the repositories directory, as
+    /// subscriptions and stars store it
+    fn stored_name(&self, repo_path: &PathBuf) -> Option<String> {
+        repo_path
+            .strip_prefix(&self.repos_dir)
+            .ok()
+            .map(|name| name.to_string_lossy().into_owned())
+    }
+
+    /// Contents of the repository's description file, unless it's git's placeholder
+    fn description(&self, repo_path: &PathBuf) -> String {
+        let description = fs::read_to_string(repo_path.join("description"))
+            .unwrap_or_default()
+            .trim()
+            .to_string();
+        if description == "Unnamed repository; edit this file 'description' to name the repository."
+        {
+            String::new()
+        } else {
+            description
         }
+    }
 
-        Ok(String::from_utf8_lossy(&output.stdout).to_string())
+    /// The URLs a repository can be cloned from, by protocol
+    fn clone_urls(&self, repo_name: &str, repo_path: &PathBuf) -> Vec<(&'static str, String)> {
+        let public = crate::orgs::is_public(&self.data_dir, &self.repos_dir, repo_name);
+        self.clone_urls.all(repo_name, repo_path, public)
     }
 
-    fn get_readme(&self, repo_path: &PathBuf, branch: &str) -> Option<String> {
-        let readme_names = ["README.md", "README", "Readme.md", "readme.md"];
+    /// The README of a directory at a revision, as its name and content
+    fn get_readme(&self, repo_path: &PathBuf, rev: &str, dir: &str) -> Option<(String, String)> {
+        let readme_names = [
+            "README.md",
+            "README.markdown",
+            "README",
+            "README.txt",
+            "Readme.md",
+            "readme.md",
+        ];
 
         for name in &readme_names {
-            if let Ok(content) = self.get_file_content(repo_path, branch, name) {
-                return Some(content);
+            let path = if dir.is_empty() {
+                name.to_string()
+            } else {
+                format!("{}/{}", dir, name)
+            };
+            if let Ok(content) = self.get_file_content(repo_path, rev, &path) {
+                return Some((name.to_string(), content));
             }
         }
 
@@ -226,10 +1109,13 @@ impl WebServer {
 }
 
 struct CommitInfo {
+    id: String,
     hash: String,
     author: String,
+    email: String,
     date: String,
     message: String,
+    signature: Signature,
 }
 
 struct FileInfo {
@@ -237,10 +1123,135 @@ struct FileInfo {
     file_type: String,
 }
 
-async fn handle_index(State(server): State<Arc<WebServer>>) -> Response {
+struct Contributor {
+    name: String,
+    email: String,
+    commits: usize,
+}
+
+struct CommitDetail {
+    id: String,
+    author: String,
+    email: String,
+    date: String,
+    parents: Vec<String>,
+    message: String,
+    diff: String,
+    /// Whether the diff was too large and is cut short
+    diff_truncated: bool,
+    signature: Signature,
+}
+
+struct TagInfo {
+    name: String,
+    /// Commit the tag points to
+    commit: String,
+    date: String,
+    /// Tagger of an annotated tag, or the commit's author
+    tagger: String,
+    /// Subject of an annotated tag's message; empty for lightweight tags
+    message: String,
+    signature: Signature,
+}
+
+/// A repository's topics, each linking to the index filtered by it
+fn topic_links(topics: &[String]) -> String {
+    if topics.is_empty() {
+        return String::new();
+    }
+    let links: Vec<String> = topics
+        .iter()
+        .map(|topic| {
+            format!(
+                "<a class=\"topic\" href=\"/?topic={}\">{}</a>",
+                url_path(topic),
+                html_escape(topic)
+            )
+        })
+        .collect();
+    format!("<p class=\"topics\">{}</p>\n", links.join(" "))
+}
+
+/// The index with one query parameter set to `value`, or dropped if None,
+/// keeping the others
+fn index_url(query: &HashMap<String, String>, key: &str, value: Option<&str>) -> String {
+    let mut params: BTreeMap<&str, &str> = query
+        .iter()
+        .map(|(key, value)| (key.as_str(), value.as_str()))
+        .collect();
+    match value {
+        Some(value) => params.insert(key, value),
+        None => params.remove(key),
+    };
+    let params: Vec<String> = params
+        .iter()
+        .filter(|(_, value)| !value.is_empty())
+        .map(|(key, value)| format!("{}={}", url_path(key), url_path(value)))
+        .collect();
+    if params.is_empty() {
+        "/".to_string()
+    } else {
+        format!("/?{}", html_escape(&params.join("&")))
+    }
+}
+
+/// The repository list; archived repositories only with ?archived=1.
+/// `?sort=stars` puts the most starred first, and `?starred=1` shows only
+/// those the signed-in user starred. `?topic=<topic>` shows only those with
+/// a topic, `?lang=<language>` those mostly written in a language, and
+/// `?q=<text>` those whose name or description contains the text, ignoring
+/// case.
+async fn handle_index(
+    State(server): State<Arc<WebServer>>,
+    Query(query): Query<HashMap<String, String>>,
+) -> Response {
+    let show_archived = query.get("archived").map(String::as_str) == Some("1");
+    let user = auth::current_user();
+    let sort_by_stars = query.get("sort").map(String::as_str) == Some("stars");
+    let only_starred = user.is_some() && query.get("starred").map(String::as_str) == Some("1");
+    let topic = query.get("topic").filter(|topic| !topic.is_empty());
+    let language = query.get("lang").filter(|language| !language.is_empty());
+    let search = query
+        .get("q")
+        .map(|q| q.trim().to_lowercase())
+        .unwrap_or_default();
+    let star_counts = crate::stars::counts(&server.data_dir).unwrap_or_default();
+    let starred = user
+        .as_deref()
+        .and_then(|user| crate::stars::starred_by(&server.data_dir, user).ok())
+        .unwrap_or_default();
     match server.list_repositories() {
-        Ok(repos) => {
-            let mut html = String::from(r#"<!DOCTYPE html>
+        Ok(mut repos) => {
+            let stars_of = |repo: &Repository| star_counts.get(&repo.name).copied().unwrap_or(0);
+            if only_starred {
+                repos.retain(|repo| starred.contains(&repo.name));
+            }
+            if let Some(topic) = topic {
+                repos.retain(|repo| {
+                    repo.topics
+                        .iter()
+                        .any(|t| t.eq_ignore_ascii_case(topic))
+                });
+            }
+            if let Some(language) = language {
+                repos.retain(|repo| {
+                    repo.language
+                        .as_deref()
+                        .map_or(false, |l| l.eq_ignore_ascii_case(language))
+                });
+            }
+            if !search.is_empty() {
+                repos.retain(|repo| {
+                    repo.name.to_lowercase().contains(&search)
+                        || repo.description.to_lowercase().contains(&search)
+                });
+            }
+            if sort_by_stars {
+                repos.sort_by(|a, b| stars_of(b).cmp(&stars_of(a)).then(a.name.cmp(&b.name)));
+            }
+            let hidden = repos.iter().filter(|repo| repo.archived).count();
+            let mut html = String::from(
+                r#"<!DOCTYPE html>
 <html>
 <head>
     <title>Agito - Git Repositories</title>
@@ -259,23 +1270,154 @@ async fn handle_index(State(server): State<Arc<WebServer>>) -> Response {
         .repo-item a { text-decoration: none; }
         .repo-desc { color: #666; margin: 10px 0; }
         .repo-meta { color: #888; font-size: 0.9em; }
+        .bell { float: right; }
+        .account { float: right; margin-left: 12px; }
+        .unread-count { background: #cb2431; color: #fff; border-radius: 8px; padding: 0 6px; font-size: 0.8em; }
+        .archived-label { font-size: 0.6em; border: 1px solid #b08800; border-radius: 8px; padding: 0 6px; color: #b08800; }
+        .topic { font-size: 0.85em; background: #eaf2fb; border-radius: 8px; padding: 0 8px; text-decoration: none; }
     </style>
+"#,
+            );
+            html.push_str(&server.custom_stylesheet());
+            html.push_str(
+                r#"
 </head>
 <body>
+"#,
+            );
+            html.push_str(&account::links(&server));
+            html.push_str(&notifications::bell(&server));
+            html.push_str(
+                r#"
     <h1>Agito - Git Repositories</h1>
-    <div class="repo-list">
-"#);
+"#,
+            );
+            html.push_str(&format!(
+                "    <p class=\"index-nav\">Sort by {} &middot; {}{}{}</p>\n",
+                if sort_by_stars {
+                    format!("<a href=\"{}\">name</a>", index_url(&query, "sort", None))
+                } else {
+                    "<strong>name</strong>".to_string()
+                },
+                if sort_by_stars {
+                    "<strong>stars</strong>".to_string()
+                } else {
+                    format!(
+                        "<a href=\"{}\">stars</a>",
+                        index_url(&query, "sort", Some("stars"))
+                    )
+                },
+                match (&user, only_starred) {
+                    (None, _) => String::new(),
+                    (Some(_), false) => format!(
+                        " &middot; <a href=\"{}\">Starred by you</a>",
+                        index_url(&query, "starred", Some("1"))
+                    ),
+                    (Some(_), true) => format!(
+                        " &middot; <a href=\"{}\">All repositories</a>",
+                        index_url(&query, "starred", None)
+                    ),
+                },
+                if server.code_search {
+                    " &middot; <a href=\"/activity\">Activity</a> &middot; <a href=\"/search\">Search code</a>"
+                } else {
+                    " &middot; <a href=\"/activity\">Activity</a>"
+                }
+            ));
+            let kept: String = ["topic", "lang", "sort", "starred", "archived"]
+                .iter()
+                .filter_map(|key| Some((key, query.get(*key).filter(|v| !v.is_empty())?)))
+                .map(|(key, value)| {
+                    format!(
+                        "<input type=\"hidden\" name=\"{}\" value=\"{}\">",
+                        key,
+                        html_escape(value)
+                    )
+                })
+                .collect();
+            html.push_str(&format!(
+                "    <form class=\"index-filter\" method=\"get\" action=\"/\">{}<input type=\"search\" name=\"q\" placeholder=\"Filter by name or description\" value=\"{}\"> <button type=\"submit\">Filter</button>{}</form>\n",
+                kept,
+                html_escape(query.get("q").map(String::as_str).unwrap_or("")),
+                match topic {
+                    Some(topic) => format!(
+                        " Topic <span class=\"topic\">{}</span> <a href=\"{}\">(all topics)</a>",
+                        html_escape(topic),
+                        index_url(&query, "topic", None)
+                    ),
+                    None => String::new(),
+                }
+            ));
+            if let Some(language) = language {
+                html.push_str(&format!(
+                    "    <p class=\"index-filter\">Language <strong>{}</strong> <a href=\"{}\">(all languages)</a></p>\n",
+                    html_escape(language),
+                    index_url(&query, "lang", None)
+                ));
+            }
+            html.push_str("    <div class=\"repo-list\">\n");
+
+            let shown = repos
+                .iter()
+                .filter(|repo| show_archived || !repo.archived)
+                .count();
+            if shown == 0
+                && (topic.is_some() || language.is_some() || !search.is_empty() || only_starred)
+            {
+                html.push_str("        <p>No repositories match.</p>\n");
+            }
 
             for repo in repos {
+                if repo.archived && !show_archived {
+                    continue;
+                }
+                let mut meta = repo.last_commit.clone();
+                if let Some(language) = &repo.language {
+                    meta.push_str(&format!(
+                        " &middot; <a href=\"{}\"><span style=\"color: {}\">&#9679;</span> {}</a>",
+                        index_url(&query, "lang", Some(language)),
+                        crate::languages::color(language),
+                        html_escape(language)
+                    ));
+                }
+                let stars = stars_of(&repo);
+                if stars > 0 {
+                    meta.push_str(&format!(" &middot; &#9733; {}", stars));
+                }
+                if let Some(size) = server.disk_usage.repo(&repo.name) {
+                    meta.push_str(&format!(" &middot; {}", usage::format_bytes(size.bytes)));
+                }
                 html.push_str(&format!(
                     r#"
         <div class="repo-item">
-            <h2><a href="/repo/{}">{}</a></h2>
+            <h2><a href="/repo/{}">{}</a>{}</h2>
             <div class="repo-desc">{}</div>
-            <div class="repo-meta">{}</div>
+            {}<div class="repo-meta">{}</div>
         </div>
 "#,
-                    repo.name, repo.name, repo.description, repo.last_commit
+                    url_path(&repo.name),
+                    html_escape(&repo.name),
+                    if repo.archived {
+                        " <span class=\"archived-label\">archived</span>"
+                    } else {
+                        ""
+                    },
+                    html_escape(&repo.description),
+                    topic_links(&repo.topics),
+                    meta
+                ));
+            }
+
+            if show_archived {
+                html.push_str(&format!(
+                    "\n    <p><a href=\"{}\">Hide archived repositories</a></p>\n",
+                    index_url(&query, "archived", None)
+                ));
+            } else if hidden > 0 {
+                html.push_str(&format!(
+                    "\n    <p><a href=\"{}\">Show {} archived repositories</a></p>\n",
+                    index_url(&query, "archived", Some("1")),
+                    hidden
                 ));
             }
 
@@ -287,7 +1429,7 @@ async fn handle_index(State(server): State<Arc<WebServer>>) -> Response {
 "#,
             );
 
-            Html(html).into_response()
+            Html(csrf::protect_forms(&html)).into_response()
         }
         Err(e) => (
             StatusCode::INTERNAL_SERVER_ERROR,
@@ -297,50 +1439,1166 @@ async fn handle_index(State(server): State<Arc<WebServer>>) -> Response {
     }
 }
 
+/// Count requests and their latency per matched route for /metrics
+async fn track_metrics(req: Request, next: Next) -> Response {
+    let start = std::time::Instant::now();
+    let method = req.method().to_string();
+    let route = req
+        .extensions()
+        .get::<MatchedPath>()
+        .map(|path| path.as_str().to_string())
+        .unwrap_or_else(|| "unmatched".to_string());
+
+    let response = next.run(req).await;
+    let status = response.status().as_u16();
+    metrics::global().http_request(&method, &route, status, start.elapsed());
+
+    let span = tracing::Span::current();
+    span.record("otel.name", format!("{} {}", method, route));
+    span.record("http.route", route.as_str());
+    span.record("http.status_code", status);
+    if status >= 500 {
+        span.record("otel.status_code", "ERROR");
+    }
+    // Streamed responses, such as archives, have no length up front
+    if let Some(length) = response
+        .headers()
+        .get(header::CONTENT_LENGTH)
+        .and_then(|value| value.to_str().ok())
+        .and_then(|value| value.parse::<u64>().ok())
+    {
+        span.record("bytes", length);
+    }
+    response
+}
+
+/// Prometheus metrics for the HTTP and SSH servers
+async fn handle_metrics(State(server): State<Arc<WebServer>>) -> Response {
+    let repositories = git::find_repositories(&server.repos_dir)
+        .map(|repos| repos.len())
+        .unwrap_or(0);
+    // Per-repository sizes name private repositories too
+    let disk_usage = auth::current_user()
+        .filter(|user| server.is_admin(user))
+        .map(|_| server.disk_usage.snapshot());
+    let body = metrics::global().render(repositories, disk_usage.as_ref(), &server.git_pools);
+    (
+        [(
+            header::CONTENT_TYPE,
+            "text/plain; version=0.0.4; charset=utf-8",
+        )],
+        body,
+    )
+        .into_response()
+}
+
+/// Mirrors of a repository with their last sync, as JSON
+async fn handle_api_mirrors(
+    State(server): State<Arc<WebServer>>,
+    Path(repo_name): Path<String>,
+) -> Response {
+    let repo_path = match server.resolve_repo(&repo_name) {
+        Some((_, path)) => path,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+
+    let mirrors: Vec<_> = mirror::list(&repo_path)
+        .into_iter()
+        .map(|m| {
+            let status = mirror::status(&repo_path, &m.name);
+            serde_json::json!({
+                "name": m.name,
+                "direction": m.direction,
+                "url": mirror::redact(&m.url),
+                "interval": (m.direction == mirror::Direction::Pull).then_some(m.interval),
+                "last_attempt": status.last_attempt,
+                "last_success": status.last_success,
+                "error": status.error,
+                "failing_since": status.failing_since,
+                "credentials": mirror::credentials(&repo_path, &m.name).map(|c| c.kind()),
+            })
+        })
+        .collect();
+    axum::Json(mirrors).into_response()
+}
+
+/// Reload the server's configuration, as SIGHUP does: POST /api/v1/admin/reload
+async fn handle_api_reload(State(server): State<Arc<WebServer>>) -> Response {
+    if !auth::current_user().map_or(false, |user| server.is_admin(&user)) {
+        return (StatusCode::FORBIDDEN, "Only server admins may reload the configuration")
+            .into_response();
+    }
+    match &server.reload {
+        Some(reload) => {
+            reload.request();
+            (StatusCode::ACCEPTED, "Reloading; see the server log for the outcome\n")
+                .into_response()
+        }
+        None => (StatusCode::NOT_IMPLEMENTED, "This server can't reload").into_response(),
+    }
+}
+
+/// Disk usage of every repository the user may read, per namespace and in
+/// total, from the last scan
+async fn handle_api_usage(State(server): State<Arc<WebServer>>) -> Response {
+    let mut snapshot = server.disk_usage.snapshot();
+    snapshot.repos.retain(|name, _| server.role(name).is_some());
+    axum::Json(serde_json::json!({
+        "scanned_at": snapshot.scanned_at,
+        "total_bytes": snapshot.total(),
+        "namespaces": snapshot.namespaces(),
+        "repos": snapshot.repos,
+    }))
+    .into_response()
+}
+
+/// The server's release and the SSH commands it understands
+async fn handle_api_version() -> Response {
+    axum::Json(serde_json::json!({
+        "version": version::VERSION,
+        "capabilities": version::CAPABILITIES,
+    }))
+    .into_response()
+}
+
+/// A repository's details, with where to clone it from
+async fn handle_api_repo(
+    State(server): State<Arc<WebServer>>,
+    Path(repo_name): Path<String>,
+    headers: HeaderMap,
+) -> Response {
+    let (repo_name, repo_path) = match server.resolve_repo(&repo_name) {
+        Some(found) => found,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    axum::Json(repo_json(&server, &repo_name, &repo_path, &headers)).into_response()
+}
+
+/// A repository as the API describes it
+fn repo_json(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    headers: &HeaderMap,
+) -> serde_json::Value {
+    let in_org = crate::orgs::in_org(&server.data_dir, repo_name);
+    let visibility = visibility::effective(repo_path, in_org);
+    let clone_urls: BTreeMap<_, _> = server
+        .clone_urls(repo_name, repo_path)
+        .into_iter()
+        .collect();
+    let web_url = format!(
+        "{}/repo/{}",
+        embed::base_url(server, headers),
+        url_path(repo_name)
+    );
+    serde_json::json!({
+        "name": repo_name,
+        "description": server.description(repo_path),
+        "visibility": visibility.name(),
+        "archived": archive::is_archived(repo_path),
+        "default_branch": server.default_branch(repo_path),
+        "topics": topics::get(repo_path),
+        "web_url": web_url,
+        "clone_urls": clone_urls,
+    })
+}
+
+async fn handle_static(State(server): State<Arc<WebServer>>, Path(path): Path<String>) -> Response {
+    server.assets.serve(&path).await
+}
+
 async fn handle_repo(
     State(server): State<Arc<WebServer>>,
-    Path(params): Path<String>,
+    Path(repo_name): Path<String>,
+    headers: HeaderMap,
+) -> Response {
+    match server.repo_path(&repo_name) {
+        Some(repo_path) => render_repo(&server, &repo_name, &repo_path, &headers),
+        None => (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    }
+}
+
+/// A repository's front page: README, files and recent commits
+fn render_repo(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    headers: &HeaderMap,
 ) -> Response {
-    let parts: Vec<&str> = params.split('/').collect();
-    let repo_name = parts[0];
-    let repo_path = server.repos_dir.join(repo_name);
+    let branch = server.default_branch(repo_path);
+
+    let description = server.description(&repo_path);
 
-    if !repo_path.exists() {
-        return (StatusCode::NOT_FOUND, "Repository not found").into_response();
+    let commits = server
+        .get_commits(&repo_path, &branch, 10)
+        .unwrap_or_default();
+    let files = server
+        .list_files(&repo_path, &branch, "")
+        .unwrap_or_default();
+    let readme = server.get_readme(&repo_path, &branch, "");
+
+    let mut body = format!(
+        "<h1>{}</h1>\n<p>{}</p>\n<p>Branch: <strong>{}</strong> &middot; <a href=\"/repo/{}/log/{}\">History</a> &middot; <a href=\"/repo/{}/contributors\">Contributors</a> &middot; <a href=\"/repo/{}/tags\">Tags</a> &middot; <a href=\"/repo/{}/releases\">Releases</a> &middot; <a href=\"/repo/{}/branches\">Branches</a> &middot; <a href=\"/repo/{}/issues\">Issues</a> &middot; <a href=\"/repo/{}/pulls\">Pull requests</a> &middot; <a href=\"/repo/{}/builds\">Builds</a></p>\n",
+        html_escape(&repo_name),
+        html_escape(&description),
+        html_escape(&branch),
+        url_path(&repo_name),
+        url_path(&branch),
+        url_path(&repo_name),
+        url_path(&repo_name),
+        url_path(&repo_name),
+        url_path(&repo_name),
+        url_path(&repo_name),
+        url_path(&repo_name),
+        url_path(&repo_name)
+    );
+    if let Some(stats) = stats::get(repo_path) {
+        body.push_str(&render_stats(&stats));
+        body.push_str(&render_languages(&stats));
+    }
+    body.push_str(&topic_links(&topics::get(repo_path)));
+    if server.code_search {
+        body.push_str(&format!(
+            "<form method=\"get\" action=\"/search\"><input type=\"hidden\" name=\"repo\" value=\"{}\"><input type=\"search\" name=\"q\" placeholder=\"Search code\"> <button type=\"submit\">Search</button></form>\n",
+            html_escape(repo_name)
+        ));
+    }
+    let watch = subscription::watch_button(server, repo_name, repo_path);
+    body.push_str(&format!(
+        "<p>{}{}</p>\n",
+        stars::star_button(server, repo_name, repo_path),
+        if watch.is_empty() {
+            String::new()
+        } else {
+            format!(" &middot; {}", watch)
+        }
+    ));
+    if server.may_administer(&repo_path) {
+        body.push_str(&format!(
+            "<p><a href=\"/repo/{}/settings/policies\">Settings</a></p>\n",
+            url_path(&repo_name)
+        ));
+    }
+
+    if let Some(size) = server.disk_usage.repo(&repo_name) {
+        body.push_str(&format!(
+            "<p class=\"repo-size\">Size on disk: {}{}</p>\n",
+            quota::with_limit(size.bytes, server.quotas.repo_limit(&repo_path)),
+            if size.alternates.is_empty() {
+                String::new()
+            } else {
+                " (plus objects shared with other repositories)".to_string()
+            }
+        ));
+    }
+    body.push_str(&render_mirrors(&repo_path));
+    body.push_str(&render_clone_urls(&server.clone_urls(repo_name, repo_path)));
+    if !commits.is_empty() {
+        body.push_str(&format!(
+            "<p><a href=\"/repo/{}/bundle\">Download a bundle</a> of all branches and tags</p>\n",
+            url_path(&repo_name)
+        ));
     }
 
-    // Get branches
     let branches = server.get_branches(&repo_path).unwrap_or_default();
-    let branch = branches.first().unwrap_or(&"master".to_string()).clone();
-
-    // Get description
-    let desc_path = repo_path.join("description");
-    let description = fs::read_to_string(&desc_path)
-        .unwrap_or_default()
-        .trim()
-        .to_string();
-    let description = if description
-        == "Unnamed repository; edit this file 'description' to name the repository."
-    {
-        String::new()
+    if branches.len() > 1 {
+        body.push_str("<p>Branches: ");
+        for name in &branches {
+            body.push_str(&format!(
+                "<a href=\"/repo/{}/tree/{}\">{}</a> ",
+                url_path(&repo_name),
+                url_path(name),
+                html_escape(name)
+            ));
+        }
+        body.push_str("</p>\n");
+    }
+
+    if !files.is_empty() {
+        body.push_str(&render_file_list(&repo_name, &branch, "", &files));
+    }
+
+    if let Some((name, content)) = &readme {
+        body.push_str(&render_readme(&repo_name, &branch, "", name, content));
+    }
+
+    if !commits.is_empty() {
+        body.push_str(r#"<div class="section"><h2>Recent Commits</h2>"#);
+        body.push_str(&render_commit_list(&server, &repo_name, &commits));
+        body.push_str("</div>");
+    }
+
+    let base = embed::base_url(&server, &headers);
+    let meta = embed::Meta {
+        title: repo_name.to_string(),
+        description: if description.is_empty() {
+            format!("Git repository {}", repo_name)
+        } else {
+            description.clone()
+        },
+        url: format!("{}/repo/{}", base, url_path(&repo_name)),
+    };
+    render_page_with_head(
+        &server,
+        &repo_name,
+        &breadcrumb(&repo_name, &[]),
+        &body,
+        &meta.head_tags(&base),
+    )
+}
+
+/// Pages below a repository: tree, blob, raw, archive, log, contributors, tags, releases, branches, commit, issues, pull requests, stars, feed, badge and widget views
+async fn handle_repo_page(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, path)): Path<(String, String)>,
+    Query(query): Query<HashMap<String, String>>,
+    headers: HeaderMap,
+) -> Response {
+    let (repo_name, repo_path, path) = match server.find_repo_page(&repo_name, &path) {
+        Some(found) => found,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    if path.is_empty() {
+        return render_repo(&server, &repo_name, &repo_path, &headers);
+    }
+
+    let (page, rest) = path.split_once('/').unwrap_or((path.as_str(), ""));
+
+    match page {
+        "tree" | "blob" | "raw" => {
+            let (rev, file_path) = if rest.is_empty() {
+                (server.default_branch(&repo_path), String::new())
+            } else {
+                match server.split_ref_path(&repo_path, rest) {
+                    Some(split) => split,
+                    None => return (StatusCode::NOT_FOUND, "Unknown ref").into_response(),
+                }
+            };
+            match page {
+                "tree" => render_tree(&server, &repo_name, &repo_path, &rev, &file_path),
+                "blob" => render_blob(&server, &repo_name, &repo_path, &rev, &file_path),
+                _ => render_raw(&server, &repo_path, &rev, &file_path).await,
+            }
+        }
+        "archive" => download_archive(&server, &repo_name, &repo_path, rest).await,
+        "log" => {
+            let rev = if rest.is_empty() {
+                server.default_branch(&repo_path)
+            } else {
+                rest.trim_end_matches('/').to_string()
+            };
+            render_log(&server, &repo_name, &repo_path, &rev)
+        }
+        "contributors" => render_contributors(&server, &repo_name, &repo_path),
+        "tags" => render_tags(&server, &repo_name, &repo_path),
+        "branches" => branches::render(&server, &repo_name, &repo_path),
+        "issues" => match rest.trim_end_matches('/') {
+            "" => issues::list_page(&server, &repo_name, &repo_path, &query),
+            "new" => issues::new_page(&server, &repo_name, &HashMap::new(), None),
+            number => match number.parse() {
+                Ok(number) => issues::issue_page(&server, &repo_name, &repo_path, number, None),
+                Err(_) => (StatusCode::NOT_FOUND, "Issue not found").into_response(),
+            },
+        },
+        "pulls" => match rest.trim_end_matches('/') {
+            "" => pulls::list_page(&server, &repo_name, &repo_path, &query),
+            "new" => pulls::new_page(&server, &repo_name, &repo_path, &query, None),
+            number => match number.split_once('/') {
+                None => match number.parse() {
+                    Ok(number) => pulls::pull_page(&server, &repo_name, &repo_path, number, None),
+                    Err(_) => (StatusCode::NOT_FOUND, "Pull request not found").into_response(),
+                },
+                Some((number, "files")) => match number.parse() {
+                    Ok(number) => {
+                        pulls::files_page(&server, &repo_name, &repo_path, number, &query)
+                    }
+                    Err(_) => (StatusCode::NOT_FOUND, "Pull request not found").into_response(),
+                },
+                Some(_) => (StatusCode::NOT_FOUND, "Page not found").into_response(),
+            },
+        },
+        "builds" => match rest.trim_end_matches('/') {
+            "" => builds::list_page(&server, &repo_name, &repo_path, &query),
+            id => match id.parse() {
+                Ok(id) => builds::build_page(&server, &repo_name, &repo_path, id, None),
+                Err(_) => (StatusCode::NOT_FOUND, "Build not found").into_response(),
+            },
+        },
+        "tag" => render_tag(&server, &repo_name, &repo_path, rest.trim_end_matches('/')),
+        "releases" => match rest.split_once('/') {
+            None if rest.is_empty() => releases::list_page(&server, &repo_name, &repo_path, None),
+            Some(("tag", tag)) => releases::release_page(&server, &repo_name, &repo_path, tag, None),
+            Some(("download", path)) => releases::download(&server, &repo_path, path).await,
+            _ => (StatusCode::NOT_FOUND, "Page not found").into_response(),
+        },
+        "commit" => render_commit(
+            &server,
+            &repo_name,
+            &repo_path,
+            rest.trim_end_matches('/'),
+            &embed::base_url(&server, &headers),
+            &query,
+        ),
+        "widget" => embed::widget(&server, &headers, &query, &repo_name, &repo_path, rest),
+        "badge.svg" => embed::status_badge(&server, &query, &repo_name, &repo_path),
+        "bundle" => bundle::download(&server, &query, &repo_name, &repo_path).await,
+        "feed.rss" => feed::render(&server, &headers, &query, &repo_name, &repo_path),
+        "releases.atom" => releases::feed(&server, &headers, &repo_name, &repo_path),
+        "subscription" => subscription::subscription_page(&server, &repo_name, &repo_path, None),
+        "stars" => stars::stars_page(&server, &repo_name, &repo_path),
+        "settings" => match rest.trim_end_matches('/') {
+            "" | "policies" => settings::policies_page(&server, &repo_name, &repo_path, None),
+            "branches" => settings::branches_page(&server, &repo_name, &repo_path, None),
+            "access" => settings::access_page(&server, &repo_name, &repo_path, None),
+            "webhooks" => webhooks::webhooks_page(&server, &repo_name, &repo_path, None),
+            "deploy-keys" => deploy_keys::deploy_keys_page(&server, &repo_name, &repo_path, None),
+            "mirrors" => mirrors::mirrors_page(&server, &repo_name, &repo_path, None),
+            "archive" => settings::archive_page(&server, &repo_name, &repo_path),
+            "delete" => settings::delete_page(&server, &repo_name, &repo_path, None),
+            "topics" => settings::topics_page(&server, &repo_name, &repo_path, None),
+            "rename" => settings::rename_page(&server, &repo_name, &repo_path, None),
+            path => match path.strip_prefix("webhooks/deliveries/").map(str::parse) {
+                Some(Ok(id)) => webhooks::delivery_page(&server, &repo_name, &repo_path, id),
+                _ => (StatusCode::NOT_FOUND, "Page not found").into_response(),
+            },
+        },
+        _ => (StatusCode::NOT_FOUND, "Page not found").into_response(),
+    }
+}
+
+async fn handle_repo_form(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, path)): Path<(String, String)>,
+    Form(form): Form<HashMap<String, String>>,
+) -> Response {
+    let (repo_name, repo_path, path) = match server.find_repo_page(&repo_name, &path) {
+        Some(found) => found,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+
+    match path.trim_end_matches('/') {
+        "settings/policies" => settings::save_policies(&server, &repo_name, &repo_path, &form),
+        "settings/branches" => settings::save_branches(&server, &repo_name, &repo_path, &form),
+        "settings/webhooks" => webhooks::save_form(&server, &repo_name, &repo_path, &form),
+        "settings/deploy-keys" => deploy_keys::save_form(&server, &repo_name, &repo_path, &form),
+        "settings/mirrors" => mirrors::save_form(&server, &repo_name, &repo_path, &form),
+        "settings/access" => settings::save_access(&server, &repo_name, &repo_path, &form),
+        "settings/archive" => settings::save_archive(&server, &repo_name, &repo_path, &form),
+        "settings/delete" => settings::delete_repo(&server, &repo_name, &repo_path, &form),
+        "settings/topics" => settings::save_topics(&server, &repo_name, &repo_path, &form),
+        "settings/rename" => settings::save_rename(&server, &repo_name, &repo_path, &form),
+        "subscription" => subscription::save_form(&server, &repo_name, &repo_path, &form),
+        "stars" => stars::save_form(&server, &repo_name, &repo_path, &form),
+        "issues/new" => issues::create_form(&server, &repo_name, &repo_path, &form),
+        "releases" => releases::save_form(&server, &repo_name, &repo_path, &form),
+        "pulls/new" => pulls::create_form(&server, &repo_name, &repo_path, &form),
+        path if path.starts_with("commit/") => {
+            match server.get_commit(&repo_path, &path["commit/".len()..]) {
+                Ok(commit) => reviews::Review::commit(&server, &repo_name, &repo_path, &commit)
+                    .save_form(&server, &form),
+                Err(_) => (StatusCode::NOT_FOUND, "Commit not found").into_response(),
+            }
+        }
+        path if path.starts_with("pulls/") && path.ends_with("/files") => {
+            pulls::files_form(&server, &repo_name, &repo_path, path, &form)
+        }
+        path if path.starts_with("builds/") => match path["builds/".len()..].parse() {
+            Ok(id) => builds::save_form(&server, &repo_name, &repo_path, id, &form),
+            Err(_) => (StatusCode::NOT_FOUND, "Build not found").into_response(),
+        },
+        path => match path.strip_prefix("issues/").map(str::parse) {
+            Some(Ok(number)) => issues::save_form(&server, &repo_name, &repo_path, number, &form),
+            _ => match path.strip_prefix("pulls/").map(str::parse) {
+                Some(Ok(number)) => {
+                    pulls::save_form(server.clone(), repo_name, repo_path, number, form).await
+                }
+                _ => (StatusCode::NOT_FOUND, "Page not found").into_response(),
+            },
+        },
+    }
+}
+
+fn render_tree(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    rev: &str,
+    path: &str,
+) -> Response {
+    let path = path.trim_matches('/');
+    if !path.is_empty() {
+        match server.object_type(repo_path, rev, path).as_deref() {
+            Some("tree") => {}
+            Some("blob") => {
+                return Redirect::to(&format!(
+                    "/repo/{}/blob/{}/{}",
+                    url_path(repo_name),
+                    url_path(rev),
+                    url_path(path)
+                ))
+                .into_response()
+            }
+            _ => return (StatusCode::NOT_FOUND, "Path not found").into_response(),
+        }
+    }
+
+    let files = server.list_files(repo_path, rev, path).unwrap_or_default();
+    let archive_url = format!("/repo/{}/archive/{}", url_path(repo_name), url_path(rev));
+    let mut body = format!(
+        "<h1>{}</h1>\n<p>Ref: <strong>{}</strong> &middot; <a href=\"/repo/{}/log/{}\">History</a> &middot; Download <a href=\"{}.tar.gz\">.tar.gz</a> <a href=\"{}.zip\">.zip</a></p>\n",
+        html_escape(repo_name),
+        html_escape(rev),
+        url_path(repo_name),
+        url_path(rev),
+        archive_url,
+        archive_url
+    );
+    body.push_str(&render_file_list(repo_name, rev, path, &files));
+    if let Some((name, content)) = server.get_readme(repo_path, rev, path) {
+        body.push_str(&render_readme(repo_name, rev, path, &name, &content));
+    }
+
+    render_page(
+        server,
+        repo_name,
+        &breadcrumb(repo_name, &path_crumbs(repo_name, rev, path)),
+        &body,
+    )
+}
+
+fn render_blob(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    rev: &str,
+    path: &str,
+) -> Response {
+    let size = match server.blob_size(repo_path, rev, path) {
+        Some(size) => size,
+        // Relative links in READMEs may name directories
+        None if server.object_type(repo_path, rev, path).as_deref() == Some("tree") => {
+            return Redirect::to(&format!(
+                "/repo/{}/tree/{}/{}",
+                url_path(repo_name),
+                url_path(rev),
+                url_path(path.trim_matches('/'))
+            ))
+            .into_response()
+        }
+        None => return (StatusCode::NOT_FOUND, "File not found").into_response(),
+    };
+
+    let raw_url = format!(
+        "/repo/{}/raw/{}/{}",
+        url_path(repo_name),
+        url_path(rev),
+        url_path(path)
+    );
+    let mut body = format!(
+        "<h1>{}</h1>\n<p>Ref: <strong>{}</strong> &middot; {} bytes &middot; <a href=\"{}\">Raw</a></p>\n",
+        html_escape(path.rsplit('/').next().unwrap_or(path)),
+        html_escape(rev),
+        size,
+        raw_url
+    );
+
+    if size > MAX_DISPLAY_BYTES {
+        body.push_str(&format!(
+            "<p>File too large to display; <a href=\"{}\">view it raw</a>.</p>",
+            raw_url
+        ));
     } else {
-        description
+        match server.get_blob(repo_path, rev, path) {
+            Ok(content) if content.contains(&0) => body.push_str("<p>Binary file not shown.</p>"),
+            Ok(content) => body.push_str(&format!(
+                "<pre>{}</pre>",
+                html_escape(&String::from_utf8_lossy(&content))
+            )),
+            Err(_) => return (StatusCode::NOT_FOUND, "File not found").into_response(),
+        }
+    }
+
+    render_page(
+        server,
+        repo_name,
+        &breadcrumb(repo_name, &path_crumbs(repo_name, rev, path)),
+        &body,
+    )
+}
+
+/// A file as it is, streamed from git however large it is
+async fn render_raw(server: &WebServer, repo_path: &PathBuf, rev: &str, path: &str) -> Response {
+    let size = match server.blob_size(repo_path, rev, path) {
+        Some(size) => size,
+        None => return (StatusCode::NOT_FOUND, "File not found").into_response(),
+    };
+    let blob_path = format!("{}:{}", rev, path);
+    let command = stream::git(repo_path, &["cat-file", "blob", &blob_path]);
+    let mut output = match stream::spawn(server, git::limits::Pool::Web, command).await {
+        Ok(output) => output,
+        Err(response) => return response,
     };
+    // Like git, call a file binary if its first 8000 bytes have a NUL.
+    // Images are served as such for READMEs to show; never SVG, which can
+    // carry scripts.
+    let content_type = match (output.peek(8000).await, image_type(path)) {
+        (Ok(_), Some(image)) => image,
+        (Ok(head), None) if head.contains(&0) => "application/octet-stream",
+        (Ok(_), None) => "text/plain; charset=utf-8",
+        (Err(e), _) => return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    };
+    (
+        [
+            (header::CONTENT_TYPE, content_type.to_string()),
+            (header::CONTENT_LENGTH, size.to_string()),
+        ],
+        output.body(),
+    )
+        .into_response()
+}
+
+/// The content type of a raster image, by its file's extension
+fn image_type(path: &str) -> Option<&'static str> {
+    let extension = path.rsplit_once('.')?.1.to_ascii_lowercase();
+    match extension.as_str() {
+        "png" => Some("image/png"),
+        "jpg" | "jpeg" => Some("image/jpeg"),
+        "gif" => Some("image/gif"),
+        "webp" => Some("image/webp"),
+        _ => None,
+    }
+}
+
+/// Counts from a repository's statistics, for its page
+fn render_stats(stats: &Stats) -> String {
+    let count =
+        |n: u64, one: &str, many: &str| format!("{} {}", n, if n == 1 { one } else { many });
+    let mut parts = vec![
+        count(stats.commits, "commit", "commits"),
+        count(stats.contributors, "contributor", "contributors"),
+        count(stats.branches, "branch", "branches"),
+        count(stats.tags, "tag", "tags"),
+    ];
+    if let Some(time) = stats.last_activity {
+        parts.push(format!("last active {}", relative_time(time)));
+    }
+    format!("<p class=\"repo-stats\">{}</p>\n", parts.join(" &middot; "))
+}
+
+/// A bar of the languages of a repository's code, each as wide as its
+/// share, with a legend
+fn render_languages(stats: &Stats) -> String {
+    let total: u64 = stats.languages.iter().map(|language| language.bytes).sum();
+    if total == 0 {
+        return String::new();
+    }
+    let mut bar = String::new();
+    let mut legend = Vec::new();
+    for language in &stats.languages {
+        let percent = language.bytes as f64 * 100.0 / total as f64;
+        let color = crate::languages::color(&language.name);
+        bar.push_str(&format!(
+            "<span style=\"width: {:.2}%; background: {}\" title=\"{}\"></span>",
+            percent,
+            color,
+            html_escape(&language.name)
+        ));
+        legend.push(format!(
+            "<a href=\"/?lang={}\"><span style=\"color: {}\">&#9679;</span> {}</a> {:.1}%",
+            url_path(&language.name),
+            color,
+            html_escape(&language.name),
+            percent
+        ));
+    }
+    format!(
+        "<div class=\"language-bar\">{}</div>\n<p class=\"languages\"><small>{}</small></p>\n",
+        bar,
+        legend.join(" &middot; ")
+    )
+}
 
-    // Get commits
-    let commits = server.get_commits(&repo_path, 10).unwrap_or_default();
+/// A README as a section of a directory's page: Markdown rendered, with
+/// relative links resolved against `dir`, and anything else as text
+fn render_readme(repo_name: &str, rev: &str, dir: &str, name: &str, content: &str) -> String {
+    let lower = name.to_ascii_lowercase();
+    let html = if lower.ends_with(".md") || lower.ends_with(".markdown") {
+        let location = markdown::Location {
+            repo_name,
+            rev,
+            dir,
+        };
+        markdown::render_file(content, &location)
+    } else {
+        format!("<pre>{}</pre>", html_escape(content))
+    };
+    format!(
+        r#"<div class="section"><h2>{}</h2>{}</div>"#,
+        html_escape(name),
+        html
+    )
+}
 
-    // Get files
-    let files = if parts.len() > 1 {
-        Vec::new()
+/// Stream a snapshot of a revision: /repo/<name>/archive/<rev>.tar.gz or
+/// .zip
+async fn download_archive(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    rest: &str,
+) -> Response {
+    let (rev, format, content_type) = if let Some(rev) = rest.strip_suffix(".tar.gz") {
+        (rev, "tar.gz", "application/gzip")
+    } else if let Some(rev) = rest.strip_suffix(".zip") {
+        (rev, "zip", "application/zip")
     } else {
-        server.list_files(&repo_path, &branch, "").unwrap_or_default()
+        return (StatusCode::NOT_FOUND, "Page not found").into_response();
     };
+    if !server.rev_exists(repo_path, rev) {
+        return (StatusCode::NOT_FOUND, "Unknown ref").into_response();
+    }
 
-    // Try to get README
-    let readme = server.get_readme(&repo_path, &branch).unwrap_or_default();
+    // webshop-v1.0 for v1.0 of team/webshop.git
+    let project = repo_name.rsplit('/').next().unwrap_or(repo_name);
+    let name = format!(
+        "{}-{}",
+        project.strip_suffix(".git").unwrap_or(project),
+        rev.replace('/', "-")
+    )
+    .replace('"', "");
+    let format_arg = format!("--format={}", format);
+    let prefix = format!("--prefix={}/", name);
+    let command = stream::git(repo_path, &["archive", &format_arg, &prefix, rev]);
+    // An archive costs the server about as much as a clone
+    let output = match stream::spawn(server, git::limits::Pool::Upload, command).await {
+        Ok(output) => output,
+        Err(response) => return response,
+    };
+    (
+        [
+            (header::CONTENT_TYPE, content_type.to_string()),
+            (
+                header::CONTENT_DISPOSITION,
+                format!("attachment; filename=\"{}.{}\"", name, format),
+            ),
+        ],
+        output.body(),
+    )
+        .into_response()
+}
+
+fn render_log(server: &WebServer, repo_name: &str, repo_path: &PathBuf, rev: &str) -> Response {
+    if !server.rev_exists(repo_path, rev) {
+        return (StatusCode::NOT_FOUND, "Unknown ref").into_response();
+    }
 
+    let commits = server.get_commits(repo_path, rev, 100).unwrap_or_default();
+    let mut body = format!(
+        "<h1>History of {}</h1>\n<div class=\"section\">",
+        html_escape(rev)
+    );
+    body.push_str(&render_commit_list(server, repo_name, &commits));
+    body.push_str("</div>");
+
+    render_page(
+        server,
+        repo_name,
+        &breadcrumb(repo_name, &[("log".to_string(), None)]),
+        &body,
+    )
+}
+
+fn render_commit(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    rev: &str,
+    base: &str,
+    query: &HashMap<String, String>,
+) -> Response {
+    let commit = match server.get_commit(repo_path, rev) {
+        Ok(commit) => commit,
+        Err(_) => return (StatusCode::NOT_FOUND, "Commit not found").into_response(),
+    };
+
+    let (subject, message_body) = commit
+        .message
+        .split_once('\n')
+        .unwrap_or((commit.message.as_str(), ""));
+
+    let mut body = format!(
+        "<h1>{}</h1>\n<p>{}<code>{}</code>{}<br/><small>{} &lt;{}&gt; committed {}</small></p>\n",
+        html_escape(subject),
+        server.avatars.img(&commit.email, 40),
+        commit.id,
+        signature_badge(&commit.signature),
+        html_escape(&commit.author),
+        html_escape(&commit.email),
+        html_escape(&commit.date)
+    );
+
+    if !message_body.trim().is_empty() {
+        body.push_str(&format!("<pre>{}</pre>", html_escape(message_body.trim())));
+    }
+
+    let build = builds::status_link(repo_name, repo_path, &commit.id);
+    if !build.is_empty() {
+        body.push_str(&format!("<p>{}</p>\n", build));
+    }
+
+    if !commit.parents.is_empty() {
+        body.push_str("<p>Parents: ");
+        for parent in &commit.parents {
+            body.push_str(&format!(
+                "<a href=\"/repo/{}/commit/{}\"><code>{}</code></a> ",
+                url_path(repo_name),
+                parent,
+                &parent[..8.min(parent.len())]
+            ));
+        }
+        body.push_str(&format!(
+            "&middot; <a href=\"/repo/{}/tree/{}\">Browse files</a></p>",
+            url_path(repo_name),
+            commit.id
+        ));
+    }
+
+    body.push_str(&format!(
+        r#"<div class="section"><h2>Changes</h2>{}</div>"#,
+        reviews::Review::commit(server, repo_name, repo_path, &commit).render(server, query)
+    ));
+
+    let meta = embed::Meta {
+        title: subject.to_string(),
+        description: format!(
+            "{} committed to {} {}",
+            commit.author,
+            repo_name,
+            &commit.id[..8]
+        ),
+        url: format!("{}/repo/{}/commit/{}", base, url_path(repo_name), commit.id),
+    };
+    render_page_with_head(
+        server,
+        repo_name,
+        &breadcrumb(repo_name, &[(commit.id[..8].to_string(), None)]),
+        &body,
+        &meta.head_tags(base),
+    )
+}
+
+fn render_contributors(server: &WebServer, repo_name: &str, repo_path: &PathBuf) -> Response {
+    let branch = server.default_branch(repo_path);
+    let contributors = server
+        .get_contributors(repo_path, &branch)
+        .unwrap_or_default();
+
+    let mut body = format!(
+        "<h1>Contributors</h1>\n<p>Authors of commits on <strong>{}</strong></p>\n<ul class=\"commit-list\">",
+        html_escape(&branch)
+    );
+    for contributor in &contributors {
+        body.push_str(&format!(
+            r#"<li class="commit-item">{}<strong>{}</strong> <small>{} commit{}</small></li>"#,
+            server.avatars.img(&contributor.email, 40),
+            html_escape(&contributor.name),
+            contributor.commits,
+            if contributor.commits == 1 { "" } else { "s" }
+        ));
+    }
+    body.push_str("</ul>");
+
+    render_page(
+        server,
+        repo_name,
+        &breadcrumb(repo_name, &[("contributors".to_string(), None)]),
+        &body,
+    )
+}
+
+fn render_tags(server: &WebServer, repo_name: &str, repo_path: &PathBuf) -> Response {
+    let tags = server
+        .get_tags(repo_path, "refs/tags", 100)
+        .unwrap_or_default();
+
+    let mut body = format!(
+        "<h1>Tags</h1>\n<p><a href=\"/repo/{0}/releases\">Releases</a> &middot; <a href=\"/repo/{0}/feed.rss?refs=tags/*\">Release feed (RSS)</a></p>\n<ul class=\"commit-list\">",
+        url_path(repo_name)
+    );
+    if tags.is_empty() {
+        body.push_str("<li class=\"commit-item\">No tags yet</li>");
+    }
+    for tag in &tags {
+        body.push_str(&format!(
+            r#"<li class="commit-item"><a href="/repo/{}/tag/{}"><strong>{}</strong></a>{} {} <br/><small>{} by {} &middot; <a href="/repo/{}/commit/{}"><code>{}</code></a></small></li>"#,
+            url_path(repo_name),
+            url_path(&tag.name),
+            html_escape(&tag.name),
+            signature_badge(&tag.signature),
+            html_escape(&tag.message),
+            tag.date,
+            html_escape(&tag.tagger),
+            url_path(repo_name),
+            tag.commit,
+            &tag.commit[..8.min(tag.commit.len())]
+        ));
+    }
+    body.push_str("</ul>");
+
+    render_page(
+        server,
+        repo_name,
+        &breadcrumb(repo_name, &[("tags".to_string(), None)]),
+        &body,
+    )
+}
+
+fn render_tag(server: &WebServer, repo_name: &str, repo_path: &PathBuf, name: &str) -> Response {
+    // The pattern also matches tags below refs/tags/<name>/
+    let tag = server
+        .get_tags(repo_path, &format!("refs/tags/{}", name), 100)
+        .ok()
+        .and_then(|tags| tags.into_iter().find(|tag| tag.name == name));
+    let tag = match tag {
+        Some(tag) if !name.is_empty() => tag,
+        _ => return (StatusCode::NOT_FOUND, "Tag not found").into_response(),
+    };
+
+    let mut body = format!(
+        "<h1>{}</h1>\n<p>Tag{} &middot; <small>{} by {}</small></p>\n",
+        html_escape(&tag.name),
+        signature_badge(&tag.signature),
+        tag.date,
+        html_escape(&tag.tagger)
+    );
+    if let Some(signer) = &tag.signature.signer {
+        body.push_str(&format!(
+            "<p><small>Signed by {}{}</small></p>\n",
+            html_escape(signer),
+            tag.signature
+                .key
+                .as_ref()
+                .map(|key| format!(" with key <code>{}</code>", html_escape(key)))
+                .unwrap_or_default()
+        ));
+    }
+    if !tag.message.is_empty() {
+        body.push_str(&format!("<pre>{}</pre>\n", html_escape(&tag.message)));
+    }
+    body.push_str(&releases::release_link(server, repo_name, repo_path, &tag.name));
+
+    let commits = server
+        .get_commits(repo_path, &tag.commit, 1)
+        .unwrap_or_default();
+    body.push_str(r#"<div class="section"><h2>Commit</h2>"#);
+    body.push_str(&render_commit_list(server, repo_name, &commits));
+    body.push_str(&format!(
+        r#"<p><a href="/repo/{}/tree/{}">Browse files</a></p></div>"#,
+        url_path(repo_name),
+        tag.commit
+    ));
+
+    render_page(
+        server,
+        repo_name,
+        &breadcrumb(
+            repo_name,
+            &[
+                (
+                    "tags".to_string(),
+                    Some(format!("/repo/{}/tags", url_path(repo_name))),
+                ),
+                (tag.name.clone(), None),
+            ],
+        ),
+        &body,
+    )
+}
+
+/// Verified or Unverified label for a signed commit or tag; nothing if unsigned
+fn signature_badge(signature: &Signature) -> String {
+    let detail = |what: &str| {
+        let mut title = what.to_string();
+        if let Some(signer) = &signature.signer {
+            title.push_str(&format!(" by {}", signer));
+        }
+        if let Some(key) = &signature.key {
+            title.push_str(&format!(" with key {}", key));
+        }
+        title
+    };
+    match signature.state {
+        signatures::State::Unsigned => String::new(),
+        signatures::State::Verified => format!(
+            r#" <span class="sig sig-verified" title="{}">Verified</span>"#,
+            html_escape(&detail("Signed"))
+        ),
+        signatures::State::Unverified => format!(
+            r#" <span class="sig sig-unverified" title="{}">Unverified</span>"#,
+            html_escape(&format!(
+                "{}: {}",
+                detail("Signed"),
+                signature.reason.as_deref().unwrap_or("not verified")
+            ))
+        ),
+    }
+}
+
+fn render_file_list(repo_name: &str, rev: &str, dir: &str, files: &[FileInfo]) -> String {
+    let mut html = String::from(r#"<div class="section"><h2>Files</h2><ul class="file-list">"#);
+
+    if !dir.is_empty() {
+        let parent = dir.rsplit_once('/').map(|(p, _)| p).unwrap_or("");
+        html.push_str(&format!(
+            r#"<li class="file-item"><a href="/repo/{}/tree/{}/{}">..</a></li>"#,
+            url_path(repo_name),
+            url_path(rev),
+            url_path(parent)
+        ));
+    }
+
+    for file in files {
+        let full_path = if dir.is_empty() {
+            file.name.clone()
+        } else {
+            format!("{}/{}", dir, file.name)
+        };
+        let view = if file.file_type == "tree" {
+            "tree"
+        } else {
+            "blob"
+        };
+        html.push_str(&format!(
+            r#"<li class="file-item"><a href="/repo/{}/{}/{}/{}">{}{}</a></li>"#,
+            url_path(repo_name),
+            view,
+            url_path(rev),
+            url_path(&full_path),
+            html_escape(&file.name),
+            if file.file_type == "tree" { "/" } else { "" }
+        ));
+    }
+
+    html.push_str("</ul></div>");
+    html
+}
+
+fn render_commit_list(server: &WebServer, repo_name: &str, commits: &[CommitInfo]) -> String {
+    let mut html = String::from(r#"<ul class="commit-list">"#);
+    for commit in commits {
+        html.push_str(&format!(
+            r#"<li class="commit-item">{}<a href="/repo/{}/commit/{}"><strong>{}</strong></a>{} - {} <br/><small>{} by {}</small></li>"#,
+            server.avatars.img(&commit.email, 20),
+            url_path(repo_name),
+            commit.id,
+            commit.hash,
+            signature_badge(&commit.signature),
+            html_escape(&commit.message),
+            commit.date,
+            html_escape(&commit.author)
+        ));
+    }
+    html.push_str("</ul>");
+    html
+}
+
+/// Render unified diff output with added/removed lines highlighted
+fn render_diff(diff: &str, view: DiffView) -> String {
+    if view == DiffView::Split {
+        return diff::split(
+            &crate::reviews::lines(diff),
+            |position| format!("<span class=\"diff-num\">{:>5}</span>", position.line),
+            |_| String::new(),
+        );
+    }
+    let mut html = String::from(r#"<pre class="diff">"#);
+    for line in diff.lines() {
+        let class = if line.starts_with("+++") || line.starts_with("---") {
+            "diff-file"
+        } else if line.starts_with('+') {
+            "diff-add"
+        } else if line.starts_with('-') {
+            "diff-del"
+        } else if line.starts_with("@@") {
+            "diff-hunk"
+        } else {
+            ""
+        };
+        html.push_str(&format!(
+            "<span class=\"{}\">{}</span>\n",
+            class,
+            html_escape(line)
+        ));
+    }
+    html.push_str("</pre>");
+    html
+}
+
+/// Breadcrumb entries for each directory level of a path
+fn path_crumbs(repo_name: &str, rev: &str, path: &str) -> Vec<(String, Option<String>)> {
+    let mut crumbs = vec![(
+        rev.to_string(),
+        Some(format!(
+            "/repo/{}/tree/{}",
+            url_path(repo_name),
+            url_path(rev)
+        )),
+    )];
+
+    let mut current = String::new();
+    for segment in path.split('/').filter(|s| !s.is_empty()) {
+        if !current.is_empty() {
+            current.push('/');
+        }
+        current.push_str(segment);
+        crumbs.push((
+            segment.to_string(),
+            Some(format!(
+                "/repo/{}/tree/{}/{}",
+                url_path(repo_name),
+                url_path(rev),
+                url_path(&current)
+            )),
+        ));
+    }
+
+    crumbs
+}
+
+fn breadcrumb(repo_name: &str, crumbs: &[(String, Option<String>)]) -> String {
     let mut html = format!(
+        r#"<a href="/">Home</a> / <a href="/repo/{}">{}</a>"#,
+        url_path(repo_name),
+        html_escape(repo_name)
+    );
+    for (label, href) in crumbs {
+        match href {
+            Some(href) => html.push_str(&format!(
+                r#" / <a href="{}">{}</a>"#,
+                href,
+                html_escape(label)
+            )),
+            None => html.push_str(&format!(" / {}", html_escape(label))),
+        }
+    }
+    html
+}
+
+/// Wrap page content in the common repository page layout
+fn render_page(server: &WebServer, title: &str, breadcrumb: &str, body: &str) -> Response {
+    render_page_with_head(server, title, breadcrumb, body, "")
+}
+
+/// Like `render_page`, with extra tags such as link preview metadata in the head
+fn render_page_with_head(
+    server: &WebServer,
+    title: &str,
+    breadcrumb: &str,
+    body: &str,
+    head: &str,
+) -> Response {
+    let html = format!(
         r#"<!DOCTYPE html>
 <html>
 <head>
@@ -348,6 +2606,7 @@ async fn handle_repo(
     <style>
         body {{ font-family: Arial, sans-serif; margin: 40px; }}
         h1 {{ color: #333; }}
+        a {{ color: #0066cc; text-decoration: none; }}
         .section {{ margin: 30px 0; }}
         .section h2 {{ color: #0066cc; border-bottom: 2px solid #0066cc; padding-bottom: 5px; }}
         .file-list, .commit-list {{ list-style: none; padding: 0; }}
@@ -357,51 +2616,196 @@ async fn handle_repo(
         }}
         .file-item:hover, .commit-item:hover {{ background: #f5f5f5; }}
         .breadcrumb {{ color: #666; margin-bottom: 20px; }}
+        .language-bar {{ display: flex; height: 8px; border-radius: 4px; overflow: hidden; background: #eee; }}
         pre {{ background: #f5f5f5; padding: 15px; border-radius: 5px; overflow-x: auto; }}
+        .diff-add {{ color: #22863a; background: #f0fff4; }}
+        .diff-del {{ color: #cb2431; background: #ffeef0; }}
+        .diff-hunk {{ color: #6f42c1; }}
+        .diff-file {{ font-weight: bold; }}
+        .avatar {{ border-radius: 3px; vertical-align: middle; margin-right: 8px; }}
+        .bell {{ float: right; }}
+        .account {{ float: right; margin-left: 12px; }}
+        .error {{ color: #cb2431; }}
+        .notice {{ background: #f0fff4; border: 1px solid #22863a; border-radius: 5px; padding: 10px; }}
+        .unread-count {{ background: #cb2431; color: #fff; border-radius: 8px; padding: 0 6px; font-size: 0.8em; }}
+        .commit-item.unread {{ font-weight: bold; }}
+        .mirror-error {{ color: #cb2431; }}
+        .clone-url input {{ font-family: monospace; width: 40em; max-width: 100%; }}
+        .sig {{ font-size: 0.75em; border: 1px solid; border-radius: 8px; padding: 0 6px; margin-left: 4px; }}
+        .sig-verified {{ color: #22863a; }}
+        .sig-unverified {{ color: #b08800; }}
+        .ahead {{ color: #22863a; }}
+        .behind {{ color: #cb2431; }}
+        .label {{ font-size: 0.75em; border: 1px solid #888; border-radius: 8px; padding: 0 6px; color: #333; }}
+        .topic {{ font-size: 0.85em; background: #eaf2fb; border-radius: 8px; padding: 0 8px; text-decoration: none; }}
+        .state-open {{ color: #22863a; }}
+        .state-closed {{ color: #cb2431; }}
+        .state-merged {{ color: #6f42c1; }}
+        .state-success, .state-delivered {{ color: #22863a; }}
+        .state-failure, .state-failed {{ color: #cb2431; }}
+        .state-queued, .state-running, .state-pending {{ color: #b08800; }}
+        .state-skipped {{ color: #999; }}
+        .build-log {{ max-height: 60em; overflow-y: auto; }}
+        .comment {{ border: 1px solid #ddd; border-radius: 5px; margin: 15px 0; }}
+        .comment-header {{ background: #f5f5f5; padding: 8px 12px; border-bottom: 1px solid #ddd; }}
+        .comment-body {{ padding: 0 12px; }}
+        .diff-num {{ color: #999; text-decoration: none; }}
+        .diff-toggle {{ font-size: 0.9em; }}
+        .diff-split {{ width: 100%; border-collapse: collapse; table-layout: fixed; background: #f5f5f5; font-family: monospace; font-size: 0.9em; }}
+        .diff-split td {{ padding: 0 6px; white-space: pre-wrap; word-break: break-all; vertical-align: top; }}
+        .diff-split td.diff-num {{ width: 4em; text-align: right; white-space: pre; }}
+        .diff-split td.diff-below {{ font-family: Arial, sans-serif; font-size: 1.1em; white-space: normal; word-break: normal; }}
+        .diff-empty {{ background: #eee; }}
+        .diff-add .diff-change {{ background: #acf2bd; }}
+        .diff-del .diff-change {{ background: #fdb8c0; }}
+        .review-thread {{ margin: 0 0 15px 3em; }}
+        .review-thread summary {{ cursor: pointer; }}
+        .default-branch {{ font-size: 0.75em; border: 1px solid #888; border-radius: 8px; padding: 0 6px; color: #666; }}
+        .archived {{ background: #fffbdd; border: 1px solid #b08800; border-radius: 5px; padding: 10px; }}
+        .maintenance {{ background: #fff5e6; border: 1px solid #d15704; border-radius: 5px; padding: 10px; }}
     </style>
+    {}
+    {}
 </head>
 <body>
+    {}
+    {}
     <div class="breadcrumb">
-        <a href="/">Home</a> / {}
+        {}
     </div>
-    <h1>{}</h1>
-    <p>{}</p>
+{}{}{}
+</body>
+</html>
 "#,
-        repo_name, repo_name, repo_name, description
+        html_escape(title),
+        server.custom_stylesheet(),
+        head,
+        account::links(server),
+        notifications::bell(server),
+        breadcrumb,
+        maintenance_banner(server),
+        archived_banner(),
+        body
     );
 
-    if !files.is_empty() {
-        html.push_str(r#"<div class="section"><h2>Files</h2><ul class="file-list">"#);
-        for file in files {
-            html.push_str(&format!(
-                r#"<li class="file-item">{} - {}</li>"#,
-                file.name, file.file_type
-            ));
-        }
-        html.push_str("</ul></div>");
+    Html(csrf::protect_forms(&html)).into_response()
+}
+
+/// Notice on every page of an archived repository
+fn archived_banner() -> &'static str {
+    if resolve::archived() {
+        "<p class=\"archived\">This repository has been archived. It is read-only: it can be cloned and browsed, but takes no more pushes or pull requests.</p>\n"
+    } else {
+        ""
     }
+}
 
-    if !readme.is_empty() {
-        html.push_str(&format!(
-            r#"<div class="section"><h2>README</h2><pre>{}</pre></div>"#,
-            html_escape(&readme)
+/// Notice on every page while the server, or the repository the page is
+/// about, is in maintenance
+fn maintenance_banner(server: &WebServer) -> String {
+    let (what, notice) = match maintenance_mode::server(&server.data_dir) {
+        Some(notice) => ("The server", notice),
+        None => match resolve::maintenance() {
+            Some(notice) => ("This repository", notice),
+            None => return String::new(),
+        },
+    };
+    let reason = if notice.message.is_empty() {
+        String::new()
+    } else {
+        format!(": {}", html_escape(&notice.message))
+    };
+    format!(
+        "<p class=\"maintenance\">{} is in maintenance{}. It can be cloned and browsed, but takes no pushes or merges until it is over.</p>\n",
+        what, reason
+    )
+}
+
+/// Where a repository is mirrored from or to, and how the last sync went
+fn render_mirrors(repo_path: &PathBuf) -> String {
+    let mut out = String::new();
+    for m in mirror::list(repo_path) {
+        let url = html_escape(&mirror::redact(&m.url));
+        let what = match m.direction {
+            mirror::Direction::Pull => format!("Mirror of <code>{}</code>", url),
+            mirror::Direction::Push => format!("Mirrored to <code>{}</code>", url),
+        };
+        let status = mirror::status(repo_path, &m.name);
+        let state = match (&status.error, status.last_attempt, status.last_success) {
+            (Some(error), Some(attempt), _) => format!(
+                "<span class=\"mirror-error\" title=\"{}\">failing since {}</span>",
+                html_escape(error),
+                relative_time(status.failing_since.unwrap_or(attempt))
+            ),
+            (None, _, Some(success)) => format!("synced {}", relative_time(success)),
+            _ => "not synced yet".to_string(),
+        };
+        out.push_str(&format!(
+            "<p class=\"mirror\">{} &middot; {}</p>\n",
+            what, state
         ));
     }
+    out
+}
 
-    if !commits.is_empty() {
-        html.push_str(r#"<div class="section"><h2>Recent Commits</h2><ul class="commit-list">"#);
-        for commit in commits {
-            html.push_str(&format!(
-                r#"<li class="commit-item"><strong>{}</strong> - {} <br/><small>{} by {}</small></li>"#,
-                commit.hash, html_escape(&commit.message), commit.date, html_escape(&commit.author)
-            ));
-        }
-        html.push_str("</ul></div>");
+/// Clone URLs in read-only fields to copy from; pages run no scripts, so
+/// there are no copy buttons
+fn render_clone_urls(urls: &[(&str, String)]) -> String {
+    let mut out = String::new();
+    for (protocol, url) in urls {
+        out.push_str(&format!(
+            "<p class=\"clone-url\"><label>Clone ({}) <input type=\"text\" readonly value=\"{}\" aria-label=\"{} clone URL\"></label></p>\n",
+            protocol.to_uppercase(),
+            html_escape(url),
+            protocol.to_uppercase()
+        ));
     }
+    if urls.iter().any(|(protocol, _)| *protocol == "ssh") {
+        out.push_str("<p><small>First clone over SSH? <a href=\"/host-keys\">Check the server's host key</a></small></p>\n");
+    }
+    out
+}
 
-    html.push_str("</body></html>");
+/// Relative time like git's `%ar`, e.g. "3 days ago"
+fn relative_time(timestamp: i64) -> String {
+    let secs = chrono::Utc::now().timestamp() - timestamp;
+    if secs < 0 {
+        return "in the future".to_string();
+    }
 
-    Html(html).into_response()
+    let plural = |n: i64, unit: &str| format!("{} {}{}", n, unit, if n == 1 { "" } else { "s" });
+    let ago = match secs {
+        s if s < 90 => plural(s, "second"),
+        s if s < 90 * 60 => plural((s + 30) / 60, "minute"),
+        s if s < 36 * 3600 => plural((s + 1800) / 3600, "hour"),
+        s if s < 14 * 86400 => plural((s + 43200) / 86400, "day"),
+        s if s < 70 * 86400 => plural((s + 302400) / 604800, "week"),
+        s if s < 365 * 86400 => plural((s + 1296000) / 2592000, "month"),
+        s => {
+            let months = (s + 1296000) / 2592000;
+            let (years, months) = (months / 12, months % 12);
+            if months > 0 && years < 5 {
+                format!("{}, {}", plural(years, "year"), plural(months, "month"))
+            } else {
+                plural(years, "year")
+            }
+        }
+    };
+    format!("{} ago", ago)
+}
+
+/// Percent-encode a value for use in a URL path, keeping `/` separators
+fn url_path(s: &str) -> String {
+    let mut out = String::with_capacity(s.len());
+    for b in s.bytes() {
+        match b {
+            b'A'..=b'Z' | b'a'..=b'z' | b'0'..=b'9' | b'-' | b'_' | b'.' | b'~' | b'/' => {
+                out.push(b as char)
+            }
+            _ => out.push_str(&format!("%{:02X}", b)),
+        }
+    }
+    out
 }
 
 fn html_escape(s: &str) -> String {
@@ -0,0 +1,234 @@
+use super::request_id::RequestId;
+use axum::{
+    body::HttpBody,
+    extract::{ConnectInfo, Request, State},
+    http::{header, HeaderMap},
+    middleware::Next,
+    response::Response,
+};
+use std::fs::{File, OpenOptions};
+use std::io::{self, Write};
+use std::net::SocketAddr;
+use std::path::Path;
+use std::str::FromStr;
+use std::sync::{Arc, Mutex};
+use std::time::Instant;
+
+/// Output format of the HTTP access log
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq)]
+pub enum AccessLogFormat {
+    /// NCSA common log format, followed by the request latency
+    #[default]
+    Common,
+    /// NCSA combined log format (common plus referer and user agent), followed by the latency
+    Combined,
+    /// One JSON object per request
+    Json,
+}
+
+impl FromStr for AccessLogFormat {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "common" => Ok(Self::Common),
+            "combined" => Ok(Self::Combined),
+            "json" => Ok(Self::Json),
+            _ => Err(format!(
+                "unknown access log format '{}' (expected common, combined or json)",
+                s
+            )),
+        }
+    }
+}
+
+/// Where access log lines are written
+#[derive(Clone, Debug, Default)]
+pub enum AccessLogOutput {
+    /// Through the application log, under the `agito::access` target
+    #[default]
+    Tracing,
+    /// Directly to standard output, one line per request
+    Stdout,
+    /// Appended to a dedicated file
+    File(Arc<Mutex<File>>),
+}
+
+impl AccessLogOutput {
+    /// Open an access log destination: `-` for stdout, otherwise a file path
+    pub fn open(target: &str) -> io::Result<Self> {
+        if target == "-" {
+            return Ok(Self::Stdout);
+        }
+
+        if let Some(parent) = Path::new(target).parent() {
+            std::fs::create_dir_all(parent)?;
+        }
+        let file = OpenOptions::new().create(true).append(true).open(target)?;
+        Ok(Self::File(Arc::new(Mutex::new(file))))
+    }
+
+    fn write(&self, line: &str) {
+        match self {
+            Self::Tracing => tracing::info!(target: "agito::access", "{}", line),
+            Self::Stdout => println!("{}", line),
+            Self::File(file) => {
+                let mut file = file.lock().unwrap();
+                if let Err(e) = writeln!(file, "{}", line) {
+                    tracing::warn!("Failed to write access log: {}", e);
+                }
+            }
+        }
+    }
+}
+
+/// Authenticated user for a request. Handlers that identify the caller insert
+/// this into the response extensions so it shows up in the access log.
+#[derive(Clone, Debug)]
+pub struct RemoteUser(pub String);
+
+/// Access log settings for the web server
+#[derive(Clone, Debug, Default)]
+pub struct AccessLog {
+    pub format: AccessLogFormat,
+    pub output: AccessLogOutput,
+    /// Take the client address from X-Forwarded-For; only enable behind a trusted reverse proxy
+    pub trust_proxy: bool,
+}
+
+struct Entry<'a> {
+    remote: String,
+    user: Option<String>,
+    method: &'a str,
+    path: &'a str,
+    version: &'a str,
+    status: u16,
+    bytes: Option<u64>,
+    referer: Option<String>,
+    user_agent: Option<String>,
+    request_id: Option<String>,
+    latency_ms: f64,
+}
+
+impl AccessLog {
+    pub(super) fn remote_addr(&self, headers: &HeaderMap, peer: Option<SocketAddr>) -> String {
+        if self.trust_proxy {
+            // The proxy appends the address it saw; anything before it came
+            // from the client, which may write whatever it likes there
+            let forwarded = headers
+                .get_all("x-forwarded-for")
+                .iter()
+                .last()
+                .and_then(|v| v.to_str().ok())
+                .and_then(|v| v.rsplit(',').next())
+                .map(|v| v.trim())
+                .filter(|v| !v.is_empty());
+            if let Some(addr) = forwarded {
+                return addr.to_string();
+            }
+        }
+
+        peer.map(|addr| addr.ip().to_string())
+            .unwrap_or_else(|| "-".to_string())
+    }
+
+    fn format(&self, entry: &Entry) -> String {
+        let common = || {
+            format!(
+                "{} - {} [{}] \"{} {} {}\" {} {}",
+                entry.remote,
+                entry.user.as_deref().unwrap_or("-"),
+                chrono::Local::now().format("%d/%b/%Y:%H:%M:%S %z"),
+                entry.method,
+                entry.path,
+                entry.version,
+                entry.status,
+                entry
+                    .bytes
+                    .map(|b| b.to_string())
+                    .unwrap_or_else(|| "-".to_string()),
+            )
+        };
+
+        match self.format {
+            AccessLogFormat::Common => format!("{} {:.3}ms", common(), entry.latency_ms),
+            AccessLogFormat::Combined => format!(
+                "{} \"{}\" \"{}\" {:.3}ms",
+                common(),
+                quote(entry.referer.as_deref().unwrap_or("-")),
+                quote(entry.user_agent.as_deref().unwrap_or("-")),
+                entry.latency_ms
+            ),
+            AccessLogFormat::Json => serde_json::json!({
+                "time": chrono::Utc::now().to_rfc3339(),
+                "remote": entry.remote,
+                "user": entry.user,
+                "method": entry.method,
+                "path": entry.path,
+                "protocol": entry.version,
+                "status": entry.status,
+                "bytes": entry.bytes,
+                "referer": entry.referer,
+                "user_agent": entry.user_agent,
+                "request_id": entry.request_id,
+                "latency_ms": entry.latency_ms,
+            })
+            .to_string(),
+        }
+    }
+}
+
+/// Escape a header value for use inside a quoted log field
+fn quote(value: &str) -> String {
+    value.replace('\\', "\\\\").replace('"', "\\\"")
+}
+
+fn header_value(headers: &HeaderMap, name: header::HeaderName) -> Option<String> {
+    headers
+        .get(name)
+        .and_then(|v| v.to_str().ok())
+        .map(|v| v.to_string())
+}
+
+/// Middleware that writes one access log line per request
+pub async fn middleware(State(log): State<Arc<AccessLog>>, req: Request, next: Next) -> Response {
+    let start = Instant::now();
+
+    let peer = req
+        .extensions()
+        .get::<ConnectInfo<SocketAddr>>()
+        .map(|info| info.0);
+    let remote = log.remote_addr(req.headers(), peer);
+    let referer = header_value(req.headers(), header::REFERER);
+    let user_agent = header_value(req.headers(), header::USER_AGENT);
+    let method = req.method().to_string();
+    let path = req
+        .uri()
+        .path_and_query()
+        .map(|p| p.to_string())
+        .unwrap_or_else(|| req.uri().path().to_string());
+    let version = format!("{:?}", req.version());
+    let request_id = req.extensions().get::<RequestId>().map(|id| id.0.clone());
+
+    let response = next.run(req).await;
+
+    let entry = Entry {
+        remote,
+        user: response
+            .extensions()
+            .get::<RemoteUser>()
+            .map(|user| user.0.clone()),
+        method: &method,
+        path: &path,
+        version: &version,
+        status: response.status().as_u16(),
+        bytes: response.body().size_hint().exact(),
+        referer,
+        user_agent,
+        request_id,
+        latency_ms: start.elapsed().as_secs_f64() * 1000.0,
+    };
+    log.output.write(&log.format(&entry));
+
+    response
+}
@@ -0,0 +1,710 @@
+use super::auth::{current_user, remote_addr, token_scope, SESSION_COOKIE};
+use super::settings::error_message;
+use super::{html_escape, relative_time, render_page, subscription, url_path, WebServer};
+use crate::audit::{self, Action, Via};
+use crate::deploy_keys;
+use crate::orgs::{self, Role};
+use crate::tokens;
+use crate::users::{self, Registration, State as AccountState, User};
+use axum::{
+    extract::{Query, State},
+    http::{header, StatusCode},
+    response::{IntoResponse, Redirect, Response},
+    Form,
+};
+use std::collections::HashMap;
+use std::sync::Arc;
+
+fn page(server: &WebServer, title: &str, body: &str) -> Response {
+    render_page(
+        server,
+        title,
+        &format!(r#"<a href="/">Home</a> / {}"#, html_escape(title)),
+        body,
+    )
+}
+
+fn accounts_disabled() -> Response {
+    (
+        StatusCode::NOT_FOUND,
+        "This server has no accounts; sign in through its proxy",
+    )
+        .into_response()
+}
+
+fn unauthorized() -> Response {
+    Redirect::to("/login?next=/account").into_response()
+}
+
+/// Only local paths, so the sign-in form cannot send users elsewhere
+fn safe_next(next: Option<&String>) -> String {
+    next.map(|n| n.as_str())
+        .filter(|n| n.starts_with('/') && !n.starts_with("//") && !n.contains('\\'))
+        .unwrap_or("/")
+        .to_string()
+}
+
+/// Sign `name` in and continue to `next`
+fn sign_in(server: &WebServer, name: &str, user: &User, next: &str) -> Response {
+    let sessions = match &server.sessions {
+        Some(sessions) => sessions,
+        None => return accounts_disabled(),
+    };
+    let secure = server
+        .public_url
+        .as_deref()
+        .map_or(false, |url| url.starts_with("https://"));
+    let cookie = format!(
+        "{}={}; Path=/; HttpOnly; SameSite=Lax; Max-Age={}{}",
+        SESSION_COOKIE,
+        sessions.issue(name, user),
+        users::SESSION_TTL,
+        if secure { "; Secure" } else { "" }
+    );
+    ([(header::SET_COOKIE, cookie)], Redirect::to(next)).into_response()
+}
+
+fn login_form(server: &WebServer, next: &str, error: Option<&str>) -> Response {
+    let mut body = String::from("<h1>Sign in</h1>\n");
+    body.push_str(&error_message(error));
+    body.push_str(&format!(
+        "<form method=\"post\" action=\"/login\">\n<input type=\"hidden\" name=\"next\" value=\"{}\">\n<label>User name<br><input type=\"text\" name=\"user\" required autofocus></label><br>\n<label>Password<br><input type=\"password\" name=\"password\" required></label><br>\n<button type=\"submit\">Sign in</button>\n</form>\n",
+        html_escape(next)
+    ));
+    if server.registration.get() != Registration::Closed {
+        body.push_str("<p>No account yet? <a href=\"/register\">Register</a></p>\n");
+    }
+    page(server, "Sign in", &body)
+}
+
+/// Sign-in form: /login?next=<path>
+pub async fn login_page(
+    State(server): State<Arc<WebServer>>,
+    Query(query): Query<HashMap<String, String>>,
+) -> Response {
+    if server.sessions.is_none() {
+        return accounts_disabled();
+    }
+    login_form(&server, &safe_next(query.get("next")), None)
+}
+
+pub async fn login(
+    State(server): State<Arc<WebServer>>,
+    Form(form): Form<HashMap<String, String>>,
+) -> Response {
+    if server.sessions.is_none() {
+        return accounts_disabled();
+    }
+    let next = safe_next(form.get("next"));
+    let name = form.get("user").map(|u| u.trim()).unwrap_or("");
+    let password = form.get("password").map(String::as_str).unwrap_or("");
+    let data_dir = server.data_dir.clone();
+    let (name_owned, password) = (name.to_string(), password.to_string());
+    // Hashing the password takes a while, so keep it off the async workers
+    let result =
+        tokio::task::spawn_blocking(move || users::authenticate(&data_dir, &name_owned, &password))
+            .await;
+    match result {
+        Ok(Ok(user)) => {
+            tracing::info!(user = %name, "Signed in");
+            sign_in(&server, name, &user, &next)
+        }
+        Ok(Err(e)) => {
+            audit::Entry::new(Action::AuthFailure, Via::Web, Some(name))
+                .with_detail(format!("Sign-in failed: {}", e))
+                .with_remote(remote_addr())
+                .record(&server.data_dir);
+            login_form(&server, &next, Some(&e))
+        }
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
+
+pub async fn logout() -> Response {
+    let cookie = format!(
+        "{}=; Path=/; HttpOnly; SameSite=Lax; Max-Age=0",
+        SESSION_COOKIE
+    );
+    ([(header::SET_COOKIE, cookie)], Redirect::to("/")).into_response()
+}
+
+fn register_form(
+    server: &WebServer,
+    bootstrap: Option<&str>,
+    form: &HashMap<String, String>,
+    error: Option<&str>,
+) -> Response {
+    let mut body = String::from("<h1>Register</h1>\n");
+    match (bootstrap, server.registration.get()) {
+        (Some(_), _) => body.push_str("<p>This account becomes the server's first admin.</p>\n"),
+        (None, Registration::Approval) => {
+            body.push_str("<p>An admin approves new accounts before they can be used.</p>\n")
+        }
+        _ => {}
+    }
+    body.push_str(&error_message(error));
+    let value = |field: &str| html_escape(form.get(field).map(String::as_str).unwrap_or(""));
+    body.push_str(&format!(
+        "<form method=\"post\" action=\"/register\">\n<input type=\"hidden\" name=\"bootstrap\" value=\"{}\">\n<label>User name<br><input type=\"text\" name=\"user\" value=\"{}\" required></label><br>\n<label>Display name<br><input type=\"text\" name=\"display_name\" value=\"{}\"></label><br>\n<label>Email<br><input type=\"email\" name=\"email\" value=\"{}\" required></label><br>\n<label>Password<br><input type=\"password\" name=\"password\" required minlength=\"8\"></label><br>\n<button type=\"submit\">Register</button>\n</form>\n",
+        html_escape(bootstrap.unwrap_or("")),
+        value("user"),
+        value("display_name"),
+        value("email")
+    ));
+    page(server, "Register", &body)
+}
+
+/// Registration form: /register, or /register?bootstrap=<token> for the
+/// first admin
+pub async fn register_page(
+    State(server): State<Arc<WebServer>>,
+    Query(query): Query<HashMap<String, String>>,
+) -> Response {
+    if server.sessions.is_none() {
+        return accounts_disabled();
+    }
+    let bootstrap = query
+        .get("bootstrap")
+        .map(String::as_str)
+        .filter(|t| !t.is_empty());
+    if bootstrap.is_none() && server.registration.get() == Registration::Closed {
+        return (
+            StatusCode::FORBIDDEN,
+            "Registration is closed; ask an admin for an account",
+        )
+            .into_response();
+    }
+    register_form(&server, bootstrap, &HashMap::new(), None)
+}
+
+pub async fn register(
+    State(server): State<Arc<WebServer>>,
+    Form(form): Form<HashMap<String, String>>,
+) -> Response {
+    if server.sessions.is_none() {
+        return accounts_disabled();
+    }
+    let bootstrap = form
+        .get("bootstrap")
+        .map(String::as_str)
+        .filter(|t| !t.is_empty());
+    let first_admin = match bootstrap {
+        Some(token) if users::valid_bootstrap(&server.data_dir, token) => true,
+        Some(_) => {
+            return register_form(
+                &server,
+                None,
+                &form,
+                Some("The bootstrap link has already been used or is wrong"),
+            )
+        }
+        None if server.registration.get() == Registration::Closed => {
+            return (
+                StatusCode::FORBIDDEN,
+                "Registration is closed; ask an admin for an account",
+            )
+                .into_response()
+        }
+        None => false,
+    };
+
+    let field = |name: &str| form.get(name).map(|v| v.trim()).unwrap_or("");
+    let name = field("user").to_string();
+    let display_name = Some(field("display_name"))
+        .filter(|d| !d.is_empty())
+        .unwrap_or(&name)
+        .to_string();
+    let state = if first_admin || server.registration.get() == Registration::Open {
+        AccountState::Active
+    } else {
+        AccountState::Pending
+    };
+    let mut user = User::new(&display_name, field("email"), state);
+    user.admin = first_admin;
+    let password = form.get("password").cloned().unwrap_or_default();
+    let data_dir = server.data_dir.clone();
+    let created = tokio::task::spawn_blocking(move || {
+        user.password = Some(users::hash_password(&password)?);
+        users::create(&data_dir, &name, user.clone())?;
+        if first_admin {
+            users::bootstrap_token(&data_dir)?;
+        }
+        Ok::<_, anyhow::Error>((name, user))
+    })
+    .await;
+
+    match created {
+        Ok(Ok((name, user))) => {
+            tracing::info!(user = %name, state = user.state.name(), admin = user.admin, "Registered");
+            audit::Entry::new(Action::AccountChange, Via::Web, Some(&name))
+                .with_target(&name)
+                .with_detail(format!(
+                    "registered ({}{})",
+                    user.state.name(),
+                    if user.admin { ", admin" } else { "" }
+                ))
+                .with_remote(remote_addr())
+                .record(&server.data_dir);
+            if user.is_active() {
+                sign_in(&server, &name, &user, "/account")
+            } else {
+                page(
+                    &server,
+                    "Register",
+                    "<h1>Thanks for registering</h1>\n<p>You can sign in once an admin has approved your account.</p>\n",
+                )
+            }
+        }
+        Ok(Err(e)) => register_form(&server, bootstrap, &form, Some(&format!("{:#}", e))),
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
+
+/// The account page; `new_token` is a token just created, shown this once
+fn account_form(
+    server: &WebServer,
+    name: &str,
+    error: Option<&str>,
+    new_token: Option<&str>,
+) -> Response {
+    let user = match users::get(&server.data_dir, name) {
+        Some(user) => user,
+        None => {
+            return page(
+                server,
+                "Account",
+                &format!(
+                    "<h1>{}</h1>\n<p>You are signed in through the server's proxy and have no account to manage here.</p>\n",
+                    html_escape(name)
+                ),
+            )
+        }
+    };
+
+    let mut body = format!("<h1>{}</h1>\n", html_escape(name));
+    body.push_str(&error_message(error));
+    let member_of: Vec<String> = orgs::load(&server.data_dir)
+        .unwrap_or_default()
+        .into_iter()
+        .filter(|(_, org)| org.is_member(name))
+        .map(|(org, _)| {
+            format!(
+                "<a href=\"/org/{}\">{}</a>",
+                url_path(&org),
+                html_escape(&org)
+            )
+        })
+        .collect();
+    if !member_of.is_empty() {
+        body.push_str(&format!("<p>Organizations: {}</p>\n", member_of.join(", ")));
+    }
+    body.push_str(&format!(
+        "<h2>Profile</h2>\n<form method=\"post\" action=\"/account\">\n<input type=\"hidden\" name=\"action\" value=\"profile\">\n<label>Display name<br><input type=\"text\" name=\"display_name\" value=\"{}\"></label><br>\n<label>Email<br><input type=\"email\" name=\"email\" value=\"{}\" required></label><br>\n<button type=\"submit\">Save</button>\n</form>\n",
+        html_escape(&user.display_name),
+        html_escape(&user.email)
+    ));
+    body.push_str(&format!(
+        "<h2>Password</h2>\n<form method=\"post\" action=\"/account\">\n<input type=\"hidden\" name=\"action\" value=\"password\">\n{}<label>New password<br><input type=\"password\" name=\"new\" required minlength=\"8\"></label><br>\n<button type=\"submit\">Change password</button>\n</form>\n",
+        if user.password.is_some() {
+            "<label>Current password<br><input type=\"password\" name=\"current\" required></label><br>\n"
+        } else {
+            ""
+        }
+    ));
+
+    body.push_str("<h2>SSH keys</h2>\n");
+    if user.keys.is_empty() {
+        body.push_str("<p>No keys yet.</p>\n");
+    } else {
+        body.push_str("<ul class=\"file-list\">\n");
+        for (i, key) in user.keys.iter().enumerate() {
+            body.push_str(&format!(
+                "<li class=\"file-item\"><code>{}</code> <form method=\"post\" action=\"/account\" style=\"display:inline\"><input type=\"hidden\" name=\"action\" value=\"remove-key\"><input type=\"hidden\" name=\"key\" value=\"{}\"><button type=\"submit\">Remove</button></form></li>\n",
+                html_escape(&short_key(key)),
+                i
+            ));
+        }
+        body.push_str("</ul>\n");
+    }
+    body.push_str("<form method=\"post\" action=\"/account\">\n<input type=\"hidden\" name=\"action\" value=\"add-key\">\n<textarea name=\"key\" rows=\"3\" cols=\"70\" placeholder=\"ssh-ed25519 AAAA... you@host\" required></textarea><br>\n<button type=\"submit\">Add key</button>\n</form>\n");
+    body.push_str(&tokens_section(server, name, new_token));
+    body.push_str(&subscription::account_section(server, name));
+
+    page(server, "Account", &body)
+}
+
+/// Expiry choices offered for new tokens, in days; 0 never expires
+const TOKEN_EXPIRY_DAYS: [i64; 4] = [30, 90, 365, 0];
+
+/// The account's access tokens, and a form for another
+fn tokens_section(server: &WebServer, name: &str, new_token: Option<&str>) -> String {
+    let mut section = String::from(
+        "<h2>Access tokens</h2>\n<p>Tokens let scripts use the API as you, sent as <code>Authorization: Bearer &lt;token&gt;</code> or as a basic auth password. A token may do no more than its scope allows.</p>\n",
+    );
+    if let Some(secret) = new_token {
+        section.push_str(&format!(
+            "<p class=\"notice\">Your new token is <code>{}</code><br>Copy it now; it won't be shown again.</p>\n",
+            html_escape(secret)
+        ));
+    }
+
+    let now = chrono::Utc::now().timestamp();
+    let found = tokens::list(&server.data_dir, name).unwrap_or_default();
+    if found.is_empty() {
+        section.push_str("<p>No tokens.</p>\n");
+    } else {
+        section.push_str("<table>\n<tr><th>Name</th><th>Scope</th><th>Created</th><th>Expires</th><th>Last used</th><th></th></tr>\n");
+        for token in &found {
+            let expires = match token.expires {
+                Some(_) if token.expired(now) => "expired".to_string(),
+                Some(expires) => chrono::DateTime::from_timestamp(expires, 0)
+                    .map(|t| t.format("%Y-%m-%d").to_string())
+                    .unwrap_or_default(),
+                None => "never".to_string(),
+            };
+            section.push_str(&format!(
+                "<tr><td>{}</td><td>{}</td><td>{}</td><td>{}</td><td>{}</td><td><form method=\"post\" action=\"/account\"><input type=\"hidden\" name=\"action\" value=\"revoke-token\"><input type=\"hidden\" name=\"token\" value=\"{}\"><button type=\"submit\">Revoke</button></form></td></tr>\n",
+                html_escape(&token.name),
+                token.scope.name(),
+                relative_time(token.created),
+                expires,
+                token.last_used.map(relative_time).unwrap_or_else(|| "never".to_string()),
+                token.id
+            ));
+        }
+        section.push_str("</table>\n");
+    }
+
+    let expiry_options: String = TOKEN_EXPIRY_DAYS
+        .iter()
+        .map(|&days| {
+            format!(
+                "<option value=\"{}\"{}>{}</option>",
+                days,
+                if days == 90 { " selected" } else { "" },
+                if days == 0 {
+                    "Never".to_string()
+                } else {
+                    format!("{} days", days)
+                }
+            )
+        })
+        .collect();
+    section.push_str(&format!(
+        "<form method=\"post\" action=\"/account\">\n<input type=\"hidden\" name=\"action\" value=\"create-token\">\n<label>Name<br><input type=\"text\" name=\"name\" placeholder=\"deploy script\" required></label><br>\n<label>Scope<br><select name=\"scope\"><option value=\"read\">read</option><option value=\"write\">write</option><option value=\"admin\">admin</option></select></label><br>\n<label>Expires<br><select name=\"expires\">{}</select></label><br>\n<button type=\"submit\">Create token</button>\n</form>\n",
+        expiry_options
+    ));
+    section
+}
+
+fn create_token(server: &WebServer, name: &str, form: &HashMap<String, String>) -> Response {
+    let field = |key: &str| form.get(key).map(String::as_str).unwrap_or("");
+    let scope: Role = match field("scope").parse() {
+        Ok(scope) => scope,
+        Err(e) => return account_form(server, name, Some(&e), None),
+    };
+    let expires = match field("expires").parse::<i64>() {
+        Ok(0) => None,
+        Ok(days) if TOKEN_EXPIRY_DAYS.contains(&days) => {
+            Some(chrono::Utc::now().timestamp() + days * 24 * 3600)
+        }
+        _ => return account_form(server, name, Some("Choose when the token expires"), None),
+    };
+    match tokens::create(&server.data_dir, name, field("name"), scope, expires) {
+        Ok((token, secret)) => {
+            tracing::info!(user = %name, "Created access token {} ({}, {})", token.id, token.name, scope.name());
+            audit::Entry::new(Action::TokenCreate, Via::Web, Some(name))
+                .with_target(name)
+                .with_detail(format!(
+                    "token {} ({}, {})",
+                    token.id,
+                    token.name,
+                    scope.name()
+                ))
+                .with_remote(remote_addr())
+                .record(&server.data_dir);
+            account_form(server, name, None, Some(&secret))
+        }
+        Err(e) => account_form(server, name, Some(&format!("{:#}", e)), None),
+    }
+}
+
+/// A key with the middle of its base64 left out
+fn short_key(key: &str) -> String {
+    let mut fields = key.split_whitespace();
+    let (kind, base64, comment) = (
+        fields.next().unwrap_or(""),
+        fields.next().unwrap_or(""),
+        fields.next().unwrap_or(""),
+    );
+    let base64 = if base64.len() > 24 {
+        format!("{}...{}", &base64[..12], &base64[base64.len() - 12..])
+    } else {
+        base64.to_string()
+    };
+    format!("{} {} {}", kind, base64, comment)
+        .trim()
+        .to_string()
+}
+
+/// The signed-in user's account: /account
+pub async fn account_page(State(server): State<Arc<WebServer>>) -> Response {
+    match current_user() {
+        Some(name) => account_form(&server, &name, None, None),
+        None => unauthorized(),
+    }
+}
+
+pub async fn save_account(
+    State(server): State<Arc<WebServer>>,
+    Form(form): Form<HashMap<String, String>>,
+) -> Response {
+    let name = match current_user() {
+        Some(name) => name,
+        None => return unauthorized(),
+    };
+    // A token must not be able to change its account or mint more tokens
+    if token_scope().is_some() {
+        return (
+            StatusCode::FORBIDDEN,
+            "Sign in with your password to change your account",
+        )
+            .into_response();
+    }
+    let action = form.get("action").cloned().unwrap_or_default();
+    match action.as_str() {
+        "create-token" => return create_token(&server, &name, &form),
+        "revoke-token" => {
+            let result = form
+                .get("token")
+                .and_then(|id| id.parse().ok())
+                .ok_or_else(|| anyhow::anyhow!("No token given"))
+                .and_then(|id| tokens::revoke(&server.data_dir, Some(&name), id));
+            return match result {
+                Ok(token) => {
+                    tracing::info!(user = %name, "Revoked access token {} ({})", token.id, token.name);
+                    audit::Entry::new(Action::TokenRevoke, Via::Web, Some(&name))
+                        .with_target(&name)
+                        .with_detail(format!("token {} ({})", token.id, token.name))
+                        .with_remote(remote_addr())
+                        .record(&server.data_dir);
+                    Redirect::to("/account").into_response()
+                }
+                Err(e) => account_form(&server, &name, Some(&format!("{:#}", e)), None),
+            };
+        }
+        _ => {}
+    }
+    let changes_password = action == "password";
+    let (repos_dir, data_dir) = (server.repos_dir.clone(), server.data_dir.clone());
+    let account = name.clone();
+    let remote = remote_addr();
+    let result = tokio::task::spawn_blocking(move || {
+        let field = |key: &str| form.get(key).cloned().unwrap_or_default();
+        let mut change = None;
+        let result = users::update(&data_dir, &account, |user| {
+            match action.as_str() {
+                "profile" => {
+                    let email = field("email").trim().to_string();
+                    if !email.contains('@') {
+                        anyhow::bail!("Invalid email address '{}'", email);
+                    }
+                    user.display_name = field("display_name").trim().to_string();
+                    user.email = email;
+                }
+                "password" => {
+                    let current = field("current");
+                    if let Some(hash) = &user.password {
+                        if !users::verify_password(hash, &current) {
+                            anyhow::bail!("The current password is wrong");
+                        }
+                    }
+                    user.password = Some(users::hash_password(&field("new"))?);
+                    change = Some((Action::AccountChange, "password changed".to_string()));
+                }
+                "add-key" => {
+                    let key = users::normalize_key(&field("key"))?;
+                    if let Some(repo) = deploy_keys::find(&repos_dir, &key) {
+                        anyhow::bail!("This key is a deploy key of {}", repo);
+                    }
+                    if !user.keys.contains(&key) {
+                        change = Some((Action::KeyAdd, audit::key_fingerprint(&key)));
+                        user.keys.push(key);
+                    }
+                }
+                "remove-key" => {
+                    let index: usize = field("key").parse()?;
+                    if index < user.keys.len() {
+                        let key = user.keys.remove(index);
+                        change = Some((Action::KeyRemove, audit::key_fingerprint(&key)));
+                    }
+                }
+                _ => anyhow::bail!("Unknown action '{}'", action),
+            }
+            Ok(())
+        });
+        if let (Ok(_), Some((action, detail))) = (&result, change) {
+            audit::Entry::new(action, Via::Web, Some(&account))
+                .with_target(&account)
+                .with_detail(detail)
+                .with_remote(remote)
+                .record(&data_dir);
+        }
+        result
+    })
+    .await;
+
+    match result {
+        // A new password ends the old session, so start a fresh one
+        Ok(Ok(user)) if changes_password => sign_in(&server, &name, &user, "/account"),
+        Ok(Ok(_)) => Redirect::to("/account").into_response(),
+        Ok(Err(e)) => account_form(&server, &name, Some(&format!("{:#}", e)), None),
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
+
+fn forbidden() -> Response {
+    (StatusCode::FORBIDDEN, "Only server admins may manage users").into_response()
+}
+
+/// Accounts and their approval: /admin/users
+pub async fn admin_page(State(server): State<Arc<WebServer>>) -> Response {
+    if !current_user().map_or(false, |user| server.is_admin(&user)) {
+        return forbidden();
+    }
+    let accounts = match users::load(&server.data_dir) {
+        Ok(accounts) => accounts,
+        Err(e) => return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    };
+
+    let mut body = format!(
+        "<h1>Users</h1>\n<p>Registration is {}.</p>\n",
+        match server.registration.get() {
+            Registration::Closed => "closed",
+            Registration::Approval => "open, with approval",
+            Registration::Open => "open",
+        }
+    );
+    body.push_str(
+        "<table>\n<tr><th>User</th><th>Email</th><th>State</th><th>Registered</th><th></th></tr>\n",
+    );
+    // Pending accounts first, as they are what admins come here for
+    let mut accounts: Vec<_> = accounts.into_iter().collect();
+    accounts.sort_by_key(|(_, user)| user.state != AccountState::Pending);
+    for (name, user) in &accounts {
+        let button = |action: &str, label: &str| {
+            format!(
+                "<form method=\"post\" action=\"/admin/users\" style=\"display:inline\"><input type=\"hidden\" name=\"user\" value=\"{}\"><input type=\"hidden\" name=\"action\" value=\"{}\"><button type=\"submit\">{}</button></form>",
+                html_escape(name),
+                action,
+                label
+            )
+        };
+        let mut actions = match user.state {
+            AccountState::Pending => {
+                button("approve", "Approve") + " " + &button("disable", "Reject")
+            }
+            AccountState::Active => button("disable", "Disable"),
+            AccountState::Disabled => button("approve", "Enable"),
+        };
+        actions.push(' ');
+        actions.push_str(&if user.admin {
+            button("revoke-admin", "Revoke admin")
+        } else {
+            button("make-admin", "Make admin")
+        });
+        body.push_str(&format!(
+            "<tr><td>{}{}<br><small>{}</small></td><td>{}</td><td>{}</td><td>{}</td><td>{}</td></tr>\n",
+            html_escape(name),
+            if user.admin { " (admin)" } else { "" },
+            html_escape(&user.display_name),
+            html_escape(&user.email),
+            user.state.name(),
+            relative_time(user.created),
+            actions
+        ));
+    }
+    body.push_str("</table>\n");
+    page(&server, "Users", &body)
+}
+
+pub async fn admin_save(
+    State(server): State<Arc<WebServer>>,
+    Form(form): Form<HashMap<String, String>>,
+) -> Response {
+    let admin = match current_user() {
+        Some(user) if server.is_admin(&user) => user,
+        _ => return forbidden(),
+    };
+    let name = form.get("user").cloned().unwrap_or_default();
+    let action = form.get("action").cloned().unwrap_or_default();
+    if name == admin && matches!(action.as_str(), "disable" | "revoke-admin") {
+        return (
+            StatusCode::BAD_REQUEST,
+            "Ask another admin to disable your account or revoke your admin rights",
+        )
+            .into_response();
+    }
+    let result = users::update(&server.data_dir, &name, |user| {
+        match action.as_str() {
+            "approve" => user.state = AccountState::Active,
+            "disable" => user.state = AccountState::Disabled,
+            "make-admin" => user.admin = true,
+            "revoke-admin" => user.admin = false,
+            _ => anyhow::bail!("Unknown action '{}'", action),
+        }
+        Ok(())
+    });
+    match result {
+        Ok(_) => {
+            tracing::info!(user = %name, admin = %admin, action = %action, "Changed account");
+            audit::Entry::new(Action::AccountChange, Via::Web, Some(&admin))
+                .with_target(&name)
+                .with_detail(action)
+                .with_remote(remote_addr())
+                .record(&server.data_dir);
+            Redirect::to("/admin/users").into_response()
+        }
+        Err(e) => (StatusCode::BAD_REQUEST, format!("{:#}", e)).into_response(),
+    }
+}
+
+/// Sign-in link, or the signed-in user's account links, shown on every page
+pub fn links(server: &WebServer) -> String {
+    match current_user() {
+        Some(user) => {
+            let mut links = format!(
+                r#"<span class="account"><a href="/account">{}</a>"#,
+                html_escape(&user)
+            );
+            if server.is_admin(&user) {
+                let pending = users::load(&server.data_dir)
+                    .map(|accounts| {
+                        accounts
+                            .values()
+                            .filter(|u| u.state == AccountState::Pending)
+                            .count()
+                    })
+                    .unwrap_or(0);
+                links.push_str(&format!(
+                    r#" | <a href="/admin/users">Users{}</a>"#,
+                    if pending > 0 {
+                        format!(r#" <span class="unread-count">{}</span>"#, pending)
+                    } else {
+                        String::new()
+                    }
+                ));
+                links.push_str(r#" | <a href="/admin/audit">Audit log</a>"#);
+            }
+            if server.sessions.is_some() {
+                links.push_str(r#" | <form method="post" action="/logout" style="display:inline"><button type="submit">Sign out</button></form>"#);
+            }
+            links.push_str("</span>");
+            links
+        }
+        None if server.sessions.is_some() => {
+            r#"<span class="account"><a href="/login">Sign in</a></span>"#.to_string()
+        }
+        None => String::new(),
+    }
+}
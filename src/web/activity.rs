@@ -0,0 +1,97 @@
+use super::{html_escape, relative_time, render_page, url_path, WebServer};
+use crate::activity;
+use axum::{
+    extract::{Query, State},
+    http::StatusCode,
+    response::{IntoResponse, Response},
+};
+use std::collections::HashMap;
+use std::sync::Arc;
+
+/// Items on the page
+const ITEMS: usize = 100;
+
+/// How many days back the page looks unless `?days=` says otherwise, and
+/// the most it may ask for
+const DEFAULT_DAYS: i64 = 7;
+const MAX_DAYS: i64 = 90;
+
+/// What is happening in the repositories the user can see: /activity, or
+/// /activity?days=30
+pub async fn page(
+    State(server): State<Arc<WebServer>>,
+    Query(query): Query<HashMap<String, String>>,
+) -> Response {
+    let days = query
+        .get("days")
+        .and_then(|days| days.parse().ok())
+        .unwrap_or(DEFAULT_DAYS)
+        .clamp(1, MAX_DAYS);
+    let repos = match server.listed_repositories() {
+        Ok(repos) => repos,
+        Err(e) => return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    };
+    let since = chrono::Utc::now().timestamp() - days * 24 * 3600;
+    let data_dir = server.data_dir.clone();
+    // Reading every repository's events, issues and pull requests is
+    // blocking file work
+    let items =
+        tokio::task::spawn_blocking(move || activity::collect(&data_dir, &repos, since, ITEMS))
+            .await
+            .unwrap_or_default();
+
+    let mut body = format!(
+        "<h1>Activity</h1>\n<p>The last {} &middot; {}</p>\n",
+        if days == 1 {
+            "day".to_string()
+        } else {
+            format!("{} days", days)
+        },
+        [1, 7, 30, 90]
+            .iter()
+            .map(|&option| if option == days {
+                format!("<strong>{}d</strong>", option)
+            } else {
+                format!("<a href=\"/activity?days={0}\">{0}d</a>", option)
+            })
+            .collect::<Vec<_>>()
+            .join(" ")
+    );
+    if items.is_empty() {
+        body.push_str("<p>Nothing happened in that time.</p>\n");
+    } else {
+        body.push_str("<ul class=\"commit-list\">\n");
+        for item in &items {
+            let repo_url = format!("/repo/{}", url_path(&item.repo));
+            let link = if item.page.is_empty() {
+                repo_url.clone()
+            } else {
+                format!("{}/{}", repo_url, url_path(&item.page))
+            };
+            body.push_str(&format!(
+                "<li class=\"commit-item\"><span class=\"label\">{}</span> <a href=\"{}\"><strong>{}</strong></a>: {} <a href=\"{}\">{}</a><br/><small>{}</small></li>\n",
+                item.kind.name(),
+                repo_url,
+                html_escape(&item.repo),
+                html_escape(item.actor.as_deref().unwrap_or("Someone")),
+                link,
+                html_escape(&item.summary),
+                relative_time(item.time)
+            ));
+        }
+        body.push_str("</ul>\n");
+        if items.len() == ITEMS {
+            body.push_str(&format!(
+                "<p><small>Only the latest {} are shown.</small></p>\n",
+                ITEMS
+            ));
+        }
+    }
+
+    render_page(
+        &server,
+        "Activity",
+        r#"<a href="/">Home</a> / Activity"#,
+        &body,
+    )
+}
@@ -0,0 +1,131 @@
+use axum::{
+    http::{header, StatusCode},
+    response::{IntoResponse, Response},
+};
+use std::collections::hash_map::DefaultHasher;
+use std::collections::HashMap;
+use std::fs;
+use std::hash::Hasher;
+use std::path::{Path, PathBuf};
+
+/// Cache-Control for content-hashed URLs, which never change once published
+const IMMUTABLE: &str = "public, max-age=31536000, immutable";
+
+/// Cache-Control for assets requested by their plain name, which may change on upgrade
+const REVALIDATE: &str = "public, no-cache";
+
+/// Static assets served under /static/ with content-hashed filenames.
+///
+/// Every file is reachable both by its plain name (`style.css`) and by a
+/// hashed name (`style.1a2b3c4d5e6f7a8b.css`). Pages should link the hashed
+/// name via [`StaticAssets::url`] so browsers can cache it forever.
+#[derive(Clone, Default)]
+pub struct StaticAssets {
+    dir: PathBuf,
+    hashed: HashMap<String, String>,
+    plain: HashMap<String, String>,
+}
+
+impl StaticAssets {
+    /// Scan a directory and compute a hashed name for every file in it
+    pub fn load(dir: impl Into<PathBuf>) -> Self {
+        let mut assets = Self {
+            dir: dir.into(),
+            ..Default::default()
+        };
+
+        let mut files = Vec::new();
+        collect_files(&assets.dir, &assets.dir, &mut files);
+
+        for name in files {
+            let content = match fs::read(assets.dir.join(&name)) {
+                Ok(content) => content,
+                Err(_) => continue,
+            };
+            let hashed = hashed_name(&name, &content);
+            assets.plain.insert(hashed.clone(), name.clone());
+            assets.hashed.insert(name, hashed);
+        }
+
+        tracing::debug!("Loaded {} static assets", assets.hashed.len());
+        assets
+    }
+
+    /// Content-hashed URL for a static asset, if it exists
+    pub fn url(&self, name: &str) -> Option<String> {
+        self.hashed
+            .get(name)
+            .map(|hashed| format!("/static/{}", hashed))
+    }
+
+    /// Serve a static asset by plain or hashed name
+    pub async fn serve(&self, path: &str) -> Response {
+        let (name, cache_control) = match self.plain.get(path) {
+            Some(name) => (name.as_str(), IMMUTABLE),
+            None if self.hashed.contains_key(path) => (path, REVALIDATE),
+            None => return StatusCode::NOT_FOUND.into_response(),
+        };
+
+        match tokio::fs::read(self.dir.join(name)).await {
+            Ok(content) => (
+                [
+                    (header::CONTENT_TYPE, content_type(name)),
+                    (header::CACHE_CONTROL, cache_control),
+                ],
+                content,
+            )
+                .into_response(),
+            Err(_) => StatusCode::NOT_FOUND.into_response(),
+        }
+    }
+}
+
+fn collect_files(root: &Path, dir: &Path, files: &mut Vec<String>) {
+    let entries = match fs::read_dir(dir) {
+        Ok(entries) => entries,
+        Err(_) => return,
+    };
+
+    for entry in entries.flatten() {
+        let path = entry.path();
+        if path.is_dir() {
+            collect_files(root, &path, files);
+        } else if let Ok(rel) = path.strip_prefix(root) {
+            files.push(rel.to_string_lossy().replace('\\', "/"));
+        }
+    }
+}
+
+/// Insert a content hash before the extension: `css/site.css` -> `css/site.<hash>.css`
+fn hashed_name(name: &str, content: &[u8]) -> String {
+    let mut hasher = DefaultHasher::new();
+    hasher.write(content);
+    let hash = format!("{:016x}", hasher.finish());
+
+    let file_start = name.rfind('/').map(|i| i + 1).unwrap_or(0);
+    match name[file_start..].rfind('.') {
+        Some(dot) if dot > 0 => {
+            let dot = file_start + dot;
+            format!("{}.{}{}", &name[..dot], hash, &name[dot..])
+        }
+        _ => format!("{}.{}", name, hash),
+    }
+}
+
+fn content_type(name: &str) -> &'static str {
+    match name.rsplit('.').next().unwrap_or("") {
+        "css" => "text/css; charset=utf-8",
+        "js" => "text/javascript; charset=utf-8",
+        "json" => "application/json",
+        "svg" => "image/svg+xml",
+        "png" => "image/png",
+        "jpg" | "jpeg" => "image/jpeg",
+        "gif" => "image/gif",
+        "ico" => "image/x-icon",
+        "woff2" => "font/woff2",
+        "woff" => "font/woff",
+        "txt" => "text/plain; charset=utf-8",
+        "html" => "text/html; charset=utf-8",
+        _ => "application/octet-stream",
+    }
+}
@@ -0,0 +1,190 @@
+use super::auth::current_user;
+use super::{html_escape, render_page, url_path, WebServer};
+use crate::audit::{self, Action, Entry, Filter};
+use axum::{
+    extract::{Query, State},
+    http::StatusCode,
+    response::{IntoResponse, Response},
+    Json,
+};
+use std::collections::HashMap;
+use std::sync::Arc;
+
+/// Entries per page, and returned by the API unless `?limit=` says otherwise
+const PAGE_SIZE: usize = 100;
+
+fn forbidden() -> Response {
+    (
+        StatusCode::FORBIDDEN,
+        "Only server admins may read the audit log",
+    )
+        .into_response()
+}
+
+fn is_admin(server: &WebServer) -> bool {
+    current_user().map_or(false, |user| server.is_admin(&user))
+}
+
+/// The filter given by `?action=&actor=&repo=&before=`; empty fields match
+/// everything
+fn filter(query: &HashMap<String, String>) -> Result<Filter, Response> {
+    let field = |key: &str| {
+        query
+            .get(key)
+            .map(|value| value.trim())
+            .filter(|value| !value.is_empty())
+    };
+    let action = match field("action") {
+        Some(action) => Some(
+            action
+                .parse::<Action>()
+                .map_err(|e| (StatusCode::BAD_REQUEST, e).into_response())?,
+        ),
+        None => None,
+    };
+    let before = match field("before") {
+        Some(before) => Some(
+            before
+                .parse()
+                .map_err(|_| (StatusCode::BAD_REQUEST, "Invalid entry ID").into_response())?,
+        ),
+        None => None,
+    };
+    Ok(Filter {
+        action,
+        actor: field("actor").map(str::to_string),
+        repo: field("repo").map(str::to_string),
+        before,
+    })
+}
+
+fn format_time(time: i64) -> String {
+    chrono::DateTime::from_timestamp(time, 0)
+        .map(|t| t.format("%Y-%m-%d %H:%M:%S UTC").to_string())
+        .unwrap_or_default()
+}
+
+fn row(entry: &Entry) -> String {
+    let optional = |value: &Option<String>| html_escape(value.as_deref().unwrap_or(""));
+    format!(
+        "<tr><td>{}</td><td>{}</td><td><code>{}</code></td><td>{}</td><td>{}</td><td>{}</td><td>{}</td><td>{}</td><td>{}</td></tr>\n",
+        entry.id,
+        format_time(entry.time),
+        entry.action,
+        optional(&entry.actor),
+        entry.via.name(),
+        optional(&entry.repo),
+        optional(&entry.target),
+        html_escape(&entry.detail),
+        optional(&entry.remote)
+    )
+}
+
+/// The audit log, newest first: /admin/audit?action=&actor=&repo=&before=
+pub async fn page(
+    State(server): State<Arc<WebServer>>,
+    Query(query): Query<HashMap<String, String>>,
+) -> Response {
+    if !is_admin(&server) {
+        return forbidden();
+    }
+    let filter = match filter(&query) {
+        Ok(filter) => filter,
+        Err(response) => return response,
+    };
+    let data_dir = server.data_dir.clone();
+    let query_filter = filter.clone();
+    let entries = match tokio::task::spawn_blocking(move || {
+        audit::query(&data_dir, &query_filter, PAGE_SIZE)
+    })
+    .await
+    {
+        Ok(Ok(entries)) => entries,
+        Ok(Err(e)) => return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+        Err(e) => return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    };
+
+    let mut options = String::from("<option value=\"\">any</option>");
+    for action in Action::ALL {
+        options.push_str(&format!(
+            "<option value=\"{0}\"{1}>{0}</option>",
+            action,
+            if filter.action == Some(action) {
+                " selected"
+            } else {
+                ""
+            }
+        ));
+    }
+    let text = |value: &Option<String>| html_escape(value.as_deref().unwrap_or(""));
+    let mut body = String::from(
+        "<h1>Audit log</h1>\n<p>Administrative and security-relevant events on this server, newest first.</p>\n",
+    );
+    body.push_str(&format!(
+        "<form method=\"get\" action=\"/admin/audit\">\n<label>Action <select name=\"action\">{}</select></label>\n<label>User <input type=\"text\" name=\"actor\" value=\"{}\"></label>\n<label>Repository <input type=\"text\" name=\"repo\" value=\"{}\"></label>\n<button type=\"submit\">Filter</button>\n</form>\n",
+        options,
+        text(&filter.actor),
+        text(&filter.repo)
+    ));
+
+    if entries.is_empty() {
+        body.push_str("<p>No matching entries.</p>\n");
+    } else {
+        body.push_str("<table>\n<tr><th>#</th><th>Time</th><th>Action</th><th>User</th><th>Via</th><th>Repository</th><th>Target</th><th>Detail</th><th>From</th></tr>\n");
+        for entry in &entries {
+            body.push_str(&row(entry));
+        }
+        body.push_str("</table>\n");
+    }
+    if let Some(oldest) = entries.last().filter(|_| entries.len() == PAGE_SIZE) {
+        let mut params: Vec<(&str, String)> = vec![("before", oldest.id.to_string())];
+        if let Some(action) = filter.action {
+            params.push(("action", action.name().to_string()));
+        }
+        for (key, value) in [("actor", &filter.actor), ("repo", &filter.repo)] {
+            if let Some(value) = value {
+                params.push((key, value.clone()));
+            }
+        }
+        let params: Vec<String> = params
+            .into_iter()
+            .map(|(key, value)| format!("{}={}", key, url_path(&value)))
+            .collect();
+        body.push_str(&format!(
+            "<p><a href=\"/admin/audit?{}\">Older entries</a></p>\n",
+            html_escape(&params.join("&"))
+        ));
+    }
+
+    render_page(
+        &server,
+        "Audit log",
+        r#"<a href="/">Home</a> / Audit log"#,
+        &body,
+    )
+}
+
+/// GET /api/v1/admin/audit?action=&actor=&repo=&before=&limit=, newest
+/// first
+pub async fn api(
+    State(server): State<Arc<WebServer>>,
+    Query(query): Query<HashMap<String, String>>,
+) -> Response {
+    if !is_admin(&server) {
+        return forbidden();
+    }
+    let filter = match filter(&query) {
+        Ok(filter) => filter,
+        Err(response) => return response,
+    };
+    let limit = query
+        .get("limit")
+        .and_then(|limit| limit.parse().ok())
+        .unwrap_or(PAGE_SIZE);
+    let data_dir = server.data_dir.clone();
+    match tokio::task::spawn_blocking(move || audit::query(&data_dir, &filter, limit)).await {
+        Ok(Ok(entries)) => Json(entries).into_response(),
+        Ok(Err(e)) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
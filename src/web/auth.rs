@@ -0,0 +1,161 @@
+use super::{RemoteUser, WebServer};
+use crate::audit::{self, Action, Via};
+use crate::orgs::Role;
+use crate::{keys, notifications, tokens, users};
+use axum::{
+    extract::{ConnectInfo, Request, State},
+    http::{header, HeaderMap, StatusCode},
+    middleware::Next,
+    response::{IntoResponse, Response},
+};
+use std::net::SocketAddr;
+use std::sync::Arc;
+
+/// Cookie holding the web session of a signed-in user
+pub const SESSION_COOKIE: &str = "agito_session";
+
+tokio::task_local! {
+    static CURRENT_USER: Option<String>;
+    static CURRENT_SCOPE: Option<Role>;
+    static CURRENT_REMOTE: Option<String>;
+}
+
+/// The user making the current request, if authenticated
+pub fn current_user() -> Option<String> {
+    CURRENT_USER.try_with(|user| user.clone()).ok().flatten()
+}
+
+/// Address of the client making the current request, as the access log
+/// records it
+pub fn remote_addr() -> Option<String> {
+    CURRENT_REMOTE
+        .try_with(|remote| remote.clone())
+        .ok()
+        .flatten()
+}
+
+/// Scope of the access token the current request was authenticated with;
+/// None for sessions and proxies, which may do all the user may
+pub fn token_scope() -> Option<Role> {
+    CURRENT_SCOPE.try_with(|scope| *scope).ok().flatten()
+}
+
+/// Whether the current request's token, if any, allows acting with `role`
+pub fn scope_allows(role: Role) -> bool {
+    token_scope().map_or(true, |scope| scope >= role)
+}
+
+/// The access token sent as `Authorization: Bearer <token>`, or as the
+/// password of basic auth with any user name. Some(None) if the header
+/// names one of these schemes but carries no token.
+fn access_token(headers: &HeaderMap) -> Option<Option<String>> {
+    let value = headers.get(header::AUTHORIZATION)?.to_str().ok()?.trim();
+    let (scheme, credentials) = value.split_once(' ').unwrap_or((value, ""));
+    let credentials = credentials.trim();
+    if scheme.eq_ignore_ascii_case("bearer") || scheme.eq_ignore_ascii_case("token") {
+        Some(Some(credentials.to_string()).filter(|token| !token.is_empty()))
+    } else if scheme.eq_ignore_ascii_case("basic") {
+        Some(
+            keys::decode_base64(credentials)
+                .and_then(|decoded| String::from_utf8(decoded).ok())
+                .and_then(|pair| Some(pair.split_once(':')?.1.to_string())),
+        )
+    } else {
+        None
+    }
+}
+
+/// Value of a cookie sent with a request
+pub(super) fn cookie<'a>(headers: &'a HeaderMap, name: &str) -> Option<&'a str> {
+    headers
+        .get_all(header::COOKIE)
+        .iter()
+        .filter_map(|value| value.to_str().ok())
+        .flat_map(|value| value.split(';'))
+        .find_map(|pair| {
+            let (key, value) = pair.trim().split_once('=')?;
+            (key == name).then_some(value)
+        })
+}
+
+/// Identify the user for each request and make it available through
+/// [`current_user`] and the access log.
+///
+/// Users sign in with their account's password and are recognized by their
+/// session cookie. Authentication can also be delegated to a reverse proxy
+/// that sets the configured header (e.g. `X-Remote-User`); the proxy must
+/// strip that header from client requests, otherwise anyone can claim to be
+/// anyone. Either way, users whose account is pending or disabled are
+/// treated as signed out.
+///
+/// Requests may instead carry a personal access token (see [`tokens`]),
+/// which limits what they may do to its scope. A request with a token that
+/// is unknown, revoked or expired is refused rather than served anonymously.
+pub async fn middleware(
+    State(server): State<Arc<WebServer>>,
+    req: Request,
+    next: Next,
+) -> Response {
+    let peer = req
+        .extensions()
+        .get::<ConnectInfo<SocketAddr>>()
+        .map(|info| info.0);
+    let remote =
+        Some(server.access_log.remote_addr(req.headers(), peer)).filter(|addr| addr != "-");
+    CURRENT_REMOTE
+        .scope(remote, authenticate(server, req, next))
+        .await
+}
+
+async fn authenticate(server: Arc<WebServer>, req: Request, next: Next) -> Response {
+    if let Some(secret) = access_token(req.headers()) {
+        let data_dir = server.data_dir.clone();
+        let token = match secret {
+            Some(secret) => tokio::task::spawn_blocking(move || tokens::verify(&data_dir, &secret))
+                .await
+                .ok()
+                .flatten(),
+            None => None,
+        };
+        let token = match token {
+            Some(token) => token,
+            None => {
+                audit::Entry::new(Action::AuthFailure, Via::Web, None)
+                    .with_detail("Invalid or expired access token")
+                    .with_remote(remote_addr())
+                    .record(&server.data_dir);
+                return (
+                    StatusCode::UNAUTHORIZED,
+                    [(header::WWW_AUTHENTICATE, "Basic realm=\"agito\"")],
+                    "Invalid or expired access token",
+                )
+                    .into_response();
+            }
+        };
+        let user = Some(token.user.clone());
+        let scoped = CURRENT_SCOPE.scope(Some(token.scope), next.run(req));
+        let mut response = CURRENT_USER.scope(user, scoped).await;
+        response.extensions_mut().insert(RemoteUser(token.user));
+        return response;
+    }
+
+    let user = server
+        .auth_proxy_header
+        .as_ref()
+        .and_then(|name| req.headers().get(name))
+        .and_then(|value| value.to_str().ok())
+        .map(|value| value.trim().to_string())
+        .filter(|value| notifications::valid_username(value))
+        .or_else(|| {
+            let sessions = server.sessions.as_ref()?;
+            sessions.verify(cookie(req.headers(), SESSION_COOKIE)?)
+        })
+        .filter(|user| !users::is_locked(&server.data_dir, user));
+
+    let scoped = CURRENT_SCOPE.scope(None, next.run(req));
+    let mut response = CURRENT_USER.scope(user.clone(), scoped).await;
+    if let Some(user) = user {
+        response.extensions_mut().insert(RemoteUser(user));
+    }
+    response
+}
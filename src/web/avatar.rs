@@ -0,0 +1,121 @@
+use axum::{
+    extract::Path,
+    http::{header, StatusCode},
+    response::{IntoResponse, Response},
+};
+use sha2::{Digest, Sha256};
+use std::str::FromStr;
+
+/// Where author avatars come from
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq)]
+pub enum AvatarSource {
+    /// Identicons generated by the server; no third party learns who is browsing
+    #[default]
+    Local,
+    /// Gravatar, falling back to its identicons for unknown addresses
+    Gravatar,
+    /// Libravatar, falling back to its identicons for unknown addresses
+    Libravatar,
+}
+
+impl FromStr for AvatarSource {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "local" => Ok(Self::Local),
+            "gravatar" => Ok(Self::Gravatar),
+            "libravatar" => Ok(Self::Libravatar),
+            _ => Err(format!(
+                "unknown avatar source '{}' (expected local, gravatar or libravatar)",
+                s
+            )),
+        }
+    }
+}
+
+impl AvatarSource {
+    /// Image URL for an author email
+    pub fn url(&self, email: &str) -> String {
+        let hash = email_hash(email);
+        match self {
+            Self::Local => format!("/avatar/{}.svg", hash),
+            Self::Gravatar => format!("https://gravatar.com/avatar/{}?d=identicon&s=80", hash),
+            Self::Libravatar => format!(
+                "https://seccdn.libravatar.org/avatar/{}?d=identicon&s=80",
+                hash
+            ),
+        }
+    }
+
+    /// `<img>` tag for an author email
+    pub fn img(&self, email: &str, size: u32) -> String {
+        format!(
+            r#"<img class="avatar" src="{}" width="{}" height="{}" alt="" loading="lazy">"#,
+            self.url(email),
+            size,
+            size
+        )
+    }
+}
+
+/// SHA-256 of the normalised address, as used by Gravatar and Libravatar
+fn email_hash(email: &str) -> String {
+    let digest = Sha256::digest(email.trim().to_lowercase().as_bytes());
+    digest.iter().map(|b| format!("{:02x}", b)).collect()
+}
+
+/// Render a 5x5 mirrored identicon for a hex hash
+fn identicon_svg(hash: &[u8]) -> String {
+    let hue = (u16::from(hash[0]) << 8 | u16::from(hash[1])) % 360;
+    let color = format!("hsl({}, 55%, 50%)", hue);
+
+    let mut cells = String::new();
+    for row in 0..5 {
+        for col in 0..3 {
+            let bit = row * 3 + col;
+            if hash[2 + bit / 8] >> (bit % 8) & 1 == 0 {
+                continue;
+            }
+            for x in [col, 4 - col] {
+                cells.push_str(&format!(
+                    r#"<rect x="{}" y="{}" width="1" height="1"/>"#,
+                    x + 1,
+                    row + 1
+                ));
+                if col == 2 {
+                    break;
+                }
+            }
+        }
+    }
+
+    format!(
+        r##"<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 7 7" shape-rendering="crispEdges"><rect width="7" height="7" fill="#f0f0f0"/><g fill="{}">{}</g></svg>"##,
+        color, cells
+    )
+}
+
+/// Serve a locally generated identicon: /avatar/<sha256>.svg
+pub async fn handle(Path(file): Path<String>) -> Response {
+    let hash = file.trim_end_matches(".svg");
+    let bytes: Option<Vec<u8>> = (0..hash.len())
+        .step_by(2)
+        .map(|i| {
+            hash.get(i..i + 2)
+                .and_then(|b| u8::from_str_radix(b, 16).ok())
+        })
+        .collect();
+
+    match bytes {
+        Some(bytes) if bytes.len() == 32 => (
+            [
+                (header::CONTENT_TYPE, "image/svg+xml"),
+                (header::CACHE_CONTROL, "public, max-age=31536000, immutable"),
+            ],
+            identicon_svg(&bytes),
+        )
+            .into_response(),
+        _ => StatusCode::NOT_FOUND.into_response(),
+    }
+}
@@ -0,0 +1,175 @@
+use super::{breadcrumb, html_escape, relative_time, render_page, url_path, WebServer};
+use crate::git;
+use axum::{
+    extract::{Path, State},
+    http::StatusCode,
+    response::{IntoResponse, Response},
+    Json,
+};
+use serde::Serialize;
+use std::collections::HashMap;
+use std::path::PathBuf;
+use std::sync::{Arc, Mutex};
+
+/// Counts kept before the cache starts over
+const CACHE_LIMIT: usize = 10_000;
+
+/// Ahead/behind counts keyed by repository and the two commits compared, so
+/// a count is reused until either branch moves
+#[derive(Clone, Default)]
+pub struct Divergence {
+    counts: Arc<Mutex<HashMap<(PathBuf, String, String), (usize, usize)>>>,
+}
+
+impl Divergence {
+    /// Commits `tip` has that `base` lacks, and the other way round
+    pub fn ahead_behind(
+        &self,
+        repo_path: &PathBuf,
+        base: &str,
+        tip: &str,
+    ) -> Option<(usize, usize)> {
+        let key = (repo_path.clone(), base.to_string(), tip.to_string());
+        if let Some(&counts) = self.counts.lock().unwrap().get(&key) {
+            return Some(counts);
+        }
+
+        let counts = git::ahead_behind(repo_path, base, tip)?;
+
+        let mut cache = self.counts.lock().unwrap();
+        if cache.len() >= CACHE_LIMIT {
+            cache.clear();
+        }
+        cache.insert(key, counts);
+        Some(counts)
+    }
+}
+
+#[derive(Serialize)]
+struct Branch {
+    name: String,
+    commit: String,
+    /// Unix time of the branch's latest commit
+    updated: i64,
+    default: bool,
+    /// Commits on this branch that are not on the default branch
+    ahead: Option<usize>,
+    /// Commits on the default branch that this branch lacks
+    behind: Option<usize>,
+}
+
+/// Branches, most recently updated first, compared with the default branch
+fn branches(server: &WebServer, repo_path: &PathBuf) -> anyhow::Result<(String, Vec<Branch>)> {
+    let output = git::run(
+        repo_path,
+        &[
+            "for-each-ref",
+            "--sort=-committerdate",
+            "--format=%(refname:lstrip=2)%00%(objectname)%00%(committerdate:unix)",
+            "refs/heads",
+        ],
+    )?;
+    if !output.status.success() {
+        anyhow::bail!("Failed to list branches");
+    }
+
+    let default_branch = server.default_branch(repo_path);
+    let refs: Vec<(String, String, i64)> = String::from_utf8_lossy(&output.stdout)
+        .lines()
+        .filter_map(|line| {
+            let fields: Vec<&str> = line.split('\0').collect();
+            match fields.as_slice() {
+                [name, commit, updated] => Some((
+                    name.to_string(),
+                    commit.to_string(),
+                    updated.parse().unwrap_or(0),
+                )),
+                _ => None,
+            }
+        })
+        .collect();
+    let base = refs
+        .iter()
+        .find(|(name, _, _)| *name == default_branch)
+        .map(|(_, commit, _)| commit.clone());
+
+    let branches = refs
+        .into_iter()
+        .map(|(name, commit, updated)| {
+            let default = name == default_branch;
+            let counts = match &base {
+                Some(base) if !default => server.divergence.ahead_behind(repo_path, base, &commit),
+                Some(_) => Some((0, 0)),
+                None => None,
+            };
+            Branch {
+                name,
+                commit,
+                updated,
+                default,
+                ahead: counts.map(|(ahead, _)| ahead),
+                behind: counts.map(|(_, behind)| behind),
+            }
+        })
+        .collect();
+    Ok((default_branch, branches))
+}
+
+/// Branches page: /repo/<name>/branches
+pub fn render(server: &WebServer, repo_name: &str, repo_path: &PathBuf) -> Response {
+    let (default_branch, branches) = match branches(server, repo_path) {
+        Ok(found) => found,
+        Err(e) => return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    };
+
+    let mut body = format!(
+        "<h1>Branches</h1>\n<p>Compared with <strong>{}</strong> &middot; <a href=\"/repo/{}/feed.rss?refs=heads/*\">Push feed (RSS)</a></p>\n<ul class=\"commit-list\">",
+        html_escape(&default_branch),
+        url_path(repo_name)
+    );
+    for branch in &branches {
+        let counts = match (branch.default, branch.behind, branch.ahead) {
+            (true, _, _) => "<span class=\"default-branch\">default</span>".to_string(),
+            (false, Some(behind), Some(ahead)) => format!(
+                "<span class=\"behind\">{} behind</span> &middot; <span class=\"ahead\">{} ahead</span>",
+                behind, ahead
+            ),
+            _ => String::new(),
+        };
+        body.push_str(&format!(
+            r#"<li class="commit-item"><a href="/repo/{}/tree/{}"><strong>{}</strong></a> {}<br/><small>Updated {} &middot; <a href="/repo/{}/log/{}">History</a></small></li>"#,
+            url_path(repo_name),
+            url_path(&branch.name),
+            html_escape(&branch.name),
+            counts,
+            relative_time(branch.updated),
+            url_path(repo_name),
+            url_path(&branch.name)
+        ));
+    }
+    body.push_str("</ul>");
+
+    render_page(
+        server,
+        repo_name,
+        &breadcrumb(repo_name, &[("branches".to_string(), None)]),
+        &body,
+    )
+}
+
+/// Branches with ahead/behind counts, as JSON
+pub async fn api(State(server): State<Arc<WebServer>>, Path(repo_name): Path<String>) -> Response {
+    let repo_path = match server.resolve_repo(&repo_name) {
+        Some((_, path)) => path,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+
+    match branches(&server, &repo_path) {
+        Ok((default_branch, branches)) => Json(serde_json::json!({
+            "default_branch": default_branch,
+            "branches": branches,
+        }))
+        .into_response(),
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
@@ -0,0 +1,517 @@
+use super::auth::current_user;
+use super::{
+    breadcrumb, html_escape, relative_time, render_page, render_page_with_head, url_path, WebServer,
+};
+use crate::archive;
+use crate::ci::{self, Build, CommitStatus, State as BuildState};
+use crate::git;
+use crate::orgs::Role;
+use axum::{
+    extract::{Path, Query, State},
+    http::{header, StatusCode},
+    response::{IntoResponse, Redirect, Response},
+    Json,
+};
+use serde::Deserialize;
+use std::collections::HashMap;
+use std::fs;
+use std::io::{Read, Seek, SeekFrom};
+use std::path::PathBuf;
+use std::sync::Arc;
+
+/// Builds listed on a repository's builds page
+const MAX_BUILDS: usize = 100;
+
+/// Bytes of log shown on a build's page; longer logs show their end
+const MAX_LOG: u64 = 512 * 1024;
+
+fn builds_url(repo_name: &str) -> String {
+    format!("/repo/{}/builds", url_path(repo_name))
+}
+
+fn duration_text(seconds: i64) -> String {
+    match seconds {
+        s if s < 60 => format!("{}s", s),
+        s if s < 3600 => format!("{}m {}s", s / 60, s % 60),
+        s => format!("{}h {}m", s / 3600, s % 3600 / 60),
+    }
+}
+
+/// "Build #3: success" linking to the latest build of a commit, followed by
+/// the states outside CI systems reported for it, or nothing if there are
+/// none
+pub fn status_link(repo_name: &str, repo_path: &PathBuf, commit: &str) -> String {
+    let mut links = Vec::new();
+    match ci::latest_for(repo_path, commit) {
+        Ok(Some(build)) => links.push(format!(
+            "<a href=\"{}/{}\">Build #{}</a>: <span class=\"state-{}\">{}</span>",
+            builds_url(repo_name),
+            build.id,
+            build.id,
+            build.status_name(),
+            build.status_name()
+        )),
+        Ok(None) => {}
+        Err(e) => tracing::warn!("Failed to read builds of {}: {:#}", repo_name, e),
+    }
+    match ci::statuses(repo_path, commit) {
+        Ok(statuses) => links.extend(statuses.iter().map(status_html)),
+        Err(e) => tracing::warn!("Failed to read statuses of {}: {:#}", repo_name, e),
+    }
+    links.join(" &middot; ")
+}
+
+/// "ci/jenkins: success", linking to the reported URL
+fn status_html(status: &CommitStatus) -> String {
+    let context = if status.target_url.is_empty() {
+        html_escape(&status.context)
+    } else {
+        format!(
+            "<a href=\"{}\" rel=\"nofollow\">{}</a>",
+            html_escape(&status.target_url),
+            html_escape(&status.context)
+        )
+    };
+    format!(
+        "{}: <span class=\"state-{}\" title=\"{}\">{}</span>",
+        context,
+        status.state.name(),
+        html_escape(&status.description),
+        status.state.name()
+    )
+}
+
+/// Build list: /repo/<name>/builds?branch=<branch>
+pub fn list_page(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    query: &HashMap<String, String>,
+) -> Response {
+    let branch = query.get("branch").filter(|b| !b.is_empty());
+    let builds = match ci::list(repo_path) {
+        Ok(builds) => builds,
+        Err(e) => return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    };
+
+    let base = builds_url(repo_name);
+    let mut body = String::from("<h1>Builds</h1>\n");
+    if let Some(branch) = branch {
+        body.push_str(&format!(
+            "<p>On <code>{}</code> &middot; <a href=\"{}\">All branches</a></p>\n",
+            html_escape(branch),
+            base
+        ));
+    }
+    let shown: Vec<&Build> = builds
+        .iter()
+        .filter(|build| branch.map_or(true, |branch| build.branch() == branch))
+        .take(MAX_BUILDS)
+        .collect();
+    if shown.is_empty() {
+        body.push_str(
+            "<p>No builds. Commits with a <code>.agito-ci.yml</code> are built when pushed.</p>\n",
+        );
+    } else {
+        body.push_str("<ul class=\"commit-list\">\n");
+        for build in shown {
+            body.push_str(&format!(
+                "<li class=\"commit-item\"><span class=\"state-{}\">{}</span> <a href=\"{}/{}\"><strong>#{}</strong></a> <a href=\"{}?branch={}\">{}</a> <a href=\"/repo/{}/commit/{}\"><code>{}</code></a><br><small>queued {}{}{}</small></li>\n",
+                build.status_name(),
+                build.status_name(),
+                base,
+                build.id,
+                build.id,
+                base,
+                url_path(build.branch()),
+                html_escape(build.branch()),
+                url_path(repo_name),
+                build.commit,
+                &build.commit[..build.commit.len().min(8)],
+                relative_time(build.created),
+                build
+                    .pusher
+                    .as_ref()
+                    .map(|pusher| format!(" by {}", html_escape(pusher)))
+                    .unwrap_or_default(),
+                build
+                    .duration()
+                    .map(|d| format!(" &middot; took {}", duration_text(d)))
+                    .unwrap_or_default()
+            ));
+        }
+        body.push_str("</ul>\n");
+    }
+
+    render_page(
+        server,
+        &format!("{} - Builds", repo_name),
+        &breadcrumb(repo_name, &[("Builds".to_string(), None)]),
+        &body,
+    )
+}
+
+/// The end of a build's log, and whether anything before it was left out
+fn read_log(repo_path: &PathBuf, id: u64) -> (String, bool) {
+    let Ok(mut file) = fs::File::open(ci::log_path(repo_path, id)) else {
+        return (String::new(), false);
+    };
+    let len = file.metadata().map(|m| m.len()).unwrap_or(0);
+    let truncated = len > MAX_LOG;
+    if truncated {
+        let _ = file.seek(SeekFrom::Start(len - MAX_LOG));
+    }
+    let mut bytes = Vec::new();
+    let _ = file.read_to_end(&mut bytes);
+    (String::from_utf8_lossy(&bytes).into_owned(), truncated)
+}
+
+/// One build with its steps and log: /repo/<name>/builds/<id>
+pub fn build_page(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    id: u64,
+    error: Option<&str>,
+) -> Response {
+    let build = match ci::get(repo_path, id) {
+        Ok(Some(build)) => build,
+        Ok(None) => return (StatusCode::NOT_FOUND, "Build not found").into_response(),
+        Err(e) => return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    };
+    let base = builds_url(repo_name);
+
+    let mut body = format!(
+        "<h1>Build #{}</h1>\n<p><span class=\"state-{}\">{}</span> <a href=\"{}?branch={}\">{}</a> at <a href=\"/repo/{}/commit/{}\"><code>{}</code></a> &middot; queued {}{}{}</p>\n",
+        build.id,
+        build.status_name(),
+        build.status_name(),
+        base,
+        url_path(build.branch()),
+        html_escape(build.branch()),
+        url_path(repo_name),
+        build.commit,
+        &build.commit[..build.commit.len().min(8)],
+        relative_time(build.created),
+        build
+            .pusher
+            .as_ref()
+            .map(|pusher| format!(" by {}", html_escape(pusher)))
+            .unwrap_or_default(),
+        build
+            .duration()
+            .map(|d| format!(" &middot; took {}", duration_text(d)))
+            .unwrap_or_default()
+    );
+    if let Some(error) = error {
+        body.push_str(&format!(
+            "<p class=\"error\"><strong>{}</strong></p>\n",
+            html_escape(error)
+        ));
+    }
+    if let Some(build_error) = &build.error {
+        body.push_str(&format!(
+            "<p class=\"error\">{}</p>\n",
+            html_escape(build_error)
+        ));
+    }
+    if build.finished.is_some() && server.has_role(repo_path, Role::Write) {
+        body.push_str(&format!(
+            "<form method=\"post\" action=\"{}/{}\"><input type=\"hidden\" name=\"action\" value=\"retry\"><button type=\"submit\">Run again</button></form>\n",
+            base, build.id
+        ));
+    }
+
+    if !build.steps.is_empty() {
+        body.push_str("<div class=\"section\"><h2>Steps</h2>\n<ul class=\"file-list\">\n");
+        for step in &build.steps {
+            let state = match (step.state, build.finished) {
+                (BuildState::Pending, Some(_)) => "skipped",
+                (BuildState::Pending, None) => "pending",
+                (state, _) => state.name(),
+            };
+            body.push_str(&format!(
+                "<li class=\"file-item\"><span class=\"state-{}\">{}</span> {}{}</li>\n",
+                state,
+                state,
+                html_escape(&step.name),
+                match step.exit_code {
+                    Some(code) => format!(
+                        " <small>exit {} after {}</small>",
+                        code,
+                        duration_text(step.duration as i64)
+                    ),
+                    None if step.state == BuildState::Failure =>
+                        " <small>timed out</small>".to_string(),
+                    None => String::new(),
+                }
+            ));
+        }
+        body.push_str("</ul></div>\n");
+    }
+
+    if build.started.is_some() {
+        let (log, truncated) = read_log(repo_path, build.id);
+        body.push_str("<div class=\"section\"><h2>Log</h2>\n");
+        if truncated {
+            body.push_str(&format!(
+                "<p><small>Showing the end of the log. <a href=\"/api/v1/repos/{}/builds/{}/log\">Full log</a></small></p>\n",
+                url_path(repo_name),
+                build.id
+            ));
+        }
+        body.push_str(&format!(
+            "<pre class=\"build-log\">{}</pre></div>\n",
+            html_escape(&log)
+        ));
+    }
+
+    let title = format!("{} - Build #{}", repo_name, build.id);
+    let crumbs = breadcrumb(
+        repo_name,
+        &[
+            ("Builds".to_string(), Some(base.clone())),
+            (format!("#{}", build.id), None),
+        ],
+    );
+    if build.finished.is_none() {
+        // Follow the build until it finishes
+        render_page_with_head(
+            server,
+            &title,
+            &crumbs,
+            &body,
+            "<meta http-equiv=\"refresh\" content=\"5\">",
+        )
+    } else {
+        render_page(server, &title, &crumbs, &body)
+    }
+}
+
+/// Queue another build of the same commit, for users with write access
+fn retry(repo_path: &PathBuf, id: u64, user: &str) -> Result<Build, (StatusCode, String)> {
+    if !matches!(ci::get(repo_path, id), Ok(Some(_))) {
+        return Err((StatusCode::NOT_FOUND, "Build not found".to_string()));
+    }
+    match ci::retry(repo_path, id, Some(user)) {
+        Ok(build) => {
+            tracing::info!(user, "Queued build {} as a retry of {}", build.id, id);
+            Ok(build)
+        }
+        Err(e) => Err((StatusCode::UNPROCESSABLE_ENTITY, format!("{:#}", e))),
+    }
+}
+
+/// POST /repo/<name>/builds/<id> with action=retry
+pub fn save_form(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    id: u64,
+    form: &HashMap<String, String>,
+) -> Response {
+    let user = match current_user() {
+        Some(user) => user,
+        None => return (StatusCode::UNAUTHORIZED, "Sign in to run builds").into_response(),
+    };
+    if !server.has_role(repo_path, Role::Write) {
+        return (StatusCode::FORBIDDEN, "Running builds needs write access").into_response();
+    }
+    match form.get("action").map(String::as_str) {
+        Some("retry") => match retry(repo_path, id, &user) {
+            Ok(build) => {
+                Redirect::to(&format!("{}/{}", builds_url(repo_name), build.id)).into_response()
+            }
+            Err((_, e)) => build_page(server, repo_name, repo_path, id, Some(&e)),
+        },
+        _ => (StatusCode::BAD_REQUEST, "Unknown action").into_response(),
+    }
+}
+
+/// GET /api/v1/repos/<name>/builds, optionally `?commit=<id>` or
+/// `?branch=<name>`, newest first
+pub async fn api_list(
+    State(server): State<Arc<WebServer>>,
+    Path(repo_name): Path<String>,
+    Query(query): Query<HashMap<String, String>>,
+) -> Response {
+    let repo_path = match server.resolve_repo(&repo_name) {
+        Some((_, path)) => path,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    match ci::list(&repo_path) {
+        Ok(builds) => Json(
+            builds
+                .into_iter()
+                .filter(|build| query.get("commit").map_or(true, |c| &build.commit == c))
+                .filter(|build| query.get("branch").map_or(true, |b| build.branch() == b))
+                .collect::<Vec<_>>(),
+        )
+        .into_response(),
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
+
+/// GET /api/v1/repos/<name>/builds/<id>
+pub async fn api_get(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, id)): Path<(String, u64)>,
+) -> Response {
+    let repo_path = match server.resolve_repo(&repo_name) {
+        Some((_, path)) => path,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    match ci::get(&repo_path, id) {
+        Ok(Some(build)) => Json(build).into_response(),
+        Ok(None) => (StatusCode::NOT_FOUND, "Build not found").into_response(),
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
+
+/// GET /api/v1/repos/<name>/builds/<id>/log, as plain text
+pub async fn api_log(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, id)): Path<(String, u64)>,
+) -> Response {
+    let repo_path = match server.resolve_repo(&repo_name) {
+        Some((_, path)) => path,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    match fs::read(ci::log_path(&repo_path, id)) {
+        Ok(log) => ([(header::CONTENT_TYPE, "text/plain; charset=utf-8")], log).into_response(),
+        Err(_) => (StatusCode::NOT_FOUND, "No log for this build").into_response(),
+    }
+}
+
+/// POST /api/v1/repos/<name>/builds/<id>/retry: queue another build of the
+/// same commit
+pub async fn api_retry(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, id)): Path<(String, u64)>,
+) -> Response {
+    let repo_path = match server.resolve_repo(&repo_name) {
+        Some((_, path)) => path,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    let user = match current_user() {
+        Some(user) => user,
+        None => return (StatusCode::UNAUTHORIZED, "Sign in to run builds").into_response(),
+    };
+    if !server.has_role(&repo_path, Role::Write) {
+        return (StatusCode::FORBIDDEN, "Running builds needs write access").into_response();
+    }
+    match retry(&repo_path, id, &user) {
+        Ok(build) => (StatusCode::CREATED, Json(build)).into_response(),
+        Err(failure) => failure.into_response(),
+    }
+}
+
+/// Full id of the commit `rev` names
+fn resolve_commit(repo_path: &PathBuf, rev: &str) -> Option<String> {
+    if rev.is_empty() || rev.starts_with('-') {
+        return None;
+    }
+    match git::batch::pool().check(repo_path, &format!("{}^{{commit}}", rev)) {
+        Ok(Some(object)) if object.kind == "commit" => Some(object.id),
+        _ => None,
+    }
+}
+
+/// GET /api/v1/repos/<name>/statuses/<rev>: the combined state of a commit
+/// and what each outside system reported for it
+pub async fn api_statuses(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, rev)): Path<(String, String)>,
+) -> Response {
+    let repo_path = match server.resolve_repo(&repo_name) {
+        Some((_, path)) => path,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    let commit = match resolve_commit(&repo_path, &rev) {
+        Some(commit) => commit,
+        None => return (StatusCode::NOT_FOUND, "Commit not found").into_response(),
+    };
+    match ci::statuses(&repo_path, &commit) {
+        Ok(statuses) => Json(serde_json::json!({
+            "commit": commit,
+            "state": ci::combined_status(&repo_path, &commit).map(BuildState::name),
+            "statuses": statuses,
+        }))
+        .into_response(),
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
+
+#[derive(Deserialize)]
+pub struct NewStatus {
+    state: String,
+    #[serde(default)]
+    context: Option<String>,
+    #[serde(default)]
+    target_url: String,
+    #[serde(default)]
+    description: String,
+}
+
+/// POST /api/v1/repos/<name>/statuses/<rev> with `state` (pending, success or
+/// failure) and optionally `context`, `target_url` and `description`
+pub async fn api_report_status(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, rev)): Path<(String, String)>,
+    Json(request): Json<NewStatus>,
+) -> Response {
+    let (repo_name, repo_path) = match server.resolve_repo(&repo_name) {
+        Some(found) => found,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    let user = match current_user() {
+        Some(user) => user,
+        None => return (StatusCode::UNAUTHORIZED, "Sign in to report statuses").into_response(),
+    };
+    if !server.has_role(&repo_path, Role::Write) {
+        return (
+            StatusCode::FORBIDDEN,
+            "Reporting statuses needs write access",
+        )
+            .into_response();
+    }
+    if archive::is_archived(&repo_path) {
+        return (StatusCode::CONFLICT, archive::refusal(&repo_name)).into_response();
+    }
+    let commit = match resolve_commit(&repo_path, &rev) {
+        Some(commit) => commit,
+        None => return (StatusCode::NOT_FOUND, "Commit not found").into_response(),
+    };
+    let state: BuildState = match request.state.parse() {
+        Ok(state) => state,
+        Err(e) => return (StatusCode::UNPROCESSABLE_ENTITY, e).into_response(),
+    };
+    let status = CommitStatus {
+        context: request
+            .context
+            .filter(|context| !context.trim().is_empty())
+            .map_or_else(
+                || "default".to_string(),
+                |context| context.trim().to_string(),
+            ),
+        state,
+        target_url: request.target_url.trim().to_string(),
+        description: request.description.trim().to_string(),
+        creator: user.clone(),
+        updated: chrono::Utc::now().timestamp(),
+    };
+    match ci::report_status(&repo_path, &commit, status.clone()) {
+        Ok(()) => {
+            tracing::info!(
+                user,
+                "{} reported {} for {} of {}",
+                status.context,
+                state.name(),
+                commit,
+                repo_name
+            );
+            (StatusCode::CREATED, Json(status)).into_response()
+        }
+        Err(e) => (StatusCode::UNPROCESSABLE_ENTITY, format!("{:#}", e)).into_response(),
+    }
+}
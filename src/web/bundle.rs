@@ -0,0 +1,47 @@
+use super::{stream, WebServer};
+use crate::bundle::{self, Request};
+use crate::git::limits::Pool;
+use axum::{
+    http::{header, StatusCode},
+    response::{IntoResponse, Response},
+};
+use std::collections::HashMap;
+use std::path::PathBuf;
+
+/// Stream a bundle: /repo/<name>/bundle?refs=main,v1.0&since=<rev>
+pub async fn download(
+    server: &WebServer,
+    query: &HashMap<String, String>,
+    repo_name: &str,
+    repo_path: &PathBuf,
+) -> Response {
+    let request = Request::new(
+        query.get("refs").map(String::as_str).unwrap_or(""),
+        query.get("since").map(String::as_str),
+    );
+    let args = match request.resolve(repo_path) {
+        Ok(args) => args,
+        Err(e) => return (StatusCode::BAD_REQUEST, e).into_response(),
+    };
+
+    // A bundle costs the server as much as a clone
+    let command = bundle::command(repo_path, &args);
+    let output = match stream::spawn(server, Pool::Upload, command).await {
+        Ok(output) => output,
+        Err(response) => return response,
+    };
+    (
+        [
+            (header::CONTENT_TYPE, "application/x-git-bundle".to_string()),
+            (
+                header::CONTENT_DISPOSITION,
+                format!(
+                    "attachment; filename=\"{}\"",
+                    bundle::file_name(repo_name).replace('"', "")
+                ),
+            ),
+        ],
+        output.body(),
+    )
+        .into_response()
+}
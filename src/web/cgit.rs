@@ -0,0 +1,66 @@
+use super::{url_path, WebServer};
+use axum::{
+    extract::{Query, State},
+    http::{StatusCode, Uri},
+    response::{IntoResponse, Redirect, Response},
+};
+use std::collections::HashMap;
+use std::sync::Arc;
+
+/// Fallback handler that redirects cgit-style URLs to the matching agito page,
+/// so bookmarks and crawlers pointed at a former cgit instance keep working.
+///
+/// Understands `/<repo>/{summary,about,refs,log,tree,plain,commit,diff,patch,tag}`
+/// with the ref taken from `h=` and the commit from `id=`. Repositories may be
+/// named with or without the `.git` suffix.
+pub async fn handle(
+    State(server): State<Arc<WebServer>>,
+    Query(query): Query<HashMap<String, String>>,
+    uri: Uri,
+) -> Response {
+    let path = uri.path().trim_start_matches('/');
+    let (repo, rest) = path.split_once('/').unwrap_or((path, ""));
+
+    let (name, repo_path) = match resolve(&server, repo) {
+        Some(found) => found,
+        None => return (StatusCode::NOT_FOUND, "Page not found").into_response(),
+    };
+
+    let (page, file_path) = rest.split_once('/').unwrap_or((rest, ""));
+    let file_path = file_path.trim_matches('/');
+
+    let branch = query.get("h").filter(|h| !h.is_empty());
+    let rev = query
+        .get("id")
+        .filter(|id| !id.is_empty())
+        .or(branch)
+        .cloned()
+        .unwrap_or_else(|| server.default_branch(&repo_path));
+
+    let base = format!("/repo/{}", url_path(&name));
+    let target = match page {
+        "" | "summary" | "about" => base,
+        "refs" => format!("{}/tags", base),
+        "tag" => match branch {
+            Some(tag) => format!("{}/tag/{}", base, url_path(tag)),
+            None => format!("{}/tags", base),
+        },
+        "log" => format!("{}/log/{}", base, url_path(&rev)),
+        "tree" if file_path.is_empty() => format!("{}/tree/{}", base, url_path(&rev)),
+        "tree" => format!("{}/tree/{}/{}", base, url_path(&rev), file_path),
+        "plain" => format!("{}/raw/{}/{}", base, url_path(&rev), file_path),
+        "commit" | "diff" | "patch" => format!("{}/commit/{}", base, url_path(&rev)),
+        _ => return (StatusCode::NOT_FOUND, "Page not found").into_response(),
+    };
+
+    Redirect::permanent(&target).into_response()
+}
+
+fn resolve(server: &WebServer, repo: &str) -> Option<(String, std::path::PathBuf)> {
+    if let Some(path) = server.repo_path(repo) {
+        return Some((repo.to_string(), path));
+    }
+
+    let name = format!("{}.git", repo);
+    server.repo_path(&name).map(|path| (name, path))
+}
@@ -0,0 +1,199 @@
+use super::auth::cookie;
+use super::WebServer;
+use crate::keys;
+use axum::{
+    body::Body,
+    extract::{Request, State},
+    http::{header, HeaderMap, HeaderValue, Method, StatusCode},
+    middleware::Next,
+    response::{IntoResponse, Response},
+};
+use std::cell::Cell;
+use std::sync::Arc;
+
+/// Cookie holding the browser's CSRF token
+pub const CSRF_COOKIE: &str = "agito_csrf";
+
+/// Form field and header carrying the token back
+const FIELD: &str = "csrf";
+const HEADER: &str = "x-csrf-token";
+
+/// Largest form read to find the token, as much as axum's form extractor
+/// takes
+const MAX_FORM_BYTES: usize = 2 * 1024 * 1024;
+
+struct Token {
+    value: String,
+    /// Whether a page handed it out, so a new one must be set as a cookie
+    used: Cell<bool>,
+}
+
+tokio::task_local! {
+    static TOKEN: Token;
+}
+
+/// Put the current request's token in every form of `html` that posts, so
+/// submitting it passes [`middleware`]
+pub fn protect_forms(html: &str) -> String {
+    let field = match TOKEN.try_with(|token| {
+        token.used.set(true);
+        format!(
+            "<input type=\"hidden\" name=\"{}\" value=\"{}\">",
+            FIELD, token.value
+        )
+    }) {
+        Ok(field) => field,
+        Err(_) => return html.to_string(),
+    };
+    let mut out = String::with_capacity(html.len());
+    let mut rest = html;
+    while let Some(start) = rest.find("<form") {
+        let end = match rest[start..].find('>') {
+            Some(end) => start + end + 1,
+            None => break,
+        };
+        out.push_str(&rest[..end]);
+        if rest[start..end].contains("method=\"post\"") {
+            out.push_str(&field);
+        }
+        rest = &rest[end..];
+    }
+    out.push_str(rest);
+    out
+}
+
+/// Turn away posts from other sites made with a signed-in user's cookies:
+/// a form post must carry the token from the browser's `agito_csrf` cookie,
+/// which pages put in their forms and other sites can't read.
+///
+/// Only posts a browser sends across sites without asking the server first
+/// are checked: forms and plain text. API clients posting JSON, and requests
+/// authenticated with an access token, which browsers don't add on their
+/// own, need no token.
+pub async fn middleware(
+    State(server): State<Arc<WebServer>>,
+    req: Request,
+    next: Next,
+) -> Response {
+    let existing = cookie(req.headers(), CSRF_COOKIE)
+        .filter(|value| valid(value))
+        .map(str::to_string);
+    let req = if needs_token(&req) {
+        match check(req, existing.as_deref()).await {
+            Ok(req) => req,
+            Err(response) => return response,
+        }
+    } else {
+        req
+    };
+
+    let (value, fresh) = match existing {
+        Some(value) => (value, false),
+        None => match keys::random_bytes(16) {
+            Ok(bytes) => (keys::hex(&bytes), true),
+            Err(e) => return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+        },
+    };
+    let token = Token {
+        value: value.clone(),
+        used: Cell::new(false),
+    };
+    let (mut response, used) = TOKEN
+        .scope(token, async {
+            let response = next.run(req).await;
+            (response, TOKEN.with(|token| token.used.get()))
+        })
+        .await;
+    if fresh && used {
+        let secure = server
+            .public_url
+            .as_deref()
+            .map_or(false, |url| url.starts_with("https://"));
+        let cookie = format!(
+            "{}={}; Path=/; HttpOnly; SameSite=Lax{}",
+            CSRF_COOKIE,
+            value,
+            if secure { "; Secure" } else { "" }
+        );
+        if let Ok(cookie) = HeaderValue::from_str(&cookie) {
+            response.headers_mut().append(header::SET_COOKIE, cookie);
+        }
+    }
+    response
+}
+
+fn valid(token: &str) -> bool {
+    token.len() == 32 && token.bytes().all(|b| b.is_ascii_hexdigit())
+}
+
+/// Whether a request is one a browser sends for any site's form
+fn needs_token(req: &Request) -> bool {
+    if req.method() != Method::POST || req.headers().contains_key(header::AUTHORIZATION) {
+        return false;
+    }
+    match content_type(req.headers()).as_deref() {
+        None => true,
+        Some(mime) => matches!(
+            mime,
+            "application/x-www-form-urlencoded" | "multipart/form-data" | "text/plain"
+        ),
+    }
+}
+
+fn content_type(headers: &HeaderMap) -> Option<String> {
+    let value = headers.get(header::CONTENT_TYPE)?.to_str().ok()?;
+    Some(
+        value
+            .split(';')
+            .next()
+            .unwrap_or("")
+            .trim()
+            .to_ascii_lowercase(),
+    )
+}
+
+/// Pass the request on if it carries the cookie's token, in the header or
+/// the form, reading the form and putting it back for the handler
+async fn check(req: Request, expected: Option<&str>) -> Result<Request, Response> {
+    let refused = || {
+        (
+            StatusCode::FORBIDDEN,
+            "The form has expired or came from another site; reload the page and try again\n",
+        )
+            .into_response()
+    };
+    let expected = expected.ok_or_else(refused)?;
+    if let Some(sent) = req.headers().get(HEADER).and_then(|v| v.to_str().ok()) {
+        return if same(sent, expected) {
+            Ok(req)
+        } else {
+            Err(refused())
+        };
+    }
+    if content_type(req.headers()).as_deref() != Some("application/x-www-form-urlencoded") {
+        return Err(refused());
+    }
+
+    let (parts, body) = req.into_parts();
+    let bytes = axum::body::to_bytes(body, MAX_FORM_BYTES)
+        .await
+        .map_err(|_| (StatusCode::PAYLOAD_TOO_LARGE, "Form too large\n").into_response())?;
+    // The token is hex, so it needs no decoding
+    let sent = bytes
+        .split(|&b| b == b'&')
+        .filter_map(|pair| pair.strip_prefix(format!("{}=", FIELD).as_bytes()))
+        .find_map(|value| std::str::from_utf8(value).ok());
+    match sent {
+        Some(sent) if same(sent, expected) => Ok(Request::from_parts(parts, Body::from(bytes))),
+        _ => Err(refused()),
+    }
+}
+
+/// Compare tokens in time independent of where they differ
+fn same(a: &str, b: &str) -> bool {
+    a.len() == b.len()
+        && a.bytes()
+            .zip(b.bytes())
+            .fold(0, |diff, (x, y)| diff | (x ^ y))
+            == 0
+}
@@ -0,0 +1,137 @@
+use super::auth::{current_user, remote_addr};
+use super::settings::{error_message, forbidden, settings_nav};
+use super::{breadcrumb, html_escape, relative_time, render_page, url_path, WebServer};
+use crate::audit::{self, Action, Via};
+use crate::deploy_keys;
+use axum::{
+    http::StatusCode,
+    response::{IntoResponse, Redirect, Response},
+};
+use std::collections::HashMap;
+use std::path::PathBuf;
+
+fn deploy_keys_url(repo_name: &str) -> String {
+    format!("/repo/{}/settings/deploy-keys", url_path(repo_name))
+}
+
+/// Deploy key settings: /repo/<name>/settings/deploy-keys
+pub fn deploy_keys_page(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    error: Option<&str>,
+) -> Response {
+    if !server.may_administer(repo_path) {
+        return forbidden();
+    }
+    let keys = match deploy_keys::list(repo_path) {
+        Ok(keys) => keys,
+        Err(e) => return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    };
+
+    let action = deploy_keys_url(repo_name);
+    let mut body = settings_nav(repo_name);
+    body.push_str(
+        "<h1>Deploy keys</h1>\n<p>A deploy key can fetch this repository over SSH and nothing else. Give CI jobs and servers their own key instead of a person's.</p>\n",
+    );
+    body.push_str(&error_message(error));
+
+    if keys.is_empty() {
+        body.push_str("<p>No deploy keys.</p>\n");
+    } else {
+        body.push_str(
+            "<table>\n<tr><th>Title</th><th>Fingerprint</th><th>Added</th><th></th></tr>\n",
+        );
+        for key in &keys {
+            body.push_str(&format!(
+                "<tr><td>{}</td><td><code>{}</code></td><td>{}{}</td><td><form method=\"post\" action=\"{}\"><input type=\"hidden\" name=\"key\" value=\"{}\"><button type=\"submit\" name=\"action\" value=\"remove\">Remove</button></form></td></tr>\n",
+                html_escape(&key.title),
+                html_escape(&key.fingerprint),
+                relative_time(key.created),
+                key.added_by
+                    .as_deref()
+                    .map(|user| format!(" by {}", html_escape(user)))
+                    .unwrap_or_default(),
+                action,
+                key.id
+            ));
+        }
+        body.push_str("</table>\n");
+    }
+
+    body.push_str(&format!(
+        "<h2>Add a deploy key</h2>\n<form method=\"post\" action=\"{}\">\n<input type=\"hidden\" name=\"action\" value=\"add\">\n<label>Title<br><input type=\"text\" name=\"title\" size=\"40\" placeholder=\"CI\"></label><br>\n<label>Public key<br><textarea name=\"key\" rows=\"3\" cols=\"70\" placeholder=\"ssh-ed25519 AAAA... ci@build\" required></textarea></label><br>\n<button type=\"submit\">Add key</button>\n</form>\n",
+        action
+    ));
+
+    render_page(
+        server,
+        &format!("{} - Deploy keys", repo_name),
+        &breadcrumb(
+            repo_name,
+            &[
+                ("Settings".to_string(), None),
+                ("Deploy keys".to_string(), None),
+            ],
+        ),
+        &body,
+    )
+}
+
+/// Add or remove a deploy key, then show the settings again
+pub fn save_form(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    form: &HashMap<String, String>,
+) -> Response {
+    if !server.may_administer(repo_path) {
+        return forbidden();
+    }
+    let user = current_user();
+    let field = |key: &str| form.get(key).map(String::as_str).unwrap_or("");
+
+    let result = match field("action") {
+        "add" => deploy_keys::add(
+            &server.repos_dir,
+            &server.data_dir,
+            repo_path,
+            field("title"),
+            field("key"),
+            user.as_deref(),
+        )
+        .map(|key| {
+            (
+                Action::DeployKeyAdd,
+                key.fingerprint,
+                format!("added deploy key {} ({})", key.id, key.title),
+            )
+        }),
+        "remove" => match field("key").parse() {
+            Ok(id) => deploy_keys::remove(repo_path, id).map(|key| {
+                (
+                    Action::DeployKeyRemove,
+                    key.fingerprint,
+                    format!("removed deploy key {} ({})", key.id, key.title),
+                )
+            }),
+            Err(_) => return (StatusCode::BAD_REQUEST, "No deploy key given").into_response(),
+        },
+        _ => return (StatusCode::BAD_REQUEST, "Unknown action").into_response(),
+    };
+    match result {
+        Ok((action, fingerprint, change)) => {
+            if let Some(user) = &user {
+                tracing::info!(repo = %repo_name, user = %user, "Deploy keys: {} {}", change, fingerprint);
+            }
+            audit::Entry::new(action, Via::Web, user.as_deref())
+                .with_repo(repo_name)
+                .with_target(&fingerprint)
+                .with_detail(change)
+                .with_remote(remote_addr())
+                .record(&server.data_dir);
+            Redirect::to(&deploy_keys_url(repo_name)).into_response()
+        }
+        Err(e) => deploy_keys_page(server, repo_name, repo_path, Some(&format!("{:#}", e))),
+    }
+}
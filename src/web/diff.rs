@@ -0,0 +1,329 @@
+//! Diffs side by side.
+//!
+//! Commit, compare and pull request pages show their diff unified or split,
+//! with the old file on the left and the new one on the right. The pages
+//! link to the other view with `?diff=split` or `?diff=unified`, and the
+//! choice is kept in the signed-in user's preferences for the next diff.
+
+use super::auth::current_user;
+use super::{html_escape, url_path, WebServer};
+use crate::preferences::{self, DiffView};
+use crate::reviews::{Kind, Line, Position};
+use std::collections::{BTreeMap, HashMap};
+
+/// The view a page shows its diff in: the one `?diff=` asks for, which is
+/// remembered for the signed-in user, or else the one they chose last
+pub fn view(server: &WebServer, query: &HashMap<String, String>) -> DiffView {
+    let asked = query
+        .get("diff")
+        .and_then(|view| view.parse::<DiffView>().ok());
+    let Some(user) = current_user() else {
+        return asked.unwrap_or_default();
+    };
+    let mut stored = match preferences::get(&server.data_dir, &user) {
+        Ok(stored) => stored,
+        Err(e) => {
+            tracing::warn!(user = %user, "Failed to read preferences: {:#}", e);
+            return asked.unwrap_or_default();
+        }
+    };
+    match asked {
+        Some(view) if stored.diff_view != Some(view) => {
+            stored.diff_view = Some(view);
+            if let Err(e) = preferences::set(&server.data_dir, &user, &stored) {
+                tracing::warn!(user = %user, "Failed to save diff view: {:#}", e);
+            }
+            view
+        }
+        Some(view) => view,
+        None => stored.diff_view.unwrap_or_default(),
+    }
+}
+
+/// Links between the views of the diff on the page at `url`, keeping the
+/// page's other query parameters
+pub fn toggle(url: &str, query: &HashMap<String, String>, view: DiffView) -> String {
+    let link = |other: DiffView| {
+        let mut params: BTreeMap<&str, &str> = query
+            .iter()
+            .map(|(key, value)| (key.as_str(), value.as_str()))
+            .collect();
+        params.insert("diff", other.name());
+        let params: Vec<String> = params
+            .iter()
+            .filter(|(_, value)| !value.is_empty())
+            .map(|(key, value)| format!("{}={}", url_path(key), url_path(value)))
+            .collect();
+        format!("{}?{}", url, html_escape(&params.join("&")))
+    };
+    let item = |other: DiffView, label: &str| {
+        if other == view {
+            format!("<strong>{}</strong>", label)
+        } else {
+            format!("<a href=\"{}\">{}</a>", link(other), label)
+        }
+    };
+    format!(
+        "<p class=\"diff-toggle\">View: {} &middot; {}</p>\n",
+        item(DiffView::Unified, "Unified"),
+        item(DiffView::Split, "Split")
+    )
+}
+
+/// The lines of a diff in a table, old lines on the left and new ones on the
+/// right. Removed lines are paired with the added lines that follow them,
+/// with the part of each pair that changed highlighted. `number` renders a
+/// line's number from its position, and whatever `below` returns for a
+/// position, such as review threads, goes in a row of its own under it.
+pub fn split(
+    lines: &[Line],
+    number: impl Fn(&Position) -> String,
+    mut below: impl FnMut(&Position) -> String,
+) -> String {
+    let mut html = String::from("<table class=\"diff-split\">\n");
+    let mut below_row = |html: &mut String, line: Option<&Line>| {
+        let Some(position) = line.and_then(|line| line.position.as_ref()) else {
+            return;
+        };
+        let content = below(position);
+        if !content.is_empty() {
+            html.push_str(&format!(
+                "<tr><td colspan=\"4\" class=\"diff-below\">{}</td></tr>\n",
+                content
+            ));
+        }
+    };
+    let cells = |line: Option<&Line>, class: &str, text: &str| match line {
+        Some(line) => format!(
+            "<td class=\"diff-num\">{}</td><td class=\"{}\">{}</td>",
+            line.position.as_ref().map(&number).unwrap_or_default(),
+            class,
+            text
+        ),
+        None => "<td class=\"diff-num\"></td><td class=\"diff-empty\"></td>".to_string(),
+    };
+
+    let mut i = 0;
+    while i < lines.len() {
+        let line = &lines[i];
+        match line.kind {
+            Kind::Removed | Kind::Added => {
+                let start = i;
+                while i < lines.len() && lines[i].kind == Kind::Removed {
+                    i += 1;
+                }
+                let removed = &lines[start..i];
+                let middle = i;
+                while i < lines.len() && lines[i].kind == Kind::Added {
+                    i += 1;
+                }
+                let added = &lines[middle..i];
+                for row in 0..removed.len().max(added.len()) {
+                    let (old, new) = (removed.get(row), added.get(row));
+                    let (old_text, new_text) = match (old, new) {
+                        (Some(old), Some(new)) => highlight(content(old), content(new)),
+                        _ => (
+                            old.map_or(String::new(), |line| html_escape(content(line))),
+                            new.map_or(String::new(), |line| html_escape(content(line))),
+                        ),
+                    };
+                    html.push_str(&format!(
+                        "<tr>{}{}</tr>\n",
+                        cells(old, "diff-del", &old_text),
+                        cells(new, "diff-add", &new_text)
+                    ));
+                    below_row(&mut html, old);
+                    below_row(&mut html, new);
+                }
+                continue;
+            }
+            Kind::Context => {
+                let text = html_escape(content(line));
+                let old_number = line
+                    .old_line
+                    .map(|n| format!("<span class=\"diff-num\">{:>5}</span>", n))
+                    .unwrap_or_default();
+                html.push_str(&format!(
+                    "<tr><td class=\"diff-num\">{}</td><td>{}</td>{}</tr>\n",
+                    old_number,
+                    text,
+                    cells(Some(line), "", &text)
+                ));
+                below_row(&mut html, Some(line));
+            }
+            Kind::File | Kind::Hunk | Kind::Other => {
+                let class = match line.kind {
+                    Kind::File => "diff-file",
+                    Kind::Hunk => "diff-hunk",
+                    _ => "",
+                };
+                html.push_str(&format!(
+                    "<tr><td colspan=\"4\" class=\"{}\">{}</td></tr>\n",
+                    class,
+                    html_escape(line.text)
+                ));
+            }
+        }
+        i += 1;
+    }
+    html.push_str("</table>");
+    html
+}
+
+/// A hunk line without its `+`, `-` or ` ` marker
+fn content<'a>(line: &Line<'a>) -> &'a str {
+    line.text.get(1..).unwrap_or("")
+}
+
+/// The two lines of a pair, escaped, with what changed between them marked:
+/// all but the start and end they share. Lines with nothing in common are
+/// left unmarked.
+fn highlight(old: &str, new: &str) -> (String, String) {
+    let prefix: usize = old
+        .chars()
+        .zip(new.chars())
+        .take_while(|(a, b)| a == b)
+        .map(|(a, _)| a.len_utf8())
+        .sum();
+    let suffix: usize = old[prefix..]
+        .chars()
+        .rev()
+        .zip(new[prefix..].chars().rev())
+        .take_while(|(a, b)| a == b)
+        .map(|(a, _)| a.len_utf8())
+        .sum();
+    if prefix == 0 && suffix == 0 {
+        return (html_escape(old), html_escape(new));
+    }
+    let mark = |text: &str| {
+        let end = text.len() - suffix;
+        let changed = &text[prefix..end];
+        if changed.is_empty() {
+            return html_escape(text);
+        }
+        format!(
+            "{}<span class=\"diff-change\">{}</span>{}",
+            html_escape(&text[..prefix]),
+            html_escape(changed),
+            html_escape(&text[end..])
+        )
+    };
+    (mark(old), mark(new))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::reviews;
+
+    fn marked(text: &str) -> String {
+        format!("<span class=\"diff-change\">{}</span>", text)
+    }
+
+    #[test]
+    fn highlight_marks_what_changed() {
+        assert_eq!(
+            highlight("two <b>", "two <i>"),
+            (
+                format!("two &lt;{}&gt;", marked("b")),
+                format!("two &lt;{}&gt;", marked("i"))
+            )
+        );
+    }
+
+    #[test]
+    fn highlight_keeps_multibyte_characters_whole() {
+        assert_eq!(
+            highlight("héllo wörld", "héllo wurld"),
+            (
+                format!("héllo w{}rld", marked("ö")),
+                format!("héllo w{}rld", marked("u"))
+            )
+        );
+        // Characters that share their first bytes still differ
+        assert_eq!(
+            highlight("x😀y", "x😁y"),
+            (format!("x{}y", marked("😀")), format!("x{}y", marked("😁")))
+        );
+    }
+
+    #[test]
+    fn highlight_does_not_let_prefix_and_suffix_overlap() {
+        // All of the old line is a prefix of the new one, and its end also a
+        // suffix; only the insertion is marked
+        assert_eq!(
+            highlight("aéa", "aéaéa"),
+            ("aéa".to_string(), format!("aéa{}", marked("éa")))
+        );
+        assert_eq!(
+            highlight("ééé", "éé"),
+            (format!("éé{}", marked("é")), "éé".to_string())
+        );
+    }
+
+    #[test]
+    fn highlight_leaves_unrelated_lines_unmarked() {
+        assert_eq!(
+            highlight("abc", "xyz"),
+            ("abc".to_string(), "xyz".to_string())
+        );
+    }
+
+    #[test]
+    fn split_pairs_removed_lines_with_the_added_ones_after_them() {
+        let diff = "diff --git a/f b/f\n--- a/f\n+++ b/f\n@@ -1,4 +1,3 @@\n one\n-two\n-three\n+2\n four\n+five\n";
+        let lines = reviews::lines(diff);
+        let html = split(
+            &lines,
+            |position| format!("{}{}", position.side.name(), position.line),
+            |_| String::new(),
+        );
+        let rows: Vec<&str> = html
+            .lines()
+            .filter(|row| row.contains("diff-num"))
+            .collect();
+        assert_eq!(rows.len(), 5);
+        assert!(rows[0].contains(">one</td><td class=\"diff-num\">new1</td>"));
+        // two and 2 side by side, then three alone on the left
+        assert!(rows[1].starts_with("<tr><td class=\"diff-num\">old2</td><td class=\"diff-del\">"));
+        assert!(rows[1].contains("<td class=\"diff-num\">new2</td><td class=\"diff-add\">2</td>"));
+        assert!(
+            rows[2].contains("<td class=\"diff-num\">old3</td><td class=\"diff-del\">three</td>")
+        );
+        assert!(
+            rows[2].ends_with("<td class=\"diff-num\"></td><td class=\"diff-empty\"></td></tr>")
+        );
+        // Context lines show their old number on the left
+        assert!(rows[3].contains(">    4</span></td><td>four</td><td class=\"diff-num\">new3</td>"));
+        // An addition with nothing removed before it is alone on the right
+        assert!(rows[4].starts_with(
+            "<tr><td class=\"diff-num\"></td><td class=\"diff-empty\"></td><td class=\"diff-num\">new4</td><td class=\"diff-add\">five</td>"
+        ));
+    }
+
+    #[test]
+    fn split_puts_what_goes_below_a_line_under_its_row() {
+        let diff = "@@ -1,2 +1,2 @@\n-old\n+new\n same\n";
+        let lines = reviews::lines(diff);
+        let html = split(
+            &lines,
+            |position| position.line.to_string(),
+            |position| match position.side {
+                reviews::Side::Old => "thread on old".to_string(),
+                reviews::Side::New if position.line == 2 => "thread on same".to_string(),
+                reviews::Side::New => String::new(),
+            },
+        );
+        let rows: Vec<&str> = html.lines().collect();
+        assert!(rows[2].contains("diff-del"));
+        assert_eq!(
+            rows[3],
+            "<tr><td colspan=\"4\" class=\"diff-below\">thread on old</td></tr>"
+        );
+        assert!(rows[4].contains(">same</td>"));
+        assert_eq!(
+            rows[5],
+            "<tr><td colspan=\"4\" class=\"diff-below\">thread on same</td></tr>"
+        );
+    }
+}
@@ -0,0 +1,367 @@
+use super::security_headers::EMBEDDABLE_POLICY;
+use super::{html_escape, relative_time, url_path, WebServer};
+use crate::{ci, git};
+use axum::{
+    extract::{Query, State},
+    http::{header, HeaderMap, StatusCode},
+    response::{Html, IntoResponse, Response},
+    Json,
+};
+use std::collections::HashMap;
+use std::path::PathBuf;
+use std::sync::Arc;
+
+/// Default size of the repository card iframe handed out over oEmbed
+const CARD_WIDTH: u32 = 400;
+const CARD_HEIGHT: u32 = 130;
+
+/// Widgets change with every push, so let embedding pages cache them only briefly
+const WIDGET_CACHE: &str = "public, max-age=300";
+
+/// The configured public URL, else the scheme and host the client used to
+/// reach the server, for absolute URLs in link previews. The scheme comes
+/// from `X-Forwarded-Proto` only behind a trusted proxy.
+pub fn base_url(server: &WebServer, headers: &HeaderMap) -> String {
+    if let Some(url) = &server.public_url {
+        return url.clone();
+    }
+    let host = headers
+        .get(header::HOST)
+        .and_then(|h| h.to_str().ok())
+        .filter(|h| {
+            !h.is_empty()
+                && h.chars()
+                    .all(|c| c.is_ascii_alphanumeric() || matches!(c, '.' | '-' | ':' | '[' | ']'))
+        })
+        .unwrap_or("localhost");
+    let scheme = if server.access_log.trust_proxy {
+        headers
+            .get("x-forwarded-proto")
+            .and_then(|p| p.to_str().ok())
+            .filter(|p| *p == "https")
+            .unwrap_or("http")
+    } else {
+        "http"
+    };
+    format!("{}://{}", scheme, host)
+}
+
+/// What a link preview shows for a page
+pub struct Meta {
+    pub title: String,
+    pub description: String,
+    /// Absolute URL of the page
+    pub url: String,
+}
+
+impl Meta {
+    /// OpenGraph and Twitter card tags, plus oEmbed discovery, for the page head
+    pub fn head_tags(&self, base: &str) -> String {
+        let title = html_escape(&self.title);
+        let description = html_escape(&self.description);
+        let url = html_escape(&self.url);
+        format!(
+            r#"<meta name="description" content="{description}">
+    <meta property="og:site_name" content="agito">
+    <meta property="og:type" content="website">
+    <meta property="og:title" content="{title}">
+    <meta property="og:description" content="{description}">
+    <meta property="og:url" content="{url}">
+    <meta name="twitter:card" content="summary">
+    <meta name="twitter:title" content="{title}">
+    <meta name="twitter:description" content="{description}">
+    <link rel="alternate" type="application/json+oembed" href="{base}/oembed?url={oembed}&amp;format=json" title="{title}">"#,
+            base = html_escape(base),
+            oembed = url_path(&self.url),
+        )
+    }
+}
+
+/// Everything the widgets show about a repository
+struct Summary {
+    name: String,
+    description: String,
+    branch: String,
+    latest_tag: Option<String>,
+    last_commit: Option<git::batch::Commit>,
+    ci: Option<ci::State>,
+}
+
+fn summarize(server: &WebServer, name: &str, repo_path: &PathBuf, rev: Option<&str>) -> Summary {
+    let branch = match rev {
+        Some(rev) if server.rev_exists(repo_path, rev) => rev.to_string(),
+        _ => server.default_branch(repo_path),
+    };
+    let last_commit = git::batch::pool().commit(repo_path, &branch).ok().flatten();
+    let ci = last_commit
+        .as_ref()
+        .and_then(|commit| ci::combined_status(repo_path, &commit.id));
+
+    Summary {
+        name: name.to_string(),
+        description: server.description(repo_path),
+        branch,
+        latest_tag: git::latest_tag(repo_path),
+        last_commit,
+        ci,
+    }
+}
+
+/// Embeddable widgets: /repo/<name>/widget/{card,card.svg,release.svg,ci.svg}.
+/// `?ref=<branch>` picks the branch the card and CI badge describe.
+pub fn widget(
+    server: &WebServer,
+    headers: &HeaderMap,
+    query: &HashMap<String, String>,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    kind: &str,
+) -> Response {
+    let summary = summarize(
+        server,
+        repo_name,
+        repo_path,
+        query.get("ref").map(|r| r.as_str()),
+    );
+
+    match kind {
+        "card" => (
+            [
+                (header::CACHE_CONTROL, WIDGET_CACHE),
+                (header::CONTENT_SECURITY_POLICY, EMBEDDABLE_POLICY),
+            ],
+            Html(card_html(&summary, &base_url(server, headers))),
+        )
+            .into_response(),
+        "card.svg" => svg(card_svg(&summary)),
+        "release.svg" => svg(release_badge(&summary)),
+        "ci.svg" => svg(build_badge(&summary)),
+        _ => (StatusCode::NOT_FOUND, "Unknown widget").into_response(),
+    }
+}
+
+/// Badge for READMEs: /repo/<name>/badge.svg shows the build status of the
+/// default branch, or of `?ref=<branch>`, over the server's own builds and
+/// the statuses outside CI systems reported; `?show=tag` shows the latest
+/// tag instead
+pub fn status_badge(
+    server: &WebServer,
+    query: &HashMap<String, String>,
+    repo_name: &str,
+    repo_path: &PathBuf,
+) -> Response {
+    let summary = summarize(
+        server,
+        repo_name,
+        repo_path,
+        query.get("ref").map(|r| r.as_str()),
+    );
+    match query.get("show").map(|show| show.as_str()) {
+        None | Some("build") => svg(build_badge(&summary)),
+        Some("tag") => svg(release_badge(&summary)),
+        Some(_) => (StatusCode::NOT_FOUND, "Unknown badge").into_response(),
+    }
+}
+
+fn release_badge(summary: &Summary) -> String {
+    match &summary.latest_tag {
+        Some(tag) => badge("release", tag, "#007ec6"),
+        None => badge("release", "none", "#9f9f9f"),
+    }
+}
+
+fn build_badge(summary: &Summary) -> String {
+    match summary.ci {
+        Some(ci::State::Success) => badge("build", "passing", "#4c1"),
+        Some(ci::State::Failure) => badge("build", "failing", "#e05d44"),
+        Some(ci::State::Pending) => badge("build", "pending", "#dfb317"),
+        None => badge("build", "unknown", "#9f9f9f"),
+    }
+}
+
+fn svg(body: String) -> Response {
+    (
+        [
+            (header::CONTENT_TYPE, "image/svg+xml"),
+            (header::CACHE_CONTROL, WIDGET_CACHE),
+        ],
+        body,
+    )
+        .into_response()
+}
+
+/// Rough width of text in 11px Verdana, enough to size badges
+fn text_width(text: &str) -> usize {
+    text.chars().count() * 7
+}
+
+/// A two-part badge in the style of shields.io
+fn badge(label: &str, value: &str, color: &str) -> String {
+    let label_width = text_width(label) + 10;
+    let value_width = text_width(value) + 10;
+    let width = label_width + value_width;
+    let (label, value) = (html_escape(label), html_escape(value));
+
+    format!(
+        r##"<svg xmlns="http://www.w3.org/2000/svg" width="{width}" height="20" role="img" aria-label="{label}: {value}">
+<title>{label}: {value}</title>
+<linearGradient id="s" x2="0" y2="100%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+<clipPath id="r"><rect width="{width}" height="20" rx="3" fill="#fff"/></clipPath>
+<g clip-path="url(#r)"><rect width="{label_width}" height="20" fill="#555"/><rect x="{label_width}" width="{value_width}" height="20" fill="{color}"/><rect width="{width}" height="20" fill="url(#s)"/></g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11"><text x="{label_x}" y="14">{label}</text><text x="{value_x}" y="14">{value}</text></g>
+</svg>
+"##,
+        label_x = label_width / 2,
+        value_x = label_width + value_width / 2,
+    )
+}
+
+/// Shorten text to `max` characters for fixed-size widgets
+fn truncate(text: &str, max: usize) -> String {
+    if text.chars().count() <= max {
+        text.to_string()
+    } else {
+        let mut short: String = text.chars().take(max - 1).collect();
+        short.push('…');
+        short
+    }
+}
+
+/// One-line facts shown under the repository name
+fn facts(summary: &Summary) -> String {
+    let mut facts = vec![format!("branch {}", summary.branch)];
+    if let Some(tag) = &summary.latest_tag {
+        facts.push(format!("latest {}", tag));
+    }
+    if let Some(state) = summary.ci {
+        facts.push(format!("CI {}", state.name()));
+    }
+    facts.join(" · ")
+}
+
+fn last_commit_line(summary: &Summary) -> String {
+    match &summary.last_commit {
+        Some(commit) => format!(
+            "{} · {}",
+            commit.subject(),
+            relative_time(commit.committer_time)
+        ),
+        None => "No commits yet".to_string(),
+    }
+}
+
+/// Self-contained HTML card, meant to be shown in an iframe
+fn card_html(summary: &Summary, base: &str) -> String {
+    format!(
+        r#"<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="utf-8">
+    <base target="_blank">
+    <style>
+        body {{ font-family: Arial, sans-serif; margin: 0; }}
+        .card {{ border: 1px solid #ddd; border-radius: 6px; padding: 12px 16px; }}
+        .name {{ color: #0066cc; font-weight: bold; font-size: 1.1em; text-decoration: none; }}
+        p {{ margin: 6px 0; overflow: hidden; text-overflow: ellipsis; white-space: nowrap; }}
+        .facts, .last {{ color: #666; font-size: 0.85em; }}
+    </style>
+</head>
+<body>
+    <div class="card">
+        <a class="name" href="{}/repo/{}">{}</a>
+        <p>{}</p>
+        <p class="facts">{}</p>
+        <p class="last">{}</p>
+    </div>
+</body>
+</html>
+"#,
+        html_escape(base),
+        url_path(&summary.name),
+        html_escape(&summary.name),
+        html_escape(&summary.description),
+        html_escape(&facts(summary)),
+        html_escape(&last_commit_line(summary))
+    )
+}
+
+/// The repository card as an image, for places that don't allow iframes
+fn card_svg(summary: &Summary) -> String {
+    format!(
+        r##"<svg xmlns="http://www.w3.org/2000/svg" width="{width}" height="{height}" role="img" aria-label="{name}">
+<rect x="0.5" y="0.5" width="{inner_width}" height="{inner_height}" rx="6" fill="#fff" stroke="#ddd"/>
+<g font-family="Arial,sans-serif">
+<text x="16" y="30" font-size="16" font-weight="bold" fill="#0066cc">{name}</text>
+<text x="16" y="56" font-size="13" fill="#333">{description}</text>
+<text x="16" y="84" font-size="12" fill="#666">{facts}</text>
+<text x="16" y="108" font-size="12" fill="#666">{last}</text>
+</g>
+</svg>
+"##,
+        width = CARD_WIDTH,
+        height = CARD_HEIGHT,
+        inner_width = CARD_WIDTH - 1,
+        inner_height = CARD_HEIGHT - 1,
+        name = html_escape(&truncate(&summary.name, 45)),
+        description = html_escape(&truncate(&summary.description, 55)),
+        facts = html_escape(&truncate(&facts(summary), 60)),
+        last = html_escape(&truncate(&last_commit_line(summary), 60)),
+    )
+}
+
+/// oEmbed endpoint: /oembed?url=<repository page URL>&format=json, answered
+/// with the repository card in an iframe
+pub async fn oembed(
+    State(server): State<Arc<WebServer>>,
+    headers: HeaderMap,
+    Query(query): Query<HashMap<String, String>>,
+) -> Response {
+    if query.get("format").map_or(false, |f| f != "json") {
+        return (StatusCode::NOT_IMPLEMENTED, "Only JSON is supported").into_response();
+    }
+
+    // Any page below /repo/<name> embeds as that repository's card
+    let url = query.get("url").map(|u| u.as_str()).unwrap_or("");
+    let path = url
+        .split_once("://")
+        .map(|(_, rest)| rest.find('/').map_or("", |i| &rest[i..]))
+        .unwrap_or(url);
+    let name = path
+        .strip_prefix("/repo/")
+        .map(|rest| rest.split(['/', '?', '#']).next().unwrap_or(""))
+        .unwrap_or("");
+    let name = match server.resolve_repo(name) {
+        Some((name, _)) => name,
+        None => return (StatusCode::NOT_FOUND, "Not an embeddable URL").into_response(),
+    };
+
+    let limit = |key: &str, default: u32| {
+        query
+            .get(key)
+            .and_then(|v| v.parse::<u32>().ok())
+            .map_or(default, |max| max.min(default))
+    };
+    let (width, height) = (
+        limit("maxwidth", CARD_WIDTH),
+        limit("maxheight", CARD_HEIGHT),
+    );
+    let base = base_url(&server, &headers);
+
+    Json(serde_json::json!({
+        "version": "1.0",
+        "type": "rich",
+        "provider_name": "agito",
+        "provider_url": base,
+        "title": &name,
+        "width": width,
+        "height": height,
+        "html": format!(
+            r#"<iframe src="{}/repo/{}/widget/card" width="{}" height="{}" frameborder="0" scrolling="no"></iframe>"#,
+            html_escape(&base),
+            url_path(&name),
+            width,
+            height
+        ),
+    }))
+    .into_response()
+}
@@ -0,0 +1,182 @@
+use super::WebServer;
+use crate::federation::{self, Federation, ACTIVITY_JSON};
+use axum::{
+    body::Bytes,
+    extract::{Path, Query, State},
+    http::{header, HeaderMap, StatusCode},
+    response::{IntoResponse, Response},
+};
+use serde_json::Value;
+use std::collections::HashMap;
+use std::path::PathBuf;
+use std::sync::Arc;
+
+/// Largest activity accepted in an inbox
+const MAX_ACTIVITY: usize = 256 * 1024;
+
+/// What a `/ap/<repo>/<page>` URL refers to
+enum Page {
+    Actor,
+    Inbox,
+    Outbox,
+    Followers,
+}
+
+/// The federated repository, its path and the page a `/ap/...` path refers
+/// to. A repository named like a page wins over the page of its namespace.
+fn find(
+    server: &WebServer,
+    federation: &Federation,
+    path: &str,
+) -> Option<(String, PathBuf, Page)> {
+    let pages = [
+        ("/inbox", Page::Inbox),
+        ("/outbox", Page::Outbox),
+        ("/followers", Page::Followers),
+    ];
+    let candidates = std::iter::once((path, Page::Actor)).chain(
+        pages
+            .into_iter()
+            .filter_map(|(suffix, page)| Some((path.strip_suffix(suffix)?, page))),
+    );
+    for (name, page) in candidates {
+        if !federation.is_public(name) {
+            continue;
+        }
+        if let Some(repo_path) = server.repo_path(name) {
+            return Some((name.to_string(), repo_path, page));
+        }
+    }
+    None
+}
+
+fn activity_json(value: Value) -> Response {
+    ([(header::CONTENT_TYPE, ACTIVITY_JSON)], value.to_string()).into_response()
+}
+
+fn not_found() -> Response {
+    (StatusCode::NOT_FOUND, "Not found").into_response()
+}
+
+/// WebFinger lookup of a repository: /.well-known/webfinger?resource=acct:<name>@<host>
+pub async fn webfinger(
+    State(server): State<Arc<WebServer>>,
+    Query(query): Query<HashMap<String, String>>,
+) -> Response {
+    let federation = match &server.federation {
+        Some(federation) => federation,
+        None => return not_found(),
+    };
+    let resource = query.get("resource").map(String::as_str).unwrap_or("");
+    let repo = match resource.strip_prefix("acct:") {
+        Some(account) => match account.rsplit_once('@') {
+            Some((handle, host)) if host.eq_ignore_ascii_case(federation.host()) => {
+                federation::repo_for_handle(handle)
+            }
+            _ => return not_found(),
+        },
+        // The actor's URL
+        None => match resource.strip_prefix(&federation.actor_id("")) {
+            Some(repo) => repo.to_string(),
+            None => return (StatusCode::BAD_REQUEST, "Unknown resource").into_response(),
+        },
+    };
+    if !federation.is_public(&repo) || server.repo_path(&repo).is_none() {
+        return not_found();
+    }
+    (
+        [(header::CONTENT_TYPE, "application/jrd+json")],
+        federation.webfinger(&repo).to_string(),
+    )
+        .into_response()
+}
+
+/// A repository's actor, outbox or followers: GET /ap/<repo>[/<page>]
+pub async fn get(State(server): State<Arc<WebServer>>, Path(path): Path<String>) -> Response {
+    let federation = match &server.federation {
+        Some(federation) => federation.clone(),
+        None => return not_found(),
+    };
+    let (repo, repo_path, page) = match find(&server, &federation, &path) {
+        Some(found) => found,
+        None => return not_found(),
+    };
+    let result = tokio::task::spawn_blocking(move || match page {
+        Page::Actor => federation.actor(&repo, &repo_path).map(Some),
+        Page::Outbox => Ok(Some(federation.outbox(&repo, &repo_path))),
+        Page::Followers => Ok(Some(federation.followers_collection(&repo, &repo_path))),
+        Page::Inbox => Ok(None),
+    })
+    .await;
+    match result {
+        Ok(Ok(Some(value))) => activity_json(value),
+        Ok(Ok(None)) => (
+            StatusCode::METHOD_NOT_ALLOWED,
+            "The inbox only takes POST requests",
+        )
+            .into_response(),
+        Ok(Err(e)) => {
+            tracing::error!("Failed to render the actor of {}: {:#}", path, e);
+            StatusCode::INTERNAL_SERVER_ERROR.into_response()
+        }
+        Err(_) => StatusCode::INTERNAL_SERVER_ERROR.into_response(),
+    }
+}
+
+/// An activity sent to a repository's inbox: POST /ap/<repo>/inbox
+pub async fn post(
+    State(server): State<Arc<WebServer>>,
+    Path(path): Path<String>,
+    headers: HeaderMap,
+    body: Bytes,
+) -> Response {
+    let federation = match &server.federation {
+        Some(federation) => federation.clone(),
+        None => return not_found(),
+    };
+    let (repo, repo_path) = match find(&server, &federation, &path) {
+        Some((repo, repo_path, Page::Inbox)) => (repo, repo_path),
+        Some(_) => {
+            return (
+                StatusCode::METHOD_NOT_ALLOWED,
+                "Post activities to the inbox",
+            )
+                .into_response()
+        }
+        None => return not_found(),
+    };
+    if body.len() > MAX_ACTIVITY {
+        return (StatusCode::PAYLOAD_TOO_LARGE, "Activity too large").into_response();
+    }
+    let activity: Value = match serde_json::from_slice(&body) {
+        Ok(activity) => activity,
+        Err(e) => {
+            return (StatusCode::BAD_REQUEST, format!("Invalid activity: {}", e)).into_response()
+        }
+    };
+    let headers: Vec<(String, String)> = headers
+        .iter()
+        .filter_map(|(name, value)| {
+            Some((name.as_str().to_string(), value.to_str().ok()?.to_string()))
+        })
+        .collect();
+    let target = format!("/ap/{}", path);
+
+    let result = tokio::task::spawn_blocking(move || {
+        let sender = federation
+            .verify(&target, &headers, &body)
+            .map_err(|e| (StatusCode::UNAUTHORIZED, e))?;
+        federation
+            .receive(&repo, &repo_path, &sender, &activity)
+            .map_err(|e| (StatusCode::BAD_REQUEST, e))
+    })
+    .await;
+    match result {
+        Ok(Ok(())) => StatusCode::ACCEPTED.into_response(),
+        Ok(Err((status, e))) => {
+            tracing::warn!("Rejected activity for {}: {:#}", path, e);
+            (status, format!("{:#}", e)).into_response()
+        }
+        Err(_) => StatusCode::INTERNAL_SERVER_ERROR.into_response(),
+    }
+}
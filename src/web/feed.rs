@@ -0,0 +1,113 @@
+use super::{embed, html_escape, url_path, WebServer};
+use crate::events::{self, RefUpdate};
+use axum::{
+    http::{header, HeaderMap},
+    response::{IntoResponse, Response},
+};
+use std::collections::HashMap;
+use std::path::PathBuf;
+
+/// Items in a feed
+const FEED_ITEMS: usize = 50;
+
+/// Commits listed in a branch update's item
+const ITEM_COMMITS: usize = 10;
+
+/// RSS feed of pushes to a repository, optionally only to the refs matching
+/// `?refs=<pattern>`: /repo/<name>/feed.rss?refs=tags/v*
+pub fn render(
+    server: &WebServer,
+    headers: &HeaderMap,
+    query: &HashMap<String, String>,
+    repo_name: &str,
+    repo_path: &PathBuf,
+) -> Response {
+    let base = embed::base_url(server, headers);
+    let pattern = query
+        .get("refs")
+        .map(String::as_str)
+        .filter(|p| !p.is_empty());
+    let repo_url = format!("{}/repo/{}", base, url_path(repo_name));
+
+    let mut items = String::new();
+    for event in events::recent(repo_path, pattern, FEED_ITEMS) {
+        items.push_str(&item(repo_name, repo_path, &repo_url, &event));
+    }
+
+    let title = match pattern {
+        Some(pattern) => format!("{} ({})", repo_name, pattern),
+        None => repo_name.to_string(),
+    };
+    let feed_url = format!(
+        "{}/feed.rss{}",
+        repo_url,
+        pattern
+            .map(|p| format!("?refs={}", url_path(p)))
+            .unwrap_or_default()
+    );
+    let xml = format!(
+        r#"<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom">
+<channel>
+<title>{}</title>
+<link>{}</link>
+<atom:link href="{}" rel="self" type="application/rss+xml"/>
+<description>Pushes to {}</description>
+{}</channel>
+</rss>
+"#,
+        html_escape(&title),
+        html_escape(&repo_url),
+        html_escape(&feed_url),
+        html_escape(&title),
+        items
+    );
+    (
+        [(header::CONTENT_TYPE, "application/rss+xml; charset=utf-8")],
+        xml,
+    )
+        .into_response()
+}
+
+fn item(repo_name: &str, repo_path: &PathBuf, repo_url: &str, event: &RefUpdate) -> String {
+    let link = match (event.is_tag(), event.deleted()) {
+        (_, true) => repo_url.to_string(),
+        (true, false) => format!("{}/tag/{}", repo_url, url_path(event.short_name())),
+        (false, false) => format!("{}/log/{}", repo_url, url_path(event.short_name())),
+    };
+
+    let mut description = String::new();
+    if let Some(pusher) = &event.pusher {
+        description.push_str(&format!("<p>Pushed by {}</p>", html_escape(pusher)));
+    }
+    let message = events::tag_message(repo_path, event);
+    if !message.is_empty() {
+        description.push_str(&format!("<pre>{}</pre>", html_escape(&message)));
+    }
+    let commits = events::new_commits(repo_path, event, ITEM_COMMITS);
+    if !commits.is_empty() {
+        description.push_str("<ul>");
+        for (hash, author, subject) in &commits {
+            description.push_str(&format!(
+                "<li><code>{}</code> {} ({})</li>",
+                html_escape(hash),
+                html_escape(subject),
+                html_escape(author)
+            ));
+        }
+        description.push_str("</ul>");
+    }
+
+    let date = chrono::DateTime::from_timestamp(event.time, 0)
+        .map(|t| t.to_rfc2822())
+        .unwrap_or_default();
+    format!(
+        "<item>\n<title>{}</title>\n<link>{}</link>\n<guid isPermaLink=\"false\">{}#{}</guid>\n<pubDate>{}</pubDate>\n<description>{}</description>\n</item>\n",
+        html_escape(&format!("{}: {}", repo_name, event.summary())),
+        html_escape(&link),
+        html_escape(repo_name),
+        event.id,
+        date,
+        html_escape(&description)
+    )
+}
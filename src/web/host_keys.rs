@@ -0,0 +1,63 @@
+use super::{html_escape, render_page, WebServer};
+use crate::host_keys;
+use axum::{
+    extract::State,
+    response::{IntoResponse, Response},
+};
+use std::sync::Arc;
+
+/// The SSH server's host key fingerprints, to check what ssh shows on the
+/// first connection: /host-keys
+pub async fn page(State(server): State<Arc<WebServer>>) -> Response {
+    let breadcrumb = r#"<a href="/">Home</a> / SSH host keys"#;
+    let mut body = String::from("<h1>SSH host keys</h1>\n");
+    let Some(port) = server.clone_urls.ssh_port else {
+        body.push_str("<p>This server doesn't serve SSH.</p>\n");
+        return render_page(&server, "SSH host keys", breadcrumb, &body);
+    };
+    let keys = host_keys::read_all(&server.host_keys);
+    if keys.is_empty() {
+        body.push_str("<p>The SSH server hasn't made its host keys yet.</p>\n");
+        return render_page(&server, "SSH host keys", breadcrumb, &body);
+    }
+    let (host, port) = (&server.clone_urls.host, port.to_string());
+
+    body.push_str(
+        "<p>The first time you connect, ssh shows the server's host key fingerprint and asks whether to trust it. Go ahead only if it is one of these:</p>\n",
+    );
+    body.push_str("<table>\n<tr><th>Type</th><th>Fingerprint</th></tr>\n");
+    for key in &keys {
+        body.push_str(&format!(
+            "<tr><td>{}</td><td><code>{}</code></td></tr>\n",
+            html_escape(&key.algorithm),
+            html_escape(&key.fingerprint)
+        ));
+    }
+    body.push_str("</table>\n");
+
+    let server_arg = match port.as_str() {
+        "22" => host.clone(),
+        port => format!("{}:{}", host, port),
+    };
+    let lines: Vec<String> = keys
+        .iter()
+        .map(|key| key.known_hosts_line(host, &port))
+        .collect();
+    body.push_str(&format!(
+        "<p>Or let <code>agito trust {}</code> fetch the keys, check them against this page and trust them, or add these lines to <code>~/.ssh/known_hosts</code> yourself:</p>\n<pre>{}</pre>\n",
+        html_escape(&server_arg),
+        html_escape(&lines.join("\n"))
+    ));
+
+    render_page(&server, "SSH host keys", breadcrumb, &body)
+}
+
+/// The SSH server's host keys, each with `algorithm`, `fingerprint` and
+/// `public_key`: GET /api/v1/host-keys
+pub async fn api(State(server): State<Arc<WebServer>>) -> Response {
+    let keys = match server.clone_urls.ssh_port {
+        Some(_) => host_keys::read_all(&server.host_keys),
+        None => Vec::new(),
+    };
+    axum::Json(keys).into_response()
+}
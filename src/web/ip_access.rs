@@ -0,0 +1,36 @@
+use super::WebServer;
+use crate::ip_access::Listener;
+use axum::{
+    extract::{ConnectInfo, Request, State},
+    http::StatusCode,
+    middleware::Next,
+    response::{IntoResponse, Response},
+};
+use std::net::{IpAddr, SocketAddr};
+use std::sync::Arc;
+
+/// Answer 403 Forbidden to clients whose address the server's rules refuse.
+/// Behind a trusted proxy, the address is the one it forwards.
+pub async fn middleware(
+    State(server): State<Arc<WebServer>>,
+    req: Request,
+    next: Next,
+) -> Response {
+    let peer = req
+        .extensions()
+        .get::<ConnectInfo<SocketAddr>>()
+        .map(|info| info.0);
+    let remote = server.access_log.remote_addr(req.headers(), peer);
+    let permitted = match remote.parse::<IpAddr>() {
+        Ok(ip) => server.ip_filter.permits(Listener::Http, ip),
+        Err(_) => !server.ip_filter.restricts(Listener::Http),
+    };
+    if !permitted {
+        return (
+            StatusCode::FORBIDDEN,
+            "Access from your address is not allowed\n",
+        )
+            .into_response();
+    }
+    next.run(req).await
+}
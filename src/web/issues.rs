@@ -0,0 +1,603 @@
+use super::auth::current_user;
+use super::notifications;
+use super::settings::error_message;
+use super::{breadcrumb, html_escape, markdown, relative_time, render_page, url_path, WebServer};
+use crate::issues::{self, Filter, Issue, State as IssueState};
+use crate::orgs::Role;
+use axum::{
+    extract::{Path, Query, State},
+    http::StatusCode,
+    response::{IntoResponse, Redirect, Response},
+    Json,
+};
+use serde::Deserialize;
+use std::collections::HashMap;
+use std::path::PathBuf;
+use std::sync::Arc;
+
+fn issues_url(repo_name: &str) -> String {
+    format!("/repo/{}/issues", url_path(repo_name))
+}
+
+/// Whether the signed-in user may edit, close and reopen an issue: its
+/// author, and users with write access to the repository
+fn may_edit(server: &WebServer, repo_path: &PathBuf, issue: &Issue) -> bool {
+    current_user().map_or(false, |user| {
+        user == issue.author || server.has_role(repo_path, Role::Write)
+    })
+}
+
+fn notify_mentions(server: &WebServer, repo_name: &str, issue: &Issue, author: &str, text: &str) {
+    notifications::mentioned(
+        server,
+        repo_name,
+        &format!("#{} {}", issue.number, issue.title),
+        &format!("{}/{}", issues_url(repo_name), issue.number),
+        author,
+        text,
+    );
+}
+
+fn labels_html(repo_name: &str, issue: &Issue) -> String {
+    issue
+        .labels
+        .iter()
+        .map(|label| {
+            format!(
+                " <a class=\"label\" href=\"{}?label={}\">{}</a>",
+                issues_url(repo_name),
+                url_path(label),
+                html_escape(label)
+            )
+        })
+        .collect()
+}
+
+/// Issue list: /repo/<name>/issues?state=open|closed|all&label=<label>&milestone=<title>
+pub fn list_page(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    query: &HashMap<String, String>,
+) -> Response {
+    let state = query.get("state").map(String::as_str).unwrap_or("open");
+    let filter = Filter {
+        state: state.parse().ok(),
+        label: query.get("label").filter(|l| !l.is_empty()).cloned(),
+        milestone: query.get("milestone").filter(|m| !m.is_empty()).cloned(),
+    };
+    let found = match issues::list(repo_path, &filter) {
+        Ok(found) => found,
+        Err(e) => return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    };
+
+    let base = issues_url(repo_name);
+    let label_query = filter
+        .label
+        .as_ref()
+        .map(|l| format!("&label={}", url_path(l)))
+        .unwrap_or_default()
+        + &filter
+            .milestone
+            .as_ref()
+            .map(|m| format!("&milestone={}", url_path(m)))
+            .unwrap_or_default();
+    let mut body = String::from("<h1>Issues</h1>\n<p>");
+    for (name, label) in [("open", "Open"), ("closed", "Closed"), ("all", "All")] {
+        if name == state {
+            body.push_str(&format!("<strong>{}</strong> ", label));
+        } else {
+            body.push_str(&format!(
+                "<a href=\"{}?state={}{}\">{}</a> ",
+                base, name, label_query, label
+            ));
+        }
+    }
+    if current_user().is_some() {
+        body.push_str(&format!("&middot; <a href=\"{}/new\">New issue</a>", base));
+    }
+    body.push_str("</p>\n");
+    if let Some(label) = &filter.label {
+        body.push_str(&format!(
+            "<p>Labeled <span class=\"label\">{}</span> &middot; <a href=\"{}?state={}\">Clear</a></p>\n",
+            html_escape(label),
+            base,
+            state
+        ));
+    }
+    if let Some(milestone) = &filter.milestone {
+        body.push_str(&format!(
+            "<p>In milestone <strong>{}</strong> &middot; <a href=\"{}?state={}\">Clear</a></p>\n",
+            html_escape(milestone),
+            base,
+            state
+        ));
+    }
+
+    if found.is_empty() {
+        body.push_str("<p>No issues.</p>\n");
+    } else {
+        body.push_str("<ul class=\"file-list\">\n");
+        for issue in &found {
+            body.push_str(&format!(
+                "<li class=\"file-item\"><span class=\"state-{}\">{}</span> <a href=\"{}/{}\">{}</a>{} <small>#{} opened {} by {}{}</small></li>\n",
+                issue.state.name(),
+                issue.state.name(),
+                base,
+                issue.number,
+                html_escape(&issue.title),
+                labels_html(repo_name, issue),
+                issue.number,
+                relative_time(issue.created),
+                html_escape(&issue.author),
+                if issue.comments.is_empty() {
+                    String::new()
+                } else {
+                    format!(" &middot; {} comments", issue.comments.len())
+                }
+            ));
+        }
+        body.push_str("</ul>\n");
+    }
+
+    render_page(
+        server,
+        &format!("{} - Issues", repo_name),
+        &breadcrumb(repo_name, &[("Issues".to_string(), None)]),
+        &body,
+    )
+}
+
+/// Form for a new issue: /repo/<name>/issues/new
+pub fn new_page(
+    server: &WebServer,
+    repo_name: &str,
+    form: &HashMap<String, String>,
+    error: Option<&str>,
+) -> Response {
+    if current_user().is_none() {
+        return Redirect::to(&format!("/login?next={}/new", issues_url(repo_name))).into_response();
+    }
+    let field = |key: &str| html_escape(form.get(key).map(String::as_str).unwrap_or(""));
+    let body = format!(
+        "<h1>New issue</h1>\n{}<form method=\"post\" action=\"{}/new\">\n<label>Title<br><input type=\"text\" name=\"title\" size=\"60\" value=\"{}\" required></label><br>\n<label>Description (Markdown)<br><textarea name=\"body\" rows=\"12\" cols=\"80\">{}</textarea></label><br>\n<label>Labels, separated by commas<br><input type=\"text\" name=\"labels\" size=\"40\" value=\"{}\"></label><br>\n<button type=\"submit\">Open issue</button>\n</form>\n",
+        error_message(error),
+        issues_url(repo_name),
+        field("title"),
+        field("body"),
+        field("labels")
+    );
+    render_page(
+        server,
+        &format!("{} - New issue", repo_name),
+        &breadcrumb(
+            repo_name,
+            &[
+                ("Issues".to_string(), Some(issues_url(repo_name))),
+                ("New".to_string(), None),
+            ],
+        ),
+        &body,
+    )
+}
+
+/// Open the issue posted from the new issue form
+pub fn create_form(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    form: &HashMap<String, String>,
+) -> Response {
+    let user = match current_user() {
+        Some(user) => user,
+        None => return (StatusCode::UNAUTHORIZED, "Sign in to open issues").into_response(),
+    };
+    let field = |key: &str| form.get(key).map(String::as_str).unwrap_or("");
+    let created = issues::parse_labels(field("labels"))
+        .and_then(|labels| issues::create(repo_path, &user, field("title"), field("body"), labels));
+    match created {
+        Ok(issue) => {
+            notify_mentions(server, repo_name, &issue, &user, &issue.body);
+            Redirect::to(&format!("{}/{}", issues_url(repo_name), issue.number)).into_response()
+        }
+        Err(e) => new_page(server, repo_name, form, Some(&format!("{:#}", e))),
+    }
+}
+
+/// An issue with its comments: /repo/<name>/issues/<number>
+pub fn issue_page(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    number: u64,
+    error: Option<&str>,
+) -> Response {
+    let issue = match issues::get(repo_path, number) {
+        Ok(Some(issue)) => issue,
+        Ok(None) => return (StatusCode::NOT_FOUND, "Issue not found").into_response(),
+        Err(e) => return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    };
+    let action = format!("{}/{}", issues_url(repo_name), number);
+    let editable = may_edit(server, repo_path, &issue);
+
+    let mut body = format!(
+        "<h1>{} <small>#{}</small></h1>\n<p><span class=\"state-{}\">{}</span>{} &middot; opened {} by {}{}{}</p>\n",
+        html_escape(&issue.title),
+        issue.number,
+        issue.state.name(),
+        issue.state.name(),
+        labels_html(repo_name, &issue),
+        relative_time(issue.created),
+        html_escape(&issue.author),
+        issue
+            .closed_by
+            .as_ref()
+            .map(|by| format!(" &middot; closed by {}", html_escape(by)))
+            .unwrap_or_default(),
+        issue
+            .milestone
+            .as_ref()
+            .map(|milestone| format!(
+                " &middot; milestone <a href=\"{}?state=all&milestone={}\">{}</a>",
+                issues_url(repo_name),
+                url_path(milestone),
+                html_escape(milestone)
+            ))
+            .unwrap_or_default()
+    );
+    body.push_str(&error_message(error));
+
+    let comment_html = |author: &str, created: i64, text: &str| {
+        format!(
+            "<div class=\"comment\"><div class=\"comment-header\"><strong>{}</strong> {}</div><div class=\"comment-body\">{}</div></div>\n",
+            html_escape(author),
+            relative_time(created),
+            if text.trim().is_empty() {
+                "<p><em>No description.</em></p>".to_string()
+            } else {
+                markdown::render(text)
+            }
+        )
+    };
+    body.push_str(&comment_html(&issue.author, issue.created, &issue.body));
+    for comment in &issue.comments {
+        body.push_str(&comment_html(
+            &comment.author,
+            comment.created,
+            &comment.body,
+        ));
+    }
+
+    if current_user().is_some() {
+        body.push_str(&format!(
+            "<form method=\"post\" action=\"{}\">\n<input type=\"hidden\" name=\"action\" value=\"comment\">\n<textarea name=\"body\" rows=\"6\" cols=\"80\" placeholder=\"Leave a comment (Markdown)\"></textarea><br>\n<button type=\"submit\">Comment</button>\n</form>\n",
+            action
+        ));
+    } else {
+        body.push_str(&format!(
+            "<p><a href=\"/login?next={}\">Sign in</a> to comment.</p>\n",
+            url_path(&action)
+        ));
+    }
+
+    if editable {
+        let (next, label) = match issue.state {
+            IssueState::Open => ("close", "Close issue"),
+            IssueState::Closed => ("reopen", "Reopen issue"),
+        };
+        body.push_str(&format!(
+            "<form method=\"post\" action=\"{0}\"><input type=\"hidden\" name=\"action\" value=\"{1}\"><button type=\"submit\">{2}</button></form>\n<h2>Edit</h2>\n<form method=\"post\" action=\"{0}\">\n<input type=\"hidden\" name=\"action\" value=\"edit\">\n<label>Title<br><input type=\"text\" name=\"title\" size=\"60\" value=\"{3}\" required></label><br>\n<label>Description<br><textarea name=\"body\" rows=\"8\" cols=\"80\">{4}</textarea></label><br>\n<label>Labels<br><input type=\"text\" name=\"labels\" size=\"40\" value=\"{5}\"></label><br>\n<button type=\"submit\">Save</button>\n</form>\n",
+            action,
+            next,
+            label,
+            html_escape(&issue.title),
+            html_escape(&issue.body),
+            html_escape(&issue.labels.iter().cloned().collect::<Vec<_>>().join(", "))
+        ));
+    }
+
+    render_page(
+        server,
+        &format!("{} - #{} {}", repo_name, issue.number, issue.title),
+        &breadcrumb(
+            repo_name,
+            &[
+                ("Issues".to_string(), Some(issues_url(repo_name))),
+                (format!("#{}", issue.number), None),
+            ],
+        ),
+        &body,
+    )
+}
+
+/// Comment on, close, reopen or edit an issue from its page
+pub fn save_form(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    number: u64,
+    form: &HashMap<String, String>,
+) -> Response {
+    let user = match current_user() {
+        Some(user) => user,
+        None => {
+            return (StatusCode::UNAUTHORIZED, "Sign in to take part in issues").into_response()
+        }
+    };
+    let field = |key: &str| form.get(key).map(String::as_str).unwrap_or("");
+    let change = Change {
+        title: Some(field("title").to_string()).filter(|_| form.contains_key("title")),
+        body: Some(field("body").to_string()).filter(|_| form.contains_key("body")),
+        labels: Some(field("labels").to_string()).filter(|_| form.contains_key("labels")),
+        state: None,
+    };
+    let result = match field("action") {
+        "comment" => comment(server, repo_name, repo_path, number, &user, field("body")),
+        "close" => apply(
+            server,
+            repo_name,
+            repo_path,
+            number,
+            &user,
+            Change::state(IssueState::Closed),
+        ),
+        "reopen" => apply(
+            server,
+            repo_name,
+            repo_path,
+            number,
+            &user,
+            Change::state(IssueState::Open),
+        ),
+        "edit" => apply(server, repo_name, repo_path, number, &user, change),
+        action => Err(Failure::Invalid(format!("Unknown action '{}'", action))),
+    };
+    match result {
+        Ok(_) => Redirect::to(&format!("{}/{}", issues_url(repo_name), number)).into_response(),
+        Err(Failure::Invalid(e)) => issue_page(server, repo_name, repo_path, number, Some(&e)),
+        Err(failure) => failure.into_response(),
+    }
+}
+
+/// Changes to an issue, from the edit form or the API
+#[derive(Default, Deserialize)]
+pub struct Change {
+    title: Option<String>,
+    body: Option<String>,
+    /// Comma-separated in forms; the API takes a list
+    #[serde(default, deserialize_with = "labels_list")]
+    labels: Option<String>,
+    state: Option<String>,
+}
+
+impl Change {
+    fn state(state: IssueState) -> Self {
+        Self {
+            state: Some(state.name().to_string()),
+            ..Default::default()
+        }
+    }
+}
+
+fn labels_list<'de, D: serde::Deserializer<'de>>(d: D) -> Result<Option<String>, D::Error> {
+    Option::<Vec<String>>::deserialize(d).map(|labels| labels.map(|l| l.join(",")))
+}
+
+/// Why an issue could not be changed
+enum Failure {
+    NotFound,
+    Forbidden,
+    /// The change itself is wrong; shown to the user
+    Invalid(String),
+    Internal(String),
+}
+
+impl IntoResponse for Failure {
+    fn into_response(self) -> Response {
+        match self {
+            Failure::NotFound => (StatusCode::NOT_FOUND, "Issue not found".to_string()),
+            Failure::Forbidden => (
+                StatusCode::FORBIDDEN,
+                "Only the issue's author and users with write access may change it".to_string(),
+            ),
+            Failure::Invalid(e) => (StatusCode::UNPROCESSABLE_ENTITY, e),
+            Failure::Internal(e) => (StatusCode::INTERNAL_SERVER_ERROR, e),
+        }
+        .into_response()
+    }
+}
+
+fn load(repo_path: &PathBuf, number: u64) -> Result<Issue, Failure> {
+    match issues::get(repo_path, number) {
+        Ok(Some(issue)) => Ok(issue),
+        Ok(None) => Err(Failure::NotFound),
+        Err(e) => Err(Failure::Internal(e.to_string())),
+    }
+}
+
+fn comment(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    number: u64,
+    user: &str,
+    text: &str,
+) -> Result<Issue, Failure> {
+    load(repo_path, number)?;
+    let issue = issues::update(repo_path, number, |issue| issue.comment(user, text))
+        .map_err(|e| Failure::Invalid(format!("{:#}", e)))?;
+    notify_mentions(server, repo_name, &issue, user, text);
+    Ok(issue)
+}
+
+fn apply(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    number: u64,
+    user: &str,
+    change: Change,
+) -> Result<Issue, Failure> {
+    let issue = load(repo_path, number)?;
+    if !may_edit(server, repo_path, &issue) {
+        return Err(Failure::Forbidden);
+    }
+    let state = change
+        .state
+        .as_deref()
+        .map(str::parse::<IssueState>)
+        .transpose()
+        .map_err(Failure::Invalid)?;
+    let new_body = change.body.clone();
+    let issue = issues::update(repo_path, number, |issue| {
+        if let Some(title) = &change.title {
+            issue.set_title(title)?;
+        }
+        if let Some(body) = &change.body {
+            issue.body = body.trim_end().to_string();
+        }
+        if let Some(labels) = &change.labels {
+            issue.set_labels(labels)?;
+        }
+        if let Some(state) = state {
+            issue.set_state(state, user);
+        }
+        Ok(())
+    })
+    .map_err(|e| Failure::Invalid(format!("{:#}", e)))?;
+    if let Some(body) = new_body {
+        notify_mentions(server, repo_name, &issue, user, &body);
+    }
+    Ok(issue)
+}
+
+/// GET /api/v1/repos/<name>/issues?state=open|closed|all&label=<label>&milestone=<title>
+pub async fn api_list(
+    State(server): State<Arc<WebServer>>,
+    Path(repo_name): Path<String>,
+    Query(query): Query<HashMap<String, String>>,
+) -> Response {
+    let repo_path = match server.resolve_repo(&repo_name) {
+        Some((_, path)) => path,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    let filter = Filter {
+        state: match query.get("state").map(String::as_str) {
+            None => Some(IssueState::Open),
+            Some("all") => None,
+            Some(state) => match state.parse() {
+                Ok(state) => Some(state),
+                Err(e) => return (StatusCode::BAD_REQUEST, e).into_response(),
+            },
+        },
+        label: query.get("label").cloned(),
+        milestone: query.get("milestone").cloned(),
+    };
+    match issues::list(&repo_path, &filter) {
+        Ok(found) => Json(found).into_response(),
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
+
+#[derive(Deserialize)]
+pub struct NewIssue {
+    title: String,
+    #[serde(default)]
+    body: String,
+    #[serde(default)]
+    labels: Vec<String>,
+}
+
+/// POST /api/v1/repos/<name>/issues with `{"title": ..., "body": ..., "labels": [...]}`
+pub async fn api_create(
+    State(server): State<Arc<WebServer>>,
+    Path(repo_name): Path<String>,
+    Json(request): Json<NewIssue>,
+) -> Response {
+    let (repo_name, repo_path) = match server.resolve_repo(&repo_name) {
+        Some(found) => found,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    let user = match current_user() {
+        Some(user) => user,
+        None => return (StatusCode::UNAUTHORIZED, "Sign in to open issues").into_response(),
+    };
+    let created = issues::parse_labels(&request.labels.join(",")).and_then(|labels| {
+        issues::create(&repo_path, &user, &request.title, &request.body, labels)
+    });
+    match created {
+        Ok(issue) => {
+            notify_mentions(&server, &repo_name, &issue, &user, &issue.body);
+            (StatusCode::CREATED, Json(issue)).into_response()
+        }
+        Err(e) => (StatusCode::UNPROCESSABLE_ENTITY, format!("{:#}", e)).into_response(),
+    }
+}
+
+/// GET /api/v1/repos/<name>/issues/<number>
+pub async fn api_get(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, number)): Path<(String, u64)>,
+) -> Response {
+    let repo_path = match server.resolve_repo(&repo_name) {
+        Some((_, path)) => path,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    match load(&repo_path, number) {
+        Ok(issue) => Json(issue).into_response(),
+        Err(failure) => failure.into_response(),
+    }
+}
+
+/// PATCH /api/v1/repos/<name>/issues/<number> with any of `title`, `body`,
+/// `labels` and `state` (open or closed)
+pub async fn api_update(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, number)): Path<(String, u64)>,
+    Json(change): Json<Change>,
+) -> Response {
+    let (repo_name, repo_path) = match server.resolve_repo(&repo_name) {
+        Some(found) => found,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    let user = match current_user() {
+        Some(user) => user,
+        None => return (StatusCode::UNAUTHORIZED, "Sign in to change issues").into_response(),
+    };
+    match apply(&server, &repo_name, &repo_path, number, &user, change) {
+        Ok(issue) => Json(issue).into_response(),
+        Err(failure) => failure.into_response(),
+    }
+}
+
+#[derive(Deserialize)]
+pub struct NewComment {
+    body: String,
+}
+
+/// POST /api/v1/repos/<name>/issues/<number>/comments with `{"body": ...}`
+pub async fn api_comment(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, number)): Path<(String, u64)>,
+    Json(request): Json<NewComment>,
+) -> Response {
+    let (repo_name, repo_path) = match server.resolve_repo(&repo_name) {
+        Some(found) => found,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    let user = match current_user() {
+        Some(user) => user,
+        None => return (StatusCode::UNAUTHORIZED, "Sign in to comment").into_response(),
+    };
+    match comment(
+        &server,
+        &repo_name,
+        &repo_path,
+        number,
+        &user,
+        &request.body,
+    ) {
+        Ok(issue) => (StatusCode::CREATED, Json(issue)).into_response(),
+        Err(failure) => failure.into_response(),
+    }
+}
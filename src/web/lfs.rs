@@ -0,0 +1,465 @@
+use super::{embed, url_path, WebServer};
+use crate::git;
+use crate::lfs::{self, Operation};
+use crate::orgs::Role;
+use axum::{
+    body::{Body, Bytes},
+    extract::{Path, State},
+    http::{header, HeaderMap, StatusCode},
+    response::{IntoResponse, Response},
+    routing::{get, post},
+    Router,
+};
+use futures::StreamExt;
+use serde::Deserialize;
+use sha2::{Digest, Sha256};
+use std::path::PathBuf;
+use std::sync::Arc;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+
+const LFS_JSON: &str = "application/vnd.git-lfs+json";
+
+/// The LFS endpoints of top-level repositories and of those in a namespace,
+/// like the smart HTTP ones
+pub fn routes() -> Router<Arc<WebServer>> {
+    Router::new()
+        .route("/:repo/info/lfs/objects/batch", post(batch))
+        .route("/:repo/info/lfs/objects/:oid", get(download).put(upload))
+        .route("/:repo/:name/info/lfs/objects/batch", post(batch))
+        .route(
+            "/:repo/:name/info/lfs/objects/:oid",
+            get(download).put(upload),
+        )
+}
+
+/// The repository a route names, `<repo>` or `<namespace>/<repo>`, and the
+/// object id if it names one
+fn route_params(params: &[(String, String)]) -> (String, &str) {
+    let repo = params
+        .iter()
+        .filter(|(key, _)| key != "oid")
+        .map(|(_, value)| value.as_str())
+        .collect::<Vec<_>>()
+        .join("/");
+    let oid = params
+        .iter()
+        .find(|(key, _)| key == "oid")
+        .map_or("", |(_, value)| value.as_str());
+    (repo, oid)
+}
+
+#[derive(Deserialize)]
+struct BatchRequest {
+    operation: String,
+    #[serde(default)]
+    transfers: Vec<String>,
+    #[serde(default)]
+    hash_algo: Option<String>,
+    #[serde(default)]
+    objects: Vec<Pointer>,
+}
+
+#[derive(Deserialize)]
+struct Pointer {
+    oid: String,
+    size: u64,
+}
+
+fn json(status: StatusCode, body: serde_json::Value) -> Response {
+    (status, [(header::CONTENT_TYPE, LFS_JSON)], body.to_string()).into_response()
+}
+
+fn error(status: StatusCode, message: &str) -> Response {
+    json(status, serde_json::json!({ "message": message }))
+}
+
+/// The `RemoteAuth` token handed out by `git-lfs-authenticate` over SSH
+fn token(headers: &HeaderMap) -> Option<&str> {
+    headers
+        .get(header::AUTHORIZATION)
+        .and_then(|value| value.to_str().ok())
+        .and_then(|value| value.strip_prefix("RemoteAuth "))
+        .map(|token| token.trim())
+}
+
+/// Downloads are open to whoever may read the repository; uploads need a
+/// token from SSH or a signed-in user with write access
+fn authorize(
+    server: &WebServer,
+    headers: &HeaderMap,
+    repo: &str,
+    repo_path: &PathBuf,
+    operation: Operation,
+) -> Result<(), Response> {
+    let allowed = match token(headers) {
+        Some(token) => server
+            .lfs_tokens
+            .as_ref()
+            .map_or(false, |tokens| tokens.verify(repo, operation, token)),
+        None => operation == Operation::Download || server.has_role(repo_path, Role::Write),
+    };
+    if allowed {
+        Ok(())
+    } else {
+        Err(error(
+            StatusCode::UNAUTHORIZED,
+            "Authenticate over SSH with git-lfs-authenticate to upload",
+        ))
+    }
+}
+
+/// The repository's current name and directory. Old names are resolved
+/// rather than redirected, as git-lfs would not resend upload bodies.
+/// Clients with a token from SSH find private repositories too; [`authorize`]
+/// checks the token.
+fn resolve(
+    server: &WebServer,
+    headers: &HeaderMap,
+    repo: &str,
+) -> Result<(String, PathBuf), Response> {
+    let found = match token(headers) {
+        Some(_) => server
+            .resolver
+            .resolve(repo)
+            .map(|name| (server.repos_dir.join(&name), name))
+            .filter(|(path, _)| git::is_repository(path))
+            .map(|(path, name)| (name, path)),
+        None => server.resolve_repo(repo),
+    };
+    found.ok_or_else(|| error(StatusCode::NOT_FOUND, "Repository not found"))
+}
+
+/// POST /<repo>.git/info/lfs/objects/batch: tell the client where to
+/// transfer each object, using the basic transfer adapter
+pub async fn batch(
+    State(server): State<Arc<WebServer>>,
+    Path(params): Path<Vec<(String, String)>>,
+    headers: HeaderMap,
+    body: Bytes,
+) -> Response {
+    let (repo, _) = route_params(&params);
+    let (repo, repo_path) = match resolve(&server, &headers, &repo) {
+        Ok(found) => found,
+        Err(response) => return response,
+    };
+    let request: BatchRequest = match serde_json::from_slice(&body) {
+        Ok(request) => request,
+        Err(e) => {
+            return error(
+                StatusCode::UNPROCESSABLE_ENTITY,
+                &format!("Invalid batch request: {}", e),
+            )
+        }
+    };
+    let operation: Operation = match request.operation.parse() {
+        Ok(operation) => operation,
+        Err(e) => return error(StatusCode::UNPROCESSABLE_ENTITY, &e),
+    };
+    if let Err(response) = authorize(&server, &headers, &repo, &repo_path, operation) {
+        return response;
+    }
+    if request
+        .hash_algo
+        .as_deref()
+        .map_or(false, |algo| algo != "sha256")
+    {
+        return error(StatusCode::CONFLICT, "Only sha256 object ids are supported");
+    }
+    if !request.transfers.is_empty() && !request.transfers.iter().any(|t| t == "basic") {
+        return error(
+            StatusCode::UNPROCESSABLE_ENTITY,
+            "Only the basic transfer adapter is supported",
+        );
+    }
+
+    // Transfers reuse the caller's token, valid as long as the one from SSH
+    let action = |oid: &str| {
+        let mut action = serde_json::json!({
+            "href": format!(
+                "{}/{}/info/lfs/objects/{}",
+                embed::base_url(&server, &headers),
+                url_path(&repo),
+                oid
+            ),
+            "expires_in": lfs::TOKEN_TTL,
+        });
+        if let Some(token) = token(&headers) {
+            action["header"] =
+                serde_json::json!({ "Authorization": format!("RemoteAuth {}", token) });
+        }
+        action
+    };
+
+    let mut objects = Vec::new();
+    let mut upload_bytes = 0;
+    for pointer in &request.objects {
+        let mut object = serde_json::json!({ "oid": pointer.oid, "size": pointer.size });
+        if !lfs::valid_oid(&pointer.oid) {
+            object["error"] = serde_json::json!({ "code": 422, "message": "Invalid object id" });
+            objects.push(object);
+            continue;
+        }
+
+        let stored = tokio::fs::metadata(lfs::object_path(&repo_path, &pointer.oid))
+            .await
+            .map(|metadata| metadata.len() == pointer.size)
+            .unwrap_or(false);
+        match (operation, stored) {
+            (Operation::Download, true) => {
+                object["actions"] = serde_json::json!({ "download": action(&pointer.oid) });
+            }
+            (Operation::Download, false) => {
+                object["error"] =
+                    serde_json::json!({ "code": 404, "message": "Object does not exist" });
+            }
+            (Operation::Upload, true) => {}
+            (Operation::Upload, false) => {
+                upload_bytes += pointer.size;
+                object["actions"] = serde_json::json!({ "upload": action(&pointer.oid) });
+            }
+        }
+        objects.push(object);
+    }
+
+    if upload_bytes > 0 {
+        let quotas = server.quotas.clone();
+        let path = repo_path.clone();
+        if let Ok(Ok(mut status)) = tokio::task::spawn_blocking(move || quotas.status(&path)).await
+        {
+            status.repo_bytes += upload_bytes;
+            status.user_bytes += upload_bytes;
+            if let Some(reason) = status.exceeded() {
+                return error(StatusCode::INSUFFICIENT_STORAGE, &reason);
+            }
+        }
+    }
+
+    json(
+        StatusCode::OK,
+        serde_json::json!({
+            "transfer": "basic",
+            "objects": objects,
+            "hash_algo": "sha256",
+        }),
+    )
+}
+
+/// GET /<repo>.git/info/lfs/objects/<oid>: stream a stored object
+pub async fn download(
+    State(server): State<Arc<WebServer>>,
+    Path(params): Path<Vec<(String, String)>>,
+    headers: HeaderMap,
+) -> Response {
+    let (repo, oid) = route_params(&params);
+    let (repo, repo_path) = match resolve(&server, &headers, &repo) {
+        Ok(found) => found,
+        Err(response) => return response,
+    };
+    if let Err(response) = authorize(&server, &headers, &repo, &repo_path, Operation::Download) {
+        return response;
+    }
+    if !lfs::valid_oid(&oid) {
+        return error(StatusCode::UNPROCESSABLE_ENTITY, "Invalid object id");
+    }
+
+    let file = match tokio::fs::File::open(lfs::object_path(&repo_path, &oid)).await {
+        Ok(file) => file,
+        Err(_) => return error(StatusCode::NOT_FOUND, "Object does not exist"),
+    };
+    let len = match file.metadata().await {
+        Ok(metadata) => metadata.len(),
+        Err(_) => return error(StatusCode::INTERNAL_SERVER_ERROR, "Failed to read object"),
+    };
+
+    let stream = futures::stream::unfold(file, |mut file| async move {
+        let mut buf = vec![0u8; 64 * 1024];
+        match file.read(&mut buf).await {
+            Ok(0) => None,
+            Ok(n) => {
+                buf.truncate(n);
+                Some((Ok::<_, std::io::Error>(Bytes::from(buf)), file))
+            }
+            Err(e) => Some((Err(e), file)),
+        }
+    });
+
+    (
+        [
+            (header::CONTENT_TYPE, "application/octet-stream".to_string()),
+            (header::CONTENT_LENGTH, len.to_string()),
+        ],
+        Body::from_stream(stream),
+    )
+        .into_response()
+}
+
+/// PUT /<repo>.git/info/lfs/objects/<oid>: store an object, keeping it only
+/// if its content matches the oid
+pub async fn upload(
+    State(server): State<Arc<WebServer>>,
+    Path(params): Path<Vec<(String, String)>>,
+    headers: HeaderMap,
+    body: Body,
+) -> Response {
+    let (repo, oid) = route_params(&params);
+    let (repo, repo_path) = match resolve(&server, &headers, &repo) {
+        Ok(found) => found,
+        Err(response) => return response,
+    };
+    if let Err(response) = authorize(&server, &headers, &repo, &repo_path, Operation::Upload) {
+        return response;
+    }
+    if !lfs::valid_oid(&oid) {
+        return error(StatusCode::UNPROCESSABLE_ENTITY, "Invalid object id");
+    }
+
+    let tmp_dir = lfs::tmp_dir(&repo_path);
+    let tmp = tmp_dir.join(format!(
+        "{}-{}",
+        oid,
+        chrono::Utc::now().timestamp_nanos_opt().unwrap_or_default()
+    ));
+    let result = receive(&tmp_dir, &tmp, body).await;
+    let digest = match result {
+        Ok(digest) => digest,
+        Err(e) => {
+            let _ = tokio::fs::remove_file(&tmp).await;
+            tracing::warn!("LFS upload of {} to {} failed: {}", oid, repo, e);
+            return error(StatusCode::INTERNAL_SERVER_ERROR, "Failed to store object");
+        }
+    };
+    if digest != oid {
+        let _ = tokio::fs::remove_file(&tmp).await;
+        return error(
+            StatusCode::UNPROCESSABLE_ENTITY,
+            "Object content does not match its oid",
+        );
+    }
+
+    let path = lfs::object_path(&repo_path, &oid);
+    let stored = async {
+        if let Some(parent) = path.parent() {
+            tokio::fs::create_dir_all(parent).await?;
+        }
+        tokio::fs::rename(&tmp, &path).await
+    };
+    if let Err(e) = stored.await {
+        let _ = tokio::fs::remove_file(&tmp).await;
+        tracing::warn!("Failed to store LFS object {} in {}: {}", oid, repo, e);
+        return error(StatusCode::INTERNAL_SERVER_ERROR, "Failed to store object");
+    }
+
+    let disk_usage = server.disk_usage.clone();
+    tokio::task::spawn_blocking(move || disk_usage.refresh_repo(&repo, &repo_path));
+
+    StatusCode::OK.into_response()
+}
+
+/// Write the request body to `tmp`, returning the hex SHA-256 of its content
+async fn receive(tmp_dir: &PathBuf, tmp: &PathBuf, body: Body) -> anyhow::Result<String> {
+    tokio::fs::create_dir_all(tmp_dir).await?;
+    let mut file = tokio::fs::File::create(tmp).await?;
+    let mut hasher = Sha256::new();
+    let mut stream = body.into_data_stream();
+    while let Some(chunk) = stream.next().await {
+        let chunk = chunk?;
+        hasher.update(&chunk);
+        file.write_all(&chunk).await?;
+    }
+    file.flush().await?;
+    Ok(hasher
+        .finalize()
+        .iter()
+        .map(|b| format!("{:02x}", b))
+        .collect())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use axum::http::{Method, Request};
+    use std::fs;
+    use std::process::Command;
+    use tower::ServiceExt;
+
+    async fn send(
+        app: &Router,
+        method: Method,
+        uri: &str,
+        token: &str,
+        body: impl Into<Body>,
+    ) -> (StatusCode, Bytes) {
+        let request = Request::builder()
+            .method(method)
+            .uri(uri)
+            .header(header::AUTHORIZATION, format!("RemoteAuth {}", token))
+            .body(body.into())
+            .unwrap();
+        let response = app.clone().oneshot(request).await.unwrap();
+        let status = response.status();
+        let body = axum::body::to_bytes(response.into_body(), usize::MAX)
+            .await
+            .unwrap();
+        (status, body)
+    }
+
+    #[tokio::test]
+    async fn pushes_objects_to_namespaced_repositories() {
+        let dir = std::env::temp_dir().join(format!("agito-lfs-{}", std::process::id()));
+        let repo_path = dir.join("repos").join("alice").join("project.git");
+        fs::create_dir_all(&repo_path).unwrap();
+        let status = Command::new("git")
+            .args(["init", "--quiet", "--bare"])
+            .arg(&repo_path)
+            .status()
+            .unwrap();
+        assert!(status.success());
+
+        let tokens = lfs::Tokens::load_or_create(&dir).unwrap();
+        let token = tokens.issue("alice/project.git", Operation::Upload);
+        let server = WebServer::new(dir.join("repos"))
+            .with_data_dir(dir.clone())
+            .with_lfs_tokens(tokens);
+        let app = routes().with_state(Arc::new(server));
+
+        let content: &'static [u8] = b"a large file\n";
+        let oid: String = Sha256::digest(content)
+            .iter()
+            .map(|b| format!("{:02x}", b))
+            .collect();
+        let objects = "/alice/project.git/info/lfs/objects";
+
+        let request = serde_json::json!({
+            "operation": "upload",
+            "objects": [{ "oid": oid, "size": content.len() }],
+        });
+        let (status, body) = send(
+            &app,
+            Method::POST,
+            &format!("{}/batch", objects),
+            &token,
+            request.to_string(),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+        let reply: serde_json::Value = serde_json::from_slice(&body).unwrap();
+        let href = reply["objects"][0]["actions"]["upload"]["href"]
+            .as_str()
+            .unwrap();
+        assert!(href.ends_with(&format!("{}/{}", objects, oid)), "{}", href);
+
+        let url = format!("{}/{}", objects, oid);
+        let (status, _) = send(&app, Method::PUT, &url, &token, content).await;
+        assert_eq!(status, StatusCode::OK);
+        assert_eq!(
+            fs::read(lfs::object_path(&repo_path, &oid)).unwrap(),
+            content
+        );
+
+        let (status, body) = send(&app, Method::GET, &url, &token, Body::empty()).await;
+        assert_eq!(status, StatusCode::OK);
+        assert_eq!(&body[..], content);
+
+        let _ = fs::remove_dir_all(&dir);
+    }
+}
@@ -0,0 +1,43 @@
+use crate::glob::glob_match;
+
+/// Name endings of directories that only hold work in progress: interrupted
+/// imports and clones, or objects quarantined until a push is accepted
+const TEMPORARY_SUFFIXES: &[&str] = &[".tmp", ".partial", ".lock"];
+const TEMPORARY_PREFIXES: &[&str] = &["tmp_", "tmp-", "incoming-", "quarantine-"];
+
+/// Repositories that back another one rather than being browsed on their own:
+/// wikis (`<name>.wiki.git`) and object pools shared by forks (`<name>.pool.git`)
+const INTERNAL_SUFFIXES: &[&str] = &[".wiki.git", ".wiki", ".pool.git"];
+
+/// Which repositories the index and sitemap show. Hidden repositories are
+/// still served to anyone who knows their name.
+#[derive(Clone, Debug, Default)]
+pub struct Listing {
+    /// Glob patterns (`*` and `?`) of names to show; empty shows all
+    pub allow: Vec<String>,
+    /// Glob patterns of names never shown, even when allowed
+    pub deny: Vec<String>,
+}
+
+impl Listing {
+    /// Whether a repository named `name` relative to the repositories
+    /// directory belongs in listings
+    pub fn shows(&self, name: &str) -> bool {
+        if internal(name) {
+            return false;
+        }
+        let allowed = self.allow.is_empty() || self.allow.iter().any(|p| glob_match(p, name));
+        allowed && !self.deny.iter().any(|p| glob_match(p, name))
+    }
+}
+
+/// Hidden directories, temporary directories and internal repositories,
+/// which are never listed
+fn internal(name: &str) -> bool {
+    name.split('/').any(|part| {
+        part.starts_with('.')
+            || TEMPORARY_SUFFIXES.iter().any(|s| part.ends_with(s))
+            || TEMPORARY_PREFIXES.iter().any(|p| part.starts_with(p))
+            || INTERNAL_SUFFIXES.iter().any(|s| part.ends_with(s))
+    })
+}
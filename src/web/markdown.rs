@@ -0,0 +1,214 @@
+//! Markdown as written in issues and comments, and in repositories' READMEs,
+//! rendered to HTML.
+//!
+//! Users' HTML is shown as text rather than passed through, links only keep
+//! web and mail URLs, and images become links to them, so that viewing a
+//! page neither runs scripts nor tells a third party who is looking. In a
+//! file from a repository, relative links go to the files they name, and
+//! relative images are shown, as this server serves them.
+
+use super::resolve::percent_decode;
+use super::{html_escape, url_path};
+use pulldown_cmark::{CodeBlockKind, Event, Options, Parser, Tag, TagEnd};
+
+/// Where a Markdown file is in a repository, which its relative links and
+/// images are resolved against
+pub struct Location<'a> {
+    pub repo_name: &'a str,
+    pub rev: &'a str,
+    /// Directory the file is in, empty at the top
+    pub dir: &'a str,
+}
+
+impl Location<'_> {
+    /// The page showing what a relative URL names in the repository, as
+    /// `view` (`blob` or `raw`) shows it; None for other URLs
+    fn resolve(&self, url: &str, view: &str) -> Option<String> {
+        let url = url.trim();
+        if url.is_empty() || url.starts_with(['/', '#', '?']) || scheme(url).is_some() {
+            return None;
+        }
+        let end = url.find(['?', '#']).unwrap_or(url.len());
+        let (path, suffix) = url.split_at(end);
+        let path = percent_decode(path).unwrap_or_else(|| path.to_string());
+        let mut segments: Vec<&str> = self.dir.split('/').filter(|s| !s.is_empty()).collect();
+        for segment in path.split('/') {
+            match segment {
+                "" | "." => {}
+                ".." => {
+                    segments.pop();
+                }
+                segment => segments.push(segment),
+            }
+        }
+        Some(format!(
+            "/repo/{}/{}/{}/{}{}",
+            url_path(self.repo_name),
+            view,
+            url_path(self.rev),
+            url_path(&segments.join("/")),
+            suffix
+        ))
+    }
+}
+
+/// Render Markdown to HTML that is safe to embed in a page
+pub fn render(text: &str) -> String {
+    render_at(text, None)
+}
+
+/// Render a Markdown file from a repository, such as a README
+pub fn render_file(text: &str, location: &Location) -> String {
+    render_at(text, Some(location))
+}
+
+fn render_at(text: &str, location: Option<&Location>) -> String {
+    let options =
+        Options::ENABLE_TABLES | Options::ENABLE_STRIKETHROUGH | Options::ENABLE_TASKLISTS;
+    let mut html = String::with_capacity(text.len() * 3 / 2);
+    // Links can't nest, so images inside them are left as their alt text
+    let mut in_link = false;
+    let mut image_link = Vec::new();
+    let mut in_table_head = false;
+    // The source and alt text of an image from the repository being shown
+    let mut image: Option<(String, String)> = None;
+
+    for event in Parser::new_ext(text, options) {
+        if let Some((_, alt)) = image.as_mut() {
+            match &event {
+                Event::Text(text) | Event::Code(text) => {
+                    alt.push_str(text);
+                    continue;
+                }
+                Event::End(TagEnd::Image) => {}
+                _ => continue,
+            }
+        }
+        match event {
+            Event::Start(tag) => match tag {
+                Tag::Paragraph => html.push_str("<p>"),
+                Tag::Heading { level, .. } => html.push_str(&format!("<{}>", level)),
+                Tag::BlockQuote(_) => html.push_str("<blockquote>\n"),
+                Tag::CodeBlock(CodeBlockKind::Fenced(lang)) if !lang.is_empty() => {
+                    html.push_str(&format!(
+                        "<pre><code class=\"language-{}\">",
+                        html_escape(lang.split_whitespace().next().unwrap_or(""))
+                    ))
+                }
+                Tag::CodeBlock(_) => html.push_str("<pre><code>"),
+                Tag::HtmlBlock => html.push_str("<p>"),
+                Tag::List(Some(1)) => html.push_str("<ol>\n"),
+                Tag::List(Some(start)) => html.push_str(&format!("<ol start=\"{}\">\n", start)),
+                Tag::List(None) => html.push_str("<ul>\n"),
+                Tag::Item => html.push_str("<li>"),
+                Tag::Table(_) => html.push_str("<table>\n"),
+                Tag::TableHead => {
+                    in_table_head = true;
+                    html.push_str("<tr>");
+                }
+                Tag::TableRow => html.push_str("<tr>"),
+                Tag::TableCell => html.push_str(if in_table_head { "<th>" } else { "<td>" }),
+                Tag::Emphasis => html.push_str("<em>"),
+                Tag::Strong => html.push_str("<strong>"),
+                Tag::Strikethrough => html.push_str("<del>"),
+                Tag::Link {
+                    dest_url, title, ..
+                } => {
+                    in_link = true;
+                    let url = location
+                        .and_then(|location| location.resolve(&dest_url, "blob"))
+                        .unwrap_or_else(|| safe_url(&dest_url));
+                    html.push_str(&format!("<a href=\"{}\"", html_escape(&url)));
+                    if !title.is_empty() {
+                        html.push_str(&format!(" title=\"{}\"", html_escape(&title)));
+                    }
+                    html.push_str(" rel=\"nofollow\">");
+                }
+                Tag::Image { dest_url, .. } => {
+                    if let Some(src) =
+                        location.and_then(|location| location.resolve(&dest_url, "raw"))
+                    {
+                        image = Some((src, String::new()));
+                        continue;
+                    }
+                    image_link.push(!in_link);
+                    if !in_link {
+                        html.push_str(&format!(
+                            "<a href=\"{}\" rel=\"nofollow\">",
+                            html_escape(&safe_url(&dest_url))
+                        ));
+                    }
+                }
+                _ => {}
+            },
+            Event::End(tag) => match tag {
+                TagEnd::Paragraph => html.push_str("</p>\n"),
+                TagEnd::Heading(level) => html.push_str(&format!("</{}>\n", level)),
+                TagEnd::BlockQuote(_) => html.push_str("</blockquote>\n"),
+                TagEnd::CodeBlock => html.push_str("</code></pre>\n"),
+                TagEnd::HtmlBlock => html.push_str("</p>\n"),
+                TagEnd::List(true) => html.push_str("</ol>\n"),
+                TagEnd::List(false) => html.push_str("</ul>\n"),
+                TagEnd::Item => html.push_str("</li>\n"),
+                TagEnd::Table => html.push_str("</table>\n"),
+                TagEnd::TableHead => {
+                    in_table_head = false;
+                    html.push_str("</tr>\n");
+                }
+                TagEnd::TableRow => html.push_str("</tr>\n"),
+                TagEnd::TableCell => html.push_str(if in_table_head { "</th>" } else { "</td>" }),
+                TagEnd::Emphasis => html.push_str("</em>"),
+                TagEnd::Strong => html.push_str("</strong>"),
+                TagEnd::Strikethrough => html.push_str("</del>"),
+                TagEnd::Link => {
+                    in_link = false;
+                    html.push_str("</a>");
+                }
+                TagEnd::Image => {
+                    if let Some((src, alt)) = image.take() {
+                        html.push_str(&format!(
+                            "<img src=\"{}\" alt=\"{}\">",
+                            html_escape(&src),
+                            html_escape(&alt)
+                        ));
+                    } else if image_link.pop().unwrap_or(false) {
+                        html.push_str("</a>");
+                    }
+                }
+                _ => {}
+            },
+            Event::Text(text) | Event::Html(text) | Event::InlineHtml(text) => {
+                html.push_str(&html_escape(&text))
+            }
+            Event::Code(code) => html.push_str(&format!("<code>{}</code>", html_escape(&code))),
+            Event::SoftBreak => html.push('\n'),
+            Event::HardBreak => html.push_str("<br>\n"),
+            Event::Rule => html.push_str("<hr>\n"),
+            Event::TaskListMarker(done) => html.push_str(if done {
+                "<input type=\"checkbox\" disabled checked> "
+            } else {
+                "<input type=\"checkbox\" disabled> "
+            }),
+            _ => {}
+        }
+    }
+    html
+}
+
+/// Links to web pages, mail addresses and pages of this server; anything
+/// else, such as `javascript:` URLs, goes nowhere
+fn safe_url(url: &str) -> String {
+    match scheme(url).as_deref() {
+        None | Some("http") | Some("https") | Some("mailto") => url.trim().to_string(),
+        Some(_) => "#".to_string(),
+    }
+}
+
+/// A URL's scheme, in lower case; None for relative URLs
+fn scheme(url: &str) -> Option<String> {
+    url.trim()
+        .split_once(':')
+        .map(|(scheme, _)| scheme)
+        .filter(|scheme| !scheme.contains(['/', '?', '#']))
+        .map(|scheme| scheme.to_ascii_lowercase())
+}
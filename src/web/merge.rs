@@ -0,0 +1,116 @@
+use super::auth::current_user;
+use super::WebServer;
+use crate::archive;
+use crate::maintenance_mode;
+use crate::merge::{self, Merge, Outcome};
+use crate::mirror;
+use crate::orgs::Role;
+use crate::protection;
+use axum::{
+    extract::{Path, State},
+    http::StatusCode,
+    response::{IntoResponse, Response},
+    Json,
+};
+use serde::Deserialize;
+use std::sync::Arc;
+
+#[derive(Deserialize)]
+pub struct MergeRequest {
+    /// Branch merged into
+    base: String,
+    /// Branch or commit merged
+    head: String,
+    /// merge, squash or rebase; the repository's default if missing
+    #[serde(default)]
+    strategy: Option<String>,
+    #[serde(default)]
+    message: Option<String>,
+}
+
+/// Merge a branch into another: POST /api/v1/repos/<name>/merge with
+/// `{"base": "main", "head": "feature", "strategy": "squash"}`. Answers 200
+/// with the new tip of the base, or 409 with the conflicting files, in which
+/// case nothing changed.
+pub async fn api(
+    State(server): State<Arc<WebServer>>,
+    Path(repo_name): Path<String>,
+    Json(request): Json<MergeRequest>,
+) -> Response {
+    let (repo_name, repo_path) = match server.resolve_repo(&repo_name) {
+        Some(found) => found,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    let user = match current_user() {
+        Some(user) => user,
+        None => return (StatusCode::UNAUTHORIZED, "Sign in to merge").into_response(),
+    };
+    if !server.has_role(&repo_path, Role::Write) {
+        return (
+            StatusCode::FORBIDDEN,
+            "Merging needs write access to the repository",
+        )
+            .into_response();
+    }
+    if mirror::is_pull_mirror(&repo_path) {
+        return (
+            StatusCode::CONFLICT,
+            "The repository is a pull mirror; merge in its upstream instead",
+        )
+            .into_response();
+    }
+    if archive::is_archived(&repo_path) {
+        return (StatusCode::CONFLICT, archive::refusal(&repo_name)).into_response();
+    }
+    if let Some(refusal) = maintenance_mode::refusal(&server.data_dir, &repo_name, &repo_path) {
+        return (StatusCode::CONFLICT, refusal).into_response();
+    }
+
+    let strategy = match request.strategy.as_deref().map(str::parse).transpose() {
+        Ok(strategy) => strategy,
+        Err(e) => {
+            return (
+                StatusCode::UNPROCESSABLE_ENTITY,
+                Json(serde_json::json!({ "status": "failed", "error": e })),
+            )
+                .into_response()
+        }
+    };
+    let merge = Merge {
+        base: request.base,
+        head: request.head,
+        strategy,
+        message: request.message.filter(|m| !m.trim().is_empty()),
+        identity: merge::Identity::for_user(&user),
+        user: Some(user),
+        via: protection::Via::Merge,
+    };
+    let usage = server.disk_usage.clone();
+    let result = tokio::task::spawn_blocking(move || {
+        let outcome = merge.run(&repo_path)?;
+        if let Outcome::Merged { .. } = outcome {
+            if let Err(e) = usage.refresh_repo(&repo_name, &repo_path) {
+                tracing::warn!("Failed to measure {} after merge: {}", repo_name, e);
+            }
+            mirror::push_all(&repo_path);
+        }
+        Ok::<_, anyhow::Error>(outcome)
+    })
+    .await;
+
+    match result {
+        Ok(Ok(outcome)) => {
+            let status = match outcome {
+                Outcome::Conflicts { .. } => StatusCode::CONFLICT,
+                _ => StatusCode::OK,
+            };
+            (status, Json(outcome)).into_response()
+        }
+        Ok(Err(e)) => (
+            StatusCode::UNPROCESSABLE_ENTITY,
+            Json(serde_json::json!({ "status": "failed", "error": format!("{:#}", e) })),
+        )
+            .into_response(),
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
@@ -0,0 +1,257 @@
+use super::auth::current_user;
+use super::{html_escape, relative_time, render_page, WebServer};
+use crate::notifications::{self, Notification, Reason};
+use axum::{
+    extract::{Path, Query, State},
+    http::StatusCode,
+    response::{IntoResponse, Redirect, Response},
+    Json,
+};
+use std::collections::HashMap;
+use std::sync::Arc;
+
+/// Tell users mentioned in `text`, written by `author`, about it, if they
+/// can see the repository
+pub fn mentioned(
+    server: &WebServer,
+    repo_name: &str,
+    title: &str,
+    url: &str,
+    author: &str,
+    text: &str,
+) {
+    for user in notifications::mentions(text) {
+        if user == author
+            || crate::orgs::role(&server.data_dir, &server.repos_dir, repo_name, Some(&user))
+                .is_none()
+        {
+            continue;
+        }
+        if let Err(e) = notifications::push(
+            &server.data_dir,
+            &user,
+            Reason::Mention,
+            repo_name,
+            title,
+            Some(url.to_string()),
+        ) {
+            tracing::warn!("Failed to notify {} of a mention: {}", user, e);
+        }
+    }
+}
+
+fn unauthorized() -> Response {
+    (
+        StatusCode::UNAUTHORIZED,
+        "Sign in to see your notifications",
+    )
+        .into_response()
+}
+
+/// Apply the `reason` and `unread` query filters
+fn filter(
+    notifications: Vec<Notification>,
+    query: &HashMap<String, String>,
+) -> Result<Vec<Notification>, Response> {
+    let reason = match query.get("reason").filter(|r| !r.is_empty()) {
+        Some(reason) => Some(
+            reason
+                .parse::<Reason>()
+                .map_err(|e| (StatusCode::BAD_REQUEST, e).into_response())?,
+        ),
+        None => None,
+    };
+    let unread_only = matches!(query.get("unread").map(|v| v.as_str()), Some("1" | "true"));
+
+    Ok(notifications
+        .into_iter()
+        .filter(|n| reason.map_or(true, |r| n.reason == r))
+        .filter(|n| !unread_only || !n.read)
+        .collect())
+}
+
+/// Inbox page: /notifications?reason=<reason>&unread=1
+pub async fn page(
+    State(server): State<Arc<WebServer>>,
+    Query(query): Query<HashMap<String, String>>,
+) -> Response {
+    let user = match current_user() {
+        Some(user) => user,
+        None => return unauthorized(),
+    };
+
+    let all = match notifications::list(&server.data_dir, &user) {
+        Ok(all) => all,
+        Err(e) => return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    };
+    let unread = all.iter().filter(|n| !n.read).count();
+    let shown = match filter(all, &query) {
+        Ok(shown) => shown,
+        Err(response) => return response,
+    };
+
+    let unread_only = query.get("unread").is_some();
+    let current = query.get("reason").map(|r| r.as_str()).unwrap_or("");
+    let unread_param = if unread_only { "&unread=1" } else { "" };
+
+    let mut body = format!(
+        "<h1>Notifications</h1>\n<p>{} unread</p>\n<p class=\"filters\">",
+        unread
+    );
+    let mut tabs = vec![("", "All")];
+    tabs.extend(Reason::ALL.iter().map(|r| (r.name(), r.label())));
+    for (name, label) in tabs {
+        if name == current {
+            body.push_str(&format!("<strong>{}</strong> ", label));
+        } else {
+            body.push_str(&format!(
+                "<a href=\"/notifications?reason={}{}\">{}</a> ",
+                name, unread_param, label
+            ));
+        }
+    }
+    body.push_str(&format!(
+        "&middot; <a href=\"/notifications?reason={}{}\">{}</a></p>\n",
+        html_escape(current),
+        if unread_only { "" } else { "&unread=1" },
+        if unread_only {
+            "Show read"
+        } else {
+            "Unread only"
+        }
+    ));
+
+    if unread > 0 {
+        body.push_str(
+            r#"<form method="post" action="/notifications/read"><button type="submit">Mark all as read</button></form>"#,
+        );
+    }
+
+    body.push_str("<ul class=\"commit-list\">\n");
+    for n in &shown {
+        let title = match &n.url {
+            Some(url) => format!(
+                "<a href=\"{}\">{}</a>",
+                html_escape(url),
+                html_escape(&n.title)
+            ),
+            None => html_escape(&n.title),
+        };
+        let action = if n.read {
+            String::new()
+        } else {
+            format!(
+                r#" <form method="post" action="/notifications/{}/read" style="display:inline"><button type="submit">Mark as read</button></form>"#,
+                n.id
+            )
+        };
+        body.push_str(&format!(
+            "<li class=\"commit-item{}\"><span class=\"reason\">{}</span> <a href=\"/repo/{}\">{}</a>: {} <small>{}</small>{}</li>\n",
+            if n.read { " read" } else { " unread" },
+            n.reason.label(),
+            html_escape(&n.repo),
+            html_escape(&n.repo),
+            title,
+            relative_time(n.created_at),
+            action
+        ));
+    }
+    if shown.is_empty() {
+        body.push_str("<li class=\"commit-item\">Nothing here.</li>\n");
+    }
+    body.push_str("</ul>\n");
+
+    render_page(
+        &server,
+        "Notifications",
+        r#"<a href="/">Home</a> / Notifications"#,
+        &body,
+    )
+}
+
+/// Mark one notification as read, then return to the inbox
+pub async fn mark_read_form(State(server): State<Arc<WebServer>>, Path(id): Path<u64>) -> Response {
+    let user = match current_user() {
+        Some(user) => user,
+        None => return unauthorized(),
+    };
+    match notifications::mark_read(&server.data_dir, &user, Some(id)) {
+        Ok(_) => Redirect::to("/notifications").into_response(),
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
+
+/// Mark every notification as read, then return to the inbox
+pub async fn mark_all_read_form(State(server): State<Arc<WebServer>>) -> Response {
+    let user = match current_user() {
+        Some(user) => user,
+        None => return unauthorized(),
+    };
+    match notifications::mark_read(&server.data_dir, &user, None) {
+        Ok(_) => Redirect::to("/notifications").into_response(),
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
+
+/// GET /api/v1/notifications?reason=<reason>&unread=true
+pub async fn api_list(
+    State(server): State<Arc<WebServer>>,
+    Query(query): Query<HashMap<String, String>>,
+) -> Response {
+    let user = match current_user() {
+        Some(user) => user,
+        None => return unauthorized(),
+    };
+    let all = match notifications::list(&server.data_dir, &user) {
+        Ok(all) => all,
+        Err(e) => return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    };
+    let unread = all.iter().filter(|n| !n.read).count();
+    match filter(all, &query) {
+        Ok(shown) => Json(serde_json::json!({
+            "unread_count": unread,
+            "notifications": shown,
+        }))
+        .into_response(),
+        Err(response) => response,
+    }
+}
+
+/// POST /api/v1/notifications/:id/read
+pub async fn api_mark_read(State(server): State<Arc<WebServer>>, Path(id): Path<u64>) -> Response {
+    mark(&server, Some(id))
+}
+
+/// POST /api/v1/notifications/read
+pub async fn api_mark_all_read(State(server): State<Arc<WebServer>>) -> Response {
+    mark(&server, None)
+}
+
+fn mark(server: &WebServer, id: Option<u64>) -> Response {
+    let user = match current_user() {
+        Some(user) => user,
+        None => return unauthorized(),
+    };
+    match notifications::mark_read(&server.data_dir, &user, id) {
+        Ok(marked) => Json(serde_json::json!({ "marked": marked })).into_response(),
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
+
+/// Link to the inbox with the unread count, shown on every page for signed-in users
+pub fn bell(server: &WebServer) -> String {
+    match current_user() {
+        Some(user) => {
+            let unread = notifications::unread_count(&server.data_dir, &user);
+            format!(
+                r#"<a class="bell" href="/notifications" title="Notifications">&#128276;{}</a>"#,
+                if unread > 0 {
+                    format!(r#" <span class="unread-count">{}</span>"#, unread)
+                } else {
+                    String::new()
+                }
+            )
+        }
+        None => String::new(),
+    }
+}
@@ -0,0 +1,316 @@
+use super::auth::{current_user, remote_addr, scope_allows};
+use super::settings::error_message;
+use super::{html_escape, render_page, url_path, WebServer};
+use crate::archive;
+use crate::audit::{self, Action, Via};
+use crate::git;
+use crate::orgs::{self, Org, Role};
+use axum::{
+    extract::{Path, State},
+    http::StatusCode,
+    response::{IntoResponse, Redirect, Response},
+    Form,
+};
+use std::collections::HashMap;
+use std::path::PathBuf;
+use std::sync::Arc;
+
+fn not_found() -> Response {
+    (StatusCode::NOT_FOUND, "Organization not found").into_response()
+}
+
+/// Whether the signed-in user may manage an organization: its owners and
+/// server admins, with an admin-scoped token if they use one
+fn may_manage(server: &WebServer, org: &Org) -> bool {
+    current_user().map_or(false, |user| {
+        (org.owners.contains(&user) && scope_allows(Role::Admin)) || server.is_admin(&user)
+    })
+}
+
+pub(super) fn role_options(selected: Option<Role>, with_none: bool) -> String {
+    let mut options = String::new();
+    if with_none {
+        options.push_str(&format!(
+            "<option value=\"none\"{}>none</option>",
+            if selected.is_none() { " selected" } else { "" }
+        ));
+    }
+    for role in [Role::Read, Role::Write, Role::Admin] {
+        options.push_str(&format!(
+            "<option value=\"{0}\"{1}>{0}</option>",
+            role.name(),
+            if selected == Some(role) {
+                " selected"
+            } else {
+                ""
+            }
+        ));
+    }
+    options
+}
+
+/// An organization's repositories, members and teams: /org/<name>. Owners
+/// manage them here as well.
+pub async fn page(State(server): State<Arc<WebServer>>, Path(name): Path<String>) -> Response {
+    render(&server, &name, None)
+}
+
+fn render(server: &WebServer, name: &str, error: Option<&str>) -> Response {
+    let org = match orgs::get(&server.data_dir, name) {
+        Some(org) => org,
+        None => return not_found(),
+    };
+    let user = current_user();
+    // Outsiders learn no more than that the organization exists
+    if !user
+        .as_deref()
+        .map_or(false, |u| org.is_member(u) || server.is_admin(u))
+    {
+        return not_found();
+    }
+    let manage = may_manage(server, &org);
+    let action = format!("/org/{}", url_path(name));
+    let form = |fields: &str, button: &str| {
+        format!(
+            "<form method=\"post\" action=\"{}\" style=\"display: inline\">{}<button type=\"submit\">{}</button></form>",
+            action, fields, button
+        )
+    };
+    let hidden = |key: &str, value: &str| {
+        format!(
+            "<input type=\"hidden\" name=\"{}\" value=\"{}\">",
+            key,
+            html_escape(value)
+        )
+    };
+
+    let title = if org.display_name.is_empty() {
+        name.to_string()
+    } else {
+        org.display_name.clone()
+    };
+    let mut body = format!("<h1>{}</h1>\n", html_escape(&title));
+    body.push_str(&error_message(error));
+
+    body.push_str("<h2>Repositories</h2>\n");
+    let repos: Vec<(String, PathBuf)> = git::find_repositories(&server.repos_dir.join(name))
+        .unwrap_or_default()
+        .into_iter()
+        .filter(|(repo, _)| !repo.contains('/'))
+        .filter(|(repo, _)| server.role(&format!("{}/{}", name, repo)).is_some())
+        .collect();
+    if repos.is_empty() {
+        body.push_str("<p>No repositories you can see.</p>\n");
+    } else {
+        body.push_str("<ul>\n");
+        for (repo, repo_path) in &repos {
+            let full = format!("{}/{}", name, repo);
+            body.push_str(&format!(
+                "<li><a href=\"/repo/{}\">{}</a> ({}){}</li>\n",
+                url_path(&full),
+                html_escape(repo),
+                server.role(&full).map_or("", |role| role.name()),
+                if archive::is_archived(repo_path) {
+                    " &middot; archived"
+                } else {
+                    ""
+                }
+            ));
+        }
+        body.push_str("</ul>\n");
+    }
+
+    body.push_str("<h2>Members</h2>\n<ul>\n");
+    for (member, owner) in org
+        .owners
+        .iter()
+        .map(|m| (m, true))
+        .chain(org.members.iter().map(|m| (m, false)))
+    {
+        body.push_str(&format!(
+            "<li>{}{}",
+            html_escape(member),
+            if owner { " (owner)" } else { "" }
+        ));
+        if manage {
+            body.push(' ');
+            body.push_str(&form(
+                &format!(
+                    "{}{}",
+                    hidden("action", if owner { "demote" } else { "promote" }),
+                    hidden("user", member)
+                ),
+                if owner { "Make member" } else { "Make owner" },
+            ));
+            body.push(' ');
+            body.push_str(&form(
+                &format!(
+                    "{}{}",
+                    hidden("action", "remove-member"),
+                    hidden("user", member)
+                ),
+                "Remove",
+            ));
+        }
+        body.push_str("</li>\n");
+    }
+    body.push_str("</ul>\n");
+    body.push_str(match org.base_role {
+        None => "<p>Members only have the roles their teams grant.</p>\n",
+        Some(Role::Read) => "<p>Members can read every repository.</p>\n",
+        Some(Role::Write) => "<p>Members can push to every repository.</p>\n",
+        Some(Role::Admin) => "<p>Members can administer every repository.</p>\n",
+    });
+    if manage {
+        body.push_str(&format!(
+            "<form method=\"post\" action=\"{0}\">{1}<input type=\"text\" name=\"user\" placeholder=\"user name\" required> <label><input type=\"checkbox\" name=\"owner\"> Owner</label> <button type=\"submit\">Add member</button></form>\n<form method=\"post\" action=\"{0}\">{2}Base role: <select name=\"role\">{3}</select> <button type=\"submit\">Save</button></form>\n",
+            action,
+            hidden("action", "add-member"),
+            hidden("action", "base-role"),
+            role_options(org.base_role, true)
+        ));
+    }
+
+    body.push_str("<h2>Teams</h2>\n");
+    if org.teams.is_empty() {
+        body.push_str("<p>No teams.</p>\n");
+    }
+    for (team_name, team) in &org.teams {
+        body.push_str(&format!(
+            "<h3>{} <small>({})</small></h3>\n",
+            html_escape(team_name),
+            team.role.name()
+        ));
+        for (label, items, remove) in [
+            ("Members", &team.members, "remove-team-member"),
+            ("Repositories", &team.repos, "revoke"),
+        ] {
+            body.push_str(&format!("<p>{}: ", label));
+            if items.is_empty() {
+                body.push_str("none");
+            }
+            for item in items {
+                body.push_str(&html_escape(item));
+                if manage {
+                    body.push(' ');
+                    body.push_str(&form(
+                        &format!(
+                            "{}{}{}",
+                            hidden("action", remove),
+                            hidden("team", team_name),
+                            hidden("value", item)
+                        ),
+                        "&times;",
+                    ));
+                }
+                body.push_str(" ");
+            }
+            body.push_str("</p>\n");
+        }
+        if manage {
+            body.push_str(&format!(
+                "<form method=\"post\" action=\"{0}\">{1}<input type=\"text\" name=\"value\" placeholder=\"member\" required> <button type=\"submit\">Add member</button></form>\n<form method=\"post\" action=\"{0}\">{2}<input type=\"text\" name=\"value\" placeholder=\"repository\" required> <button type=\"submit\">Add repository</button></form>\n<form method=\"post\" action=\"{0}\">{3}<select name=\"role\">{4}</select> <button type=\"submit\">Change role</button></form>\n{5}\n",
+                action,
+                format!("{}{}", hidden("action", "add-team-member"), hidden("team", team_name)),
+                format!("{}{}", hidden("action", "grant"), hidden("team", team_name)),
+                format!("{}{}", hidden("action", "set-team"), hidden("team", team_name)),
+                role_options(Some(team.role), false),
+                form(
+                    &format!("{}{}", hidden("action", "delete-team"), hidden("team", team_name)),
+                    "Delete team"
+                )
+            ));
+        }
+    }
+    if manage {
+        body.push_str(&format!(
+            "<h3>New team</h3>\n<form method=\"post\" action=\"{}\">{}<input type=\"text\" name=\"team\" placeholder=\"team name\" required> <select name=\"role\">{}</select> <button type=\"submit\">Create</button></form>\n",
+            action,
+            hidden("action", "set-team"),
+            role_options(Some(Role::Read), false)
+        ));
+    }
+
+    render_page(
+        server,
+        &title,
+        &format!("<a href=\"/\">Home</a> / {}", html_escape(name)),
+        &body,
+    )
+}
+
+/// Change an organization's members or teams, then show it again
+pub async fn save(
+    State(server): State<Arc<WebServer>>,
+    Path(name): Path<String>,
+    Form(form): Form<HashMap<String, String>>,
+) -> Response {
+    let org = match orgs::get(&server.data_dir, &name) {
+        Some(org) => org,
+        None => return not_found(),
+    };
+    if !may_manage(&server, &org) {
+        return (
+            StatusCode::FORBIDDEN,
+            "Only the organization's owners may change it",
+        )
+            .into_response();
+    }
+
+    let field = |key: &str| form.get(key).map(|v| v.trim()).unwrap_or("");
+    let action = field("action");
+    let (user, team, value) = (field("user"), field("team"), field("value"));
+    let role = || -> anyhow::Result<Option<Role>> {
+        match field("role") {
+            "none" => Ok(None),
+            role => role.parse().map(Some).map_err(anyhow::Error::msg),
+        }
+    };
+    let result = orgs::update(&server.data_dir, &name, |org| match action {
+        "add-member" => org.add_member(user, form.contains_key("owner")),
+        "promote" => org.add_member(user, true),
+        "demote" => org.demote(user),
+        "remove-member" => org.remove_member(user),
+        "base-role" => {
+            org.base_role = role()?;
+            Ok(())
+        }
+        "set-team" => match role()? {
+            Some(role) => org.set_team(team, role),
+            None => anyhow::bail!("Teams need a role"),
+        },
+        "delete-team" => {
+            org.teams.remove(team);
+            Ok(())
+        }
+        "add-team-member" => org.add_to_team(team, value),
+        "remove-team-member" => {
+            org.team_mut(team)?.members.remove(value);
+            Ok(())
+        }
+        "grant" => org.grant(team, value),
+        "revoke" => org.revoke(team, value),
+        _ => anyhow::bail!("Unknown action '{}'", action),
+    });
+
+    match result {
+        Ok(_) => {
+            let by = current_user();
+            if let Some(by) = &by {
+                tracing::info!(org = %name, user = %by, "Organization changed: {}", action);
+            }
+            let subject = [user, team, value]
+                .into_iter()
+                .filter(|field| !field.is_empty())
+                .collect::<Vec<_>>()
+                .join(" ");
+            audit::Entry::new(Action::OrgChange, Via::Web, by.as_deref())
+                .with_target(&name)
+                .with_detail(format!("{} {}", action, subject).trim_end().to_string())
+                .with_remote(remote_addr())
+                .record(&server.data_dir);
+            Redirect::to(&format!("/org/{}", url_path(&name))).into_response()
+        }
+        Err(e) => render(&server, &name, Some(&format!("{:#}", e))),
+    }
+}
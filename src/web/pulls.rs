@@ -0,0 +1,1158 @@
+use super::auth::current_user;
+use super::builds;
+use super::reviews::Review;
+use super::settings::error_message;
+use super::{
+    breadcrumb, diff as diff_view, html_escape, markdown, notifications, relative_time,
+    render_commit_list, render_diff, render_page, stream, url_path, CommitInfo, WebServer,
+    DIFF_TRUNCATED, MAX_DIFF_BYTES,
+};
+use crate::git::{self, limits::Pool};
+use crate::maintenance_mode;
+use crate::merge::{Conflict, Outcome, Strategy};
+use crate::mirror;
+use crate::orgs::Role;
+use crate::pulls::{self, Mergeability, Pull, State as PullState};
+use axum::{
+    extract::{Path, Query, State},
+    http::{header, StatusCode},
+    response::{IntoResponse, Redirect, Response},
+    Json,
+};
+use serde::Deserialize;
+use std::collections::HashMap;
+use std::path::PathBuf;
+use std::sync::Arc;
+
+/// Commits listed on a pull request's page
+const MAX_COMMITS: usize = 250;
+
+fn pulls_url(repo_name: &str) -> String {
+    format!("/repo/{}/pulls", url_path(repo_name))
+}
+
+/// Whether the signed-in user may edit, close and reopen a pull request: its
+/// author, and users with write access to the repository
+fn may_edit(server: &WebServer, repo_path: &PathBuf, pull: &Pull) -> bool {
+    current_user().map_or(false, |user| {
+        user == pull.author || server.has_role(repo_path, Role::Write)
+    })
+}
+
+fn notify_mentions(server: &WebServer, repo_name: &str, pull: &Pull, author: &str, text: &str) {
+    notifications::mentioned(
+        server,
+        repo_name,
+        &format!("#{} {}", pull.number, pull.title),
+        &format!("{}/{}", pulls_url(repo_name), pull.number),
+        author,
+        text,
+    );
+}
+
+/// Commits `head` has that `base` lacks, newest first
+fn commits(server: &WebServer, repo_path: &PathBuf, base: &str, head: &str) -> Vec<CommitInfo> {
+    let output = match git::run(
+        repo_path,
+        &[
+            "log",
+            &format!("--max-count={}", MAX_COMMITS),
+            "--format=%H%x00%an%x00%ae%x00%at%x00%s",
+            &format!("{}..{}", base, head),
+            "--",
+        ],
+    ) {
+        Ok(output) if output.status.success() => output,
+        _ => return Vec::new(),
+    };
+    let log = String::from_utf8_lossy(&output.stdout);
+    let ids: Vec<&str> = log
+        .lines()
+        .filter_map(|line| line.split('\0').next())
+        .collect();
+    let mut signatures = server.signatures.commits(repo_path, &ids);
+    log.lines()
+        .filter_map(|line| {
+            let fields: Vec<&str> = line.splitn(5, '\0').collect();
+            match fields.as_slice() {
+                [id, author, email, time, subject] => Some(CommitInfo {
+                    hash: id[..8.min(id.len())].to_string(),
+                    author: author.to_string(),
+                    email: email.to_string(),
+                    date: relative_time(time.parse().unwrap_or(0)),
+                    message: subject.to_string(),
+                    signature: signatures.remove(*id).unwrap_or_default(),
+                    id: id.to_string(),
+                }),
+                _ => None,
+            }
+        })
+        .collect()
+}
+
+/// Changes of `head` since it forked from `base`, as a patch with stats,
+/// and whether it is too large to show and cut short
+pub fn diff(repo_path: &PathBuf, base: &str, head: &str) -> anyhow::Result<(String, bool)> {
+    let range = format!("{}...{}", base, head);
+    let (output, truncated) = git::run_capped(repo_path, &diff_args(&range), MAX_DIFF_BYTES)?;
+    // git is stopped when the diff is cut short
+    if !output.status.success() && !truncated {
+        anyhow::bail!(
+            "git diff failed: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok((
+        String::from_utf8_lossy(&output.stdout).to_string(),
+        truncated,
+    ))
+}
+
+fn diff_args(range: &str) -> [&str; 6] {
+    ["diff", "--stat", "--patch", "--no-color", range, "--"]
+}
+
+fn conflicts_html(conflicts: &[Conflict]) -> String {
+    let mut html = String::from("<ul>\n");
+    for conflict in conflicts {
+        html.push_str(&format!(
+            "<li><code>{}</code> ({})</li>\n",
+            html_escape(&conflict.path),
+            html_escape(&conflict.kind)
+        ));
+    }
+    html.push_str("</ul>\n");
+    html
+}
+
+fn strategy_options(selected: Strategy, strategies: &[Strategy]) -> String {
+    strategies
+        .iter()
+        .map(|strategy| {
+            format!(
+                "<option value=\"{0}\"{1}>{0}</option>",
+                strategy.name(),
+                if *strategy == selected {
+                    " selected"
+                } else {
+                    ""
+                }
+            )
+        })
+        .collect()
+}
+
+/// Pull request list: /repo/<name>/pulls?state=open|closed|merged|all
+pub fn list_page(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    query: &HashMap<String, String>,
+) -> Response {
+    let state = query.get("state").map(String::as_str).unwrap_or("open");
+    let found = match pulls::list(repo_path, state.parse().ok()) {
+        Ok(found) => found,
+        Err(e) => return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    };
+
+    let base = pulls_url(repo_name);
+    let mut body = String::from("<h1>Pull requests</h1>\n<p>");
+    for (name, label) in [
+        ("open", "Open"),
+        ("merged", "Merged"),
+        ("closed", "Closed"),
+        ("all", "All"),
+    ] {
+        if name == state {
+            body.push_str(&format!("<strong>{}</strong> ", label));
+        } else {
+            body.push_str(&format!(
+                "<a href=\"{}?state={}\">{}</a> ",
+                base, name, label
+            ));
+        }
+    }
+    if current_user().is_some() {
+        body.push_str(&format!(
+            "&middot; <a href=\"{}/new\">New pull request</a>",
+            base
+        ));
+    }
+    body.push_str("</p>\n");
+
+    if found.is_empty() {
+        body.push_str("<p>No pull requests.</p>\n");
+    } else {
+        body.push_str("<ul class=\"file-list\">\n");
+        for pull in &found {
+            body.push_str(&format!(
+                "<li class=\"file-item\"><span class=\"state-{}\">{}</span> <a href=\"{}/{}\">{}</a> <small>#{} &middot; {} into {} &middot; opened {} by {}{}</small></li>\n",
+                pull.state.name(),
+                pull.state.name(),
+                base,
+                pull.number,
+                html_escape(&pull.title),
+                pull.number,
+                html_escape(&pull.head),
+                html_escape(&pull.base),
+                relative_time(pull.created),
+                html_escape(&pull.author),
+                if pull.comments.is_empty() {
+                    String::new()
+                } else {
+                    format!(" &middot; {} comments", pull.comments.len())
+                }
+            ));
+        }
+        body.push_str("</ul>\n");
+    }
+
+    render_page(
+        server,
+        &format!("{} - Pull requests", repo_name),
+        &breadcrumb(repo_name, &[("Pull requests".to_string(), None)]),
+        &body,
+    )
+}
+
+/// Compare two branches and propose merging them:
+/// /repo/<name>/pulls/new?base=<branch>&head=<branch>
+pub fn new_page(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    form: &HashMap<String, String>,
+    error: Option<&str>,
+) -> Response {
+    if current_user().is_none() {
+        return Redirect::to(&format!("/login?next={}/new", pulls_url(repo_name))).into_response();
+    }
+    let field = |key: &str| form.get(key).map(String::as_str).unwrap_or("");
+    let default_branch = server.default_branch(repo_path);
+    let base = Some(field("base"))
+        .filter(|b| !b.is_empty())
+        .unwrap_or(&default_branch);
+    let head = field("head");
+    let branches = server.get_branches(repo_path).unwrap_or_default();
+    let select = |name: &str, selected: &str| {
+        let mut html = format!("<select name=\"{}\">", name);
+        if selected.is_empty() {
+            html.push_str("<option value=\"\" selected>choose a branch</option>");
+        }
+        for branch in &branches {
+            html.push_str(&format!(
+                "<option value=\"{0}\"{1}>{0}</option>",
+                html_escape(branch),
+                if branch == selected { " selected" } else { "" }
+            ));
+        }
+        html.push_str("</select>");
+        html
+    };
+
+    let mut body = format!(
+        "<h1>New pull request</h1>\n{}<form method=\"get\" action=\"{}/new\">Merge {} into {} <button type=\"submit\">Compare</button></form>\n",
+        error_message(error),
+        pulls_url(repo_name),
+        select("head", head),
+        select("base", base)
+    );
+
+    if !head.is_empty() && head != base && branches.iter().any(|b| b == head) {
+        let found = commits(server, repo_path, base, head);
+        if found.is_empty() {
+            body.push_str(&format!(
+                "<p>{} already contains everything on {}.</p>\n",
+                html_escape(base),
+                html_escape(head)
+            ));
+        } else {
+            let title = if field("title").is_empty() && found.len() == 1 {
+                found[0].message.clone()
+            } else {
+                field("title").to_string()
+            };
+            body.push_str(&format!(
+                "<form method=\"post\" action=\"{}/new\">\n<input type=\"hidden\" name=\"base\" value=\"{}\">\n<input type=\"hidden\" name=\"head\" value=\"{}\">\n<label>Title<br><input type=\"text\" name=\"title\" size=\"60\" value=\"{}\" required></label><br>\n<label>Description (Markdown)<br><textarea name=\"body\" rows=\"10\" cols=\"80\">{}</textarea></label><br>\n<button type=\"submit\">Open pull request</button>\n</form>\n",
+                pulls_url(repo_name),
+                html_escape(base),
+                html_escape(head),
+                html_escape(&title),
+                html_escape(field("body"))
+            ));
+            body.push_str(&format!(
+                "<div class=\"section\"><h2>Commits ({})</h2>{}</div>\n",
+                found.len(),
+                render_commit_list(server, repo_name, &found)
+            ));
+            if let Ok((patch, truncated)) = diff(repo_path, base, head) {
+                let view = diff_view::view(server, form);
+                body.push_str(&format!(
+                    "<div class=\"section\"><h2>Changes</h2>{}{}{}</div>\n",
+                    diff_view::toggle(&format!("{}/new", pulls_url(repo_name)), form, view),
+                    render_diff(&patch, view),
+                    if truncated { DIFF_TRUNCATED } else { "" }
+                ));
+            }
+        }
+    }
+
+    render_page(
+        server,
+        &format!("{} - New pull request", repo_name),
+        &breadcrumb(
+            repo_name,
+            &[
+                ("Pull requests".to_string(), Some(pulls_url(repo_name))),
+                ("New".to_string(), None),
+            ],
+        ),
+        &body,
+    )
+}
+
+/// Open the pull request posted from the compare page
+pub fn create_form(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    form: &HashMap<String, String>,
+) -> Response {
+    let user = match current_user() {
+        Some(user) => user,
+        None => return (StatusCode::UNAUTHORIZED, "Sign in to open pull requests").into_response(),
+    };
+    let field = |key: &str| form.get(key).map(String::as_str).unwrap_or("");
+    match pulls::create(
+        repo_path,
+        &user,
+        field("base"),
+        field("head"),
+        field("title"),
+        field("body"),
+    ) {
+        Ok(pull) => {
+            notify_mentions(server, repo_name, &pull, &user, &pull.body);
+            Redirect::to(&format!("{}/{}", pulls_url(repo_name), pull.number)).into_response()
+        }
+        Err(e) => new_page(
+            server,
+            repo_name,
+            repo_path,
+            form,
+            Some(&format!("{:#}", e)),
+        ),
+    }
+}
+
+fn load(repo_path: &PathBuf, number: u64) -> Result<Pull, Failure> {
+    match pulls::get(repo_path, number) {
+        Ok(Some(pull)) => Ok(pull),
+        Ok(None) => Err(Failure::NotFound),
+        Err(e) => Err(Failure::Internal(e.to_string())),
+    }
+}
+
+/// Where an open pull request stands: ahead/behind its base, whether it
+/// merges, and the merge and update forms for those who may use them
+fn status_html(server: &WebServer, repo_path: &PathBuf, pull: &Pull, action: &str) -> String {
+    let (base, head) = pulls::compared(repo_path, pull);
+    let mut html = String::from("<div class=\"section\">\n");
+    let behind = match server.divergence.ahead_behind(repo_path, &base, &head) {
+        Some((ahead, behind)) => {
+            html.push_str(&format!(
+                "<p><span class=\"ahead\">{} ahead</span> &middot; <span class=\"behind\">{} behind</span> {}</p>\n",
+                ahead,
+                behind,
+                html_escape(&pull.base)
+            ));
+            behind
+        }
+        None => 0,
+    };
+    let writable = server.has_role(repo_path, Role::Write);
+    let mergeability = pulls::mergeability(repo_path, pull);
+    match &mergeability {
+        Ok(Mergeability::Clean) => html.push_str("<p class=\"ahead\">No conflicts with the base branch.</p>\n"),
+        Ok(Mergeability::Conflicts { conflicts }) => html.push_str(&format!(
+            "<p class=\"behind\">These files conflict with {} and need to be resolved in {}:</p>\n{}",
+            html_escape(&pull.base),
+            html_escape(&pull.head),
+            conflicts_html(conflicts)
+        )),
+        Ok(Mergeability::UpToDate) => html.push_str(&format!(
+            "<p>{} already contains these changes.</p>\n",
+            html_escape(&pull.base)
+        )),
+        Ok(Mergeability::MissingBranch { branch }) => html.push_str(&format!(
+            "<p class=\"behind\">The branch {} no longer exists.</p>\n",
+            html_escape(branch)
+        )),
+        Err(e) => html.push_str(&format!(
+            "<p class=\"error\">Could not check for conflicts: {}</p>\n",
+            html_escape(&format!("{:#}", e))
+        )),
+    }
+    if writable && matches!(mergeability, Ok(Mergeability::Clean)) {
+        html.push_str(&format!(
+            "<form method=\"post\" action=\"{}\"><input type=\"hidden\" name=\"action\" value=\"merge\"><select name=\"strategy\">{}</select> <button type=\"submit\">Merge pull request</button></form>\n",
+            action,
+            strategy_options(
+                Strategy::default_for(repo_path),
+                &[Strategy::Merge, Strategy::Squash, Strategy::Rebase]
+            )
+        ));
+    }
+    if writable && behind > 0 && !matches!(mergeability, Ok(Mergeability::MissingBranch { .. })) {
+        html.push_str(&format!(
+            "<form method=\"post\" action=\"{}\"><input type=\"hidden\" name=\"action\" value=\"update-branch\"><select name=\"strategy\">{}</select> <button type=\"submit\">Update branch</button></form>\n",
+            action,
+            strategy_options(Strategy::Merge, &[Strategy::Merge, Strategy::Rebase])
+        ));
+    }
+    html.push_str("</div>\n");
+    html
+}
+
+/// A pull request with its discussion and commits: /repo/<name>/pulls/<number>
+pub fn pull_page(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    number: u64,
+    error: Option<&str>,
+) -> Response {
+    let pull = match load(repo_path, number) {
+        Ok(pull) => pull,
+        Err(failure) => return failure.into_response(),
+    };
+    let action = format!("{}/{}", pulls_url(repo_name), number);
+    let (base, head) = pulls::compared(repo_path, &pull);
+    let found = commits(server, repo_path, &base, &head);
+
+    let mut body = format!(
+        "<h1>{} <small>#{}</small></h1>\n<p><span class=\"state-{}\">{}</span> {} wants to merge {} commit{} from <code>{}</code> into <code>{}</code> &middot; opened {}</p>\n",
+        html_escape(&pull.title),
+        pull.number,
+        pull.state.name(),
+        pull.state.name(),
+        html_escape(&pull.author),
+        found.len(),
+        if found.len() == 1 { "" } else { "s" },
+        html_escape(&pull.head),
+        html_escape(&pull.base),
+        relative_time(pull.created)
+    );
+    let build = builds::status_link(repo_name, repo_path, &head);
+    body.push_str(&format!(
+        "<p><a href=\"{0}/files\">Files changed</a> &middot; <code>git fetch origin refs/pull/{1}/head</code>{2}</p>\n",
+        action,
+        pull.number,
+        if build.is_empty() {
+            String::new()
+        } else {
+            format!(" &middot; {}", build)
+        }
+    ));
+    body.push_str(&error_message(error));
+
+    match (&pull.state, &pull.merged) {
+        (PullState::Open, _) => body.push_str(&status_html(server, repo_path, &pull, &action)),
+        (PullState::Merged, Some(merged)) => body.push_str(&format!(
+            "<p class=\"state-merged\">Merged{}{} as <a href=\"/repo/{}/commit/{}\"><code>{}</code></a> {}</p>\n",
+            merged
+                .by
+                .as_ref()
+                .map(|by| format!(" by {}", html_escape(by)))
+                .unwrap_or_default(),
+            merged
+                .strategy
+                .map(|s| format!(" ({})", s.name()))
+                .unwrap_or_default(),
+            url_path(repo_name),
+            merged.commit,
+            &merged.commit[..8.min(merged.commit.len())],
+            relative_time(merged.time)
+        )),
+        _ => body.push_str(&format!(
+            "<p class=\"state-closed\">Closed{}</p>\n",
+            pull.closed_by
+                .as_ref()
+                .map(|by| format!(" by {}", html_escape(by)))
+                .unwrap_or_default()
+        )),
+    }
+
+    let comment_html = |author: &str, created: i64, text: &str| {
+        format!(
+            "<div class=\"comment\"><div class=\"comment-header\"><strong>{}</strong> {}</div><div class=\"comment-body\">{}</div></div>\n",
+            html_escape(author),
+            relative_time(created),
+            if text.trim().is_empty() {
+                "<p><em>No description.</em></p>".to_string()
+            } else {
+                markdown::render(text)
+            }
+        )
+    };
+    body.push_str(&comment_html(&pull.author, pull.created, &pull.body));
+    for comment in &pull.comments {
+        body.push_str(&comment_html(
+            &comment.author,
+            comment.created,
+            &comment.body,
+        ));
+    }
+
+    if current_user().is_some() {
+        body.push_str(&format!(
+            "<form method=\"post\" action=\"{}\">\n<input type=\"hidden\" name=\"action\" value=\"comment\">\n<textarea name=\"body\" rows=\"6\" cols=\"80\" placeholder=\"Leave a comment (Markdown)\"></textarea><br>\n<button type=\"submit\">Comment</button>\n</form>\n",
+            action
+        ));
+    } else {
+        body.push_str(&format!(
+            "<p><a href=\"/login?next={}\">Sign in</a> to comment.</p>\n",
+            url_path(&action)
+        ));
+    }
+
+    if may_edit(server, repo_path, &pull) && pull.state != PullState::Merged {
+        let (next, label) = match pull.state {
+            PullState::Open => ("close", "Close pull request"),
+            _ => ("reopen", "Reopen pull request"),
+        };
+        body.push_str(&format!(
+            "<form method=\"post\" action=\"{0}\"><input type=\"hidden\" name=\"action\" value=\"{1}\"><button type=\"submit\">{2}</button></form>\n<h2>Edit</h2>\n<form method=\"post\" action=\"{0}\">\n<input type=\"hidden\" name=\"action\" value=\"edit\">\n<label>Title<br><input type=\"text\" name=\"title\" size=\"60\" value=\"{3}\" required></label><br>\n<label>Description<br><textarea name=\"body\" rows=\"8\" cols=\"80\">{4}</textarea></label><br>\n<button type=\"submit\">Save</button>\n</form>\n",
+            action,
+            next,
+            label,
+            html_escape(&pull.title),
+            html_escape(&pull.body)
+        ));
+    }
+
+    if !found.is_empty() {
+        body.push_str(&format!(
+            "<div class=\"section\"><h2>Commits ({})</h2>{}</div>\n",
+            found.len(),
+            render_commit_list(server, repo_name, &found)
+        ));
+    }
+
+    render_page(
+        server,
+        &format!("{} - #{} {}", repo_name, pull.number, pull.title),
+        &breadcrumb(
+            repo_name,
+            &[
+                ("Pull requests".to_string(), Some(pulls_url(repo_name))),
+                (format!("#{}", pull.number), None),
+            ],
+        ),
+        &body,
+    )
+}
+
+/// What a pull request changes, with review threads on its lines:
+/// /repo/<name>/pulls/<number>/files
+pub fn files_page(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    number: u64,
+    query: &HashMap<String, String>,
+) -> Response {
+    let pull = match load(repo_path, number) {
+        Ok(pull) => pull,
+        Err(failure) => return failure.into_response(),
+    };
+    let review = match Review::pull(repo_name, repo_path, &pull) {
+        Ok(review) => review,
+        Err(e) => return (StatusCode::INTERNAL_SERVER_ERROR, format!("{:#}", e)).into_response(),
+    };
+    let action = format!("{}/{}", pulls_url(repo_name), number);
+    let body = format!(
+        "<h1>{} <small>#{}</small></h1>\n<p>Changes on <code>{}</code> since it branched from <code>{}</code> &middot; <a href=\"{}\">Conversation</a></p>\n<div class=\"section\"><h2>Files changed</h2>{}</div>\n",
+        html_escape(&pull.title),
+        pull.number,
+        html_escape(&pull.head),
+        html_escape(&pull.base),
+        action,
+        review.render(server, query)
+    );
+    render_page(
+        server,
+        &format!("{} - #{} files", repo_name, pull.number),
+        &breadcrumb(
+            repo_name,
+            &[
+                ("Pull requests".to_string(), Some(pulls_url(repo_name))),
+                (format!("#{}", pull.number), Some(action)),
+                ("Files".to_string(), None),
+            ],
+        ),
+        &body,
+    )
+}
+
+/// Review forms posted to /repo/<name>/pulls/<number>/files
+pub fn files_form(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    path: &str,
+    form: &HashMap<String, String>,
+) -> Response {
+    let number = path
+        .trim_start_matches("pulls/")
+        .trim_end_matches("/files")
+        .parse();
+    let pull = match number.map(|number| load(repo_path, number)) {
+        Ok(Ok(pull)) => pull,
+        Ok(Err(failure)) => return failure.into_response(),
+        Err(_) => return Failure::NotFound.into_response(),
+    };
+    match Review::pull(repo_name, repo_path, &pull) {
+        Ok(review) => review.save_form(server, form),
+        Err(e) => (StatusCode::UNPROCESSABLE_ENTITY, format!("{:#}", e)).into_response(),
+    }
+}
+
+/// Comment on, close, reopen, edit, merge or update a pull request from its
+/// page
+pub async fn save_form(
+    server: Arc<WebServer>,
+    repo_name: String,
+    repo_path: PathBuf,
+    number: u64,
+    form: HashMap<String, String>,
+) -> Response {
+    let user = match current_user() {
+        Some(user) => user,
+        None => {
+            return (
+                StatusCode::UNAUTHORIZED,
+                "Sign in to take part in pull requests",
+            )
+                .into_response()
+        }
+    };
+    let field = |key: &str| form.get(key).map(String::as_str).unwrap_or("");
+    let strategy = || {
+        field("strategy")
+            .parse::<Strategy>()
+            .map_err(Failure::Invalid)
+    };
+    let result = match field("action") {
+        "comment" => comment(
+            &server,
+            &repo_name,
+            &repo_path,
+            number,
+            &user,
+            field("body"),
+        )
+        .map(drop),
+        "close" => apply(
+            &server,
+            &repo_name,
+            &repo_path,
+            number,
+            &user,
+            Change::state(PullState::Closed),
+        )
+        .map(drop),
+        "reopen" => apply(
+            &server,
+            &repo_name,
+            &repo_path,
+            number,
+            &user,
+            Change::state(PullState::Open),
+        )
+        .map(drop),
+        "edit" => apply(
+            &server,
+            &repo_name,
+            &repo_path,
+            number,
+            &user,
+            Change {
+                title: Some(field("title").to_string()),
+                body: Some(field("body").to_string()),
+                state: None,
+            },
+        )
+        .map(drop),
+        "merge" => match strategy() {
+            Ok(strategy) => merge(
+                &server,
+                &repo_name,
+                &repo_path,
+                number,
+                &user,
+                Some(strategy),
+                None,
+            )
+            .await
+            .and_then(outcome_result),
+            Err(failure) => Err(failure),
+        },
+        "update-branch" => match strategy() {
+            Ok(strategy) => update_branch(&server, &repo_name, &repo_path, number, &user, strategy)
+                .await
+                .and_then(outcome_result),
+            Err(failure) => Err(failure),
+        },
+        action => Err(Failure::Invalid(format!("Unknown action '{}'", action))),
+    };
+    match result {
+        Ok(_) => Redirect::to(&format!("{}/{}", pulls_url(&repo_name), number)).into_response(),
+        Err(Failure::Invalid(e)) => pull_page(&server, &repo_name, &repo_path, number, Some(&e)),
+        Err(failure) => failure.into_response(),
+    }
+}
+
+/// Conflicts as a failure to show, for forms
+fn outcome_result(outcome: Outcome) -> Result<(), Failure> {
+    match outcome {
+        Outcome::Conflicts { conflicts } => Err(Failure::Invalid(format!(
+            "Nothing changed because these files conflict: {}",
+            conflicts
+                .iter()
+                .map(|c| format!("{} ({})", c.path, c.kind))
+                .collect::<Vec<_>>()
+                .join(", ")
+        ))),
+        _ => Ok(()),
+    }
+}
+
+/// Changes to a pull request, from the edit form or the API
+#[derive(Default, Deserialize)]
+pub struct Change {
+    title: Option<String>,
+    body: Option<String>,
+    /// open or closed
+    state: Option<String>,
+}
+
+impl Change {
+    fn state(state: PullState) -> Self {
+        Self {
+            state: Some(state.name().to_string()),
+            ..Default::default()
+        }
+    }
+}
+
+/// Why a pull request could not be changed
+enum Failure {
+    NotFound,
+    Forbidden(&'static str),
+    /// The change itself is wrong; shown to the user
+    Invalid(String),
+    Internal(String),
+}
+
+impl IntoResponse for Failure {
+    fn into_response(self) -> Response {
+        match self {
+            Failure::NotFound => (StatusCode::NOT_FOUND, "Pull request not found".to_string()),
+            Failure::Forbidden(message) => (StatusCode::FORBIDDEN, message.to_string()),
+            Failure::Invalid(e) => (StatusCode::UNPROCESSABLE_ENTITY, e),
+            Failure::Internal(e) => (StatusCode::INTERNAL_SERVER_ERROR, e),
+        }
+        .into_response()
+    }
+}
+
+fn comment(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    number: u64,
+    user: &str,
+    text: &str,
+) -> Result<Pull, Failure> {
+    load(repo_path, number)?;
+    let pull = pulls::update(repo_path, number, |pull| pull.comment(user, text))
+        .map_err(|e| Failure::Invalid(format!("{:#}", e)))?;
+    notify_mentions(server, repo_name, &pull, user, text);
+    Ok(pull)
+}
+
+fn apply(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    number: u64,
+    user: &str,
+    change: Change,
+) -> Result<Pull, Failure> {
+    let pull = load(repo_path, number)?;
+    if !may_edit(server, repo_path, &pull) {
+        return Err(Failure::Forbidden(
+            "Only the pull request's author and users with write access may change it",
+        ));
+    }
+    let state = change
+        .state
+        .as_deref()
+        .map(str::parse::<PullState>)
+        .transpose()
+        .map_err(Failure::Invalid)?;
+    let new_body = change.body.clone();
+    let pull = pulls::update(repo_path, number, |pull| {
+        if let Some(title) = &change.title {
+            pull.set_title(title)?;
+        }
+        if let Some(body) = &change.body {
+            pull.body = body.trim_end().to_string();
+        }
+        if let Some(state) = state {
+            pull.set_state(state, user)?;
+        }
+        Ok(())
+    })
+    .map_err(|e| Failure::Invalid(format!("{:#}", e)))?;
+    if let Some(body) = new_body {
+        notify_mentions(server, repo_name, &pull, user, &body);
+    }
+    Ok(pull)
+}
+
+/// Run a merge or branch update off the async runtime, then measure the
+/// repository and push it to its mirrors if a branch moved
+async fn run_merge(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    number: u64,
+    run: impl FnOnce(&std::path::Path) -> anyhow::Result<Outcome> + Send + 'static,
+) -> Result<Outcome, Failure> {
+    if !server.has_role(repo_path, Role::Write) {
+        return Err(Failure::Forbidden(
+            "Merging needs write access to the repository",
+        ));
+    }
+    if let Some(refusal) = maintenance_mode::refusal(&server.data_dir, repo_name, repo_path) {
+        return Err(Failure::Invalid(refusal));
+    }
+    load(repo_path, number)?;
+    let usage = server.disk_usage.clone();
+    let (repo_name, repo_path) = (repo_name.to_string(), repo_path.clone());
+    let result = tokio::task::spawn_blocking(move || {
+        let outcome = run(&repo_path)?;
+        if let Outcome::Merged { .. } = outcome {
+            if let Err(e) = usage.refresh_repo(&repo_name, &repo_path) {
+                tracing::warn!("Failed to measure {} after merge: {}", repo_name, e);
+            }
+            mirror::push_all(&repo_path);
+        }
+        Ok::<_, anyhow::Error>(outcome)
+    })
+    .await;
+    match result {
+        Ok(Ok(outcome)) => Ok(outcome),
+        Ok(Err(e)) => Err(Failure::Invalid(format!("{:#}", e))),
+        Err(e) => Err(Failure::Internal(e.to_string())),
+    }
+}
+
+async fn merge(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    number: u64,
+    user: &str,
+    strategy: Option<Strategy>,
+    message: Option<String>,
+) -> Result<Outcome, Failure> {
+    let user = user.to_string();
+    run_merge(server, repo_name, repo_path, number, move |repo_path| {
+        pulls::merge(repo_path, number, strategy, message, &user)
+    })
+    .await
+}
+
+async fn update_branch(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    number: u64,
+    user: &str,
+    strategy: Strategy,
+) -> Result<Outcome, Failure> {
+    let user = user.to_string();
+    run_merge(server, repo_name, repo_path, number, move |repo_path| {
+        pulls::update_branch(repo_path, number, strategy, &user)
+    })
+    .await
+}
+
+/// GET /api/v1/repos/<name>/pulls?state=open|closed|merged|all
+pub async fn api_list(
+    State(server): State<Arc<WebServer>>,
+    Path(repo_name): Path<String>,
+    Query(query): Query<HashMap<String, String>>,
+) -> Response {
+    let repo_path = match server.resolve_repo(&repo_name) {
+        Some((_, path)) => path,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    let state = match query.get("state").map(String::as_str) {
+        None => Some(PullState::Open),
+        Some("all") => None,
+        Some(state) => match state.parse() {
+            Ok(state) => Some(state),
+            Err(e) => return (StatusCode::BAD_REQUEST, e).into_response(),
+        },
+    };
+    match pulls::list(&repo_path, state) {
+        Ok(found) => Json(found).into_response(),
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
+
+#[derive(Deserialize)]
+pub struct NewPull {
+    base: String,
+    head: String,
+    title: String,
+    #[serde(default)]
+    body: String,
+}
+
+/// POST /api/v1/repos/<name>/pulls with
+/// `{"base": "main", "head": "feature", "title": ..., "body": ...}`
+pub async fn api_create(
+    State(server): State<Arc<WebServer>>,
+    Path(repo_name): Path<String>,
+    Json(request): Json<NewPull>,
+) -> Response {
+    let (repo_name, repo_path) = match server.resolve_repo(&repo_name) {
+        Some(found) => found,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    let user = match current_user() {
+        Some(user) => user,
+        None => return (StatusCode::UNAUTHORIZED, "Sign in to open pull requests").into_response(),
+    };
+    match pulls::create(
+        &repo_path,
+        &user,
+        &request.base,
+        &request.head,
+        &request.title,
+        &request.body,
+    ) {
+        Ok(pull) => {
+            notify_mentions(&server, &repo_name, &pull, &user, &pull.body);
+            (StatusCode::CREATED, Json(pull)).into_response()
+        }
+        Err(e) => (StatusCode::UNPROCESSABLE_ENTITY, format!("{:#}", e)).into_response(),
+    }
+}
+
+/// GET /api/v1/repos/<name>/pulls/<number>, with ahead/behind counts and
+/// mergeability while it is open
+pub async fn api_get(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, number)): Path<(String, u64)>,
+) -> Response {
+    let repo_path = match server.resolve_repo(&repo_name) {
+        Some((_, path)) => path,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    let pull = match load(&repo_path, number) {
+        Ok(pull) => pull,
+        Err(failure) => return failure.into_response(),
+    };
+    let mut value = match serde_json::to_value(&pull) {
+        Ok(value) => value,
+        Err(e) => return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    };
+    if pull.state == PullState::Open {
+        let (base, head) = pulls::compared(&repo_path, &pull);
+        if let Some((ahead, behind)) = server.divergence.ahead_behind(&repo_path, &base, &head) {
+            value["ahead"] = ahead.into();
+            value["behind"] = behind.into();
+        }
+        match pulls::mergeability(&repo_path, &pull) {
+            Ok(mergeability) => {
+                value["mergeability"] = serde_json::to_value(mergeability).unwrap_or_default()
+            }
+            Err(e) => tracing::warn!("Failed to check #{} for conflicts: {:#}", number, e),
+        }
+    }
+    Json(value).into_response()
+}
+
+/// GET /api/v1/repos/<name>/pulls/<number>/diff, as a plain-text patch,
+/// streamed in full however large it is
+pub async fn api_diff(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, number)): Path<(String, u64)>,
+) -> Response {
+    let repo_path = match server.resolve_repo(&repo_name) {
+        Some((_, path)) => path,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    let pull = match load(&repo_path, number) {
+        Ok(pull) => pull,
+        Err(failure) => return failure.into_response(),
+    };
+    let (base, head) = pulls::compared(&repo_path, &pull);
+    let range = format!("{}...{}", base, head);
+    let command = stream::git(&repo_path, &diff_args(&range));
+    match stream::spawn(&server, Pool::Web, command).await {
+        Ok(output) => (
+            [(header::CONTENT_TYPE, "text/plain; charset=utf-8")],
+            output.body(),
+        )
+            .into_response(),
+        Err(response) => response,
+    }
+}
+
+/// PATCH /api/v1/repos/<name>/pulls/<number> with any of `title`, `body`
+/// and `state` (open or closed)
+pub async fn api_update(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, number)): Path<(String, u64)>,
+    Json(change): Json<Change>,
+) -> Response {
+    let (repo_name, repo_path) = match server.resolve_repo(&repo_name) {
+        Some(found) => found,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    let user = match current_user() {
+        Some(user) => user,
+        None => {
+            return (StatusCode::UNAUTHORIZED, "Sign in to change pull requests").into_response()
+        }
+    };
+    match apply(&server, &repo_name, &repo_path, number, &user, change) {
+        Ok(pull) => Json(pull).into_response(),
+        Err(failure) => failure.into_response(),
+    }
+}
+
+#[derive(Deserialize)]
+pub struct NewComment {
+    body: String,
+}
+
+/// POST /api/v1/repos/<name>/pulls/<number>/comments with `{"body": ...}`
+pub async fn api_comment(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, number)): Path<(String, u64)>,
+    Json(request): Json<NewComment>,
+) -> Response {
+    let (repo_name, repo_path) = match server.resolve_repo(&repo_name) {
+        Some(found) => found,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    let user = match current_user() {
+        Some(user) => user,
+        None => return (StatusCode::UNAUTHORIZED, "Sign in to comment").into_response(),
+    };
+    match comment(
+        &server,
+        &repo_name,
+        &repo_path,
+        number,
+        &user,
+        &request.body,
+    ) {
+        Ok(pull) => (StatusCode::CREATED, Json(pull)).into_response(),
+        Err(failure) => failure.into_response(),
+    }
+}
+
+#[derive(Deserialize)]
+pub struct MergeRequest {
+    /// merge, squash or rebase; the repository's default if missing
+    #[serde(default)]
+    strategy: Option<String>,
+    #[serde(default)]
+    message: Option<String>,
+}
+
+/// Answer a merge or branch update like the merge API: 200 with the outcome,
+/// or 409 with the conflicting files, in which case nothing changed
+fn outcome_response(result: Result<Outcome, Failure>) -> Response {
+    match result {
+        Ok(outcome) => {
+            let status = match outcome {
+                Outcome::Conflicts { .. } => StatusCode::CONFLICT,
+                _ => StatusCode::OK,
+            };
+            (status, Json(outcome)).into_response()
+        }
+        Err(Failure::Invalid(e)) => (
+            StatusCode::UNPROCESSABLE_ENTITY,
+            Json(serde_json::json!({ "status": "failed", "error": e })),
+        )
+            .into_response(),
+        Err(failure) => failure.into_response(),
+    }
+}
+
+/// POST /api/v1/repos/<name>/pulls/<number>/merge with
+/// `{"strategy": "squash", "message": ...}`, both optional
+pub async fn api_merge(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, number)): Path<(String, u64)>,
+    Json(request): Json<MergeRequest>,
+) -> Response {
+    let (repo_name, repo_path) = match server.resolve_repo(&repo_name) {
+        Some(found) => found,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    let user = match current_user() {
+        Some(user) => user,
+        None => return (StatusCode::UNAUTHORIZED, "Sign in to merge").into_response(),
+    };
+    let strategy = match request.strategy.as_deref().map(str::parse).transpose() {
+        Ok(strategy) => strategy,
+        Err(e) => return outcome_response(Err(Failure::Invalid(e))),
+    };
+    let message = request.message.filter(|m| !m.trim().is_empty());
+    outcome_response(
+        merge(
+            &server, &repo_name, &repo_path, number, &user, strategy, message,
+        )
+        .await,
+    )
+}
+
+#[derive(Deserialize)]
+pub struct UpdateRequest {
+    /// merge or rebase; merge if missing
+    #[serde(default)]
+    strategy: Option<String>,
+}
+
+/// POST /api/v1/repos/<name>/pulls/<number>/update-branch with
+/// `{"strategy": "rebase"}`: bring the head branch up to date with the base
+pub async fn api_update_branch(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, number)): Path<(String, u64)>,
+    Json(request): Json<UpdateRequest>,
+) -> Response {
+    let (repo_name, repo_path) = match server.resolve_repo(&repo_name) {
+        Some(found) => found,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    let user = match current_user() {
+        Some(user) => user,
+        None => return (StatusCode::UNAUTHORIZED, "Sign in to update branches").into_response(),
+    };
+    let strategy = match request.strategy.as_deref().unwrap_or("merge").parse() {
+        Ok(strategy) => strategy,
+        Err(e) => return outcome_response(Err(Failure::Invalid(e))),
+    };
+    outcome_response(update_branch(&server, &repo_name, &repo_path, number, &user, strategy).await)
+}
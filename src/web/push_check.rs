@@ -0,0 +1,96 @@
+use super::auth::current_user;
+use super::WebServer;
+use crate::orgs::Role;
+use crate::{git, push_check};
+use axum::{
+    body::Body,
+    extract::{Path, State},
+    http::StatusCode,
+    response::{IntoResponse, Response},
+    Json,
+};
+use futures::StreamExt;
+use std::sync::Arc;
+use tokio::io::AsyncWriteExt;
+
+/// Check a push without making it: POST /api/v1/repos/<name>/push-check with
+/// the refs and pack described in [`push_check`] as the body. Answers with
+/// whether the push would be accepted and the rules it breaks.
+pub async fn api(
+    State(server): State<Arc<WebServer>>,
+    Path(repo_name): Path<String>,
+    body: Body,
+) -> Response {
+    let repo_path = match server.resolve_repo(&repo_name) {
+        Some((_, path)) => path,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    if current_user().is_none() {
+        return (StatusCode::UNAUTHORIZED, "Sign in to check pushes").into_response();
+    }
+    if !server.has_role(&repo_path, Role::Write) {
+        return (
+            StatusCode::FORBIDDEN,
+            "Checking pushes needs write access to the repository",
+        )
+            .into_response();
+    }
+
+    // Spool the body, which holds a whole pack, rather than keep it in memory
+    let dir = git::data_dir(&repo_path).join("push-check");
+    let spool = dir.join(format!(
+        "{}-{}.spool",
+        std::process::id(),
+        chrono::Utc::now().timestamp_nanos_opt().unwrap_or_default()
+    ));
+    let received = async {
+        tokio::fs::create_dir_all(&dir).await?;
+        let mut file = tokio::fs::File::create(&spool).await?;
+        let mut stream = body.into_data_stream();
+        while let Some(chunk) = stream.next().await {
+            file.write_all(&chunk?).await?;
+        }
+        file.flush().await?;
+        Ok::<_, anyhow::Error>(())
+    };
+    if let Err(e) = received.await {
+        let _ = tokio::fs::remove_file(&spool).await;
+        return (
+            StatusCode::BAD_REQUEST,
+            format!("Failed to read the push: {}", e),
+        )
+            .into_response();
+    }
+
+    let result = tokio::task::spawn_blocking(move || {
+        let result = std::fs::File::open(&spool)
+            .map_err(anyhow::Error::from)
+            .and_then(|file| push_check::run(&repo_path, &mut std::io::BufReader::new(file)));
+        let _ = std::fs::remove_file(&spool);
+        result
+    })
+    .await;
+
+    match result {
+        Ok(Ok(report)) => Json(serde_json::json!({
+            "accepted": report.accepted(),
+            "updates": report
+                .updates
+                .iter()
+                .map(|(old, new, refname)| serde_json::json!({
+                    "refname": refname,
+                    "old": old,
+                    "new": new,
+                }))
+                .collect::<Vec<_>>(),
+            "violations": report.violations,
+        }))
+        .into_response(),
+        Ok(Err(e)) => (
+            StatusCode::UNPROCESSABLE_ENTITY,
+            Json(serde_json::json!({ "error": format!("{:#}", e) })),
+        )
+            .into_response(),
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
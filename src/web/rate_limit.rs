@@ -0,0 +1,55 @@
+use super::auth::remote_addr;
+use super::WebServer;
+use crate::git::limits::{self, Pool};
+use crate::rate_limit;
+use axum::{
+    extract::{Request, State},
+    http::{header, StatusCode},
+    middleware::Next,
+    response::{IntoResponse, Response},
+};
+use std::sync::Arc;
+
+/// Turn away clients over the per-address request rate with 429 Too Many
+/// Requests. Runs after authentication, which finds the client's address.
+pub async fn middleware(
+    State(server): State<Arc<WebServer>>,
+    req: Request,
+    next: Next,
+) -> Response {
+    if let Some(remote) = remote_addr() {
+        if let Err(wait) = server.rate_limiter.request(&remote) {
+            return (
+                StatusCode::TOO_MANY_REQUESTS,
+                [(
+                    header::RETRY_AFTER,
+                    rate_limit::retry_after(wait).to_string(),
+                )],
+                "Too many requests; slow down\n",
+            )
+                .into_response();
+        }
+    }
+    next.run(req).await
+}
+
+/// Count the git a request runs in the web pool, and answer 503 Service
+/// Unavailable if any of it waited too long for a place
+pub async fn git_pools(State(server): State<Arc<WebServer>>, req: Request, next: Next) -> Response {
+    let (response, refused) = server
+        .git_pools
+        .scope(Pool::Web, async {
+            let response = next.run(req).await;
+            (response, limits::refused())
+        })
+        .await;
+    if refused {
+        return (
+            StatusCode::SERVICE_UNAVAILABLE,
+            [(header::RETRY_AFTER, "10")],
+            "The server is busy; try again shortly\n",
+        )
+            .into_response();
+    }
+    response
+}
@@ -0,0 +1,981 @@
+use super::auth::{current_user, remote_addr};
+use super::settings::error_message;
+use super::{
+    breadcrumb, embed, html_escape, markdown, relative_time, render_page, url_path, WebServer,
+};
+use crate::archive;
+use crate::audit::{self, Action, Via};
+use crate::orgs::Role;
+use crate::releases::{self, Asset, Release};
+use crate::usage;
+use axum::{
+    body::{Body, Bytes},
+    extract::{Path, Query, State},
+    http::{header, HeaderMap, StatusCode},
+    response::{IntoResponse, Redirect, Response},
+    Json,
+};
+use futures::StreamExt;
+use serde::Deserialize;
+use std::collections::HashMap;
+use std::path::PathBuf;
+use std::sync::Arc;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+
+/// Releases listed on the releases page
+const LIST_ENTRIES: usize = 50;
+
+/// Releases in the feed
+const FEED_ENTRIES: usize = 20;
+
+/// Commits of each release's changelog on the releases page and in the
+/// feed, before a link to the rest
+const LIST_CHANGES: usize = 10;
+
+/// Commits of the changelog on a release's own page
+const PAGE_CHANGES: usize = 500;
+
+fn releases_url(repo_name: &str) -> String {
+    format!("/repo/{}/releases", url_path(repo_name))
+}
+
+fn release_url(repo_name: &str, tag: &str) -> String {
+    format!("{}/tag/{}", releases_url(repo_name), url_path(tag))
+}
+
+fn feed_url(repo_name: &str) -> String {
+    format!("/repo/{}/releases.atom", url_path(repo_name))
+}
+
+/// Where an asset is downloaded from
+fn download_url(repo_name: &str, tag: &str, asset: &str) -> String {
+    format!(
+        "{}/download/{}/{}",
+        releases_url(repo_name),
+        url_path(tag),
+        url_path(asset)
+    )
+}
+
+fn record_change(server: &WebServer, repo_name: &str, tag: &str, change: String) {
+    audit::Entry::new(Action::ReleaseChange, Via::Web, current_user().as_deref())
+        .with_repo(repo_name)
+        .with_target(tag)
+        .with_detail(change)
+        .with_remote(remote_addr())
+        .record(&server.data_dir);
+}
+
+/// Whether the signed-in user may publish and edit releases: those with
+/// write access
+fn may_publish(server: &WebServer, repo_path: &PathBuf) -> bool {
+    current_user().is_some() && server.has_role(repo_path, Role::Write)
+}
+
+/// A release, if it exists and the user may see it; drafts are only shown to
+/// those who may publish them
+fn find(server: &WebServer, repo_path: &PathBuf, tag: &str) -> Result<Release, Failure> {
+    match releases::get(repo_path, tag) {
+        Ok(Some(release)) if !release.draft || may_publish(server, repo_path) => Ok(release),
+        Ok(_) => Err(Failure::NotFound),
+        Err(e) => Err(Failure::Internal(format!("{:#}", e))),
+    }
+}
+
+fn visible(server: &WebServer, repo_path: &PathBuf) -> Vec<Release> {
+    let publisher = may_publish(server, repo_path);
+    releases::list(repo_path)
+        .unwrap_or_default()
+        .into_iter()
+        .filter(|release| publisher || !release.draft)
+        .collect()
+}
+
+/// What the releases page shows of a tag: its release, or the tag itself for
+/// an annotated tag without one
+enum Entry {
+    Published(Release),
+    Tag(releases::Tag),
+}
+
+impl Entry {
+    fn tag(&self) -> &str {
+        match self {
+            Entry::Published(release) => &release.tag,
+            Entry::Tag(tag) => &tag.name,
+        }
+    }
+
+    fn title(&self) -> &str {
+        match self {
+            Entry::Published(release) => release.title(),
+            Entry::Tag(tag) => &tag.name,
+        }
+    }
+
+    fn time(&self) -> i64 {
+        match self {
+            Entry::Published(release) => release.created,
+            Entry::Tag(tag) => tag.time,
+        }
+    }
+
+    fn author(&self) -> &str {
+        match self {
+            Entry::Published(release) => &release.author,
+            Entry::Tag(tag) => &tag.tagger,
+        }
+    }
+
+    fn badges(&self) -> String {
+        match self {
+            Entry::Published(release) => badges(release),
+            Entry::Tag(_) => String::new(),
+        }
+    }
+
+    /// The release notes, or the tag's message, as HTML
+    fn notes(&self) -> String {
+        match self {
+            Entry::Published(release) => markdown::render(&release.body),
+            Entry::Tag(tag) if tag.message.is_empty() => String::new(),
+            Entry::Tag(tag) => format!("<pre>{}</pre>\n", html_escape(&tag.message)),
+        }
+    }
+}
+
+/// The releases the user may see, and annotated tags without a release,
+/// newest first. Tags of drafts are left out with them.
+fn entries(server: &WebServer, repo_path: &PathBuf, tags: &[releases::Tag]) -> Vec<Entry> {
+    let all = releases::list(repo_path).unwrap_or_default();
+    let mut entries: Vec<Entry> = visible(server, repo_path)
+        .into_iter()
+        .map(Entry::Published)
+        .collect();
+    entries.extend(
+        tags.iter()
+            .filter(|tag| tag.annotated && !all.iter().any(|release| release.tag == tag.name))
+            .cloned()
+            .map(Entry::Tag),
+    );
+    entries.sort_by(|a, b| b.time().cmp(&a.time()).then(b.tag().cmp(a.tag())));
+    entries
+}
+
+/// "<tag> · <when> by <who>"
+fn byline(repo_name: &str, entry: &Entry) -> String {
+    format!(
+        "<p><small><a href=\"/repo/{}/tag/{}\">{}</a> &middot; {} by {}</small></p>\n",
+        url_path(repo_name),
+        url_path(entry.tag()),
+        html_escape(entry.tag()),
+        relative_time(entry.time()),
+        html_escape(entry.author())
+    )
+}
+
+/// The source at the tag as archives, then the release's assets; nothing
+/// for a release whose tag is gone
+fn downloads_html(repo_name: &str, entry: &Entry, tags: &[releases::Tag]) -> String {
+    let mut out = String::new();
+    if tags.iter().any(|tag| tag.name == entry.tag()) {
+        let archive_url = format!(
+            "/repo/{}/archive/{}",
+            url_path(repo_name),
+            url_path(entry.tag())
+        );
+        out.push_str(&format!(
+            "<p><small>Source code: <a href=\"{0}.tar.gz\">.tar.gz</a> <a href=\"{0}.zip\">.zip</a></small></p>\n",
+            archive_url
+        ));
+    }
+    if let Entry::Published(release) = entry {
+        out.push_str(&assets_html(repo_name, release));
+    }
+    out
+}
+
+/// The commits since the tag before, up to `limit` of them, then a link to
+/// `more` if given
+fn changelog_html(
+    repo_name: &str,
+    repo_path: &PathBuf,
+    tags: &[releases::Tag],
+    tag: &str,
+    limit: usize,
+    more: Option<&str>,
+) -> String {
+    if !tags.iter().any(|t| t.name == tag) {
+        return String::new();
+    }
+    let previous = releases::previous(tags, tag);
+    let mut changes = releases::changelog(repo_path, tag, previous, limit + 1).unwrap_or_default();
+    if changes.is_empty() {
+        return String::new();
+    }
+    let mut out = match previous {
+        Some(previous) => format!(
+            "<h3>Changes since <a href=\"/repo/{}/tag/{}\">{}</a></h3>\n",
+            url_path(repo_name),
+            url_path(previous),
+            html_escape(previous)
+        ),
+        None => "<h3>Changes</h3>\n".to_string(),
+    };
+    let truncated = changes.len() > limit;
+    changes.truncate(limit);
+    out.push_str("<ul class=\"changelog\">\n");
+    for change in &changes {
+        out.push_str(&format!(
+            "<li><a href=\"/repo/{}/commit/{}\"><code>{}</code></a> {} <small>{}</small></li>\n",
+            url_path(repo_name),
+            change.hash,
+            &change.hash[..8.min(change.hash.len())],
+            html_escape(&change.subject),
+            html_escape(&change.author)
+        ));
+    }
+    out.push_str("</ul>\n");
+    if truncated {
+        out.push_str(&match more {
+            Some(url) => format!("<p><a href=\"{}\">All changes</a></p>\n", url),
+            None => format!(
+                "<p><small>Only the latest {} commits are shown.</small></p>\n",
+                limit
+            ),
+        });
+    }
+    out
+}
+
+/// "Release: <title>" linking to the release of a tag, or nothing if it has
+/// none the user may see
+pub fn release_link(server: &WebServer, repo_name: &str, repo_path: &PathBuf, tag: &str) -> String {
+    match find(server, repo_path, tag) {
+        Ok(release) => format!(
+            "<p>Release: <a href=\"{}\">{}</a>{}</p>\n",
+            release_url(repo_name, tag),
+            html_escape(release.title()),
+            badges(&release)
+        ),
+        Err(_) => String::new(),
+    }
+}
+
+fn badges(release: &Release) -> String {
+    let mut out = String::new();
+    if release.draft {
+        out.push_str(" <span class=\"label\">draft</span>");
+    }
+    if release.prerelease {
+        out.push_str(" <span class=\"label\">pre-release</span>");
+    }
+    out
+}
+
+fn assets_html(repo_name: &str, release: &Release) -> String {
+    if release.assets.is_empty() {
+        return String::new();
+    }
+    let mut out = String::from("<ul class=\"assets\">\n");
+    for asset in &release.assets {
+        out.push_str(&format!(
+            "<li><a href=\"{}\">{}</a> <small>{} &middot; sha256 <code>{}</code></small></li>\n",
+            download_url(repo_name, &release.tag, &asset.name),
+            html_escape(&asset.name),
+            usage::format_bytes(asset.size),
+            html_escape(&asset.sha256)
+        ));
+    }
+    out.push_str("</ul>\n");
+    out
+}
+
+/// Tags without a release, newest first, to offer for a new one
+fn unreleased_tags(server: &WebServer, repo_path: &PathBuf) -> Vec<String> {
+    let released = releases::list(repo_path).unwrap_or_default();
+    server
+        .get_tags(repo_path, "refs/tags", 100)
+        .unwrap_or_default()
+        .into_iter()
+        .map(|tag| tag.name)
+        .filter(|tag| !released.iter().any(|release| &release.tag == tag))
+        .collect()
+}
+
+fn release_fields(release: Option<&Release>) -> String {
+    let checked = |on: bool| if on { " checked" } else { "" };
+    format!(
+        "<input type=\"text\" name=\"name\" placeholder=\"Title (the tag if empty)\" size=\"50\" value=\"{}\"><br>\n<textarea name=\"body\" rows=\"8\" cols=\"80\" placeholder=\"Release notes (Markdown)\">{}</textarea><br>\n<label><input type=\"checkbox\" name=\"prerelease\" value=\"on\"{}> Pre-release</label> <label><input type=\"checkbox\" name=\"draft\" value=\"on\"{}> Draft, only shown to those with write access</label><br>\n",
+        html_escape(release.map_or("", |r| r.name.as_str())),
+        html_escape(release.map_or("", |r| r.body.as_str())),
+        checked(release.map_or(false, |r| r.prerelease)),
+        checked(release.map_or(false, |r| r.draft))
+    )
+}
+
+/// A repository's releases: /repo/<name>/releases
+pub fn list_page(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    error: Option<&str>,
+) -> Response {
+    let tags = releases::tags(repo_path).unwrap_or_default();
+    let entries = entries(server, repo_path, &tags);
+    let mut body = format!(
+        "<h1>Releases</h1>\n<p><a href=\"/repo/{}/tags\">Tags</a> &middot; <a href=\"{}\">Release feed (Atom)</a></p>\n",
+        url_path(repo_name),
+        feed_url(repo_name)
+    );
+    body.push_str(&error_message(error));
+    if entries.is_empty() {
+        body.push_str("<p>No releases yet. Annotated tags show up here with their message.</p>\n");
+    }
+    for entry in entries.iter().take(LIST_ENTRIES) {
+        body.push_str(&format!(
+            "<div class=\"section\"><h2><a href=\"{}\">{}</a>{}</h2>\n{}{}{}{}</div>\n",
+            release_url(repo_name, entry.tag()),
+            html_escape(entry.title()),
+            entry.badges(),
+            byline(repo_name, entry),
+            entry.notes(),
+            downloads_html(repo_name, entry, &tags),
+            changelog_html(
+                repo_name,
+                repo_path,
+                &tags,
+                entry.tag(),
+                LIST_CHANGES,
+                Some(&release_url(repo_name, entry.tag()))
+            )
+        ));
+    }
+
+    if may_publish(server, repo_path) && !archive::is_archived(repo_path) {
+        let tags = unreleased_tags(server, repo_path);
+        if tags.is_empty() {
+            body.push_str("<p><small>Push a tag to publish a release of it.</small></p>\n");
+        } else {
+            let options: String = tags
+                .iter()
+                .map(|tag| format!("<option value=\"{0}\">{0}</option>", html_escape(tag)))
+                .collect();
+            body.push_str(&format!(
+                "<h2>New release</h2>\n<form method=\"post\" action=\"{}\">\n<input type=\"hidden\" name=\"action\" value=\"create\">\n<select name=\"tag\">{}</select><br>\n{}<button type=\"submit\">Publish</button>\n</form>\n<p><small>Attach files with <code>agito release &lt;name&gt; upload &lt;tag&gt; &lt;file&gt;</code> or the API.</small></p>\n",
+                releases_url(repo_name),
+                options,
+                release_fields(None)
+            ));
+        }
+    }
+
+    render_page(
+        server,
+        &format!("{} - Releases", repo_name),
+        &breadcrumb(repo_name, &[("releases".to_string(), None)]),
+        &body,
+    )
+}
+
+/// One release, or annotated tag: /repo/<name>/releases/tag/<tag>
+pub fn release_page(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    tag: &str,
+    error: Option<&str>,
+) -> Response {
+    let tags = releases::tags(repo_path).unwrap_or_default();
+    let entry = match find(server, repo_path, tag) {
+        Ok(release) => Entry::Published(release),
+        Err(Failure::NotFound) => match tags.iter().find(|t| t.name == tag && t.annotated) {
+            Some(tag) => Entry::Tag(tag.clone()),
+            None => return Failure::NotFound.into_response(),
+        },
+        Err(failure) => return failure.into_response(),
+    };
+    let mut body = format!(
+        "<h1>{}{}</h1>\n{}",
+        html_escape(entry.title()),
+        entry.badges(),
+        byline(repo_name, &entry)
+    );
+    body.push_str(&error_message(error));
+    body.push_str(&entry.notes());
+    body.push_str(&downloads_html(repo_name, &entry, &tags));
+    body.push_str(&changelog_html(
+        repo_name,
+        repo_path,
+        &tags,
+        entry.tag(),
+        PAGE_CHANGES,
+        None,
+    ));
+
+    if let Entry::Published(release) = &entry {
+        if may_publish(server, repo_path) && !archive::is_archived(repo_path) {
+            body.push_str(&edit_forms(repo_name, release));
+        }
+    }
+
+    render_page(
+        server,
+        &format!("{} - {}", repo_name, entry.title()),
+        &breadcrumb(
+            repo_name,
+            &[
+                ("releases".to_string(), Some(releases_url(repo_name))),
+                (entry.tag().to_string(), None),
+            ],
+        ),
+        &body,
+    )
+}
+
+fn edit_forms(repo_name: &str, release: &Release) -> String {
+    let action = releases_url(repo_name);
+    let tag_field = format!(
+        "<input type=\"hidden\" name=\"tag\" value=\"{}\">",
+        html_escape(&release.tag)
+    );
+    let mut out = format!(
+        "<h2>Edit</h2>\n<form method=\"post\" action=\"{}\">\n<input type=\"hidden\" name=\"action\" value=\"edit\">{}\n{}<button type=\"submit\">Save</button>\n</form>\n",
+        action,
+        tag_field,
+        release_fields(Some(release))
+    );
+    for asset in &release.assets {
+        out.push_str(&format!(
+            "<form method=\"post\" action=\"{}\"><input type=\"hidden\" name=\"action\" value=\"remove-asset\">{}<input type=\"hidden\" name=\"asset\" value=\"{}\"><button type=\"submit\">Remove {}</button></form>\n",
+            action,
+            tag_field,
+            html_escape(&asset.name),
+            html_escape(&asset.name)
+        ));
+    }
+    out.push_str(&format!(
+        "<form method=\"post\" action=\"{}\"><input type=\"hidden\" name=\"action\" value=\"delete\">{}<button type=\"submit\">Delete release</button> <small>The tag stays.</small></form>\n",
+        action, tag_field
+    ));
+    out
+}
+
+/// Atom feed of a repository's releases, drafts left out:
+/// /repo/<name>/releases.atom
+pub fn feed(
+    server: &WebServer,
+    headers: &HeaderMap,
+    repo_name: &str,
+    repo_path: &PathBuf,
+) -> Response {
+    let base = embed::base_url(server, headers);
+    let tags = releases::tags(repo_path).unwrap_or_default();
+    let entries: Vec<Entry> = entries(server, repo_path, &tags)
+        .into_iter()
+        .filter(|entry| !matches!(entry, Entry::Published(release) if release.draft))
+        .take(FEED_ENTRIES)
+        .collect();
+
+    let mut items = String::new();
+    for entry in &entries {
+        let link = format!("{}{}", base, release_url(repo_name, entry.tag()));
+        let content = format!(
+            "{}{}{}",
+            entry.notes(),
+            downloads_html(repo_name, entry, &tags),
+            changelog_html(
+                repo_name,
+                repo_path,
+                &tags,
+                entry.tag(),
+                LIST_CHANGES,
+                Some(&release_url(repo_name, entry.tag()))
+            )
+        );
+        items.push_str(&format!(
+            "<entry>\n<title>{}</title>\n<id>{}</id>\n<link href=\"{}\"/>\n<updated>{}</updated>\n<author><name>{}</name></author>\n<content type=\"html\">{}</content>\n</entry>\n",
+            html_escape(entry.title()),
+            html_escape(&link),
+            html_escape(&link),
+            atom_time(entry.time()),
+            html_escape(entry.author()),
+            html_escape(&content)
+        ));
+    }
+
+    let feed_url = format!("{}{}", base, feed_url(repo_name));
+    // Links in the entries' content are relative to the server
+    let xml = format!(
+        r#"<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom" xml:base="{}/">
+<title>{} releases</title>
+<id>{}</id>
+<link rel="self" href="{}"/>
+<link href="{}{}"/>
+<updated>{}</updated>
+{}</feed>
+"#,
+        html_escape(&base),
+        html_escape(repo_name),
+        html_escape(&feed_url),
+        html_escape(&feed_url),
+        html_escape(&base),
+        releases_url(repo_name),
+        atom_time(entries.first().map_or(0, Entry::time)),
+        items
+    );
+    (
+        [(header::CONTENT_TYPE, "application/atom+xml; charset=utf-8")],
+        xml,
+    )
+        .into_response()
+}
+
+fn atom_time(time: i64) -> String {
+    chrono::DateTime::from_timestamp(time, 0)
+        .map(|t| t.to_rfc3339_opts(chrono::SecondsFormat::Secs, true))
+        .unwrap_or_default()
+}
+
+/// Changes to a release, from the forms or the API
+#[derive(Default, Deserialize)]
+pub struct Change {
+    name: Option<String>,
+    body: Option<String>,
+    prerelease: Option<bool>,
+    draft: Option<bool>,
+}
+
+/// Why a release could not be changed
+enum Failure {
+    NotFound,
+    Forbidden,
+    Archived(String),
+    /// The change itself is wrong; shown to the user
+    Invalid(String),
+    Internal(String),
+}
+
+impl IntoResponse for Failure {
+    fn into_response(self) -> Response {
+        match self {
+            Failure::NotFound => (StatusCode::NOT_FOUND, "Release not found".to_string()),
+            Failure::Forbidden => (
+                StatusCode::FORBIDDEN,
+                "Only users with write access may publish and change releases".to_string(),
+            ),
+            Failure::Archived(e) => (StatusCode::CONFLICT, e),
+            Failure::Invalid(e) => (StatusCode::UNPROCESSABLE_ENTITY, e),
+            Failure::Internal(e) => (StatusCode::INTERNAL_SERVER_ERROR, e),
+        }
+        .into_response()
+    }
+}
+
+/// Check that the user may change the repository's releases now
+fn check_publish(server: &WebServer, repo_name: &str, repo_path: &PathBuf) -> Result<(), Failure> {
+    if !may_publish(server, repo_path) {
+        return Err(Failure::Forbidden);
+    }
+    if archive::is_archived(repo_path) {
+        return Err(Failure::Archived(archive::refusal(repo_name)));
+    }
+    Ok(())
+}
+
+fn create(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    tag: &str,
+    change: Change,
+) -> Result<Release, Failure> {
+    check_publish(server, repo_name, repo_path)?;
+    if !releases::tag_exists(repo_path, tag) {
+        return Err(Failure::Invalid(format!("No tag named '{}'", tag)));
+    }
+    match releases::get(repo_path, tag) {
+        Ok(None) => {}
+        Ok(Some(_)) => {
+            return Err(Failure::Invalid(format!(
+                "There is already a release of {}",
+                tag
+            )))
+        }
+        Err(e) => return Err(Failure::Internal(format!("{:#}", e))),
+    }
+    let release = Release {
+        tag: tag.to_string(),
+        name: change.name.unwrap_or_default().trim().to_string(),
+        body: change.body.unwrap_or_default().trim_end().to_string(),
+        author: current_user().unwrap_or_default(),
+        created: chrono::Utc::now().timestamp(),
+        prerelease: change.prerelease.unwrap_or(false),
+        draft: change.draft.unwrap_or(false),
+        assets: Vec::new(),
+    };
+    releases::save(repo_path, release.clone()).map_err(|e| Failure::Invalid(format!("{:#}", e)))?;
+    record_change(server, repo_name, tag, "published".to_string());
+    Ok(release)
+}
+
+fn edit(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    tag: &str,
+    change: Change,
+) -> Result<Release, Failure> {
+    check_publish(server, repo_name, repo_path)?;
+    let mut release = find(server, repo_path, tag)?;
+    if let Some(name) = change.name {
+        release.name = name.trim().to_string();
+    }
+    if let Some(body) = change.body {
+        release.body = body.trim_end().to_string();
+    }
+    if let Some(prerelease) = change.prerelease {
+        release.prerelease = prerelease;
+    }
+    if let Some(draft) = change.draft {
+        release.draft = draft;
+    }
+    releases::save(repo_path, release.clone())
+        .map_err(|e| Failure::Internal(format!("{:#}", e)))?;
+    record_change(server, repo_name, tag, "edited".to_string());
+    Ok(release)
+}
+
+fn delete(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    tag: &str,
+) -> Result<Release, Failure> {
+    check_publish(server, repo_name, repo_path)?;
+    match releases::remove(repo_path, tag) {
+        Ok(Some(release)) => {
+            record_change(server, repo_name, tag, "deleted".to_string());
+            Ok(release)
+        }
+        Ok(None) => Err(Failure::NotFound),
+        Err(e) => Err(Failure::Internal(format!("{:#}", e))),
+    }
+}
+
+fn remove_asset(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    tag: &str,
+    name: &str,
+) -> Result<Asset, Failure> {
+    check_publish(server, repo_name, repo_path)?;
+    match releases::remove_asset(repo_path, tag, name) {
+        Ok(Some(asset)) => {
+            record_change(server, repo_name, tag, format!("removed asset {}", name));
+            Ok(asset)
+        }
+        Ok(None) => Err(Failure::NotFound),
+        Err(e) => Err(Failure::Internal(format!("{:#}", e))),
+    }
+}
+
+pub fn save_form(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    form: &HashMap<String, String>,
+) -> Response {
+    let field = |key: &str| form.get(key).map(String::as_str).unwrap_or("");
+    let tag = field("tag");
+    let change = || Change {
+        name: Some(field("name").to_string()),
+        body: Some(field("body").to_string()),
+        prerelease: Some(field("prerelease") == "on"),
+        draft: Some(field("draft") == "on"),
+    };
+    let action = field("action");
+    let result = match action {
+        "create" => create(server, repo_name, repo_path, tag, change())
+            .map(|release| release_url(repo_name, &release.tag)),
+        "edit" => edit(server, repo_name, repo_path, tag, change())
+            .map(|release| release_url(repo_name, &release.tag)),
+        "remove-asset" => remove_asset(server, repo_name, repo_path, tag, field("asset"))
+            .map(|_| release_url(repo_name, tag)),
+        "delete" => delete(server, repo_name, repo_path, tag).map(|_| releases_url(repo_name)),
+        _ => return (StatusCode::BAD_REQUEST, "Unknown action").into_response(),
+    };
+    match result {
+        Ok(location) => Redirect::to(&location).into_response(),
+        Err(Failure::Invalid(e)) if action == "create" => {
+            list_page(server, repo_name, repo_path, Some(&e))
+        }
+        Err(Failure::Invalid(e)) => release_page(server, repo_name, repo_path, tag, Some(&e)),
+        Err(failure) => failure.into_response(),
+    }
+}
+
+/// Stream an asset: /repo/<name>/releases/download/<tag>/<asset>
+pub async fn download(server: &WebServer, repo_path: &PathBuf, path: &str) -> Response {
+    let (tag, name) = match path.rsplit_once('/') {
+        Some(split) => split,
+        None => return Failure::NotFound.into_response(),
+    };
+    let release = match find(server, repo_path, tag) {
+        Ok(release) => release,
+        Err(failure) => return failure.into_response(),
+    };
+    let asset = match release.asset(name) {
+        Some(asset) => asset,
+        None => return (StatusCode::NOT_FOUND, "Asset not found").into_response(),
+    };
+    let file = match tokio::fs::File::open(releases::asset_path(repo_path, asset)).await {
+        Ok(file) => file,
+        Err(_) => return (StatusCode::NOT_FOUND, "Asset not found").into_response(),
+    };
+
+    let stream = futures::stream::unfold(file, |mut file| async move {
+        let mut buf = vec![0u8; 64 * 1024];
+        match file.read(&mut buf).await {
+            Ok(0) => None,
+            Ok(n) => {
+                buf.truncate(n);
+                Some((Ok::<_, std::io::Error>(Bytes::from(buf)), file))
+            }
+            Err(e) => Some((Err(e), file)),
+        }
+    });
+    (
+        [
+            (header::CONTENT_TYPE, "application/octet-stream".to_string()),
+            (header::CONTENT_LENGTH, asset.size.to_string()),
+            (
+                header::CONTENT_DISPOSITION,
+                format!("attachment; filename=\"{}\"", asset.name.replace('"', "")),
+            ),
+            (header::ETAG, format!("\"{}\"", asset.sha256)),
+        ],
+        Body::from_stream(stream),
+    )
+        .into_response()
+}
+
+/// A release as the API returns it, with the download URL of each asset
+fn release_json(repo_name: &str, release: &Release) -> serde_json::Value {
+    let mut value = serde_json::to_value(release).unwrap_or_default();
+    if let Some(assets) = value.get_mut("assets").and_then(|a| a.as_array_mut()) {
+        for asset in assets {
+            let name = asset["name"].as_str().unwrap_or_default().to_string();
+            asset["download_url"] = download_url(repo_name, &release.tag, &name).into();
+        }
+    }
+    value
+}
+
+fn resolve(server: &WebServer, repo_name: &str) -> Result<(String, PathBuf), Response> {
+    server
+        .resolve_repo(repo_name)
+        .ok_or_else(|| (StatusCode::NOT_FOUND, "Repository not found").into_response())
+}
+
+/// GET /api/v1/repos/<name>/releases
+pub async fn api_list(
+    State(server): State<Arc<WebServer>>,
+    Path(repo_name): Path<String>,
+) -> Response {
+    let (repo_name, repo_path) = match resolve(&server, &repo_name) {
+        Ok(found) => found,
+        Err(response) => return response,
+    };
+    let releases: Vec<_> = visible(&server, &repo_path)
+        .iter()
+        .map(|release| release_json(&repo_name, release))
+        .collect();
+    Json(releases).into_response()
+}
+
+#[derive(Deserialize)]
+pub struct NewRelease {
+    tag: String,
+    #[serde(flatten)]
+    change: Change,
+}
+
+/// POST /api/v1/repos/<name>/releases with `{"tag": ..., "name": ..., "body": ...,
+/// "prerelease": false, "draft": false}`; the tag must exist
+pub async fn api_create(
+    State(server): State<Arc<WebServer>>,
+    Path(repo_name): Path<String>,
+    Json(request): Json<NewRelease>,
+) -> Response {
+    let (repo_name, repo_path) = match resolve(&server, &repo_name) {
+        Ok(found) => found,
+        Err(response) => return response,
+    };
+    match create(
+        &server,
+        &repo_name,
+        &repo_path,
+        &request.tag,
+        request.change,
+    ) {
+        Ok(release) => (
+            StatusCode::CREATED,
+            Json(release_json(&repo_name, &release)),
+        )
+            .into_response(),
+        Err(failure) => failure.into_response(),
+    }
+}
+
+/// GET /api/v1/repos/<name>/releases/<tag>
+pub async fn api_get(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, tag)): Path<(String, String)>,
+) -> Response {
+    let (repo_name, repo_path) = match resolve(&server, &repo_name) {
+        Ok(found) => found,
+        Err(response) => return response,
+    };
+    match find(&server, &repo_path, &tag) {
+        Ok(release) => Json(release_json(&repo_name, &release)).into_response(),
+        Err(failure) => failure.into_response(),
+    }
+}
+
+/// PATCH /api/v1/repos/<name>/releases/<tag> with any of `name`, `body`,
+/// `prerelease` and `draft`
+pub async fn api_update(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, tag)): Path<(String, String)>,
+    Json(change): Json<Change>,
+) -> Response {
+    let (repo_name, repo_path) = match resolve(&server, &repo_name) {
+        Ok(found) => found,
+        Err(response) => return response,
+    };
+    match edit(&server, &repo_name, &repo_path, &tag, change) {
+        Ok(release) => Json(release_json(&repo_name, &release)).into_response(),
+        Err(failure) => failure.into_response(),
+    }
+}
+
+/// DELETE /api/v1/repos/<name>/releases/<tag>; the tag stays
+pub async fn api_delete(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, tag)): Path<(String, String)>,
+) -> Response {
+    let (repo_name, repo_path) = match resolve(&server, &repo_name) {
+        Ok(found) => found,
+        Err(response) => return response,
+    };
+    match delete(&server, &repo_name, &repo_path, &tag) {
+        Ok(_) => StatusCode::NO_CONTENT.into_response(),
+        Err(failure) => failure.into_response(),
+    }
+}
+
+/// POST /api/v1/repos/<name>/releases/<tag>/assets?name=<file name> with the
+/// file as the body; an asset of the same name is replaced
+pub async fn api_upload(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, tag)): Path<(String, String)>,
+    Query(query): Query<HashMap<String, String>>,
+    body: Body,
+) -> Response {
+    let (repo_name, repo_path) = match resolve(&server, &repo_name) {
+        Ok(found) => found,
+        Err(response) => return response,
+    };
+    if let Err(failure) = check_publish(&server, &repo_name, &repo_path) {
+        return failure.into_response();
+    }
+    let name = query.get("name").map(String::as_str).unwrap_or("");
+    if !releases::valid_asset_name(name) {
+        return Failure::Invalid(format!("Invalid asset name '{}'", name)).into_response();
+    }
+    if let Err(failure) = find(&server, &repo_path, &tag) {
+        return failure.into_response();
+    }
+
+    let dir = releases::upload_dir(&repo_path);
+    let upload = dir.join(format!(
+        "{}-{}",
+        std::process::id(),
+        chrono::Utc::now().timestamp_nanos_opt().unwrap_or_default()
+    ));
+    let size = match receive(&dir, &upload, body).await {
+        Ok(size) => size,
+        Err(e) => {
+            let _ = tokio::fs::remove_file(&upload).await;
+            tracing::warn!("Upload of {} to {} {} failed: {}", name, repo_name, tag, e);
+            return Failure::Internal("Failed to store the asset".to_string()).into_response();
+        }
+    };
+
+    let quotas = server.quotas.clone();
+    let (path, user) = (repo_path.clone(), current_user().unwrap_or_default());
+    let (tag_owned, name_owned) = (tag.clone(), name.to_string());
+    let result = tokio::task::spawn_blocking(move || {
+        if let Ok(mut status) = quotas.status(&path) {
+            status.repo_bytes += size;
+            status.user_bytes += size;
+            if let Some(reason) = status.exceeded() {
+                let _ = std::fs::remove_file(&upload);
+                return Err(Failure::Invalid(reason));
+            }
+        }
+        releases::add_asset(&path, &tag_owned, &name_owned, &upload, &user).map_err(|e| {
+            let _ = std::fs::remove_file(&upload);
+            Failure::Internal(format!("{:#}", e))
+        })
+    })
+    .await;
+    match result {
+        Ok(Ok(asset)) => {
+            record_change(
+                &server,
+                &repo_name,
+                &tag,
+                format!("uploaded asset {}", asset.name),
+            );
+            let disk_usage = server.disk_usage.clone();
+            tokio::task::spawn_blocking(move || disk_usage.refresh_repo(&repo_name, &repo_path));
+            (StatusCode::CREATED, Json(asset)).into_response()
+        }
+        Ok(Err(failure)) => failure.into_response(),
+        Err(_) => StatusCode::INTERNAL_SERVER_ERROR.into_response(),
+    }
+}
+
+/// DELETE /api/v1/repos/<name>/releases/<tag>/assets/<asset>
+pub async fn api_delete_asset(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, tag, name)): Path<(String, String, String)>,
+) -> Response {
+    let (repo_name, repo_path) = match resolve(&server, &repo_name) {
+        Ok(found) => found,
+        Err(response) => return response,
+    };
+    match remove_asset(&server, &repo_name, &repo_path, &tag, &name) {
+        Ok(_) => StatusCode::NO_CONTENT.into_response(),
+        Err(failure) => failure.into_response(),
+    }
+}
+
+/// Write the request body to `upload`, returning its size
+async fn receive(dir: &PathBuf, upload: &PathBuf, body: Body) -> anyhow::Result<u64> {
+    tokio::fs::create_dir_all(dir).await?;
+    let mut file = tokio::fs::File::create(upload).await?;
+    let mut size = 0;
+    let mut stream = body.into_data_stream();
+    while let Some(chunk) = stream.next().await {
+        let chunk = chunk?;
+        size += chunk.len() as u64;
+        file.write_all(&chunk).await?;
+    }
+    file.flush().await?;
+    Ok(size)
+}
@@ -0,0 +1,229 @@
+//! Managing repositories through the API, for clients that can't use SSH:
+//! listing, creating and deleting them, and their disk usage.
+
+use super::auth::{current_user, remote_addr, scope_allows};
+use super::{repo_json, WebServer};
+use crate::archive;
+use crate::audit::{self, Action, Via};
+use crate::create;
+use crate::git;
+use crate::maintenance_mode;
+use crate::orgs::Role;
+use crate::stats;
+use crate::templates;
+use crate::trash;
+use crate::visibility::{self, Visibility};
+use axum::{
+    extract::{Path, State},
+    http::{HeaderMap, StatusCode},
+    response::{IntoResponse, Response},
+    Json,
+};
+use serde::Deserialize;
+use std::sync::Arc;
+
+/// GET /api/v1/repos: the repositories the user may read, as `agito list
+/// --json` shows them
+pub async fn api_list(State(server): State<Arc<WebServer>>) -> Response {
+    let repos = match git::find_repositories(&server.repos_dir) {
+        Ok(repos) => repos,
+        Err(e) => return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    };
+    let repos: Vec<_> = repos
+        .into_iter()
+        .filter(|(name, _)| server.role(name).is_some())
+        .map(|(name, path)| {
+            let in_org = crate::orgs::in_org(&server.data_dir, &name);
+            serde_json::json!({
+                "name": name,
+                "visibility": visibility::effective(&path, in_org).name(),
+                "archived": archive::is_archived(&path),
+            })
+        })
+        .collect();
+    Json(repos).into_response()
+}
+
+#[derive(Deserialize)]
+pub struct CreateRequest {
+    /// As `agito create` takes it: `name` in the user's namespace,
+    /// `org/name` or `/name` at the top level
+    name: String,
+    visibility: Option<String>,
+    /// Template repository to start from
+    template: Option<String>,
+    #[serde(default)]
+    with_hooks: bool,
+}
+
+/// POST /api/v1/repos with `name` and optionally `visibility`, `template`
+/// and `with_hooks`, creating a repository as `agito-create-repo` does
+pub async fn api_create(
+    State(server): State<Arc<WebServer>>,
+    headers: HeaderMap,
+    Json(request): Json<CreateRequest>,
+) -> Response {
+    let user = match current_user() {
+        Some(user) => user,
+        None => {
+            return (StatusCode::UNAUTHORIZED, "Sign in to create repositories").into_response()
+        }
+    };
+    if !scope_allows(Role::Write) {
+        return (
+            StatusCode::FORBIDDEN,
+            "Creating repositories needs a token with write scope",
+        )
+            .into_response();
+    }
+    if let Some(notice) = maintenance_mode::server(&server.data_dir) {
+        return (
+            StatusCode::SERVICE_UNAVAILABLE,
+            maintenance_mode::server_refusal(&notice),
+        )
+            .into_response();
+    }
+    let visibility = match request.visibility.as_deref().map(str::parse::<Visibility>) {
+        None => server.default_visibility,
+        Some(Ok(visibility)) => visibility,
+        Some(Err(e)) => return (StatusCode::UNPROCESSABLE_ENTITY, e).into_response(),
+    };
+    if request.with_hooks && request.template.is_none() {
+        return (
+            StatusCode::UNPROCESSABLE_ENTITY,
+            "with_hooks needs a template",
+        )
+            .into_response();
+    }
+    let repo_name = match server.limits.place(Some(&user), &request.name) {
+        Ok(name) => name,
+        Err(e) => return (StatusCode::FORBIDDEN, e.to_string()).into_response(),
+    };
+    if server.repos_dir.join(&repo_name).exists() {
+        return (
+            StatusCode::CONFLICT,
+            format!("Repository already exists: {}", repo_name),
+        )
+            .into_response();
+    }
+    let template = match &request.template {
+        None => None,
+        Some(template) => match server.resolve_repo(template.trim_start_matches('/')) {
+            Some((name, path)) if templates::is_template(&path) => Some((name, path)),
+            Some((name, _)) => {
+                return (
+                    StatusCode::UNPROCESSABLE_ENTITY,
+                    format!("{} is not a template", name),
+                )
+                    .into_response()
+            }
+            None => {
+                return (
+                    StatusCode::NOT_FOUND,
+                    format!("Repository not found: {}", template),
+                )
+                    .into_response()
+            }
+        },
+    };
+
+    let create_request = create::Request {
+        name: &repo_name,
+        visibility,
+        template: template.as_ref().map(|(_, path)| path.as_path()),
+        with_hooks: request.with_hooks,
+        user: Some(&user),
+    };
+    let repo_path = match create::create(&server.limits, &server.hook_templates, &create_request) {
+        Ok(repo_path) => repo_path,
+        Err(e) => return (StatusCode::INTERNAL_SERVER_ERROR, format!("{:#}", e)).into_response(),
+    };
+    let detail = match &template {
+        Some((template_name, _)) => {
+            format!("{} from template {}", visibility.name(), template_name)
+        }
+        None => visibility.name().to_string(),
+    };
+    audit::Entry::new(Action::RepoCreate, Via::Web, Some(&user))
+        .with_repo(&repo_name)
+        .with_detail(detail)
+        .with_remote(remote_addr())
+        .record(&server.data_dir);
+    (
+        StatusCode::CREATED,
+        Json(repo_json(&server, &repo_name, &repo_path, &headers)),
+    )
+        .into_response()
+}
+
+/// DELETE /api/v1/repos/<name>: move a repository to the trash
+pub async fn api_delete(
+    State(server): State<Arc<WebServer>>,
+    Path(repo_name): Path<String>,
+) -> Response {
+    let (repo_name, repo_path) = match server.resolve_repo(&repo_name) {
+        Some(found) => found,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    if !server.may_administer(&repo_path) {
+        return (
+            StatusCode::FORBIDDEN,
+            "Only the repository's admins may delete it",
+        )
+            .into_response();
+    }
+    let user = current_user();
+    let deleted = match trash::delete(&server.repos_dir, &repo_name, user.as_deref()) {
+        Ok(deleted) => deleted,
+        Err(e) => return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    };
+    tracing::info!(repo = %repo_name, user = ?user, id = %deleted.id, "Repository moved to the trash");
+    audit::Entry::new(Action::RepoDelete, Via::Web, user.as_deref())
+        .with_repo(&repo_name)
+        .with_detail(format!("moved to the trash as {}", deleted.id))
+        .with_remote(remote_addr())
+        .record(&server.data_dir);
+    Json(serde_json::json!({ "name": repo_name, "trash_id": deleted.id })).into_response()
+}
+
+/// GET /api/v1/repos/<name>/stats: the repository's statistics as last
+/// computed
+pub async fn api_stats(
+    State(server): State<Arc<WebServer>>,
+    Path(repo_name): Path<String>,
+) -> Response {
+    let (repo_name, repo_path) = match server.resolve_repo(&repo_name) {
+        Some(found) => found,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    match stats::get(&repo_path) {
+        Some(stats) => {
+            let mut value = serde_json::to_value(stats).unwrap_or_default();
+            value["name"] = repo_name.into();
+            Json(value).into_response()
+        }
+        None => (
+            StatusCode::NOT_FOUND,
+            "The repository's statistics have not been computed yet",
+        )
+            .into_response(),
+    }
+}
+
+/// GET /api/v1/repos/<name>/quota: a repository's size and quota, as
+/// `agito info --json` shows them
+pub async fn api_quota(
+    State(server): State<Arc<WebServer>>,
+    Path(repo_name): Path<String>,
+) -> Response {
+    let (repo_name, repo_path) = match server.resolve_repo(&repo_name) {
+        Some(found) => found,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    let quotas = server.quotas.clone();
+    match tokio::task::spawn_blocking(move || quotas.status(&repo_path)).await {
+        Ok(Ok(status)) => Json(status.json(&repo_name)).into_response(),
+        Ok(Err(e)) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
@@ -0,0 +1,73 @@
+use axum::{
+    extract::Request,
+    http::{HeaderName, HeaderValue},
+    middleware::Next,
+    response::Response,
+};
+use tracing::Span;
+
+/// Header carrying the request ID, both ways
+pub static HEADER: HeaderName = HeaderName::from_static("x-request-id");
+
+/// Longest request ID taken from a client or proxy
+const MAX_LEN: usize = 64;
+
+/// ID of the request being handled, in the request extensions
+#[derive(Clone, Debug)]
+pub struct RequestId(pub String);
+
+/// An ID from a reverse proxy is kept, so its logs and ours line up, if it
+/// looks like one
+fn valid(id: &str) -> bool {
+    !id.is_empty()
+        && id.len() <= MAX_LEN
+        && id
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || matches!(c, '-' | '_' | '.'))
+}
+
+/// Middleware giving each request an ID, taken from `X-Request-Id` or made
+/// up, and returning it in the response's `X-Request-Id`
+pub async fn middleware(mut req: Request, next: Next) -> Response {
+    let id = req
+        .headers()
+        .get(&HEADER)
+        .and_then(|value| value.to_str().ok())
+        .filter(|id| valid(id))
+        .map(str::to_string)
+        .unwrap_or_else(crate::telemetry::new_id);
+    let value = HeaderValue::from_str(&id).expect("request IDs are valid header values");
+    req.headers_mut().insert(HEADER.clone(), value.clone());
+    req.extensions_mut().insert(RequestId(id));
+
+    let mut response = next.run(req).await;
+    response.headers_mut().insert(HEADER.clone(), value);
+    response
+}
+
+/// Span of one request, so every line logged while handling it carries its
+/// ID. The route, repository, status and response size are filled in as the
+/// request is handled, for traces exported over OTLP.
+pub fn make_span(req: &Request) -> Span {
+    let id = req
+        .extensions()
+        .get::<RequestId>()
+        .map(|id| id.0.as_str())
+        .unwrap_or("-");
+    let span = tracing::info_span!(
+        "request",
+        component = "web",
+        request_id = id,
+        method = %req.method(),
+        uri = %req.uri(),
+        otel.name = tracing::field::Empty,
+        otel.kind = "server",
+        otel.status_code = tracing::field::Empty,
+        http.route = tracing::field::Empty,
+        http.status_code = tracing::field::Empty,
+        repo = tracing::field::Empty,
+        bytes = tracing::field::Empty,
+    );
+    crate::telemetry::continue_trace(&span, req.headers());
+    span
+}
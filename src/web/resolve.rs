@@ -0,0 +1,142 @@
+use super::{url_path, WebServer};
+use crate::archive;
+use crate::maintenance_mode::{self, Notice};
+use axum::{
+    extract::{Request, State},
+    http::{header, Method, StatusCode, Uri},
+    middleware::Next,
+    response::{IntoResponse, Response},
+};
+use std::path::PathBuf;
+use std::sync::Arc;
+
+tokio::task_local! {
+    /// Whether the repository the request is about is archived
+    static ARCHIVED: bool;
+    /// The repository's own maintenance notice, if it has one
+    static MAINTENANCE: Option<Notice>;
+}
+
+/// Whether the current request is for a page of an archived repository
+pub fn archived() -> bool {
+    ARCHIVED.try_with(|archived| *archived).unwrap_or(false)
+}
+
+/// The maintenance notice of the repository the current request is for
+pub fn maintenance() -> Option<Notice> {
+    MAINTENANCE.try_with(Clone::clone).ok().flatten()
+}
+
+/// Send requests for /repo/<name>/... and /api/v1/repos/<name>/... under a
+/// name that isn't the repository's own, such as an old name or one
+/// differing in case, to the same page or endpoint under the current name
+pub async fn middleware(
+    State(server): State<Arc<WebServer>>,
+    req: Request,
+    next: Next,
+) -> Response {
+    match target(&server, req.uri()) {
+        Target::Repo(repo_path) => {
+            let archived = archive::is_archived(&repo_path);
+            let maintenance = maintenance_mode::repo(&repo_path);
+            ARCHIVED
+                .scope(archived, MAINTENANCE.scope(maintenance, next.run(req)))
+                .await
+        }
+        Target::Moved(location) => {
+            // 301 for links and bookmarks; API clients that post get 308,
+            // which tells them to send the same request again
+            let status = if req.method() == Method::GET || req.method() == Method::HEAD {
+                StatusCode::MOVED_PERMANENTLY
+            } else {
+                StatusCode::PERMANENT_REDIRECT
+            };
+            (status, [(header::LOCATION, location)]).into_response()
+        }
+        Target::Other => next.run(req).await,
+    }
+}
+
+enum Target {
+    /// A page of the repository in this directory
+    Repo(PathBuf),
+    /// The same page under the repository's current name
+    Moved(String),
+    /// Not a repository page, or no repository by that name
+    Other,
+}
+
+fn target(server: &WebServer, uri: &Uri) -> Target {
+    if let Some(rest) = uri.path().strip_prefix("/api/v1/repos/") {
+        return api_target(server, uri, rest);
+    }
+    let rest = match uri.path().strip_prefix("/repo/") {
+        Some(rest) => rest,
+        None => return Target::Other,
+    };
+    let (name, page) = match rest.split_once('/') {
+        Some((name, page)) => (name, Some(page)),
+        None => (rest, None),
+    };
+    if let Some((name, repo_path, _)) = server.find_repo_page(name, page.unwrap_or("")) {
+        tracing::Span::current().record("repo", name.as_str());
+        return Target::Repo(repo_path);
+    }
+
+    let (found, _) = match server.resolve_repo(name) {
+        Some(found) => found,
+        None => return Target::Other,
+    };
+    let mut location = format!("/repo/{}", url_path(&found));
+    if let Some(page) = page {
+        location.push('/');
+        location.push_str(page);
+    }
+    if let Some(query) = uri.query() {
+        location.push('?');
+        location.push_str(query);
+    }
+    Target::Moved(location)
+}
+
+/// API endpoints name the repository in one path segment, with the slash of
+/// a namespace encoded as %2F
+fn api_target(server: &WebServer, uri: &Uri, rest: &str) -> Target {
+    let (segment, endpoint) = rest.split_once('/').unwrap_or((rest, ""));
+    let name = match percent_decode(segment) {
+        Some(name) => name,
+        None => return Target::Other,
+    };
+    let found = match server.resolve_repo(&name) {
+        Some((found, _)) if found != name => found,
+        Some(_) => {
+            tracing::Span::current().record("repo", name.as_str());
+            return Target::Other;
+        }
+        None => return Target::Other,
+    };
+    let mut location = format!(
+        "/api/v1/repos/{}/{}",
+        url_path(&found).replace('/', "%2F"),
+        endpoint
+    );
+    if let Some(query) = uri.query() {
+        location.push('?');
+        location.push_str(query);
+    }
+    Target::Moved(location)
+}
+
+pub(super) fn percent_decode(s: &str) -> Option<String> {
+    let mut out = Vec::with_capacity(s.len());
+    let mut bytes = s.bytes();
+    while let Some(b) = bytes.next() {
+        if b == b'%' {
+            let hex = [bytes.next()?, bytes.next()?];
+            out.push(u8::from_str_radix(std::str::from_utf8(&hex).ok()?, 16).ok()?);
+        } else {
+            out.push(b);
+        }
+    }
+    String::from_utf8(out).ok()
+}
@@ -0,0 +1,658 @@
+use super::auth::current_user;
+use super::{
+    diff, html_escape, markdown, notifications, relative_time, url_path, CommitDetail, WebServer,
+    DIFF_TRUNCATED,
+};
+use crate::notifications::Reason;
+use crate::orgs::Role;
+use crate::preferences::DiffView;
+use crate::pulls::{self, Pull};
+use crate::reviews::{self, Kind, Position, Target, Thread};
+use crate::{merge, users};
+use axum::{
+    extract::{Path, State},
+    http::StatusCode,
+    response::{IntoResponse, Redirect, Response},
+    Json,
+};
+use serde::Deserialize;
+use std::collections::{BTreeSet, HashMap};
+use std::path::PathBuf;
+use std::sync::Arc;
+
+/// A diff under review: a commit's, or a pull request's
+pub struct Review {
+    repo_name: String,
+    repo_path: PathBuf,
+    target: Target,
+    /// The commit whose diff is shown
+    commit: String,
+    diff: String,
+    /// Whether the diff was too large and is cut short
+    truncated: bool,
+    /// The page showing the diff; forms post back to it
+    url: String,
+    /// What notifications call the change
+    title: String,
+    /// The user whose change it is, who hears about every comment
+    owner: Option<String>,
+}
+
+impl Review {
+    pub fn commit(
+        server: &WebServer,
+        repo_name: &str,
+        repo_path: &PathBuf,
+        commit: &CommitDetail,
+    ) -> Self {
+        Self {
+            repo_name: repo_name.to_string(),
+            repo_path: repo_path.clone(),
+            target: Target::Commit(commit.id.clone()),
+            commit: commit.id.clone(),
+            diff: commit.diff.clone(),
+            truncated: commit.diff_truncated,
+            url: format!("/repo/{}/commit/{}", url_path(repo_name), commit.id),
+            title: format!(
+                "{} {}",
+                &commit.id[..8.min(commit.id.len())],
+                commit.message.lines().next().unwrap_or("")
+            ),
+            owner: users::by_email(&server.data_dir, &commit.email),
+        }
+    }
+
+    /// The review of a pull request's changes, against its head commit
+    pub fn pull(repo_name: &str, repo_path: &PathBuf, pull: &Pull) -> anyhow::Result<Self> {
+        let (base, head) = pulls::compared(repo_path, pull);
+        let commit = merge::rev_parse(repo_path, &head)
+            .ok_or_else(|| anyhow::anyhow!("The branch {} no longer exists", pull.head))?;
+        let (diff, truncated) = super::pulls::diff(repo_path, &base, &commit)?;
+        Ok(Self {
+            repo_name: repo_name.to_string(),
+            repo_path: repo_path.clone(),
+            target: Target::Pull(pull.number),
+            diff,
+            truncated,
+            commit,
+            url: format!("/repo/{}/pulls/{}/files", url_path(repo_name), pull.number),
+            title: format!("#{} {}", pull.number, pull.title),
+            owner: Some(pull.author.clone()),
+        })
+    }
+
+    fn threads(&self) -> anyhow::Result<Vec<Thread>> {
+        reviews::list(&self.repo_path, &self.target)
+    }
+
+    /// Whether the signed-in user may resolve a thread: whoever started it,
+    /// the owner of the change, and users with write access
+    fn may_resolve(&self, server: &WebServer, thread: &Thread) -> bool {
+        current_user().map_or(false, |user| {
+            user == thread.author
+                || Some(&user) == self.owner.as_ref()
+                || server.has_role(&self.repo_path, Role::Write)
+        })
+    }
+
+    /// The diff, unified or split as the user chose, with its threads shown
+    /// under the lines they are about. Signed-in users can click a line
+    /// number to start a thread there.
+    pub fn render(&self, server: &WebServer, query: &HashMap<String, String>) -> String {
+        let threads = match self.threads() {
+            Ok(threads) => threads,
+            Err(e) => {
+                tracing::warn!("Failed to load review threads: {:#}", e);
+                Vec::new()
+            }
+        };
+        let lines = reviews::lines(&self.diff);
+        let mut inline: HashMap<&Position, Vec<&Thread>> = HashMap::new();
+        let mut outdated = Vec::new();
+        for thread in &threads {
+            if reviews::is_current(&lines, thread) {
+                inline.entry(&thread.position).or_default().push(thread);
+            } else {
+                outdated.push(thread);
+            }
+        }
+        let signed_in = current_user().is_some();
+        let draft = signed_in
+            .then(|| {
+                Some(Position {
+                    path: query.get("path")?.clone(),
+                    side: query.get("side")?.parse().ok()?,
+                    line: query.get("line")?.parse().ok()?,
+                })
+            })
+            .flatten();
+
+        let mut html = String::new();
+        if !outdated.is_empty() {
+            html.push_str("<h3>Comments on earlier versions</h3>\n");
+            for thread in &outdated {
+                html.push_str(&self.thread_html(server, thread, true));
+            }
+        }
+        // The threads on a line and the form starting one there
+        let below = |position: &Position| {
+            let mut html = String::new();
+            for thread in inline.get(position).into_iter().flatten() {
+                html.push_str(&self.thread_html(server, thread, false));
+            }
+            if draft.as_ref() == Some(position) {
+                html.push_str(&format!(
+                    "<form class=\"review-thread\" id=\"new-thread\" method=\"post\" action=\"{}\">\n<input type=\"hidden\" name=\"action\" value=\"start\">\n<input type=\"hidden\" name=\"path\" value=\"{}\">\n<input type=\"hidden\" name=\"side\" value=\"{}\">\n<input type=\"hidden\" name=\"line\" value=\"{}\">\n<textarea name=\"body\" rows=\"4\" cols=\"80\" placeholder=\"Comment on line {} (Markdown)\" required></textarea><br>\n<button type=\"submit\">Comment</button> <a href=\"{}\">Cancel</a>\n</form>\n",
+                    self.url,
+                    html_escape(&position.path),
+                    position.side.name(),
+                    position.line,
+                    position.line,
+                    self.url
+                ));
+            }
+            html
+        };
+        let number = |position: &Position| self.number_html(position, signed_in);
+
+        let view = diff::view(server, query);
+        html.push_str(&diff::toggle(&self.url, query, view));
+        match view {
+            DiffView::Split => html.push_str(&diff::split(&lines, number, below)),
+            DiffView::Unified => {
+                html.push_str(r#"<pre class="diff">"#);
+                for line in &lines {
+                    let class = match line.kind {
+                        Kind::File => "diff-file",
+                        Kind::Hunk => "diff-hunk",
+                        Kind::Added => "diff-add",
+                        Kind::Removed => "diff-del",
+                        Kind::Context | Kind::Other => "",
+                    };
+                    html.push_str(&format!(
+                        "{}<span class=\"{}\">{}</span>\n",
+                        line.position
+                            .as_ref()
+                            .map_or("      ".to_string(), |position| format!(
+                                "{} ",
+                                number(position)
+                            )),
+                        class,
+                        html_escape(line.text)
+                    ));
+                    let Some(position) = &line.position else {
+                        continue;
+                    };
+                    let content = below(position);
+                    if !content.is_empty() {
+                        html.push_str("</pre>\n");
+                        html.push_str(&content);
+                        html.push_str(r#"<pre class="diff">"#);
+                    }
+                }
+                html.push_str("</pre>");
+            }
+        }
+        if self.truncated {
+            html.push_str(DIFF_TRUNCATED);
+        }
+        html
+    }
+
+    /// A line's number, which signed-in users click to comment on the line
+    fn number_html(&self, position: &Position, signed_in: bool) -> String {
+        if !signed_in {
+            return format!("<span class=\"diff-num\">{:>5}</span>", position.line);
+        }
+        format!(
+            "<a class=\"diff-num\" href=\"{}?path={}&amp;side={}&amp;line={}#new-thread\" title=\"Comment on this line\">{:>5}</a>",
+            self.url,
+            url_path(&position.path),
+            position.side.name(),
+            position.line,
+            position.line
+        )
+    }
+
+    fn thread_html(&self, server: &WebServer, thread: &Thread, outdated: bool) -> String {
+        let comment_html = |author: &str, created: i64, text: &str| {
+            format!(
+                "<div class=\"comment\"><div class=\"comment-header\"><strong>{}</strong> {}</div><div class=\"comment-body\">{}</div></div>\n",
+                html_escape(author),
+                relative_time(created),
+                markdown::render(text)
+            )
+        };
+        let summary = format!(
+            "<code>{}</code> line {}{}{}",
+            html_escape(&thread.position.path),
+            thread.position.line,
+            match thread.position.side {
+                reviews::Side::Old => " (removed)",
+                reviews::Side::New => "",
+            },
+            thread
+                .resolved_by
+                .as_ref()
+                .map(|by| format!(" &middot; resolved by {}", html_escape(by)))
+                .unwrap_or_default()
+        );
+
+        let mut html = String::new();
+        if outdated {
+            html.push_str(&format!(
+                "<pre class=\"diff\">{}</pre>\n",
+                html_escape(&thread.code)
+            ));
+        }
+        html.push_str(&comment_html(&thread.author, thread.created, &thread.body));
+        for reply in &thread.replies {
+            html.push_str(&comment_html(&reply.author, reply.created, &reply.body));
+        }
+        if current_user().is_some() {
+            html.push_str(&format!(
+                "<form method=\"post\" action=\"{}\"><input type=\"hidden\" name=\"action\" value=\"reply\"><input type=\"hidden\" name=\"thread\" value=\"{}\"><textarea name=\"body\" rows=\"2\" cols=\"80\" placeholder=\"Reply (Markdown)\" required></textarea><br><button type=\"submit\">Reply</button></form>\n",
+                self.url, thread.id
+            ));
+        }
+        if self.may_resolve(server, thread) {
+            let (action, label) = if thread.resolved {
+                ("unresolve", "Unresolve")
+            } else {
+                ("resolve", "Resolve")
+            };
+            html.push_str(&format!(
+                "<form method=\"post\" action=\"{}\"><input type=\"hidden\" name=\"action\" value=\"{}\"><input type=\"hidden\" name=\"thread\" value=\"{}\"><button type=\"submit\">{}</button></form>\n",
+                self.url, action, thread.id, label
+            ));
+        }
+
+        // Resolved threads start folded
+        format!(
+            "<details class=\"review-thread\" id=\"thread-{}\"{}><summary>{}</summary>\n{}</details>\n",
+            thread.id,
+            if thread.resolved { "" } else { " open" },
+            summary,
+            html
+        )
+    }
+
+    /// Tell the owner of the change and everyone in the thread about a new
+    /// comment, except its author; users mentioned in it hear about that
+    /// instead
+    fn notify(&self, server: &WebServer, thread: &Thread, author: &str, text: &str) {
+        let url = format!("{}#thread-{}", self.url, thread.id);
+        let mentioned = crate::notifications::mentions(text);
+        let mut recipients: BTreeSet<&str> = thread.participants().into_iter().collect();
+        recipients.extend(self.owner.as_deref());
+        for user in recipients {
+            if user == author
+                || mentioned.contains(user)
+                || crate::orgs::role(
+                    &server.data_dir,
+                    &server.repos_dir,
+                    &self.repo_name,
+                    Some(user),
+                )
+                .is_none()
+            {
+                continue;
+            }
+            if let Err(e) = crate::notifications::push(
+                &server.data_dir,
+                user,
+                Reason::ReviewComment,
+                &self.repo_name,
+                &format!("{}: {}", self.title, thread.position.path),
+                Some(url.clone()),
+            ) {
+                tracing::warn!("Failed to notify {} of a review comment: {}", user, e);
+            }
+        }
+        notifications::mentioned(server, &self.repo_name, &self.title, &url, author, text);
+    }
+
+    fn start(
+        &self,
+        server: &WebServer,
+        user: &str,
+        position: Position,
+        body: &str,
+    ) -> Result<Thread, Failure> {
+        let thread = reviews::start(
+            &self.repo_path,
+            &self.target,
+            &self.diff,
+            &self.commit,
+            position,
+            user,
+            body,
+        )
+        .map_err(|e| Failure::Invalid(format!("{:#}", e)))?;
+        self.notify(server, &thread, user, body);
+        Ok(thread)
+    }
+
+    fn reply(
+        &self,
+        server: &WebServer,
+        user: &str,
+        id: u64,
+        body: &str,
+    ) -> Result<Thread, Failure> {
+        self.load(id)?;
+        let thread = reviews::update(&self.repo_path, &self.target, id, |thread| {
+            thread.reply(user, body)
+        })
+        .map_err(|e| Failure::Invalid(format!("{:#}", e)))?;
+        self.notify(server, &thread, user, body);
+        Ok(thread)
+    }
+
+    fn resolve(
+        &self,
+        server: &WebServer,
+        user: &str,
+        id: u64,
+        resolved: bool,
+    ) -> Result<Thread, Failure> {
+        if !self.may_resolve(server, &self.load(id)?) {
+            return Err(Failure::Forbidden);
+        }
+        reviews::update(&self.repo_path, &self.target, id, |thread| {
+            thread.set_resolved(resolved, user);
+            Ok(())
+        })
+        .map_err(|e| Failure::Internal(e.to_string()))
+    }
+
+    fn load(&self, id: u64) -> Result<Thread, Failure> {
+        match reviews::get(&self.repo_path, &self.target, id) {
+            Ok(Some(thread)) => Ok(thread),
+            Ok(None) => Err(Failure::NotFound),
+            Err(e) => Err(Failure::Internal(e.to_string())),
+        }
+    }
+
+    /// Start, reply to, resolve or unresolve a thread from the diff's page
+    pub fn save_form(&self, server: &WebServer, form: &HashMap<String, String>) -> Response {
+        let user = match current_user() {
+            Some(user) => user,
+            None => return (StatusCode::UNAUTHORIZED, "Sign in to review changes").into_response(),
+        };
+        let field = |key: &str| form.get(key).map(String::as_str).unwrap_or("");
+        let thread = || {
+            field("thread")
+                .parse::<u64>()
+                .map_err(|_| Failure::Invalid("Missing thread".to_string()))
+        };
+        let result = match field("action") {
+            "start" => match (field("side").parse(), field("line").parse()) {
+                (Ok(side), Ok(line)) => self.start(
+                    server,
+                    &user,
+                    Position {
+                        path: field("path").to_string(),
+                        side,
+                        line,
+                    },
+                    field("body"),
+                ),
+                _ => Err(Failure::Invalid("Missing line".to_string())),
+            },
+            "reply" => thread().and_then(|id| self.reply(server, &user, id, field("body"))),
+            "resolve" => thread().and_then(|id| self.resolve(server, &user, id, true)),
+            "unresolve" => thread().and_then(|id| self.resolve(server, &user, id, false)),
+            action => Err(Failure::Invalid(format!("Unknown action '{}'", action))),
+        };
+        match result {
+            Ok(thread) => {
+                Redirect::to(&format!("{}#thread-{}", self.url, thread.id)).into_response()
+            }
+            Err(failure) => failure.into_response(),
+        }
+    }
+}
+
+/// Why a thread could not be changed
+enum Failure {
+    NotFound,
+    Forbidden,
+    /// The change itself is wrong; shown to the user
+    Invalid(String),
+    Internal(String),
+}
+
+impl IntoResponse for Failure {
+    fn into_response(self) -> Response {
+        match self {
+            Failure::NotFound => (StatusCode::NOT_FOUND, "Review thread not found".to_string()),
+            Failure::Forbidden => (
+                StatusCode::FORBIDDEN,
+                "Only the thread's author, the change's author and users with write access may resolve threads".to_string(),
+            ),
+            Failure::Invalid(e) => (StatusCode::UNPROCESSABLE_ENTITY, e),
+            Failure::Internal(e) => (StatusCode::INTERNAL_SERVER_ERROR, e),
+        }
+        .into_response()
+    }
+}
+
+/// The review of a commit named in an API path
+fn commit_review(server: &WebServer, repo_name: &str, rev: &str) -> Result<Review, Response> {
+    let (repo_name, repo_path) = server
+        .resolve_repo(repo_name)
+        .ok_or_else(|| (StatusCode::NOT_FOUND, "Repository not found").into_response())?;
+    let commit = server
+        .get_commit(&repo_path, rev)
+        .map_err(|_| (StatusCode::NOT_FOUND, "Commit not found").into_response())?;
+    Ok(Review::commit(server, &repo_name, &repo_path, &commit))
+}
+
+/// The review of a pull request named in an API path
+fn pull_review(server: &WebServer, repo_name: &str, number: u64) -> Result<Review, Response> {
+    let (repo_name, repo_path) = server
+        .resolve_repo(repo_name)
+        .ok_or_else(|| (StatusCode::NOT_FOUND, "Repository not found").into_response())?;
+    let pull = match pulls::get(&repo_path, number) {
+        Ok(Some(pull)) => pull,
+        Ok(None) => return Err((StatusCode::NOT_FOUND, "Pull request not found").into_response()),
+        Err(e) => return Err((StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response()),
+    };
+    Review::pull(&repo_name, &repo_path, &pull)
+        .map_err(|e| (StatusCode::UNPROCESSABLE_ENTITY, format!("{:#}", e)).into_response())
+}
+
+/// Threads with whether each is still `current`, that is shown inline
+fn list(review: Result<Review, Response>) -> Response {
+    let review = match review {
+        Ok(review) => review,
+        Err(response) => return response,
+    };
+    let lines = reviews::lines(&review.diff);
+    match review.threads() {
+        Ok(threads) => Json(
+            threads
+                .into_iter()
+                .map(|thread| {
+                    let current = reviews::is_current(&lines, &thread);
+                    let mut value = serde_json::to_value(thread).unwrap_or_default();
+                    value["current"] = current.into();
+                    value
+                })
+                .collect::<Vec<_>>(),
+        )
+        .into_response(),
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
+
+#[derive(Deserialize)]
+pub struct NewThread {
+    #[serde(flatten)]
+    position: Position,
+    body: String,
+}
+
+fn start(server: &WebServer, review: Result<Review, Response>, request: NewThread) -> Response {
+    let review = match review {
+        Ok(review) => review,
+        Err(response) => return response,
+    };
+    let user = match current_user() {
+        Some(user) => user,
+        None => return (StatusCode::UNAUTHORIZED, "Sign in to review changes").into_response(),
+    };
+    match review.start(server, &user, request.position, &request.body) {
+        Ok(thread) => (StatusCode::CREATED, Json(thread)).into_response(),
+        Err(failure) => failure.into_response(),
+    }
+}
+
+#[derive(Deserialize)]
+pub struct ThreadChange {
+    #[serde(default)]
+    resolved: Option<bool>,
+}
+
+fn change(
+    server: &WebServer,
+    review: Result<Review, Response>,
+    id: u64,
+    change: ThreadChange,
+) -> Response {
+    let review = match review {
+        Ok(review) => review,
+        Err(response) => return response,
+    };
+    let user = match current_user() {
+        Some(user) => user,
+        None => return (StatusCode::UNAUTHORIZED, "Sign in to review changes").into_response(),
+    };
+    let result = match change.resolved {
+        Some(resolved) => review.resolve(server, &user, id, resolved),
+        None => review.load(id),
+    };
+    match result {
+        Ok(thread) => Json(thread).into_response(),
+        Err(failure) => failure.into_response(),
+    }
+}
+
+#[derive(Deserialize)]
+pub struct NewReply {
+    body: String,
+}
+
+fn reply(
+    server: &WebServer,
+    review: Result<Review, Response>,
+    id: u64,
+    request: NewReply,
+) -> Response {
+    let review = match review {
+        Ok(review) => review,
+        Err(response) => return response,
+    };
+    let user = match current_user() {
+        Some(user) => user,
+        None => return (StatusCode::UNAUTHORIZED, "Sign in to review changes").into_response(),
+    };
+    match review.reply(server, &user, id, &request.body) {
+        Ok(thread) => (StatusCode::CREATED, Json(thread)).into_response(),
+        Err(failure) => failure.into_response(),
+    }
+}
+
+/// GET /api/v1/repos/<name>/commits/<id>/threads
+pub async fn api_commit_list(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, rev)): Path<(String, String)>,
+) -> Response {
+    list(commit_review(&server, &repo_name, &rev))
+}
+
+/// POST /api/v1/repos/<name>/commits/<id>/threads with
+/// `{"path": ..., "side": "new", "line": 12, "body": ...}`
+pub async fn api_commit_start(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, rev)): Path<(String, String)>,
+    Json(request): Json<NewThread>,
+) -> Response {
+    start(&server, commit_review(&server, &repo_name, &rev), request)
+}
+
+/// PATCH /api/v1/repos/<name>/commits/<id>/threads/<thread> with
+/// `{"resolved": true}`
+pub async fn api_commit_change(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, rev, id)): Path<(String, String, u64)>,
+    Json(request): Json<ThreadChange>,
+) -> Response {
+    change(
+        &server,
+        commit_review(&server, &repo_name, &rev),
+        id,
+        request,
+    )
+}
+
+/// POST /api/v1/repos/<name>/commits/<id>/threads/<thread>/replies with
+/// `{"body": ...}`
+pub async fn api_commit_reply(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, rev, id)): Path<(String, String, u64)>,
+    Json(request): Json<NewReply>,
+) -> Response {
+    reply(
+        &server,
+        commit_review(&server, &repo_name, &rev),
+        id,
+        request,
+    )
+}
+
+/// GET /api/v1/repos/<name>/pulls/<number>/threads
+pub async fn api_pull_list(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, number)): Path<(String, u64)>,
+) -> Response {
+    list(pull_review(&server, &repo_name, number))
+}
+
+/// POST /api/v1/repos/<name>/pulls/<number>/threads, like commit threads
+pub async fn api_pull_start(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, number)): Path<(String, u64)>,
+    Json(request): Json<NewThread>,
+) -> Response {
+    start(&server, pull_review(&server, &repo_name, number), request)
+}
+
+/// PATCH /api/v1/repos/<name>/pulls/<number>/threads/<thread>
+pub async fn api_pull_change(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, number, id)): Path<(String, u64, u64)>,
+    Json(request): Json<ThreadChange>,
+) -> Response {
+    change(
+        &server,
+        pull_review(&server, &repo_name, number),
+        id,
+        request,
+    )
+}
+
+/// POST /api/v1/repos/<name>/pulls/<number>/threads/<thread>/replies
+pub async fn api_pull_reply(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, number, id)): Path<(String, u64, u64)>,
+    Json(request): Json<NewReply>,
+) -> Response {
+    reply(
+        &server,
+        pull_review(&server, &repo_name, number),
+        id,
+        request,
+    )
+}
@@ -0,0 +1,128 @@
+use super::WebServer;
+use crate::git;
+use axum::{
+    extract::{Request, State},
+    http::{header, HeaderMap, HeaderValue},
+    middleware::Next,
+    response::{IntoResponse, Response},
+};
+use std::path::Path;
+use std::str::FromStr;
+use std::sync::Arc;
+
+/// Whether search engines may crawl the instance
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq)]
+pub enum RobotsPolicy {
+    /// Crawl repository pages, except repositories that opted out
+    #[default]
+    Allow,
+    /// Keep all crawlers away, e.g. for internal instances
+    Deny,
+}
+
+impl FromStr for RobotsPolicy {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "allow" => Ok(Self::Allow),
+            "deny" => Ok(Self::Deny),
+            _ => Err(format!(
+                "unknown robots policy '{}' (expected allow or deny)",
+                s
+            )),
+        }
+    }
+}
+
+/// Whether a repository asked to be left out of search engines with
+/// `agito.noindex = true` in its git config
+pub fn excluded(repo_path: &Path) -> bool {
+    git::config_get(repo_path, "agito.noindex").as_deref() == Some("true")
+}
+
+/// Pages below /repo/<name>/ that are costly to crawl or useless in search
+/// results. Recent commits are listed in the sitemap instead of crawled via logs.
+const UNCRAWLED_PAGES: &[&str] = &["raw", "archive", "log", "contributors", "widget"];
+
+/// Top-level paths that are per-user, machine-readable or both
+const PRIVATE_PATHS: &[&str] = &["/api/", "/notifications", "/oembed", "/avatar/", "/metrics"];
+
+/// GET /robots.txt: web/static/robots.txt if present, else generated from the policy
+pub async fn handle(State(server): State<Arc<WebServer>>, headers: HeaderMap) -> Response {
+    if server.assets.url("robots.txt").is_some() {
+        return server.assets.serve("robots.txt").await;
+    }
+
+    let mut body = String::from("User-agent: *\n");
+    match server.robots {
+        RobotsPolicy::Deny => body.push_str("Disallow: /\n"),
+        RobotsPolicy::Allow => {
+            for path in PRIVATE_PATHS {
+                body.push_str(&format!("Disallow: {}\n", path));
+            }
+            for page in UNCRAWLED_PAGES {
+                body.push_str(&format!("Disallow: /repo/*/{}/\n", page));
+            }
+            if let Ok(repos) = git::find_repositories(&server.repos_dir) {
+                // Others are hidden from crawlers anyway, and naming them
+                // would give them away
+                for (name, path) in repos {
+                    if excluded(&path)
+                        && crate::orgs::is_public(&server.data_dir, &server.repos_dir, &name)
+                    {
+                        body.push_str(&format!("Disallow: /repo/{}\n", super::url_path(&name)));
+                    }
+                }
+            }
+            if server.sitemap.is_some() {
+                body.push_str(&format!(
+                    "\nSitemap: {}/sitemap.xml\n",
+                    super::embed::base_url(&server, &headers)
+                ));
+            }
+        }
+    }
+
+    ([(header::CONTENT_TYPE, "text/plain; charset=utf-8")], body).into_response()
+}
+
+/// Add `X-Robots-Tag` to responses that should stay out of search indexes,
+/// for crawlers that ignore robots.txt or reach pages through links
+pub async fn middleware(
+    State(server): State<Arc<WebServer>>,
+    req: Request,
+    next: Next,
+) -> Response {
+    let tag = robots_tag(&server, req.uri().path());
+    let mut response = next.run(req).await;
+    if let Some(tag) = tag {
+        response
+            .headers_mut()
+            .insert("x-robots-tag", HeaderValue::from_static(tag));
+    }
+    response
+}
+
+fn robots_tag(server: &WebServer, path: &str) -> Option<&'static str> {
+    if server.robots == RobotsPolicy::Deny {
+        return Some("noindex, nofollow");
+    }
+    if PRIVATE_PATHS
+        .iter()
+        .any(|p| path.starts_with(p.trim_end_matches('/')))
+    {
+        return Some("noindex");
+    }
+
+    let rest = path.strip_prefix("/repo/")?;
+    let (name, page) = rest.split_once('/').unwrap_or((rest, ""));
+    if server.repo_path(name).map_or(false, |p| excluded(&p)) {
+        return Some("noindex, nofollow");
+    }
+    let page = page.split('/').next().unwrap_or("");
+    if page == "raw" || page == "widget" {
+        return Some("noindex");
+    }
+    None
+}
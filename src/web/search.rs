@@ -0,0 +1,249 @@
+use super::{html_escape, render_page, url_path, WebServer};
+use crate::git;
+use crate::search::{self, Hit, Query as SearchQuery};
+use axum::{
+    extract::{Query, State},
+    http::StatusCode,
+    response::{IntoResponse, Response},
+    Json,
+};
+use std::collections::HashMap;
+use std::path::PathBuf;
+use std::sync::Arc;
+
+/// Files shown for one search, over all repositories
+const MAX_HITS: usize = 50;
+
+/// Languages offered in the search form
+const LANGUAGES: &[&str] = &[
+    "C",
+    "C++",
+    "C#",
+    "Go",
+    "HCL",
+    "Java",
+    "JavaScript",
+    "Kotlin",
+    "Markdown",
+    "PHP",
+    "Python",
+    "Ruby",
+    "Rust",
+    "Shell",
+    "SQL",
+    "Swift",
+    "TypeScript",
+    "YAML",
+];
+
+/// Matches in one repository
+struct RepoHits {
+    repo: String,
+    branch: String,
+    hits: Vec<Hit>,
+}
+
+/// The search and the repositories it covers, from `q`, `repo`, `lang` and
+/// `path`: the one repository asked for, or every listed repository the user
+/// may read
+fn parse(
+    server: &WebServer,
+    query: &HashMap<String, String>,
+) -> Result<(SearchQuery, Vec<(String, PathBuf)>), (StatusCode, String)> {
+    let language = match query.get("lang").filter(|lang| !lang.is_empty()) {
+        Some(lang) => match search::find_language(lang) {
+            Some(language) => Some(language.to_string()),
+            None => {
+                return Err((
+                    StatusCode::BAD_REQUEST,
+                    format!("Unknown language '{}'", lang),
+                ))
+            }
+        },
+        None => None,
+    };
+    let search_query = SearchQuery {
+        text: query.get("q").cloned().unwrap_or_default(),
+        language,
+        path: query.get("path").filter(|path| !path.is_empty()).cloned(),
+    };
+
+    let repos = match query.get("repo").filter(|repo| !repo.is_empty()) {
+        Some(repo) => match server.resolve_repo(repo) {
+            Some(found) => vec![found],
+            None => return Err((StatusCode::NOT_FOUND, "Repository not found".to_string())),
+        },
+        None => git::find_repositories(&server.repos_dir)
+            .unwrap_or_default()
+            .into_iter()
+            .filter(|(name, _)| server.listing.shows(name))
+            .filter_map(|(name, _)| Some((name.clone(), server.repo_path(&name)?)))
+            .collect(),
+    };
+    Ok((search_query, repos))
+}
+
+/// Run a search over repositories, stopping at [`MAX_HITS`] files
+fn run(query: &SearchQuery, repos: &[(String, PathBuf)]) -> Vec<RepoHits> {
+    let mut found = Vec::new();
+    let mut remaining = MAX_HITS;
+    for (repo, repo_path) in repos {
+        if remaining == 0 {
+            break;
+        }
+        if let Some((branch, hits)) = search::search(repo_path, query, remaining) {
+            if !hits.is_empty() {
+                remaining -= hits.len();
+                found.push(RepoHits {
+                    repo: repo.clone(),
+                    branch,
+                    hits,
+                });
+            }
+        }
+    }
+    found
+}
+
+fn disabled() -> Response {
+    (
+        StatusCode::NOT_FOUND,
+        "Code search is not enabled on this server",
+    )
+        .into_response()
+}
+
+/// Code search: /search?q=<text>&repo=<name>&lang=<language>&path=<prefix>
+pub async fn search_page(
+    State(server): State<Arc<WebServer>>,
+    Query(query): Query<HashMap<String, String>>,
+) -> Response {
+    if !server.code_search {
+        return disabled();
+    }
+    let value = |key: &str| html_escape(query.get(key).map(String::as_str).unwrap_or(""));
+    let selected = query.get("lang").map(String::as_str).unwrap_or("");
+    let mut options = String::from("<option value=\"\">Any language</option>");
+    for language in LANGUAGES {
+        options.push_str(&format!(
+            "<option{}>{}</option>",
+            if language.eq_ignore_ascii_case(selected) {
+                " selected"
+            } else {
+                ""
+            },
+            html_escape(language)
+        ));
+    }
+    let mut body = format!(
+        "<h1>Search code</h1>\n<form method=\"get\" action=\"/search\">\n<input type=\"search\" name=\"q\" size=\"40\" placeholder=\"Text to find\" value=\"{}\" autofocus>\n<input type=\"text\" name=\"repo\" placeholder=\"Repository\" value=\"{}\">\n<input type=\"text\" name=\"path\" placeholder=\"Path prefix\" value=\"{}\">\n<select name=\"lang\">{}</select>\n<button type=\"submit\">Search</button>\n</form>\n",
+        value("q"),
+        value("repo"),
+        value("path"),
+        options
+    );
+
+    if query.get("q").map_or(false, |q| !q.trim().is_empty()) {
+        match parse(&server, &query) {
+            Err((_, e)) => body.push_str(&format!(
+                "<p class=\"error\"><strong>{}</strong></p>\n",
+                html_escape(&e)
+            )),
+            Ok((search_query, repos)) => match search_query.check() {
+                Err(e) => body.push_str(&format!(
+                    "<p class=\"error\"><strong>{}</strong></p>\n",
+                    html_escape(&e)
+                )),
+                Ok(()) => body.push_str(&results_html(&run(&search_query, &repos))),
+            },
+        }
+    }
+
+    render_page(
+        &server,
+        "Search code",
+        r#"<a href="/">Home</a> / Search"#,
+        &body,
+    )
+}
+
+fn results_html(found: &[RepoHits]) -> String {
+    let files: usize = found.iter().map(|repo| repo.hits.len()).sum();
+    if files == 0 {
+        return "<p>No matches. Only the default branch of each repository is searched.</p>\n"
+            .to_string();
+    }
+    let mut html = format!(
+        "<p>{} {}{}.</p>\n",
+        files,
+        if files == 1 { "file" } else { "files" },
+        if files >= MAX_HITS {
+            "; narrow the search to see more"
+        } else {
+            ""
+        }
+    );
+    for repo in found {
+        html.push_str(&format!(
+            "<div class=\"section\"><h2><a href=\"/repo/{}\">{}</a></h2>\n",
+            url_path(&repo.repo),
+            html_escape(&repo.repo)
+        ));
+        for hit in &repo.hits {
+            html.push_str(&format!(
+                "<p><a href=\"/repo/{}/blob/{}/{}\"><code>{}</code></a>{} &middot; {} {}</p>\n<pre>",
+                url_path(&repo.repo),
+                url_path(&repo.branch),
+                url_path(&hit.path),
+                html_escape(&hit.path),
+                hit.language
+                    .as_ref()
+                    .map(|language| format!(" <span class=\"label\">{}</span>", html_escape(language)))
+                    .unwrap_or_default(),
+                hit.matches,
+                if hit.matches == 1 { "match" } else { "matches" }
+            ));
+            for line in &hit.lines {
+                html.push_str(&format!(
+                    "<span class=\"diff-num\">{:>5}</span>  {}\n",
+                    line.number,
+                    html_escape(&line.text)
+                ));
+            }
+            html.push_str("</pre>\n");
+        }
+        html.push_str("</div>\n");
+    }
+    html
+}
+
+/// GET /api/v1/search/code?q=<text>&repo=<name>&lang=<language>&path=<prefix>
+pub async fn api(
+    State(server): State<Arc<WebServer>>,
+    Query(query): Query<HashMap<String, String>>,
+) -> Response {
+    if !server.code_search {
+        return disabled();
+    }
+    let (search_query, repos) = match parse(&server, &query) {
+        Ok(parsed) => parsed,
+        Err(response) => return response.into_response(),
+    };
+    if let Err(e) = search_query.check() {
+        return (StatusCode::BAD_REQUEST, e).into_response();
+    }
+    let found = run(&search_query, &repos);
+    Json(
+        found
+            .into_iter()
+            .map(|repo| {
+                serde_json::json!({
+                    "repo": repo.repo,
+                    "branch": repo.branch,
+                    "files": repo.hits,
+                })
+            })
+            .collect::<Vec<_>>(),
+    )
+    .into_response()
+}
@@ -0,0 +1,47 @@
+use axum::{
+    extract::Request,
+    http::{header, HeaderName, HeaderValue},
+    middleware::Next,
+    response::Response,
+};
+
+/// What pages may load: only the server's own styles and images, plus images
+/// from anywhere over HTTPS for READMEs and avatars, and no scripts at all.
+/// Only the server's own pages may frame them.
+const CONTENT_SECURITY_POLICY: &str = "default-src 'self'; img-src 'self' https: data:; style-src 'self' 'unsafe-inline'; script-src 'none'; object-src 'none'; base-uri 'none'; form-action 'self'; frame-ancestors 'self'";
+
+/// Policy of pages made to be embedded on other sites, such as the
+/// repository card widget
+pub const EMBEDDABLE_POLICY: &str =
+    "default-src 'none'; img-src 'self' https: data:; style-src 'unsafe-inline'; frame-ancestors *";
+
+/// Add headers that keep browsers from running, framing or sniffing what
+/// the server sends in ways it didn't mean. A response that sets its own
+/// Content-Security-Policy keeps it, and can then be framed as it allows.
+pub async fn middleware(req: Request, next: Next) -> Response {
+    let mut response = next.run(req).await;
+    let headers = response.headers_mut();
+    if !headers.contains_key(header::CONTENT_SECURITY_POLICY) {
+        headers.insert(
+            header::CONTENT_SECURITY_POLICY,
+            HeaderValue::from_static(CONTENT_SECURITY_POLICY),
+        );
+        // For browsers that don't know frame-ancestors
+        headers.insert(
+            header::X_FRAME_OPTIONS,
+            HeaderValue::from_static("SAMEORIGIN"),
+        );
+    }
+    let defaults: [(HeaderName, &str); 2] = [
+        (header::X_CONTENT_TYPE_OPTIONS, "nosniff"),
+        // Links to other sites don't reveal which page, or repository, they
+        // were followed from
+        (header::REFERRER_POLICY, "same-origin"),
+    ];
+    for (name, value) in defaults {
+        if !headers.contains_key(&name) {
+            headers.insert(name, HeaderValue::from_static(value));
+        }
+    }
+    response
+}
@@ -0,0 +1,719 @@
+use super::auth::{current_user, remote_addr};
+use super::{breadcrumb, html_escape, render_page, url_path, WebServer};
+use crate::archive;
+use crate::audit::{self, Action, Via};
+use crate::git_daemon;
+use crate::namespaces;
+use crate::orgs::{self, Role};
+use crate::policies::{self, Policy};
+use crate::protection::{self, Rule};
+use crate::redirects;
+use crate::topics;
+use crate::trash;
+use crate::visibility::{self, Visibility};
+use axum::{
+    extract::{Path, State},
+    http::StatusCode,
+    response::{IntoResponse, Redirect, Response},
+    Json,
+};
+use serde::Deserialize;
+use std::collections::HashMap;
+use std::path::PathBuf;
+use std::sync::Arc;
+
+pub fn forbidden() -> Response {
+    (
+        StatusCode::FORBIDDEN,
+        "Only the repository's admins may change its settings",
+    )
+        .into_response()
+}
+
+/// Links between the settings pages
+pub fn settings_nav(repo_name: &str) -> String {
+    format!(
+        "<p><a href=\"/repo/{0}/settings/access\">Access</a> | <a href=\"/repo/{0}/settings/policies\">Push policies</a> | <a href=\"/repo/{0}/settings/branches\">Protected branches</a> | <a href=\"/repo/{0}/settings/webhooks\">Webhooks</a> | <a href=\"/repo/{0}/settings/deploy-keys\">Deploy keys</a> | <a href=\"/repo/{0}/settings/mirrors\">Mirrors</a> | <a href=\"/repo/{0}/settings/topics\">Topics</a> | <a href=\"/repo/{0}/settings/rename\">Rename</a> | <a href=\"/repo/{0}/settings/archive\">Archive</a> | <a href=\"/repo/{0}/settings/delete\">Delete</a></p>\n",
+        url_path(repo_name)
+    )
+}
+
+pub fn error_message(error: Option<&str>) -> String {
+    error
+        .map(|e| {
+            format!(
+                "<p class=\"error\"><strong>{}</strong></p>\n",
+                html_escape(e)
+            )
+        })
+        .unwrap_or_default()
+}
+
+/// Push policy settings: /repo/<name>/settings/policies
+pub fn policies_page(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    error: Option<&str>,
+) -> Response {
+    if !server.may_administer(repo_path) {
+        return forbidden();
+    }
+
+    let mut body = settings_nav(repo_name);
+    body.push_str(
+        "<h1>Push policies</h1>\n<p>Built-in checks run on every push; a push breaking any of them is rejected.</p>\n",
+    );
+    body.push_str(&error_message(error));
+    body.push_str(&format!(
+        "<form method=\"post\" action=\"/repo/{}/settings/policies\">\n",
+        url_path(repo_name)
+    ));
+    for policy in Policy::ALL {
+        let value = policies::value(repo_path, policy);
+        body.push_str(&format!(
+            "<fieldset>\n<label><input type=\"checkbox\" name=\"{}\"{}> {}</label><br>\n<input type=\"text\" name=\"{}.value\" value=\"{}\" size=\"40\"> <small>{}</small>\n</fieldset>\n",
+            policy.name(),
+            if value.is_some() { " checked" } else { "" },
+            policy.label(),
+            policy.name(),
+            html_escape(value.as_deref().unwrap_or(policy.default_value())),
+            policy.parameter()
+        ));
+    }
+    body.push_str("<button type=\"submit\">Save</button>\n</form>\n");
+
+    render_page(
+        server,
+        &format!("{} - Push policies", repo_name),
+        &breadcrumb(
+            repo_name,
+            &[
+                ("Settings".to_string(), None),
+                ("Push policies".to_string(), None),
+            ],
+        ),
+        &body,
+    )
+}
+
+/// Save the push policy form, then show the settings again
+pub fn save_policies(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    form: &HashMap<String, String>,
+) -> Response {
+    if !server.may_administer(repo_path) {
+        return forbidden();
+    }
+
+    // Check everything before changing anything, so a bad value leaves the
+    // settings as they were
+    let mut changes = Vec::new();
+    for policy in Policy::ALL {
+        if form.contains_key(policy.name()) {
+            let value = form
+                .get(&format!("{}.value", policy.name()))
+                .map(|v| v.trim())
+                .unwrap_or("");
+            if let Err(e) = policy.validate(value) {
+                return policies_page(
+                    server,
+                    repo_name,
+                    repo_path,
+                    Some(&format!("{}: {}", policy.label(), e)),
+                );
+            }
+            changes.push((policy, Some(value)));
+        } else {
+            changes.push((policy, None));
+        }
+    }
+    for (policy, value) in changes {
+        if let Err(e) = policies::set(repo_path, policy, value) {
+            return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response();
+        }
+    }
+    if let Some(user) = current_user() {
+        tracing::info!(repo = %repo_name, user = %user, "Updated push policies");
+    }
+    Redirect::to(&format!("/repo/{}/settings/policies", url_path(repo_name))).into_response()
+}
+
+/// Protected branch settings: /repo/<name>/settings/branches
+pub fn branches_page(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    error: Option<&str>,
+) -> Response {
+    if !server.may_administer(repo_path) {
+        return forbidden();
+    }
+
+    let action = format!("/repo/{}/settings/branches", url_path(repo_name));
+    let mut body = settings_nav(repo_name);
+    body.push_str(
+        "<h1>Protected branches</h1>\n<p>Protected branches cannot be force-pushed or deleted unless their rule allows it.</p>\n",
+    );
+    body.push_str(&error_message(error));
+
+    let rules = protection::rules(repo_path);
+    if rules.is_empty() {
+        body.push_str("<p>No branches are protected.</p>\n");
+    } else {
+        body.push_str(
+            "<table>\n<tr><th>Branches</th><th>Force-push</th><th>Deletion</th><th>Pushes</th><th></th></tr>\n",
+        );
+        for rule in &rules {
+            let allowed = |yes| if yes { "allowed" } else { "rejected" };
+            body.push_str(&format!(
+                "<tr><td><code>{}</code></td><td>{}</td><td>{}</td><td>{}</td><td><form method=\"post\" action=\"{}\"><input type=\"hidden\" name=\"remove\" value=\"{}\"><button type=\"submit\">Remove</button></form></td></tr>\n",
+                html_escape(&rule.pattern),
+                allowed(rule.allow_force_push),
+                allowed(rule.allow_deletion),
+                if rule.require_pull_request {
+                    "pull requests only"
+                } else {
+                    "allowed"
+                },
+                action,
+                html_escape(&rule.pattern)
+            ));
+        }
+        body.push_str("</table>\n");
+    }
+
+    body.push_str(&format!(
+        "<h2>Protect branches</h2>\n<form method=\"post\" action=\"{}\">\n<input type=\"text\" name=\"pattern\" placeholder=\"main or release/*\" size=\"30\" required><br>\n<label><input type=\"checkbox\" name=\"allow-force-push\"> Allow force-pushes</label><br>\n<label><input type=\"checkbox\" name=\"allow-deletion\"> Allow deletion</label><br>\n<label><input type=\"checkbox\" name=\"require-pull-request\"> Require merging on the server instead of pushing</label><br>\n<button type=\"submit\">Protect</button>\n</form>\n",
+        action
+    ));
+
+    render_page(
+        server,
+        &format!("{} - Protected branches", repo_name),
+        &breadcrumb(
+            repo_name,
+            &[
+                ("Settings".to_string(), None),
+                ("Protected branches".to_string(), None),
+            ],
+        ),
+        &body,
+    )
+}
+
+/// Add or remove a protected branch rule, then show the settings again
+pub fn save_branches(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    form: &HashMap<String, String>,
+) -> Response {
+    if !server.may_administer(repo_path) {
+        return forbidden();
+    }
+
+    let result = if let Some(pattern) = form.get("remove") {
+        protection::unprotect(repo_path, pattern).map(|_| format!("unprotected {}", pattern))
+    } else {
+        let pattern = form.get("pattern").map(|p| p.trim()).unwrap_or("");
+        if pattern.is_empty() || pattern.contains(char::is_whitespace) {
+            return branches_page(
+                server,
+                repo_name,
+                repo_path,
+                Some("Enter one branch name or glob"),
+            );
+        }
+        let rule = Rule {
+            pattern: pattern.trim_start_matches("refs/heads/").to_string(),
+            allow_force_push: form.contains_key("allow-force-push"),
+            allow_deletion: form.contains_key("allow-deletion"),
+            require_pull_request: form.contains_key("require-pull-request"),
+        };
+        protection::protect(repo_path, &rule).map(|()| format!("protected {}", rule))
+    };
+    match result {
+        Ok(change) => {
+            let user = current_user();
+            if let Some(user) = &user {
+                tracing::info!(repo = %repo_name, user = %user, "Branch protection: {}", change);
+            }
+            audit::Entry::new(Action::ProtectionChange, Via::Web, user.as_deref())
+                .with_repo(repo_name)
+                .with_detail(change)
+                .with_remote(remote_addr())
+                .record(&server.data_dir);
+            Redirect::to(&format!("/repo/{}/settings/branches", url_path(repo_name)))
+                .into_response()
+        }
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
+
+/// Archiving: /repo/<name>/settings/archive
+pub fn archive_page(server: &WebServer, repo_name: &str, repo_path: &PathBuf) -> Response {
+    if !server.may_administer(repo_path) {
+        return forbidden();
+    }
+
+    let action = format!("/repo/{}/settings/archive", url_path(repo_name));
+    let mut body = settings_nav(repo_name);
+    body.push_str("<h1>Archive</h1>\n");
+    if archive::is_archived(repo_path) {
+        body.push_str(&format!(
+            "<p>The repository is archived: it can be cloned and browsed, but takes no pushes, merges or new pull requests, and is left out of the repository list.</p>\n<form method=\"post\" action=\"{}\">\n<input type=\"hidden\" name=\"archived\" value=\"false\">\n<button type=\"submit\">Unarchive</button>\n</form>\n",
+            action
+        ));
+    } else {
+        body.push_str(&format!(
+            "<p>Archive a repository that is finished but must stay readable. It can still be cloned and browsed, but takes no more pushes, merges or pull requests, and pull mirrors stop fetching. It is left out of the repository list unless archived repositories are shown. You can unarchive it at any time.</p>\n<form method=\"post\" action=\"{}\">\n<input type=\"hidden\" name=\"archived\" value=\"true\">\n<button type=\"submit\">Archive this repository</button>\n</form>\n",
+            action
+        ));
+    }
+
+    render_page(
+        server,
+        &format!("{} - Archive", repo_name),
+        &breadcrumb(
+            repo_name,
+            &[
+                ("Settings".to_string(), None),
+                ("Archive".to_string(), None),
+            ],
+        ),
+        &body,
+    )
+}
+
+/// Archive or unarchive the repository, then show its front page
+pub fn save_archive(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    form: &HashMap<String, String>,
+) -> Response {
+    if !server.may_administer(repo_path) {
+        return forbidden();
+    }
+
+    let archived = form.get("archived").map(String::as_str) == Some("true");
+    if let Err(e) = archive::set(repo_path, archived) {
+        return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response();
+    }
+    let change = if archived { "archived" } else { "unarchived" };
+    let user = current_user();
+    if let Some(user) = &user {
+        tracing::info!(repo = %repo_name, user = %user, "Repository {}", change);
+    }
+    audit::Entry::new(Action::RepoArchive, Via::Web, user.as_deref())
+        .with_repo(repo_name)
+        .with_detail(change)
+        .with_remote(remote_addr())
+        .record(&server.data_dir);
+    Redirect::to(&format!("/repo/{}", url_path(repo_name))).into_response()
+}
+
+/// Who may use the repository: /repo/<name>/settings/access
+pub fn access_page(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    error: Option<&str>,
+) -> Response {
+    if !server.may_administer(repo_path) {
+        return forbidden();
+    }
+
+    let action = format!("/repo/{}/settings/access", url_path(repo_name));
+    let current = visibility::effective(repo_path, orgs::in_org(&server.data_dir, repo_name));
+    let mut body = settings_nav(repo_name);
+    body.push_str("<h1>Access</h1>\n");
+    body.push_str(&error_message(error));
+    body.push_str("<h2>Visibility</h2>\n<p>Anyone may read a public repository, signed-in users an internal one, and only collaborators and those the namespace or organization grants a role a private one. Pushing always needs write access.</p>\n");
+    let options: String = Visibility::ALL
+        .iter()
+        .map(|visibility| {
+            format!(
+                "<option value=\"{0}\"{1}>{0}</option>",
+                visibility.name(),
+                if *visibility == current {
+                    " selected"
+                } else {
+                    ""
+                }
+            )
+        })
+        .collect();
+    body.push_str(&format!(
+        "<form method=\"post\" action=\"{}\">\n<input type=\"hidden\" name=\"action\" value=\"visibility\">\n<select name=\"visibility\">{}</select>\n<button type=\"submit\">Save</button>\n</form>\n",
+        action, options
+    ));
+
+    body.push_str("<h2>git:// daemon</h2>\n");
+    let exported = git_daemon::is_exported(repo_path);
+    body.push_str(&format!(
+        "<p>{}</p>\n<form method=\"post\" action=\"{}\">\n<input type=\"hidden\" name=\"action\" value=\"export\">\n<input type=\"hidden\" name=\"exported\" value=\"{}\">\n<button type=\"submit\">{}</button>\n</form>\n",
+        if exported {
+            "The repository is marked for anonymous clones over git://, which the server offers while it is public and the git daemon runs."
+        } else {
+            "Public repositories can also offer anonymous clones over git://, the quickest way to clone, when the server runs the git daemon."
+        },
+        action,
+        !exported,
+        if exported { "Stop serving over git://" } else { "Serve over git://" }
+    ));
+
+    body.push_str("<h2>Collaborators</h2>\n");
+    let collaborators = match visibility::collaborators(repo_path) {
+        Ok(collaborators) => collaborators,
+        Err(e) => return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    };
+    if collaborators.is_empty() {
+        body.push_str("<p>No collaborators.</p>\n");
+    } else {
+        body.push_str("<table>\n<tr><th>User</th><th>Role</th><th></th></tr>\n");
+        for (user, role) in &collaborators {
+            body.push_str(&format!(
+                "<tr><td>{0}</td><td>{1}</td><td><form method=\"post\" action=\"{2}\"><input type=\"hidden\" name=\"action\" value=\"remove\"><input type=\"hidden\" name=\"user\" value=\"{0}\"><button type=\"submit\">Remove</button></form></td></tr>\n",
+                html_escape(user),
+                role.name(),
+                action
+            ));
+        }
+        body.push_str("</table>\n");
+    }
+    body.push_str(&format!(
+        "<form method=\"post\" action=\"{}\">\n<input type=\"hidden\" name=\"action\" value=\"add\">\n<input type=\"text\" name=\"user\" placeholder=\"user name\" required>\n<select name=\"role\">{}</select>\n<button type=\"submit\">Add or change</button>\n</form>\n",
+        action,
+        super::orgs::role_options(Some(Role::Write), false)
+    ));
+
+    render_page(
+        server,
+        &format!("{} - Access", repo_name),
+        &breadcrumb(
+            repo_name,
+            &[("Settings".to_string(), None), ("Access".to_string(), None)],
+        ),
+        &body,
+    )
+}
+
+/// Change the repository's visibility or collaborators, then show the page
+/// again
+pub fn save_access(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    form: &HashMap<String, String>,
+) -> Response {
+    if !server.may_administer(repo_path) {
+        return forbidden();
+    }
+
+    let field = |name: &str| form.get(name).map(|value| value.trim()).unwrap_or("");
+    let (detail, result) = match field("action") {
+        "visibility" => match field("visibility").parse::<Visibility>() {
+            Ok(visibility) => (
+                format!("visibility {}", visibility.name()),
+                visibility::set(repo_path, visibility),
+            ),
+            Err(e) => return access_page(server, repo_name, repo_path, Some(&e)),
+        },
+        "add" => {
+            let user = field("user");
+            if !namespaces::valid_user(user) {
+                let e = format!("Invalid user name '{}'", user);
+                return access_page(server, repo_name, repo_path, Some(&e));
+            }
+            match field("role").parse::<Role>() {
+                Ok(role) => (
+                    format!("collaborator {} {}", user, role.name()),
+                    visibility::set_collaborator(repo_path, user, Some(role)),
+                ),
+                Err(e) => return access_page(server, repo_name, repo_path, Some(&e)),
+            }
+        }
+        "remove" => (
+            format!("collaborator {} removed", field("user")),
+            visibility::set_collaborator(repo_path, field("user"), None),
+        ),
+        "export" => {
+            let exported = field("exported") == "true";
+            (
+                format!(
+                    "{} over git://",
+                    if exported { "exported" } else { "unexported" }
+                ),
+                git_daemon::set_exported(repo_path, exported).map_err(Into::into),
+            )
+        }
+        _ => return (StatusCode::BAD_REQUEST, "Unknown action").into_response(),
+    };
+    if let Err(e) = result {
+        return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response();
+    }
+    let user = current_user();
+    tracing::info!(repo = %repo_name, user = ?user, "Repository access changed: {}", detail);
+    audit::Entry::new(Action::RepoAccess, Via::Web, user.as_deref())
+        .with_repo(repo_name)
+        .with_detail(detail)
+        .with_remote(remote_addr())
+        .record(&server.data_dir);
+    Redirect::to(&format!("/repo/{}/settings/access", url_path(repo_name))).into_response()
+}
+
+/// Topics the index can filter by: /repo/<name>/settings/topics
+pub fn topics_page(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    error: Option<&str>,
+) -> Response {
+    if !server.may_administer(repo_path) {
+        return forbidden();
+    }
+
+    let mut body = settings_nav(repo_name);
+    body.push_str("<h1>Topics</h1>\n");
+    body.push_str(&error_message(error));
+    body.push_str(&format!(
+        "<p>Topics are shown on the repository page and the index, and the index can list only the repositories with a topic. Use lowercase letters, digits and hyphens, at most {} topics.</p>\n<form method=\"post\" action=\"/repo/{}/settings/topics\">\n<label>Topics, separated by commas<br><input type=\"text\" name=\"topics\" size=\"60\" placeholder=\"infra, terraform\" value=\"{}\"></label>\n<button type=\"submit\">Save</button>\n</form>\n",
+        topics::MAX_TOPICS,
+        url_path(repo_name),
+        html_escape(&topics::get(repo_path).join(", "))
+    ));
+
+    render_page(
+        server,
+        &format!("{} - Topics", repo_name),
+        &breadcrumb(
+            repo_name,
+            &[("Settings".to_string(), None), ("Topics".to_string(), None)],
+        ),
+        &body,
+    )
+}
+
+/// Replace the repository's topics, then show its front page
+pub fn save_topics(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    form: &HashMap<String, String>,
+) -> Response {
+    if !server.may_administer(repo_path) {
+        return forbidden();
+    }
+
+    let list = form.get("topics").map(String::as_str).unwrap_or("");
+    let parsed = match topics::parse(list) {
+        Ok(parsed) => parsed,
+        Err(e) => return topics_page(server, repo_name, repo_path, Some(&e)),
+    };
+    if let Err(e) = topics::set(repo_path, &parsed) {
+        return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response();
+    }
+    Redirect::to(&format!("/repo/{}", url_path(repo_name))).into_response()
+}
+
+/// GET /api/v1/repos/<name>/topics
+pub async fn api_topics(
+    State(server): State<Arc<WebServer>>,
+    Path(repo_name): Path<String>,
+) -> Response {
+    match server.resolve_repo(&repo_name) {
+        Some((_, repo_path)) => {
+            Json(serde_json::json!({ "topics": topics::get(&repo_path) })).into_response()
+        }
+        None => (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    }
+}
+
+#[derive(Deserialize)]
+pub struct TopicsRequest {
+    topics: Vec<String>,
+}
+
+/// PUT /api/v1/repos/<name>/topics with `topics`, replacing them all
+pub async fn api_set_topics(
+    State(server): State<Arc<WebServer>>,
+    Path(repo_name): Path<String>,
+    Json(request): Json<TopicsRequest>,
+) -> Response {
+    let repo_path = match server.resolve_repo(&repo_name) {
+        Some((_, repo_path)) => repo_path,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    if !server.may_administer(&repo_path) {
+        return forbidden();
+    }
+    let parsed = match topics::parse(&request.topics.join(",")) {
+        Ok(parsed) => parsed,
+        Err(e) => return (StatusCode::UNPROCESSABLE_ENTITY, e).into_response(),
+    };
+    match topics::set(&repo_path, &parsed) {
+        Ok(()) => Json(serde_json::json!({ "topics": parsed })).into_response(),
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
+
+/// Renaming the repository: /repo/<name>/settings/rename
+pub fn rename_page(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    error: Option<&str>,
+) -> Response {
+    if !server.may_administer(repo_path) {
+        return forbidden();
+    }
+
+    let (namespace, name) = match repo_name.split_once('/') {
+        Some((namespace, name)) => (format!("{}/", namespace), name),
+        None => (String::new(), repo_name),
+    };
+    let redirect = match server.resolver.redirect_days {
+        Some(days) => format!("for {} days", days),
+        None => "from now on".to_string(),
+    };
+    let mut body = settings_nav(repo_name);
+    body.push_str("<h1>Rename</h1>\n");
+    body.push_str(&error_message(error));
+    body.push_str(&format!(
+        "<p>The old name keeps working {}: web links and API calls are redirected, and clones using it as their remote can still fetch and push, with a warning to update the remote. To move the repository to another namespace, use <code>agito repo {} rename</code>.</p>\n<form method=\"post\" action=\"/repo/{}/settings/rename\">\n<label>New name {}<input type=\"text\" name=\"name\" value=\"{}\"></label>\n<button type=\"submit\">Rename</button>\n</form>\n",
+        redirect,
+        html_escape(repo_name),
+        url_path(repo_name),
+        html_escape(&namespace),
+        html_escape(name)
+    ));
+
+    render_page(
+        server,
+        &format!("{} - Rename", repo_name),
+        &breadcrumb(
+            repo_name,
+            &[("Settings".to_string(), None), ("Rename".to_string(), None)],
+        ),
+        &body,
+    )
+}
+
+/// Rename the repository within its namespace, then show it under the new
+/// name
+pub fn save_rename(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    form: &HashMap<String, String>,
+) -> Response {
+    if !server.may_administer(repo_path) {
+        return forbidden();
+    }
+
+    let requested = form.get("name").map(|name| name.trim()).unwrap_or("");
+    if requested.contains('/') {
+        return rename_page(
+            server,
+            repo_name,
+            repo_path,
+            Some("Use agito repo rename to move the repository to another namespace"),
+        );
+    }
+    let to = match repo_name.split_once('/') {
+        Some((namespace, _)) => format!("{}/{}", namespace, requested),
+        None => requested.to_string(),
+    };
+    let to = match namespaces::qualified_name(&to) {
+        Ok(to) if to == repo_name => return rename_page(server, repo_name, repo_path, None),
+        Ok(to) => to,
+        Err(e) => return rename_page(server, repo_name, repo_path, Some(&e.to_string())),
+    };
+    if let Err(e) = redirects::rename(
+        &server.repos_dir,
+        &server.data_dir,
+        repo_name,
+        &to,
+        server.resolver.redirect_days,
+    ) {
+        return rename_page(server, repo_name, repo_path, Some(&format!("{:#}", e)));
+    }
+    let user = current_user();
+    tracing::info!(repo = %to, user = ?user, "Repository renamed from {}", repo_name);
+    audit::Entry::new(Action::RepoRename, Via::Web, user.as_deref())
+        .with_repo(&to)
+        .with_target(repo_name)
+        .with_detail(format!("renamed from {}", repo_name))
+        .with_remote(remote_addr())
+        .record(&server.data_dir);
+    Redirect::to(&format!("/repo/{}", url_path(&to))).into_response()
+}
+
+/// Repository deletion: /repo/<name>/settings/delete
+pub fn delete_page(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    error: Option<&str>,
+) -> Response {
+    if !server.may_administer(repo_path) {
+        return forbidden();
+    }
+
+    let mut body = settings_nav(repo_name);
+    body.push_str("<h1>Delete</h1>\n");
+    body.push_str(&error_message(error));
+    body.push_str(&format!(
+        "<p>Deleting the repository removes it for everyone: its code, issues, pull requests and settings. It is kept in the server's trash for a while, and only a server admin can restore it from there. Consider <a href=\"/repo/{0}/settings/archive\">archiving</a> it instead.</p>\n<form method=\"post\" action=\"/repo/{0}/settings/delete\">\n<label>Type <code>{1}</code> to confirm <input type=\"text\" name=\"confirm\" autocomplete=\"off\"></label>\n<button type=\"submit\">Delete this repository</button>\n</form>\n",
+        url_path(repo_name),
+        html_escape(repo_name)
+    ));
+
+    render_page(
+        server,
+        &format!("{} - Delete", repo_name),
+        &breadcrumb(
+            repo_name,
+            &[("Settings".to_string(), None), ("Delete".to_string(), None)],
+        ),
+        &body,
+    )
+}
+
+/// Move the repository to the trash once its name is confirmed, then show
+/// the repository list
+pub fn delete_repo(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    form: &HashMap<String, String>,
+) -> Response {
+    if !server.may_administer(repo_path) {
+        return forbidden();
+    }
+    if form.get("confirm").map(|name| name.trim()) != Some(repo_name) {
+        return delete_page(
+            server,
+            repo_name,
+            repo_path,
+            Some("Type the repository's name to confirm"),
+        );
+    }
+
+    let user = current_user();
+    let deleted = match trash::delete(&server.repos_dir, repo_name, user.as_deref()) {
+        Ok(deleted) => deleted,
+        Err(e) => return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    };
+    tracing::info!(repo = %repo_name, user = ?user, id = %deleted.id, "Repository moved to the trash");
+    audit::Entry::new(Action::RepoDelete, Via::Web, user.as_deref())
+        .with_repo(repo_name)
+        .with_detail(format!("moved to the trash as {}", deleted.id))
+        .with_remote(remote_addr())
+        .record(&server.data_dir);
+    Redirect::to("/").into_response()
+}
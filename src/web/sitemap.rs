@@ -0,0 +1,237 @@
+use super::{embed, html_escape, robots, url_path, Listing, RobotsPolicy, WebServer};
+use crate::visibility::{self, Visibility};
+use crate::{git, jobs};
+use axum::{
+    extract::{Path, State},
+    http::{header, HeaderMap, StatusCode},
+    response::{IntoResponse, Response},
+};
+use std::io;
+use std::path::PathBuf;
+use std::sync::{Arc, RwLock};
+use std::time::Duration;
+
+/// Most URLs a single sitemap may list, per the sitemaps protocol
+const PAGE_SIZE: usize = 50_000;
+
+/// Commits listed per repository, newest first on the default branch
+const RECENT_COMMITS: usize = 20;
+
+/// A page to list, relative to the server's base URL
+#[derive(Clone, Debug)]
+struct Entry {
+    path: String,
+    /// Unix time the page last changed, if known
+    lastmod: Option<i64>,
+}
+
+#[derive(Default)]
+struct Generated {
+    entries: Vec<Entry>,
+    generated_at: i64,
+}
+
+/// Pages of public repositories for search engines, regenerated by a
+/// background job and served as /sitemap.xml
+#[derive(Clone, Default)]
+pub struct Sitemap {
+    generated: Arc<RwLock<Option<Generated>>>,
+}
+
+impl Sitemap {
+    /// List the pages of every listed repository below `repos_dir` and replace the sitemap
+    pub fn refresh(&self, repos_dir: &std::path::Path, listing: &Listing) -> io::Result<()> {
+        let entries = generate(repos_dir, listing)?;
+        tracing::debug!("Sitemap lists {} pages", entries.len());
+        *self.generated.write().unwrap() = Some(Generated {
+            entries,
+            generated_at: chrono::Utc::now().timestamp(),
+        });
+        Ok(())
+    }
+
+    /// Regenerate the sitemap every `interval` in the background
+    pub fn spawn_generator(
+        &self,
+        repos_dir: PathBuf,
+        listing: Listing,
+        interval: Duration,
+    ) -> tokio::task::JoinHandle<()> {
+        let sitemap = self.clone();
+        jobs::spawn_periodic("sitemap", interval, move || {
+            sitemap.refresh(&repos_dir, &listing)?;
+            Ok(())
+        })
+    }
+}
+
+/// Pages of all listed public repositories that allow indexing: the overview, every
+/// directory on the default branch and its recent commits
+fn generate(repos_dir: &std::path::Path, listing: &Listing) -> io::Result<Vec<Entry>> {
+    let mut entries = vec![Entry {
+        path: "/".to_string(),
+        lastmod: None,
+    }];
+    for (name, path) in git::find_repositories(repos_dir)? {
+        // The web viewer only serves top-level repositories
+        if name.contains('/')
+            || !listing.shows(&name)
+            || robots::excluded(&path)
+            || visibility::effective(&path, false) != Visibility::Public
+        {
+            continue;
+        }
+        match repo_entries(&name, &path) {
+            Ok(repo) => entries.extend(repo),
+            Err(e) => tracing::warn!("Failed to list {} for the sitemap: {}", name, e),
+        }
+    }
+    Ok(entries)
+}
+
+fn repo_entries(name: &str, repo_path: &PathBuf) -> io::Result<Vec<Entry>> {
+    let base = format!("/repo/{}", url_path(name));
+    let branch = git::head_branch(repo_path).unwrap_or_else(|| "master".to_string());
+    let commits = git::batch::pool().log(repo_path, &branch, RECENT_COMMITS)?;
+    let head_time = commits.first().map(|commit| commit.committer_time);
+
+    let mut entries = vec![Entry {
+        path: base.clone(),
+        lastmod: head_time,
+    }];
+    if commits.is_empty() {
+        return Ok(entries);
+    }
+
+    let tree = format!("{}/tree/{}", base, url_path(&branch));
+    entries.push(Entry {
+        path: tree.clone(),
+        lastmod: head_time,
+    });
+    let output = git::run(
+        repo_path,
+        &["ls-tree", "-r", "-d", "-z", "--name-only", &branch],
+    )?;
+    if output.status.success() {
+        for dir in output.stdout.split(|&b| b == 0).filter(|d| !d.is_empty()) {
+            entries.push(Entry {
+                path: format!("{}/{}", tree, url_path(&String::from_utf8_lossy(dir))),
+                lastmod: None,
+            });
+        }
+    }
+
+    for commit in &commits {
+        entries.push(Entry {
+            path: format!("{}/commit/{}", base, commit.id),
+            lastmod: Some(commit.committer_time),
+        });
+    }
+    Ok(entries)
+}
+
+/// W3C datetime, as sitemaps expect
+fn w3c_time(timestamp: i64) -> Option<String> {
+    chrono::DateTime::from_timestamp(timestamp, 0)
+        .map(|time| time.format("%Y-%m-%dT%H:%M:%S+00:00").to_string())
+}
+
+fn xml(body: String) -> Response {
+    (
+        [(header::CONTENT_TYPE, "application/xml; charset=utf-8")],
+        body,
+    )
+        .into_response()
+}
+
+/// The sitemap if it is enabled, else a 404 response
+fn sitemap(server: &WebServer) -> Result<&Sitemap, Response> {
+    match &server.sitemap {
+        Some(sitemap) if server.robots == RobotsPolicy::Allow => Ok(sitemap),
+        _ => Err((StatusCode::NOT_FOUND, "Not found").into_response()),
+    }
+}
+
+fn not_generated() -> Response {
+    (
+        StatusCode::SERVICE_UNAVAILABLE,
+        [(header::RETRY_AFTER, "60")],
+        "Sitemap is being generated",
+    )
+        .into_response()
+}
+
+/// GET /sitemap.xml: index of the sitemap pages
+pub async fn index(State(server): State<Arc<WebServer>>, headers: HeaderMap) -> Response {
+    let sitemap = match sitemap(&server) {
+        Ok(sitemap) => sitemap,
+        Err(response) => return response,
+    };
+    let generated = sitemap.generated.read().unwrap();
+    let generated = match generated.as_ref() {
+        Some(generated) => generated,
+        None => return not_generated(),
+    };
+
+    let base = html_escape(&embed::base_url(&server, &headers));
+    let lastmod = w3c_time(generated.generated_at).unwrap_or_default();
+    let pages = generated.entries.len().div_ceil(PAGE_SIZE).max(1);
+    let mut body = String::from(
+        "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n\
+         <sitemapindex xmlns=\"http://www.sitemaps.org/schemas/sitemap/0.9\">\n",
+    );
+    for page in 1..=pages {
+        body.push_str(&format!(
+            "  <sitemap><loc>{}/sitemap/{}.xml</loc><lastmod>{}</lastmod></sitemap>\n",
+            base, page, lastmod
+        ));
+    }
+    body.push_str("</sitemapindex>\n");
+    xml(body)
+}
+
+/// GET /sitemap/<n>.xml: up to 50,000 page URLs, starting at 1
+pub async fn page(
+    State(server): State<Arc<WebServer>>,
+    Path(page): Path<String>,
+    headers: HeaderMap,
+) -> Response {
+    let sitemap = match sitemap(&server) {
+        Ok(sitemap) => sitemap,
+        Err(response) => return response,
+    };
+    let generated = sitemap.generated.read().unwrap();
+    let generated = match generated.as_ref() {
+        Some(generated) => generated,
+        None => return not_generated(),
+    };
+
+    let entries = page
+        .strip_suffix(".xml")
+        .and_then(|n| n.parse::<usize>().ok())
+        .filter(|&n| n > 0)
+        .and_then(|n| generated.entries.chunks(PAGE_SIZE).nth(n - 1));
+    let entries = match entries {
+        Some(entries) => entries,
+        None => return (StatusCode::NOT_FOUND, "Not found").into_response(),
+    };
+
+    let base = html_escape(&embed::base_url(&server, &headers));
+    let mut body = String::from(
+        "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n\
+         <urlset xmlns=\"http://www.sitemaps.org/schemas/sitemap/0.9\">\n",
+    );
+    for entry in entries {
+        body.push_str(&format!(
+            "  <url><loc>{}{}</loc>",
+            base,
+            html_escape(&entry.path)
+        ));
+        if let Some(lastmod) = entry.lastmod.and_then(w3c_time) {
+            body.push_str(&format!("<lastmod>{}</lastmod>", lastmod));
+        }
+        body.push_str("</url>\n");
+    }
+    body.push_str("</urlset>\n");
+    xml(body)
+}
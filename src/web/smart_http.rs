@@ -0,0 +1,456 @@
+//! Git's smart HTTP protocol: clones, fetches and pushes over
+//! `http(s)://<host>/<repo>`, run through `git http-backend`.
+//!
+//! Reading takes what browsing the repository takes, so public repositories
+//! clone anonymously. Pushing takes write access, from a signed-in user: git
+//! sends an access token as the password of basic auth when asked for one.
+
+use super::auth::{current_user, remote_addr};
+use super::WebServer;
+use crate::git::limits::Pool;
+use crate::git::process::{self, Child};
+use crate::orgs::Role;
+use crate::usage::DiskUsage;
+use crate::{archive, maintenance_mode, metrics, mirror, rate_limit, wire};
+use axum::{
+    body::{Body, Bytes},
+    extract::{Path, Query, Request, State},
+    http::{header, HeaderName, HeaderValue, StatusCode},
+    response::{IntoResponse, Response},
+};
+use futures::StreamExt;
+use std::collections::HashMap;
+use std::path::PathBuf;
+use std::process::Stdio;
+use std::sync::Arc;
+use tokio::io::AsyncWriteExt;
+use tokio::process::{ChildStdout, Command};
+use tokio::time::Instant;
+
+/// Longest CGI header `git http-backend` may send before its body
+const MAX_HEADER: usize = 64 * 1024;
+
+#[derive(Clone, Copy, PartialEq)]
+enum Service {
+    Upload,
+    Receive,
+}
+
+impl Service {
+    fn parse(name: &str) -> Option<Self> {
+        match name {
+            "git-upload-pack" => Some(Self::Upload),
+            "git-receive-pack" => Some(Self::Receive),
+            _ => None,
+        }
+    }
+
+    fn name(self) -> &'static str {
+        match self {
+            Self::Upload => "git-upload-pack",
+            Self::Receive => "git-receive-pack",
+        }
+    }
+
+    fn needs(self) -> Role {
+        match self {
+            Self::Upload => Role::Read,
+            Self::Receive => Role::Write,
+        }
+    }
+
+    fn pool(self) -> Pool {
+        match self {
+            Self::Upload => Pool::Upload,
+            Self::Receive => Pool::Receive,
+        }
+    }
+}
+
+/// The repository named by a route's parameters, `/<repo>/...` or
+/// `/<namespace>/<repo>/...`, with or without `.git`
+fn repo_name(params: &[(String, String)]) -> String {
+    params
+        .iter()
+        .map(|(_, value)| value.as_str())
+        .collect::<Vec<_>>()
+        .join("/")
+}
+
+fn unauthorized(message: &str) -> Response {
+    (
+        StatusCode::UNAUTHORIZED,
+        [(header::WWW_AUTHENTICATE, "Basic realm=\"agito\"")],
+        format!("{}\n", message),
+    )
+        .into_response()
+}
+
+/// Find the repository and make sure the user may use `service` on it.
+/// Users who aren't signed in are asked to, so git retries with
+/// credentials for what anonymous users can't see or change.
+fn authorize(
+    server: &WebServer,
+    name: &str,
+    service: Service,
+) -> Result<(String, PathBuf), Response> {
+    let found = server
+        .resolve_repo(name)
+        .or_else(|| server.resolve_repo(&format!("{}.git", name)));
+    let (name, repo_path) = match found {
+        Some(found) => found,
+        None if current_user().is_none() => {
+            return Err(unauthorized("Sign in to access this repository"))
+        }
+        None => return Err((StatusCode::NOT_FOUND, "Repository not found\n").into_response()),
+    };
+    if service.needs() > Role::Read && !server.has_role(&repo_path, service.needs()) {
+        return Err(match current_user() {
+            None => unauthorized("Sign in with an access token to push"),
+            Some(_) => (
+                StatusCode::FORBIDDEN,
+                format!("You need write access to push to {}\n", name),
+            )
+                .into_response(),
+        });
+    }
+
+    if service == Service::Receive {
+        let refusal = if mirror::is_pull_mirror(&repo_path) {
+            Some(format!(
+                "{} is a pull mirror; push to its upstream instead",
+                name
+            ))
+        } else if archive::is_archived(&repo_path) {
+            Some(archive::refusal(&name))
+        } else {
+            maintenance_mode::refusal(&server.data_dir, &name, &repo_path)
+        };
+        if let Some(refusal) = refusal {
+            return Err((StatusCode::FORBIDDEN, format!("{}\n", refusal)).into_response());
+        }
+    }
+    Ok((name, repo_path))
+}
+
+/// GET /<repo>/info/refs?service=<service>: the refs, which start every
+/// clone, fetch and push. Only the smart protocol is spoken.
+pub async fn info_refs(
+    State(server): State<Arc<WebServer>>,
+    Path(params): Path<Vec<(String, String)>>,
+    Query(query): Query<HashMap<String, String>>,
+    req: Request,
+) -> Response {
+    let service = match query.get("service").and_then(|name| Service::parse(name)) {
+        Some(service) => service,
+        None => {
+            return (
+                StatusCode::FORBIDDEN,
+                "Only git's smart HTTP protocol is served; upgrade git\n",
+            )
+                .into_response()
+        }
+    };
+    let (name, repo_path) = match authorize(&server, &repo_name(&params), service) {
+        Ok(found) => found,
+        Err(response) => return response,
+    };
+    // Every clone, fetch and push starts here, so count its protocol here
+    let version = wire::record(
+        "http",
+        req.headers()
+            .get("git-protocol")
+            .and_then(|value| value.to_str().ok()),
+    );
+    tracing::debug!(repo = %name, protocol = version.name(), "{} started", service.name());
+    let path_info = format!("/{}/info/refs", name);
+    backend(&server, service, &name, repo_path, &path_info, req, None).await
+}
+
+/// POST /<repo>/git-upload-pack: send the objects a clone or fetch wants
+pub async fn upload_pack(
+    State(server): State<Arc<WebServer>>,
+    Path(params): Path<Vec<(String, String)>>,
+    req: Request,
+) -> Response {
+    rpc(server, &repo_name(&params), Service::Upload, req).await
+}
+
+/// POST /<repo>/git-receive-pack: take a push
+pub async fn receive_pack(
+    State(server): State<Arc<WebServer>>,
+    Path(params): Path<Vec<(String, String)>>,
+    req: Request,
+) -> Response {
+    rpc(server, &repo_name(&params), Service::Receive, req).await
+}
+
+async fn rpc(server: Arc<WebServer>, name: &str, service: Service, req: Request) -> Response {
+    let (name, repo_path) = match authorize(&server, name, service) {
+        Ok(found) => found,
+        Err(response) => return response,
+    };
+    let peer = remote_addr().unwrap_or_default();
+    let user = current_user();
+
+    // Held until the response is sent, so the clone counts as running until then
+    let clone = match service {
+        Service::Upload => match server.rate_limiter.clone_started(&peer, user.as_deref()) {
+            Ok(guard) => Some(guard),
+            Err(msg) => {
+                return (StatusCode::TOO_MANY_REQUESTS, format!("{}\n", msg)).into_response()
+            }
+        },
+        Service::Receive => match server.rate_limiter.push(&peer, user.as_deref()) {
+            Ok(()) => None,
+            Err(wait) => {
+                return (
+                    StatusCode::TOO_MANY_REQUESTS,
+                    [(
+                        header::RETRY_AFTER,
+                        rate_limit::retry_after(wait).to_string(),
+                    )],
+                    "Too many pushes; slow down\n",
+                )
+                    .into_response()
+            }
+        },
+    };
+    let permit = match server.git_pools.acquire_async(service.pool()).await {
+        Ok(permit) => permit,
+        Err(busy) => {
+            return (
+                StatusCode::SERVICE_UNAVAILABLE,
+                [(header::RETRY_AFTER, "10")],
+                busy.to_string(),
+            )
+                .into_response()
+        }
+    };
+
+    let path_info = format!("/{}/{}", name, service.name());
+    let held: Held = Box::new((clone, permit));
+    backend(
+        &server,
+        service,
+        &name,
+        repo_path,
+        &path_info,
+        req,
+        Some(held),
+    )
+    .await
+}
+
+/// What must live as long as the response: rate limit guards and pool permits
+type Held = Box<dyn Send + 'static>;
+
+/// Run `git http-backend` for the request, streaming the body in and its
+/// output back
+async fn backend(
+    server: &WebServer,
+    service: Service,
+    name: &str,
+    repo_path: PathBuf,
+    path_info: &str,
+    req: Request,
+    held: Option<Held>,
+) -> Response {
+    let (parts, body) = req.into_parts();
+    let header_value = |name: HeaderName| {
+        parts
+            .headers
+            .get(name)
+            .and_then(|value| value.to_str().ok())
+            .unwrap_or("")
+            .to_string()
+    };
+    let user = current_user();
+
+    let mut command = Command::new("git");
+    command
+        .args(["-c", "http.receivepack=true", "http-backend"])
+        .env("GIT_PROJECT_ROOT", &server.repos_dir)
+        .env("GIT_HTTP_EXPORT_ALL", "1")
+        .env("PATH_INFO", path_info)
+        .env("REQUEST_METHOD", parts.method.as_str())
+        .env("QUERY_STRING", parts.uri.query().unwrap_or(""))
+        .env("CONTENT_TYPE", header_value(header::CONTENT_TYPE))
+        .env(
+            "HTTP_CONTENT_ENCODING",
+            header_value(header::CONTENT_ENCODING),
+        )
+        .env(
+            "HTTP_GIT_PROTOCOL",
+            header_value(HeaderName::from_static("git-protocol")),
+        )
+        .env("REMOTE_ADDR", remote_addr().unwrap_or_default())
+        // The quota settings reach the pre-receive hook through the
+        // environment, and the pusher's name the post-receive hook
+        .envs(server.quotas.env())
+        .envs(user.iter().map(|user| ("AGITO_USER", user.clone())))
+        .envs(user.iter().map(|user| ("REMOTE_USER", user.clone())));
+    if let Some(length) = parts.headers.get(header::CONTENT_LENGTH) {
+        command.env("CONTENT_LENGTH", length.to_str().unwrap_or(""));
+    }
+    // Clones build their pack through the cache, and may be partial.
+    // http-backend passes the Git-Protocol header on to git itself.
+    if service == Service::Upload {
+        command.envs(wire::env(None, Some(&server.pack_cache)));
+    }
+    let mut child = match Child::spawn(
+        command
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::null()),
+    ) {
+        Ok(child) => child,
+        Err(e) => return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    };
+    let start = std::time::Instant::now();
+    // A transfer that takes too long is stopped, along with what git started
+    let deadline = server
+        .git_pools
+        .timeout(service.pool())
+        .map(|timeout| Instant::now() + timeout);
+
+    // git reads the request while it writes the response, so feed it alongside
+    let mut stdin = child.stdin.take().unwrap();
+    tokio::spawn(async move {
+        let mut stream = body.into_data_stream();
+        while let Some(Ok(chunk)) = stream.next().await {
+            if stdin.write_all(&chunk).await.is_err() {
+                break;
+            }
+        }
+    });
+
+    let mut stdout = child.stdout.take().unwrap();
+    let (headers, rest) = match read_cgi_header(&mut stdout, deadline).await {
+        Some(header) => header,
+        None => {
+            return (
+                StatusCode::INTERNAL_SERVER_ERROR,
+                "git http-backend failed\n",
+            )
+                .into_response()
+        }
+    };
+    let mut response = Response::builder();
+    for line in headers.lines() {
+        let (key, value) = match line.split_once(':') {
+            Some((key, value)) => (key.trim(), value.trim()),
+            None => continue,
+        };
+        if key.eq_ignore_ascii_case("status") {
+            let code = value.split(' ').next().and_then(|code| code.parse::<u16>().ok());
+            response = response.status(code.unwrap_or(500));
+        } else if let (Ok(key), Ok(value)) =
+            (HeaderName::try_from(key), HeaderValue::from_str(value))
+        {
+            response = response.header(key, value);
+        }
+    }
+
+    // git and the places it holds go when the response ends, or is abandoned
+    let transfer = Transfer {
+        first: Some(Bytes::from(rest)).filter(|rest| !rest.is_empty()),
+        stdout,
+        child: Some(child),
+        held,
+        pushed: (service == Service::Receive).then(|| (name.to_string(), repo_path)),
+        disk_usage: server.disk_usage.clone(),
+        start,
+        deadline,
+    };
+    let stream = futures::stream::unfold(transfer, |mut transfer| async move {
+        if let Some(first) = transfer.first.take() {
+            return Some((Ok(first), transfer));
+        }
+        let mut buf = vec![0u8; 64 * 1024];
+        match process::read(&mut transfer.stdout, &mut buf, transfer.deadline).await {
+            Ok(0) => {
+                transfer.finish().await;
+                None
+            }
+            Ok(n) => {
+                buf.truncate(n);
+                Some((Ok::<_, std::io::Error>(Bytes::from(buf)), transfer))
+            }
+            Err(e) => Some((Err(e), transfer)),
+        }
+    });
+    response
+        .body(Body::from_stream(stream))
+        .unwrap_or_else(|e| (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response())
+}
+
+/// A response on its way from `git http-backend` to the client
+struct Transfer {
+    /// What of the body was read along with the CGI header
+    first: Option<Bytes>,
+    stdout: ChildStdout,
+    child: Option<Child>,
+    held: Option<Held>,
+    /// The repository, for a push
+    pushed: Option<(String, PathBuf)>,
+    disk_usage: DiskUsage,
+    start: std::time::Instant,
+    /// When git is stopped, done or not
+    deadline: Option<Instant>,
+}
+
+impl Transfer {
+    async fn finish(&mut self) {
+        let status = match self.child.take() {
+            Some(mut child) => child.wait().await.ok(),
+            None => None,
+        };
+        metrics::global().git_subprocess("git-http-backend", self.start.elapsed());
+        self.held = None;
+        if let (Some((name, repo_path)), true) = (
+            self.pushed.take(),
+            status.map_or(false, |status| status.success()),
+        ) {
+            // This push goes to the mirrors in the background
+            let usage = self.disk_usage.clone();
+            tokio::task::spawn_blocking(move || {
+                if let Err(e) = usage.refresh_repo(&name, &repo_path) {
+                    tracing::warn!("Failed to measure {} after push: {}", name, e);
+                }
+                mirror::push_all(&repo_path);
+            });
+        }
+    }
+}
+
+/// Read the CGI header ahead of the body, returning it and whatever of the
+/// body came with it
+async fn read_cgi_header(
+    stdout: &mut ChildStdout,
+    deadline: Option<Instant>,
+) -> Option<(String, Vec<u8>)> {
+    let mut buf = Vec::new();
+    let mut chunk = [0u8; 8192];
+    loop {
+        let found = [&b"\r\n\r\n"[..], &b"\n\n"[..]]
+            .iter()
+            .filter_map(|end| {
+                buf.windows(end.len())
+                    .position(|window| window == *end)
+                    .map(|at| (at, at + end.len()))
+            })
+            .min();
+        if let Some((end, body)) = found {
+            let header = String::from_utf8_lossy(&buf[..end]).into_owned();
+            return Some((header, buf.split_off(body)));
+        }
+        if buf.len() > MAX_HEADER {
+            return None;
+        }
+        match process::read(stdout, &mut chunk, deadline).await {
+            Ok(0) | Err(_) => return None,
+            Ok(n) => buf.extend_from_slice(&chunk[..n]),
+        }
+    }
+}
@@ -0,0 +1,180 @@
+use super::auth::current_user;
+use super::{breadcrumb, html_escape, render_page, url_path, WebServer};
+use crate::stars;
+use axum::{
+    extract::{Path, State},
+    http::StatusCode,
+    response::{IntoResponse, Redirect, Response},
+    Json,
+};
+use std::collections::HashMap;
+use std::path::PathBuf;
+use std::sync::Arc;
+
+fn stars_url(repo_name: &str) -> String {
+    format!("/repo/{}/stars", url_path(repo_name))
+}
+
+/// Star button and count for the repository page; the count alone for
+/// visitors who aren't signed in
+pub fn star_button(server: &WebServer, repo_name: &str, repo_path: &PathBuf) -> String {
+    let repo = match server.stored_name(repo_path) {
+        Some(repo) => repo,
+        None => return String::new(),
+    };
+    let count = stars::stargazers(&server.data_dir, &repo)
+        .map(|users| users.len())
+        .unwrap_or(0);
+    let count = format!("<a href=\"{}\">&#9733; {}</a>", stars_url(repo_name), count);
+    match current_user() {
+        Some(user) => {
+            let (action, label) = if stars::is_starred(&server.data_dir, &user, &repo) {
+                ("unstar", "Unstar")
+            } else {
+                ("star", "Star")
+            };
+            format!(
+                "<form method=\"post\" action=\"{}\" style=\"display:inline\"><input type=\"hidden\" name=\"action\" value=\"{}\"><button type=\"submit\">{}</button></form> {}",
+                stars_url(repo_name),
+                action,
+                label,
+                count
+            )
+        }
+        None => count,
+    }
+}
+
+/// Who starred a repository: /repo/<name>/stars
+pub fn stars_page(server: &WebServer, repo_name: &str, repo_path: &PathBuf) -> Response {
+    let users = server
+        .stored_name(repo_path)
+        .and_then(|repo| stars::stargazers(&server.data_dir, &repo).ok())
+        .unwrap_or_default();
+    let mut body = format!(
+        "<h1>Stars</h1>\n<p>{} {} starred {}.</p>\n",
+        users.len(),
+        if users.len() == 1 { "user" } else { "users" },
+        html_escape(repo_name)
+    );
+    if !users.is_empty() {
+        body.push_str("<ul class=\"file-list\">\n");
+        for user in &users {
+            body.push_str(&format!(
+                "<li class=\"file-item\">{}</li>\n",
+                html_escape(user)
+            ));
+        }
+        body.push_str("</ul>\n");
+    }
+    render_page(
+        server,
+        &format!("{} - Stars", repo_name),
+        &breadcrumb(repo_name, &[("Stars".to_string(), None)]),
+        &body,
+    )
+}
+
+/// POST /repo/<name>/stars with action=star or action=unstar
+pub fn save_form(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    form: &HashMap<String, String>,
+) -> Response {
+    let user = match current_user() {
+        Some(user) => user,
+        None => {
+            return Redirect::to(&format!("/login?next=/repo/{}", url_path(repo_name)))
+                .into_response()
+        }
+    };
+    let repo = match server.stored_name(repo_path) {
+        Some(repo) => repo,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    let starred = match form.get("action").map(String::as_str) {
+        Some("star") => true,
+        Some("unstar") => false,
+        _ => return (StatusCode::BAD_REQUEST, "Unknown action").into_response(),
+    };
+    if let Err(e) = stars::set(&server.data_dir, &user, &repo, starred) {
+        return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response();
+    }
+    Redirect::to(&format!("/repo/{}", url_path(repo_name))).into_response()
+}
+
+/// GET /api/v1/repos/<name>/stars: the number of stars and who gave them
+pub async fn api_list(
+    State(server): State<Arc<WebServer>>,
+    Path(repo_name): Path<String>,
+) -> Response {
+    let repo = match server
+        .resolve_repo(&repo_name)
+        .and_then(|(_, repo_path)| server.stored_name(&repo_path))
+    {
+        Some(repo) => repo,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    match stars::stargazers(&server.data_dir, &repo) {
+        Ok(users) => Json(serde_json::json!({
+            "count": users.len(),
+            "stargazers": users,
+        }))
+        .into_response(),
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
+
+/// PUT or DELETE /api/v1/repos/<name>/star: star or unstar as the signed-in
+/// user
+fn api_set(server: &WebServer, repo_name: &str, starred: bool) -> Response {
+    let user = match current_user() {
+        Some(user) => user,
+        None => return (StatusCode::UNAUTHORIZED, "Sign in to star repositories").into_response(),
+    };
+    let repo = match server
+        .resolve_repo(repo_name)
+        .and_then(|(_, repo_path)| server.stored_name(&repo_path))
+    {
+        Some(repo) => repo,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+    match stars::set(&server.data_dir, &user, &repo, starred) {
+        Ok(_) => StatusCode::NO_CONTENT.into_response(),
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
+
+pub async fn api_star(
+    State(server): State<Arc<WebServer>>,
+    Path(repo_name): Path<String>,
+) -> Response {
+    api_set(&server, &repo_name, true)
+}
+
+pub async fn api_unstar(
+    State(server): State<Arc<WebServer>>,
+    Path(repo_name): Path<String>,
+) -> Response {
+    api_set(&server, &repo_name, false)
+}
+
+/// GET /api/v1/starred: repositories the signed-in user starred and may
+/// still read
+pub async fn api_starred(State(server): State<Arc<WebServer>>) -> Response {
+    let user = match current_user() {
+        Some(user) => user,
+        None => return (StatusCode::UNAUTHORIZED, "Sign in first").into_response(),
+    };
+    match stars::starred_by(&server.data_dir, &user) {
+        Ok(repos) => Json(
+            repos
+                .into_iter()
+                .filter(|repo| server.repo_path(repo).is_some())
+                .collect::<Vec<_>>(),
+        )
+        .into_response(),
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
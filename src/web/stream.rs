@@ -0,0 +1,121 @@
+//! Sending git's output to the client as git writes it, so that large
+//! blobs, patches, archives and bundles never have to fit in memory. git is
+//! stopped when the client goes away, or its pool's timeout passes.
+
+use super::WebServer;
+use crate::git::limits::{Permit, Pool};
+use crate::git::process::{self, Child};
+use axum::{
+    body::{Body, Bytes},
+    http::{header, StatusCode},
+    response::{IntoResponse, Response},
+};
+use std::io;
+use std::process::{Command, Stdio};
+use tokio::process::ChildStdout;
+use tokio::time::Instant;
+
+/// Size of the chunks the output is sent in
+const CHUNK_BYTES: usize = 64 * 1024;
+
+/// A running git whose stdout is yet to be sent
+pub struct Output {
+    stdout: ChildStdout,
+    child: Child,
+    permit: Permit,
+    /// Output already read, which goes first
+    head: Vec<u8>,
+    /// When git is stopped, done or not
+    deadline: Option<Instant>,
+}
+
+/// Start `command` with a place in `pool`, answering 503 when the pool is
+/// full
+pub async fn spawn(server: &WebServer, pool: Pool, command: Command) -> Result<Output, Response> {
+    let permit = match server.git_pools.acquire_async(pool).await {
+        Ok(permit) => permit,
+        Err(busy) => {
+            return Err((
+                StatusCode::SERVICE_UNAVAILABLE,
+                [(header::RETRY_AFTER, "10")],
+                busy.to_string(),
+            )
+                .into_response())
+        }
+    };
+    let mut child = match Child::spawn(
+        tokio::process::Command::from(command)
+            .stdin(Stdio::null())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::null()),
+    ) {
+        Ok(child) => child,
+        Err(e) => return Err((StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response()),
+    };
+    let stdout = child.stdout.take().unwrap();
+    Ok(Output {
+        stdout,
+        child,
+        permit,
+        head: Vec::new(),
+        deadline: server
+            .git_pools
+            .timeout(pool)
+            .map(|timeout| Instant::now() + timeout),
+    })
+}
+
+/// `git -C <repo_path> <args>`
+pub fn git(repo_path: &std::path::Path, args: &[&str]) -> Command {
+    let mut command = Command::new("git");
+    command.arg("-C").arg(repo_path).args(args);
+    command
+}
+
+impl Output {
+    /// Read the first `len` bytes, or all there are if fewer, to look at
+    /// before sending them
+    pub async fn peek(&mut self, len: usize) -> io::Result<&[u8]> {
+        while self.head.len() < len {
+            let mut buf = vec![0u8; len - self.head.len()];
+            match process::read(&mut self.stdout, &mut buf, self.deadline).await? {
+                0 => break,
+                n => self.head.extend_from_slice(&buf[..n]),
+            }
+        }
+        Ok(&self.head)
+    }
+
+    /// The output as a response body. git and its place in the pool go
+    /// when the body is sent, or abandoned.
+    pub fn body(self) -> Body {
+        let Output {
+            stdout,
+            child,
+            permit,
+            head,
+            deadline,
+        } = self;
+        let stream = futures::stream::unfold(
+            (stdout, child, permit, head),
+            move |(mut stdout, child, permit, head)| async move {
+                if !head.is_empty() {
+                    return Some((
+                        Ok::<_, io::Error>(Bytes::from(head)),
+                        (stdout, child, permit, Vec::new()),
+                    ));
+                }
+                let mut buf = vec![0u8; CHUNK_BYTES];
+                match process::read(&mut stdout, &mut buf, deadline).await {
+                    Ok(0) => None,
+                    Ok(n) => {
+                        buf.truncate(n);
+                        Some((Ok(Bytes::from(buf)), (stdout, child, permit, Vec::new())))
+                    }
+                    Err(e) => Some((Err(e), (stdout, child, permit, Vec::new()))),
+                }
+            },
+        );
+        Body::from_stream(stream)
+    }
+}
@@ -0,0 +1,298 @@
+use super::auth::current_user;
+use super::settings::error_message;
+use super::{breadcrumb, html_escape, render_page, url_path, WebServer};
+use crate::orgs::Role;
+use crate::subscriptions::{self, Subscription};
+use crate::users;
+use axum::{
+    extract::{Path, State},
+    http::StatusCode,
+    response::{IntoResponse, Redirect, Response},
+    Json,
+};
+use serde::Deserialize;
+use std::collections::HashMap;
+use std::path::PathBuf;
+use std::sync::Arc;
+
+fn subscription_url(repo_name: &str) -> String {
+    format!("/repo/{}/subscription", url_path(repo_name))
+}
+
+/// What the signed-in account is mailed about a repository:
+/// /repo/<name>/subscription
+pub fn subscription_page(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    error: Option<&str>,
+) -> Response {
+    let user = match current_user() {
+        Some(user) => user,
+        None => {
+            return Redirect::to(&format!("/login?next={}", subscription_url(repo_name)))
+                .into_response()
+        }
+    };
+    if !server.has_role(repo_path, Role::Read) {
+        return (StatusCode::NOT_FOUND, "Repository not found").into_response();
+    }
+
+    let mut body = String::from("<h1>Email notifications</h1>\n");
+    body.push_str(&error_message(error));
+    match users::get(&server.data_dir, &user) {
+        None => body.push_str(
+            "<p>You are signed in through the server's proxy and have no account to mail.</p>\n",
+        ),
+        Some(account) => {
+            let subscription = server
+                .stored_name(repo_path)
+                .and_then(|repo| subscriptions::get(&server.data_dir, &user, &repo).ok())
+                .flatten()
+                .unwrap_or_default();
+            let checked = |yes| if yes { " checked" } else { "" };
+            body.push_str(&format!(
+                "<p>Mail goes to {} (<a href=\"/account\">change</a>). You are never mailed about what you did yourself.</p>\n<form method=\"post\" action=\"{}\">\n<label>Pushes to branches, separated by commas<br><input type=\"text\" name=\"branches\" size=\"40\" placeholder=\"main, release/*\" value=\"{}\"></label><br>\n<label><input type=\"checkbox\" name=\"issues\"{}> New issues</label><br>\n<label><input type=\"checkbox\" name=\"pulls\"{}> Pull requests opened, commented on, updated, closed or merged</label><br>\n<button type=\"submit\">Save</button>\n</form>\n",
+                html_escape(&account.email),
+                subscription_url(repo_name),
+                html_escape(&subscription.branches.join(", ")),
+                checked(subscription.issues),
+                checked(subscription.pulls)
+            ));
+        }
+    }
+
+    render_page(
+        server,
+        &format!("{} - Email notifications", repo_name),
+        &breadcrumb(repo_name, &[("Subscription".to_string(), None)]),
+        &body,
+    )
+}
+
+/// Save the subscription form; asking for nothing unsubscribes. The watch
+/// button on the repository page posts `action=watch` or `action=unwatch`
+/// instead, and returns there.
+pub fn save_form(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    form: &HashMap<String, String>,
+) -> Response {
+    let user = match current_user() {
+        Some(user) => user,
+        None => {
+            return Redirect::to(&format!("/login?next={}", subscription_url(repo_name)))
+                .into_response()
+        }
+    };
+    if !server.has_role(repo_path, Role::Read) {
+        return (StatusCode::NOT_FOUND, "Repository not found").into_response();
+    }
+    if users::get(&server.data_dir, &user).is_none() {
+        return subscription_page(
+            server,
+            repo_name,
+            repo_path,
+            Some("Only accounts can subscribe"),
+        );
+    }
+    let repo = match server.stored_name(repo_path) {
+        Some(repo) => repo,
+        None => return (StatusCode::NOT_FOUND, "Repository not found").into_response(),
+    };
+
+    let (subscription, next) = match form.get("action").map(String::as_str) {
+        Some("watch") => (
+            Subscription::everything(&repo),
+            format!("/repo/{}", url_path(repo_name)),
+        ),
+        Some("unwatch") => (
+            Subscription {
+                repo,
+                ..Default::default()
+            },
+            format!("/repo/{}", url_path(repo_name)),
+        ),
+        _ => (
+            Subscription {
+                repo,
+                branches: subscriptions::parse_branches(
+                    form.get("branches").map(String::as_str).unwrap_or(""),
+                ),
+                issues: form.contains_key("issues"),
+                pulls: form.contains_key("pulls"),
+            },
+            subscription_url(repo_name),
+        ),
+    };
+    if let Err(e) = subscriptions::set(&server.data_dir, &user, subscription) {
+        return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response();
+    }
+    Redirect::to(&next).into_response()
+}
+
+/// Watch button for the repository page: watching mails pushes to every
+/// branch, issues and pull requests; anything less is a custom subscription
+pub fn watch_button(server: &WebServer, repo_name: &str, repo_path: &PathBuf) -> String {
+    let user = match current_user() {
+        Some(user) => user,
+        None => return String::new(),
+    };
+    if users::get(&server.data_dir, &user).is_none() {
+        return String::new();
+    }
+    let subscription = server
+        .stored_name(repo_path)
+        .and_then(|repo| subscriptions::get(&server.data_dir, &user, &repo).ok())
+        .flatten()
+        .unwrap_or_default();
+    let (action, label) = if subscription.is_empty() {
+        ("watch", "Watch")
+    } else {
+        ("unwatch", "Unwatch")
+    };
+    format!(
+        "<form method=\"post\" action=\"{}\" style=\"display:inline\"><input type=\"hidden\" name=\"action\" value=\"{}\"><button type=\"submit\">{}</button></form> <a href=\"{}\">{}</a>",
+        subscription_url(repo_name),
+        action,
+        label,
+        subscription_url(repo_name),
+        match (subscription.is_empty(), subscription.is_everything()) {
+            (true, _) => "Email notifications",
+            (false, true) => "Watching everything",
+            (false, false) => "Watching some activity",
+        }
+    )
+}
+
+/// The signed-in user's subscriptions, for the account page
+pub fn account_section(server: &WebServer, user: &str) -> String {
+    let mut section = String::from("<h2>Email notifications</h2>\n");
+    let found = subscriptions::list(&server.data_dir, user).unwrap_or_default();
+    if found.is_empty() {
+        section.push_str(
+            "<p>You are not subscribed to any repository. Subscribe from a repository's page.</p>\n",
+        );
+        return section;
+    }
+    section.push_str("<ul class=\"file-list\">\n");
+    for subscription in found {
+        let mut wants = Vec::new();
+        if !subscription.branches.is_empty() {
+            wants.push(format!(
+                "pushes to {}",
+                html_escape(&subscription.branches.join(", "))
+            ));
+        }
+        if subscription.issues {
+            wants.push("new issues".to_string());
+        }
+        if subscription.pulls {
+            wants.push("pull requests".to_string());
+        }
+        section.push_str(&format!(
+            "<li class=\"file-item\"><a href=\"{}\">{}</a>: {}</li>\n",
+            subscription_url(&subscription.repo),
+            html_escape(&subscription.repo),
+            wants.join(", ")
+        ));
+    }
+    section.push_str("</ul>\n");
+    section
+}
+
+/// The signed-in account and the stored name of a repository it may read,
+/// for the subscription API
+fn api_target(server: &WebServer, repo_name: &str) -> Result<(String, String), Response> {
+    let user = match current_user() {
+        Some(user) if users::get(&server.data_dir, &user).is_some() => user,
+        Some(_) => {
+            return Err((StatusCode::FORBIDDEN, "Only accounts can subscribe").into_response())
+        }
+        None => return Err((StatusCode::UNAUTHORIZED, "Sign in first").into_response()),
+    };
+    server
+        .resolve_repo(repo_name)
+        .and_then(|(_, repo_path)| server.stored_name(&repo_path))
+        .map(|repo| (user, repo))
+        .ok_or_else(|| (StatusCode::NOT_FOUND, "Repository not found").into_response())
+}
+
+/// GET /api/v1/repos/<name>/subscription: what the user is mailed about the
+/// repository; all empty when not watching
+pub async fn api_get(
+    State(server): State<Arc<WebServer>>,
+    Path(repo_name): Path<String>,
+) -> Response {
+    let (user, repo) = match api_target(&server, &repo_name) {
+        Ok(target) => target,
+        Err(response) => return response,
+    };
+    match subscriptions::get(&server.data_dir, &user, &repo) {
+        Ok(subscription) => Json(subscription.unwrap_or(Subscription {
+            repo,
+            ..Default::default()
+        }))
+        .into_response(),
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
+
+#[derive(Deserialize)]
+pub struct WatchRequest {
+    branches: Option<Vec<String>>,
+    issues: Option<bool>,
+    pulls: Option<bool>,
+}
+
+/// PUT /api/v1/repos/<name>/subscription with any of `branches`, `issues`
+/// and `pulls`; an empty object watches everything
+pub async fn api_set(
+    State(server): State<Arc<WebServer>>,
+    Path(repo_name): Path<String>,
+    Json(request): Json<WatchRequest>,
+) -> Response {
+    let (user, repo) = match api_target(&server, &repo_name) {
+        Ok(target) => target,
+        Err(response) => return response,
+    };
+    let subscription = match request {
+        WatchRequest {
+            branches: None,
+            issues: None,
+            pulls: None,
+        } => Subscription::everything(&repo),
+        request => Subscription {
+            repo,
+            branches: subscriptions::parse_branches(
+                &request.branches.unwrap_or_default().join(","),
+            ),
+            issues: request.issues.unwrap_or(false),
+            pulls: request.pulls.unwrap_or(false),
+        },
+    };
+    match subscriptions::set(&server.data_dir, &user, subscription.clone()) {
+        Ok(()) => Json(subscription).into_response(),
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
+
+/// DELETE /api/v1/repos/<name>/subscription: stop watching
+pub async fn api_delete(
+    State(server): State<Arc<WebServer>>,
+    Path(repo_name): Path<String>,
+) -> Response {
+    let (user, repo) = match api_target(&server, &repo_name) {
+        Ok(target) => target,
+        Err(response) => return response,
+    };
+    let unsubscribed = Subscription {
+        repo,
+        ..Default::default()
+    };
+    match subscriptions::set(&server.data_dir, &user, unsubscribed) {
+        Ok(()) => StatusCode::NO_CONTENT.into_response(),
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
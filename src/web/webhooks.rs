@@ -0,0 +1,487 @@
+use super::auth::{current_user, remote_addr};
+use super::settings::{error_message, forbidden, settings_nav};
+use super::{breadcrumb, html_escape, relative_time, render_page, url_path, WebServer};
+use crate::audit::{self, Action, Via};
+use crate::webhooks::{self, Delivery, Event, Webhook};
+use axum::{
+    extract::{Path, Query, State},
+    http::StatusCode,
+    response::{IntoResponse, Redirect, Response},
+    Json,
+};
+use serde::Deserialize;
+use std::collections::HashMap;
+use std::path::PathBuf;
+use std::sync::Arc;
+
+/// Deliveries listed on the webhook settings page and by the API
+const MAX_DELIVERIES: usize = 50;
+
+fn record_change(server: &WebServer, repo_name: &str, user: Option<&str>, change: String) {
+    audit::Entry::new(Action::WebhookChange, Via::Web, user)
+        .with_repo(repo_name)
+        .with_detail(change)
+        .with_remote(remote_addr())
+        .record(&server.data_dir);
+}
+
+fn webhooks_url(repo_name: &str) -> String {
+    format!("/repo/{}/settings/webhooks", url_path(repo_name))
+}
+
+fn events_text(hook: &Webhook) -> String {
+    if hook.events.is_empty() {
+        "all events".to_string()
+    } else {
+        hook.events
+            .iter()
+            .map(|event| event.name())
+            .collect::<Vec<_>>()
+            .join(", ")
+    }
+}
+
+fn delivery_status(delivery: &Delivery) -> String {
+    match delivery.attempts.last() {
+        Some(attempt) => match (attempt.status, &attempt.error) {
+            (Some(status), _) => format!("HTTP {}", status),
+            (None, Some(error)) => error.clone(),
+            (None, None) => "no response".to_string(),
+        },
+        None => "not sent yet".to_string(),
+    }
+}
+
+/// Webhook settings: /repo/<name>/settings/webhooks
+pub fn webhooks_page(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    error: Option<&str>,
+) -> Response {
+    if !server.may_administer(repo_path) {
+        return forbidden();
+    }
+    let hooks = match webhooks::list(repo_path) {
+        Ok(hooks) => hooks,
+        Err(e) => return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    };
+
+    let action = webhooks_url(repo_name);
+    let mut body = settings_nav(repo_name);
+    body.push_str(
+        "<h1>Webhooks</h1>\n<p>Webhooks POST a JSON description of each event to a URL. Failed deliveries are retried with increasing delays.</p>\n",
+    );
+    body.push_str(&error_message(error));
+
+    if hooks.is_empty() {
+        body.push_str("<p>No webhooks.</p>\n");
+    } else {
+        body.push_str("<table>\n<tr><th>URL</th><th>Events</th><th>Signed</th><th></th></tr>\n");
+        for hook in &hooks {
+            body.push_str(&format!(
+                "<tr><td><code>{}</code>{}</td><td>{}</td><td>{}</td><td><form method=\"post\" action=\"{}\"><input type=\"hidden\" name=\"hook\" value=\"{}\"><button type=\"submit\" name=\"action\" value=\"{}\">{}</button> <button type=\"submit\" name=\"action\" value=\"remove\">Remove</button></form></td></tr>\n",
+                html_escape(&hook.url),
+                if hook.active { "" } else { " <small>(paused)</small>" },
+                events_text(hook),
+                if hook.secret.is_some() { "yes" } else { "no" },
+                action,
+                hook.id,
+                if hook.active { "pause" } else { "resume" },
+                if hook.active { "Pause" } else { "Resume" }
+            ));
+        }
+        body.push_str("</table>\n");
+    }
+
+    body.push_str(&format!(
+        "<h2>Add a webhook</h2>\n<form method=\"post\" action=\"{}\">\n<input type=\"hidden\" name=\"action\" value=\"add\">\n<input type=\"url\" name=\"url\" placeholder=\"https://example.com/hook\" size=\"50\" required><br>\n<input type=\"text\" name=\"secret\" placeholder=\"Secret for X-Agito-Signature (optional)\" size=\"50\"><br>\n",
+        action
+    ));
+    for event in Event::ALL {
+        body.push_str(&format!(
+            "<label><input type=\"checkbox\" name=\"event.{0}\"> {0}</label>\n",
+            event.name()
+        ));
+    }
+    body.push_str(
+        "<br><small>No events checked means all of them.</small><br>\n<button type=\"submit\">Add webhook</button>\n</form>\n",
+    );
+
+    match webhooks::deliveries(repo_path, None, MAX_DELIVERIES) {
+        Ok(deliveries) if !deliveries.is_empty() => {
+            body.push_str(
+                "<div class=\"section\"><h2>Recent deliveries</h2>\n<ul class=\"commit-list\">\n",
+            );
+            for delivery in &deliveries {
+                body.push_str(&format!(
+                    "<li class=\"commit-item\"><span class=\"state-{}\">{}</span> <a href=\"{}/deliveries/{}\"><strong>#{}</strong></a> {} to <code>{}</code><br><small>{} &middot; {} attempt{} &middot; {}</small></li>\n",
+                    delivery.state.name(),
+                    delivery.state.name(),
+                    action,
+                    delivery.id,
+                    delivery.id,
+                    delivery.event.name(),
+                    html_escape(&delivery.url),
+                    relative_time(delivery.created),
+                    delivery.attempts.len(),
+                    if delivery.attempts.len() == 1 { "" } else { "s" },
+                    html_escape(&delivery_status(delivery))
+                ));
+            }
+            body.push_str("</ul></div>\n");
+        }
+        Ok(_) => {}
+        Err(e) => tracing::warn!(
+            "Failed to read webhook deliveries of {}: {:#}",
+            repo_name,
+            e
+        ),
+    }
+
+    render_page(
+        server,
+        &format!("{} - Webhooks", repo_name),
+        &breadcrumb(
+            repo_name,
+            &[
+                ("Settings".to_string(), None),
+                ("Webhooks".to_string(), None),
+            ],
+        ),
+        &body,
+    )
+}
+
+/// One delivery with its request and every attempt's response:
+/// /repo/<name>/settings/webhooks/deliveries/<id>
+pub fn delivery_page(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    id: u64,
+) -> Response {
+    if !server.may_administer(repo_path) {
+        return forbidden();
+    }
+    let delivery = match webhooks::get_delivery(repo_path, id) {
+        Ok(Some(delivery)) => delivery,
+        Ok(None) => return (StatusCode::NOT_FOUND, "Delivery not found").into_response(),
+        Err(e) => return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    };
+    let base = webhooks_url(repo_name);
+
+    let mut body = format!(
+        "<h1>Delivery #{}</h1>\n<p><span class=\"state-{}\">{}</span> {} to <code>{}</code> &middot; queued {}{}</p>\n",
+        delivery.id,
+        delivery.state.name(),
+        delivery.state.name(),
+        delivery.event.name(),
+        html_escape(&delivery.url),
+        relative_time(delivery.created),
+        delivery
+            .redelivery_of
+            .map(|of| format!(
+                " &middot; redelivers <a href=\"{}/deliveries/{}\">#{}</a>",
+                base, of, of
+            ))
+            .unwrap_or_default()
+    );
+    if let Some(next) = delivery
+        .next_attempt
+        .filter(|_| !delivery.attempts.is_empty())
+    {
+        body.push_str(&format!(
+            "<p>Retrying {}</p>\n",
+            chrono::DateTime::from_timestamp(next, 0)
+                .map(|time| format!("at {}", time.format("%Y-%m-%d %H:%M:%S UTC")))
+                .unwrap_or_default()
+        ));
+    }
+    body.push_str(&format!(
+        "<form method=\"post\" action=\"{}\"><input type=\"hidden\" name=\"delivery\" value=\"{}\"><button type=\"submit\" name=\"action\" value=\"redeliver\">Redeliver</button></form>\n",
+        base, delivery.id
+    ));
+
+    let headers: String = delivery
+        .request_headers
+        .iter()
+        .map(|(name, value)| format!("{}: {}\n", name, value))
+        .collect();
+    body.push_str(&format!(
+        "<div class=\"section\"><h2>Request</h2>\n<pre class=\"build-log\">POST {}\n{}\n{}</pre></div>\n",
+        html_escape(&delivery.url),
+        html_escape(&headers),
+        html_escape(&serde_json::to_string_pretty(&delivery.payload).unwrap_or_default())
+    ));
+
+    if !delivery.attempts.is_empty() {
+        body.push_str("<div class=\"section\"><h2>Attempts</h2>\n");
+        for (number, attempt) in delivery.attempts.iter().enumerate().rev() {
+            body.push_str(&format!(
+                "<h3><span class=\"state-{}\">{}</span> Attempt {} <small>{} &middot; {} ms</small></h3>\n",
+                if attempt.succeeded() { "delivered" } else { "failed" },
+                match (attempt.status, &attempt.error) {
+                    (Some(status), _) => status.to_string(),
+                    (None, Some(_)) => "error".to_string(),
+                    (None, None) => "-".to_string(),
+                },
+                number + 1,
+                relative_time(attempt.time),
+                attempt.duration_ms
+            ));
+            if let Some(error) = &attempt.error {
+                body.push_str(&format!("<p class=\"error\">{}</p>\n", html_escape(error)));
+            }
+            if !attempt.response_headers.is_empty() {
+                body.push_str(&format!(
+                    "<pre class=\"build-log\">{}\n\n{}</pre>\n",
+                    html_escape(attempt.response_headers.trim_end()),
+                    html_escape(&attempt.response_body)
+                ));
+            }
+        }
+        body.push_str("</div>\n");
+    }
+
+    render_page(
+        server,
+        &format!("{} - Webhook delivery #{}", repo_name, delivery.id),
+        &breadcrumb(
+            repo_name,
+            &[
+                ("Settings".to_string(), None),
+                ("Webhooks".to_string(), Some(base.clone())),
+                (format!("Delivery #{}", delivery.id), None),
+            ],
+        ),
+        &body,
+    )
+}
+
+/// Add, pause, resume or remove a webhook or redeliver a delivery, then
+/// show the settings again
+pub fn save_form(
+    server: &WebServer,
+    repo_name: &str,
+    repo_path: &PathBuf,
+    form: &HashMap<String, String>,
+) -> Response {
+    if !server.may_administer(repo_path) {
+        return forbidden();
+    }
+    let id = |field: &str| form.get(field).and_then(|id| id.parse::<u64>().ok());
+    let base = webhooks_url(repo_name);
+
+    let result = match form.get("action").map(String::as_str) {
+        Some("add") => {
+            let events = Event::ALL
+                .into_iter()
+                .filter(|event| form.contains_key(&format!("event.{}", event.name())))
+                .collect();
+            webhooks::add(
+                repo_path,
+                form.get("url").map(String::as_str).unwrap_or(""),
+                form.get("secret").map(String::as_str),
+                events,
+            )
+            .map(|hook| format!("added webhook {} to {}", hook.id, hook.url))
+        }
+        Some(action @ ("pause" | "resume")) => match id("hook") {
+            Some(hook) => webhooks::update(repo_path, hook, |hook| {
+                hook.active = action == "resume";
+                Ok(())
+            })
+            .map(|hook| format!("{}d webhook {}", action, hook.id)),
+            None => return (StatusCode::BAD_REQUEST, "No webhook given").into_response(),
+        },
+        Some("remove") => match id("hook") {
+            Some(hook) => {
+                webhooks::remove(repo_path, hook).map(|()| format!("removed webhook {}", hook))
+            }
+            None => return (StatusCode::BAD_REQUEST, "No webhook given").into_response(),
+        },
+        Some("redeliver") => match id("delivery") {
+            Some(delivery) => match webhooks::redeliver(repo_path, delivery) {
+                Ok(redelivery) => {
+                    if let Some(user) = current_user() {
+                        tracing::info!(repo = %repo_name, user = %user, "Redelivered webhook delivery {}", delivery);
+                    }
+                    return Redirect::to(&format!("{}/deliveries/{}", base, redelivery.id))
+                        .into_response();
+                }
+                Err(e) => Err(e),
+            },
+            None => return (StatusCode::BAD_REQUEST, "No delivery given").into_response(),
+        },
+        _ => return (StatusCode::BAD_REQUEST, "Unknown action").into_response(),
+    };
+    match result {
+        Ok(change) => {
+            let user = current_user();
+            if let Some(user) = &user {
+                tracing::info!(repo = %repo_name, user = %user, "Webhooks: {}", change);
+            }
+            record_change(server, repo_name, user.as_deref(), change);
+            Redirect::to(&base).into_response()
+        }
+        Err(e) => webhooks_page(server, repo_name, repo_path, Some(&format!("{:#}", e))),
+    }
+}
+
+/// The repository of an API request, if the signed-in user administers it
+fn administered(server: &WebServer, repo_name: &str) -> Result<PathBuf, Response> {
+    let repo_path = match server.resolve_repo(repo_name) {
+        Some((_, path)) => path,
+        None => return Err((StatusCode::NOT_FOUND, "Repository not found").into_response()),
+    };
+    if current_user().is_none() {
+        return Err((StatusCode::UNAUTHORIZED, "Sign in to manage webhooks").into_response());
+    }
+    if !server.may_administer(&repo_path) {
+        return Err(forbidden());
+    }
+    Ok(repo_path)
+}
+
+/// GET /api/v1/repos/<name>/hooks; secrets are masked
+pub async fn api_list(
+    State(server): State<Arc<WebServer>>,
+    Path(repo_name): Path<String>,
+) -> Response {
+    let repo_path = match administered(&server, &repo_name) {
+        Ok(path) => path,
+        Err(response) => return response,
+    };
+    match webhooks::list(&repo_path) {
+        Ok(hooks) => Json(hooks.iter().map(Webhook::redacted).collect::<Vec<_>>()).into_response(),
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
+
+#[derive(Deserialize)]
+pub struct NewWebhook {
+    url: String,
+    #[serde(default)]
+    secret: Option<String>,
+    #[serde(default)]
+    events: Vec<String>,
+}
+
+/// POST /api/v1/repos/<name>/hooks with `{"url": ..., "secret": ...,
+/// "events": [...]}`
+pub async fn api_create(
+    State(server): State<Arc<WebServer>>,
+    Path(repo_name): Path<String>,
+    Json(request): Json<NewWebhook>,
+) -> Response {
+    let repo_path = match administered(&server, &repo_name) {
+        Ok(path) => path,
+        Err(response) => return response,
+    };
+    let events = match request
+        .events
+        .iter()
+        .map(|event| event.parse())
+        .collect::<Result<Vec<Event>, String>>()
+    {
+        Ok(events) => events,
+        Err(e) => return (StatusCode::UNPROCESSABLE_ENTITY, e).into_response(),
+    };
+    match webhooks::add(&repo_path, &request.url, request.secret.as_deref(), events) {
+        Ok(hook) => {
+            let change = format!("added webhook {} to {}", hook.id, hook.url);
+            record_change(&server, &repo_name, current_user().as_deref(), change);
+            (StatusCode::CREATED, Json(hook.redacted())).into_response()
+        }
+        Err(e) => (StatusCode::UNPROCESSABLE_ENTITY, format!("{:#}", e)).into_response(),
+    }
+}
+
+/// DELETE /api/v1/repos/<name>/hooks/<id>
+pub async fn api_delete(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, id)): Path<(String, u64)>,
+) -> Response {
+    let repo_path = match administered(&server, &repo_name) {
+        Ok(path) => path,
+        Err(response) => return response,
+    };
+    match webhooks::get(&repo_path, id) {
+        Ok(Some(_)) => {}
+        Ok(None) => return (StatusCode::NOT_FOUND, "Webhook not found").into_response(),
+        Err(e) => return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+    match webhooks::remove(&repo_path, id) {
+        Ok(()) => {
+            let change = format!("removed webhook {}", id);
+            record_change(&server, &repo_name, current_user().as_deref(), change);
+            StatusCode::NO_CONTENT.into_response()
+        }
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
+
+/// GET /api/v1/repos/<name>/hooks/<id>/deliveries, newest first, at most
+/// `?limit=` (50)
+pub async fn api_deliveries(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, id)): Path<(String, u64)>,
+    Query(query): Query<HashMap<String, String>>,
+) -> Response {
+    let repo_path = match administered(&server, &repo_name) {
+        Ok(path) => path,
+        Err(response) => return response,
+    };
+    let limit = query
+        .get("limit")
+        .and_then(|limit| limit.parse().ok())
+        .unwrap_or(MAX_DELIVERIES);
+    match webhooks::deliveries(&repo_path, Some(id), limit) {
+        Ok(deliveries) => Json(deliveries).into_response(),
+        Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+    }
+}
+
+/// The delivery `id` of hook `hook`
+fn hook_delivery(repo_path: &PathBuf, hook: u64, id: u64) -> Result<Delivery, Response> {
+    match webhooks::get_delivery(repo_path, id) {
+        Ok(Some(delivery)) if delivery.hook == hook => Ok(delivery),
+        Ok(_) => Err((StatusCode::NOT_FOUND, "Delivery not found").into_response()),
+        Err(e) => Err((StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response()),
+    }
+}
+
+/// GET /api/v1/repos/<name>/hooks/<id>/deliveries/<delivery>
+pub async fn api_delivery(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, hook, id)): Path<(String, u64, u64)>,
+) -> Response {
+    let repo_path = match administered(&server, &repo_name) {
+        Ok(path) => path,
+        Err(response) => return response,
+    };
+    match hook_delivery(&repo_path, hook, id) {
+        Ok(delivery) => Json(delivery).into_response(),
+        Err(response) => response,
+    }
+}
+
+/// POST /api/v1/repos/<name>/hooks/<id>/deliveries/<delivery>/redeliver:
+/// queue the same payload again
+pub async fn api_redeliver(
+    State(server): State<Arc<WebServer>>,
+    Path((repo_name, hook, id)): Path<(String, u64, u64)>,
+) -> Response {
+    let repo_path = match administered(&server, &repo_name) {
+        Ok(path) => path,
+        Err(response) => return response,
+    };
+    if let Err(response) = hook_delivery(&repo_path, hook, id) {
+        return response;
+    }
+    match webhooks::redeliver(&repo_path, id) {
+        Ok(delivery) => (StatusCode::CREATED, Json(delivery)).into_response(),
+        Err(e) => (StatusCode::UNPROCESSABLE_ENTITY, format!("{:#}", e)).into_response(),
+    }
+}
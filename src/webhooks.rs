@@ -0,0 +1,651 @@
+//! Webhooks: JSON POSTs to other services when something happens in a
+//! repository.
+//!
+//! Hooks are configured per repository in `agito/webhooks/hooks.json`. Each
+//! event a hook wants becomes a delivery, `agito/webhooks/deliveries/<id>.json`,
+//! queued by a marker in `agito/webhooks/queue/`. The server sends queued
+//! deliveries in the background and retries failures with exponential
+//! backoff, recording every attempt's response; deliveries expire with the
+//! webhook delivery retention.
+//!
+//! Requests carry `X-Agito-Event`, `X-Agito-Delivery` and, for hooks with a
+//! secret, `X-Agito-Signature: sha256=<hex>`, the HMAC-SHA256 of the body
+//! keyed with the secret.
+
+use crate::{git, jobs};
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use serde_json::{json, Value};
+use sha2::{Digest, Sha256};
+use std::fs;
+use std::io::{self, Write};
+use std::path::{Path, PathBuf};
+use std::process::{Command, Stdio};
+use std::str::FromStr;
+use std::time::{Duration, Instant};
+
+/// Attempts per delivery before it is given up
+pub const MAX_ATTEMPTS: usize = 8;
+
+/// Wait before the first retry; doubles with every further one
+const FIRST_RETRY: i64 = 15;
+
+/// Bytes of each response body kept in the delivery log
+const MAX_RESPONSE_BODY: usize = 64 * 1024;
+
+/// What a hook can be told about
+#[derive(Clone, Copy, Debug, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Event {
+    /// A branch or tag created, moved or deleted
+    Push,
+    Issues,
+    PullRequest,
+    /// A CI build finished
+    Build,
+}
+
+impl FromStr for Event {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "push" => Ok(Self::Push),
+            "issues" => Ok(Self::Issues),
+            "pull_request" => Ok(Self::PullRequest),
+            "build" => Ok(Self::Build),
+            _ => Err(format!(
+                "unknown webhook event '{}' (expected push, issues, pull_request or build)",
+                s
+            )),
+        }
+    }
+}
+
+impl Event {
+    pub const ALL: [Event; 4] = [Event::Push, Event::Issues, Event::PullRequest, Event::Build];
+
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::Push => "push",
+            Self::Issues => "issues",
+            Self::PullRequest => "pull_request",
+            Self::Build => "build",
+        }
+    }
+}
+
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Webhook {
+    pub id: u64,
+    pub url: String,
+    /// Key of the X-Agito-Signature HMAC
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub secret: Option<String>,
+    /// Events the hook wants; all of them if empty
+    #[serde(default)]
+    pub events: Vec<Event>,
+    #[serde(default = "active_default")]
+    pub active: bool,
+    /// Unix time
+    pub created: i64,
+}
+
+fn active_default() -> bool {
+    true
+}
+
+impl Webhook {
+    pub fn wants(&self, event: Event) -> bool {
+        self.active && (self.events.is_empty() || self.events.contains(&event))
+    }
+
+    /// The hook as shown to users: the secret stays on the server
+    pub fn redacted(&self) -> Self {
+        Self {
+            secret: self.secret.as_ref().map(|_| "********".to_string()),
+            ..self.clone()
+        }
+    }
+}
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum State {
+    /// Queued, or waiting for its next retry
+    Pending,
+    Delivered,
+    /// Every attempt failed
+    Failed,
+}
+
+impl State {
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::Pending => "pending",
+            Self::Delivered => "delivered",
+            Self::Failed => "failed",
+        }
+    }
+}
+
+/// One try at sending a delivery
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Attempt {
+    /// Unix time
+    pub time: i64,
+    /// HTTP status of the response, if there was one
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub status: Option<u16>,
+    /// Why no response arrived, e.g. a timeout
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub error: Option<String>,
+    /// Response status line and headers
+    #[serde(default)]
+    pub response_headers: String,
+    /// Start of the response body
+    #[serde(default)]
+    pub response_body: String,
+    pub duration_ms: u64,
+}
+
+impl Attempt {
+    pub fn succeeded(&self) -> bool {
+        self.status
+            .map_or(false, |status| (200..300).contains(&status))
+    }
+}
+
+#[derive(Clone, Debug, PartialEq, Serialize, Deserialize)]
+pub struct Delivery {
+    pub id: u64,
+    /// ID of the hook delivered to
+    pub hook: u64,
+    pub url: String,
+    pub event: Event,
+    /// Request body; the repository is filled in when it is first sent
+    pub payload: Value,
+    /// Headers of the request as last sent
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub request_headers: Vec<(String, String)>,
+    pub state: State,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub attempts: Vec<Attempt>,
+    /// Unix time of the next try, while pending
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub next_attempt: Option<i64>,
+    /// Unix time
+    pub created: i64,
+    /// The delivery this one sends again
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub redelivery_of: Option<u64>,
+}
+
+fn webhooks_dir(repo_path: &Path) -> PathBuf {
+    git::data_dir(repo_path).join("webhooks")
+}
+
+fn hooks_path(repo_path: &Path) -> PathBuf {
+    webhooks_dir(repo_path).join("hooks.json")
+}
+
+fn deliveries_dir(repo_path: &Path) -> PathBuf {
+    webhooks_dir(repo_path).join("deliveries")
+}
+
+fn delivery_path(repo_path: &Path, id: u64) -> PathBuf {
+    deliveries_dir(repo_path).join(format!("{}.json", id))
+}
+
+fn queue_dir(repo_path: &Path) -> PathBuf {
+    webhooks_dir(repo_path).join("queue")
+}
+
+/// Hooks configured on a repository
+pub fn list(repo_path: &Path) -> Result<Vec<Webhook>> {
+    let path = hooks_path(repo_path);
+    match fs::read_to_string(&path) {
+        Ok(content) => serde_json::from_str(&content)
+            .with_context(|| format!("Failed to parse {}", path.display())),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(Vec::new()),
+        Err(e) => Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    }
+}
+
+pub fn get(repo_path: &Path, id: u64) -> Result<Option<Webhook>> {
+    Ok(list(repo_path)?.into_iter().find(|hook| hook.id == id))
+}
+
+fn save_hooks(repo_path: &Path, hooks: &[Webhook]) -> Result<()> {
+    let path = hooks_path(repo_path);
+    fs::create_dir_all(webhooks_dir(repo_path))?;
+    let tmp = path.with_extension("json.tmp");
+    fs::write(&tmp, serde_json::to_string_pretty(hooks)?)?;
+    fs::rename(&tmp, &path)?;
+    Ok(())
+}
+
+/// Check a hook URL: http or https, with a host
+pub fn valid_url(url: &str) -> Result<String> {
+    let url = url.trim();
+    let rest = url
+        .strip_prefix("https://")
+        .or_else(|| url.strip_prefix("http://"))
+        .context("Webhook URLs start with http:// or https://")?;
+    if rest.is_empty() || rest.starts_with('/') || url.chars().any(char::is_whitespace) {
+        anyhow::bail!("Invalid webhook URL: {}", url);
+    }
+    Ok(url.to_string())
+}
+
+/// Add a hook
+pub fn add(
+    repo_path: &Path,
+    url: &str,
+    secret: Option<&str>,
+    events: Vec<Event>,
+) -> Result<Webhook> {
+    let mut hooks = list(repo_path)?;
+    let hook = Webhook {
+        id: hooks.iter().map(|hook| hook.id).max().unwrap_or(0) + 1,
+        url: valid_url(url)?,
+        secret: secret
+            .map(str::trim)
+            .filter(|s| !s.is_empty())
+            .map(str::to_string),
+        events,
+        active: true,
+        created: chrono::Utc::now().timestamp(),
+    };
+    hooks.push(hook.clone());
+    save_hooks(repo_path, &hooks)?;
+    Ok(hook)
+}
+
+/// Change a hook and save it, returning the result
+pub fn update(
+    repo_path: &Path,
+    id: u64,
+    change: impl FnOnce(&mut Webhook) -> Result<()>,
+) -> Result<Webhook> {
+    let mut hooks = list(repo_path)?;
+    let hook = hooks
+        .iter_mut()
+        .find(|hook| hook.id == id)
+        .with_context(|| format!("No such webhook: {}", id))?;
+    change(hook)?;
+    hook.url = valid_url(&hook.url)?;
+    let hook = hook.clone();
+    save_hooks(repo_path, &hooks)?;
+    Ok(hook)
+}
+
+pub fn remove(repo_path: &Path, id: u64) -> Result<()> {
+    let mut hooks = list(repo_path)?;
+    let before = hooks.len();
+    hooks.retain(|hook| hook.id != id);
+    if hooks.len() == before {
+        anyhow::bail!("No such webhook: {}", id);
+    }
+    save_hooks(repo_path, &hooks)
+}
+
+/// Queue a delivery of the payload to every hook that wants `event`; the
+/// payload is only built if one does. Failures are logged: a broken hook must
+/// not get in the way of what triggered it.
+pub fn trigger(repo_path: &Path, event: Event, payload: impl FnOnce() -> Value) {
+    let hooks = match list(repo_path) {
+        Ok(hooks) => hooks,
+        Err(e) => {
+            tracing::warn!("Failed to read webhooks: {:#}", e);
+            return;
+        }
+    };
+    let hooks: Vec<&Webhook> = hooks.iter().filter(|hook| hook.wants(event)).collect();
+    if hooks.is_empty() {
+        return;
+    }
+    let payload = payload();
+    for hook in hooks {
+        if let Err(e) = create(repo_path, hook, event, payload.clone(), None) {
+            tracing::warn!("Failed to queue a {} webhook: {:#}", event.name(), e);
+        }
+    }
+}
+
+/// Queue another delivery of the same payload to the same hook
+pub fn redeliver(repo_path: &Path, id: u64) -> Result<Delivery> {
+    let delivery =
+        get_delivery(repo_path, id)?.with_context(|| format!("No such delivery: {}", id))?;
+    let hook = get(repo_path, delivery.hook)?
+        .with_context(|| format!("Webhook {} was removed", delivery.hook))?;
+    create(
+        repo_path,
+        &hook,
+        delivery.event,
+        delivery.payload,
+        Some(delivery.id),
+    )
+}
+
+fn create(
+    repo_path: &Path,
+    hook: &Webhook,
+    event: Event,
+    payload: Value,
+    redelivery_of: Option<u64>,
+) -> Result<Delivery> {
+    let now = chrono::Utc::now().timestamp();
+    let mut delivery = Delivery {
+        id: 0,
+        hook: hook.id,
+        url: hook.url.clone(),
+        event,
+        payload,
+        request_headers: Vec::new(),
+        state: State::Pending,
+        attempts: Vec::new(),
+        next_attempt: Some(now),
+        created: now,
+        redelivery_of,
+    };
+
+    let dir = deliveries_dir(repo_path);
+    fs::create_dir_all(&dir)?;
+    let mut id = ids(&dir, ".json")?.last().copied().unwrap_or(0) + 1;
+    // Claim the id by creating its file, so concurrent events can't get the
+    // same one
+    loop {
+        match fs::OpenOptions::new()
+            .write(true)
+            .create_new(true)
+            .open(delivery_path(repo_path, id))
+        {
+            Ok(_) => break,
+            Err(e) if e.kind() == io::ErrorKind::AlreadyExists => id += 1,
+            Err(e) => return Err(e).context("Failed to queue the delivery"),
+        }
+    }
+    delivery.id = id;
+    save_delivery(repo_path, &delivery)?;
+    fs::create_dir_all(queue_dir(repo_path))?;
+    fs::write(queue_dir(repo_path).join(id.to_string()), "")?;
+    Ok(delivery)
+}
+
+/// IDs of the files named `<id><suffix>` in a directory, in order
+fn ids(dir: &Path, suffix: &str) -> Result<Vec<u64>> {
+    let entries = match fs::read_dir(dir) {
+        Ok(entries) => entries,
+        Err(e) if e.kind() == io::ErrorKind::NotFound => return Ok(Vec::new()),
+        Err(e) => return Err(e).with_context(|| format!("Failed to read {}", dir.display())),
+    };
+    let mut ids: Vec<u64> = entries
+        .filter_map(|entry| {
+            entry
+                .ok()?
+                .file_name()
+                .to_str()?
+                .strip_suffix(suffix)?
+                .parse()
+                .ok()
+        })
+        .collect();
+    ids.sort_unstable();
+    Ok(ids)
+}
+
+/// Deliveries of a repository, newest first; only those to one hook if given
+pub fn deliveries(repo_path: &Path, hook: Option<u64>, limit: usize) -> Result<Vec<Delivery>> {
+    let mut found = Vec::new();
+    for id in ids(&deliveries_dir(repo_path), ".json")?.into_iter().rev() {
+        if found.len() >= limit {
+            break;
+        }
+        if let Some(delivery) = get_delivery(repo_path, id)? {
+            if hook.map_or(true, |hook| delivery.hook == hook) {
+                found.push(delivery);
+            }
+        }
+    }
+    Ok(found)
+}
+
+pub fn get_delivery(repo_path: &Path, id: u64) -> Result<Option<Delivery>> {
+    let path = delivery_path(repo_path, id);
+    match fs::read_to_string(&path) {
+        // Just claimed by create() and not written yet
+        Ok(content) if content.is_empty() => Ok(None),
+        Ok(content) => serde_json::from_str(&content)
+            .map(Some)
+            .with_context(|| format!("Failed to parse {}", path.display())),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(None),
+        Err(e) => Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    }
+}
+
+fn save_delivery(repo_path: &Path, delivery: &Delivery) -> Result<()> {
+    let path = delivery_path(repo_path, delivery.id);
+    let tmp = path.with_extension("json.tmp");
+    fs::write(&tmp, serde_json::to_string_pretty(delivery)?)?;
+    fs::rename(&tmp, &path)?;
+    Ok(())
+}
+
+/// HMAC-SHA256 of `message` keyed with `key` (RFC 2104)
+fn hmac_sha256(key: &[u8], message: &[u8]) -> [u8; 32] {
+    const BLOCK: usize = 64;
+    let mut block = [0u8; BLOCK];
+    if key.len() > BLOCK {
+        block[..32].copy_from_slice(&Sha256::digest(key));
+    } else {
+        block[..key.len()].copy_from_slice(key);
+    }
+    let pad = |byte: u8| block.map(|b| b ^ byte);
+    let inner = Sha256::new()
+        .chain_update(pad(0x36))
+        .chain_update(message)
+        .finalize();
+    Sha256::new()
+        .chain_update(pad(0x5c))
+        .chain_update(inner)
+        .finalize()
+        .into()
+}
+
+/// Value of the X-Agito-Signature header for a body
+pub fn signature(secret: &str, body: &[u8]) -> String {
+    let mac = hmac_sha256(secret.as_bytes(), body);
+    let hex: String = mac.iter().map(|b| format!("{:02x}", b)).collect();
+    format!("sha256={}", hex)
+}
+
+/// Sends deliveries over HTTP with curl
+#[derive(Clone, Debug)]
+pub struct Sender {
+    /// Path of the curl binary
+    pub curl: PathBuf,
+    /// URL of the web interface, for links in payloads
+    pub public_url: String,
+    /// Longest a hook may take to respond
+    pub timeout: Duration,
+}
+
+impl Sender {
+    /// Send the queued deliveries of every repository that are due
+    pub fn deliver_due(&self, repos_dir: &Path, now: i64) -> Result<usize> {
+        let mut sent = 0;
+        for (name, repo_path) in git::find_repositories(repos_dir)? {
+            for id in ids(&queue_dir(&repo_path), "")? {
+                let marker = queue_dir(&repo_path).join(id.to_string());
+                let Some(mut delivery) = get_delivery(&repo_path, id)? else {
+                    // Expired by retention
+                    let _ = fs::remove_file(&marker);
+                    continue;
+                };
+                if delivery.state != State::Pending
+                    || delivery.next_attempt.map_or(false, |next| next > now)
+                {
+                    continue;
+                }
+                self.attempt(&name, &repo_path, &mut delivery);
+                save_delivery(&repo_path, &delivery)?;
+                if delivery.state != State::Pending {
+                    let _ = fs::remove_file(&marker);
+                }
+                sent += 1;
+            }
+        }
+        Ok(sent)
+    }
+
+    /// Try a delivery once and schedule the next try if it failed
+    fn attempt(&self, repo_name: &str, repo_path: &Path, delivery: &mut Delivery) {
+        let now = chrono::Utc::now().timestamp();
+        let hook = match get(repo_path, delivery.hook) {
+            Ok(Some(hook)) => hook,
+            Ok(None) => {
+                delivery.attempts.push(Attempt {
+                    time: now,
+                    status: None,
+                    error: Some("The webhook was removed".to_string()),
+                    response_headers: String::new(),
+                    response_body: String::new(),
+                    duration_ms: 0,
+                });
+                delivery.state = State::Failed;
+                delivery.next_attempt = None;
+                return;
+            }
+            Err(e) => {
+                tracing::warn!(repo = %repo_name, "Failed to read webhooks: {:#}", e);
+                return;
+            }
+        };
+
+        if let Value::Object(payload) = &mut delivery.payload {
+            payload.entry("repository").or_insert_with(|| {
+                json!({
+                    "name": repo_name,
+                    "url": format!("{}/repo/{}", self.public_url.trim_end_matches('/'), repo_name),
+                })
+            });
+        }
+        let body = serde_json::to_vec(&delivery.payload).unwrap_or_default();
+        let mut headers = vec![
+            ("Content-Type".to_string(), "application/json".to_string()),
+            ("User-Agent".to_string(), "agito-webhook".to_string()),
+            (
+                "X-Agito-Event".to_string(),
+                delivery.event.name().to_string(),
+            ),
+            ("X-Agito-Delivery".to_string(), delivery.id.to_string()),
+        ];
+        if let Some(secret) = &hook.secret {
+            headers.push(("X-Agito-Signature".to_string(), signature(secret, &body)));
+        }
+        delivery.url = hook.url.clone();
+        delivery.request_headers = headers;
+
+        let attempt = self.post(&hook.url, &delivery.request_headers, &body);
+        tracing::info!(
+            repo = %repo_name,
+            status = attempt.status,
+            "Webhook delivery {} to {}",
+            delivery.id,
+            hook.url
+        );
+        let succeeded = attempt.succeeded();
+        delivery.attempts.push(attempt);
+        if succeeded {
+            delivery.state = State::Delivered;
+            delivery.next_attempt = None;
+        } else if delivery.attempts.len() >= MAX_ATTEMPTS {
+            delivery.state = State::Failed;
+            delivery.next_attempt = None;
+        } else {
+            let retries = delivery.attempts.len() as u32 - 1;
+            delivery.next_attempt = Some(now + FIRST_RETRY * 2i64.pow(retries));
+        }
+    }
+
+    fn post(&self, url: &str, headers: &[(String, String)], body: &[u8]) -> Attempt {
+        let time = chrono::Utc::now().timestamp();
+        let start = Instant::now();
+        let failed = |error: String| Attempt {
+            time,
+            status: None,
+            error: Some(error),
+            response_headers: String::new(),
+            response_body: String::new(),
+            duration_ms: start.elapsed().as_millis() as u64,
+        };
+
+        let mut command = Command::new(&self.curl);
+        command
+            .args(["--silent", "--show-error", "--include", "--request", "POST"])
+            .args(["--proto", "=http,https", "--max-time"])
+            .arg(self.timeout.as_secs().max(1).to_string())
+            .args(["--data-binary", "@-", "--write-out", "\n%{http_code}"]);
+        for (name, value) in headers {
+            command.arg("--header").arg(format!("{}: {}", name, value));
+        }
+        let child = command
+            .arg("--")
+            .arg(url)
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::piped())
+            .spawn();
+        let mut child = match child {
+            Ok(child) => child,
+            Err(e) => return failed(format!("Failed to run {}: {}", self.curl.display(), e)),
+        };
+        if let Some(mut stdin) = child.stdin.take() {
+            let _ = stdin.write_all(body);
+        }
+        let output = match child.wait_with_output() {
+            Ok(output) => output,
+            Err(e) => return failed(e.to_string()),
+        };
+        if !output.status.success() {
+            return failed(String::from_utf8_lossy(&output.stderr).trim().to_string());
+        }
+
+        // Headers, a blank line and the body, then the status from --write-out
+        let stdout = String::from_utf8_lossy(&output.stdout);
+        let (response, status) = stdout.rsplit_once('\n').unwrap_or(("", &stdout));
+        let (headers, body) = response.split_once("\r\n\r\n").unwrap_or((response, ""));
+        let mut body = body.to_string();
+        if body.len() > MAX_RESPONSE_BODY {
+            let mut end = MAX_RESPONSE_BODY;
+            while !body.is_char_boundary(end) {
+                end -= 1;
+            }
+            body.truncate(end);
+        }
+        Attempt {
+            time,
+            status: status.trim().parse().ok().filter(|&status| status != 0),
+            error: None,
+            response_headers: headers.to_string(),
+            response_body: body,
+            duration_ms: start.elapsed().as_millis() as u64,
+        }
+    }
+}
+
+/// Send due deliveries every `interval` in the background
+pub fn spawn(
+    repos_dir: PathBuf,
+    sender: Sender,
+    interval: Duration,
+) -> tokio::task::JoinHandle<()> {
+    jobs::spawn_periodic("webhooks", interval, move || {
+        let sent = sender.deliver_due(&repos_dir, chrono::Utc::now().timestamp())?;
+        if sent > 0 {
+            tracing::debug!("Sent {} webhook deliveries", sent);
+        }
+        Ok(())
+    })
+}
@@ -0,0 +1,99 @@
+//! Git's wire protocol.
+//!
+//! Clients ask for a protocol version through `GIT_PROTOCOL`: over SSH as an
+//! environment variable, which git sends itself with OpenSSH's `SendEnv`;
+//! over HTTP as the `Git-Protocol` header; over git:// after the request's
+//! host. Passed on to git, it answers in version 2 when asked, which lets
+//! clients list only the refs they need. Clones may also be partial
+//! (`git clone --filter=blob:none`) and fetch refs by name.
+
+use crate::metrics;
+use crate::pack_cache::PackCache;
+
+/// What git-upload-pack offers on top of its defaults: filtering the
+/// objects sent, for partial clones, and `want-ref`, for fetching refs by
+/// name in version 2
+const UPLOAD_CONFIG: &[(&str, &str)] = &[
+    ("uploadpack.allowFilter", "true"),
+    ("uploadpack.allowRefInWant", "true"),
+];
+
+/// Longest `GIT_PROTOCOL` value passed on to git
+const MAX_VALUE_BYTES: usize = 256;
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq, PartialOrd, Ord)]
+pub enum Version {
+    V0,
+    V1,
+    V2,
+}
+
+impl Version {
+    /// The highest version a `GIT_PROTOCOL` value asks for, such as
+    /// `version=2`; entries are separated by colons
+    pub fn requested(git_protocol: Option<&str>) -> Self {
+        git_protocol
+            .unwrap_or_default()
+            .split(':')
+            .filter_map(|entry| match entry.strip_prefix("version=")? {
+                "0" => Some(Self::V0),
+                "1" => Some(Self::V1),
+                "2" => Some(Self::V2),
+                _ => None,
+            })
+            .max()
+            .unwrap_or(Self::V0)
+    }
+
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::V0 => "v0",
+            Self::V1 => "v1",
+            Self::V2 => "v2",
+        }
+    }
+}
+
+/// Environment for git serving a client: the `GIT_PROTOCOL` it sent, and
+/// for clones and fetches, what [`UPLOAD_CONFIG`] and the pack cache set.
+/// The settings are read like `git -c`, which git-upload-pack doesn't take.
+pub fn env(git_protocol: Option<&str>, upload: Option<&PackCache>) -> Vec<(String, String)> {
+    let mut env = Vec::new();
+    if let Some(value) = git_protocol.filter(|value| valid(value)) {
+        env.push(("GIT_PROTOCOL".to_string(), value.to_string()));
+    }
+    if let Some(pack_cache) = upload {
+        let mut config: Vec<(&str, String)> = UPLOAD_CONFIG
+            .iter()
+            .map(|(key, value)| (*key, value.to_string()))
+            .collect();
+        config.extend(pack_cache.config());
+        env.push(("GIT_CONFIG_COUNT".to_string(), config.len().to_string()));
+        for (i, (key, value)) in config.into_iter().enumerate() {
+            env.push((format!("GIT_CONFIG_KEY_{}", i), key.to_string()));
+            env.push((format!("GIT_CONFIG_VALUE_{}", i), value));
+        }
+        env.extend(
+            pack_cache
+                .env()
+                .into_iter()
+                .map(|(key, value)| (key.to_string(), value)),
+        );
+    }
+    env
+}
+
+/// Count the version a client asked for in /metrics, by transport (`ssh`,
+/// `http` or `git`), and return it for the logs
+pub fn record(transport: &str, git_protocol: Option<&str>) -> Version {
+    let version = Version::requested(git_protocol);
+    metrics::global().git_protocol(transport, version.name());
+    version
+}
+
+/// Whether a `GIT_PROTOCOL` value is fit to pass on to git
+fn valid(value: &str) -> bool {
+    !value.is_empty()
+        && value.len() <= MAX_VALUE_BYTES
+        && value.bytes().all(|byte| byte.is_ascii_graphic())
+}